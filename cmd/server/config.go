@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix starts the environment variables overriding settings. The rest
+// of the name is the flag's in upper case, e.g. FAKE_BATCH_SIM_RUNNING_DURATION
+// for --sim-running-duration.
+const envPrefix = "FAKE_BATCH_"
+
+// envName returns the environment variable overriding flag name.
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// loadConfig sets the flags not given on the command line from their
+// environment variable or else from the YAML/JSON config file at path, if
+// any. The file is keyed by flag name; nested keys are joined with dashes, so
+// {"sim": {"running-duration": "2s"}} sets --sim-running-duration.
+func loadConfig(flags *pflag.FlagSet, path string) error {
+	settings := make(map[string]string)
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var raw map[string]interface{}
+		if err := yaml.Unmarshal(data, &raw); err != nil {
+			return fmt.Errorf("failed to parse config file %s: %v", path, err)
+		}
+		flattenConfig("", raw, settings)
+
+		names := make([]string, 0, len(settings))
+		for name := range settings {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if name == "config" || flags.Lookup(name) == nil {
+				return fmt.Errorf("invalid config file %s: unknown setting %q", path, name)
+			}
+		}
+	}
+
+	var err error
+	flags.VisitAll(func(flag *pflag.Flag) {
+		if err != nil || flag.Changed || flag.Name == "config" {
+			return
+		}
+		source := envName(flag.Name)
+		value, ok := os.LookupEnv(source)
+		if !ok {
+			source = path
+			if value, ok = settings[flag.Name]; !ok {
+				return
+			}
+		}
+		if setErr := flags.Set(flag.Name, value); setErr != nil {
+			err = fmt.Errorf("invalid %s from %s: %v", flag.Name, source, setErr)
+		}
+	})
+	return err
+}
+
+// flattenConfig adds the settings of a config file section to settings,
+// naming them by their dash-joined keys. Lists become comma-separated values.
+func flattenConfig(prefix string, section map[string]interface{}, settings map[string]string) {
+	for key, value := range section {
+		name := strings.ReplaceAll(key, "_", "-")
+		if prefix != "" {
+			name = prefix + "-" + name
+		}
+		switch value := value.(type) {
+		case map[string]interface{}:
+			flattenConfig(name, value, settings)
+		case []interface{}:
+			items := make([]string, len(value))
+			for i, item := range value {
+				items[i] = fmt.Sprint(item)
+			}
+			settings[name] = strings.Join(items, ",")
+		case nil:
+			settings[name] = ""
+		default:
+			settings[name] = fmt.Sprint(value)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/pyshx/fake-batch-server/pkg/snapshot"
+)
+
+var diffFormat string
+
+var diffCmd = &cobra.Command{
+	Use:   "diff SNAPSHOT_A SNAPSHOT_B",
+	Short: "Report jobs created, transitioned and deleted between two snapshots",
+	Long:  `Compare two snapshots saved from GET /admin/snapshot and report which jobs were created, changed state (including their tasks) or were deleted in between.`,
+	Args:  cobra.ExactArgs(2),
+	RunE:  runDiff,
+}
+
+func init() {
+	diffCmd.Flags().StringVar(&diffFormat, "format", "json", "Output format: json or text")
+	rootCmd.AddCommand(diffCmd)
+}
+
+func runDiff(cmd *cobra.Command, args []string) error {
+	before, err := snapshot.Load(args[0])
+	if err != nil {
+		return err
+	}
+	after, err := snapshot.Load(args[1])
+	if err != nil {
+		return err
+	}
+
+	report := snapshot.Diff(before, after)
+
+	switch diffFormat {
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	case "text":
+		return report.WriteText(os.Stdout)
+	default:
+		return fmt.Errorf("unknown format %q, must be json or text", diffFormat)
+	}
+}
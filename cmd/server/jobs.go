@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+	"github.com/pyshx/fake-batch-server/pkg/client"
+)
+
+var (
+	jobsServer   string
+	jobsProject  string
+	jobsLocation string
+	jobsToken    string
+
+	submitJobID string
+)
+
+var jobsCmd = &cobra.Command{
+	Use:   "jobs",
+	Short: "Manage the jobs of a running server",
+}
+
+var jobsSubmitCmd = &cobra.Command{
+	Use:   "submit JOB_FILE",
+	Short: "Create a job from a YAML or JSON file",
+	Long:  `Create a job from a YAML or JSON file holding the job as the API takes it, with the same field names.`,
+	Args:  cobra.ExactArgs(1),
+	RunE:  runJobsSubmit,
+}
+
+var jobsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the jobs of a location and their task counts",
+	Args:  cobra.NoArgs,
+	RunE:  runJobsList,
+}
+
+var jobsDescribeCmd = &cobra.Command{
+	Use:   "describe JOB",
+	Short: "Print a job as JSON",
+	Args:  cobra.ExactArgs(1),
+	RunE:  runJobsDescribe,
+}
+
+var jobsDeleteCmd = &cobra.Command{
+	Use:   "delete JOB",
+	Short: "Delete a job",
+	Args:  cobra.ExactArgs(1),
+	RunE:  runJobsDelete,
+}
+
+var tasksCmd = &cobra.Command{
+	Use:   "tasks",
+	Short: "Inspect the tasks of the jobs of a running server",
+}
+
+var tasksListCmd = &cobra.Command{
+	Use:   "list JOB",
+	Short: "List the tasks of a job and their states",
+	Args:  cobra.ExactArgs(1),
+	RunE:  runTasksList,
+}
+
+var jobsWatchCmd = &cobra.Command{
+	Use:   "watch",
+	Short: "Show a live table of the jobs of a location and their task counts",
+	Long:  `Follow the jobs of a location through GET .../jobs:watch and redraw a table of their states and task counts on every change, until interrupted. A dropped stream is reopened, waiting up to 30s between attempts.`,
+	Args:  cobra.NoArgs,
+	RunE:  runJobsWatch,
+}
+
+func init() {
+	for _, cmd := range []*cobra.Command{jobsCmd, tasksCmd} {
+		cmd.PersistentFlags().StringVar(&jobsServer, "server", "http://localhost:8080", "Address of the fake Batch server")
+		cmd.PersistentFlags().StringVar(&jobsProject, "project", "", "Project of the jobs")
+		cmd.PersistentFlags().StringVar(&jobsLocation, "location", "", "Location of the jobs")
+		cmd.PersistentFlags().StringVar(&jobsToken, "token", "", "Bearer token sent to servers started with --auth-config")
+		cmd.MarkPersistentFlagRequired("project")
+		cmd.MarkPersistentFlagRequired("location")
+		rootCmd.AddCommand(cmd)
+	}
+	jobsSubmitCmd.Flags().StringVar(&submitJobID, "job-id", "", "ID of the job (default: generated)")
+	jobsCmd.AddCommand(jobsWatchCmd, jobsSubmitCmd, jobsListCmd, jobsDescribeCmd, jobsDeleteCmd)
+	tasksCmd.AddCommand(tasksListCmd)
+}
+
+// jobsParent returns the name of the location given by --project and
+// --location.
+func jobsParent() string {
+	return fmt.Sprintf("projects/%s/locations/%s", url.PathEscape(jobsProject), url.PathEscape(jobsLocation))
+}
+
+// jobName returns the name of the job given on the command line, either by
+// its full name or by its ID in the location of --project and --location.
+func jobName(arg string) string {
+	if strings.Contains(arg, "/") {
+		return arg
+	}
+	return jobsParent() + "/jobs/" + url.PathEscape(arg)
+}
+
+// newClient returns a client of the server given by --server.
+func newClient() *client.Client {
+	return client.New(strings.TrimSuffix(jobsServer, "/")+"/v1", client.WithBearerToken(jobsToken))
+}
+
+func runJobsSubmit(cmd *cobra.Command, args []string) error {
+	job, err := loadJob(args[0])
+	if err != nil {
+		return err
+	}
+	created, err := newClient().CreateJob(cmd.Context(), jobsParent(), submitJobID, job)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Created job %s (%s)\n", created.Name, created.State)
+	return nil
+}
+
+// loadJob reads a job from a YAML or JSON file. It is decoded through JSON so
+// that YAML files use the same field names as the API.
+func loadJob(path string) (*api.Job, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse job file %s: %v", path, err)
+	}
+	if data, err = json.Marshal(raw); err != nil {
+		return nil, fmt.Errorf("failed to parse job file %s: %v", path, err)
+	}
+	var job api.Job
+	if err := json.Unmarshal(data, &job); err != nil {
+		return nil, fmt.Errorf("failed to parse job file %s: %v", path, err)
+	}
+	return &job, nil
+}
+
+func runJobsList(cmd *cobra.Command, args []string) error {
+	jobs, err := newClient().ListJobs(cmd.Context(), jobsParent(), 0).All()
+	if err != nil {
+		return err
+	}
+	writeJobsTable(os.Stdout, jobsParent(), jobs, time.Now())
+	return nil
+}
+
+func runJobsDescribe(cmd *cobra.Command, args []string) error {
+	job, err := newClient().GetJob(cmd.Context(), jobName(args[0]))
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(job)
+}
+
+func runJobsDelete(cmd *cobra.Command, args []string) error {
+	name := jobName(args[0])
+	if _, err := newClient().DeleteJob(cmd.Context(), name); err != nil {
+		return err
+	}
+	fmt.Printf("Deleting job %s\n", name)
+	return nil
+}
+
+func runTasksList(cmd *cobra.Command, args []string) error {
+	tasks, err := newClient().ListTasks(cmd.Context(), jobName(args[0]), 0).All()
+	if err != nil {
+		return err
+	}
+	writeTasksTable(os.Stdout, tasks)
+	return nil
+}
+
+const (
+	// watchRetryMin and watchRetryMax bound the wait before jobs watch
+	// reconnects a dropped stream, which doubles after every attempt that
+	// fails to connect.
+	watchRetryMin = time.Second
+	watchRetryMax = 30 * time.Second
+)
+
+func runJobsWatch(cmd *cobra.Command, args []string) error {
+	ctx := cmd.Context()
+	parent := jobsParent()
+
+	wait := watchRetryMin
+	for {
+		connected, err := watchJobs(ctx, parent)
+		if ctx.Err() != nil {
+			return nil
+		}
+		var status *watchStatusError
+		if errors.As(err, &status) && status.code < http.StatusInternalServerError {
+			return err
+		}
+		if err == nil {
+			err = errors.New("server closed the stream")
+		}
+		if connected {
+			wait = watchRetryMin
+		}
+
+		fmt.Fprintf(os.Stderr, "Watching jobs failed: %v; reconnecting in %s\n", err, wait)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(wait):
+		}
+		if wait *= 2; wait > watchRetryMax {
+			wait = watchRetryMax
+		}
+	}
+}
+
+// watchStatusError is the error status a server answered a watch with.
+type watchStatusError struct {
+	code int
+	body string
+}
+
+func (e *watchStatusError) Error() string {
+	return fmt.Sprintf("watching jobs returned %d: %s", e.code, e.body)
+}
+
+// watchJobs redraws the table of the jobs of parent on every event of a
+// single jobs:watch stream, until the stream ends. It reports whether the
+// stream was opened.
+func watchJobs(ctx context.Context, parent string) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(jobsServer, "/")+"/v1/"+parent+"/jobs:watch", nil)
+	if err != nil {
+		return false, err
+	}
+	if jobsToken != "" {
+		req.Header.Set("Authorization", "Bearer "+jobsToken)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return false, &watchStatusError{code: resp.StatusCode, body: strings.TrimSpace(string(body))}
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	var event, data string
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		case line == "":
+			if event == "jobs" {
+				var jobs api.ListJobsResponse
+				if err := json.Unmarshal([]byte(data), &jobs); err != nil {
+					return true, fmt.Errorf("invalid jobs event: %v", err)
+				}
+				// Clear the screen before redrawing the table.
+				fmt.Fprint(os.Stdout, "\033[H\033[2J")
+				writeJobsTable(os.Stdout, parent, jobs.Jobs, time.Now())
+			}
+			event, data = "", ""
+		}
+	}
+	return true, scanner.Err()
+}
+
+// writeJobsTable writes a table of jobs with their task counts, summed over
+// their task groups.
+func writeJobsTable(out io.Writer, parent string, jobs []*api.Job, now time.Time) {
+	fmt.Fprintf(out, "Jobs in %s at %s\n\n", parent, now.Format("15:04:05"))
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "JOB\tSTATE\tTASKS\tPENDING\tRUNNING\tSUCCEEDED\tFAILED\tAGE")
+	for _, job := range jobs {
+		counts := make(map[string]int64)
+		var total int64
+		if job.Status != nil {
+			for _, group := range job.Status.TaskGroups {
+				for state, count := range group.Counts {
+					counts[state] += count
+					total += count
+				}
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%d\t%d\t%s\n",
+			job.Name[strings.LastIndex(job.Name, "/")+1:], job.State, total,
+			counts[string(api.TaskStatePending)]+counts[string(api.TaskStateAssigned)],
+			counts[string(api.TaskStateRunning)],
+			counts[string(api.TaskStateSucceeded)],
+			counts[string(api.TaskStateFailed)],
+			now.Sub(job.CreateTime).Round(time.Second))
+	}
+	w.Flush()
+}
+
+// writeTasksTable writes a table of tasks, named by their group and index,
+// with their states and last status events.
+func writeTasksTable(out io.Writer, tasks []*api.Task) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TASK\tSTATE\tLAST EVENT")
+	for _, task := range tasks {
+		name := task.Name
+		if i := strings.Index(name, "/taskGroups/"); i >= 0 {
+			name = strings.Replace(name[i+len("/taskGroups/"):], "/tasks/", "/", 1)
+		}
+		var state api.TaskState
+		var event string
+		if task.Status != nil {
+			state = task.Status.State
+			if n := len(task.Status.StatusEvents); n > 0 {
+				event = task.Status.StatusEvents[n-1].Description
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", name, state, event)
+	}
+	w.Flush()
+}
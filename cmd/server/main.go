@@ -10,18 +10,103 @@ import (
 	"syscall"
 	"time"
 
-	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 
+	"github.com/pyshx/fake-batch-server/pkg/api"
+	"github.com/pyshx/fake-batch-server/pkg/audit"
+	"github.com/pyshx/fake-batch-server/pkg/auth"
+	"github.com/pyshx/fake-batch-server/pkg/blobstore"
+	"github.com/pyshx/fake-batch-server/pkg/catalog"
+	"github.com/pyshx/fake-batch-server/pkg/clock"
+	"github.com/pyshx/fake-batch-server/pkg/executor"
+	"github.com/pyshx/fake-batch-server/pkg/faults"
 	"github.com/pyshx/fake-batch-server/pkg/handlers"
-	"github.com/pyshx/fake-batch-server/pkg/storage"
+	"github.com/pyshx/fake-batch-server/pkg/registry"
+	"github.com/pyshx/fake-batch-server/pkg/server"
+	"github.com/pyshx/fake-batch-server/pkg/simulation"
+	"github.com/pyshx/fake-batch-server/pkg/tracing"
+	"github.com/pyshx/fake-batch-server/pkg/webhook"
 )
 
 var (
-	port    int
-	verbose bool
-	host    string
+	port      int
+	verbose   bool
+	logFormat string
+	host      string
+
+	deterministic        bool
+	simConfig            string
+	simQueuedDuration    time.Duration
+	simScheduledDuration time.Duration
+	simRunningDuration   time.Duration
+	simProgressInterval  time.Duration
+	simTaskJitter        time.Duration
+	taskFailureRate      float64
+	spotPreemptionRate   float64
+	profilesConfig       string
+	scenariosConfig      string
+	maxRunningJobs       int
+	schedulingPolicy     string
+	capacityConfig       string
+
+	serverDefaults   bool
+	maxTaskCount     int64
+	defaultCPUMilli  int64
+	defaultMemoryMib int64
+	maxRequestBytes  int64
+
+	executorMode string
+	dockerHost   string
+	volumesRoot  string
+
+	logsRoot    string
+	gcsEndpoint string
+	gcsVolumes  bool
+
+	checkImages        string
+	insecureRegistries []string
+	machineTypes       string
+	strictJSON         bool
+
+	enablePprof bool
+
+	pubsubEmulatorHost string
+	webhooksConfig     string
+
+	otelEndpoint string
+
+	auditFile         string
+	auditOTLPEndpoint string
+
+	authConfig string
+
+	tenantMode     bool
+	projectsConfig string
+
+	quotasConfig string
+
+	injectLatency time.Duration
+	injectJitter  time.Duration
+	errorRate     float64
+	faultMatrix   string
+
+	stateFile    string
+	seedFile     string
+	drainTimeout time.Duration
+
+	jobTTL          time.Duration
+	maxFinishedJobs int
+	jobArchiveDir   string
+
+	tlsCert  string
+	tlsKey   string
+	clientCA string
+
+	objectStore    bool
+	objectStoreURL string
+
+	configFile string
 )
 
 var rootCmd = &cobra.Command{
@@ -47,6 +132,62 @@ func init() {
 	rootCmd.Flags().IntVarP(&port, "port", "p", defaultPort, "Port to run the server on")
 	rootCmd.Flags().StringVarP(&host, "host", "H", defaultHost, "Host to bind the server to")
 	rootCmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "Enable verbose logging")
+	rootCmd.Flags().StringVar(&logFormat, "log-format", "text", "Format of log lines: text, or json for log pipelines")
+	rootCmd.Flags().BoolVar(&deterministic, "deterministic", false, "Drive the simulation from a fake clock advanced via POST /admin/clock/advance")
+	rootCmd.Flags().StringVar(&simConfig, "sim-config", "", "Path to a YAML/JSON file with per-state simulation timings")
+	rootCmd.Flags().DurationVar(&simQueuedDuration, "sim-queued-duration", time.Second, "Time a simulated job spends in QUEUED")
+	rootCmd.Flags().DurationVar(&simScheduledDuration, "sim-scheduled-duration", time.Second, "Time a simulated job spends in SCHEDULED")
+	rootCmd.Flags().DurationVar(&simRunningDuration, "sim-running-duration", 5*time.Second, "Time a simulated job spends in RUNNING")
+	rootCmd.Flags().DurationVar(&simProgressInterval, "sim-progress-interval", 0, "Interval between job_progress events of a RUNNING job (0: none)")
+	rootCmd.Flags().DurationVar(&simTaskJitter, "sim-task-jitter", 0, "Most a simulated task attempt runs past --sim-running-duration, drawn at random per attempt (0: none)")
+	rootCmd.Flags().Float64Var(&taskFailureRate, "task-failure-rate", 0, "Probability (0-1) that a simulated task attempt fails")
+	rootCmd.Flags().Float64Var(&spotPreemptionRate, "spot-preemption-rate", 0, "Probability (0-1) that a simulated task attempt on SPOT or PREEMPTIBLE VMs is preempted")
+	rootCmd.Flags().StringVar(&profilesConfig, "profiles-config", "", "Path to a YAML/JSON file mapping projects to simulation profiles")
+	rootCmd.Flags().StringVar(&scenariosConfig, "scenarios-config", "", "Path to a YAML/JSON file of scripted lifecycles for the jobs matching given labels or job ID patterns")
+	rootCmd.Flags().IntVar(&maxRunningJobs, "max-running-jobs", 0, "Maximum number of jobs simulated past QUEUED at once (0: unlimited)")
+	rootCmd.Flags().StringVar(&schedulingPolicy, "scheduling-policy", simulation.PolicyFIFO, "How --max-running-jobs capacity is shared: fifo, or fair to round-robin across projects")
+	rootCmd.Flags().StringVar(&capacityConfig, "capacity-config", "", "Path to a YAML/JSON file of the vCPU and memory capacity of each location that running jobs hold")
+	rootCmd.Flags().StringVar(&quotasConfig, "quotas-config", "", "Path to a YAML/JSON file of per-project quotas on jobs created per minute, running jobs and CPU in use")
+	rootCmd.Flags().DurationVar(&injectLatency, "inject-latency", 0, "Delay every API response by this long")
+	rootCmd.Flags().DurationVar(&injectJitter, "inject-jitter", 0, "Add up to this much random delay to every API response")
+	rootCmd.Flags().Float64Var(&errorRate, "error-rate", 0, "Probability (0-1) that an API request fails with a random 500 or 503 error")
+	rootCmd.Flags().StringVar(&faultMatrix, "fault-matrix", "", "Path to a YAML/JSON file of rules failing API requests, by endpoint and condition, with configured errors")
+	rootCmd.Flags().Int64Var(&maxTaskCount, "max-task-count", handlers.DefaultMaxTaskCount, "Most tasks a task group may have; larger jobs are rejected with the production error")
+	rootCmd.Flags().Int64Var(&maxRequestBytes, "max-request-bytes", handlers.DefaultMaxRequestBytes, "Largest API request body accepted; larger ones fail with 413 (negative for no limit)")
+	rootCmd.Flags().BoolVar(&serverDefaults, "server-defaults", true, "Fill unset job fields with the defaults the real API populates")
+	rootCmd.Flags().Int64Var(&defaultCPUMilli, "default-cpu-milli", 2000, "Default computeResource.cpuMilli of a task")
+	rootCmd.Flags().Int64Var(&defaultMemoryMib, "default-memory-mib", 2000, "Default computeResource.memoryMib of a task")
+	rootCmd.Flags().StringVar(&executorMode, "executor", "simulated", "How container runnables are run: simulated or docker")
+	rootCmd.Flags().StringVar(&dockerHost, "docker-host", os.Getenv("DOCKER_HOST"), "Docker daemon address used by --executor=docker (default "+executor.DefaultDockerHost+")")
+	rootCmd.Flags().StringVar(&volumesRoot, "volumes-root", "", "Directory the VM paths containers run by --executor=docker mount are resolved under")
+	rootCmd.Flags().StringVar(&checkImages, "check-images", "", "Reject jobs whose container images do not exist, looked up in their registry or via the docker daemon: registry or docker")
+	rootCmd.Flags().StringVar(&machineTypes, "machine-types", "warn", "How jobs with machine or accelerator types missing from the built-in catalog are handled: warn, reject or off")
+	rootCmd.Flags().BoolVar(&strictJSON, "strict-json", false, "Reject request bodies with unknown fields, e.g. a misspelled taskCount, instead of ignoring them")
+	rootCmd.Flags().StringSliceVar(&insecureRegistries, "insecure-registry", nil, "Registry reached over plain HTTP by --check-images=registry, e.g. localhost:5000")
+	rootCmd.Flags().StringVar(&pubsubEmulatorHost, "pubsub-emulator-host", os.Getenv("PUBSUB_EMULATOR_HOST"), "Pub/Sub emulator job notifications are published to (default: kept in memory, see /admin/pubsub)")
+	rootCmd.Flags().StringVar(&webhooksConfig, "webhooks-config", "", "Path to a YAML/JSON file of webhooks called on every job and task state change")
+	rootCmd.Flags().StringVar(&otelEndpoint, "otel-endpoint", os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"), "OTLP/HTTP collector spans are exported to, e.g. http://localhost:4318 (default: tracing disabled)")
+	rootCmd.Flags().BoolVar(&enablePprof, "enable-pprof", false, "Serve net/http/pprof profiles under /debug/pprof/ and goroutine, store and simulation counters under /debug/vars")
+	rootCmd.Flags().StringVar(&auditFile, "audit-file", "", "File every API call is appended to as a JSON line")
+	rootCmd.Flags().StringVar(&auditOTLPEndpoint, "audit-otlp-endpoint", "", "OTLP/HTTP collector every API call is exported to as a log record, e.g. http://localhost:4318")
+	rootCmd.Flags().StringVar(&authConfig, "auth-config", "", "Path to a YAML/JSON file of bearer tokens and the projects each may access; API requests without a valid token are rejected")
+	rootCmd.Flags().BoolVar(&tenantMode, "tenant-mode", false, "Only serve API requests for projects registered through the admin API or --projects-config; others fail with PERMISSION_DENIED")
+	rootCmd.Flags().StringVar(&projectsConfig, "projects-config", "", "Path to a YAML/JSON file of the project IDs registered for tenant mode (implies --tenant-mode)")
+	rootCmd.Flags().StringVar(&stateFile, "state-file", "", "File jobs are checkpointed to on shutdown and resumed from on startup, so in-flight simulations survive a restart")
+	rootCmd.Flags().DurationVar(&drainTimeout, "drain-timeout", 0, "On shutdown, wait this long for running simulations to finish, fast-forwarding the clock in --deterministic mode, before stopping or checkpointing the rest")
+	rootCmd.Flags().StringVar(&seedFile, "seed-file", "", "Path to a YAML/JSON file of jobs, in any state, to create at startup")
+	rootCmd.Flags().DurationVar(&jobTTL, "job-ttl", 0, "Remove SUCCEEDED, FAILED and CANCELLED jobs this long after they finished (0: keep them)")
+	rootCmd.Flags().IntVar(&maxFinishedJobs, "max-finished-jobs", 0, "Most finished jobs kept; the oldest are removed beyond it (0: unlimited)")
+	rootCmd.Flags().StringVar(&jobArchiveDir, "job-archive-dir", "", "Directory finished jobs removed by --job-ttl or --max-finished-jobs are archived to as JSON")
+	rootCmd.Flags().StringVar(&logsRoot, "logs-root", "", "Directory the logsPath of jobs logging to PATH is resolved under")
+	rootCmd.Flags().BoolVar(&objectStore, "object-store", false, "Serve a built-in object store under /storage, also used for gs:// logsPaths when --gcs-endpoint is not set")
+	rootCmd.Flags().StringVar(&objectStoreURL, "object-store-url", "", "Address executed containers reach the built-in object store at, passed as OBJECT_STORE_URL (default http://host.docker.internal:<port>/storage)")
+	rootCmd.Flags().StringVar(&tlsCert, "tls-cert", "", "PEM certificate to serve HTTPS with, together with --tls-key")
+	rootCmd.Flags().StringVar(&tlsKey, "tls-key", "", "PEM private key of --tls-cert")
+	rootCmd.Flags().StringVar(&clientCA, "client-ca", "", "PEM bundle of CAs clients must present a certificate signed by (mutual TLS; requires --tls-cert)")
+	rootCmd.Flags().StringVar(&configFile, "config", os.Getenv(envName("config")), "Path to a YAML/JSON file of settings keyed by flag name; flags and "+envPrefix+"* environment variables take precedence")
+	rootCmd.Flags().StringVar(&gcsEndpoint, "gcs-endpoint", os.Getenv("STORAGE_EMULATOR_HOST"), "Cloud Storage emulator a gs:// logsPath is written to, e.g. http://localhost:4443")
+	rootCmd.Flags().BoolVar(&gcsVolumes, "gcs-volumes", false, "Fail tasks whose GCS volumes name a bucket missing from --gcs-endpoint, and sync the volumes into executed containers")
 
 	if os.Getenv("VERBOSE") == "true" {
 		verbose = true
@@ -60,39 +201,320 @@ func main() {
 }
 
 func runServer(cmd *cobra.Command, args []string) {
+	if err := loadConfig(cmd.Flags(), configFile); err != nil {
+		logrus.Fatal(err)
+	}
 	if verbose {
 		logrus.SetLevel(logrus.DebugLevel)
 	}
+	switch logFormat {
+	case "text":
+	case "json":
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		logrus.Fatalf("--log-format must be text or json, got %q", logFormat)
+	}
+
+	timings, err := simulationTimings(cmd)
+	if err != nil {
+		logrus.Fatal(err)
+	}
 
-	store := storage.NewMemoryStore()
-	handler := handlers.NewHandler(store)
+	if taskFailureRate < 0 || taskFailureRate > 1 {
+		logrus.Fatalf("--task-failure-rate must be between 0 and 1, got %v", taskFailureRate)
+	}
+	if spotPreemptionRate < 0 || spotPreemptionRate > 1 {
+		logrus.Fatalf("--spot-preemption-rate must be between 0 and 1, got %v", spotPreemptionRate)
+	}
 
-	router := mux.NewRouter()
-	router.Use(loggingMiddleware)
-	router.Use(contentTypeMiddleware)
+	if gcsVolumes && gcsEndpoint == "" {
+		logrus.Fatal("--gcs-volumes requires --gcs-endpoint")
+	}
 
-	v1 := router.PathPrefix("/v1").Subrouter()
-	
-	v1.HandleFunc("/projects/{project}/locations/{location}/jobs", handler.CreateJob).Methods("POST")
-	v1.HandleFunc("/projects/{project}/locations/{location}/jobs", handler.ListJobs).Methods("GET")
-	v1.HandleFunc("/projects/{project}/locations/{location}/jobs/{job}", handler.GetJob).Methods("GET")
-	v1.HandleFunc("/projects/{project}/locations/{location}/jobs/{job}", handler.DeleteJob).Methods("DELETE")
-	v1.HandleFunc("/projects/{project}/locations/{location}/jobs/{job}/tasks", handler.ListTasks).Methods("GET")
-	v1.HandleFunc("/projects/{project}/locations/{location}/jobs/{job}/tasks/{task}", handler.GetTask).Methods("GET")
+	if maxTaskCount < 1 {
+		logrus.Fatalf("--max-task-count must be positive, got %d", maxTaskCount)
+	}
 
-	v1.HandleFunc("/health", healthCheck).Methods("GET")
+	defaults := handlers.ServerDefaults{}
+	if serverDefaults {
+		defaults = handlers.DefaultServerDefaults()
+		defaults.CPUMilli = defaultCPUMilli
+		defaults.MemoryMib = defaultMemoryMib
+	}
+
+	cfg := handlers.Config{
+		Timings:            timings,
+		TaskFailureRate:    taskFailureRate,
+		SpotPreemptionRate: spotPreemptionRate,
+		ServerDefaults:     &defaults,
+		MaxTaskCount:       maxTaskCount,
+		MaxRequestBytes:    maxRequestBytes,
+		LogsRoot:           logsRoot,
+		VolumesRoot:        volumesRoot,
+		GCSEndpoint:        gcsEndpoint,
+		GCSVolumes:         gcsVolumes,
+		PubSubEmulatorHost: pubsubEmulatorHost,
+		StrictJSON:         strictJSON,
+		Pprof:              enablePprof,
+	}
+	if profilesConfig != "" {
+		profiles, err := simulation.LoadProfiles(profilesConfig)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		cfg.Profiles = profiles
+		logrus.Infof("Loaded %d simulation profiles for %d projects", len(profiles.Profiles), len(profiles.Projects))
+	}
+	if scenariosConfig != "" {
+		scenarios, err := simulation.LoadScenarios(scenariosConfig)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		cfg.Scenarios = scenarios
+		logrus.Infof("Loaded %d scenarios", len(scenarios.Scenarios))
+	}
+	if maxRunningJobs > 0 {
+		scheduler, err := simulation.NewScheduler(maxRunningJobs, schedulingPolicy)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		cfg.Scheduler = scheduler
+		logrus.Infof("Running at most %d jobs at once with the %s scheduling policy", maxRunningJobs, schedulingPolicy)
+	} else if maxRunningJobs < 0 {
+		logrus.Fatalf("--max-running-jobs must not be negative, got %d", maxRunningJobs)
+	}
+	if capacityConfig != "" {
+		capacity, err := simulation.LoadCapacity(capacityConfig)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		if cfg.Scheduler == nil {
+			if cfg.Scheduler, err = simulation.NewTenantScheduler(schedulingPolicy); err != nil {
+				logrus.Fatal(err)
+			}
+		}
+		cfg.Scheduler.SetCapacity(capacity)
+		logrus.Infof("Loaded capacity for %d locations", len(capacity.Locations))
+	}
+	if injectLatency < 0 || injectJitter < 0 {
+		logrus.Fatal("--inject-latency and --inject-jitter must not be negative")
+	}
+	if errorRate < 0 || errorRate > 1 {
+		logrus.Fatalf("--error-rate must be between 0 and 1, got %v", errorRate)
+	}
+	cfg.Chaos = handlers.Chaos{Latency: injectLatency, Jitter: injectJitter, ErrorRate: errorRate}
+	if cfg.Chaos != (handlers.Chaos{}) {
+		logrus.Infof("Injecting %s latency, %s jitter and a %v error rate into API requests", injectLatency, injectJitter, errorRate)
+	}
+	if faultMatrix != "" {
+		matrix, err := faults.Load(faultMatrix)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		cfg.Faults = matrix
+		logrus.Infof("Injecting the API errors of the fault matrix %s", faultMatrix)
+	}
+	if quotasConfig != "" {
+		quotas, err := handlers.LoadQuotas(quotasConfig)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		cfg.Quotas = quotas
+		if defaultLimit, limits, ok := quotas.RunningJobLimits(); ok {
+			if cfg.Scheduler == nil {
+				if cfg.Scheduler, err = simulation.NewTenantScheduler(schedulingPolicy); err != nil {
+					logrus.Fatal(err)
+				}
+			}
+			cfg.Scheduler.SetTenantLimits(defaultLimit, limits)
+		}
+		logrus.Infof("Loaded quotas for %d projects", len(quotas.Projects))
+	}
+	if webhooksConfig != "" {
+		hooks, err := webhook.LoadHooks(webhooksConfig)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		for _, hook := range hooks {
+			if err := hook.Validate(); err != nil {
+				logrus.Fatalf("Invalid webhook in %s: %v", webhooksConfig, err)
+			}
+		}
+		cfg.Webhooks = hooks
+	}
+	if pubsubEmulatorHost != "" {
+		logrus.Infof("Publishing job notifications to the Pub/Sub emulator at %s", pubsubEmulatorHost)
+	}
+	switch executorMode {
+	case "simulated":
+	case "docker":
+		docker, err := executor.NewDocker(dockerHost)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		cfg.Executor = docker
+		logrus.Info("Docker executor enabled; container runnables are run for real")
+	default:
+		logrus.Fatalf("--executor must be simulated or docker, got %q", executorMode)
+	}
+
+	switch checkImages {
+	case "":
+	case "registry":
+		cfg.ImageChecker = registry.NewChecker(&http.Client{Timeout: 10 * time.Second}, insecureRegistries...)
+		logrus.Info("Image checks enabled; images are looked up in their registries")
+	case "docker":
+		docker, err := executor.NewDocker(dockerHost)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		cfg.ImageChecker = docker
+		logrus.Info("Image checks enabled; images are looked up through the docker daemon")
+	default:
+		logrus.Fatalf("--check-images must be registry or docker, got %q", checkImages)
+	}
+
+	switch machineTypes {
+	case "off":
+	case "warn", "reject":
+		cfg.Catalog = catalog.Default()
+		cfg.StrictCatalog = machineTypes == "reject"
+	default:
+		logrus.Fatalf("--machine-types must be warn, reject or off, got %q", machineTypes)
+	}
+
+	var exporter *tracing.OTLP
+	if otelEndpoint != "" {
+		service := os.Getenv("OTEL_SERVICE_NAME")
+		if service == "" {
+			service = "fake-batch-server"
+		}
+		exporter = tracing.NewOTLP(otelEndpoint, service, 10*time.Second)
+		cfg.Tracer = tracing.NewTracer(service, exporter)
+		logrus.Infof("Exporting traces to %s", otelEndpoint)
+	}
+
+	if authConfig != "" {
+		tokens, err := auth.Load(authConfig)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		cfg.Auth = tokens
+		logrus.Infof("Authentication enabled; API requests need a bearer token from %s", authConfig)
+	}
+	switch {
+	case projectsConfig != "":
+		projects, err := handlers.LoadProjects(projectsConfig)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		cfg.Projects = projects
+		logrus.Infof("Tenant mode enabled with %d projects from %s", len(projects.List()), projectsConfig)
+	case tenantMode:
+		cfg.Projects, _ = handlers.NewProjects(nil)
+		logrus.Info("Tenant mode enabled; register projects through the admin API")
+	}
+	if auditFile != "" {
+		sink, err := audit.NewFile(auditFile)
+		if err != nil {
+			logrus.Fatalf("Failed to open audit file: %v", err)
+		}
+		cfg.AuditSinks = append(cfg.AuditSinks, sink)
+		logrus.Infof("Appending API calls to %s", auditFile)
+	}
+	if auditOTLPEndpoint != "" {
+		service := os.Getenv("OTEL_SERVICE_NAME")
+		if service == "" {
+			service = "fake-batch-server"
+		}
+		cfg.AuditSinks = append(cfg.AuditSinks, audit.NewOTLP(auditOTLPEndpoint, service, 10*time.Second))
+		logrus.Infof("Exporting API calls to %s", auditOTLPEndpoint)
+	}
+
+	if jobTTL < 0 || maxFinishedJobs < 0 {
+		logrus.Fatal("--job-ttl and --max-finished-jobs must not be negative")
+	}
+	cfg.Retention = handlers.Retention{TTL: jobTTL, MaxFinishedJobs: maxFinishedJobs, ArchiveDir: jobArchiveDir}
+	if jobTTL > 0 || maxFinishedJobs > 0 {
+		logrus.Infof("Removing finished jobs older than %s or beyond the newest %d", jobTTL, maxFinishedJobs)
+	} else if jobArchiveDir != "" {
+		logrus.Warn("--job-archive-dir has no effect without --job-ttl or --max-finished-jobs")
+	}
+
+	if deterministic {
+		cfg.Clock = clock.NewFake(time.Now())
+		logrus.Info("Deterministic mode enabled; advance time via POST /admin/clock/advance")
+	}
+
+	if objectStore {
+		objectsClock := cfg.Clock
+		if objectsClock == nil {
+			objectsClock = clock.Real()
+		}
+		cfg.ObjectStore = blobstore.NewStore(objectsClock)
+		cfg.ObjectStoreURL = objectStoreURL
+		if cfg.ObjectStoreURL == "" {
+			cfg.ObjectStoreURL = fmt.Sprintf("http://host.docker.internal:%d/storage", port)
+		}
+		logrus.Infof("Object store enabled under /storage, reached by containers at %s", cfg.ObjectStoreURL)
+	}
+
+	emulator := server.New(server.WithConfig(cfg))
+	handler := emulator.API()
+	if stateFile != "" {
+		resumed, err := handler.Restore(stateFile)
+		if err != nil {
+			logrus.Fatalf("Failed to restore state: %v", err)
+		}
+		logrus.Infof("Restored state from %s, resuming %d jobs", stateFile, resumed)
+	}
+	if seedFile != "" {
+		jobs, err := handlers.LoadSeed(seedFile)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		seeded, err := handler.Seed(jobs)
+		if err != nil {
+			logrus.Fatalf("Failed to seed jobs from %s: %v", seedFile, err)
+		}
+		logrus.Infof("Seeded %d jobs from %s", seeded, seedFile)
+	}
 
 	srv := &http.Server{
 		Addr:         fmt.Sprintf("%s:%d", host, port),
-		Handler:      router,
+		Handler:      emulator,
 		ReadTimeout:  15 * time.Second,
 		WriteTimeout: 15 * time.Second,
 		IdleTimeout:  60 * time.Second,
 	}
 
+	if (tlsCert == "") != (tlsKey == "") {
+		logrus.Fatal("--tls-cert and --tls-key must be set together")
+	}
+	if clientCA != "" && tlsCert == "" {
+		logrus.Fatal("--client-ca requires --tls-cert and --tls-key")
+	}
+	scheme := "http"
+	if tlsCert != "" {
+		tlsConfig, err := serverTLSConfig(tlsCert, tlsKey, clientCA)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		srv.TLSConfig = tlsConfig
+		scheme = "https"
+		if clientCA != "" {
+			logrus.Infof("Requiring client certificates signed by %s", clientCA)
+		}
+	}
+
 	go func() {
-		logrus.Infof("Starting Fake Batch Server on %s:%d", host, port)
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logrus.Infof("Starting Fake Batch Server on %s://%s:%d", scheme, host, port)
+		serve := srv.ListenAndServe
+		if srv.TLSConfig != nil {
+			// The certificate is already loaded into TLSConfig.
+			serve = func() error { return srv.ListenAndServeTLS("", "") }
+		}
+		if err := serve(); err != nil && err != http.ErrServerClosed {
 			logrus.Fatal(err)
 		}
 	}()
@@ -108,33 +530,72 @@ func runServer(cmd *cobra.Command, args []string) {
 	if err := srv.Shutdown(ctx); err != nil {
 		logrus.Fatal("Server forced to shutdown:", err)
 	}
+	if drainTimeout > 0 {
+		logrus.Infof("Draining simulations for up to %s", drainTimeout)
+		drainCtx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+		if running := handler.Drain(drainCtx); running > 0 {
+			logrus.Warnf("%d simulations still running after %s", running, drainTimeout)
+		}
+		cancel()
+	}
+	if stateFile != "" {
+		if err := handler.Checkpoint(stateFile); err != nil {
+			logrus.Errorf("Failed to checkpoint state to %s: %v", stateFile, err)
+		} else {
+			logrus.Infof("Checkpointed state to %s", stateFile)
+		}
+	}
+	if err := emulator.Stop(ctx); err != nil {
+		logrus.Errorf("Failed to stop the emulator: %v", err)
+	}
+	if exporter != nil {
+		exporter.Shutdown()
+	}
 
 	logrus.Info("Server stopped")
 }
 
-func loggingMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-		next.ServeHTTP(w, r)
-		logrus.WithFields(logrus.Fields{
-			"method":   r.Method,
-			"path":     r.URL.Path,
-			"duration": time.Since(start),
-		}).Debug("Request handled")
-	})
-}
-
-func contentTypeMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		next.ServeHTTP(w, r)
-	})
-}
+// simulationTimings builds the simulation timings from the config file, with
+// explicitly set flags taking precedence over it.
+func simulationTimings(cmd *cobra.Command) (simulation.Timings, error) {
+	timings := simulation.Timings{States: make(map[api.JobState]time.Duration)}
+	if simConfig != "" {
+		loaded, err := simulation.LoadTimings(simConfig)
+		if err != nil {
+			return timings, err
+		}
+		timings = timings.Merge(loaded)
+	}
 
-func healthCheck(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusOK)
-	if _, err := w.Write([]byte(`{"status":"healthy"}`)); err != nil {
-		logrus.Errorf("Failed to write health check response: %v", err)
+	for _, flag := range []struct {
+		name     string
+		state    api.JobState
+		duration time.Duration
+	}{
+		{"sim-queued-duration", api.JobStateQueued, simQueuedDuration},
+		{"sim-scheduled-duration", api.JobStateScheduled, simScheduledDuration},
+		{"sim-running-duration", api.JobStateRunning, simRunningDuration},
+	} {
+		if !cmd.Flags().Changed(flag.name) {
+			continue
+		}
+		if flag.duration < 0 {
+			return timings, fmt.Errorf("--%s must not be negative, got %s", flag.name, flag.duration)
+		}
+		timings.States[flag.state] = flag.duration
+	}
+	if cmd.Flags().Changed("sim-progress-interval") {
+		if simProgressInterval < 0 {
+			return timings, fmt.Errorf("--sim-progress-interval must not be negative, got %s", simProgressInterval)
+		}
+		timings.Progress = simProgressInterval
+	}
+	if cmd.Flags().Changed("sim-task-jitter") {
+		if simTaskJitter < 0 {
+			return timings, fmt.Errorf("--sim-task-jitter must not be negative, got %s", simTaskJitter)
+		}
+		timings.Jitter = simTaskJitter
 	}
-}
 
+	return timings, nil
+}
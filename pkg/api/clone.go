@@ -0,0 +1,74 @@
+package api
+
+import "reflect"
+
+// Clone returns a deep copy of j, sharing no pointers, slices or maps with
+// it, so that one goroutine may modify it while another reads j.
+func (j *Job) Clone() *Job {
+	return deepCopy(j)
+}
+
+// Clone returns a deep copy of t.
+func (t *Task) Clone() *Task {
+	return deepCopy(t)
+}
+
+// Clone returns a deep copy of op.
+func (op *Operation) Clone() *Operation {
+	return deepCopy(op)
+}
+
+// deepCopy returns a copy of v that shares no pointers, slices or maps with
+// it.
+func deepCopy[T any](v T) T {
+	var c T
+	copyValue(reflect.ValueOf(&c).Elem(), reflect.ValueOf(v))
+	return c
+}
+
+// copyValue sets dst to a deep copy of src. Unexported fields, such as those
+// of time.Time, are copied as they are.
+func copyValue(dst, src reflect.Value) {
+	switch src.Kind() {
+	case reflect.Pointer:
+		if src.IsNil() {
+			return
+		}
+		dst.Set(reflect.New(src.Type().Elem()))
+		copyValue(dst.Elem(), src.Elem())
+	case reflect.Struct:
+		dst.Set(src)
+		for i := 0; i < src.NumField(); i++ {
+			if dst.Field(i).CanSet() {
+				copyValue(dst.Field(i), src.Field(i))
+			}
+		}
+	case reflect.Slice:
+		if src.IsNil() {
+			return
+		}
+		dst.Set(reflect.MakeSlice(src.Type(), src.Len(), src.Len()))
+		for i := 0; i < src.Len(); i++ {
+			copyValue(dst.Index(i), src.Index(i))
+		}
+	case reflect.Map:
+		if src.IsNil() {
+			return
+		}
+		dst.Set(reflect.MakeMapWithSize(src.Type(), src.Len()))
+		for iter := src.MapRange(); iter.Next(); {
+			value := reflect.New(src.Type().Elem()).Elem()
+			copyValue(value, iter.Value())
+			dst.SetMapIndex(iter.Key(), value)
+		}
+	case reflect.Interface:
+		if src.IsNil() {
+			return
+		}
+		value := reflect.New(src.Elem().Type()).Elem()
+		copyValue(value, src.Elem())
+		dst.Set(value)
+	default:
+		dst.Set(src)
+	}
+}
@@ -0,0 +1,126 @@
+package api
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FormatTimestamp formats t like the JSON form of a google.protobuf.Timestamp:
+// RFC 3339 in UTC with 0, 3, 6 or 9 fractional digits.
+func FormatTimestamp(t time.Time) string {
+	t = t.UTC()
+	layout := "2006-01-02T15:04:05"
+	switch nanos := t.Nanosecond(); {
+	case nanos == 0:
+	case nanos%int(time.Millisecond) == 0:
+		layout += ".000"
+	case nanos%int(time.Microsecond) == 0:
+		layout += ".000000"
+	default:
+		layout += ".000000000"
+	}
+	return t.Format(layout + "Z")
+}
+
+// FormatDuration formats d like the JSON form of a google.protobuf.Duration:
+// seconds with 0, 3, 6 or 9 fractional digits followed by "s", e.g. "7s" or
+// "0.250s".
+func FormatDuration(d time.Duration) string {
+	sign := ""
+	if d < 0 {
+		sign, d = "-", -d
+	}
+	seconds := strconv.FormatInt(int64(d/time.Second), 10)
+	nanos := int64(d % time.Second)
+	switch {
+	case nanos == 0:
+		return sign + seconds + "s"
+	case nanos%int64(time.Millisecond) == 0:
+		return sign + seconds + "." + pad(nanos/int64(time.Millisecond), 3) + "s"
+	case nanos%int64(time.Microsecond) == 0:
+		return sign + seconds + "." + pad(nanos/int64(time.Microsecond), 6) + "s"
+	default:
+		return sign + seconds + "." + pad(nanos, 9) + "s"
+	}
+}
+
+func pad(n int64, digits int) string {
+	s := strconv.FormatInt(n, 10)
+	return strings.Repeat("0", digits-len(s)) + s
+}
+
+// timestamp is a time.Time marshaled by FormatTimestamp.
+type timestamp time.Time
+
+func (t timestamp) MarshalJSON() ([]byte, error) {
+	return json.Marshal(FormatTimestamp(time.Time(t)))
+}
+
+// UnmarshalJSON decodes the element, also accepting the fields of its policy
+// inline, e.g. {"machineType": "e2-standard-4"}, as earlier versions of the
+// server took them.
+func (p *InstancePolicyOrTemplate) UnmarshalJSON(data []byte) error {
+	type plain InstancePolicyOrTemplate
+	if err := json.Unmarshal(data, (*plain)(p)); err != nil {
+		return err
+	}
+	if p.Policy != nil {
+		return nil
+	}
+	var policy InstancePolicy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return err
+	}
+	if !reflect.ValueOf(policy).IsZero() {
+		p.Policy = &policy
+	}
+	return nil
+}
+
+// MarshalJSON encodes the job with its times formatted by FormatTimestamp.
+func (j Job) MarshalJSON() ([]byte, error) {
+	type plain Job
+	return json.Marshal(&struct {
+		*plain
+		CreateTime timestamp `json:"createTime"`
+		UpdateTime timestamp `json:"updateTime"`
+	}{(*plain)(&j), timestamp(j.CreateTime), timestamp(j.UpdateTime)})
+}
+
+// MarshalJSON encodes the event with its time formatted by FormatTimestamp.
+func (e StatusEvent) MarshalJSON() ([]byte, error) {
+	type plain StatusEvent
+	return json.Marshal(&struct {
+		*plain
+		EventTime timestamp `json:"eventTime"`
+	}{(*plain)(&e), timestamp(e.EventTime)})
+}
+
+// MarshalJSON encodes the metadata with its times formatted by
+// FormatTimestamp.
+func (m OperationMetadata) MarshalJSON() ([]byte, error) {
+	type plain OperationMetadata
+	var endTime *timestamp
+	if m.EndTime != nil {
+		t := timestamp(*m.EndTime)
+		endTime = &t
+	}
+	return json.Marshal(&struct {
+		*plain
+		CreateTime timestamp  `json:"createTime"`
+		EndTime    *timestamp `json:"endTime,omitempty"`
+	}{(*plain)(&m), timestamp(m.CreateTime), endTime})
+}
+
+// MarshalJSON encodes the allowance with its time formatted by
+// FormatTimestamp.
+func (a ResourceAllowance) MarshalJSON() ([]byte, error) {
+	type plain ResourceAllowance
+	return json.Marshal(&struct {
+		*plain
+		CreateTime timestamp `json:"createTime"`
+	}{(*plain)(&a), timestamp(a.CreateTime)})
+}
@@ -0,0 +1,120 @@
+package api
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormatTimestamp(t *testing.T) {
+	zone := time.FixedZone("CEST", 2*60*60)
+	tests := []struct {
+		time     time.Time
+		expected string
+	}{
+		{time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC), "2024-01-01T12:00:00Z"},
+		{time.Date(2024, 1, 1, 14, 0, 0, 0, zone), "2024-01-01T12:00:00Z"},
+		{time.Date(2024, 1, 1, 12, 0, 0, 500000000, time.UTC), "2024-01-01T12:00:00.500Z"},
+		{time.Date(2024, 1, 1, 12, 0, 0, 1500, time.UTC), "2024-01-01T12:00:00.000001500Z"},
+		{time.Date(2024, 1, 1, 12, 0, 0, 120000, time.UTC), "2024-01-01T12:00:00.000120Z"},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, FormatTimestamp(tt.time))
+	}
+}
+
+func TestFormatDuration(t *testing.T) {
+	tests := []struct {
+		duration time.Duration
+		expected string
+	}{
+		{0, "0s"},
+		{7 * time.Second, "7s"},
+		{250 * time.Millisecond, "0.250s"},
+		{90*time.Second + 5*time.Microsecond, "90.000005s"},
+		{time.Nanosecond, "0.000000001s"},
+		{-1500 * time.Millisecond, "-1.500s"},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, FormatDuration(tt.duration))
+	}
+}
+
+func TestMarshalTimestamps(t *testing.T) {
+	created := time.Date(2024, 1, 1, 14, 0, 0, 250000000, time.FixedZone("CEST", 2*60*60))
+	job := &Job{
+		Name:       "projects/p/locations/l/jobs/j",
+		CreateTime: created,
+		UpdateTime: created.Add(time.Second),
+		Status: &JobStatus{
+			StatusEvents: []*StatusEvent{{Type: "job_created", EventTime: created}},
+		},
+	}
+
+	data, err := json.Marshal(job)
+	require.NoError(t, err)
+	var raw map[string]interface{}
+	require.NoError(t, json.Unmarshal(data, &raw))
+	assert.Equal(t, "projects/p/locations/l/jobs/j", raw["name"])
+	assert.Equal(t, "2024-01-01T12:00:00.250Z", raw["createTime"])
+	assert.Equal(t, "2024-01-01T12:00:01.250Z", raw["updateTime"])
+	event := raw["status"].(map[string]interface{})["statusEvents"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, "2024-01-01T12:00:00.250Z", event["eventTime"])
+	assert.NotContains(t, event, "taskExecution")
+
+	// The encoding decodes back to the same instants.
+	var decoded Job
+	require.NoError(t, json.Unmarshal(data, &decoded))
+	assert.True(t, decoded.CreateTime.Equal(created))
+
+	data, err = json.Marshal(&OperationMetadata{CreateTime: created})
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"createTime":"2024-01-01T12:00:00.250Z"`)
+	assert.NotContains(t, string(data), "endTime")
+
+	data, err = json.Marshal(&StatusEvent{Type: "task_failed", TaskExecution: &TaskExecution{ExitCode: 1}})
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"taskExecution":{"exitCode":1}`)
+}
+
+func TestUnmarshalInstancePolicyOrTemplate(t *testing.T) {
+	spec := `{
+		"taskGroups": [{"name": "group0", "taskSpec": {}, "requireHostsFile": true, "permissiveSsh": true}],
+		"allocationPolicy": {
+			"instances": [
+				{"policy": {"machineType": "a2-highgpu-1g", "bootDisk": {"sizeGb": 100}}, "installGpuDrivers": true},
+				{"instanceTemplate": "batch-template", "installOpsAgent": true, "blockProjectSshKeys": true},
+				{"machineType": "e2-standard-4", "provisioningModel": "SPOT"}
+			],
+			"placement": {"collocation": "COLLOCATED", "maxDistance": 2}
+		},
+		"notifications": [{"pubsubTopic": "projects/p/topics/jobs"}]
+	}`
+	var job Job
+	require.NoError(t, json.Unmarshal([]byte(spec), &job))
+
+	assert.True(t, job.TaskGroups[0].RequireHostsFile)
+	assert.True(t, job.TaskGroups[0].PermissiveSSH)
+	assert.Equal(t, &PlacementPolicy{Collocation: "COLLOCATED", MaxDistance: 2}, job.AllocationPolicy.Placement)
+	assert.Equal(t, []*InstancePolicyOrTemplate{
+		{Policy: &InstancePolicy{MachineType: "a2-highgpu-1g", BootDisk: &Disk{SizeGb: 100}}, InstallGpuDrivers: true},
+		{InstanceTemplate: "batch-template", InstallOpsAgent: true, BlockProjectSSHKeys: true},
+		// A policy given inline is moved under policy.
+		{Policy: &InstancePolicy{MachineType: "e2-standard-4", ProvisioningModel: "SPOT"}},
+	}, job.AllocationPolicy.Instances)
+	require.Len(t, job.Notifications, 1)
+
+	// The fields survive a round trip.
+	data, err := json.Marshal(job)
+	require.NoError(t, err)
+	var decoded Job
+	require.NoError(t, json.Unmarshal(data, &decoded))
+	assert.Equal(t, job.AllocationPolicy, decoded.AllocationPolicy)
+	assert.Equal(t, job.TaskGroups, decoded.TaskGroups)
+	assert.Contains(t, string(data), `{"policy":{"machineType":"e2-standard-4","provisioningModel":"SPOT"}}`)
+}
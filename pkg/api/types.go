@@ -15,6 +15,10 @@ const (
 	JobStateFailed      JobState = "FAILED"
 	JobStateDeleting    JobState = "DELETING"
 	JobStateDeleted     JobState = "DELETED"
+
+	// The cancellation states exist only in the v1alpha API.
+	JobStateCancellationInProgress JobState = "CANCELLATION_IN_PROGRESS"
+	JobStateCancelled              JobState = "CANCELLED"
 )
 
 // TaskState represents the state of a task within a job.
@@ -30,63 +34,77 @@ const (
 	TaskStateAborted     TaskState = "ABORTED"
 )
 
+// Scheduling policies for the tasks of a task group.
+const (
+	SchedulingPolicyUnspecified      = "SCHEDULING_POLICY_UNSPECIFIED"
+	SchedulingPolicyAsSoonAsPossible = "AS_SOON_AS_POSSIBLE"
+	SchedulingPolicyInOrder          = "IN_ORDER"
+)
+
 // Job represents a batch job.
 type Job struct {
-	Name            string              `json:"name"`
-	UID             string              `json:"uid"`
-	Priority        int32               `json:"priority,omitempty"`
-	State           JobState            `json:"state"`
-	CreateTime      time.Time           `json:"createTime"`
-	UpdateTime      time.Time           `json:"updateTime"`
-	Labels          map[string]string   `json:"labels,omitempty"`
-	TaskGroups      []*TaskGroup        `json:"taskGroups"`
-	AllocationPolicy *AllocationPolicy   `json:"allocationPolicy,omitempty"`
-	LogsPolicy      *LogsPolicy         `json:"logsPolicy,omitempty"`
-	Status          *JobStatus          `json:"status,omitempty"`
+	Name             string             `json:"name"`
+	UID              string             `json:"uid"`
+	Priority         int32              `json:"priority,omitempty"`
+	State            JobState           `json:"state"`
+	CreateTime       time.Time          `json:"createTime"`
+	UpdateTime       time.Time          `json:"updateTime"`
+	Labels           map[string]string  `json:"labels,omitempty"`
+	TaskGroups       []*TaskGroup       `json:"taskGroups"`
+	AllocationPolicy *AllocationPolicy  `json:"allocationPolicy,omitempty"`
+	LogsPolicy       *LogsPolicy        `json:"logsPolicy,omitempty"`
+	Notifications    []*JobNotification `json:"notifications,omitempty"`
+	Status           *JobStatus         `json:"status,omitempty"`
 }
 
 // TaskGroup represents a group of tasks with the same configuration.
 type TaskGroup struct {
-	Name             string            `json:"name"`
-	TaskSpec         *TaskSpec         `json:"taskSpec"`
-	TaskCount        int64             `json:"taskCount,omitempty"`
-	TaskCountPerNode int64             `json:"taskCountPerNode,omitempty"`
-	Parallelism      int64             `json:"parallelism,omitempty"`
-	SchedulingPolicy string            `json:"schedulingPolicy,omitempty"`
-	TaskEnvironments []*Environment    `json:"taskEnvironments,omitempty"`
+	Name             string         `json:"name"`
+	TaskSpec         *TaskSpec      `json:"taskSpec"`
+	TaskCount        int64          `json:"taskCount,omitempty"`
+	TaskCountPerNode int64          `json:"taskCountPerNode,omitempty"`
+	Parallelism      int64          `json:"parallelism,omitempty"`
+	SchedulingPolicy string         `json:"schedulingPolicy,omitempty"`
+	TaskEnvironments []*Environment `json:"taskEnvironments,omitempty"`
+	// RequireHostsFile makes the runtime list the instances of the group in
+	// the file BATCH_HOSTS_FILE names.
+	RequireHostsFile bool `json:"requireHostsFile,omitempty"`
+	PermissiveSSH    bool `json:"permissiveSsh,omitempty"`
 }
 
 // TaskSpec defines the specification for tasks in a task group.
 type TaskSpec struct {
-	ComputeResource  *ComputeResource  `json:"computeResource,omitempty"`
-	Runnables        []*Runnable       `json:"runnables"`
-	MaxRunDuration   string            `json:"maxRunDuration,omitempty"`
-	MaxRetryCount    int32             `json:"maxRetryCount,omitempty"`
-	Volumes          []*Volume         `json:"volumes,omitempty"`
-	Environment      *Environment      `json:"environment,omitempty"`
+	ComputeResource *ComputeResource `json:"computeResource,omitempty"`
+	Runnables       []*Runnable      `json:"runnables"`
+	MaxRunDuration  string           `json:"maxRunDuration,omitempty"`
+	MaxRetryCount   int32            `json:"maxRetryCount,omitempty"`
+	Volumes         []*Volume        `json:"volumes,omitempty"`
+	Environment     *Environment     `json:"environment,omitempty"`
+	// Environments is deprecated in favor of Environment.
+	Environments map[string]string `json:"environments,omitempty"`
 }
 
 // Runnable represents an executable unit within a task.
 type Runnable struct {
-	Container      *Container     `json:"container,omitempty"`
-	Script         *Script        `json:"script,omitempty"`
-	Barrier        *Barrier       `json:"barrier,omitempty"`
-	DisplayName    string         `json:"displayName,omitempty"`
+	Container        *Container   `json:"container,omitempty"`
+	Script           *Script      `json:"script,omitempty"`
+	Barrier          *Barrier     `json:"barrier,omitempty"`
+	DisplayName      string       `json:"displayName,omitempty"`
 	IgnoreExitStatus bool         `json:"ignoreExitStatus,omitempty"`
-	Background     bool           `json:"background,omitempty"`
-	AlwaysRun      bool           `json:"alwaysRun,omitempty"`
-	Environment    *Environment   `json:"environment,omitempty"`
-	Timeout        string         `json:"timeout,omitempty"`
+	Background       bool         `json:"background,omitempty"`
+	AlwaysRun        bool         `json:"alwaysRun,omitempty"`
+	Environment      *Environment `json:"environment,omitempty"`
+	Timeout          string       `json:"timeout,omitempty"`
 }
 
 // Container represents a Docker container configuration.
 type Container struct {
-	ImageURI         string   `json:"imageUri"`
-	Commands         []string `json:"commands,omitempty"`
-	Entrypoint       string   `json:"entrypoint,omitempty"`
-	Volumes          []string `json:"volumes,omitempty"`
-	Options          string   `json:"options,omitempty"`
-	BlockExternalNetwork bool `json:"blockExternalNetwork,omitempty"`
+	ImageURI             string   `json:"imageUri"`
+	Commands             []string `json:"commands,omitempty"`
+	Entrypoint           string   `json:"entrypoint,omitempty"`
+	Volumes              []string `json:"volumes,omitempty"`
+	Options              string   `json:"options,omitempty"`
+	BlockExternalNetwork bool     `json:"blockExternalNetwork,omitempty"`
 }
 
 // Script represents a script to be executed.
@@ -102,18 +120,18 @@ type Barrier struct {
 
 // ComputeResource defines the compute resources required by a task.
 type ComputeResource struct {
-	CPUMilli    int64  `json:"cpuMilli,omitempty"`
-	MemoryMib   int64  `json:"memoryMib,omitempty"`
-	GPUCount    int64  `json:"gpuCount,omitempty"`
-	BootDiskMib int64  `json:"bootDiskMib,omitempty"`
+	CPUMilli    int64 `json:"cpuMilli,omitempty"`
+	MemoryMib   int64 `json:"memoryMib,omitempty"`
+	GPUCount    int64 `json:"gpuCount,omitempty"`
+	BootDiskMib int64 `json:"bootDiskMib,omitempty"`
 }
 
 // Volume represents a storage volume configuration.
 type Volume struct {
-	NFS       *NFS      `json:"nfs,omitempty"`
-	GCS       *GCS      `json:"gcs,omitempty"`
-	DeviceName string   `json:"deviceName,omitempty"`
-	MountPath  string   `json:"mountPath"`
+	NFS          *NFS     `json:"nfs,omitempty"`
+	GCS          *GCS     `json:"gcs,omitempty"`
+	DeviceName   string   `json:"deviceName,omitempty"`
+	MountPath    string   `json:"mountPath"`
 	MountOptions []string `json:"mountOptions,omitempty"`
 }
 
@@ -136,11 +154,12 @@ type Environment struct {
 
 // AllocationPolicy defines resource allocation policies for a job.
 type AllocationPolicy struct {
-	Location    *LocationPolicy    `json:"location,omitempty"`
-	Instances   []*InstancePolicy  `json:"instances,omitempty"`
-	ServiceAccount *ServiceAccount `json:"serviceAccount,omitempty"`
-	Labels      map[string]string  `json:"labels,omitempty"`
-	Network     *NetworkPolicy     `json:"network,omitempty"`
+	Location       *LocationPolicy             `json:"location,omitempty"`
+	Instances      []*InstancePolicyOrTemplate `json:"instances,omitempty"`
+	ServiceAccount *ServiceAccount             `json:"serviceAccount,omitempty"`
+	Labels         map[string]string           `json:"labels,omitempty"`
+	Network        *NetworkPolicy              `json:"network,omitempty"`
+	Placement      *PlacementPolicy            `json:"placement,omitempty"`
 }
 
 // LocationPolicy defines location constraints for job execution.
@@ -148,12 +167,30 @@ type LocationPolicy struct {
 	AllowedLocations []string `json:"allowedLocations,omitempty"`
 }
 
+// PlacementPolicy defines how close to each other the VMs of a job are
+// placed.
+type PlacementPolicy struct {
+	Collocation string `json:"collocation,omitempty"`
+	MaxDistance int64  `json:"maxDistance,omitempty"`
+}
+
+// InstancePolicyOrTemplate is an element of allocationPolicy.instances: the
+// policy of the VMs to create, or the instance template to create them from.
+type InstancePolicyOrTemplate struct {
+	Policy              *InstancePolicy `json:"policy,omitempty"`
+	InstanceTemplate    string          `json:"instanceTemplate,omitempty"`
+	InstallGpuDrivers   bool            `json:"installGpuDrivers,omitempty"`
+	InstallOpsAgent     bool            `json:"installOpsAgent,omitempty"`
+	BlockProjectSSHKeys bool            `json:"blockProjectSshKeys,omitempty"`
+}
+
 // InstancePolicy defines VM instance configuration.
 type InstancePolicy struct {
-	MachineType      string            `json:"machineType,omitempty"`
-	ProvisioningModel string           `json:"provisioningModel,omitempty"`
-	Accelerators     []*Accelerator    `json:"accelerators,omitempty"`
-	Disks            []*AttachedDisk   `json:"disks,omitempty"`
+	MachineType       string          `json:"machineType,omitempty"`
+	ProvisioningModel string          `json:"provisioningModel,omitempty"`
+	Accelerators      []*Accelerator  `json:"accelerators,omitempty"`
+	BootDisk          *Disk           `json:"bootDisk,omitempty"`
+	Disks             []*AttachedDisk `json:"disks,omitempty"`
 }
 
 // Accelerator represents a hardware accelerator configuration.
@@ -188,23 +225,50 @@ type NetworkPolicy struct {
 
 // NetworkInterface represents a network interface configuration.
 type NetworkInterface struct {
-	Network         string `json:"network,omitempty"`
-	Subnetwork      string `json:"subnetwork,omitempty"`
-	NoExternalIPAddress bool `json:"noExternalIpAddress,omitempty"`
+	Network             string `json:"network,omitempty"`
+	Subnetwork          string `json:"subnetwork,omitempty"`
+	NoExternalIPAddress bool   `json:"noExternalIpAddress,omitempty"`
 }
 
 // LogsPolicy defines logging configuration for a job.
 type LogsPolicy struct {
-	Destination     string `json:"destination,omitempty"`
-	LogsPath        string `json:"logsPath,omitempty"`
+	Destination string `json:"destination,omitempty"`
+	LogsPath    string `json:"logsPath,omitempty"`
+}
+
+// Types of messages published for job notifications.
+const (
+	NotificationTypeJobStateChanged  = "JOB_STATE_CHANGED"
+	NotificationTypeTaskStateChanged = "TASK_STATE_CHANGED"
+)
+
+// JobNotification names a Pub/Sub topic that receives messages about the
+// job's state changes.
+type JobNotification struct {
+	// PubsubTopic is the topic, e.g. "projects/p/topics/t".
+	PubsubTopic string `json:"pubsubTopic,omitempty"`
+	// Message selects the changes published. Nothing is published without
+	// it.
+	Message *NotificationMessage `json:"message,omitempty"`
+}
+
+// NotificationMessage selects the state changes a JobNotification publishes.
+type NotificationMessage struct {
+	// Type is NotificationTypeJobStateChanged or
+	// NotificationTypeTaskStateChanged.
+	Type string `json:"type,omitempty"`
+	// NewJobState, if set, limits job messages to changes to that state.
+	NewJobState JobState `json:"newJobState,omitempty"`
+	// NewTaskState, if set, limits task messages to changes to that state.
+	NewTaskState TaskState `json:"newTaskState,omitempty"`
 }
 
 // JobStatus represents the current status of a job.
 type JobStatus struct {
-	State          JobState               `json:"state"`
-	StatusEvents   []*StatusEvent         `json:"statusEvents,omitempty"`
-	TaskGroups     map[string]*TaskGroupStatus `json:"taskGroups,omitempty"`
-	RunDuration    string                 `json:"runDuration,omitempty"`
+	State        JobState                    `json:"state"`
+	StatusEvents []*StatusEvent              `json:"statusEvents,omitempty"`
+	TaskGroups   map[string]*TaskGroupStatus `json:"taskGroups,omitempty"`
+	RunDuration  string                      `json:"runDuration,omitempty"`
 }
 
 // StatusEvent represents a status change event.
@@ -212,17 +276,44 @@ type StatusEvent struct {
 	Type        string    `json:"type"`
 	Description string    `json:"description"`
 	EventTime   time.Time `json:"eventTime"`
+	// TaskExecution is set on the events of task attempts ending, and on
+	// the event of a job failing for the first of its failed tasks.
+	TaskExecution *TaskExecution `json:"taskExecution,omitempty"`
+}
+
+// TaskExecution describes how a task attempt ended.
+type TaskExecution struct {
+	// ExitCode is the exit code of the attempt: 0 if it succeeded, that of
+	// the runnable that failed it otherwise, or one of the service's codes
+	// above 50000, e.g. 50001 for a preempted Spot VM.
+	ExitCode int32 `json:"exitCode"`
 }
 
 // TaskGroupStatus represents the status of a task group.
 type TaskGroupStatus struct {
 	Counts map[string]int64 `json:"counts"`
+	// Instances are the kinds of VMs the tasks of the group run on, once the
+	// job is scheduled.
+	Instances []*InstanceStatus `json:"instances,omitempty"`
+}
+
+// InstanceStatus describes the VMs a task group runs on.
+type InstanceStatus struct {
+	MachineType       string `json:"machineType,omitempty"`
+	ProvisioningModel string `json:"provisioningModel,omitempty"`
+	// TaskPack is the number of tasks each VM runs at once.
+	TaskPack int64 `json:"taskPack,omitempty"`
+	BootDisk *Disk `json:"bootDisk,omitempty"`
 }
 
 // Task represents an individual task within a job.
 type Task struct {
-	Name       string    `json:"name"`
-	Status     *TaskStatus `json:"status"`
+	Name   string      `json:"name"`
+	Status *TaskStatus `json:"status"`
+	// Environment holds the BATCH_* variables the runtime sets for the
+	// task's runnables. The service does not report it; the server adds it
+	// to the tasks it returns.
+	Environment *Environment `json:"environment,omitempty"`
 }
 
 // TaskStatus represents the current status of a task.
@@ -231,6 +322,17 @@ type TaskStatus struct {
 	StatusEvents []*StatusEvent `json:"statusEvents,omitempty"`
 }
 
+// ExitCode returns the exit code of the task's latest finished attempt. It
+// reports false if no attempt has finished.
+func (s *TaskStatus) ExitCode() (int32, bool) {
+	for i := len(s.StatusEvents) - 1; i >= 0; i-- {
+		if execution := s.StatusEvents[i].TaskExecution; execution != nil {
+			return execution.ExitCode, true
+		}
+	}
+	return 0, false
+}
+
 // ListJobsResponse represents the response for listing jobs.
 type ListJobsResponse struct {
 	Jobs          []*Job `json:"jobs"`
@@ -243,3 +345,84 @@ type ListTasksResponse struct {
 	NextPageToken string  `json:"nextPageToken,omitempty"`
 }
 
+// Operation represents a long-running operation, as returned by DeleteJob.
+type Operation struct {
+	Name     string             `json:"name"`
+	Metadata *OperationMetadata `json:"metadata,omitempty"`
+	Done     bool               `json:"done"`
+	Error    *Status            `json:"error,omitempty"`
+	Response map[string]string  `json:"response,omitempty"`
+}
+
+// OperationMetadata describes the operation a long-running Operation tracks.
+type OperationMetadata struct {
+	Type       string     `json:"@type"`
+	CreateTime time.Time  `json:"createTime"`
+	EndTime    *time.Time `json:"endTime,omitempty"`
+	Target     string     `json:"target"`
+	Verb       string     `json:"verb"`
+	APIVersion string     `json:"apiVersion"`
+}
+
+// Status is the google.rpc.Status error model used by Google APIs.
+type Status struct {
+	Code    int                      `json:"code"`
+	Message string                   `json:"message"`
+	Status  string                   `json:"status,omitempty"`
+	Details []map[string]interface{} `json:"details,omitempty"`
+}
+
+// ErrorResponse is the JSON error envelope returned by Google APIs.
+type ErrorResponse struct {
+	Error *Status `json:"error"`
+}
+
+// ResourceAllowance limits the resources the jobs of a location may consume
+// over a calendar period. It exists only in the v1alpha API.
+type ResourceAllowance struct {
+	Name                   string                  `json:"name"`
+	UID                    string                  `json:"uid"`
+	CreateTime             time.Time               `json:"createTime"`
+	Labels                 map[string]string       `json:"labels,omitempty"`
+	UsageResourceAllowance *UsageResourceAllowance `json:"usageResourceAllowance"`
+}
+
+// UsageResourceAllowance is a limit on the usage of a resource type.
+type UsageResourceAllowance struct {
+	Spec   *UsageResourceAllowanceSpec   `json:"spec"`
+	Status *UsageResourceAllowanceStatus `json:"status,omitempty"`
+}
+
+// UsageResourceAllowanceSpec names the limited resource, e.g.
+// "cpu-core-hours", and its limit.
+type UsageResourceAllowanceSpec struct {
+	Type  string `json:"type"`
+	Limit *Limit `json:"limit"`
+}
+
+// Limit is the amount of a resource allowed per calendar period, "DAY",
+// "WEEK", "MONTH", "QUARTER" or "YEAR".
+type Limit struct {
+	CalendarPeriod string  `json:"calendarPeriod"`
+	Limit          float64 `json:"limit"`
+}
+
+// UsageResourceAllowanceStatus reports whether an allowance is in effect and
+// how much of it the current period has consumed.
+type UsageResourceAllowanceStatus struct {
+	State       string       `json:"state"`
+	LimitStatus *LimitStatus `json:"limitStatus,omitempty"`
+}
+
+// LimitStatus is the consumption of a limit in the current period.
+type LimitStatus struct {
+	Limit           *Limit  `json:"limit"`
+	ConsumedPercent float64 `json:"consumedPercent"`
+}
+
+// ListResourceAllowancesResponse is the response for listing resource
+// allowances.
+type ListResourceAllowancesResponse struct {
+	ResourceAllowances []*ResourceAllowance `json:"resourceAllowances"`
+	NextPageToken      string               `json:"nextPageToken,omitempty"`
+}
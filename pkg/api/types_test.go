@@ -138,6 +138,51 @@ func TestTaskStructure(t *testing.T) {
 	assert.Len(t, task.Status.StatusEvents, 1)
 }
 
+func TestJobClone(t *testing.T) {
+	job := &Job{
+		Name:       "projects/p/locations/l/jobs/j",
+		CreateTime: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		Labels:     map[string]string{"team": "a"},
+		TaskGroups: []*TaskGroup{{Name: "group0", TaskCount: 2}},
+		Status: &JobStatus{
+			State:        JobStateRunning,
+			StatusEvents: []*StatusEvent{{Type: "job_created"}},
+			TaskGroups:   map[string]*TaskGroupStatus{"group0": {Counts: map[string]int64{"RUNNING": 2}}},
+		},
+	}
+
+	clone := job.Clone()
+	assert.Equal(t, job, clone)
+
+	clone.Labels["team"] = "b"
+	clone.TaskGroups[0].TaskCount = 3
+	clone.Status.StatusEvents = append(clone.Status.StatusEvents, &StatusEvent{Type: "job_started"})
+	clone.Status.StatusEvents[0].Type = "changed"
+	clone.Status.TaskGroups["group0"].Counts["RUNNING"] = 1
+	assert.Equal(t, "a", job.Labels["team"])
+	assert.Equal(t, int64(2), job.TaskGroups[0].TaskCount)
+	assert.Len(t, job.Status.StatusEvents, 1)
+	assert.Equal(t, "job_created", job.Status.StatusEvents[0].Type)
+	assert.Equal(t, int64(2), job.Status.TaskGroups["group0"].Counts["RUNNING"])
+	assert.Nil(t, (&Job{}).Clone().Status)
+}
+
+func TestTaskStatusExitCode(t *testing.T) {
+	status := &TaskStatus{StatusEvents: []*StatusEvent{{Type: "task_started"}}}
+	_, ok := status.ExitCode()
+	assert.False(t, ok)
+
+	status.StatusEvents = append(status.StatusEvents,
+		&StatusEvent{Type: "task_failed", TaskExecution: &TaskExecution{ExitCode: 1}},
+		&StatusEvent{Type: "task_retried"},
+		&StatusEvent{Type: "task_failed", TaskExecution: &TaskExecution{ExitCode: 50001}},
+		&StatusEvent{Type: "task_completed"},
+	)
+	exitCode, ok := status.ExitCode()
+	assert.True(t, ok)
+	assert.Equal(t, int32(50001), exitCode)
+}
+
 func TestEnvironmentVariables(t *testing.T) {
 	env := &Environment{
 		Variables: map[string]string{
@@ -0,0 +1,85 @@
+package apispec
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiscovery(t *testing.T) {
+	doc := Discovery("http://localhost:8080")
+	assert.Equal(t, "http://localhost:8080/", doc.RootURL)
+
+	jobs := doc.Resources["projects"].Resources["locations"].Resources["jobs"]
+	require.NotNil(t, jobs)
+	create := jobs.Methods["create"]
+	require.NotNil(t, create)
+	assert.Equal(t, "batch.projects.locations.jobs.create", create.ID)
+	assert.Equal(t, "v1/{+parent}/jobs", create.Path)
+	assert.Equal(t, "POST", create.HTTPMethod)
+	assert.Equal(t, []string{"parent"}, create.ParameterOrder)
+	assert.Equal(t, "Job", create.Request.Ref)
+	assert.Equal(t, "query", create.Parameters["jobId"].Location)
+	assert.NotNil(t, jobs.Resources["taskGroups"].Resources["tasks"].Methods["get"])
+
+	job := doc.Schemas["Job"]
+	require.NotNil(t, job)
+	assert.Equal(t, "Job", job.ID)
+	assert.Equal(t, "array", job.Properties["taskGroups"].Type)
+	assert.Equal(t, "TaskGroup", job.Properties["taskGroups"].Items.Ref)
+	assert.Contains(t, job.Properties["state"].Enum, "SUCCEEDED")
+	assert.Equal(t, "date-time", job.Properties["createTime"].Format)
+	assert.Equal(t, "int64", doc.Schemas["TaskGroup"].Properties["taskCount"].Format)
+	assert.Equal(t, "string", job.Properties["labels"].AdditionalProperties.Type)
+}
+
+func TestOpenAPI(t *testing.T) {
+	doc := OpenAPI("http://localhost:8080/")
+	assert.Equal(t, "http://localhost:8080", doc.Servers[0].URL)
+
+	get := doc.Paths["/v1/projects/{project}/locations/{location}/jobs/{job}"]["get"]
+	require.NotNil(t, get)
+	assert.Equal(t, "batch.projects.locations.jobs.get", get.OperationID)
+	var params []string
+	for _, p := range get.Parameters {
+		params = append(params, p.Name)
+	}
+	assert.Equal(t, []string{"project", "location", "job"}, params)
+	assert.Equal(t, "#/components/schemas/Job", get.Responses["200"].Content["application/json"].Schema.Ref)
+
+	// Every reference resolves to a component.
+	data, err := json.Marshal(doc)
+	require.NoError(t, err)
+	for _, ref := range strings.Split(string(data), `"$ref":"`)[1:] {
+		name := strings.TrimPrefix(ref[:strings.Index(ref, `"`)], "#/components/schemas/")
+		assert.Contains(t, doc.Components.Schemas, name)
+	}
+	assert.Empty(t, doc.Components.Schemas["Job"].ID)
+}
+
+func TestHandlers(t *testing.T) {
+	r := httptest.NewRequest("GET", "/$discovery/rest?version=v1", nil)
+	r.Host = "batch.local:9000"
+	w := httptest.NewRecorder()
+	DiscoveryHandler().ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+	var doc RestDescription
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&doc))
+	assert.Equal(t, "http://batch.local:9000/", doc.RootURL)
+
+	w = httptest.NewRecorder()
+	DiscoveryHandler().ServeHTTP(w, httptest.NewRequest("GET", "/$discovery/rest?version=v2", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+	OpenAPIHandler().ServeHTTP(w, httptest.NewRequest("GET", "/openapi.json", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	var spec OpenAPIDocument
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&spec))
+	assert.Equal(t, "3.0.3", spec.OpenAPI)
+}
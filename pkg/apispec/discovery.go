@@ -0,0 +1,114 @@
+package apispec
+
+import (
+	"strings"
+)
+
+// RestDescription is a Google API discovery document.
+type RestDescription struct {
+	Kind             string               `json:"kind"`
+	DiscoveryVersion string               `json:"discoveryVersion"`
+	ID               string               `json:"id"`
+	Name             string               `json:"name"`
+	Version          string               `json:"version"`
+	Title            string               `json:"title"`
+	Description      string               `json:"description"`
+	Protocol         string               `json:"protocol"`
+	RootURL          string               `json:"rootUrl"`
+	ServicePath      string               `json:"servicePath"`
+	BaseURL          string               `json:"baseUrl"`
+	Schemas          map[string]*Schema   `json:"schemas"`
+	Resources        map[string]*Resource `json:"resources"`
+}
+
+// Resource groups the methods and child resources of a resource collection.
+type Resource struct {
+	Methods   map[string]*Method   `json:"methods,omitempty"`
+	Resources map[string]*Resource `json:"resources,omitempty"`
+}
+
+// Method describes an API method in a discovery document.
+type Method struct {
+	ID             string                `json:"id"`
+	Path           string                `json:"path"`
+	FlatPath       string                `json:"flatPath"`
+	HTTPMethod     string                `json:"httpMethod"`
+	Description    string                `json:"description,omitempty"`
+	Parameters     map[string]*Parameter `json:"parameters"`
+	ParameterOrder []string              `json:"parameterOrder"`
+	Request        *Schema               `json:"request,omitempty"`
+	Response       *Schema               `json:"response,omitempty"`
+}
+
+// Parameter describes a path or query parameter of a method.
+type Parameter struct {
+	Type        string `json:"type"`
+	Format      string `json:"format,omitempty"`
+	Location    string `json:"location"`
+	Required    bool   `json:"required,omitempty"`
+	Pattern     string `json:"pattern,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// Discovery returns the discovery document of the v1 Batch API served at
+// rootURL, e.g. http://localhost:8080/.
+func Discovery(rootURL string) *RestDescription {
+	if !strings.HasSuffix(rootURL, "/") {
+		rootURL += "/"
+	}
+	schemas := newSchemaBuilder(func(name string) string { return name }, true)
+	doc := &RestDescription{
+		Kind:             "discovery#restDescription",
+		DiscoveryVersion: "v1",
+		ID:               "batch:v1",
+		Name:             "batch",
+		Version:          "v1",
+		Title:            "Batch API",
+		Description:      "An API to manage the running of Batch resources on Google Cloud Platform, served by the fake Batch server.",
+		Protocol:         "rest",
+		RootURL:          rootURL,
+		BaseURL:          rootURL,
+		Resources:        make(map[string]*Resource),
+	}
+
+	for _, m := range methods {
+		parent := &Resource{Resources: doc.Resources}
+		for _, name := range strings.Split(m.resource, ".") {
+			if parent.Resources == nil {
+				parent.Resources = make(map[string]*Resource)
+			}
+			child, ok := parent.Resources[name]
+			if !ok {
+				child = &Resource{}
+				parent.Resources[name] = child
+			}
+			parent = child
+		}
+		if parent.Methods == nil {
+			parent.Methods = make(map[string]*Method)
+		}
+
+		method := &Method{
+			ID:          m.id(),
+			Path:        m.path,
+			FlatPath:    strings.TrimPrefix(m.route, "/"),
+			HTTPMethod:  m.verb,
+			Description: m.description,
+			Parameters: map[string]*Parameter{
+				m.param: {Type: "string", Location: "path", Required: true, Pattern: m.pattern},
+			},
+			ParameterOrder: []string{m.param},
+			Response:       schemas.schema(m.response),
+		}
+		for _, q := range m.query {
+			method.Parameters[q.name] = &Parameter{Type: q.typ, Format: q.format, Location: "query", Description: q.description}
+		}
+		if m.request != nil {
+			method.Request = schemas.schema(m.request)
+		}
+		parent.Methods[m.name] = method
+	}
+
+	doc.Schemas = schemas.schemas
+	return doc
+}
@@ -0,0 +1,50 @@
+package apispec
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+)
+
+// DiscoveryHandler serves the discovery document of the API, as Google
+// serves it at /$discovery/rest?version=v1. Only version v1 exists.
+func DiscoveryHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if version := r.URL.Query().Get("version"); version != "" && version != "v1" {
+			writeError(w, http.StatusNotFound, "Discovery document not found for API service: batch.googleapis.com version %s", version)
+			return
+		}
+		writeJSON(w, http.StatusOK, Discovery(rootURL(r)+"/"))
+	})
+}
+
+// OpenAPIHandler serves the OpenAPI 3 spec of the API.
+func OpenAPIHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, OpenAPI(rootURL(r)))
+	})
+}
+
+// rootURL returns the address the client reached the server at, without a
+// trailing slash.
+func rootURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, format string, args ...interface{}) {
+	writeJSON(w, status, &api.ErrorResponse{
+		Error: &api.Status{Code: status, Message: fmt.Sprintf(format, args...)},
+	})
+}
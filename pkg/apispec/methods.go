@@ -0,0 +1,170 @@
+package apispec
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+)
+
+// parameter is a query parameter of a method.
+type parameter struct {
+	name        string
+	typ         string
+	format      string
+	description string
+}
+
+// method is an API method served by the emulator.
+type method struct {
+	// resource is the path of the method's resource in the discovery
+	// document, e.g. projects.locations.jobs.
+	resource string
+	name     string
+	verb     string
+	// route is the server route, with one path parameter per name segment.
+	route string
+	// path is the discovery path, with the resource name as a single
+	// reserved-expansion parameter, e.g. v1/{+parent}/jobs.
+	path string
+	// param is the name of that parameter and pattern the names it takes.
+	param   string
+	pattern string
+	query   []parameter
+	// request and response are the body types. A nil request means no
+	// body.
+	request     reflect.Type
+	response    reflect.Type
+	description string
+}
+
+// id returns the method ID, e.g. batch.projects.locations.jobs.create.
+func (m *method) id() string {
+	return "batch." + m.resource + "." + m.name
+}
+
+// pathParams returns the names of the path parameters of the route.
+func (m *method) pathParams() []string {
+	var params []string
+	for _, segment := range strings.Split(m.route, "/") {
+		if strings.HasPrefix(segment, "{") {
+			params = append(params, strings.Trim(segment, "{}"))
+		}
+	}
+	return params
+}
+
+const (
+	parentPattern = "^projects/[^/]+/locations/[^/]+$"
+	jobPattern    = "^projects/[^/]+/locations/[^/]+/jobs/[^/]+$"
+)
+
+var pageParameters = []parameter{
+	{name: "pageSize", typ: "integer", format: "int32", description: "Most results to return in one page."},
+	{name: "pageToken", typ: "string", description: "Page token returned by a previous call."},
+}
+
+// methods are the Batch API methods the emulator serves.
+var methods = []*method{
+	{
+		resource: "projects.locations.jobs",
+		name:     "create",
+		verb:     "POST",
+		route:    "/v1/projects/{project}/locations/{location}/jobs",
+		path:     "v1/{+parent}/jobs",
+		param:    "parent",
+		pattern:  parentPattern,
+		query: []parameter{
+			{name: "jobId", typ: "string", description: "ID of the job. Generated when unset."},
+			{name: "requestId", typ: "string", description: "UUID identifying the request. Retries with the same requestId within an hour return the job the first request created."},
+			{name: "validateOnly", typ: "boolean", description: "Validate the job and return it as it would be created, without creating it."},
+			{name: "final_state", typ: "string", description: "Terminal state the simulated job is forced to end in: SUCCEEDED or FAILED."},
+		},
+		request:     reflect.TypeOf(api.Job{}),
+		response:    reflect.TypeOf(api.Job{}),
+		description: "Create a Job.",
+	},
+	{
+		resource:    "projects.locations.jobs",
+		name:        "list",
+		verb:        "GET",
+		route:       "/v1/projects/{project}/locations/{location}/jobs",
+		path:        "v1/{+parent}/jobs",
+		param:       "parent",
+		pattern:     parentPattern,
+		query:       pageParameters,
+		response:    reflect.TypeOf(api.ListJobsResponse{}),
+		description: "List all Jobs for a project within a region.",
+	},
+	{
+		resource:    "projects.locations.jobs",
+		name:        "get",
+		verb:        "GET",
+		route:       "/v1/projects/{project}/locations/{location}/jobs/{job}",
+		path:        "v1/{+name}",
+		param:       "name",
+		pattern:     jobPattern,
+		response:    reflect.TypeOf(api.Job{}),
+		description: "Get a Job specified by its resource name.",
+	},
+	{
+		resource: "projects.locations.jobs",
+		name:     "patch",
+		verb:     "PATCH",
+		route:    "/v1/projects/{project}/locations/{location}/jobs/{job}",
+		path:     "v1/{+name}",
+		param:    "name",
+		pattern:  jobPattern,
+		query: []parameter{
+			{name: "updateMask", typ: "string", format: "google-fieldmask", description: "Fields to update: labels, priority, taskGroups or taskGroups[N].taskCount."},
+		},
+		request:     reflect.TypeOf(api.Job{}),
+		response:    reflect.TypeOf(api.Job{}),
+		description: "Update a Job.",
+	},
+	{
+		resource:    "projects.locations.jobs",
+		name:        "delete",
+		verb:        "DELETE",
+		route:       "/v1/projects/{project}/locations/{location}/jobs/{job}",
+		path:        "v1/{+name}",
+		param:       "name",
+		pattern:     jobPattern,
+		response:    reflect.TypeOf(api.Operation{}),
+		description: "Delete a Job.",
+	},
+	{
+		resource:    "projects.locations.jobs.tasks",
+		name:        "list",
+		verb:        "GET",
+		route:       "/v1/projects/{project}/locations/{location}/jobs/{job}/tasks",
+		path:        "v1/{+parent}/tasks",
+		param:       "parent",
+		pattern:     jobPattern,
+		query:       pageParameters,
+		response:    reflect.TypeOf(api.ListTasksResponse{}),
+		description: "List Tasks associated with a Job.",
+	},
+	{
+		resource:    "projects.locations.jobs.taskGroups.tasks",
+		name:        "get",
+		verb:        "GET",
+		route:       "/v1/projects/{project}/locations/{location}/jobs/{job}/taskGroups/{group}/tasks/{task}",
+		path:        "v1/{+name}",
+		param:       "name",
+		pattern:     "^projects/[^/]+/locations/[^/]+/jobs/[^/]+/taskGroups/[^/]+/tasks/[^/]+$",
+		response:    reflect.TypeOf(api.Task{}),
+		description: "Return a single Task.",
+	},
+	{
+		resource:    "projects.locations.operations",
+		name:        "get",
+		verb:        "GET",
+		route:       "/v1/projects/{project}/locations/{location}/operations/{operation}",
+		path:        "v1/{+name}",
+		param:       "name",
+		pattern:     "^projects/[^/]+/locations/[^/]+/operations/[^/]+$",
+		response:    reflect.TypeOf(api.Operation{}),
+		description: "Get the latest state of a long-running operation.",
+	},
+}
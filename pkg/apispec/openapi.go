@@ -0,0 +1,123 @@
+package apispec
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+)
+
+// OpenAPIDocument is an OpenAPI 3 document.
+type OpenAPIDocument struct {
+	OpenAPI    string                           `json:"openapi"`
+	Info       *Info                            `json:"info"`
+	Servers    []*Server                        `json:"servers"`
+	Paths      map[string]map[string]*Operation `json:"paths"`
+	Components *Components                      `json:"components"`
+}
+
+// Info describes the API of an OpenAPI document.
+type Info struct {
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Version     string `json:"version"`
+}
+
+// Server is the address the API is served at.
+type Server struct {
+	URL string `json:"url"`
+}
+
+// Operation describes a method of an OpenAPI path.
+type Operation struct {
+	OperationID string               `json:"operationId"`
+	Summary     string               `json:"summary,omitempty"`
+	Parameters  []*OpenAPIParameter  `json:"parameters,omitempty"`
+	RequestBody *RequestBody         `json:"requestBody,omitempty"`
+	Responses   map[string]*Response `json:"responses"`
+}
+
+// OpenAPIParameter describes a path or query parameter of an operation.
+type OpenAPIParameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Required    bool    `json:"required,omitempty"`
+	Description string  `json:"description,omitempty"`
+	Schema      *Schema `json:"schema"`
+}
+
+// RequestBody describes the body of an operation.
+type RequestBody struct {
+	Required bool                  `json:"required"`
+	Content  map[string]*MediaType `json:"content"`
+}
+
+// Response describes a response of an operation.
+type Response struct {
+	Description string                `json:"description"`
+	Content     map[string]*MediaType `json:"content,omitempty"`
+}
+
+// MediaType holds the schema of a body.
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+// Components holds the schemas referred to by the operations.
+type Components struct {
+	Schemas map[string]*Schema `json:"schemas"`
+}
+
+// OpenAPI returns the OpenAPI 3 spec of the v1 Batch API served at serverURL,
+// e.g. http://localhost:8080.
+func OpenAPI(serverURL string) *OpenAPIDocument {
+	schemas := newSchemaBuilder(func(name string) string { return "#/components/schemas/" + name }, false)
+	errorResponse := &Response{Description: "Error", Content: jsonContent(schemas.schema(reflect.TypeOf(api.ErrorResponse{})))}
+	doc := &OpenAPIDocument{
+		OpenAPI: "3.0.3",
+		Info: &Info{
+			Title:       "Batch API",
+			Description: "The Google Cloud Batch API as served by the fake Batch server.",
+			Version:     "v1",
+		},
+		Servers: []*Server{{URL: strings.TrimSuffix(serverURL, "/")}},
+		Paths:   make(map[string]map[string]*Operation),
+	}
+
+	for _, m := range methods {
+		op := &Operation{
+			OperationID: m.id(),
+			Summary:     m.description,
+			Responses: map[string]*Response{
+				"200":     {Description: "Successful response", Content: jsonContent(schemas.schema(m.response))},
+				"default": errorResponse,
+			},
+		}
+		for _, name := range m.pathParams() {
+			op.Parameters = append(op.Parameters, &OpenAPIParameter{Name: name, In: "path", Required: true, Schema: &Schema{Type: "string"}})
+		}
+		for _, q := range m.query {
+			op.Parameters = append(op.Parameters, &OpenAPIParameter{
+				Name:        q.name,
+				In:          "query",
+				Description: q.description,
+				Schema:      &Schema{Type: q.typ, Format: q.format},
+			})
+		}
+		if m.request != nil {
+			op.RequestBody = &RequestBody{Required: true, Content: jsonContent(schemas.schema(m.request))}
+		}
+
+		if doc.Paths[m.route] == nil {
+			doc.Paths[m.route] = make(map[string]*Operation)
+		}
+		doc.Paths[m.route][strings.ToLower(m.verb)] = op
+	}
+
+	doc.Components = &Components{Schemas: schemas.schemas}
+	return doc
+}
+
+func jsonContent(schema *Schema) map[string]*MediaType {
+	return map[string]*MediaType{"application/json": {Schema: schema}}
+}
@@ -0,0 +1,122 @@
+// Package apispec describes the emulated Batch API for generated clients and
+// API tools: a Google discovery document and an OpenAPI 3 spec, both derived
+// from the types of package api so that they follow the wire format the
+// server actually uses.
+package apispec
+
+import (
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+)
+
+// Schema is a JSON schema in the subset shared by discovery documents and
+// OpenAPI 3.
+type Schema struct {
+	// ID names the schema in a discovery document. OpenAPI leaves it unset.
+	ID                   string             `json:"id,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Ref                  string             `json:"$ref,omitempty"`
+	Enum                 []string           `json:"enum,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+}
+
+// enums lists the values of the string types of package api that are enums.
+var enums = map[reflect.Type][]string{
+	reflect.TypeOf(api.JobState("")): {
+		string(api.JobStateUnspecified), string(api.JobStateQueued), string(api.JobStateScheduled),
+		string(api.JobStateRunning), string(api.JobStateSucceeded), string(api.JobStateFailed),
+		string(api.JobStateDeleting), string(api.JobStateDeleted),
+		string(api.JobStateCancellationInProgress), string(api.JobStateCancelled),
+	},
+	reflect.TypeOf(api.TaskState("")): {
+		string(api.TaskStateUnspecified), string(api.TaskStatePending), string(api.TaskStateAssigned),
+		string(api.TaskStateRunning), string(api.TaskStateSucceeded), string(api.TaskStateFailed),
+		string(api.TaskStateAborted),
+	},
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schemaBuilder collects the schemas of the structs reachable from the types
+// it is asked about, keyed by Go type name.
+type schemaBuilder struct {
+	// ref returns the reference to the schema of the named struct.
+	ref func(name string) string
+	// ids sets the ID of each collected schema.
+	ids     bool
+	schemas map[string]*Schema
+}
+
+func newSchemaBuilder(ref func(name string) string, ids bool) *schemaBuilder {
+	return &schemaBuilder{ref: ref, ids: ids, schemas: make(map[string]*Schema)}
+}
+
+// schema returns the schema of values of t, collecting the structs it refers
+// to.
+func (b *schemaBuilder) schema(t reflect.Type) *Schema {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch {
+	case t == timeType:
+		return &Schema{Type: "string", Format: "date-time"}
+	case t.Kind() == reflect.Struct:
+		b.collect(t)
+		return &Schema{Ref: b.ref(t.Name())}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return &Schema{Type: "string", Enum: enums[t]}
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int32:
+		return &Schema{Type: "integer", Format: "int32"}
+	case reflect.Int64:
+		return &Schema{Type: "integer", Format: "int64"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number", Format: "double"}
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: "array", Items: b.schema(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: b.schema(t.Elem())}
+	default:
+		return &Schema{}
+	}
+}
+
+// collect adds the schema of struct t, and of the structs it refers to, unless
+// it is already collected.
+func (b *schemaBuilder) collect(t reflect.Type) {
+	if _, ok := b.schemas[t.Name()]; ok {
+		return
+	}
+	schema := &Schema{Type: "object", Properties: make(map[string]*Schema)}
+	if b.ids {
+		schema.ID = t.Name()
+	}
+	// Registered before the fields so that recursive types terminate.
+	b.schemas[t.Name()] = schema
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		schema.Properties[name] = b.schema(field.Type)
+	}
+}
@@ -0,0 +1,149 @@
+// Package assert provides test helpers that wait for the emulator to reach an
+// expected state. They follow jobs through the watch API instead of polling,
+// so tests neither sleep nor miss short-lived states.
+package assert
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+)
+
+// TestingT is the subset of *testing.T the helpers use.
+type TestingT interface {
+	Helper()
+	Errorf(format string, args ...interface{})
+	FailNow()
+}
+
+// errDeleted is returned by WatchJob when the job was deleted.
+var errDeleted = fmt.Errorf("job was deleted")
+
+// WatchJob calls fn with the job named name, e.g.
+// "projects/p/locations/l/jobs/j", every time it changes, until fn returns
+// true, the job is deleted or ctx is done. baseURL is the versioned API root
+// of the server, e.g. "http://localhost:8080/v1". It returns the job fn
+// accepted.
+func WatchJob(ctx context.Context, client *http.Client, baseURL, name string, fn func(*api.Job) bool) (*api.Job, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL+"/"+name+"/watch", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("watching %s returned %d", name, resp.StatusCode)
+	}
+
+	var event string
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			if event == "deleted" {
+				return nil, errDeleted
+			}
+			var job api.Job
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &job); err != nil {
+				return nil, err
+			}
+			if fn(&job) {
+				return &job, nil
+			}
+		}
+	}
+
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("watch of %s ended unexpectedly", name)
+}
+
+// EventuallyJobState waits up to timeout for the job named name to reach
+// state and returns it. The test fails if the job ends in a different
+// terminal state, is deleted or the timeout expires.
+func EventuallyJobState(t TestingT, client *http.Client, baseURL, name string, state api.JobState, timeout time.Duration) *api.Job {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var last api.JobState
+	job, err := WatchJob(ctx, client, baseURL, name, func(job *api.Job) bool {
+		last = job.State
+		return job.State == state || isTerminal(job.State)
+	})
+	if err != nil {
+		t.Errorf("job %s did not reach %s (last state %s): %v", name, state, last, err)
+		t.FailNow()
+		return nil
+	}
+	if job.State != state {
+		t.Errorf("job %s ended in %s, expected %s", name, job.State, state)
+		t.FailNow()
+	}
+	return job
+}
+
+// TaskStateCounts waits up to timeout for the task counts of task group group
+// of the job named name to equal want, e.g. {"SUCCEEDED": 3}. States missing
+// from want must have no tasks.
+func TaskStateCounts(t TestingT, client *http.Client, baseURL, name, group string, want map[string]int64, timeout time.Duration) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var last map[string]int64
+	_, err := WatchJob(ctx, client, baseURL, name, func(job *api.Job) bool {
+		last = taskCounts(job, group)
+		return reflect.DeepEqual(last, normalize(want))
+	})
+	if err != nil {
+		t.Errorf("task counts of %s group %s never became %v (last %v): %v", name, group, want, last, err)
+		t.FailNow()
+	}
+}
+
+// taskCounts returns the non-zero task counts of group.
+func taskCounts(job *api.Job, group string) map[string]int64 {
+	if job.Status == nil || job.Status.TaskGroups[group] == nil {
+		return map[string]int64{}
+	}
+	return normalize(job.Status.TaskGroups[group].Counts)
+}
+
+// normalize drops zero counts.
+func normalize(counts map[string]int64) map[string]int64 {
+	result := make(map[string]int64, len(counts))
+	for state, count := range counts {
+		if count != 0 {
+			result[state] = count
+		}
+	}
+	return result
+}
+
+func isTerminal(state api.JobState) bool {
+	return state == api.JobStateSucceeded || state == api.JobStateFailed || state == api.JobStateCancelled
+}
@@ -0,0 +1,143 @@
+package assert
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	testify "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+	"github.com/pyshx/fake-batch-server/pkg/clock"
+	"github.com/pyshx/fake-batch-server/pkg/handlers"
+	"github.com/pyshx/fake-batch-server/pkg/storage"
+)
+
+// recorder is a TestingT that records failures instead of stopping the test.
+type recorder struct {
+	errors []string
+	failed bool
+}
+
+func (r *recorder) Helper() {}
+
+func (r *recorder) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func (r *recorder) FailNow() {
+	r.failed = true
+}
+
+func setupServer(t *testing.T) (string, *clock.Fake) {
+	fake := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	handler := handlers.NewHandler(storage.NewMemoryStore(), handlers.WithClock(fake))
+	t.Cleanup(handler.Close)
+
+	router := mux.NewRouter()
+	v1 := router.PathPrefix("/v1").Subrouter()
+	v1.HandleFunc("/projects/{project}/locations/{location}/jobs", handler.CreateJob).Methods("POST")
+	v1.HandleFunc("/projects/{project}/locations/{location}/jobs/{job}", handler.DeleteJob).Methods("DELETE")
+	v1.HandleFunc("/projects/{project}/locations/{location}/jobs/{job}/watch", handler.WatchJob).Methods("GET")
+
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	return server.URL + "/v1", fake
+}
+
+func createJob(t *testing.T, baseURL, query string, taskCount int64) string {
+	body, _ := json.Marshal(api.Job{TaskGroups: []*api.TaskGroup{{TaskCount: taskCount}}})
+	resp, err := http.Post(baseURL+"/projects/p/locations/l/jobs?job_id=job"+query, "application/json", bytes.NewBuffer(body))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var job api.Job
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&job))
+	return job.Name
+}
+
+func TestEventuallyJobState(t *testing.T) {
+	baseURL, fake := setupServer(t)
+	name := createJob(t, baseURL, "", 3)
+
+	job := EventuallyJobState(t, http.DefaultClient, baseURL, name, api.JobStateQueued, time.Second)
+	testify.Equal(t, api.JobStateQueued, job.State)
+
+	fake.Advance(time.Minute)
+	job = EventuallyJobState(t, http.DefaultClient, baseURL, name, api.JobStateSucceeded, time.Second)
+	testify.Equal(t, name, job.Name)
+	TaskStateCounts(t, http.DefaultClient, baseURL, name, "group0", map[string]int64{"SUCCEEDED": 3}, time.Second)
+}
+
+func TestEventuallyJobState_WrongTerminalState(t *testing.T) {
+	baseURL, fake := setupServer(t)
+	name := createJob(t, baseURL, "&final_state=FAILED", 1)
+	fake.Advance(time.Minute)
+
+	r := &recorder{}
+	EventuallyJobState(r, http.DefaultClient, baseURL, name, api.JobStateSucceeded, time.Second)
+	testify.True(t, r.failed)
+	require.Len(t, r.errors, 1)
+	testify.Contains(t, r.errors[0], "ended in FAILED")
+}
+
+func TestEventuallyJobState_Timeout(t *testing.T) {
+	baseURL, _ := setupServer(t)
+	name := createJob(t, baseURL, "", 1)
+
+	r := &recorder{}
+	EventuallyJobState(r, http.DefaultClient, baseURL, name, api.JobStateRunning, 50*time.Millisecond)
+	testify.True(t, r.failed)
+	require.Len(t, r.errors, 1)
+	testify.Contains(t, r.errors[0], "last state QUEUED")
+}
+
+func TestEventuallyJobState_Deleted(t *testing.T) {
+	baseURL, fake := setupServer(t)
+	name := createJob(t, baseURL, "", 1)
+
+	req, _ := http.NewRequest("DELETE", baseURL+"/"+name, nil)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	done := make(chan *recorder)
+	go func() {
+		r := &recorder{}
+		EventuallyJobState(r, http.DefaultClient, baseURL, name, api.JobStateSucceeded, 5*time.Second)
+		done <- r
+	}()
+	// Keep advancing until the pending deletion has registered with the
+	// clock and completed.
+	var r *recorder
+	require.Eventually(t, func() bool {
+		fake.Advance(time.Minute)
+		select {
+		case r = <-done:
+			return true
+		default:
+			return false
+		}
+	}, 5*time.Second, time.Millisecond)
+	testify.True(t, r.failed)
+	require.Len(t, r.errors, 1)
+	testify.Contains(t, r.errors[0], "deleted")
+}
+
+func TestTaskStateCounts_Mismatch(t *testing.T) {
+	baseURL, _ := setupServer(t)
+	name := createJob(t, baseURL, "", 2)
+
+	r := &recorder{}
+	TaskStateCounts(r, http.DefaultClient, baseURL, name, "group0", map[string]int64{"SUCCEEDED": 2}, 50*time.Millisecond)
+	testify.True(t, r.failed)
+	require.Len(t, r.errors, 1)
+	testify.Contains(t, r.errors[0], "last map[PENDING:2]")
+}
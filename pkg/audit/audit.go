@@ -0,0 +1,120 @@
+// Package audit records the API calls made to the emulator so tests can
+// check every call a client made during a run, either by querying the server
+// or from entries exported to a file or an OpenTelemetry collector.
+package audit
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultMaxEntries is the number of entries a Log keeps for querying by
+// default. Sinks receive every entry regardless.
+const DefaultMaxEntries = 10000
+
+// Entry is a single API call.
+type Entry struct {
+	Time   time.Time `json:"time"`
+	Method string    `json:"method"`
+	Path   string    `json:"path"`
+	// Route is the path template the call matched, e.g.
+	// "/v1/projects/{project}/locations/{location}/jobs".
+	Route string `json:"route,omitempty"`
+	// Project is the project named in the path, if any.
+	Project string `json:"project,omitempty"`
+	Status  int    `json:"status"`
+	// LatencySeconds is the time taken to handle the call.
+	LatencySeconds float64 `json:"latencySeconds"`
+	RemoteAddr     string  `json:"remoteAddr,omitempty"`
+	UserAgent      string  `json:"userAgent,omitempty"`
+}
+
+// Sink receives every entry recorded by a Log, as it is recorded.
+type Sink interface {
+	Write(entry *Entry)
+	// Close flushes pending entries and releases the sink.
+	Close() error
+}
+
+// Filter selects entries. Empty fields match any entry.
+type Filter struct {
+	Project string
+	Method  string
+	// Since, if set, drops entries recorded before it.
+	Since time.Time
+}
+
+func (f Filter) matches(entry *Entry) bool {
+	return (f.Project == "" || entry.Project == f.Project) &&
+		(f.Method == "" || entry.Method == f.Method) &&
+		(f.Since.IsZero() || !entry.Time.Before(f.Since))
+}
+
+// Log keeps the most recent entries in memory and forwards all of them to
+// its sinks.
+type Log struct {
+	max int
+
+	mu      sync.Mutex
+	entries []*Entry
+	sinks   []Sink
+}
+
+// NewLog creates a log keeping up to max entries, or DefaultMaxEntries if
+// max is not positive, and forwarding entries to sinks.
+func NewLog(max int, sinks ...Sink) *Log {
+	if max <= 0 {
+		max = DefaultMaxEntries
+	}
+	return &Log{max: max, sinks: sinks}
+}
+
+// Record adds entry to the log and writes it to the sinks.
+func (l *Log) Record(entry *Entry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.entries = append(l.entries, entry)
+	if len(l.entries) > l.max {
+		l.entries = append([]*Entry(nil), l.entries[len(l.entries)-l.max:]...)
+	}
+	for _, sink := range l.sinks {
+		sink.Write(entry)
+	}
+}
+
+// Entries returns the kept entries matching filter, oldest first.
+func (l *Log) Entries(filter Filter) []*Entry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entries := []*Entry{}
+	for _, entry := range l.entries {
+		if filter.matches(entry) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// Reset drops the kept entries. Entries already written to sinks stay there.
+func (l *Log) Reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = nil
+}
+
+// Close closes the sinks, returning the first error.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var first error
+	for _, sink := range l.sinks {
+		if err := sink.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	l.sinks = nil
+	return first
+}
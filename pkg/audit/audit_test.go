@@ -0,0 +1,98 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var start = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func TestLog(t *testing.T) {
+	log := NewLog(3)
+	log.Record(&Entry{Time: start, Method: "POST", Path: "/v1/projects/a/locations/l/jobs", Project: "a", Status: 200})
+	log.Record(&Entry{Time: start.Add(time.Second), Method: "GET", Path: "/v1/projects/a/locations/l/jobs/j", Project: "a", Status: 200})
+	log.Record(&Entry{Time: start.Add(2 * time.Second), Method: "GET", Path: "/v1/projects/b/locations/l/jobs/j", Project: "b", Status: 404})
+
+	assert.Len(t, log.Entries(Filter{}), 3)
+	assert.Len(t, log.Entries(Filter{Project: "a"}), 2)
+	assert.Len(t, log.Entries(Filter{Project: "a", Method: "GET"}), 1)
+	assert.Len(t, log.Entries(Filter{Since: start.Add(time.Second)}), 2)
+
+	// Only the most recent entries are kept.
+	log.Record(&Entry{Time: start.Add(3 * time.Second), Method: "DELETE", Project: "a"})
+	entries := log.Entries(Filter{})
+	require.Len(t, entries, 3)
+	assert.Equal(t, "GET", entries[0].Method)
+	assert.Equal(t, "DELETE", entries[2].Method)
+
+	log.Reset()
+	assert.Empty(t, log.Entries(Filter{}))
+}
+
+func TestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	sink, err := NewFile(path)
+	require.NoError(t, err)
+
+	log := NewLog(1, sink)
+	log.Record(&Entry{Time: start, Method: "POST", Path: "/v1/a", Status: 200})
+	log.Record(&Entry{Time: start, Method: "GET", Path: "/v1/b", Status: 404})
+	require.NoError(t, log.Close())
+	// Writes after closing are ignored.
+	sink.Write(&Entry{Method: "GET"})
+
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+
+	var methods []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry Entry
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &entry))
+		methods = append(methods, entry.Method)
+	}
+	assert.Equal(t, []string{"POST", "GET"}, methods, "every entry reaches the file, not just the kept ones")
+}
+
+func TestOTLP(t *testing.T) {
+	var mu sync.Mutex
+	var requests []otlpRequest
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/logs", r.URL.Path)
+		var request otlpRequest
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, request)
+	}))
+	defer collector.Close()
+
+	exporter := NewOTLP(collector.URL, "fake-batch-server", time.Second)
+	exporter.Write(&Entry{Time: start, Method: "POST", Path: "/v1/projects/p/locations/l/jobs", Project: "p", Status: 200})
+	exporter.Write(&Entry{Time: start, Method: "GET", Path: "/v1/projects/p/locations/l/jobs/missing", Project: "p", Status: 404})
+	require.NoError(t, exporter.Close())
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, requests, 1)
+	records := requests[0].ResourceLogs[0].ScopeLogs[0].LogRecords
+	require.Len(t, records, 2)
+	assert.Equal(t, "POST /v1/projects/p/locations/l/jobs 200", *records[0].Body.StringValue)
+	assert.Equal(t, severityInfo, records[0].SeverityNumber)
+	assert.Equal(t, severityWarn, records[1].SeverityNumber)
+	assert.Contains(t, records[0].Attributes, otlpAttribute{Key: "gcp.project_id", Value: stringValue("p")})
+
+	// Entries written after closing are dropped.
+	exporter.Write(&Entry{Method: "GET"})
+}
@@ -0,0 +1,54 @@
+package audit
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// File appends entries to a file as JSON lines.
+type File struct {
+	path string
+
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+// NewFile opens path for appending entries, creating it if needed.
+func NewFile(path string) (*File, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &File{path: path, file: file, enc: json.NewEncoder(file)}, nil
+}
+
+// Write appends entry to the file. Entries are written straight through so
+// the file is complete even if the server is killed.
+func (f *File) Write(entry *Entry) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return
+	}
+	if err := f.enc.Encode(entry); err != nil {
+		logrus.Warnf("Failed to write audit entry to %s: %v", f.path, err)
+	}
+}
+
+// Close closes the file.
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
@@ -0,0 +1,244 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// OTLP batching limits.
+const (
+	otlpQueueSize     = 4096
+	otlpBatchSize     = 512
+	otlpFlushInterval = 5 * time.Second
+)
+
+// OpenTelemetry severity numbers of entries, by status class.
+const (
+	severityInfo  = 9
+	severityWarn  = 13
+	severityError = 17
+)
+
+// OTLP exports entries as log records in batches to an OTLP/HTTP collector
+// using the JSON encoding.
+type OTLP struct {
+	client  *http.Client
+	url     string
+	service string
+
+	entries chan *Entry
+	flush   chan chan struct{}
+	done    chan struct{}
+	once    sync.Once
+}
+
+// NewOTLP creates an exporter sending the entries of service to the
+// collector at endpoint, e.g. "http://localhost:4318". Entries are sent
+// every few seconds until Close.
+func NewOTLP(endpoint, service string, timeout time.Duration) *OTLP {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "http://" + endpoint
+	}
+	e := &OTLP{
+		client:  &http.Client{Timeout: timeout},
+		url:     strings.TrimSuffix(endpoint, "/") + "/v1/logs",
+		service: service,
+		entries: make(chan *Entry, otlpQueueSize),
+		flush:   make(chan chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go e.loop()
+	return e
+}
+
+// Write queues entry for sending. Entries are dropped when the queue is full
+// or the exporter has been closed.
+func (e *OTLP) Write(entry *Entry) {
+	select {
+	case <-e.done:
+		return
+	default:
+	}
+
+	select {
+	case e.entries <- entry:
+	default:
+		logrus.Debugf("Dropping audit entry for %s %s: export queue is full", entry.Method, entry.Path)
+	}
+}
+
+// Flush sends the queued entries and waits until they have been sent.
+func (e *OTLP) Flush() {
+	flushed := make(chan struct{})
+	select {
+	case e.flush <- flushed:
+		<-flushed
+	case <-e.done:
+	}
+}
+
+// Close sends the queued entries and stops the exporter.
+func (e *OTLP) Close() error {
+	e.Flush()
+	e.once.Do(func() { close(e.done) })
+	return nil
+}
+
+func (e *OTLP) loop() {
+	ticker := time.NewTicker(otlpFlushInterval)
+	defer ticker.Stop()
+
+	var batch []*Entry
+	send := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := e.send(batch); err != nil {
+			logrus.Warnf("Failed to export %d audit entries to %s: %v", len(batch), e.url, err)
+		}
+		batch = nil
+	}
+
+	for {
+		select {
+		case entry := <-e.entries:
+			batch = append(batch, entry)
+			if len(batch) >= otlpBatchSize {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		case flushed := <-e.flush:
+			for drained := false; !drained; {
+				select {
+				case entry := <-e.entries:
+					batch = append(batch, entry)
+				default:
+					drained = true
+				}
+			}
+			send()
+			close(flushed)
+		case <-e.done:
+			return
+		}
+	}
+}
+
+// send posts entries to the collector.
+func (e *OTLP) send(entries []*Entry) error {
+	body, err := json.Marshal(e.request(entries))
+	if err != nil {
+		return err
+	}
+
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("collector returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// The OTLP/JSON encoding of an ExportLogsServiceRequest.
+type (
+	otlpRequest struct {
+		ResourceLogs []otlpResourceLogs `json:"resourceLogs"`
+	}
+	otlpResourceLogs struct {
+		Resource  otlpResource    `json:"resource"`
+		ScopeLogs []otlpScopeLogs `json:"scopeLogs"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+	otlpScopeLogs struct {
+		Scope      otlpScope       `json:"scope"`
+		LogRecords []otlpLogRecord `json:"logRecords"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpLogRecord struct {
+		TimeUnixNano   string          `json:"timeUnixNano"`
+		SeverityNumber int             `json:"severityNumber"`
+		SeverityText   string          `json:"severityText"`
+		Body           otlpValue       `json:"body"`
+		Attributes     []otlpAttribute `json:"attributes"`
+	}
+	otlpAttribute struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpValue struct {
+		StringValue *string  `json:"stringValue,omitempty"`
+		IntValue    *string  `json:"intValue,omitempty"`
+		DoubleValue *float64 `json:"doubleValue,omitempty"`
+	}
+)
+
+func stringValue(s string) otlpValue {
+	return otlpValue{StringValue: &s}
+}
+
+func intValue(i int) otlpValue {
+	s := strconv.Itoa(i)
+	return otlpValue{IntValue: &s}
+}
+
+func (e *OTLP) request(entries []*Entry) *otlpRequest {
+	records := make([]otlpLogRecord, 0, len(entries))
+	for _, entry := range entries {
+		severity, text := severityInfo, "INFO"
+		switch {
+		case entry.Status >= 500:
+			severity, text = severityError, "ERROR"
+		case entry.Status >= 400:
+			severity, text = severityWarn, "WARN"
+		}
+
+		latency := entry.LatencySeconds
+		attributes := []otlpAttribute{
+			{Key: "http.request.method", Value: stringValue(entry.Method)},
+			{Key: "url.path", Value: stringValue(entry.Path)},
+			{Key: "http.response.status_code", Value: intValue(entry.Status)},
+			{Key: "http.server.request.duration", Value: otlpValue{DoubleValue: &latency}},
+		}
+		optional := []struct{ key, value string }{
+			{"http.route", entry.Route},
+			{"gcp.project_id", entry.Project},
+			{"client.address", entry.RemoteAddr},
+			{"user_agent.original", entry.UserAgent},
+		}
+		for _, attribute := range optional {
+			if attribute.value != "" {
+				attributes = append(attributes, otlpAttribute{Key: attribute.key, Value: stringValue(attribute.value)})
+			}
+		}
+
+		records = append(records, otlpLogRecord{
+			TimeUnixNano:   strconv.FormatInt(entry.Time.UnixNano(), 10),
+			SeverityNumber: severity,
+			SeverityText:   text,
+			Body:           stringValue(fmt.Sprintf("%s %s %d", entry.Method, entry.Path, entry.Status)),
+			Attributes:     attributes,
+		})
+	}
+
+	return &otlpRequest{ResourceLogs: []otlpResourceLogs{{
+		Resource:  otlpResource{Attributes: []otlpAttribute{{Key: "service.name", Value: stringValue(e.service)}}},
+		ScopeLogs: []otlpScopeLogs{{Scope: otlpScope{Name: e.service + "/audit"}, LogRecords: records}},
+	}}}
+}
@@ -0,0 +1,96 @@
+// Package auth implements a fake bearer-token authentication layer, so
+// clients can check that they send credentials and handle 401 and 403
+// responses.
+package auth
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// AnyProject in a token's projects allows every project.
+const AnyProject = "*"
+
+// Token is a bearer token and the projects it may access.
+type Token struct {
+	Token string `yaml:"token"`
+	// Name identifies the caller in logs, e.g. "ci".
+	Name string `yaml:"name"`
+	// Projects are the project IDs the token may access, or AnyProject.
+	Projects []string `yaml:"projects"`
+}
+
+// Allows reports whether t may access project.
+func (t *Token) Allows(project string) bool {
+	for _, p := range t.Projects {
+		if p == AnyProject || p == project {
+			return true
+		}
+	}
+	return false
+}
+
+// Tokens holds the accepted tokens.
+type Tokens struct {
+	tokens map[string]*Token
+}
+
+// NewTokens creates Tokens accepting tokens. Tokens must be unique and
+// non-empty.
+func NewTokens(tokens []*Token) (*Tokens, error) {
+	t := &Tokens{tokens: make(map[string]*Token, len(tokens))}
+	for i, token := range tokens {
+		if token.Token == "" {
+			return nil, fmt.Errorf("tokens[%d]: token is required", i)
+		}
+		if _, ok := t.tokens[token.Token]; ok {
+			return nil, fmt.Errorf("tokens[%d]: duplicate token", i)
+		}
+		if token.Name == "" {
+			token.Name = fmt.Sprintf("tokens[%d]", i)
+		}
+		t.tokens[token.Token] = token
+	}
+	return t, nil
+}
+
+// Load reads the tokens of a YAML/JSON file of the form
+// {"tokens": [{"token": "secret", "name": "ci", "projects": ["p"]}]}.
+func Load(path string) (*Tokens, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config struct {
+		Tokens []*Token `yaml:"tokens"`
+	}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse auth config %s: %v", path, err)
+	}
+	tokens, err := NewTokens(config.Tokens)
+	if err != nil {
+		return nil, fmt.Errorf("invalid auth config %s: %v", path, err)
+	}
+	return tokens, nil
+}
+
+// Authenticate returns the token of an Authorization header value of the form
+// "Bearer <token>".
+func (t *Tokens) Authenticate(header string) (*Token, error) {
+	if header == "" {
+		return nil, fmt.Errorf("request is missing an Authorization header")
+	}
+	scheme, credentials, _ := strings.Cut(header, " ")
+	if !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(credentials) == "" {
+		return nil, fmt.Errorf("Authorization header must be a Bearer token")
+	}
+	token, ok := t.tokens[strings.TrimSpace(credentials)]
+	if !ok {
+		return nil, fmt.Errorf("invalid bearer token")
+	}
+	return token, nil
+}
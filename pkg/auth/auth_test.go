@@ -0,0 +1,48 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "auth.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+tokens:
+  - token: ci-token
+    name: ci
+    projects: [proj-a, proj-b]
+  - token: admin-token
+    projects: ["*"]
+`), 0o644))
+
+	tokens, err := Load(path)
+	require.NoError(t, err)
+
+	token, err := tokens.Authenticate("Bearer ci-token")
+	require.NoError(t, err)
+	assert.Equal(t, "ci", token.Name)
+	assert.True(t, token.Allows("proj-a"))
+	assert.False(t, token.Allows("proj-c"))
+
+	token, err = tokens.Authenticate("bearer admin-token")
+	require.NoError(t, err)
+	assert.Equal(t, "tokens[1]", token.Name)
+	assert.True(t, token.Allows("anything"))
+
+	for _, header := range []string{"", "Bearer", "Basic Y2k6dG9rZW4=", "Bearer wrong"} {
+		_, err := tokens.Authenticate(header)
+		assert.Error(t, err, header)
+	}
+}
+
+func TestNewTokens_Invalid(t *testing.T) {
+	_, err := NewTokens([]*Token{{Projects: []string{"p"}}})
+	assert.Error(t, err)
+	_, err = NewTokens([]*Token{{Token: "a"}, {Token: "a"}})
+	assert.Error(t, err)
+}
@@ -0,0 +1,166 @@
+// Package blobstore is a small in-memory object store served by the emulator
+// itself, for staging task inputs and outputs where a separate Cloud Storage
+// emulator cannot be run.
+package blobstore
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pyshx/fake-batch-server/pkg/clock"
+)
+
+// DefaultContentType is the content type of objects stored without one.
+const DefaultContentType = "application/octet-stream"
+
+// Object describes a stored object.
+type Object struct {
+	Bucket      string    `json:"bucket"`
+	Name        string    `json:"name"`
+	Size        int64     `json:"size"`
+	ContentType string    `json:"contentType"`
+	Updated     time.Time `json:"updated"`
+}
+
+// entry is a stored object with its data.
+type entry struct {
+	Object
+	data []byte
+}
+
+// Store holds objects by bucket and name. Buckets exist as soon as an object
+// is stored in them.
+type Store struct {
+	clock clock.Clock
+
+	mu      sync.RWMutex
+	objects map[string]*entry
+}
+
+// NewStore creates an empty store timestamping objects with clk.
+func NewStore(clk clock.Clock) *Store {
+	return &Store{clock: clk, objects: make(map[string]*entry)}
+}
+
+func key(bucket, name string) string {
+	return bucket + "/" + name
+}
+
+// Put stores data as object name in bucket, replacing any previous version.
+func (s *Store) Put(bucket, name, contentType string, data []byte) *Object {
+	if contentType == "" {
+		contentType = DefaultContentType
+	}
+	e := &entry{
+		Object: Object{
+			Bucket:      bucket,
+			Name:        name,
+			Size:        int64(len(data)),
+			ContentType: contentType,
+			Updated:     s.clock.Now().UTC(),
+		},
+		data: data,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[key(bucket, name)] = e
+	object := e.Object
+	return &object
+}
+
+// Get returns object name in bucket and its data. It reports false if there
+// is no such object.
+func (s *Store) Get(bucket, name string) (*Object, []byte, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	e, ok := s.objects[key(bucket, name)]
+	if !ok {
+		return nil, nil, false
+	}
+	object := e.Object
+	return &object, e.data, true
+}
+
+// Delete removes object name from bucket. It reports false if there was no
+// such object.
+func (s *Store) Delete(bucket, name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k := key(bucket, name)
+	if _, ok := s.objects[k]; !ok {
+		return false
+	}
+	delete(s.objects, k)
+	return true
+}
+
+// List returns the objects in bucket whose name starts with prefix, sorted by
+// name.
+func (s *Store) List(bucket, prefix string) []*Object {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	objects := []*Object{}
+	for _, e := range s.objects {
+		if e.Bucket == bucket && strings.HasPrefix(e.Name, prefix) {
+			object := e.Object
+			objects = append(objects, &object)
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Name < objects[j].Name })
+	return objects
+}
+
+// Reset removes every object.
+func (s *Store) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects = make(map[string]*entry)
+}
+
+// Writer returns a writer that collects its input and stores it as object
+// name in bucket when closed, like an upload to Cloud Storage. Nothing is
+// stored if nothing was written.
+func (s *Store) Writer(bucket, name string) io.WriteCloser {
+	return &writer{store: s, bucket: bucket, name: name}
+}
+
+// writer buffers an object until it is closed.
+type writer struct {
+	store  *Store
+	bucket string
+	name   string
+
+	mu     sync.Mutex
+	buf    bytes.Buffer
+	closed bool
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return 0, fmt.Errorf("write to closed object %s/%s", w.bucket, w.name)
+	}
+	return w.buf.Write(p)
+}
+
+func (w *writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.closed && w.buf.Len() > 0 {
+		w.store.Put(w.bucket, w.name, "text/plain; charset=utf-8", bytes.Clone(w.buf.Bytes()))
+	}
+	w.closed = true
+	return nil
+}
@@ -0,0 +1,122 @@
+package blobstore
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pyshx/fake-batch-server/pkg/clock"
+)
+
+func TestStore(t *testing.T) {
+	fake := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	store := NewStore(fake)
+
+	object := store.Put("bucket", "inputs/a.txt", "", []byte("hello"))
+	assert.Equal(t, &Object{Bucket: "bucket", Name: "inputs/a.txt", Size: 5, ContentType: DefaultContentType, Updated: fake.Now()}, object)
+	store.Put("bucket", "inputs/b.txt", "text/plain", []byte("b"))
+	store.Put("bucket", "outputs/c.txt", "text/plain", []byte("c"))
+	store.Put("other", "inputs/d.txt", "text/plain", []byte("d"))
+
+	got, data, ok := store.Get("bucket", "inputs/a.txt")
+	require.True(t, ok)
+	assert.Equal(t, object, got)
+	assert.Equal(t, "hello", string(data))
+
+	var names []string
+	for _, object := range store.List("bucket", "inputs/") {
+		names = append(names, object.Name)
+	}
+	assert.Equal(t, []string{"inputs/a.txt", "inputs/b.txt"}, names)
+
+	assert.True(t, store.Delete("bucket", "inputs/a.txt"))
+	assert.False(t, store.Delete("bucket", "inputs/a.txt"))
+	_, _, ok = store.Get("bucket", "inputs/a.txt")
+	assert.False(t, ok)
+
+	store.Reset()
+	assert.Empty(t, store.List("bucket", ""))
+}
+
+func TestStore_Writer(t *testing.T) {
+	store := NewStore(clock.Real())
+
+	w := store.Writer("bucket", "logs/task-0.log")
+	io.WriteString(w, "line 1\n")
+	_, _, ok := store.Get("bucket", "logs/task-0.log")
+	assert.False(t, ok, "objects are only stored once closed")
+	io.WriteString(w, "line 2\n")
+	require.NoError(t, w.Close())
+
+	_, data, ok := store.Get("bucket", "logs/task-0.log")
+	require.True(t, ok)
+	assert.Equal(t, "line 1\nline 2\n", string(data))
+	_, err := io.WriteString(w, "late")
+	assert.Error(t, err)
+
+	require.NoError(t, store.Writer("bucket", "empty.log").Close())
+	_, _, ok = store.Get("bucket", "empty.log")
+	assert.False(t, ok)
+}
+
+func TestHandler(t *testing.T) {
+	store := NewStore(clock.Real())
+	server := httptest.NewServer(Handler(store, "/storage/"))
+	defer server.Close()
+
+	do := func(method, path, contentType, body string) *http.Response {
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		require.NoError(t, err)
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	resp := do("PUT", "/storage/bucket/inputs/data.csv", "text/csv", "a,b\n1,2\n")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var object Object
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&object))
+	assert.Equal(t, "inputs/data.csv", object.Name)
+	assert.Equal(t, int64(8), object.Size)
+
+	resp = do("GET", "/storage/bucket/inputs/data.csv", "", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/csv", resp.Header.Get("Content-Type"))
+	data, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, "a,b\n1,2\n", string(data))
+
+	req, _ := http.NewRequest("GET", server.URL+"/storage/bucket/inputs/data.csv", nil)
+	req.Header.Set("Range", "bytes=4-")
+	ranged, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer ranged.Body.Close()
+	assert.Equal(t, http.StatusPartialContent, ranged.StatusCode)
+	data, _ = io.ReadAll(ranged.Body)
+	assert.Equal(t, "1,2\n", string(data))
+
+	do("PUT", "/storage/bucket/outputs/result.txt", "", "done")
+	resp = do("GET", "/storage/bucket?prefix=inputs/", "", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var list ListResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&list))
+	require.Len(t, list.Items, 1)
+	assert.Equal(t, "inputs/data.csv", list.Items[0].Name)
+
+	assert.Equal(t, http.StatusNoContent, do("DELETE", "/storage/bucket/inputs/data.csv", "", "").StatusCode)
+	assert.Equal(t, http.StatusNotFound, do("GET", "/storage/bucket/inputs/data.csv", "", "").StatusCode)
+	assert.Equal(t, http.StatusNotFound, do("DELETE", "/storage/bucket/inputs/data.csv", "", "").StatusCode)
+	assert.Equal(t, http.StatusMethodNotAllowed, do("POST", "/storage/bucket/outputs/result.txt", "", "").StatusCode)
+	assert.Equal(t, http.StatusMethodNotAllowed, do("PUT", "/storage/bucket", "", "").StatusCode)
+	assert.Equal(t, http.StatusNotFound, do("GET", "/storage/", "", "").StatusCode)
+}
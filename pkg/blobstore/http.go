@@ -0,0 +1,81 @@
+package blobstore
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+)
+
+// ListResponse is the body returned when listing a bucket.
+type ListResponse struct {
+	Items []*Object `json:"items"`
+}
+
+// Handler serves the objects of store for requests under prefix, e.g.
+// "/storage/":
+//
+//	PUT    {prefix}{bucket}/{object}    stores the request body
+//	GET    {prefix}{bucket}/{object}    returns it, honouring Range headers
+//	DELETE {prefix}{bucket}/{object}    removes it
+//	GET    {prefix}{bucket}?prefix=...  lists the objects of the bucket
+func Handler(store *Store, prefix string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bucket, name, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, prefix), "/")
+		if bucket == "" {
+			writeError(w, http.StatusNotFound, "Bucket not specified")
+			return
+		}
+
+		if name == "" {
+			if r.Method != http.MethodGet {
+				writeError(w, http.StatusMethodNotAllowed, "Method %s not allowed on bucket %s", r.Method, bucket)
+				return
+			}
+			writeJSON(w, http.StatusOK, &ListResponse{Items: store.List(bucket, r.URL.Query().Get("prefix"))})
+			return
+		}
+
+		switch r.Method {
+		case http.MethodPut:
+			data, err := io.ReadAll(r.Body)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "Failed to read request body: %v", err)
+				return
+			}
+			writeJSON(w, http.StatusOK, store.Put(bucket, name, r.Header.Get("Content-Type"), data))
+		case http.MethodGet, http.MethodHead:
+			object, data, ok := store.Get(bucket, name)
+			if !ok {
+				writeError(w, http.StatusNotFound, "Object %s/%s not found", bucket, name)
+				return
+			}
+			w.Header().Set("Content-Type", object.ContentType)
+			http.ServeContent(w, r, name, object.Updated, bytes.NewReader(data))
+		case http.MethodDelete:
+			if !store.Delete(bucket, name) {
+				writeError(w, http.StatusNotFound, "Object %s/%s not found", bucket, name)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "Method %s not allowed on objects", r.Method)
+		}
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, format string, args ...interface{}) {
+	writeJSON(w, status, &api.ErrorResponse{
+		Error: &api.Status{Code: status, Message: fmt.Sprintf(format, args...)},
+	})
+}
@@ -0,0 +1,171 @@
+package catalog
+
+import "fmt"
+
+// series is a series of predefined machine types, e.g. n2-standard, with
+// memoryGiB of memory per vCPU.
+type series struct {
+	name      string
+	memoryGiB float64
+	cpus      []int64
+}
+
+var builtinSeries = []series{
+	{"e2-standard", 4, []int64{2, 4, 8, 16, 32}},
+	{"e2-highmem", 8, []int64{2, 4, 8, 16}},
+	{"e2-highcpu", 1, []int64{2, 4, 8, 16, 32}},
+	{"n1-standard", 3.75, []int64{1, 2, 4, 8, 16, 32, 64, 96}},
+	{"n1-highmem", 6.5, []int64{2, 4, 8, 16, 32, 64, 96}},
+	{"n1-highcpu", 0.9, []int64{2, 4, 8, 16, 32, 64, 96}},
+	{"n2-standard", 4, []int64{2, 4, 8, 16, 32, 48, 64, 80, 96, 128}},
+	{"n2-highmem", 8, []int64{2, 4, 8, 16, 32, 48, 64, 80, 96, 128}},
+	{"n2-highcpu", 1, []int64{2, 4, 8, 16, 32, 48, 64, 80, 96}},
+	{"n2d-standard", 4, []int64{2, 4, 8, 16, 32, 48, 64, 80, 96, 128, 224}},
+	{"n2d-highmem", 8, []int64{2, 4, 8, 16, 32, 48, 64, 80, 96}},
+	{"n2d-highcpu", 1, []int64{2, 4, 8, 16, 32, 48, 64, 80, 96, 128, 224}},
+	{"c2-standard", 4, []int64{4, 8, 16, 30, 60}},
+	{"c2d-standard", 4, []int64{2, 4, 8, 16, 32, 56, 112}},
+	{"c2d-highmem", 8, []int64{2, 4, 8, 16, 32, 56, 112}},
+	{"c2d-highcpu", 2, []int64{2, 4, 8, 16, 32, 56, 112}},
+	{"c3-standard", 4, []int64{4, 8, 22, 44, 88, 176}},
+	{"c3-highmem", 8, []int64{4, 8, 22, 44, 88, 176}},
+	{"c3-highcpu", 2, []int64{4, 8, 22, 44, 88, 176}},
+	{"t2d-standard", 4, []int64{1, 2, 4, 8, 16, 32, 48, 60}},
+}
+
+// builtinMachineTypes are the machine types that do not belong to a series.
+var builtinMachineTypes = []MachineType{
+	{Name: "e2-micro", CPUs: 2, MemoryMib: 1024},
+	{Name: "e2-small", CPUs: 2, MemoryMib: 2048},
+	{Name: "e2-medium", CPUs: 2, MemoryMib: 4096},
+	{Name: "m1-megamem-96", CPUs: 96, MemoryMib: 1468006},
+	{Name: "m1-ultramem-40", CPUs: 40, MemoryMib: 984064},
+	{Name: "m1-ultramem-80", CPUs: 80, MemoryMib: 1968128},
+	{Name: "m1-ultramem-160", CPUs: 160, MemoryMib: 3936256},
+	{Name: "a2-highgpu-1g", CPUs: 12, MemoryMib: 87040, Accelerator: "nvidia-tesla-a100", GPUs: 1},
+	{Name: "a2-highgpu-2g", CPUs: 24, MemoryMib: 174080, Accelerator: "nvidia-tesla-a100", GPUs: 2},
+	{Name: "a2-highgpu-4g", CPUs: 48, MemoryMib: 348160, Accelerator: "nvidia-tesla-a100", GPUs: 4},
+	{Name: "a2-highgpu-8g", CPUs: 96, MemoryMib: 696320, Accelerator: "nvidia-tesla-a100", GPUs: 8},
+	{Name: "a2-megagpu-16g", CPUs: 96, MemoryMib: 1392640, Accelerator: "nvidia-tesla-a100", GPUs: 16},
+	{Name: "a2-ultragpu-1g", CPUs: 12, MemoryMib: 174080, Accelerator: "nvidia-a100-80gb", GPUs: 1},
+	{Name: "a2-ultragpu-2g", CPUs: 24, MemoryMib: 348160, Accelerator: "nvidia-a100-80gb", GPUs: 2},
+	{Name: "a2-ultragpu-4g", CPUs: 48, MemoryMib: 696320, Accelerator: "nvidia-a100-80gb", GPUs: 4},
+	{Name: "a2-ultragpu-8g", CPUs: 96, MemoryMib: 1392640, Accelerator: "nvidia-a100-80gb", GPUs: 8},
+	{Name: "a3-highgpu-8g", CPUs: 208, MemoryMib: 1916928, Accelerator: "nvidia-h100-80gb", GPUs: 8},
+	{Name: "g2-standard-4", CPUs: 4, MemoryMib: 16384, Accelerator: "nvidia-l4", GPUs: 1},
+	{Name: "g2-standard-8", CPUs: 8, MemoryMib: 32768, Accelerator: "nvidia-l4", GPUs: 1},
+	{Name: "g2-standard-12", CPUs: 12, MemoryMib: 49152, Accelerator: "nvidia-l4", GPUs: 1},
+	{Name: "g2-standard-16", CPUs: 16, MemoryMib: 65536, Accelerator: "nvidia-l4", GPUs: 1},
+	{Name: "g2-standard-24", CPUs: 24, MemoryMib: 98304, Accelerator: "nvidia-l4", GPUs: 2},
+	{Name: "g2-standard-32", CPUs: 32, MemoryMib: 131072, Accelerator: "nvidia-l4", GPUs: 1},
+	{Name: "g2-standard-48", CPUs: 48, MemoryMib: 196608, Accelerator: "nvidia-l4", GPUs: 4},
+	{Name: "g2-standard-96", CPUs: 96, MemoryMib: 393216, Accelerator: "nvidia-l4", GPUs: 8},
+}
+
+// customFamilies are the families with custom machine types.
+var customFamilies = map[string]bool{"e2": true, "n1": true, "n2": true, "n2d": true}
+
+// generalFamilies are offered in every region.
+var generalFamilies = []string{"e2", "n1", "n2", "n2d"}
+
+// builtinRegions lists the families, besides generalFamilies, and the
+// accelerator types each region offers.
+var builtinRegions = map[string]Region{
+	"us-central1": {
+		Families:     []string{"c2", "c2d", "c3", "t2d", "m1", "a2", "a3", "g2"},
+		Accelerators: []string{"nvidia-tesla-t4", "nvidia-tesla-v100", "nvidia-tesla-p100", "nvidia-tesla-p4", "nvidia-tesla-a100", "nvidia-a100-80gb", "nvidia-l4", "nvidia-h100-80gb"},
+	},
+	"us-east1": {
+		Families:     []string{"c2", "c2d", "c3", "t2d", "m1", "g2"},
+		Accelerators: []string{"nvidia-tesla-t4", "nvidia-tesla-v100", "nvidia-tesla-p100", "nvidia-l4"},
+	},
+	"us-east4": {
+		Families:     []string{"c2", "c2d", "c3", "t2d", "m1", "a2", "a3", "g2"},
+		Accelerators: []string{"nvidia-tesla-t4", "nvidia-tesla-p4", "nvidia-a100-80gb", "nvidia-l4", "nvidia-h100-80gb"},
+	},
+	"us-west1": {
+		Families:     []string{"c2", "c2d", "c3", "t2d", "m1", "a2", "g2"},
+		Accelerators: []string{"nvidia-tesla-t4", "nvidia-tesla-v100", "nvidia-tesla-p100", "nvidia-tesla-a100", "nvidia-l4"},
+	},
+	"us-west2": {
+		Families:     []string{"c2", "c3"},
+		Accelerators: []string{"nvidia-tesla-t4", "nvidia-tesla-p4"},
+	},
+	"us-west4": {
+		Families:     []string{"c2", "c2d", "c3", "t2d", "m1", "a2", "a3", "g2"},
+		Accelerators: []string{"nvidia-tesla-t4", "nvidia-tesla-a100", "nvidia-l4", "nvidia-h100-80gb"},
+	},
+	"northamerica-northeast1": {
+		Families:     []string{"c2", "c2d", "c3"},
+		Accelerators: []string{"nvidia-tesla-t4", "nvidia-tesla-p4"},
+	},
+	"southamerica-east1": {
+		Families:     []string{"c2", "c2d", "c3", "t2d"},
+		Accelerators: []string{"nvidia-tesla-t4"},
+	},
+	"europe-west1": {
+		Families:     []string{"c2", "c2d", "c3", "t2d", "m1", "g2"},
+		Accelerators: []string{"nvidia-tesla-t4", "nvidia-tesla-p100", "nvidia-l4"},
+	},
+	"europe-west2": {
+		Families:     []string{"c2", "c2d", "c3", "t2d", "m1", "g2"},
+		Accelerators: []string{"nvidia-tesla-t4", "nvidia-l4"},
+	},
+	"europe-west3": {
+		Families:     []string{"c2", "c2d", "c3", "m1"},
+		Accelerators: []string{"nvidia-tesla-t4"},
+	},
+	"europe-west4": {
+		Families:     []string{"c2", "c2d", "c3", "t2d", "m1", "a2", "a3", "g2"},
+		Accelerators: []string{"nvidia-tesla-t4", "nvidia-tesla-v100", "nvidia-tesla-p100", "nvidia-tesla-p4", "nvidia-tesla-a100", "nvidia-a100-80gb", "nvidia-l4", "nvidia-h100-80gb"},
+	},
+	"asia-east1": {
+		Families:     []string{"c2", "c2d", "c3", "t2d", "m1", "a2", "g2"},
+		Accelerators: []string{"nvidia-tesla-t4", "nvidia-tesla-v100", "nvidia-tesla-p100", "nvidia-l4"},
+	},
+	"asia-northeast1": {
+		Families:     []string{"c2", "c2d", "c3", "t2d", "m1", "a2", "g2"},
+		Accelerators: []string{"nvidia-tesla-t4", "nvidia-tesla-a100", "nvidia-l4"},
+	},
+	"asia-south1": {
+		Families:     []string{"c2", "c2d", "c3", "t2d", "m1", "g2"},
+		Accelerators: []string{"nvidia-tesla-t4", "nvidia-l4"},
+	},
+	"asia-southeast1": {
+		Families:     []string{"c2", "c2d", "c3", "t2d", "m1", "a2", "a3", "g2"},
+		Accelerators: []string{"nvidia-tesla-t4", "nvidia-tesla-p4", "nvidia-tesla-a100", "nvidia-a100-80gb", "nvidia-l4", "nvidia-h100-80gb"},
+	},
+	"australia-southeast1": {
+		Families:     []string{"c2", "c2d", "c3", "m1"},
+		Accelerators: []string{"nvidia-tesla-t4", "nvidia-tesla-p4"},
+	},
+}
+
+// Default returns the built-in catalog, a snapshot of the machine types and
+// accelerator types of the main regions of Compute Engine.
+func Default() *Catalog {
+	c := &Catalog{
+		machineTypes: make(map[string]MachineType),
+		accelerators: make(map[string]bool),
+		regions:      make(map[string]Region),
+	}
+	for _, s := range builtinSeries {
+		for _, cpus := range s.cpus {
+			name := fmt.Sprintf("%s-%d", s.name, cpus)
+			c.machineTypes[name] = MachineType{Name: name, CPUs: cpus, MemoryMib: int64(float64(cpus) * s.memoryGiB * 1024)}
+		}
+	}
+	for _, m := range builtinMachineTypes {
+		c.machineTypes[m.Name] = m
+	}
+	for name, region := range builtinRegions {
+		c.regions[name] = Region{
+			Families:     append(append([]string(nil), generalFamilies...), region.Families...),
+			Accelerators: region.Accelerators,
+		}
+		for _, accelerator := range region.Accelerators {
+			c.accelerators[accelerator] = true
+		}
+	}
+	return c
+}
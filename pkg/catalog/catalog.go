@@ -0,0 +1,200 @@
+// Package catalog knows the Compute Engine machine types and accelerator
+// types Batch jobs can ask for, and which regions offer them, so that typos
+// and requests no machine can hold are caught before a job reaches
+// production.
+package catalog
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+)
+
+// MachineType is a Compute Engine machine type.
+type MachineType struct {
+	Name      string
+	CPUs      int64
+	MemoryMib int64
+	// Accelerator is the type of the GPUs the machine type comes with, e.g.
+	// the A100s of a2-highgpu-1g, and GPUs their number.
+	Accelerator string
+	GPUs        int64
+}
+
+// Family returns the machine family of m, e.g. "n2" for n2-standard-4.
+func (m MachineType) Family() string {
+	if strings.HasPrefix(m.Name, "custom-") {
+		return "n1"
+	}
+	family, _, _ := strings.Cut(m.Name, "-")
+	return family
+}
+
+// Region is what a region offers.
+type Region struct {
+	Families     []string
+	Accelerators []string
+}
+
+// Catalog is the machine types and accelerator types of each region.
+type Catalog struct {
+	machineTypes map[string]MachineType
+	accelerators map[string]bool
+	regions      map[string]Region
+}
+
+// MachineType returns the machine type called name, including custom machine
+// types such as n2-custom-8-16384.
+func (c *Catalog) MachineType(name string) (MachineType, bool) {
+	if m, ok := c.machineTypes[name]; ok {
+		return m, true
+	}
+	return customMachineType(name)
+}
+
+// customMachineType parses the name of a custom machine type:
+// [FAMILY-]custom-CPUS-MEMORY_MIB[-ext], FAMILY being n1 if omitted.
+func customMachineType(name string) (MachineType, bool) {
+	family, rest, ok := strings.Cut(strings.TrimSuffix(name, "-ext"), "custom-")
+	if !ok || (family != "" && !customFamilies[strings.TrimSuffix(family, "-")]) {
+		return MachineType{}, false
+	}
+	cpus, memory, ok := strings.Cut(rest, "-")
+	if !ok {
+		return MachineType{}, false
+	}
+	m := MachineType{Name: name}
+	var err error
+	if m.CPUs, err = strconv.ParseInt(cpus, 10, 64); err != nil || m.CPUs <= 0 {
+		return MachineType{}, false
+	}
+	if m.MemoryMib, err = strconv.ParseInt(memory, 10, 64); err != nil || m.MemoryMib <= 0 || m.MemoryMib%256 != 0 {
+		return MachineType{}, false
+	}
+	return m, true
+}
+
+// Problem is a field of a job the catalog finds fault with.
+type Problem struct {
+	// Field is the path of the field, e.g.
+	// "allocationPolicy.instances[0].policy.machineType".
+	Field   string
+	Message string
+}
+
+func (p *Problem) Error() string {
+	return p.Field + ": " + p.Message
+}
+
+// Check returns the problems of job, a job of region: machine and
+// accelerator types that do not exist or that region does not offer.
+// Offerings are not checked in regions the catalog does not know, nor are
+// instance templates.
+func (c *Catalog) Check(job *api.Job, region string) []*Problem {
+	if job.AllocationPolicy == nil {
+		return nil
+	}
+	offered, known := c.regions[region]
+
+	var problems []*Problem
+	problem := func(field, format string, args ...interface{}) {
+		problems = append(problems, &Problem{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+	for i, element := range job.AllocationPolicy.Instances {
+		if element == nil || element.Policy == nil {
+			continue
+		}
+		instance := element.Policy
+		prefix := fmt.Sprintf("allocationPolicy.instances[%d].policy", i)
+		if instance.MachineType != "" {
+			m, ok := c.MachineType(instance.MachineType)
+			switch {
+			case !ok:
+				problem(prefix+".machineType", "machine type %q does not exist", instance.MachineType)
+			case known && !contains(offered.Families, m.Family()):
+				problem(prefix+".machineType", "machine type %q is not available in %s", instance.MachineType, region)
+			}
+		}
+		for j, accelerator := range instance.Accelerators {
+			if accelerator == nil {
+				continue
+			}
+			field := fmt.Sprintf("%s.accelerators[%d].type", prefix, j)
+			switch {
+			case !c.accelerators[accelerator.Type]:
+				problem(field, "accelerator type %q does not exist", accelerator.Type)
+			case known && !contains(offered.Accelerators, accelerator.Type):
+				problem(field, "accelerator type %q is not available in %s", accelerator.Type, region)
+			}
+		}
+	}
+	return problems
+}
+
+// CheckResources returns a problem for each computeResource of job that a
+// VM of one of its instance policies cannot hold, with taskCountPerNode
+// tasks on each VM: more vCPUs or memory than the machine type has, more
+// GPUs than it comes with and its accelerators add, or a bootDiskMib
+// larger than its boot disk. The vCPUs, memory and GPUs of machine types
+// the catalog does not know are not checked, nor are instance templates.
+func (c *Catalog) CheckResources(job *api.Job) []*Problem {
+	if job.AllocationPolicy == nil {
+		return nil
+	}
+
+	var problems []*Problem
+	for i, taskGroup := range job.TaskGroups {
+		if taskGroup.TaskSpec == nil || taskGroup.TaskSpec.ComputeResource == nil {
+			continue
+		}
+		resource := taskGroup.TaskSpec.ComputeResource
+		tasks := max(taskGroup.TaskCountPerNode, 1)
+		prefix := fmt.Sprintf("taskGroups[%d].taskSpec.computeResource", i)
+		problem := func(field, format string, args ...interface{}) {
+			problems = append(problems, &Problem{Field: prefix + "." + field, Message: fmt.Sprintf(format, args...)})
+		}
+
+		for j, element := range job.AllocationPolicy.Instances {
+			if element == nil || element.Policy == nil {
+				continue
+			}
+			instance := element.Policy
+			policy := fmt.Sprintf("allocationPolicy.instances[%d].policy", j)
+			if disk := instance.BootDisk; disk != nil && disk.SizeGb > 0 && resource.BootDiskMib*tasks > disk.SizeGb*1024 {
+				problem("bootDiskMib", "%d task(s) of %d bootDiskMib do not fit the %d GB boot disk of %s", tasks, resource.BootDiskMib, disk.SizeGb, policy)
+			}
+
+			m, ok := c.MachineType(instance.MachineType)
+			if instance.MachineType != "" && !ok {
+				continue
+			}
+			if ok && resource.CPUMilli*tasks > m.CPUs*1000 {
+				problem("cpuMilli", "%d task(s) of %d cpuMilli do not fit the %d vCPUs of machine type %s", tasks, resource.CPUMilli, m.CPUs, m.Name)
+			}
+			if ok && resource.MemoryMib*tasks > m.MemoryMib {
+				problem("memoryMib", "%d task(s) of %d memoryMib do not fit the %d MiB of machine type %s", tasks, resource.MemoryMib, m.MemoryMib, m.Name)
+			}
+			gpus := m.GPUs
+			for _, accelerator := range instance.Accelerators {
+				if accelerator != nil {
+					gpus += accelerator.Count
+				}
+			}
+			if resource.GPUCount*tasks > gpus {
+				problem("gpuCount", "%d task(s) of %d gpuCount do not fit the %d GPUs of %s", tasks, resource.GPUCount, gpus, policy)
+			}
+		}
+	}
+	return problems
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
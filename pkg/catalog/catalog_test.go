@@ -0,0 +1,135 @@
+package catalog
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+)
+
+// wrap returns the instances of an allocation policy with the policies.
+func wrap(policies ...*api.InstancePolicy) []*api.InstancePolicyOrTemplate {
+	var instances []*api.InstancePolicyOrTemplate
+	for _, policy := range policies {
+		instances = append(instances, &api.InstancePolicyOrTemplate{Policy: policy})
+	}
+	return instances
+}
+
+func TestMachineType(t *testing.T) {
+	c := Default()
+
+	m, ok := c.MachineType("n1-standard-4")
+	require.True(t, ok)
+	assert.Equal(t, MachineType{Name: "n1-standard-4", CPUs: 4, MemoryMib: 15360}, m)
+
+	m, ok = c.MachineType("g2-standard-24")
+	require.True(t, ok)
+	assert.Equal(t, "nvidia-l4", m.Accelerator)
+	assert.Equal(t, int64(2), m.GPUs)
+
+	m, ok = c.MachineType("n2-custom-8-16384-ext")
+	require.True(t, ok)
+	assert.Equal(t, int64(8), m.CPUs)
+	assert.Equal(t, int64(16384), m.MemoryMib)
+	assert.Equal(t, "n2", m.Family())
+
+	m, ok = c.MachineType("custom-2-4096")
+	require.True(t, ok)
+	assert.Equal(t, "n1", m.Family())
+
+	for _, name := range []string{"e2-standrad-4", "n2-standard-3", "c2-custom-4-8192", "n2-custom-4-1000", "custom-4"} {
+		_, ok := c.MachineType(name)
+		assert.False(t, ok, name)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	c := Default()
+	job := func(computeResource *api.ComputeResource, taskCountPerNode int64, instances ...*api.InstancePolicy) *api.Job {
+		return &api.Job{
+			TaskGroups: []*api.TaskGroup{{
+				TaskCountPerNode: taskCountPerNode,
+				TaskSpec:         &api.TaskSpec{ComputeResource: computeResource},
+			}},
+			AllocationPolicy: &api.AllocationPolicy{Instances: wrap(instances...)},
+		}
+	}
+	messages := func(problems []*Problem) []string {
+		var result []string
+		for _, problem := range problems {
+			result = append(result, problem.Error())
+		}
+		return result
+	}
+
+	assert.Empty(t, c.Check(&api.Job{}, "us-central1"))
+	assert.Empty(t, c.Check(job(&api.ComputeResource{CPUMilli: 4000, MemoryMib: 16000}, 0,
+		&api.InstancePolicy{MachineType: "e2-standard-4"},
+		&api.InstancePolicy{MachineType: "n1-standard-8", Accelerators: []*api.Accelerator{{Type: "nvidia-tesla-t4", Count: 1}}},
+	), "us-central1"))
+
+	assert.Equal(t, []string{
+		`allocationPolicy.instances[0].policy.machineType: machine type "e2-standrad-4" does not exist`,
+		`allocationPolicy.instances[1].policy.machineType: machine type "a2-highgpu-1g" is not available in europe-west1`,
+		`allocationPolicy.instances[2].policy.accelerators[0].type: accelerator type "nvidia-tesla-t5" does not exist`,
+		`allocationPolicy.instances[2].policy.accelerators[1].type: accelerator type "nvidia-tesla-a100" is not available in europe-west1`,
+	}, messages(c.Check(job(nil, 0,
+		&api.InstancePolicy{MachineType: "e2-standrad-4"},
+		&api.InstancePolicy{MachineType: "a2-highgpu-1g"},
+		&api.InstancePolicy{Accelerators: []*api.Accelerator{{Type: "nvidia-tesla-t5"}, {Type: "nvidia-tesla-a100"}}},
+	), "europe-west1")))
+
+	// Offerings are not checked in unknown regions.
+	assert.Empty(t, c.Check(job(nil, 0, &api.InstancePolicy{MachineType: "a2-highgpu-1g"}), "l"))
+}
+
+func TestCheckResources(t *testing.T) {
+	c := Default()
+	check := func(resource *api.ComputeResource, taskCountPerNode int64, instance *api.InstancePolicy) []string {
+		problems := c.CheckResources(&api.Job{
+			TaskGroups: []*api.TaskGroup{{
+				TaskCountPerNode: taskCountPerNode,
+				TaskSpec:         &api.TaskSpec{ComputeResource: resource},
+			}},
+			AllocationPolicy: &api.AllocationPolicy{Instances: wrap(instance)},
+		})
+		var result []string
+		for _, problem := range problems {
+			result = append(result, problem.Error())
+		}
+		return result
+	}
+
+	assert.Empty(t, check(&api.ComputeResource{CPUMilli: 4000, MemoryMib: 16000}, 0, &api.InstancePolicy{MachineType: "e2-standard-4"}))
+	assert.Equal(t, []string{
+		"taskGroups[0].taskSpec.computeResource.cpuMilli: 1 task(s) of 8000 cpuMilli do not fit the 4 vCPUs of machine type e2-standard-4",
+	}, check(&api.ComputeResource{CPUMilli: 8000, MemoryMib: 2000}, 0, &api.InstancePolicy{MachineType: "e2-standard-4"}))
+	assert.Equal(t, []string{
+		"taskGroups[0].taskSpec.computeResource.memoryMib: 3 task(s) of 6000 memoryMib do not fit the 16384 MiB of machine type e2-standard-4",
+	}, check(&api.ComputeResource{CPUMilli: 1000, MemoryMib: 6000}, 3, &api.InstancePolicy{MachineType: "e2-standard-4"}))
+
+	// GPUs come with the machine type or from its accelerators.
+	assert.Empty(t, check(&api.ComputeResource{GPUCount: 2}, 0, &api.InstancePolicy{MachineType: "g2-standard-24"}))
+	assert.Empty(t, check(&api.ComputeResource{GPUCount: 1}, 2, &api.InstancePolicy{
+		MachineType:  "n1-standard-8",
+		Accelerators: []*api.Accelerator{{Type: "nvidia-tesla-t4", Count: 2}},
+	}))
+	assert.Equal(t, []string{
+		"taskGroups[0].taskSpec.computeResource.gpuCount: 1 task(s) of 1 gpuCount do not fit the 0 GPUs of allocationPolicy.instances[0].policy",
+	}, check(&api.ComputeResource{GPUCount: 1}, 0, &api.InstancePolicy{MachineType: "n1-standard-8"}))
+	assert.Equal(t, []string{
+		"taskGroups[0].taskSpec.computeResource.gpuCount: 2 task(s) of 2 gpuCount do not fit the 2 GPUs of allocationPolicy.instances[0].policy",
+	}, check(&api.ComputeResource{GPUCount: 2}, 2, &api.InstancePolicy{Accelerators: []*api.Accelerator{{Type: "nvidia-tesla-t4", Count: 2}}}))
+
+	assert.Equal(t, []string{
+		"taskGroups[0].taskSpec.computeResource.bootDiskMib: 1 task(s) of 51200 bootDiskMib do not fit the 30 GB boot disk of allocationPolicy.instances[0].policy",
+	}, check(&api.ComputeResource{BootDiskMib: 51200}, 0, &api.InstancePolicy{BootDisk: &api.Disk{SizeGb: 30}}))
+
+	// Unknown machine types are only checked for their boot disk.
+	assert.Equal(t, []string{
+		"taskGroups[0].taskSpec.computeResource.bootDiskMib: 1 task(s) of 51200 bootDiskMib do not fit the 30 GB boot disk of allocationPolicy.instances[0].policy",
+	}, check(&api.ComputeResource{CPUMilli: 999000, GPUCount: 8, BootDiskMib: 51200}, 0, &api.InstancePolicy{MachineType: "x9-huge-1", BootDisk: &api.Disk{SizeGb: 30}}))
+}
@@ -0,0 +1,343 @@
+// Package client is a typed Go client for the emulator's Batch API, so test
+// code can create, inspect, list and delete jobs, and wait for them to reach
+// a state, without building HTTP requests by hand.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+)
+
+const (
+	// DefaultPollInterval is the first delay between the polls of
+	// WaitForState, and DefaultMaxPollInterval the longest it backs off to.
+	DefaultPollInterval    = 100 * time.Millisecond
+	DefaultMaxPollInterval = 5 * time.Second
+)
+
+// Done is returned by the Next method of an iterator once it has returned
+// every item.
+var Done = errors.New("no more items in iterator")
+
+// Client calls the Batch API of an emulator.
+type Client struct {
+	baseURL         string
+	http            *http.Client
+	token           string
+	pollInterval    time.Duration
+	maxPollInterval time.Duration
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithHTTPClient makes the client send its requests with c instead of
+// http.DefaultClient.
+func WithHTTPClient(c *http.Client) Option {
+	return func(client *Client) {
+		client.http = c
+	}
+}
+
+// WithBearerToken makes the client authenticate with token, for servers
+// started with --auth-config.
+func WithBearerToken(token string) Option {
+	return func(client *Client) {
+		client.token = token
+	}
+}
+
+// WithPollInterval sets the first delay between the polls of WaitForState
+// and the longest delay it backs off to.
+func WithPollInterval(interval, max time.Duration) Option {
+	return func(client *Client) {
+		client.pollInterval, client.maxPollInterval = interval, max
+	}
+}
+
+// New creates a Client for the versioned API root of a server, e.g.
+// "http://localhost:8080/v1".
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:         strings.TrimSuffix(baseURL, "/"),
+		http:            http.DefaultClient,
+		pollInterval:    DefaultPollInterval,
+		maxPollInterval: DefaultMaxPollInterval,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Error is an error response of the API.
+type Error struct {
+	// Code is the HTTP status, e.g. 404.
+	Code int
+	// Status is the google.rpc.Code name, e.g. NOT_FOUND.
+	Status  string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Code, e.Status, e.Message)
+}
+
+// IsNotFound reports whether err is an API error for a resource that does
+// not exist.
+func IsNotFound(err error) bool {
+	var apiErr *Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound
+}
+
+// CreateJob creates job under parent, e.g. "projects/p/locations/l", with
+// the given ID, or a generated one if jobID is empty, and returns the job as
+// created.
+func (c *Client) CreateJob(ctx context.Context, parent, jobID string, job *api.Job) (*api.Job, error) {
+	query := url.Values{}
+	if jobID != "" {
+		query.Set("job_id", jobID)
+	}
+	var created api.Job
+	if err := c.do(ctx, http.MethodPost, parent+"/jobs", query, job, &created); err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+// GetJob returns the job named name, e.g. "projects/p/locations/l/jobs/j".
+func (c *Client) GetJob(ctx context.Context, name string) (*api.Job, error) {
+	var job api.Job
+	if err := c.do(ctx, http.MethodGet, name, nil, nil, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// DeleteJob starts deleting the job named name and returns the operation
+// tracking the deletion.
+func (c *Client) DeleteJob(ctx context.Context, name string) (*api.Operation, error) {
+	var op api.Operation
+	if err := c.do(ctx, http.MethodDelete, name, nil, nil, &op); err != nil {
+		return nil, err
+	}
+	return &op, nil
+}
+
+// ListJobs returns an iterator over the jobs of parent, e.g.
+// "projects/p/locations/l", fetched pageSize at a time, or in pages of the
+// server's choosing if pageSize is 0.
+func (c *Client) ListJobs(ctx context.Context, parent string, pageSize int) *JobIterator {
+	return &JobIterator{ctx: ctx, client: c, parent: parent, pageSize: pageSize}
+}
+
+// JobIterator iterates over the jobs of a ListJobs call.
+type JobIterator struct {
+	ctx      context.Context
+	client   *Client
+	parent   string
+	pageSize int
+
+	jobs  []*api.Job
+	token string
+	// started is set once the first page has been fetched.
+	started bool
+}
+
+// Next returns the next job, fetching the next page when needed. It returns
+// Done once there are no more jobs.
+func (it *JobIterator) Next() (*api.Job, error) {
+	for len(it.jobs) == 0 {
+		if it.started && it.token == "" {
+			return nil, Done
+		}
+		var page api.ListJobsResponse
+		if err := it.client.do(it.ctx, http.MethodGet, it.parent+"/jobs", pageQuery(it.pageSize, it.token), nil, &page); err != nil {
+			return nil, err
+		}
+		it.jobs, it.token, it.started = page.Jobs, page.NextPageToken, true
+	}
+
+	job := it.jobs[0]
+	it.jobs = it.jobs[1:]
+	return job, nil
+}
+
+// All returns the remaining jobs.
+func (it *JobIterator) All() ([]*api.Job, error) {
+	var jobs []*api.Job
+	for {
+		job, err := it.Next()
+		if err == Done {
+			return jobs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+}
+
+// ListTasks returns an iterator over the tasks of the job named name,
+// fetched pageSize at a time, or in pages of the server's choosing if
+// pageSize is 0.
+func (c *Client) ListTasks(ctx context.Context, name string, pageSize int) *TaskIterator {
+	return &TaskIterator{ctx: ctx, client: c, job: name, pageSize: pageSize}
+}
+
+// TaskIterator iterates over the tasks of a ListTasks call.
+type TaskIterator struct {
+	ctx      context.Context
+	client   *Client
+	job      string
+	pageSize int
+
+	tasks []*api.Task
+	token string
+	// started is set once the first page has been fetched.
+	started bool
+}
+
+// Next returns the next task, fetching the next page when needed. It
+// returns Done once there are no more tasks.
+func (it *TaskIterator) Next() (*api.Task, error) {
+	for len(it.tasks) == 0 {
+		if it.started && it.token == "" {
+			return nil, Done
+		}
+		var page api.ListTasksResponse
+		if err := it.client.do(it.ctx, http.MethodGet, it.job+"/tasks", pageQuery(it.pageSize, it.token), nil, &page); err != nil {
+			return nil, err
+		}
+		it.tasks, it.token, it.started = page.Tasks, page.NextPageToken, true
+	}
+
+	task := it.tasks[0]
+	it.tasks = it.tasks[1:]
+	return task, nil
+}
+
+// All returns the remaining tasks.
+func (it *TaskIterator) All() ([]*api.Task, error) {
+	var tasks []*api.Task
+	for {
+		task, err := it.Next()
+		if err == Done {
+			return tasks, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, task)
+	}
+}
+
+// pageQuery returns the query of a list request for a page of pageSize
+// items, if not 0, starting at token, if not empty.
+func pageQuery(pageSize int, token string) url.Values {
+	query := url.Values{}
+	if pageSize > 0 {
+		query.Set("pageSize", strconv.Itoa(pageSize))
+	}
+	if token != "" {
+		query.Set("pageToken", token)
+	}
+	return query
+}
+
+// WaitForState polls the job named name until it is in one of states and
+// returns it. The delay between polls starts at the client's poll interval
+// and doubles up to its maximum. It fails if the job reaches a terminal
+// state that is not one of states, or once ctx is done.
+func (c *Client) WaitForState(ctx context.Context, name string, states ...api.JobState) (*api.Job, error) {
+	interval := c.pollInterval
+	for {
+		job, err := c.GetJob(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, state := range states {
+			if job.State == state {
+				return job, nil
+			}
+		}
+		if terminal(job.State) {
+			return job, fmt.Errorf("job %s ended in %s, expected %v", name, job.State, states)
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return job, fmt.Errorf("job %s did not reach %v (last state %s): %w", name, states, job.State, ctx.Err())
+		}
+		if interval *= 2; interval > c.maxPollInterval {
+			interval = c.maxPollInterval
+		}
+	}
+}
+
+// WaitForJobCompletion waits for the job named name to finish, i.e. to be
+// SUCCEEDED, FAILED or CANCELLED, and returns it.
+func (c *Client) WaitForJobCompletion(ctx context.Context, name string) (*api.Job, error) {
+	return c.WaitForState(ctx, name, api.JobStateSucceeded, api.JobStateFailed, api.JobStateCancelled)
+}
+
+// terminal reports whether a job in state has finished.
+func terminal(state api.JobState) bool {
+	return state == api.JobStateSucceeded || state == api.JobStateFailed || state == api.JobStateCancelled
+}
+
+// do sends a request for the resource path, relative to the API root, with
+// body encoded as JSON if it is not nil, and decodes the response into out.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body, out interface{}) error {
+	target := c.baseURL + "/" + strings.TrimPrefix(path, "/")
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		apiErr := &Error{Code: resp.StatusCode, Status: http.StatusText(resp.StatusCode)}
+		var envelope api.ErrorResponse
+		if err := json.NewDecoder(resp.Body).Decode(&envelope); err == nil && envelope.Error != nil {
+			apiErr.Status, apiErr.Message = envelope.Error.Status, envelope.Error.Message
+		}
+		return apiErr
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,108 @@
+package client
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+	"github.com/pyshx/fake-batch-server/pkg/clock"
+	"github.com/pyshx/fake-batch-server/pkg/handlers"
+	"github.com/pyshx/fake-batch-server/pkg/storage"
+)
+
+func setupServer(t *testing.T) (*Client, *clock.Fake) {
+	fake := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	handler := handlers.NewHandler(storage.NewMemoryStore(), handlers.WithClock(fake))
+	t.Cleanup(handler.Close)
+
+	router := mux.NewRouter()
+	v1 := router.PathPrefix("/v1").Subrouter()
+	v1.HandleFunc("/projects/{project}/locations/{location}/jobs", handler.CreateJob).Methods("POST")
+	v1.HandleFunc("/projects/{project}/locations/{location}/jobs", handler.ListJobs).Methods("GET")
+	v1.HandleFunc("/projects/{project}/locations/{location}/jobs/{job}", handler.GetJob).Methods("GET")
+	v1.HandleFunc("/projects/{project}/locations/{location}/jobs/{job}", handler.DeleteJob).Methods("DELETE")
+	v1.HandleFunc("/projects/{project}/locations/{location}/jobs/{job}/tasks", handler.ListTasks).Methods("GET")
+
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	return New(server.URL+"/v1", WithPollInterval(time.Millisecond, 10*time.Millisecond)), fake
+}
+
+func TestClient_JobLifecycle(t *testing.T) {
+	client, fake := setupServer(t)
+	ctx := context.Background()
+	job := &api.Job{TaskGroups: []*api.TaskGroup{{TaskCount: 2}}}
+
+	created, err := client.CreateJob(ctx, "projects/p/locations/l", "job1", job)
+	require.NoError(t, err)
+	assert.Equal(t, "projects/p/locations/l/jobs/job1", created.Name)
+	assert.Equal(t, api.JobStateQueued, created.State)
+
+	_, err = client.CreateJob(ctx, "projects/p/locations/l", "job1", job)
+	var apiErr *Error
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, "ALREADY_EXISTS", apiErr.Status)
+
+	fake.Advance(time.Minute)
+	done, err := client.WaitForJobCompletion(ctx, created.Name)
+	require.NoError(t, err)
+	assert.Equal(t, api.JobStateSucceeded, done.State)
+
+	// Waiting for a state the job can no longer reach fails right away.
+	_, err = client.WaitForState(ctx, created.Name, api.JobStateRunning)
+	assert.ErrorContains(t, err, "ended in SUCCEEDED")
+
+	op, err := client.DeleteJob(ctx, created.Name)
+	require.NoError(t, err)
+	assert.Equal(t, created.Name, op.Metadata.Target)
+
+	_, err = client.GetJob(ctx, "projects/p/locations/l/jobs/missing")
+	assert.True(t, IsNotFound(err))
+}
+
+func TestClient_ListJobs(t *testing.T) {
+	client, _ := setupServer(t)
+	ctx := context.Background()
+	for _, id := range []string{"job1", "job2", "job3"} {
+		_, err := client.CreateJob(ctx, "projects/p/locations/l", id, &api.Job{TaskGroups: []*api.TaskGroup{{TaskCount: 1}}})
+		require.NoError(t, err)
+	}
+
+	it := client.ListJobs(ctx, "projects/p/locations/l", 2)
+	jobs, err := it.All()
+	require.NoError(t, err)
+	require.Len(t, jobs, 3)
+	assert.Equal(t, "projects/p/locations/l/jobs/job3", jobs[2].Name)
+	_, err = it.Next()
+	assert.Equal(t, Done, err)
+}
+
+func TestClient_ListTasks(t *testing.T) {
+	client, _ := setupServer(t)
+	ctx := context.Background()
+	job, err := client.CreateJob(ctx, "projects/p/locations/l", "job1", &api.Job{TaskGroups: []*api.TaskGroup{{TaskCount: 3}}})
+	require.NoError(t, err)
+
+	tasks, err := client.ListTasks(ctx, job.Name, 2).All()
+	require.NoError(t, err)
+	require.Len(t, tasks, 3)
+	assert.Equal(t, job.Name+"/taskGroups/group0/tasks/2", tasks[2].Name)
+}
+
+func TestClient_WaitForStateTimeout(t *testing.T) {
+	client, _ := setupServer(t)
+	created, err := client.CreateJob(context.Background(), "projects/p/locations/l", "", &api.Job{TaskGroups: []*api.TaskGroup{{TaskCount: 1}}})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = client.WaitForJobCompletion(ctx, created.Name)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.ErrorContains(t, err, "last state QUEUED")
+}
@@ -0,0 +1,139 @@
+// Package clock provides a time source abstraction so the job simulation can
+// run against either the wall clock or a manually advanced fake clock.
+package clock
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is a source of time for the simulation engine.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// After waits for the duration to elapse and then sends the current time
+	// on the returned channel.
+	After(d time.Duration) <-chan time.Time
+}
+
+// SleepUntil blocks until c reaches t or ctx is done, in which case it
+// returns ctx.Err(). It returns immediately if t is not in the future.
+func SleepUntil(ctx context.Context, c Clock, t time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if d := t.Sub(c.Now()); d > 0 {
+		select {
+		case <-c.After(d):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+type realClock struct{}
+
+// Real returns a Clock backed by the time package.
+func Real() Clock {
+	return realClock{}
+}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+type waiter struct {
+	deadline time.Time
+	ch       chan time.Time
+}
+
+// Fake is a Clock that only moves when Advance is called.
+type Fake struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*waiter
+}
+
+// NewFake creates a fake clock starting at the given time.
+func NewFake(start time.Time) *Fake {
+	return &Fake{now: start}
+}
+
+// Now returns the fake clock's current time.
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.now
+}
+
+// After returns a channel that receives the fake time once the clock has
+// been advanced by at least d.
+func (f *Fake) After(d time.Duration) <-chan time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	w := &waiter{deadline: f.now.Add(d), ch: make(chan time.Time, 1)}
+	if d <= 0 {
+		w.ch <- f.now
+		return w.ch
+	}
+
+	f.waiters = append(f.waiters, w)
+	return w.ch
+}
+
+// Advance moves the clock forward by d, waking every waiter whose deadline
+// has been reached in deadline order. It returns the new time.
+func (f *Fake) Advance(d time.Duration) time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.now = f.now.Add(d)
+
+	sort.Slice(f.waiters, func(i, j int) bool {
+		return f.waiters[i].deadline.Before(f.waiters[j].deadline)
+	})
+
+	remaining := f.waiters[:0]
+	for _, w := range f.waiters {
+		if w.deadline.After(f.now) {
+			remaining = append(remaining, w)
+			continue
+		}
+		w.ch <- f.now
+	}
+	f.waiters = remaining
+
+	return f.now
+}
+
+// Next returns the earliest deadline of the pending After calls, or false if
+// there are none.
+func (f *Fake) Next() (time.Time, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var next time.Time
+	for _, w := range f.waiters {
+		if next.IsZero() || w.deadline.Before(next) {
+			next = w.deadline
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// Waiters returns the number of pending After calls.
+func (f *Fake) Waiters() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return len(f.waiters)
+}
@@ -0,0 +1,97 @@
+package clock
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFake_Advance(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	fake := NewFake(start)
+
+	short := fake.After(time.Second)
+	long := fake.After(time.Minute)
+	assert.Equal(t, 2, fake.Waiters())
+
+	now := fake.Advance(2 * time.Second)
+	assert.Equal(t, start.Add(2*time.Second), now)
+	assert.Equal(t, now, fake.Now())
+
+	select {
+	case fired := <-short:
+		assert.Equal(t, now, fired)
+	default:
+		t.Fatal("expected short waiter to fire")
+	}
+
+	select {
+	case <-long:
+		t.Fatal("long waiter fired early")
+	default:
+	}
+	assert.Equal(t, 1, fake.Waiters())
+
+	fake.Advance(time.Minute)
+	<-long
+	assert.Equal(t, 0, fake.Waiters())
+}
+
+func TestFake_Next(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	fake := NewFake(start)
+
+	_, ok := fake.Next()
+	assert.False(t, ok)
+
+	fake.After(time.Minute)
+	fake.After(time.Second)
+	next, ok := fake.Next()
+	assert.True(t, ok)
+	assert.Equal(t, start.Add(time.Second), next)
+}
+
+func TestFake_AfterNonPositive(t *testing.T) {
+	fake := NewFake(time.Now())
+
+	select {
+	case <-fake.After(0):
+	default:
+		t.Fatal("expected zero duration to fire immediately")
+	}
+}
+
+func TestSleepUntil(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	fake := NewFake(start)
+
+	// Deadlines already reached return without waiting.
+	assert.NoError(t, SleepUntil(context.Background(), fake, start.Add(-time.Second)))
+
+	done := make(chan struct{})
+	go func() {
+		assert.NoError(t, SleepUntil(context.Background(), fake, start.Add(time.Second)))
+		close(done)
+	}()
+
+	assert.Eventually(t, func() bool { return fake.Waiters() == 1 }, time.Second, time.Millisecond)
+	fake.Advance(time.Second)
+	<-done
+}
+
+func TestSleepUntil_Cancelled(t *testing.T) {
+	fake := NewFake(time.Now())
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan error)
+	go func() {
+		done <- SleepUntil(ctx, fake, fake.Now().Add(time.Hour))
+	}()
+
+	assert.Eventually(t, func() bool { return fake.Waiters() == 1 }, time.Second, time.Millisecond)
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+	assert.ErrorIs(t, SleepUntil(ctx, fake, fake.Now()), context.Canceled)
+}
@@ -0,0 +1,213 @@
+// Package doctor scans the store for jobs and tasks whose state has drifted
+// out of sync and optionally repairs them.
+package doctor
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+	"github.com/pyshx/fake-batch-server/pkg/simulation"
+	"github.com/pyshx/fake-batch-server/pkg/storage"
+)
+
+// Kinds of findings reported by Check.
+const (
+	// KindActiveTaskInTerminalJob is a task that has not finished although its
+	// job has.
+	KindActiveTaskInTerminalJob = "ACTIVE_TASK_IN_TERMINAL_JOB"
+	// KindStuckDeleting is a job that has been DELETING for longer than the
+	// configured threshold.
+	KindStuckDeleting = "STUCK_DELETING"
+	// KindCountMismatch is a task group whose reported counts do not match
+	// the states of its tasks.
+	KindCountMismatch = "COUNT_MISMATCH"
+)
+
+// DefaultDeletingThreshold is how long a job may stay DELETING before it is
+// reported as stuck.
+const DefaultDeletingThreshold = 10 * time.Minute
+
+// Options controls a Check.
+type Options struct {
+	// Now is the time DELETING ages are measured against and repairs are
+	// recorded at.
+	Now time.Time
+	// DeletingThreshold is how long a job may stay DELETING. Defaults to
+	// DefaultDeletingThreshold.
+	DeletingThreshold time.Duration
+	// Repair fixes every finding instead of only reporting it.
+	Repair bool
+	// Skip excludes jobs from the check, e.g. ones still being simulated
+	// whose state is legitimately in flux.
+	Skip func(jobName string) bool
+}
+
+// Finding is a single inconsistency.
+type Finding struct {
+	Kind        string `json:"kind"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Repaired    bool   `json:"repaired"`
+}
+
+// Report is the result of a Check.
+type Report struct {
+	CheckedJobs int        `json:"checkedJobs"`
+	Findings    []*Finding `json:"findings"`
+}
+
+// Check scans every job in store for inconsistencies. With opts.Repair set,
+// active tasks of terminal jobs are moved to the job's state, stuck DELETING
+// jobs are removed and task counts are recomputed.
+func Check(store storage.Store, opts Options) *Report {
+	if opts.DeletingThreshold <= 0 {
+		opts.DeletingThreshold = DefaultDeletingThreshold
+	}
+
+	snap := store.Snapshot()
+	report := &Report{Findings: []*Finding{}}
+
+	for _, job := range snap.Jobs {
+		if opts.Skip != nil && opts.Skip(job.Name) {
+			continue
+		}
+		report.CheckedJobs++
+
+		if job.State == api.JobStateDeleting {
+			if age := opts.Now.Sub(job.UpdateTime); age > opts.DeletingThreshold {
+				finding := &Finding{
+					Kind:        KindStuckDeleting,
+					Name:        job.Name,
+					Description: fmt.Sprintf("Job has been DELETING for %s", age.Round(time.Second)),
+				}
+				if opts.Repair {
+					finding.Repaired = store.DeleteJob(job.Name) == nil
+				}
+				report.Findings = append(report.Findings, finding)
+				continue
+			}
+		}
+
+		// Counts are checked against the task states as found, before any
+		// task repairs, and recomputed afterwards if anything changed.
+		tasks := snap.Tasks[job.Name]
+		counts := simulation.TaskCounts(job, tasks)
+		taskFindings := checkTasks(store, job, tasks, opts)
+		countFindings := checkCounts(job, counts)
+
+		if opts.Repair && len(taskFindings)+len(countFindings) > 0 {
+			repaired := recount(store, job, tasks)
+			for _, finding := range countFindings {
+				finding.Repaired = repaired
+			}
+		}
+
+		report.Findings = append(report.Findings, taskFindings...)
+		report.Findings = append(report.Findings, countFindings...)
+	}
+
+	return report
+}
+
+// checkTasks reports tasks that are still active although job has finished.
+func checkTasks(store storage.Store, job *api.Job, tasks []*api.Task, opts Options) []*Finding {
+	var final api.TaskState
+	switch job.State {
+	case api.JobStateSucceeded:
+		final = api.TaskStateSucceeded
+	case api.JobStateFailed, api.JobStateCancelled:
+		final = api.TaskStateFailed
+	default:
+		return nil
+	}
+
+	var findings []*Finding
+	for _, task := range tasks {
+		if task.Status == nil || isTerminal(task.Status.State) {
+			continue
+		}
+
+		finding := &Finding{
+			Kind:        KindActiveTaskInTerminalJob,
+			Name:        task.Name,
+			Description: fmt.Sprintf("Task is %s but job is %s", task.Status.State, job.State),
+		}
+		if opts.Repair {
+			previous := task.Status.State
+			task.Status.State = final
+			task.Status.StatusEvents = append(task.Status.StatusEvents, &api.StatusEvent{
+				Type:        "task_repaired",
+				Description: fmt.Sprintf("Task moved from %s to %s to match its job", previous, final),
+				EventTime:   opts.Now,
+			})
+			finding.Repaired = store.UpdateTask(job.Name, task) == nil
+		}
+		findings = append(findings, finding)
+	}
+
+	return findings
+}
+
+// checkCounts reports task groups whose reported counts disagree with the
+// actual counts of their tasks.
+func checkCounts(job *api.Job, actual map[string]map[string]int64) []*Finding {
+	if job.Status == nil {
+		return nil
+	}
+
+	var findings []*Finding
+	for _, taskGroup := range job.TaskGroups {
+		var reported map[string]int64
+		if status := job.Status.TaskGroups[taskGroup.Name]; status != nil {
+			reported = status.Counts
+		}
+		if reflect.DeepEqual(nonZero(reported), nonZero(actual[taskGroup.Name])) {
+			continue
+		}
+
+		findings = append(findings, &Finding{
+			Kind:        KindCountMismatch,
+			Name:        fmt.Sprintf("%s/taskGroups/%s", job.Name, taskGroup.Name),
+			Description: fmt.Sprintf("Reported counts %v do not match task states %v", nonZero(reported), nonZero(actual[taskGroup.Name])),
+		})
+	}
+
+	return findings
+}
+
+// recount recomputes job's task counts from the current task states and
+// stores it. It reports whether the job was updated.
+func recount(store storage.Store, job *api.Job, tasks []*api.Task) bool {
+	if job.Status == nil {
+		job.Status = &api.JobStatus{State: job.State}
+	}
+	if job.Status.TaskGroups == nil {
+		job.Status.TaskGroups = make(map[string]*api.TaskGroupStatus)
+	}
+	for name, counts := range simulation.TaskCounts(job, tasks) {
+		job.Status.TaskGroups[name] = &api.TaskGroupStatus{Counts: counts}
+	}
+
+	return store.UpdateJob(job) == nil
+}
+
+func isTerminal(state api.TaskState) bool {
+	switch state {
+	case api.TaskStateSucceeded, api.TaskStateFailed, api.TaskStateAborted:
+		return true
+	}
+	return false
+}
+
+// nonZero drops zero counts so that absent and zero entries compare equal.
+func nonZero(counts map[string]int64) map[string]int64 {
+	result := make(map[string]int64, len(counts))
+	for state, count := range counts {
+		if count != 0 {
+			result[state] = count
+		}
+	}
+	return result
+}
@@ -0,0 +1,105 @@
+package doctor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+	"github.com/pyshx/fake-batch-server/pkg/storage"
+)
+
+// newJob stores a job with a single group of taskCount PENDING tasks whose
+// counts are consistent.
+func newJob(t *testing.T, store *storage.MemoryStore, name string, state api.JobState, taskCount int64) *api.Job {
+	job := &api.Job{
+		Name:       name,
+		State:      state,
+		TaskGroups: []*api.TaskGroup{{Name: "group1", TaskCount: taskCount}},
+		Status: &api.JobStatus{
+			State: state,
+			TaskGroups: map[string]*api.TaskGroupStatus{
+				"group1": {Counts: map[string]int64{"PENDING": taskCount}},
+			},
+		},
+	}
+	require.NoError(t, store.CreateJob(job))
+	return job
+}
+
+func kinds(report *Report) []string {
+	var result []string
+	for _, finding := range report.Findings {
+		result = append(result, finding.Kind)
+	}
+	return result
+}
+
+func TestCheck_Healthy(t *testing.T) {
+	store := storage.NewMemoryStore()
+	newJob(t, store, "jobs/queued", api.JobStateQueued, 2)
+
+	report := Check(store, Options{Now: time.Now()})
+	assert.Equal(t, 1, report.CheckedJobs)
+	assert.Empty(t, report.Findings)
+}
+
+func TestCheck_Findings(t *testing.T) {
+	store := storage.NewMemoryStore()
+
+	// The job succeeded but one of its tasks is still pending.
+	newJob(t, store, "jobs/done", api.JobStateSucceeded, 1)
+
+	// The counts claim two tasks are running.
+	miscounted := newJob(t, store, "jobs/miscounted", api.JobStateQueued, 2)
+	miscounted.Status.TaskGroups["group1"].Counts = map[string]int64{"RUNNING": 2}
+	require.NoError(t, store.UpdateJob(miscounted))
+
+	deleting := newJob(t, store, "jobs/deleting", api.JobStateDeleting, 1)
+
+	report := Check(store, Options{Now: deleting.UpdateTime.Add(time.Hour)})
+	assert.Equal(t, 3, report.CheckedJobs)
+	assert.ElementsMatch(t, []string{KindActiveTaskInTerminalJob, KindStuckDeleting, KindCountMismatch}, kinds(report))
+	for _, finding := range report.Findings {
+		assert.False(t, finding.Repaired)
+	}
+
+	// A generous threshold tolerates the deleting job.
+	report = Check(store, Options{Now: deleting.UpdateTime.Add(time.Hour), DeletingThreshold: 2 * time.Hour})
+	assert.NotContains(t, kinds(report), KindStuckDeleting)
+
+	// Skipped jobs are not checked.
+	report = Check(store, Options{Now: time.Now(), Skip: func(name string) bool { return name == "jobs/done" }})
+	assert.NotContains(t, kinds(report), KindActiveTaskInTerminalJob)
+}
+
+func TestCheck_Repair(t *testing.T) {
+	store := storage.NewMemoryStore()
+	done := newJob(t, store, "jobs/done", api.JobStateFailed, 2)
+	newJob(t, store, "jobs/deleting", api.JobStateDeleting, 1)
+
+	report := Check(store, Options{Now: time.Now().Add(time.Hour), Repair: true})
+	assert.ElementsMatch(t, []string{KindActiveTaskInTerminalJob, KindActiveTaskInTerminalJob, KindStuckDeleting}, kinds(report))
+	for _, finding := range report.Findings {
+		assert.True(t, finding.Repaired, finding.Name)
+	}
+
+	_, err := store.GetJob("jobs/deleting")
+	assert.Error(t, err)
+
+	tasks, err := store.ListTasks(done.Name)
+	require.NoError(t, err)
+	for _, task := range tasks {
+		assert.Equal(t, api.TaskStateFailed, task.Status.State)
+		last := task.Status.StatusEvents[len(task.Status.StatusEvents)-1]
+		assert.Equal(t, "task_repaired", last.Type)
+	}
+	done, err = store.GetJob(done.Name)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{"FAILED": 2}, done.Status.TaskGroups["group1"].Counts)
+
+	// Everything is consistent afterwards.
+	assert.Empty(t, Check(store, Options{Now: time.Now()}).Findings)
+}
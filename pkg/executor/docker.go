@@ -0,0 +1,440 @@
+// Package executor runs container runnables for real instead of simulating
+// them.
+package executor
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/pyshx/fake-batch-server/pkg/simulation"
+)
+
+// DefaultDockerHost is the Docker daemon address used when none is given.
+const DefaultDockerHost = "unix:///var/run/docker.sock"
+
+// TaskLabel is the container label holding the name of the task a container
+// was started for.
+const TaskLabel = "fake-batch/task"
+
+// Docker runs container runnables through the Docker Engine API.
+type Docker struct {
+	client  *http.Client
+	baseURL string
+	// hostname is the host the ports published by the daemon are reached
+	// at.
+	hostname string
+}
+
+// NewDocker creates a Docker executor talking to the daemon at host, either
+// unix:///path/to/docker.sock or tcp://host:port.
+func NewDocker(host string) (*Docker, error) {
+	if host == "" {
+		host = DefaultDockerHost
+	}
+
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, fmt.Errorf("invalid docker host %q: %v", host, err)
+	}
+
+	switch u.Scheme {
+	case "unix":
+		socket := u.Path
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socket)
+			},
+		}
+		return &Docker{client: &http.Client{Transport: transport}, baseURL: "http://docker", hostname: "127.0.0.1"}, nil
+	case "tcp", "http":
+		return &Docker{client: &http.Client{}, baseURL: "http://" + u.Host, hostname: u.Hostname()}, nil
+	default:
+		return nil, fmt.Errorf("unsupported docker host %q", host)
+	}
+}
+
+// Run pulls the image of the runnable, runs it with its commands,
+// entrypoint, environment and files, and returns the container's exit code.
+// The container is killed if ctx is done and removed in any case.
+func (d *Docker) Run(ctx context.Context, execution *simulation.Execution) (int, error) {
+	container := execution.Container
+	if err := d.pull(ctx, container.ImageURI); err != nil {
+		return 0, err
+	}
+
+	config := map[string]interface{}{
+		"Image":  container.ImageURI,
+		"Env":    environment(execution.Env),
+		"Labels": map[string]string{TaskLabel: execution.Task},
+	}
+	if len(container.Commands) > 0 {
+		config["Cmd"] = container.Commands
+	}
+	if container.Entrypoint != "" {
+		config["Entrypoint"] = []string{container.Entrypoint}
+	}
+	hostConfig := map[string]interface{}{}
+	if container.BlockExternalNetwork {
+		hostConfig["NetworkMode"] = "none"
+	}
+	if binds := binds(execution.Mounts); len(binds) > 0 {
+		hostConfig["Binds"] = binds
+	}
+	if len(hostConfig) > 0 {
+		config["HostConfig"] = hostConfig
+	}
+
+	var created struct {
+		ID string `json:"Id"`
+	}
+	if err := d.call(ctx, "POST", "/containers/create", config, &created); err != nil {
+		return 0, fmt.Errorf("failed to create container: %v", err)
+	}
+	defer d.remove(created.ID)
+
+	if len(execution.Files) > 0 {
+		archive, err := tarFiles(execution.Files)
+		if err != nil {
+			return 0, err
+		}
+		if err := d.call(ctx, "PUT", "/containers/"+created.ID+"/archive?path=/", archive, nil); err != nil {
+			return 0, fmt.Errorf("failed to copy files to container: %v", err)
+		}
+	}
+
+	if err := d.call(ctx, "POST", "/containers/"+created.ID+"/start", nil, nil); err != nil {
+		return 0, fmt.Errorf("failed to start container: %v", err)
+	}
+	logrus.Debugf("Started container %s for %s", created.ID, execution.Task)
+
+	// The log stream ends when the container exits.
+	streamed := make(chan struct{})
+	defer func() { <-streamed }()
+	go func() {
+		defer close(streamed)
+		if execution.Output != nil {
+			d.streamLogs(ctx, created.ID, execution.Output)
+		}
+	}()
+
+	var waited struct {
+		StatusCode int `json:"StatusCode"`
+	}
+	if err := d.call(ctx, "POST", "/containers/"+created.ID+"/wait", nil, &waited); err != nil {
+		if ctx.Err() != nil {
+			d.kill(created.ID)
+			return 0, ctx.Err()
+		}
+		return 0, fmt.Errorf("failed to wait for container: %v", err)
+	}
+
+	return waited.StatusCode, nil
+}
+
+// streamLogs copies the stdout and stderr of a container to out until the
+// container exits.
+func (d *Docker) streamLogs(ctx context.Context, id string, out io.Writer) {
+	resp, err := d.do(ctx, "GET", "/containers/"+id+"/logs?follow=1&stdout=1&stderr=1", nil)
+	if err != nil {
+		logrus.Warnf("Failed to stream logs of container %s: %v", id, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if err := demux(resp.Body, out); err != nil && ctx.Err() == nil {
+		logrus.Warnf("Failed to stream logs of container %s: %v", id, err)
+	}
+}
+
+// demux copies the payload of a multiplexed Docker log stream, in which
+// every frame starts with an 8-byte header holding its size, to out.
+func demux(r io.Reader, out io.Writer) error {
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		size := int64(binary.BigEndian.Uint32(header[4:]))
+		if _, err := io.CopyN(out, r, size); err != nil {
+			return err
+		}
+	}
+}
+
+// pull fetches image, which may carry a tag or digest.
+func (d *Docker) pull(ctx context.Context, image string) error {
+	query := url.Values{"fromImage": {image}}
+	if !strings.Contains(image, "@") {
+		if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+			query.Set("fromImage", image[:i])
+			query.Set("tag", image[i+1:])
+		} else {
+			query.Set("tag", "latest")
+		}
+	}
+
+	resp, err := d.do(ctx, "POST", "/images/create?"+query.Encode(), nil)
+	if err != nil {
+		return fmt.Errorf("failed to pull %s: %v", image, err)
+	}
+	defer resp.Body.Close()
+
+	// Progress is streamed as JSON messages; failures arrive as a message
+	// with an error rather than as a status code.
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var message struct {
+			Error string `json:"error"`
+		}
+		if err := decoder.Decode(&message); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to pull %s: %v", image, err)
+		}
+		if message.Error != "" {
+			return fmt.Errorf("failed to pull %s: %s", image, message.Error)
+		}
+	}
+}
+
+// ImageExists reports whether image is available to the daemon, either
+// locally or, as far as the daemon can tell with its credentials, in its
+// registry.
+func (d *Docker) ImageExists(ctx context.Context, image string) (bool, error) {
+	for _, path := range []string{"/images/" + image + "/json", "/distribution/" + image + "/json"} {
+		err := d.call(ctx, "GET", path, nil, nil)
+		if err == nil {
+			return true, nil
+		}
+		var apiErr *apiError
+		if !errors.As(err, &apiErr) {
+			return false, fmt.Errorf("failed to look up %s: %v", image, err)
+		}
+		// The daemon answers 401 or 403 rather than 404 for repositories the
+		// registry does not disclose.
+		switch apiErr.status {
+		case http.StatusNotFound, http.StatusUnauthorized, http.StatusForbidden:
+		default:
+			return false, fmt.Errorf("failed to look up %s: %v", image, err)
+		}
+	}
+	return false, nil
+}
+
+// Service is a long-running container started by StartService.
+type Service struct {
+	// ID is the container's ID.
+	ID string
+	// Address is the host:port the container's port is published on.
+	Address string
+}
+
+// StartService starts a detached container of image, pulling the image if
+// the daemon does not have it, with env set and the given TCP port published
+// on a free port of the daemon's host. It is left running until
+// StopService removes it.
+func (d *Docker) StartService(ctx context.Context, image string, port int, env map[string]string) (*Service, error) {
+	if err := d.call(ctx, "GET", "/images/"+image+"/json", nil, nil); err != nil {
+		if err := d.pull(ctx, image); err != nil {
+			return nil, err
+		}
+	}
+
+	exposed := fmt.Sprintf("%d/tcp", port)
+	config := map[string]interface{}{
+		"Image":        image,
+		"Env":          environment(env),
+		"ExposedPorts": map[string]struct{}{exposed: {}},
+		"HostConfig": map[string]interface{}{
+			"PortBindings": map[string][]map[string]string{exposed: {{"HostPort": ""}}},
+		},
+	}
+	var created struct {
+		ID string `json:"Id"`
+	}
+	if err := d.call(ctx, "POST", "/containers/create", config, &created); err != nil {
+		return nil, fmt.Errorf("failed to create container: %v", err)
+	}
+	if err := d.call(ctx, "POST", "/containers/"+created.ID+"/start", nil, nil); err != nil {
+		d.remove(created.ID)
+		return nil, fmt.Errorf("failed to start container: %v", err)
+	}
+
+	var inspected struct {
+		NetworkSettings struct {
+			Ports map[string][]struct {
+				HostPort string `json:"HostPort"`
+			} `json:"Ports"`
+		} `json:"NetworkSettings"`
+	}
+	if err := d.call(ctx, "GET", "/containers/"+created.ID+"/json", nil, &inspected); err != nil {
+		d.remove(created.ID)
+		return nil, fmt.Errorf("failed to inspect container: %v", err)
+	}
+	bindings := inspected.NetworkSettings.Ports[exposed]
+	if len(bindings) == 0 {
+		d.remove(created.ID)
+		return nil, fmt.Errorf("port %s of container %s is not published", exposed, created.ID)
+	}
+	logrus.Debugf("Started container %s of %s", created.ID, image)
+	return &Service{ID: created.ID, Address: net.JoinHostPort(d.hostname, bindings[0].HostPort)}, nil
+}
+
+// StopService removes a container started by StartService.
+func (d *Docker) StopService(ctx context.Context, id string) error {
+	return d.call(ctx, "DELETE", "/containers/"+id+"?force=true", nil, nil)
+}
+
+// kill stops a container whose run was cancelled.
+func (d *Docker) kill(id string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := d.call(ctx, "POST", "/containers/"+id+"/kill", nil, nil); err != nil {
+		logrus.Warnf("Failed to kill container %s: %v", id, err)
+	}
+}
+
+// remove deletes a container.
+func (d *Docker) remove(id string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := d.call(ctx, "DELETE", "/containers/"+id+"?force=true", nil, nil); err != nil {
+		logrus.Warnf("Failed to remove container %s: %v", id, err)
+	}
+}
+
+// call sends a JSON request and decodes the JSON response into out, if given.
+func (d *Docker) call(ctx context.Context, method, path string, body, out interface{}) error {
+	resp, err := d.do(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// do sends a request to the daemon and returns the response if it succeeded.
+// A body of type *tarArchive is sent as is, any other as JSON.
+func (d *Docker) do(ctx context.Context, method, path string, body interface{}) (*http.Response, error) {
+	var payload bytes.Buffer
+	contentType := "application/json"
+	if archive, ok := body.(*tarArchive); ok {
+		payload.Write(archive.Bytes())
+		contentType = "application/x-tar"
+	} else if body != nil {
+		if err := json.NewEncoder(&payload).Encode(body); err != nil {
+			return nil, err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, d.baseURL+path, &payload)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		var message struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&message)
+		return nil, &apiError{status: resp.StatusCode, message: message.Message}
+	}
+
+	return resp, nil
+}
+
+// apiError is an error response of the daemon.
+type apiError struct {
+	status  int
+	message string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("docker returned %d: %s", e.status, e.message)
+}
+
+// tarArchive is a tar archive to extract into a container.
+type tarArchive struct {
+	bytes.Buffer
+}
+
+// tarFiles archives files, keyed by absolute path, in sorted order.
+func tarFiles(files map[string]string) (*tarArchive, error) {
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	archive := &tarArchive{}
+	w := tar.NewWriter(archive)
+	for _, path := range paths {
+		header := &tar.Header{Name: strings.TrimPrefix(path, "/"), Mode: 0o644, Size: int64(len(files[path]))}
+		if err := w.WriteHeader(header); err != nil {
+			return nil, err
+		}
+		if _, err := io.WriteString(w, files[path]); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return archive, nil
+}
+
+// binds formats mounts as the source:target[:options] binds of a container.
+func binds(mounts []simulation.Mount) []string {
+	var result []string
+	for _, mount := range mounts {
+		options := mount.Options
+		if mount.ReadOnly {
+			options = append([]string{"ro"}, options...)
+		}
+		bind := mount.Source + ":" + mount.Target
+		if len(options) > 0 {
+			bind += ":" + strings.Join(options, ",")
+		}
+		result = append(result, bind)
+	}
+	return result
+}
+
+// environment formats env as sorted NAME=value pairs.
+func environment(env map[string]string) []string {
+	result := make([]string, 0, len(env))
+	for name, value := range env {
+		result = append(result, name+"="+value)
+	}
+	sort.Strings(result)
+	return result
+}
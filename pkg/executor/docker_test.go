@@ -0,0 +1,280 @@
+package executor
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+	"github.com/pyshx/fake-batch-server/pkg/simulation"
+)
+
+// fakeDocker emulates the parts of the Docker Engine API the executor uses.
+type fakeDocker struct {
+	mu         sync.Mutex
+	pullError  string
+	statusCode int
+	block      bool
+	requests   []string
+	created    map[string]interface{}
+	pulled     string
+	tag        string
+	// archive holds the files copied to the container, by path.
+	archive map[string]string
+	// local and remote are the images known to the daemon and its registry.
+	local  map[string]bool
+	remote map[string]int
+}
+
+func (f *fakeDocker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+	f.mu.Unlock()
+
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/images/") && strings.HasSuffix(r.URL.Path, "/json"):
+		if !f.local[strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/images/"), "/json")] {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"message":"No such image"}`))
+		}
+	case strings.HasPrefix(r.URL.Path, "/distribution/"):
+		if status := f.remote[strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/distribution/"), "/json")]; status != 0 {
+			w.WriteHeader(status)
+			w.Write([]byte(`{"message":"registry error"}`))
+		}
+	case r.URL.Path == "/images/create":
+		f.mu.Lock()
+		f.pulled = r.URL.Query().Get("fromImage")
+		f.tag = r.URL.Query().Get("tag")
+		f.mu.Unlock()
+		w.Write([]byte(`{"status":"Pulling"}` + "\n"))
+		if f.pullError != "" {
+			json.NewEncoder(w).Encode(map[string]string{"error": f.pullError})
+		}
+	case r.URL.Path == "/containers/create":
+		f.mu.Lock()
+		json.NewDecoder(r.Body).Decode(&f.created)
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"Id":"c1"}`))
+	case strings.HasSuffix(r.URL.Path, "/archive"):
+		f.mu.Lock()
+		f.archive = make(map[string]string)
+		reader := tar.NewReader(r.Body)
+		for header, err := reader.Next(); err == nil; header, err = reader.Next() {
+			data, _ := io.ReadAll(reader)
+			f.archive[r.URL.Query().Get("path")+header.Name] = string(data)
+		}
+		f.mu.Unlock()
+	case strings.HasPrefix(r.URL.Path, "/containers/") && strings.HasSuffix(r.URL.Path, "/json"):
+		w.Write([]byte(`{"NetworkSettings":{"Ports":{"8080/tcp":[{"HostIp":"0.0.0.0","HostPort":"49153"}]}}}`))
+	case strings.HasSuffix(r.URL.Path, "/logs"):
+		w.Write(frame(1, "hello\n"))
+		w.Write(frame(2, "oops\n"))
+	case strings.HasSuffix(r.URL.Path, "/wait"):
+		if f.block {
+			<-r.Context().Done()
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]int{"StatusCode": f.statusCode})
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// frame encodes text as a frame of a multiplexed log stream.
+func frame(stream byte, text string) []byte {
+	header := make([]byte, 8)
+	header[0] = stream
+	binary.BigEndian.PutUint32(header[4:], uint32(len(text)))
+	return append(header, text...)
+}
+
+func (f *fakeDocker) calls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.requests...)
+}
+
+func setupDocker(t *testing.T, fake *fakeDocker) *Docker {
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	docker, err := NewDocker("tcp://" + strings.TrimPrefix(server.URL, "http://"))
+	require.NoError(t, err)
+	return docker
+}
+
+func TestNewDocker(t *testing.T) {
+	_, err := NewDocker("")
+	assert.NoError(t, err)
+	_, err = NewDocker("unix:///tmp/docker.sock")
+	assert.NoError(t, err)
+	_, err = NewDocker("ssh://host")
+	assert.Error(t, err)
+}
+
+func TestDocker_Run(t *testing.T) {
+	fake := &fakeDocker{statusCode: 3}
+	docker := setupDocker(t, fake)
+
+	var output bytes.Buffer
+	exitCode, err := docker.Run(context.Background(), &simulation.Execution{
+		Task: "projects/p/locations/l/jobs/j/taskGroups/group0/tasks/0",
+		Container: &api.Container{
+			ImageURI:   "gcr.io/project/image:v1",
+			Commands:   []string{"-c", "exit 3"},
+			Entrypoint: "/bin/sh",
+		},
+		Env:    map[string]string{"B": "2", "A": "1"},
+		Output: &output,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 3, exitCode)
+	assert.Equal(t, "hello\noops\n", output.String())
+
+	assert.Equal(t, "gcr.io/project/image", fake.pulled)
+	assert.Equal(t, "v1", fake.tag)
+	assert.Equal(t, "gcr.io/project/image:v1", fake.created["Image"])
+	assert.Equal(t, []interface{}{"-c", "exit 3"}, fake.created["Cmd"])
+	assert.Equal(t, []interface{}{"/bin/sh"}, fake.created["Entrypoint"])
+	assert.Equal(t, []interface{}{"A=1", "B=2"}, fake.created["Env"])
+	// Logs are streamed while waiting for the container.
+	calls := fake.calls()
+	require.Len(t, calls, 6)
+	assert.Equal(t, []string{
+		"POST /images/create",
+		"POST /containers/create",
+		"POST /containers/c1/start",
+	}, calls[:3])
+	assert.ElementsMatch(t, []string{"GET /containers/c1/logs", "POST /containers/c1/wait"}, calls[3:5])
+	assert.Equal(t, "DELETE /containers/c1", calls[5])
+}
+
+func TestDocker_RunFilesAndMounts(t *testing.T) {
+	fake := &fakeDocker{}
+	docker := setupDocker(t, fake)
+
+	_, err := docker.Run(context.Background(), &simulation.Execution{
+		Container: &api.Container{ImageURI: "mpi", BlockExternalNetwork: true},
+		Files:     map[string]string{"/etc/cloudbatch-taskgroup-hosts": "host-0\nhost-1\n"},
+		Mounts: []simulation.Mount{
+			{Source: "/tmp/input", Target: "/mnt/disks/input", ReadOnly: true},
+			{Source: "/tmp/output", Target: "/mnt/disks/output"},
+			{Source: "/tmp/share", Target: "/share", ReadOnly: true, Options: []string{"z", "rshared"}},
+		},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"/etc/cloudbatch-taskgroup-hosts": "host-0\nhost-1\n"}, fake.archive)
+	assert.Equal(t, map[string]interface{}{
+		"NetworkMode": "none",
+		"Binds":       []interface{}{"/tmp/input:/mnt/disks/input:ro", "/tmp/output:/mnt/disks/output", "/tmp/share:/share:ro,z,rshared"},
+	}, fake.created["HostConfig"])
+	// The files are copied before the container starts.
+	calls := fake.calls()
+	require.GreaterOrEqual(t, len(calls), 4)
+	assert.Equal(t, []string{
+		"POST /images/create",
+		"POST /containers/create",
+		"PUT /containers/c1/archive",
+		"POST /containers/c1/start",
+	}, calls[:4])
+}
+
+func TestDocker_RunPullError(t *testing.T) {
+	fake := &fakeDocker{pullError: "manifest unknown"}
+	docker := setupDocker(t, fake)
+
+	_, err := docker.Run(context.Background(), &simulation.Execution{
+		Container: &api.Container{ImageURI: "missing"},
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "manifest unknown")
+	assert.Equal(t, "latest", fake.tag)
+	assert.Equal(t, []string{"POST /images/create"}, fake.calls())
+}
+
+func TestDocker_RunCancelled(t *testing.T) {
+	fake := &fakeDocker{block: true}
+	docker := setupDocker(t, fake)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := docker.Run(ctx, &simulation.Execution{
+			Container: &api.Container{ImageURI: "busybox"},
+		})
+		done <- err
+	}()
+
+	require.Eventually(t, func() bool {
+		calls := fake.calls()
+		return len(calls) > 0 && calls[len(calls)-1] == "POST /containers/c1/wait"
+	}, 5*time.Second, 10*time.Millisecond)
+	cancel()
+
+	assert.ErrorIs(t, <-done, context.Canceled)
+	assert.Contains(t, fake.calls(), "POST /containers/c1/kill")
+	assert.Contains(t, fake.calls(), "DELETE /containers/c1")
+}
+
+func TestDocker_StartService(t *testing.T) {
+	fake := &fakeDocker{local: map[string]bool{"fake-batch-server:latest": true}}
+	docker := setupDocker(t, fake)
+
+	service, err := docker.StartService(context.Background(), "fake-batch-server:latest", 8080, map[string]string{"VERBOSE": "true"})
+	require.NoError(t, err)
+	assert.Equal(t, "c1", service.ID)
+	assert.Equal(t, "127.0.0.1:49153", service.Address)
+	// The image is only pulled if the daemon lacks it.
+	assert.Empty(t, fake.pulled)
+	assert.Equal(t, map[string]interface{}{"8080/tcp": map[string]interface{}{}}, fake.created["ExposedPorts"])
+	assert.Equal(t, []interface{}{"VERBOSE=true"}, fake.created["Env"])
+
+	require.NoError(t, docker.StopService(context.Background(), service.ID))
+	assert.Equal(t, "DELETE /containers/c1", fake.calls()[len(fake.calls())-1])
+}
+
+func TestDocker_ImageExists(t *testing.T) {
+	fake := &fakeDocker{
+		local: map[string]bool{"local:v1": true},
+		remote: map[string]int{
+			"missing:v1": http.StatusNotFound,
+			"private:v1": http.StatusUnauthorized,
+			"broken:v1":  http.StatusInternalServerError,
+		},
+	}
+	docker := setupDocker(t, fake)
+	ctx := context.Background()
+
+	exists, err := docker.ImageExists(ctx, "local:v1")
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	exists, err = docker.ImageExists(ctx, "gcr.io/project/remote:v1")
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	exists, err = docker.ImageExists(ctx, "missing:v1")
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	exists, err = docker.ImageExists(ctx, "private:v1")
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	_, err = docker.ImageExists(ctx, "broken:v1")
+	assert.Error(t, err)
+}
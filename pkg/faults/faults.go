@@ -0,0 +1,209 @@
+// Package faults implements a configurable fault matrix: rules mapping API
+// requests, by endpoint and condition, to the error they fail with. It lets
+// QA make the emulator return every error a Batch client may see, driven
+// entirely by configuration.
+package faults
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Rule fails the API requests that match its endpoint and condition with
+// its error.
+type Rule struct {
+	// Name identifies the rule in logs. Defaults to faults[N].
+	Name string `yaml:"name"`
+	// Method is the HTTP method requests must use, e.g. POST. Empty matches
+	// any.
+	Method string `yaml:"method"`
+	// Path is a regular expression the request path must match, e.g.
+	// /jobs$ for CreateJob and ListJobs. Empty matches any.
+	Path string `yaml:"path"`
+	// When further narrows the matching requests.
+	When Condition `yaml:"when"`
+	// Error is what matching requests fail with.
+	Error Error `yaml:"error"`
+
+	path *regexp.Regexp
+	hits int
+}
+
+// Condition selects the requests of an endpoint a rule applies to. Unset
+// fields match every request.
+type Condition struct {
+	// Project is the project the request path names.
+	Project string `yaml:"project"`
+	// Headers are request headers that must have the given values, e.g.
+	// {"X-Fault": "quota"} to let a test pick the error per request.
+	Headers map[string]string `yaml:"headers"`
+	// Query are query parameters that must have the given values.
+	Query map[string]string `yaml:"query"`
+	// Times limits the rule to the first Times matching requests, e.g. 2 to
+	// fail twice and then let retries through.
+	Times int `yaml:"times"`
+	// Rate is the probability, between 0 and 1, that a matching request
+	// fails. Zero means always.
+	Rate float64 `yaml:"rate"`
+}
+
+// Error is the error a rule answers with, in the Google API error format.
+type Error struct {
+	// Code is the HTTP status, e.g. 429.
+	Code int `yaml:"code"`
+	// Status is the google.rpc.Code name, e.g. RESOURCE_EXHAUSTED. Defaults
+	// to the one matching Code.
+	Status string `yaml:"status"`
+	// Message is the error message. Defaults to the text of Code.
+	Message string `yaml:"message"`
+	// Details are returned as the error details, e.g. a
+	// google.rpc.RetryInfo with its "@type".
+	Details []map[string]interface{} `yaml:"details"`
+}
+
+// Matrix holds the fault rules, tried in order.
+type Matrix struct {
+	mu    sync.Mutex
+	rules []*Rule
+}
+
+// NewMatrix creates a Matrix of rules, compiling and checking each one.
+func NewMatrix(rules []*Rule) (*Matrix, error) {
+	for i, rule := range rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("faults[%d]", i)
+		}
+		path, err := regexp.Compile(rule.Path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid path: %v", rule.Name, err)
+		}
+		rule.path = path
+		if rule.Error.Code < 400 || rule.Error.Code > 599 {
+			return nil, fmt.Errorf("%s: error code must be between 400 and 599, got %d", rule.Name, rule.Error.Code)
+		}
+		if rule.When.Times < 0 {
+			return nil, fmt.Errorf("%s: times must not be negative, got %d", rule.Name, rule.When.Times)
+		}
+		if rule.When.Rate < 0 || rule.When.Rate > 1 {
+			return nil, fmt.Errorf("%s: rate must be between 0 and 1, got %v", rule.Name, rule.When.Rate)
+		}
+	}
+	return &Matrix{rules: rules}, nil
+}
+
+// Load reads the rules of a YAML/JSON file, e.g.:
+//
+//	faults:
+//	  - name: create-quota
+//	    method: POST
+//	    path: /jobs$
+//	    when:
+//	      headers: {X-Fault: quota}
+//	    error:
+//	      code: 429
+//	      message: Quota exceeded for quota metric 'Job create requests'
+//	  - name: flaky-get
+//	    method: GET
+//	    path: /jobs/[^/]+$
+//	    when: {project: flaky, times: 2}
+//	    error: {code: 503}
+func Load(path string) (*Matrix, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config struct {
+		Faults []*Rule `yaml:"faults"`
+	}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse fault matrix %s: %v", path, err)
+	}
+	matrix, err := NewMatrix(config.Faults)
+	if err != nil {
+		return nil, fmt.Errorf("invalid fault matrix %s: %v", path, err)
+	}
+	return matrix, nil
+}
+
+// Match returns the first rule that fails r, or nil if r is to be handled.
+// Rules limited to a number of requests count the ones they failed.
+func (m *Matrix) Match(r *http.Request) *Rule {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, rule := range m.rules {
+		if !rule.matches(r) {
+			continue
+		}
+		if rule.When.Times > 0 && rule.hits >= rule.When.Times {
+			continue
+		}
+		if rule.When.Rate > 0 && rand.Float64() >= rule.When.Rate {
+			continue
+		}
+		rule.hits++
+		return rule
+	}
+	return nil
+}
+
+// Reset forgets how many requests each rule failed.
+func (m *Matrix) Reset() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, rule := range m.rules {
+		rule.hits = 0
+	}
+}
+
+// matches reports whether r is a request of the rule's endpoint that meets
+// its condition, ignoring Times and Rate.
+func (rule *Rule) matches(r *http.Request) bool {
+	if rule.Method != "" && !strings.EqualFold(rule.Method, r.Method) {
+		return false
+	}
+	if !rule.path.MatchString(r.URL.Path) {
+		return false
+	}
+	if rule.When.Project != "" && project(r.URL.Path) != rule.When.Project {
+		return false
+	}
+	for name, value := range rule.When.Headers {
+		if r.Header.Get(name) != value {
+			return false
+		}
+	}
+	query := r.URL.Query()
+	for name, value := range rule.When.Query {
+		if query.Get(name) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// project returns the project named by an API path, e.g. p for
+// /v1/projects/p/locations/l/jobs.
+func project(path string) string {
+	_, rest, ok := strings.Cut(path, "/projects/")
+	if !ok {
+		return ""
+	}
+	project, _, _ := strings.Cut(rest, "/")
+	return project
+}
@@ -0,0 +1,77 @@
+package faults
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "faults.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+faults:
+  - name: create-quota
+    method: POST
+    path: /jobs$
+    when:
+      headers: {X-Fault: quota}
+    error:
+      code: 429
+      status: RESOURCE_EXHAUSTED
+      details:
+        - "@type": type.googleapis.com/google.rpc.RetryInfo
+          retryDelay: 30s
+  - method: get
+    path: /jobs/[^/]+$
+    when: {project: flaky, query: {view: full}, times: 2}
+    error: {code: 503}
+`), 0o644))
+
+	matrix, err := Load(path)
+	require.NoError(t, err)
+
+	r := httptest.NewRequest("POST", "/v1/projects/p/locations/l/jobs", nil)
+	assert.Nil(t, matrix.Match(r))
+	r.Header.Set("X-Fault", "quota")
+	rule := matrix.Match(r)
+	require.NotNil(t, rule)
+	assert.Equal(t, "create-quota", rule.Name)
+	assert.Equal(t, "RESOURCE_EXHAUSTED", rule.Error.Status)
+	assert.Equal(t, "30s", rule.Error.Details[0]["retryDelay"])
+
+	get := httptest.NewRequest("GET", "/v1/projects/flaky/locations/l/jobs/j?view=full", nil)
+	for i := 0; i < 2; i++ {
+		rule = matrix.Match(get)
+		require.NotNil(t, rule)
+		assert.Equal(t, "faults[1]", rule.Name)
+	}
+	assert.Nil(t, matrix.Match(get), "the rule is used up")
+	matrix.Reset()
+	assert.NotNil(t, matrix.Match(get))
+
+	assert.Nil(t, matrix.Match(httptest.NewRequest("GET", "/v1/projects/other/locations/l/jobs/j?view=full", nil)))
+	assert.Nil(t, matrix.Match(httptest.NewRequest("GET", "/v1/projects/flaky/locations/l/jobs/j", nil)))
+
+	var none *Matrix
+	assert.Nil(t, none.Match(get))
+}
+
+func TestNewMatrix_Invalid(t *testing.T) {
+	tests := map[string]*Rule{
+		"Path":    {Path: "(", Error: Error{Code: 500}},
+		"Code":    {Error: Error{Code: 200}},
+		"Times":   {When: Condition{Times: -1}, Error: Error{Code: 500}},
+		"Rate":    {When: Condition{Rate: 1.5}, Error: Error{Code: 500}},
+		"NoError": {Path: "/jobs"},
+	}
+	for name, rule := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := NewMatrix([]*Rule{rule})
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,176 @@
+// Package fuzz drives the API handlers in process so that go test -fuzz can
+// search for requests that crash the server or break its invariants. Use
+// FuzzCreateJob from a fuzz test of your own, or build targets for other
+// methods on a Harness.
+package fuzz
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+	"github.com/pyshx/fake-batch-server/pkg/clock"
+	"github.com/pyshx/fake-batch-server/pkg/handlers"
+	"github.com/pyshx/fake-batch-server/pkg/storage"
+)
+
+// maxTaskCount caps task groups in a Harness so that single inputs cannot make
+// an iteration create the production limit of tasks.
+const maxTaskCount = 1000
+
+// Parent is the project and location the jobs of FuzzCreateJob are created in.
+const Parent = "projects/fuzz/locations/us-central1"
+
+// Harness is a handler with an in-memory store, driven by a fake clock so that
+// simulations stay put unless the fuzz target advances it.
+type Harness struct {
+	Handler *handlers.Handler
+	Clock   *clock.Fake
+	router  *mux.Router
+}
+
+// NewHarness creates a Harness serving the v1 job, task and operation
+// methods. Close it when done.
+func NewHarness() *Harness {
+	fake := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	handler := handlers.NewHandlerWithConfig(storage.NewMemoryStore(), handlers.Config{
+		Clock:        fake,
+		MaxTaskCount: maxTaskCount,
+	})
+
+	router := mux.NewRouter()
+	router.Use(handler.DeadlineMiddleware)
+	v1 := router.PathPrefix("/v1").Subrouter()
+	v1.HandleFunc("/projects/{project}/locations/{location}/jobs", handler.CreateJob).Methods("POST")
+	v1.HandleFunc("/projects/{project}/locations/{location}/jobs", handler.ListJobs).Methods("GET")
+	v1.HandleFunc("/projects/{project}/locations/{location}/jobs:lint", handler.LintJob).Methods("POST")
+	v1.HandleFunc("/projects/{project}/locations/{location}/jobs/{job}", handler.GetJob).Methods("GET")
+	v1.HandleFunc("/projects/{project}/locations/{location}/jobs/{job}", handler.DeleteJob).Methods("DELETE")
+	v1.HandleFunc("/projects/{project}/locations/{location}/jobs/{job}/tasks", handler.ListTasks).Methods("GET")
+	v1.HandleFunc("/projects/{project}/locations/{location}/jobs/{job}/taskGroups/{group}/tasks/{task}", handler.GetTask).Methods("GET")
+	v1.HandleFunc("/projects/{project}/locations/{location}/operations/{operation}", handler.GetOperation).Methods("GET")
+
+	return &Harness{Handler: handler, Clock: fake, router: router}
+}
+
+// Do serves a request with the given body, which may be empty, and returns
+// the response.
+func (h *Harness) Do(method, path string, body []byte) *http.Response {
+	var reader io.Reader
+	if body != nil {
+		reader = strings.NewReader(string(body))
+	}
+	w := httptest.NewRecorder()
+	h.router.ServeHTTP(w, httptest.NewRequest(method, path, reader))
+	return w.Result()
+}
+
+// Close stops the simulations the handler started.
+func (h *Harness) Close() {
+	h.Handler.Close()
+}
+
+// FuzzCreateJob fuzzes the body of CreateJob, seeded with a few valid jobs.
+// Every request must be answered with 200 or a 4xx error in the Google error
+// format, and an accepted job must be readable along with all of its tasks.
+// Call it from a fuzz test:
+//
+//	func FuzzCreateJob(f *testing.F) { fuzz.FuzzCreateJob(f) }
+func FuzzCreateJob(f *testing.F) {
+	for _, seed := range []string{
+		`{}`,
+		`{"taskGroups": [{"taskCount": 3, "parallelism": 1, "taskSpec": {"runnables": [{"script": {"text": "echo hi"}}]}}]}`,
+		`{"taskGroups": [{"taskSpec": {"runnables": [{"container": {"imageUri": "busybox"}, "timeout": "5s"}], "maxRunDuration": "60s"}}], "logsPolicy": {"destination": "CLOUD_LOGGING"}}`,
+		`{"labels": {"fake-batch/final-state": "FAILED"}, "taskGroups": [{"taskCount": 2, "schedulingPolicy": "IN_ORDER"}]}`,
+	} {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, body []byte) {
+		h := NewHarness()
+		defer h.Close()
+		CheckCreateJob(t, h, body)
+	})
+}
+
+// CheckCreateJob creates a job from body on h and fails t if the response or
+// the state it leaves behind breaks the invariants of FuzzCreateJob.
+func CheckCreateJob(t testing.TB, h *Harness, body []byte) {
+	t.Helper()
+
+	resp := h.Do(http.MethodPost, "/v1/"+Parent+"/jobs", body)
+	if resp.StatusCode != http.StatusOK {
+		checkError(t, resp)
+		return
+	}
+
+	var job api.Job
+	if err := json.NewDecoder(resp.Body).Decode(&job); err != nil {
+		t.Fatalf("CreateJob returned an invalid job: %v", err)
+	}
+	if !strings.HasPrefix(job.Name, Parent+"/jobs/") {
+		t.Fatalf("CreateJob returned job %q outside %s", job.Name, Parent)
+	}
+
+	checkJob(t, h, &job)
+}
+
+// checkJob fails t unless job and its tasks can be read back.
+func checkJob(t testing.TB, h *Harness, job *api.Job) {
+	t.Helper()
+
+	resp := h.Do(http.MethodGet, "/v1/"+job.Name, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GetJob %s returned %d", job.Name, resp.StatusCode)
+	}
+	var got api.Job
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatalf("GetJob %s returned an invalid job: %v", job.Name, err)
+	}
+	if got.UID != job.UID {
+		t.Fatalf("GetJob %s returned UID %q, want %q", job.Name, got.UID, job.UID)
+	}
+
+	resp = h.Do(http.MethodGet, "/v1/"+job.Name+"/tasks", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("ListTasks %s returned %d", job.Name, resp.StatusCode)
+	}
+	var tasks api.ListTasksResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tasks); err != nil {
+		t.Fatalf("ListTasks %s returned invalid tasks: %v", job.Name, err)
+	}
+	want := int64(0)
+	for _, group := range job.TaskGroups {
+		want += group.TaskCount
+	}
+	if int64(len(tasks.Tasks)) != want {
+		t.Fatalf("ListTasks %s returned %d tasks, want %d", job.Name, len(tasks.Tasks), want)
+	}
+}
+
+// checkError fails t unless resp is a client error in the Google error
+// format whose code matches its status.
+func checkError(t testing.TB, resp *http.Response) {
+	t.Helper()
+
+	if resp.StatusCode < 400 || resp.StatusCode >= 500 {
+		t.Fatalf("CreateJob returned %d, want 200 or a client error", resp.StatusCode)
+	}
+	var envelope api.ErrorResponse
+	if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil || envelope.Error == nil {
+		t.Fatalf("CreateJob returned %d without an error body: %v", resp.StatusCode, err)
+	}
+	if envelope.Error.Code != resp.StatusCode {
+		t.Fatalf("CreateJob returned %d with error code %d", resp.StatusCode, envelope.Error.Code)
+	}
+	if envelope.Error.Message == "" {
+		t.Fatalf("CreateJob returned %d without an error message", resp.StatusCode)
+	}
+}
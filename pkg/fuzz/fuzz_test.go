@@ -0,0 +1,11 @@
+package fuzz_test
+
+import (
+	"testing"
+
+	"github.com/pyshx/fake-batch-server/pkg/fuzz"
+)
+
+func FuzzCreateJob(f *testing.F) {
+	fuzz.FuzzCreateJob(f)
+}
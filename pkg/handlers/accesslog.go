@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// AccessLogMiddleware logs every request once it has been handled, with its
+// method, path, status code and latency, its request ID, and the project,
+// location and job it names. Health checks and metrics
+// scrapes, which are polled constantly, are only logged at debug level.
+func AccessLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		fields := logrus.Fields{
+			"method":         r.Method,
+			"path":           r.URL.Path,
+			"status":         recorder.status,
+			"latencySeconds": time.Since(start).Seconds(),
+		}
+		id := recorder.Header().Get(requestIDHeader)
+		if id == "" {
+			id = r.Header.Get(requestIDHeader)
+		}
+		if id != "" {
+			fields["requestId"] = id
+		}
+		vars := mux.Vars(r)
+		for _, key := range []string{"project", "location"} {
+			if value := vars[key]; value != "" {
+				fields[key] = value
+			}
+		}
+		if vars["job"] != "" {
+			fields["job"] = fmt.Sprintf("projects/%s/locations/%s/jobs/%s", vars["project"], vars["location"], vars["job"])
+		}
+
+		entry := logrus.WithFields(fields)
+		if r.URL.Path == "/v1/health" || r.URL.Path == "/metrics" {
+			entry.Debug("Request handled")
+		} else {
+			entry.Info("Request handled")
+		}
+	})
+}
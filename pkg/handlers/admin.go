@@ -0,0 +1,484 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+	"github.com/pyshx/fake-batch-server/pkg/doctor"
+	"github.com/pyshx/fake-batch-server/pkg/pubsub"
+	"github.com/pyshx/fake-batch-server/pkg/storage"
+	"github.com/pyshx/fake-batch-server/pkg/webhook"
+)
+
+// advancer is implemented by clocks that can be stepped forward manually.
+type advancer interface {
+	Advance(d time.Duration) time.Time
+}
+
+// AdvanceClockResponse is returned by AdvanceClock.
+type AdvanceClockResponse struct {
+	Now time.Time `json:"now"`
+}
+
+// AdvanceClock steps the simulation clock forward by the duration given in
+// the duration query parameter (e.g. ?duration=5s). It is only available when
+// the server runs with a fake clock.
+func (h *Handler) AdvanceClock(w http.ResponseWriter, r *http.Request) {
+	fake, ok := h.clock.(advancer)
+	if !ok {
+		writeError(w, http.StatusBadRequest, "Clock cannot be advanced; start the server with --deterministic")
+		return
+	}
+
+	d, err := time.ParseDuration(r.URL.Query().Get("duration"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid duration: %v", err)
+		return
+	}
+	if d < 0 {
+		writeError(w, http.StatusBadRequest, "Invalid duration: %s is negative", d)
+		return
+	}
+
+	now := fake.Advance(d)
+	requestLog(w).Debugf("Advanced clock by %s to %s", d, now)
+	writeJSON(w, http.StatusOK, &AdvanceClockResponse{Now: now})
+}
+
+// Snapshot dumps every job and task in the store. The output can be saved and
+// compared with `fake-batch-server diff`.
+func (h *Handler) Snapshot(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.store.Snapshot())
+}
+
+// Reset stops every simulation and pending deletion, then wipes the store,
+// task logs, written log entries, in-memory Pub/Sub topics, the kept audit
+// entries, the jobs counted against per-minute quotas, the remembered
+// requestIds, the resource allowances and the built-in object store. Test
+// suites can call it between test cases to start from a clean slate without
+// restarting the server. Webhooks, the projects registered for tenant mode
+// and the clock are left alone.
+func (h *Handler) Reset(w http.ResponseWriter, r *http.Request) {
+	h.sim.Reset()
+
+	for _, job := range h.store.Snapshot().Jobs {
+		h.logs.DeleteJob(job.Name)
+	}
+	if err := h.store.Restore(&storage.Snapshot{}); err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to reset store: %v", err)
+		return
+	}
+	h.logging.Reset()
+	h.topics.Reset()
+	h.audit.Reset()
+	h.quotaMu.Lock()
+	h.recentCreates = make(map[string][]time.Time)
+	h.quotaMu.Unlock()
+	h.requestMu.Lock()
+	h.createRequests = make(map[string]*createRequest)
+	h.requestMu.Unlock()
+	h.allowanceMu.Lock()
+	h.allowances = make(map[string]*api.ResourceAllowance)
+	h.allowanceMu.Unlock()
+	h.faults.Reset()
+	if h.objects != nil {
+		h.objects.Reset()
+	}
+
+	requestLog(w).Info("Reset server state")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListAllJobs returns the jobs of every project and location, sorted by
+// name. The optional project and state query parameters narrow the list.
+func (h *Handler) ListAllJobs(w http.ResponseWriter, r *http.Request) {
+	project := r.URL.Query().Get("project")
+	state := api.JobState(r.URL.Query().Get("state"))
+
+	jobs := make([]*api.Job, 0)
+	for _, job := range h.store.Snapshot().Jobs {
+		if project != "" && !strings.HasPrefix(job.Name, "projects/"+project+"/") {
+			continue
+		}
+		if state != "" && job.State != state {
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	writeJSON(w, http.StatusOK, &api.ListJobsResponse{Jobs: jobs})
+}
+
+// StateStats counts jobs and tasks by state.
+type StateStats struct {
+	Jobs  map[api.JobState]int  `json:"jobs"`
+	Tasks map[api.TaskState]int `json:"tasks"`
+	// Projects counts the jobs of each project by state.
+	Projects map[string]map[api.JobState]int `json:"projects"`
+	// PendingOperations is the number of operations not yet done.
+	PendingOperations int `json:"pendingOperations"`
+}
+
+// Stats counts the jobs and tasks in the store by state, overall and per
+// project. The optional project query parameter narrows the counts to one
+// project. In tenant mode every registered project is listed, even without
+// jobs.
+func (h *Handler) Stats(w http.ResponseWriter, r *http.Request) {
+	only := r.URL.Query().Get("project")
+	snapshot := h.store.Snapshot()
+	stats := &StateStats{
+		Jobs:     make(map[api.JobState]int),
+		Tasks:    make(map[api.TaskState]int),
+		Projects: make(map[string]map[api.JobState]int),
+	}
+	if h.projects != nil {
+		for _, project := range h.projects.List() {
+			if only == "" || project == only {
+				stats.Projects[project] = make(map[api.JobState]int)
+			}
+		}
+	}
+
+	for _, job := range snapshot.Jobs {
+		project, _, _ := strings.Cut(strings.TrimPrefix(job.Name, "projects/"), "/")
+		if only != "" && project != only {
+			continue
+		}
+		stats.Jobs[job.State]++
+		if stats.Projects[project] == nil {
+			stats.Projects[project] = make(map[api.JobState]int)
+		}
+		stats.Projects[project][job.State]++
+	}
+	for name, tasks := range snapshot.Tasks {
+		if only != "" && !strings.HasPrefix(name, "projects/"+only+"/") {
+			continue
+		}
+		for _, task := range tasks {
+			stats.Tasks[task.Status.State]++
+		}
+	}
+	for _, op := range snapshot.Operations {
+		if !op.Done && (only == "" || strings.HasPrefix(op.Name, "projects/"+only+"/")) {
+			stats.PendingOperations++
+		}
+	}
+
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// SimulatorStats reports how many jobs are being simulated, how many
+// transitions are queued and how many goroutines are running.
+func (h *Handler) SimulatorStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.sim.Stats())
+}
+
+// Doctor scans the store for inconsistent jobs and tasks. The optional
+// deleting_threshold query parameter (e.g. ?deleting_threshold=5m) sets how
+// long a job may stay DELETING. Findings are repaired when repair=true is
+// passed to a POST. Jobs still being simulated are skipped.
+func (h *Handler) Doctor(w http.ResponseWriter, r *http.Request) {
+	opts := doctor.Options{
+		Now:  h.clock.Now(),
+		Skip: h.sim.Running,
+	}
+
+	if value := r.URL.Query().Get("deleting_threshold"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			writeError(w, http.StatusBadRequest, "Invalid deleting_threshold %q", value)
+			return
+		}
+		opts.DeletingThreshold = d
+	}
+
+	if value := r.URL.Query().Get("repair"); value != "" {
+		repair, err := strconv.ParseBool(value)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid repair %q", value)
+			return
+		}
+		if repair && r.Method != http.MethodPost {
+			writeError(w, http.StatusBadRequest, "Repairs must be requested with POST")
+			return
+		}
+		opts.Repair = repair
+	}
+
+	report := doctor.Check(h.store, opts)
+	if len(report.Findings) > 0 {
+		requestLog(w).Warnf("Doctor found %d issue(s) in %d job(s)", len(report.Findings), report.CheckedJobs)
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// SetPriorityRequest is the body accepted by SetJobPriority.
+type SetPriorityRequest struct {
+	Priority int32 `json:"priority"`
+}
+
+// SetJobPriority changes the priority of a job that is still QUEUED and
+// records the change as a status event.
+func (h *Handler) SetJobPriority(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	jobName := fmt.Sprintf("projects/%s/locations/%s/jobs/%s", vars["project"], vars["location"], vars["job"])
+
+	var req SetPriorityRequest
+	if err := h.decodeBody(r.Body, &req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if req.Priority < 0 || req.Priority > 99 {
+		writeError(w, http.StatusBadRequest, "Invalid priority %d, must be between 0 and 99", req.Priority)
+		return
+	}
+
+	store := h.storeFor(r)
+	job, err := store.GetJob(jobName)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "Job not found: %v", err)
+		return
+	}
+
+	// The job is changed between the steps of its simulation, if it is
+	// being simulated, which would otherwise overwrite the change.
+	var previous int32
+	now := h.clock.Now()
+	reprioritize := func(job *api.Job) error {
+		if job.State != api.JobStateQueued {
+			return &patchError{fmt.Sprintf("Job %s is %s; only QUEUED jobs can be reprioritized", jobName, job.State)}
+		}
+		previous = job.Priority
+		job.Priority = req.Priority
+		job.UpdateTime = now
+		job.Status.StatusEvents = append(job.Status.StatusEvents, &api.StatusEvent{
+			Type:        "priority_changed",
+			Description: fmt.Sprintf("Job priority changed from %d to %d", previous, req.Priority),
+			EventTime:   now,
+		})
+		return nil
+	}
+	simulated, err := h.sim.Update(jobName, reprioritize)
+	if !simulated {
+		if err = reprioritize(job); err == nil {
+			err = store.UpdateJob(job)
+		}
+	}
+	var invalid *patchError
+	if errors.As(err, &invalid) {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to update job: %v", err)
+		return
+	}
+	h.sim.Reprioritize(jobName, req.Priority)
+
+	if job, err = store.GetJob(jobName); err != nil {
+		writeError(w, http.StatusNotFound, "Job not found: %v", err)
+		return
+	}
+
+	requestLog(w).Infof("Changed priority of job %s from %d to %d", jobName, previous, req.Priority)
+	writeJSON(w, http.StatusOK, job)
+}
+
+// ForceStateRequest is the body accepted by ForceJobState.
+type ForceStateRequest struct {
+	State api.JobState `json:"state"`
+}
+
+// ForceJobState stops the simulation of a job and moves it straight to the
+// SUCCEEDED or FAILED state given in the body. Tasks that have not finished
+// end in the same state. The job's change is notified, and its completion
+// callbacks called, like a simulated job completing; the tasks' are not.
+func (h *Handler) ForceJobState(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	jobName := fmt.Sprintf("projects/%s/locations/%s/jobs/%s", vars["project"], vars["location"], vars["job"])
+
+	var req ForceStateRequest
+	if err := h.decodeBody(r.Body, &req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if req.State != api.JobStateSucceeded && req.State != api.JobStateFailed {
+		writeError(w, http.StatusBadRequest, "Unsupported state %q, must be SUCCEEDED or FAILED", req.State)
+		return
+	}
+
+	store := h.storeFor(r)
+	job, err := store.GetJob(jobName)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "Job not found: %v", err)
+		return
+	}
+	switch job.State {
+	case api.JobStateSucceeded, api.JobStateFailed, api.JobStateCancellationInProgress, api.JobStateCancelled,
+		api.JobStateDeleting, api.JobStateDeleted:
+		writeError(w, http.StatusBadRequest, "Job %s is already %s", jobName, job.State)
+		return
+	}
+
+	// Stop the simulation first so it cannot overwrite the forced state, and read
+	// the job again, as the simulation may have saved it since.
+	h.sim.Stop(jobName)
+	if job, err = store.GetJob(jobName); err != nil {
+		writeError(w, http.StatusNotFound, "Job not found: %v", err)
+		return
+	}
+
+	if job.Status == nil {
+		job.Status = &api.JobStatus{}
+	}
+	previous := job.Status.TaskGroups
+	job.Status.TaskGroups = make(map[string]*api.TaskGroupStatus)
+
+	now := h.clock.Now()
+	taskState := api.TaskState(req.State)
+	for _, taskGroup := range job.TaskGroups {
+		var counts map[string]int64
+		var err error
+		if storage.Lazy(taskGroup) {
+			counts, err = forceLazyTasks(store, job, taskGroup, taskState, now)
+		} else {
+			counts, err = forceTasks(store, job, taskGroup, taskState, now)
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "Failed to update tasks: %v", err)
+			return
+		}
+		status := &api.TaskGroupStatus{Counts: counts}
+		if previous[taskGroup.Name] != nil {
+			status.Instances = previous[taskGroup.Name].Instances
+		}
+		job.Status.TaskGroups[taskGroup.Name] = status
+	}
+	job.State = req.State
+	job.UpdateTime = now
+	job.Status.State = req.State
+	job.Status.StatusEvents = append(job.Status.StatusEvents, &api.StatusEvent{
+		Type:        "job_forced",
+		Description: fmt.Sprintf("Job state forced to %s", req.State),
+		EventTime:   now,
+	})
+	if err := store.UpdateJob(job); err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to update job: %v", err)
+		return
+	}
+	h.sim.Complete(r.Context(), job, now)
+
+	requestLog(w).Infof("Forced job %s to %s", jobName, req.State)
+	writeJSON(w, http.StatusOK, job)
+}
+
+// forceTasks moves the unfinished stored tasks of taskGroup to state and
+// returns the group's task counts.
+func forceTasks(store storage.Store, job *api.Job, taskGroup *api.TaskGroup, state api.TaskState, now time.Time) (map[string]int64, error) {
+	counts := make(map[string]int64)
+	for index := int64(0); index < taskGroup.TaskCount; index++ {
+		task, err := store.GetTask(job.Name, fmt.Sprintf("%s/taskGroups/%s/tasks/%d", job.Name, taskGroup.Name, index))
+		if err != nil {
+			return nil, err
+		}
+		switch task.Status.State {
+		case api.TaskStateSucceeded, api.TaskStateFailed, api.TaskStateAborted:
+		default:
+			task.Status.State = state
+			task.Status.StatusEvents = append(task.Status.StatusEvents, &api.StatusEvent{
+				Type:        "task_forced",
+				Description: fmt.Sprintf("Task state forced to %s", state),
+				EventTime:   now,
+			})
+			if err := store.UpdateTask(job.Name, task); err != nil {
+				return nil, err
+			}
+		}
+		counts[string(task.Status.State)]++
+	}
+	return counts, nil
+}
+
+// forceLazyTasks moves the unfinished tasks of taskGroup to state through
+// the group's progress, if it is lazy, rather than storing each of them, and
+// returns the group's task counts. Groups grown past the limit after the job
+// was created keep their stored tasks.
+func forceLazyTasks(store storage.Store, job *api.Job, taskGroup *api.TaskGroup, state api.TaskState, now time.Time) (map[string]int64, error) {
+	progress, err := store.GetTaskProgress(job.Name, taskGroup.Name)
+	if err != nil {
+		return forceTasks(store, job, taskGroup, state, now)
+	}
+	if progress.Finished < taskGroup.TaskCount {
+		progress.Forced = &storage.TaskForce{State: state, At: now}
+		if err := store.UpdateTaskProgress(job.Name, taskGroup.Name, progress); err != nil {
+			return nil, err
+		}
+	}
+	return progress.Counts(taskGroup.TaskCount), nil
+}
+
+// TopicMessagesResponse lists the messages published to a topic.
+type TopicMessagesResponse struct {
+	Messages []*pubsub.Message `json:"messages"`
+}
+
+// ListTopicMessages returns the job notifications published to an in-memory
+// Pub/Sub topic, oldest first. Nothing is recorded when notifications go to
+// a Pub/Sub emulator.
+func (h *Handler) ListTopicMessages(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	topic := fmt.Sprintf("projects/%s/topics/%s", vars["project"], vars["topic"])
+	writeJSON(w, http.StatusOK, &TopicMessagesResponse{Messages: h.topics.Messages(topic)})
+}
+
+// ClearTopicMessages drops the messages published to an in-memory Pub/Sub
+// topic.
+func (h *Handler) ClearTopicMessages(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	h.topics.Clear(fmt.Sprintf("projects/%s/topics/%s", vars["project"], vars["topic"]))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// WebhooksResponse lists the registered webhooks.
+type WebhooksResponse struct {
+	Webhooks []*webhook.Hook `json:"webhooks"`
+}
+
+// ListWebhooks returns the webhooks called on state changes.
+func (h *Handler) ListWebhooks(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, &WebhooksResponse{Webhooks: h.webhooks.List()})
+}
+
+// CreateWebhook registers a webhook called on every state change it selects,
+// e.g. {"url": "http://localhost:9000/events", "types": ["JOB_STATE_CHANGED"]}.
+func (h *Handler) CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	var hook webhook.Hook
+	if err := h.decodeBody(r.Body, &hook); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+
+	if err := h.webhooks.Add(&hook); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid webhook: %v", err)
+		return
+	}
+
+	requestLog(w).Infof("Registered webhook %s for %s", hook.ID, hook.URL)
+	writeJSON(w, http.StatusOK, &hook)
+}
+
+// DeleteWebhook unregisters a webhook.
+func (h *Handler) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if !h.webhooks.Remove(id) {
+		writeError(w, http.StatusNotFound, "Webhook %s not found", id)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
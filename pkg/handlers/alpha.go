@@ -0,0 +1,330 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+	"github.com/pyshx/fake-batch-server/pkg/simulation"
+)
+
+const (
+	cancelJobResponseType = "type.googleapis.com/google.cloud.batch.v1alpha.CancelJobResponse"
+
+	// codeAborted is the google.rpc.Code for ABORTED errors.
+	codeAborted = 10
+)
+
+// calendarPeriods are the periods a resource allowance limit may span.
+var calendarPeriods = map[string]bool{"DAY": true, "WEEK": true, "MONTH": true, "QUARTER": true, "YEAR": true}
+
+// apiVersion returns the API version a request was made against, "v1" or
+// "v1alpha", from the first segment of its path.
+func apiVersion(r *http.Request) string {
+	version, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	return version
+}
+
+// CancelJob stops a job that has not finished yet and returns a long-running
+// operation that completes once the job is CANCELLED. The job is
+// CANCELLATION_IN_PROGRESS in the meantime, and its unfinished tasks end
+// FAILED. Only the v1alpha API offers it.
+func (h *Handler) CancelJob(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	project := vars["project"]
+	location := vars["location"]
+	jobName := fmt.Sprintf("projects/%s/locations/%s/jobs/%s", project, location, vars["job"])
+
+	store := h.storeFor(r)
+	job, err := store.GetJob(jobName)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "Job not found: %v", err)
+		return
+	}
+	switch job.State {
+	case api.JobStateSucceeded, api.JobStateFailed, api.JobStateCancelled, api.JobStateCancellationInProgress,
+		api.JobStateDeleting, api.JobStateDeleted:
+		writeError(w, http.StatusBadRequest, "Job %s is %s and cannot be cancelled", jobName, job.State)
+		return
+	}
+
+	// Stop the simulation first so it cannot overwrite the cancellation, and read
+	// the job again, as the simulation may have saved it since.
+	h.sim.Stop(jobName)
+	if job, err = store.GetJob(jobName); err != nil {
+		writeError(w, http.StatusNotFound, "Job not found: %v", err)
+		return
+	}
+
+	job.State = api.JobStateCancellationInProgress
+	job.UpdateTime = h.clock.Now()
+	if job.Status == nil {
+		job.Status = &api.JobStatus{}
+	}
+	job.Status.State = job.State
+	job.Status.StatusEvents = append(job.Status.StatusEvents, &api.StatusEvent{
+		Type:        "job_cancelling",
+		Description: "Job cancellation requested",
+		EventTime:   job.UpdateTime,
+	})
+	if err := store.UpdateJob(job); err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to update job: %v", err)
+		return
+	}
+	h.transitioned(r.Context(), job, nil, job.UpdateTime)
+
+	op := &api.Operation{
+		Name: fmt.Sprintf("projects/%s/locations/%s/operations/operation-%d-%s",
+			project, location, job.UpdateTime.UnixMilli(), h.ids.NewID()),
+		Metadata: &api.OperationMetadata{
+			Type:       fmt.Sprintf(operationMetadataType, apiVersion(r)),
+			CreateTime: job.UpdateTime,
+			Target:     jobName,
+			Verb:       "cancel",
+			APIVersion: apiVersion(r),
+		},
+	}
+	if err := store.CreateOperation(op); err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to create operation: %v", err)
+		return
+	}
+
+	h.finishCancellation(op, h.timings.Merge(h.planDefaults(project).Timings).Duration(api.JobStateCancellationInProgress))
+
+	requestLog(w).Infof("Cancelling job: %s", jobName)
+	writeJSON(w, http.StatusOK, op)
+}
+
+// finishCancellation moves the job targeted by the cancel operation op to
+// CANCELLED after delay, failing its unfinished tasks, and marks op done. The
+// operation is aborted if the job was deleted in the meantime.
+func (h *Handler) finishCancellation(op *api.Operation, delay time.Duration) {
+	jobName := op.Metadata.Target
+	h.sim.Go(func(ctx context.Context) {
+		select {
+		case <-h.clock.After(delay):
+		case <-ctx.Done():
+			return
+		}
+
+		endTime := h.clock.Now()
+		metadata := *op.Metadata
+		metadata.EndTime = &endTime
+		done := &api.Operation{Name: op.Name, Metadata: &metadata, Done: true}
+
+		if err := h.cancelled(ctx, jobName, endTime); err != nil {
+			logrus.Errorf("Failed to cancel job %s: %v", jobName, err)
+			done.Error = &api.Status{Code: codeAborted, Message: err.Error()}
+		} else {
+			done.Response = map[string]string{"@type": cancelJobResponseType}
+		}
+
+		if err := h.store.UpdateOperation(done); err != nil {
+			logrus.Errorf("Failed to update operation %s: %v", op.Name, err)
+		}
+	})
+}
+
+// cancelled moves the job named jobName from CANCELLATION_IN_PROGRESS to
+// CANCELLED at the given time.
+func (h *Handler) cancelled(ctx context.Context, jobName string, at time.Time) error {
+	job, err := h.store.GetJob(jobName)
+	if err != nil {
+		return err
+	}
+	if job.State != api.JobStateCancellationInProgress {
+		return fmt.Errorf("job %s became %s before its cancellation finished", jobName, job.State)
+	}
+
+	tasks, err := h.store.ListTasks(jobName)
+	if err != nil {
+		return err
+	}
+	for _, task := range tasks {
+		switch task.Status.State {
+		case api.TaskStateSucceeded, api.TaskStateFailed, api.TaskStateAborted:
+			continue
+		}
+		task.Status.State = api.TaskStateFailed
+		task.Status.StatusEvents = append(task.Status.StatusEvents, &api.StatusEvent{
+			Type:        "task_cancelled",
+			Description: "Task cancelled with its job",
+			EventTime:   at,
+		})
+		if err := h.store.UpdateTask(jobName, task); err != nil {
+			return err
+		}
+		h.transitioned(ctx, job, task, at)
+	}
+
+	previous := job.Status.TaskGroups
+	job.Status.TaskGroups = make(map[string]*api.TaskGroupStatus)
+	for name, counts := range simulation.TaskCounts(job, tasks) {
+		status := &api.TaskGroupStatus{Counts: counts}
+		if previous[name] != nil {
+			status.Instances = previous[name].Instances
+		}
+		job.Status.TaskGroups[name] = status
+	}
+	job.State = api.JobStateCancelled
+	job.UpdateTime = at
+	job.Status.State = job.State
+	job.Status.StatusEvents = append(job.Status.StatusEvents, &api.StatusEvent{
+		Type:        "job_cancelled",
+		Description: "Job cancelled",
+		EventTime:   at,
+	})
+	if err := h.store.UpdateJob(job); err != nil {
+		return err
+	}
+	h.transitioned(ctx, job, nil, at)
+
+	logrus.Infof("Cancelled job: %s", jobName)
+	return nil
+}
+
+// CreateResourceAllowance stores a resource allowance named by the
+// resource_allowance_id query parameter, or a generated ID. Allowances are
+// kept in memory and reported ACTIVE, but their limits are not enforced.
+// Only the v1alpha API offers them.
+func (h *Handler) CreateResourceAllowance(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	var allowance api.ResourceAllowance
+	if err := h.decodeBody(r.Body, &allowance); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if err := validateResourceAllowance(&allowance); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid resource allowance: %v", err)
+		return
+	}
+
+	id := r.URL.Query().Get("resource_allowance_id")
+	if id == "" {
+		id = fmt.Sprintf("resource-allowance-%s", shortID(h.ids.NewID()))
+	}
+	allowance.Name = fmt.Sprintf("projects/%s/locations/%s/resourceAllowances/%s", vars["project"], vars["location"], id)
+	allowance.UID = h.ids.NewID()
+	allowance.CreateTime = h.clock.Now()
+	spec := allowance.UsageResourceAllowance.Spec
+	allowance.UsageResourceAllowance.Status = &api.UsageResourceAllowanceStatus{
+		State:       "RESOURCE_ALLOWANCE_ACTIVE",
+		LimitStatus: &api.LimitStatus{Limit: spec.Limit},
+	}
+
+	h.allowanceMu.Lock()
+	defer h.allowanceMu.Unlock()
+	if _, ok := h.allowances[allowance.Name]; ok {
+		writeError(w, http.StatusConflict, "Resource allowance %s already exists", allowance.Name)
+		return
+	}
+	h.allowances[allowance.Name] = &allowance
+
+	requestLog(w).Infof("Created resource allowance: %s", allowance.Name)
+	writeJSON(w, http.StatusOK, &allowance)
+}
+
+func validateResourceAllowance(allowance *api.ResourceAllowance) error {
+	if allowance.UsageResourceAllowance == nil || allowance.UsageResourceAllowance.Spec == nil {
+		return fmt.Errorf("usageResourceAllowance.spec is required")
+	}
+	spec := allowance.UsageResourceAllowance.Spec
+	if spec.Type == "" {
+		return fmt.Errorf("usageResourceAllowance.spec.type is required")
+	}
+	if spec.Limit == nil {
+		return fmt.Errorf("usageResourceAllowance.spec.limit is required")
+	}
+	if !calendarPeriods[spec.Limit.CalendarPeriod] {
+		return fmt.Errorf("invalid usageResourceAllowance.spec.limit.calendarPeriod %q, must be DAY, WEEK, MONTH, QUARTER or YEAR", spec.Limit.CalendarPeriod)
+	}
+	if spec.Limit.Limit < 0 {
+		return fmt.Errorf("negative usageResourceAllowance.spec.limit.limit %g", spec.Limit.Limit)
+	}
+	return nil
+}
+
+// GetResourceAllowance returns a resource allowance.
+func (h *Handler) GetResourceAllowance(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := fmt.Sprintf("projects/%s/locations/%s/resourceAllowances/%s", vars["project"], vars["location"], vars["allowance"])
+
+	h.allowanceMu.Lock()
+	allowance, ok := h.allowances[name]
+	h.allowanceMu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "Resource allowance %s not found", name)
+		return
+	}
+	writeJSON(w, http.StatusOK, allowance)
+}
+
+// ListResourceAllowances returns the resource allowances of a location,
+// sorted by name.
+func (h *Handler) ListResourceAllowances(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	prefix := fmt.Sprintf("projects/%s/locations/%s/resourceAllowances/", vars["project"], vars["location"])
+
+	response := &api.ListResourceAllowancesResponse{ResourceAllowances: []*api.ResourceAllowance{}}
+	h.allowanceMu.Lock()
+	for name, allowance := range h.allowances {
+		if strings.HasPrefix(name, prefix) {
+			response.ResourceAllowances = append(response.ResourceAllowances, allowance)
+		}
+	}
+	h.allowanceMu.Unlock()
+	sort.Slice(response.ResourceAllowances, func(i, j int) bool {
+		return response.ResourceAllowances[i].Name < response.ResourceAllowances[j].Name
+	})
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// DeleteResourceAllowance removes a resource allowance and returns a
+// long-running operation that is already done.
+func (h *Handler) DeleteResourceAllowance(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	project := vars["project"]
+	location := vars["location"]
+	name := fmt.Sprintf("projects/%s/locations/%s/resourceAllowances/%s", project, location, vars["allowance"])
+
+	h.allowanceMu.Lock()
+	_, ok := h.allowances[name]
+	delete(h.allowances, name)
+	h.allowanceMu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "Resource allowance %s not found", name)
+		return
+	}
+
+	now := h.clock.Now()
+	op := &api.Operation{
+		Name: fmt.Sprintf("projects/%s/locations/%s/operations/operation-%d-%s",
+			project, location, now.UnixMilli(), h.ids.NewID()),
+		Metadata: &api.OperationMetadata{
+			Type:       fmt.Sprintf(operationMetadataType, apiVersion(r)),
+			CreateTime: now,
+			EndTime:    &now,
+			Target:     name,
+			Verb:       "delete",
+			APIVersion: apiVersion(r),
+		},
+		Done:     true,
+		Response: map[string]string{"@type": emptyResponseType},
+	}
+	if err := h.storeFor(r).CreateOperation(op); err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to create operation: %v", err)
+		return
+	}
+
+	requestLog(w).Infof("Deleted resource allowance: %s", name)
+	writeJSON(w, http.StatusOK, op)
+}
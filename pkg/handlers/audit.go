@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/pyshx/fake-batch-server/pkg/audit"
+)
+
+// unauditedPrefixes are the paths of requests not recorded in the audit log:
+// the admin API, the dashboard, metrics scrapes and debug endpoints.
+var unauditedPrefixes = []string{"/admin", "/ui", "/metrics", "/debug"}
+
+// AuditMiddleware records every API call in the audit log once it has been
+// handled.
+func (h *Handler) AuditMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hasAnyPrefix(r.URL.Path, unauditedPrefixes) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		at := h.clock.Now()
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		h.audit.Record(&audit.Entry{
+			Time:           at,
+			Method:         r.Method,
+			Path:           r.URL.Path,
+			Route:          routeTemplate(r),
+			Project:        mux.Vars(r)["project"],
+			Status:         recorder.status,
+			LatencySeconds: time.Since(start).Seconds(),
+			RemoteAddr:     r.RemoteAddr,
+			UserAgent:      r.UserAgent(),
+		})
+	})
+}
+
+// ListAuditEntriesResponse is the response of ListAuditEntries.
+type ListAuditEntriesResponse struct {
+	Entries []*audit.Entry `json:"entries"`
+}
+
+// ListAuditEntries returns the recorded API calls, oldest first. The
+// optional project, method and since (RFC 3339) query parameters narrow the
+// list.
+func (h *Handler) ListAuditEntries(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := audit.Filter{Project: query.Get("project"), Method: query.Get("method")}
+	if since := query.Get("since"); since != "" {
+		t, err := time.Parse(time.RFC3339Nano, since)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid since %q, must be an RFC 3339 time", since)
+			return
+		}
+		filter.Since = t
+	}
+	writeJSON(w, http.StatusOK, &ListAuditEntriesResponse{Entries: h.audit.Entries(filter)})
+}
@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+
+	"github.com/pyshx/fake-batch-server/pkg/auth"
+)
+
+// apiPrefixes are the paths of the emulated Google APIs, which require a
+// token once authentication is enabled and are subject to injected faults.
+// The admin API, dashboard, metrics and health check are left alone.
+var apiPrefixes = []string{"/v1/", "/v1alpha/", "/v2/", "/hooks/"}
+
+// isAPIRequest reports whether path is one of the emulated Google APIs.
+func isAPIRequest(path string) bool {
+	return path != "/v1/health" && hasAnyPrefix(path, apiPrefixes)
+}
+
+// AuthMiddleware requires a known bearer token on API requests when the
+// handler has tokens configured, failing with 401 UNAUTHENTICATED otherwise.
+// Requests for a project the token does not allow fail with 403
+// PERMISSION_DENIED.
+func (h *Handler) AuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.auth == nil || !isAPIRequest(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token, err := h.auth.Authenticate(r.Header.Get("Authorization"))
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="fake-batch-server"`)
+			writeError(w, http.StatusUnauthorized, "Request had invalid authentication credentials: %v", err)
+			return
+		}
+		if project := mux.Vars(r)["project"]; project != "" && !token.Allows(project) {
+			writeError(w, http.StatusForbidden, "Permission denied on resource project %s for %s", project, token.Name)
+			return
+		}
+
+		logrus.Debugf("Authenticated %s %s as %s", r.Method, r.URL.Path, token.Name)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tokenKey{}, token)))
+	})
+}
+
+type tokenKey struct{}
+
+// tokenFromContext returns the token the request of ctx was authenticated
+// with, or nil if authentication is disabled. Handlers of requests that do not
+// name their project check it against the project of what they return.
+func tokenFromContext(ctx context.Context) *auth.Token {
+	token, _ := ctx.Value(tokenKey{}).(*auth.Token)
+	return token
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
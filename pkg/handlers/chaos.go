@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+	"github.com/pyshx/fake-batch-server/pkg/faults"
+)
+
+// Chaos holds the faults injected into API requests, for hardening clients
+// against a slow or flaky network.
+type Chaos struct {
+	// Latency delays every API response.
+	Latency time.Duration
+	// Jitter adds up to this much random delay on top of Latency.
+	Jitter time.Duration
+	// ErrorRate is the probability, between 0 and 1, that an API request
+	// fails with a 500 INTERNAL or 503 UNAVAILABLE error instead of being
+	// handled.
+	ErrorRate float64
+}
+
+// ChaosMiddleware delays API requests and fails some of them at random, as
+// configured by Config.Chaos, and fails those matching a rule of
+// Config.Faults with its error. The admin API, dashboard, metrics and health
+// check are left alone. A request whose context ends while it is delayed is
+// not handled.
+func (h *Handler) ChaosMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if (h.chaos == (Chaos{}) && h.faults == nil) || !isAPIRequest(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		delay := h.chaos.Latency
+		if h.chaos.Jitter > 0 {
+			delay += time.Duration(rand.Int63n(int64(h.chaos.Jitter) + 1))
+		}
+		if delay > 0 {
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-r.Context().Done():
+				timer.Stop()
+				writeContextError(w, r.Context().Err())
+				return
+			}
+		}
+
+		if rule := h.faults.Match(r); rule != nil {
+			writeFault(w, rule)
+			return
+		}
+		if h.chaos.ErrorRate > 0 && rand.Float64() < h.chaos.ErrorRate {
+			if rand.Intn(2) == 0 {
+				writeError(w, http.StatusInternalServerError, "Internal error encountered.")
+			} else {
+				writeError(w, http.StatusServiceUnavailable, "The service is currently unavailable.")
+			}
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeFault answers with the error of a fault matrix rule, filling in the
+// status and message it leaves unset.
+func writeFault(w http.ResponseWriter, rule *faults.Rule) {
+	status := &api.Status{
+		Code:    rule.Error.Code,
+		Message: rule.Error.Message,
+		Status:  rule.Error.Status,
+		Details: withRequestInfo(w, rule.Error.Details),
+	}
+	if status.Status == "" {
+		status.Status = canonicalStatus(status.Code)
+	}
+	if status.Message == "" {
+		status.Message = http.StatusText(status.Code)
+	}
+	requestLog(w).Infof("Fault %s: %s", rule.Name, status.Message)
+	writeJSON(w, status.Code, &api.ErrorResponse{Error: status})
+}
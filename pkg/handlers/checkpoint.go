@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+	"github.com/pyshx/fake-batch-server/pkg/simulation"
+	"github.com/pyshx/fake-batch-server/pkg/storage"
+)
+
+// Checkpoint is the state saved on shutdown so that a restarted server can
+// pick up where the previous one stopped.
+type Checkpoint struct {
+	// SchemaVersion is the layout version of the checkpoint. Older
+	// checkpoints are migrated when they are restored.
+	SchemaVersion int       `json:"schemaVersion"`
+	SavedAt       time.Time `json:"savedAt"`
+	// Store holds every job, task and operation.
+	Store *storage.Snapshot `json:"store"`
+	// Plans holds the plans of the jobs that were still being simulated,
+	// keyed by job name.
+	Plans map[string]*simulation.Plan `json:"plans,omitempty"`
+}
+
+// Checkpoint stops every simulation and writes the store, along with the
+// plans of the jobs that were being simulated, to path. The handler simulates
+// nothing afterwards; it is meant to be called on shutdown.
+func (h *Handler) Checkpoint(path string) error {
+	plans := h.sim.Plans()
+	h.sim.Shutdown()
+
+	data, err := json.MarshalIndent(&Checkpoint{
+		SchemaVersion: checkpointSchemaVersion(),
+		SavedAt:       h.clock.Now(),
+		Store:         h.store.Snapshot(),
+		Plans:         plans,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// Restore loads a checkpoint written by Checkpoint into the store and resumes
+// the jobs it left in flight: QUEUED, SCHEDULED and RUNNING jobs continue
+// their simulation from that state, with the time they spent in it before
+// the restart counted, and DELETING jobs are deleted. Checkpoints
+// of older servers are migrated first. A missing file is not an error. It
+// returns the number of jobs resumed.
+func (h *Handler) Restore(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if data, err = migrateCheckpoint(path, data); err != nil {
+		return 0, err
+	}
+
+	var checkpoint Checkpoint
+	if err := json.Unmarshal(data, &checkpoint); err != nil {
+		return 0, fmt.Errorf("failed to parse checkpoint %s: %v", path, err)
+	}
+	if checkpoint.Store == nil {
+		return 0, fmt.Errorf("checkpoint %s has no store", path)
+	}
+	if err := h.store.Restore(checkpoint.Store); err != nil {
+		return 0, fmt.Errorf("failed to restore checkpoint %s: %v", path, err)
+	}
+
+	deletions := make(map[string]*api.Operation)
+	cancellations := make(map[string]*api.Operation)
+	for _, op := range checkpoint.Store.Operations {
+		if op.Done || op.Metadata == nil {
+			continue
+		}
+		switch op.Metadata.Verb {
+		case "delete":
+			deletions[op.Metadata.Target] = op
+		case "cancel":
+			cancellations[op.Metadata.Target] = op
+		}
+	}
+
+	resumed := 0
+	for _, job := range checkpoint.Store.Jobs {
+		project, _, _ := strings.Cut(strings.TrimPrefix(job.Name, "projects/"), "/")
+		switch job.State {
+		case api.JobStateQueued, api.JobStateScheduled, api.JobStateRunning:
+			plan := checkpoint.Plans[job.Name]
+			if plan == nil {
+				if plan, err = h.newPlan(job, project, ""); err != nil {
+					logrus.Warnf("Not resuming job %s: %v", job.Name, err)
+					continue
+				}
+			}
+			h.sim.Recover(job, plan)
+		case api.JobStateDeleting:
+			op := deletions[job.Name]
+			if op == nil {
+				logrus.Warnf("Not resuming deletion of job %s: no pending delete operation", job.Name)
+				continue
+			}
+			h.finishDeletion(op, h.timings.Merge(h.planDefaults(project).Timings).Duration(api.JobStateDeleting))
+		case api.JobStateCancellationInProgress:
+			op := cancellations[job.Name]
+			if op == nil {
+				logrus.Warnf("Not resuming cancellation of job %s: no pending cancel operation", job.Name)
+				continue
+			}
+			h.finishCancellation(op, h.timings.Merge(h.planDefaults(project).Timings).Duration(api.JobStateCancellationInProgress))
+		default:
+			continue
+		}
+		logrus.Infof("Resuming job %s from %s", job.Name, job.State)
+		resumed++
+	}
+	return resumed, nil
+}
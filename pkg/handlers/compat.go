@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+	"github.com/pyshx/fake-batch-server/pkg/lint"
+)
+
+// freeformFields are the job fields holding user-chosen keys, which are left
+// as sent.
+var freeformFields = map[string]bool{
+	"labels":          true,
+	"environments":    true,
+	"variables":       true,
+	"secretVariables": true,
+}
+
+// decodeJob decodes a job request body. Older generated clients spell fields
+// in snake_case, e.g. "task_groups" or "max_run_duration"; those are accepted
+// as their canonical lowerCamelCase names and reported as deprecation
+// warnings. If strict is set, bodies with fields Job has no room for are
+// rejected.
+func decodeJob(body io.Reader, strict bool) (*api.Job, []*lint.Warning, error) {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := checkDepth(data); err != nil {
+		return nil, nil, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var raw interface{}
+	if err := decoder.Decode(&raw); err != nil {
+		return nil, nil, err
+	}
+
+	var warnings []*lint.Warning
+	if migrateFields(raw, "", &warnings) {
+		if data, err = json.Marshal(raw); err != nil {
+			return nil, nil, err
+		}
+	}
+	if strict {
+		if err := checkUnknownFields(raw, reflect.TypeOf(api.Job{})); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var job api.Job
+	if err := json.Unmarshal(data, &job); err != nil {
+		return nil, nil, err
+	}
+	return &job, warnings, nil
+}
+
+// migrateFields renames the snake_case keys of the objects in value, found at
+// path, to lowerCamelCase, adding a warning for each. It reports whether
+// anything changed.
+func migrateFields(value interface{}, path string, warnings *[]*lint.Warning) bool {
+	changed := false
+	switch value := value.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			name := key
+			if canonical := lowerCamelCase(key); canonical != key {
+				name = canonical
+				field := joinField(path, key)
+				if _, ok := value[canonical]; ok {
+					*warnings = append(*warnings, &lint.Warning{Kind: lint.KindDeprecatedField, Field: field,
+						Message: fmt.Sprintf("%s is a legacy spelling of %s and is ignored since both are set", key, canonical)})
+				} else {
+					*warnings = append(*warnings, &lint.Warning{Kind: lint.KindDeprecatedField, Field: field,
+						Message: fmt.Sprintf("%s is a legacy spelling; use %s", key, canonical)})
+					value[canonical] = value[key]
+				}
+				delete(value, key)
+				changed = true
+			}
+			if !freeformFields[name] && migrateFields(value[name], joinField(path, name), warnings) {
+				changed = true
+			}
+		}
+	case []interface{}:
+		for i, item := range value {
+			if migrateFields(item, path+"["+strconv.Itoa(i)+"]", warnings) {
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+// lowerCamelCase returns the lowerCamelCase spelling of a snake_case name.
+func lowerCamelCase(name string) string {
+	parts := strings.Split(name, "_")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] != "" {
+			parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
+
+func joinField(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// writeWarnings reports warnings in Warning headers of the response and logs
+// them.
+func writeWarnings(w http.ResponseWriter, warnings []*lint.Warning) {
+	for _, warning := range warnings {
+		requestLog(w).Warnf("%s: %s", warning.Field, warning.Message)
+		w.Header().Add("Warning", fmt.Sprintf("299 - %q", warning.Field+": "+warning.Message))
+	}
+}
@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// statusClientClosedRequest is the non-standard status reported for requests
+// the client gave up on, as CANCELLED.
+const statusClientClosedRequest = 499
+
+// serverTimeoutHeader carries the deadline of a request in seconds, as sent
+// by Google API clients.
+const serverTimeoutHeader = "X-Server-Timeout"
+
+// DeadlineMiddleware bounds the context of each request by its
+// X-Server-Timeout header, if any. The context is also cancelled when the
+// client disconnects. Once it is done, store operations made for the request
+// fail and whatever response the handler writes is replaced by a 504
+// DEADLINE_EXCEEDED or 499 CANCELLED error. Responses that already started,
+// such as streams, are left alone.
+func (h *Handler) DeadlineMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if value := r.Header.Get(serverTimeoutHeader); value != "" {
+			seconds, err := strconv.ParseFloat(value, 64)
+			if err != nil || seconds <= 0 {
+				writeError(w, http.StatusBadRequest, "Invalid %s header %q, must be a positive number of seconds", serverTimeoutHeader, value)
+				return
+			}
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, time.Duration(seconds*float64(time.Second)))
+			defer cancel()
+		}
+
+		next.ServeHTTP(&deadlineWriter{ResponseWriter: w, ctx: ctx}, r.WithContext(ctx))
+	})
+}
+
+// deadlineWriter replaces the response of a request whose context is done by
+// the time the response starts.
+type deadlineWriter struct {
+	http.ResponseWriter
+	ctx         context.Context
+	wroteHeader bool
+	discard     bool
+}
+
+func (w *deadlineWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	if err := w.ctx.Err(); err != nil {
+		w.discard = true
+		writeContextError(w.ResponseWriter, err)
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *deadlineWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.discard {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *deadlineWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok && !w.discard {
+		flusher.Flush()
+	}
+}
+
+// Unwrap lets an http.ResponseController reach the connection's writer.
+func (w *deadlineWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// clearWriteDeadline lifts the server's WriteTimeout from a streamed
+// response, which stays open for as long as the client keeps reading.
+func clearWriteDeadline(w http.ResponseWriter) {
+	err := http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	if err != nil && !errors.Is(err, http.ErrNotSupported) {
+		logrus.Warnf("Failed to clear the write deadline of a stream: %v", err)
+	}
+}
+
+// writeContextError writes the error for a request whose context ended with
+// err.
+func writeContextError(w http.ResponseWriter, err error) {
+	if errors.Is(err, context.DeadlineExceeded) {
+		writeError(w, http.StatusGatewayTimeout, "Request deadline exceeded")
+		return
+	}
+	writeError(w, statusClientClosedRequest, "Request cancelled by the client")
+}
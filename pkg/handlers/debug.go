@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"net/http"
+	"runtime"
+
+	"github.com/pyshx/fake-batch-server/pkg/simulation"
+)
+
+// DebugVars is the response of the DebugVars endpoint.
+type DebugVars struct {
+	Goroutines int              `json:"goroutines"`
+	Memory     MemoryVars       `json:"memory"`
+	Store      StoreVars        `json:"store"`
+	Simulator  simulation.Stats `json:"simulator"`
+}
+
+// MemoryVars are the heap counters of the Go runtime.
+type MemoryVars struct {
+	AllocBytes     uint64 `json:"allocBytes"`
+	HeapInuseBytes uint64 `json:"heapInuseBytes"`
+	SysBytes       uint64 `json:"sysBytes"`
+	NumGC          uint32 `json:"numGC"`
+}
+
+// StoreVars count what the store holds. Tasks only counts the stored tasks
+// of lazy task groups.
+type StoreVars struct {
+	Jobs       int `json:"jobs"`
+	Tasks      int `json:"tasks"`
+	Operations int `json:"operations"`
+}
+
+// DebugVars reports runtime counters for tracking down leaks: goroutines,
+// heap usage, the size of the store and the simulations in flight. A
+// goroutine count that keeps growing while Simulator.Runners and
+// Simulator.Background do not points at goroutines nothing tracks.
+func (h *Handler) DebugVars(w http.ResponseWriter, r *http.Request) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	snapshot := h.store.Snapshot()
+	vars := &DebugVars{
+		Goroutines: runtime.NumGoroutine(),
+		Memory: MemoryVars{
+			AllocBytes:     mem.Alloc,
+			HeapInuseBytes: mem.HeapInuse,
+			SysBytes:       mem.Sys,
+			NumGC:          mem.NumGC,
+		},
+		Store:     StoreVars{Jobs: len(snapshot.Jobs), Operations: len(snapshot.Operations)},
+		Simulator: h.sim.Stats(),
+	}
+	for _, tasks := range snapshot.Tasks {
+		vars.Store.Tasks += len(tasks)
+	}
+
+	writeJSON(w, http.StatusOK, vars)
+}
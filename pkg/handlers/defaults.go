@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"fmt"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+	"github.com/pyshx/fake-batch-server/pkg/simulation"
+)
+
+// ServerDefaults are the values the server fills into fields a submitted job
+// leaves unset, so the job echoed back matches what production returns. Empty
+// values are not applied.
+type ServerDefaults struct {
+	// CPUMilli is the default computeResource.cpuMilli of a task.
+	CPUMilli int64
+	// MemoryMib is the default computeResource.memoryMib of a task.
+	MemoryMib int64
+	// MaxRunDuration is the default taskSpec.maxRunDuration.
+	MaxRunDuration string
+	// LogsDestination is the default logsPolicy.destination.
+	LogsDestination string
+	// ProvisioningModel is the default provisioning model of each instance
+	// policy.
+	ProvisioningModel string
+	// Normalize fills in task group names, counts and scheduling policy,
+	// restricts the allocation policy to the job's region when it has none and
+	// rewrites durations the way production formats them, e.g. "60.5s" as
+	// "60.500s".
+	Normalize bool
+}
+
+// DefaultServerDefaults returns the defaults documented for the Batch API.
+func DefaultServerDefaults() ServerDefaults {
+	return ServerDefaults{
+		CPUMilli:          2000,
+		MemoryMib:         2000,
+		MaxRunDuration:    "604800s",
+		LogsDestination:   "CLOUD_LOGGING",
+		ProvisioningModel: "STANDARD",
+		Normalize:         true,
+	}
+}
+
+// apply populates the unset fields of job, which is being created in
+// location.
+func (d ServerDefaults) apply(job *api.Job, location string) {
+	for i, taskGroup := range job.TaskGroups {
+		if d.Normalize {
+			if taskGroup.Name == "" {
+				taskGroup.Name = fmt.Sprintf("group%d", i)
+			}
+			if taskGroup.TaskCount == 0 {
+				taskGroup.TaskCount = 1
+			}
+			if taskGroup.Parallelism == 0 {
+				taskGroup.Parallelism = taskGroup.TaskCount
+			}
+			if taskGroup.TaskCountPerNode == 0 {
+				taskGroup.TaskCountPerNode = 1
+			}
+			if taskGroup.SchedulingPolicy == "" {
+				taskGroup.SchedulingPolicy = api.SchedulingPolicyAsSoonAsPossible
+			}
+		}
+
+		if taskGroup.TaskSpec == nil {
+			continue
+		}
+		if d.CPUMilli != 0 || d.MemoryMib != 0 {
+			if taskGroup.TaskSpec.ComputeResource == nil {
+				taskGroup.TaskSpec.ComputeResource = &api.ComputeResource{}
+			}
+			if taskGroup.TaskSpec.ComputeResource.CPUMilli == 0 {
+				taskGroup.TaskSpec.ComputeResource.CPUMilli = d.CPUMilli
+			}
+			if taskGroup.TaskSpec.ComputeResource.MemoryMib == 0 {
+				taskGroup.TaskSpec.ComputeResource.MemoryMib = d.MemoryMib
+			}
+		}
+		if taskGroup.TaskSpec.MaxRunDuration == "" {
+			taskGroup.TaskSpec.MaxRunDuration = d.MaxRunDuration
+		}
+		if d.Normalize {
+			taskGroup.TaskSpec.MaxRunDuration = canonicalDuration(taskGroup.TaskSpec.MaxRunDuration)
+			for _, runnable := range taskGroup.TaskSpec.Runnables {
+				runnable.Timeout = canonicalDuration(runnable.Timeout)
+			}
+		}
+	}
+
+	if d.LogsDestination != "" {
+		if job.LogsPolicy == nil {
+			job.LogsPolicy = &api.LogsPolicy{}
+		}
+		if job.LogsPolicy.Destination == "" {
+			job.LogsPolicy.Destination = d.LogsDestination
+		}
+	}
+
+	if d.Normalize {
+		if job.AllocationPolicy == nil {
+			job.AllocationPolicy = &api.AllocationPolicy{}
+		}
+		if job.AllocationPolicy.Location == nil || len(job.AllocationPolicy.Location.AllowedLocations) == 0 {
+			job.AllocationPolicy.Location = &api.LocationPolicy{
+				AllowedLocations: []string{"regions/" + location},
+			}
+		}
+	}
+	if job.AllocationPolicy != nil && d.ProvisioningModel != "" {
+		for _, instance := range job.AllocationPolicy.Instances {
+			if instance.Policy != nil && instance.Policy.ProvisioningModel == "" {
+				instance.Policy.ProvisioningModel = d.ProvisioningModel
+			}
+		}
+	}
+}
+
+// canonicalDuration formats the duration value with api.FormatDuration,
+// leaving empty and invalid values alone.
+func canonicalDuration(value string) string {
+	if value == "" {
+		return value
+	}
+	d, err := simulation.ParseDuration(value)
+	if err != nil {
+		return value
+	}
+	return api.FormatDuration(d)
+}
@@ -0,0 +1,40 @@
+package handlers
+
+import (
+	"context"
+	"time"
+
+	"github.com/pyshx/fake-batch-server/pkg/clock"
+)
+
+// drainPollInterval is how often Drain checks whether simulations are left.
+const drainPollInterval = 10 * time.Millisecond
+
+// Drain waits for the jobs being simulated to finish, until ctx is done, and
+// returns the number still running. It is meant for shutdown, after the
+// server stops taking requests: the simulations Drain leaves are stopped
+// between two transitions by Close, or saved by Checkpoint and resumed by
+// Restore. A fake clock, which nothing advances anymore, is fast-forwarded
+// from one pending deadline to the next.
+func (h *Handler) Drain(ctx context.Context) int {
+	fake, _ := h.clock.(*clock.Fake)
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for {
+		running := h.sim.Stats().Runners
+		if running == 0 {
+			return 0
+		}
+		select {
+		case <-ctx.Done():
+			return running
+		case <-ticker.C:
+		}
+		if fake == nil {
+			continue
+		}
+		if next, ok := fake.Next(); ok {
+			fake.Advance(next.Sub(fake.Now()))
+		}
+	}
+}
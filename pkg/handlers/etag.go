@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// writeJSONWithETag writes v like writeJSON, with an ETag header derived from
+// its encoding. A request whose If-None-Match header lists that ETag gets a
+// bodiless 304 Not Modified instead, so clients polling a resource only pay
+// for it when it changes.
+func writeJSONWithETag(w http.ResponseWriter, r *http.Request, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to encode response: %v", err)
+		return
+	}
+	data = append(data, '\n')
+
+	sum := sha256.Sum256(data)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	w.Header().Set("ETag", etag)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(data); err != nil {
+		requestLog(w).Errorf("Failed to write response: %v", err)
+	}
+}
+
+// etagMatches reports whether the If-None-Match header value lists etag,
+// comparing weakly as RFC 9110 requires for If-None-Match.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -2,51 +2,672 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
 
 	"github.com/pyshx/fake-batch-server/pkg/api"
+	"github.com/pyshx/fake-batch-server/pkg/audit"
+	"github.com/pyshx/fake-batch-server/pkg/auth"
+	"github.com/pyshx/fake-batch-server/pkg/blobstore"
+	"github.com/pyshx/fake-batch-server/pkg/catalog"
+	"github.com/pyshx/fake-batch-server/pkg/clock"
+	"github.com/pyshx/fake-batch-server/pkg/faults"
+	"github.com/pyshx/fake-batch-server/pkg/lint"
+	"github.com/pyshx/fake-batch-server/pkg/logging"
+	"github.com/pyshx/fake-batch-server/pkg/logs"
+	"github.com/pyshx/fake-batch-server/pkg/pubsub"
+	"github.com/pyshx/fake-batch-server/pkg/simulation"
 	"github.com/pyshx/fake-batch-server/pkg/storage"
+	"github.com/pyshx/fake-batch-server/pkg/tracing"
+	"github.com/pyshx/fake-batch-server/pkg/webhook"
+)
+
+const (
+	// operationMetadataType is formatted with the API version.
+	operationMetadataType = "type.googleapis.com/google.cloud.batch.%s.OperationMetadata"
+	emptyResponseType     = "type.googleapis.com/google.protobuf.Empty"
+
+	// codeInternal is the google.rpc.Code for INTERNAL errors.
+	codeInternal = 13
+
+	// maxGeneratedIDAttempts is how many generated job IDs CreateJob tries
+	// before giving up on finding a free one.
+	maxGeneratedIDAttempts = 5
 )
 
 // Handler manages HTTP handlers for the Batch API.
 type Handler struct {
-	store *storage.MemoryStore
+	store     storage.Store
+	timings   simulation.Timings
+	clock     clock.Clock
+	sim       Simulator
+	ids       IDGenerator
+	logs      *logs.Store
+	logsRoot  string
+	gcs       logs.ObjectWriter
+	objects   *blobstore.Store
+	logging   *logging.Store
+	images    ImageChecker
+	topics    *pubsub.Topics
+	notifier  *pubsub.Notifier
+	webhooks  *webhook.Registry
+	metrics   *serverMetrics
+	tracer    *tracing.Tracer
+	audit     *audit.Log
+	auth      *auth.Tokens
+	projects  *Projects
+	quotas    *Quotas
+	chaos     Chaos
+	faults    *faults.Matrix
+	defaults  simulation.Plan
+	profiles  *simulation.Profiles
+	scenarios *simulation.Scenarios
+	// maxTaskCount is the most tasks a task group may have.
+	maxTaskCount int64
+	retention    Retention
+	// closing is closed by Close to stop the retention reaper.
+	closing   chan struct{}
+	closeOnce sync.Once
+
+	serverDefaults ServerDefaults
+	pages          *cursors
+
+	// catalog, if set, is checked against the machine types of created
+	// jobs, rejecting those it finds fault with if strictCatalog is set.
+	catalog       *catalog.Catalog
+	strictCatalog bool
+
+	// strictJSON rejects request bodies with unknown fields.
+	strictJSON bool
+	// maxBodyBytes is the largest API request body accepted, if positive.
+	maxBodyBytes int64
+
+	// quotaMu serializes quota checks with the job creations they allow.
+	quotaMu sync.Mutex
+	// recentCreates holds the creation times of each project's jobs in the
+	// last minute.
+	recentCreates map[string][]time.Time
+
+	// requestMu serializes the creation of jobs requested with a requestId
+	// with the lookup of earlier requests.
+	requestMu sync.Mutex
+	// createRequests holds the CreateJob requests made with a requestId in
+	// the last requestIDTTL, keyed by parent and requestId.
+	createRequests map[string]*createRequest
+
+	allowanceMu sync.Mutex
+	// allowances holds the v1alpha resource allowances by name.
+	allowances map[string]*api.ResourceAllowance
+}
+
+// Config holds optional Handler settings.
+type Config struct {
+	// Timings controls the simulated job lifecycle. Unset states fall back to
+	// simulation.DefaultTimings.
+	Timings simulation.Timings
+	// Clock is the time source for the simulation. Defaults to the wall clock.
+	Clock clock.Clock
+	// TaskFailureRate is the default probability, between 0 and 1, that a
+	// single task attempt fails.
+	TaskFailureRate float64
+	// SpotPreemptionRate is the default probability, between 0 and 1, that
+	// a single task attempt of a job on Spot VMs is preempted.
+	SpotPreemptionRate float64
+	// Profiles, if set, selects the timings and failure rate of the jobs of
+	// each project instead of Timings and TaskFailureRate.
+	Profiles *simulation.Profiles
+	// Scenarios, if set, script the lifecycle of the jobs they match
+	// instead of simulating it.
+	Scenarios *simulation.Scenarios
+	// ServerDefaults are filled into unset fields of submitted jobs. Defaults
+	// to DefaultServerDefaults.
+	ServerDefaults *ServerDefaults
+	// MaxTaskCount is the most tasks a task group may have. Defaults to
+	// DefaultMaxTaskCount, the production limit.
+	MaxTaskCount int64
+	// MaxRequestBytes is the largest API request body accepted; larger ones
+	// fail with 413. Defaults to DefaultMaxRequestBytes. Negative values
+	// remove the limit.
+	MaxRequestBytes int64
+	// Executor runs container runnables for real. Defaults to simulating
+	// them. It is ignored when Simulator is set.
+	Executor simulation.Executor
+	// Scheduler, if set, limits how many jobs the default engine runs at
+	// once. It is ignored when Simulator is set.
+	Scheduler *simulation.Scheduler
+	// Simulator drives submitted jobs. Defaults to a simulation.Engine.
+	Simulator Simulator
+	// IDGenerator generates job and operation IDs. Defaults to random UUIDs.
+	IDGenerator IDGenerator
+	// LogsRoot, if set, is the directory the logsPath of jobs logging to
+	// PATH is resolved under instead of the filesystem root.
+	LogsRoot string
+	// VolumesRoot, if set, is the directory the VM paths executed containers
+	// mount are resolved under instead of the filesystem root.
+	VolumesRoot string
+	// GCSEndpoint, if set, is the address of the Cloud Storage emulator a
+	// gs:// logsPath is written to, e.g. http://localhost:4443.
+	GCSEndpoint string
+	// GCSVolumes makes task attempts with GCS volumes fail when a bucket is
+	// missing from GCSEndpoint, and executed containers get the volumes
+	// synced from and back to it.
+	GCSVolumes bool
+	// ObjectStore, if set, is the built-in object store a gs:// logsPath is
+	// written to when no GCSEndpoint is given. It is emptied on reset.
+	ObjectStore *blobstore.Store
+	// ObjectStoreURL, if set, is the address executed containers reach
+	// ObjectStore at, passed to them as OBJECT_STORE_URL.
+	ObjectStoreURL string
+	// ImageChecker, if set, is asked whether the container images of a job
+	// exist before the job is created.
+	ImageChecker ImageChecker
+	// Catalog, if set, is the machine and accelerator types jobs are
+	// checked against when created. Unknown types and types their region
+	// does not offer are reported as warnings, or rejected with
+	// StrictCatalog. It also sizes the machine types computeResources are
+	// checked against, the built-in catalog doing so by default.
+	Catalog       *catalog.Catalog
+	StrictCatalog bool
+	// StrictJSON rejects request bodies with fields the API does not have,
+	// e.g. a misspelled "taskcount", instead of ignoring them.
+	StrictJSON bool
+	// Pprof serves the net/http/pprof profiles under /debug/pprof/ and the
+	// counters of DebugVars under /debug/vars.
+	Pprof bool
+	// PubSubEmulatorHost, if set, is the address of the Pub/Sub emulator job
+	// notifications are published to. By default they are kept in memory
+	// and read through the admin API.
+	PubSubEmulatorHost string
+	// Webhooks are called on every job and task state change. More can be
+	// registered through the admin API.
+	Webhooks []*webhook.Hook
+	// Tracer, if set, records spans for requests, store operations and
+	// simulated jobs.
+	Tracer *tracing.Tracer
+	// AuditSinks receive every API call recorded by AuditMiddleware, in
+	// addition to the in-memory audit log. They are closed by Close.
+	AuditSinks []audit.Sink
+	// Auth, if set, makes API requests require one of its bearer tokens and
+	// limits each token to its projects.
+	Auth *auth.Tokens
+	// Projects, if set, turns on tenant mode: API requests may only name
+	// the projects it registers. More can be registered through the admin
+	// API.
+	Projects *Projects
+	// Quotas, if set, limit the jobs each project creates per minute and
+	// the CPU they use at once. Their running job limits are applied to
+	// Scheduler by the caller.
+	Quotas *Quotas
+	// Chaos delays API requests and fails some of them at random.
+	Chaos Chaos
+	// Faults, if set, fails the API requests matching its rules with their
+	// configured errors.
+	Faults *faults.Matrix
+	// Retention, if enabled, removes finished jobs in the background once
+	// they are too old or too many.
+	Retention Retention
+}
+
+// NewHandler creates a new Handler with the given storage and options.
+func NewHandler(store storage.Store, opts ...Option) *Handler {
+	var cfg Config
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return NewHandlerWithConfig(store, cfg)
+}
+
+// NewHandlerWithConfig creates a new Handler with the given storage and config.
+func NewHandlerWithConfig(store storage.Store, cfg Config) *Handler {
+	if cfg.Clock == nil {
+		cfg.Clock = clock.Real()
+	}
+
+	if cfg.IDGenerator == nil {
+		cfg.IDGenerator = uuidGenerator{}
+	}
+
+	if cfg.ServerDefaults == nil {
+		defaults := DefaultServerDefaults()
+		cfg.ServerDefaults = &defaults
+	}
+
+	if cfg.MaxTaskCount == 0 {
+		cfg.MaxTaskCount = DefaultMaxTaskCount
+	}
+	if cfg.MaxRequestBytes == 0 {
+		cfg.MaxRequestBytes = DefaultMaxRequestBytes
+	}
+
+	timings := simulation.DefaultTimings().Merge(cfg.Timings)
+
+	topics := pubsub.NewTopics()
+	var publisher pubsub.Publisher = topics
+	if cfg.PubSubEmulatorHost != "" {
+		publisher = pubsub.NewEmulator(cfg.PubSubEmulatorHost, webhook.DefaultTimeout)
+	}
+
+	webhooks := webhook.NewRegistry(webhook.DefaultTimeout)
+	for _, hook := range cfg.Webhooks {
+		if err := webhooks.Add(hook); err != nil {
+			logrus.Errorf("Ignoring webhook: %v", err)
+		}
+	}
+
+	var gcs logs.ObjectWriter
+	var buckets simulation.Buckets
+	if cfg.GCSEndpoint != "" {
+		client := logs.NewGCS(cfg.GCSEndpoint, webhook.DefaultTimeout)
+		gcs = client
+		if cfg.GCSVolumes {
+			buckets = client
+		}
+	} else if cfg.ObjectStore != nil {
+		gcs = cfg.ObjectStore
+	}
+
+	h := &Handler{
+		store:          store,
+		timings:        timings,
+		clock:          cfg.Clock,
+		sim:            cfg.Simulator,
+		ids:            cfg.IDGenerator,
+		logs:           logs.NewStore(),
+		logsRoot:       cfg.LogsRoot,
+		gcs:            gcs,
+		objects:        cfg.ObjectStore,
+		logging:        logging.NewStore(),
+		images:         cfg.ImageChecker,
+		catalog:        cfg.Catalog,
+		strictCatalog:  cfg.StrictCatalog,
+		strictJSON:     cfg.StrictJSON,
+		maxBodyBytes:   cfg.MaxRequestBytes,
+		topics:         topics,
+		notifier:       pubsub.NewNotifier(publisher),
+		webhooks:       webhooks,
+		defaults:       simulation.Plan{TaskFailureRate: cfg.TaskFailureRate, SpotPreemptionRate: cfg.SpotPreemptionRate},
+		profiles:       cfg.Profiles,
+		scenarios:      cfg.Scenarios,
+		maxTaskCount:   cfg.MaxTaskCount,
+		retention:      cfg.Retention,
+		closing:        make(chan struct{}),
+		serverDefaults: *cfg.ServerDefaults,
+		pages:          newCursors(),
+		tracer:         cfg.Tracer,
+		audit:          audit.NewLog(0, cfg.AuditSinks...),
+		auth:           cfg.Auth,
+		projects:       cfg.Projects,
+		quotas:         cfg.Quotas,
+		chaos:          cfg.Chaos,
+		faults:         cfg.Faults,
+		recentCreates:  make(map[string][]time.Time),
+		createRequests: make(map[string]*createRequest),
+		allowances:     make(map[string]*api.ResourceAllowance),
+	}
+	h.metrics = newServerMetrics(h)
+
+	if h.sim == nil {
+		engine := simulation.NewEngine(store, cfg.Clock, timings)
+		engine.SetLogs(h.logs)
+		if cfg.Executor != nil {
+			engine.SetExecutor(cfg.Executor)
+		}
+		if cfg.Scheduler != nil {
+			engine.SetScheduler(cfg.Scheduler)
+		}
+		if buckets != nil {
+			engine.SetBuckets(buckets)
+		}
+		engine.SetVolumesRoot(cfg.VolumesRoot)
+		engine.SetObjectStoreURL(cfg.ObjectStoreURL)
+		engine.SetTracer(cfg.Tracer)
+		callbacks := webhook.NewNotifier(webhook.DefaultTimeout)
+		engine.OnComplete(func(ctx context.Context, job *api.Job) {
+			callbacks.Notify(ctx, job)
+		})
+		engine.OnTransition(func(ctx context.Context, transition simulation.Transition) {
+			h.transitioned(ctx, transition.Job, transition.Task, transition.Time)
+		})
+		h.sim = engine
+	}
+	if cfg.Retention.enabled() {
+		go h.reapLoop()
+	}
+
+	return h
+}
+
+// transitioned announces a state change of task, or of job if task is nil,
+// to the job's Pub/Sub notifications and the registered webhooks, and records
+// the duration of jobs that finished.
+func (h *Handler) transitioned(ctx context.Context, job *api.Job, task *api.Task, at time.Time) {
+	h.notifier.Notify(ctx, job, task, at)
+	h.webhooks.Deliver(ctx, job, task, at)
+	if task == nil {
+		h.metrics.jobFinished(job, at)
+	}
 }
 
-// NewHandler creates a new Handler with the given storage.
-func NewHandler(store *storage.MemoryStore) *Handler {
-	return &Handler{store: store}
+// Close stops every running simulation and pending deletion, waits for them
+// to exit, stops the webhook deliveries and flushes the audit sinks. It also
+// stops the retention reaper.
+func (h *Handler) Close() {
+	h.closeOnce.Do(func() { close(h.closing) })
+	h.sim.Shutdown()
+	h.webhooks.Close()
+	if err := h.audit.Close(); err != nil {
+		logrus.Errorf("Failed to close audit sinks: %v", err)
+	}
 }
 
-// CreateJob handles job creation requests.
+// CreateJob handles job creation requests. The job ID is taken from the jobId
+// or job_id query parameter. A request retried with the requestId of one that
+// created a job returns that job instead of creating another. With
+// validateOnly=true the job is checked and returned as it would be created,
+// but neither stored nor run.
 func (h *Handler) CreateJob(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	project := vars["project"]
 	location := vars["location"]
+	parent := fmt.Sprintf("projects/%s/locations/%s", project, location)
+	if location == storage.AnyLocation {
+		writeError(w, http.StatusBadRequest, "Invalid request: jobs cannot be created in location %q", location)
+		return
+	}
+
+	jobID, err := queryParam(r, "jobId", "job_id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request: %v", err)
+		return
+	}
+	requestID, err := queryParam(r, "requestId", "request_id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request: %v", err)
+		return
+	}
+	validateOnlyParam, err := queryParam(r, "validateOnly", "validate_only")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request: %v", err)
+		return
+	}
+	validateOnly := false
+	if validateOnlyParam != "" {
+		if validateOnly, err = strconv.ParseBool(validateOnlyParam); err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid validateOnly %q, must be true or false", validateOnlyParam)
+			return
+		}
+	}
+	if requestID != "" {
+		if err := validateRequestID(requestID); err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid request: %v", err)
+			return
+		}
+		// Retries of a request that created a job get that job back.
+		h.requestMu.Lock()
+		existing, ok := h.requestedJob(h.storeFor(r), parent, requestID)
+		h.requestMu.Unlock()
+		if ok {
+			writeJSON(w, http.StatusOK, existing)
+			return
+		}
+	}
+
+	job, warnings, err := decodeJob(r.Body, h.strictJSON)
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	writeWarnings(w, warnings)
+
+	plan, err := h.newPlan(job, project, r.URL.Query().Get("final_state"))
+	if value := r.Header.Get(scenarioHeader); value != "" && err == nil {
+		err = simulation.ApplyOverride(plan, value, h.timings, h.scenarios)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid simulation options: %v", err)
+		return
+	}
+
+	if err := h.checkTaskCounts(job); err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+
+	if err := validateJob(job); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid job: %v", err)
+		return
+	}
+
+	locationWarnings, err := checkAllowedLocations(job, location)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid job: %v", err)
+		return
+	}
+	writeWarnings(w, locationWarnings)
+
+	if err := h.checkResources(job); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid job: %v", err)
+		return
+	}
+
+	catalogWarnings, err := h.checkCatalog(job, location)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid job: %v", err)
+		return
+	}
+	writeWarnings(w, catalogWarnings)
+
+	if err := h.checkImages(r.Context(), job); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid job: %v", err)
+		return
+	}
+
+	if validateOnly {
+		if err := h.dryRunJob(r.Context(), project, location, jobID, job); err != nil {
+			writeSubmitError(w, err)
+			return
+		}
+		requestLog(w).Infof("Validated job: %s", job.Name)
+		writeJSON(w, http.StatusOK, job)
+		return
+	}
+
+	if requestID != "" {
+		h.requestMu.Lock()
+		defer h.requestMu.Unlock()
+		// A concurrent request with the same requestId may have won the race.
+		if existing, ok := h.requestedJob(h.storeFor(r), parent, requestID); ok {
+			writeJSON(w, http.StatusOK, existing)
+			return
+		}
+	}
 
-	var job api.Job
-	if err := json.NewDecoder(r.Body).Decode(&job); err != nil {
-		writeError(w, http.StatusBadRequest, "Invalid request body: %v", err)
+	if err := h.submitJob(r.Context(), project, location, jobID, job, plan); err != nil {
+		writeSubmitError(w, err)
 		return
 	}
+	if requestID != "" {
+		h.createRequests[parent+"/"+requestID] = &createRequest{job: job.Name, time: job.CreateTime}
+	}
+
+	writeJSON(w, http.StatusOK, job)
+}
+
+// validateJob checks the fields of a submitted job the server acts on.
+func validateJob(job *api.Job) error {
+	if err := webhook.Validate(job); err != nil {
+		return err
+	}
+	if err := pubsub.Validate(job); err != nil {
+		return err
+	}
+	if job.LogsPolicy != nil && job.LogsPolicy.Destination == logsDestinationPath {
+		if job.LogsPolicy.LogsPath == "" {
+			return fmt.Errorf("logsPolicy.logsPath is required when the destination is PATH")
+		}
+		if bucket, _, ok := logs.ParseGCSURL(job.LogsPolicy.LogsPath); ok && bucket == "" {
+			return fmt.Errorf("invalid logsPolicy.logsPath %q, must name a bucket", job.LogsPolicy.LogsPath)
+		}
+	}
+	for i, taskGroup := range job.TaskGroups {
+		if taskGroup.TaskSpec == nil {
+			continue
+		}
+		if value := taskGroup.TaskSpec.MaxRunDuration; value != "" {
+			if _, err := simulation.ParseDuration(value); err != nil {
+				return fmt.Errorf("taskGroups[%d].taskSpec.maxRunDuration: %v", i, err)
+			}
+		}
+		for j, runnable := range taskGroup.TaskSpec.Runnables {
+			if runnable.Timeout == "" {
+				continue
+			}
+			if _, err := simulation.ParseDuration(runnable.Timeout); err != nil {
+				return fmt.Errorf("taskGroups[%d].taskSpec.runnables[%d].timeout: %v", i, j, err)
+			}
+		}
+	}
+	return nil
+}
+
+// DefaultMaxTaskCount is the production limit on the number of tasks in a
+// task group.
+const DefaultMaxTaskCount = 100000
+
+// checkTaskCounts rejects task groups with a negative task count or more
+// tasks than the handler allows, with the message production returns.
+func (h *Handler) checkTaskCounts(job *api.Job) error {
+	for i, taskGroup := range job.TaskGroups {
+		if taskGroup.TaskCount < 0 || taskGroup.TaskCount > h.maxTaskCount {
+			return fmt.Errorf("Invalid value for field 'taskGroups[%d].taskCount': '%d'. Task count must be between 1 and %d.", i, taskGroup.TaskCount, h.maxTaskCount)
+		}
+	}
+	return nil
+}
+
+// checkImages verifies that every container image of job exists, if an
+// ImageChecker is configured.
+func (h *Handler) checkImages(ctx context.Context, job *api.Job) error {
+	if h.images == nil {
+		return nil
+	}
+
+	checked := make(map[string]bool)
+	for _, taskGroup := range job.TaskGroups {
+		if taskGroup.TaskSpec == nil {
+			continue
+		}
+		for _, runnable := range taskGroup.TaskSpec.Runnables {
+			if runnable.Container == nil || checked[runnable.Container.ImageURI] {
+				continue
+			}
+			image := runnable.Container.ImageURI
+			checked[image] = true
+
+			exists, err := h.images.ImageExists(ctx, image)
+			if err != nil {
+				return fmt.Errorf("could not verify image %q: %v", image, err)
+			}
+			if !exists {
+				return fmt.Errorf("image %q does not exist", image)
+			}
+		}
+	}
+	return nil
+}
+
+// checkCatalog checks the machine and accelerator types of job, a job of
+// location, against the handler's catalog, if any. The problems found are
+// returned as warnings, or the first as an error with a strict catalog.
+func (h *Handler) checkCatalog(job *api.Job, location string) ([]*lint.Warning, error) {
+	if h.catalog == nil {
+		return nil, nil
+	}
+	problems := h.catalog.Check(job, location)
+	if h.strictCatalog && len(problems) > 0 {
+		return nil, problems[0]
+	}
+	var warnings []*lint.Warning
+	for _, problem := range problems {
+		warnings = append(warnings, &lint.Warning{Kind: lint.KindMachineCatalog, Field: problem.Field, Message: problem.Message})
+	}
+	return warnings, nil
+}
 
-	jobID := r.URL.Query().Get("job_id")
+// builtinCatalog is the catalog resources are checked against when the
+// handler has none.
+var builtinCatalog = catalog.Default()
+
+// checkResources rejects jobs whose computeResource the VMs of their
+// instance policies cannot hold, like production does, whether or not the
+// handler checks machine types against a catalog.
+func (h *Handler) checkResources(job *api.Job) error {
+	c := h.catalog
+	if c == nil {
+		c = builtinCatalog
+	}
+	if problems := c.CheckResources(job); len(problems) > 0 {
+		return problems[0]
+	}
+	return nil
+}
+
+// planDefaults returns the simulation defaults for the jobs of project,
+// taking its profile into account.
+func (h *Handler) planDefaults(project string) simulation.Plan {
+	if _, profile, ok := h.profiles.For(project); ok {
+		return profile.Apply(h.defaults)
+	}
+	return h.defaults
+}
+
+// scenarioHeader overrides the simulation of the job CreateJob creates, e.g.
+// "fail-after-running,run=30s"; see simulation.ApplyOverride.
+const scenarioHeader = "X-Fake-Batch-Scenario"
+
+// newPlan builds the simulation plan of job, a job of project, from its
+// labels, the defaults of the project and the requested final state, and
+// attaches the scenario the job matches, if any.
+func (h *Handler) newPlan(job *api.Job, project, finalState string) (*simulation.Plan, error) {
+	plan, err := simulation.NewPlan(job, h.planDefaults(project), finalState)
+	if err != nil {
+		return nil, err
+	}
+	plan.Scenario = h.scenarios.For(job)
+	return plan, nil
+}
+
+// storeFor returns the store traced as part of the request r, failing its
+// operations once r is cancelled or past its deadline.
+func (h *Handler) storeFor(r *http.Request) storage.Store {
+	return storage.WithContext(r.Context(), tracing.WrapStore(r.Context(), h.store))
+}
+
+// prepareJob populates the server-side fields of job, other than its UID, for
+// a job named jobID in project and location. A random job ID is generated
+// when jobID is empty.
+func (h *Handler) prepareJob(project, location, jobID string, job *api.Job) {
 	if jobID == "" {
-		jobID = fmt.Sprintf("job-%s", uuid.New().String()[:8])
+		jobID = fmt.Sprintf("job-%s", shortID(h.ids.NewID()))
 	}
 
 	job.Name = fmt.Sprintf("projects/%s/locations/%s/jobs/%s", project, location, jobID)
-	job.UID = uuid.New().String()
 	job.State = api.JobStateQueued
-	job.CreateTime = time.Now()
+	job.CreateTime = h.clock.Now()
 	job.UpdateTime = job.CreateTime
+	h.serverDefaults.apply(job, location)
 
 	if job.Status == nil {
 		job.Status = &api.JobStatus{
@@ -69,19 +690,82 @@ func (h *Handler) CreateJob(w http.ResponseWriter, r *http.Request) {
 			},
 		}
 	}
+}
 
-	if err := h.store.CreateJob(&job); err != nil {
-		writeError(w, http.StatusConflict, "Failed to create job: %v", err)
-		return
+// submitJob populates the server-side fields of job, stores it and starts
+// its simulated execution according to plan. A random job ID is generated when jobID is empty.
+// The simulation is traced as part of the span in ctx, if any.
+func (h *Handler) submitJob(ctx context.Context, project, location, jobID string, job *api.Job, plan *simulation.Plan) error {
+	generated := jobID == ""
+	h.prepareJob(project, location, jobID, job)
+	job.UID = h.ids.NewID()
+
+	h.quotaMu.Lock()
+	if err := h.checkQuota(project, location, job); err != nil {
+		h.quotaMu.Unlock()
+		return err
 	}
+	for attempt := 1; ; attempt++ {
+		err := tracing.WrapStore(ctx, h.store).CreateJob(job)
+		if err == nil {
+			break
+		}
+		// Generated IDs are short enough to collide under heavy parallel
+		// creation, so a taken one is replaced rather than reported.
+		if !generated || !errors.Is(err, storage.ErrAlreadyExists) || attempt == maxGeneratedIDAttempts {
+			h.quotaMu.Unlock()
+			return err
+		}
+		logrus.Debugf("Generated job name %s is taken, generating another", job.Name)
+		job.Name = fmt.Sprintf("projects/%s/locations/%s/jobs/job-%s", project, location, shortID(h.ids.NewID()))
+	}
+	h.quotaCreated(project)
+	h.quotaMu.Unlock()
+	h.mirrorLogs(job)
+	h.transitioned(context.Background(), job, nil, job.CreateTime)
 
-	go h.simulateJobExecution(&job)
+	plan.Trace = tracing.SpanContextFromContext(ctx)
+	h.sim.Start(job, plan)
 
 	logrus.Infof("Created job: %s", job.Name)
-	writeJSON(w, http.StatusOK, &job)
+	return nil
 }
 
-// GetJob retrieves a specific job by ID.
+// dryRunJob populates the server-side fields of job like submitJob and
+// returns the error submitJob would fail with, without storing the job or
+// starting its simulation.
+func (h *Handler) dryRunJob(ctx context.Context, project, location, jobID string, job *api.Job) error {
+	h.prepareJob(project, location, jobID, job)
+
+	h.quotaMu.Lock()
+	defer h.quotaMu.Unlock()
+	if err := h.checkQuota(project, location, job); err != nil {
+		return err
+	}
+	if jobID != "" {
+		if _, err := tracing.WrapStore(ctx, h.store).GetJob(job.Name); err == nil {
+			return fmt.Errorf("job %s %w", job.Name, storage.ErrAlreadyExists)
+		}
+	}
+	return nil
+}
+
+// writeSubmitError writes the error of a job submitJob failed to create.
+func writeSubmitError(w http.ResponseWriter, err error) {
+	var quota *quotaError
+	if errors.As(err, &quota) {
+		if quota.retryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(quota.retryAfter.Seconds()))))
+		}
+		writeError(w, http.StatusTooManyRequests, "%v", err)
+		return
+	}
+	writeError(w, http.StatusConflict, "Failed to create job: %v", err)
+}
+
+// GetJob retrieves a specific job by ID. Polling clients can send back the
+// ETag of the previous response in If-None-Match to get a 304 while the job
+// is unchanged.
 func (h *Handler) GetJob(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	project := vars["project"]
@@ -90,35 +774,117 @@ func (h *Handler) GetJob(w http.ResponseWriter, r *http.Request) {
 
 	jobName := fmt.Sprintf("projects/%s/locations/%s/jobs/%s", project, location, jobID)
 
-	job, err := h.store.GetJob(jobName)
+	job, err := h.storeFor(r).GetJob(jobName)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "Job not found: %v", err)
+		return
+	}
+
+	writeJSONWithETag(w, r, job)
+}
+
+// LookupJob retrieves a job by the UID given in the uid query parameter, for
+// callers that key jobs on their UID rather than their name.
+func (h *Handler) LookupJob(w http.ResponseWriter, r *http.Request) {
+	uid := r.URL.Query().Get("uid")
+	if uid == "" {
+		writeError(w, http.StatusBadRequest, "uid query parameter is required")
+		return
+	}
+
+	job, err := h.storeFor(r).GetJobByUID(uid)
 	if err != nil {
 		writeError(w, http.StatusNotFound, "Job not found: %v", err)
 		return
 	}
+	project, _, _ := strings.Cut(strings.TrimPrefix(job.Name, "projects/"), "/")
+	if token := tokenFromContext(r.Context()); token != nil && !token.Allows(project) {
+		writeError(w, http.StatusForbidden, "Permission denied on resource project %s for %s", project, token.Name)
+		return
+	}
+	if !h.projects.Allows(project) {
+		writeProjectDenied(w, project)
+		return
+	}
 
 	writeJSON(w, http.StatusOK, job)
 }
 
-// ListJobs returns all jobs for a project and location.
+// inParent reports whether the job named name is in project and location,
+// which may be the "-" wildcard.
+func inParent(name, project, location string) bool {
+	if location == storage.AnyLocation {
+		return strings.HasPrefix(name, fmt.Sprintf("projects/%s/locations/", project))
+	}
+	return strings.HasPrefix(name, fmt.Sprintf("projects/%s/locations/%s/jobs/", project, location))
+}
+
+// ListJobs returns the jobs of a project and location, one page at a time
+// when pageSize or pageToken is given. The location "-" lists the jobs of
+// every location of the project. With a uid query parameter it returns only
+// the job of that UID, if it is in the project and location. Listings of more
+// than streamThreshold jobs are streamed.
 func (h *Handler) ListJobs(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	project := vars["project"]
 	location := vars["location"]
 
-	jobs, err := h.store.ListJobs(project, location)
+	if uid := r.URL.Query().Get("uid"); uid != "" {
+		response := &api.ListJobsResponse{Jobs: []*api.Job{}}
+		if job, err := h.storeFor(r).GetJobByUID(uid); err == nil && inParent(job.Name, project, location) {
+			response.Jobs = append(response.Jobs, job)
+		}
+		writeJSON(w, http.StatusOK, response)
+		return
+	}
+
+	pageReq, err := parsePageRequest(r)
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, "Failed to list jobs: %v", err)
+		writeError(w, http.StatusBadRequest, "Invalid request: %v", err)
+		return
+	}
+
+	parent := fmt.Sprintf("projects/%s/locations/%s", project, location)
+	names, nextPageToken, err := h.pages.page(parent, pageReq, func() listing {
+		jobs, _ := h.storeFor(r).ListJobs(project, location)
+		names := make(nameList, 0, len(jobs))
+		for _, job := range jobs {
+			names = append(names, job.Name)
+		}
+		sort.Strings(names)
+		return names
+	}, func(name string) bool {
+		_, err := h.storeFor(r).GetJob(name)
+		return err == nil
+	})
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request: %v", err)
+		return
+	}
+
+	if len(names) > streamThreshold {
+		streamList(w, "jobs", names, nextPageToken, func(name string) (interface{}, bool) {
+			job, err := h.storeFor(r).GetJob(name)
+			return job, err == nil
+		})
 		return
 	}
 
 	response := &api.ListJobsResponse{
-		Jobs: jobs,
+		Jobs:          make([]*api.Job, 0, len(names)),
+		NextPageToken: nextPageToken,
+	}
+	for _, name := range names {
+		if job, err := h.storeFor(r).GetJob(name); err == nil {
+			response.Jobs = append(response.Jobs, job)
+		}
 	}
 
 	writeJSON(w, http.StatusOK, response)
 }
 
-// DeleteJob marks a job for deletion.
+// DeleteJob marks a job for deletion and returns a long-running operation
+// that completes once the job has been removed.
 func (h *Handler) DeleteJob(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	project := vars["project"]
@@ -127,158 +893,243 @@ func (h *Handler) DeleteJob(w http.ResponseWriter, r *http.Request) {
 
 	jobName := fmt.Sprintf("projects/%s/locations/%s/jobs/%s", project, location, jobID)
 
-	job, err := h.store.GetJob(jobName)
+	// Stop the simulation first so it cannot overwrite the DELETING state,
+	// and read the job once it has made its last save.
+	h.sim.Stop(jobName)
+
+	job, err := h.storeFor(r).GetJob(jobName)
 	if err != nil {
 		writeError(w, http.StatusNotFound, "Job not found: %v", err)
 		return
 	}
 
 	job.State = api.JobStateDeleting
-	job.UpdateTime = time.Now()
-	if err := h.store.UpdateJob(job); err != nil {
+	job.UpdateTime = h.clock.Now()
+	if err := h.storeFor(r).UpdateJob(job); err != nil {
 		writeError(w, http.StatusInternalServerError, "Failed to update job: %v", err)
 		return
 	}
+	h.transitioned(r.Context(), job, nil, job.UpdateTime)
+
+	op := &api.Operation{
+		Name: fmt.Sprintf("projects/%s/locations/%s/operations/operation-%d-%s",
+			project, location, job.UpdateTime.UnixMilli(), h.ids.NewID()),
+		Metadata: &api.OperationMetadata{
+			Type:       fmt.Sprintf(operationMetadataType, apiVersion(r)),
+			CreateTime: job.UpdateTime,
+			Target:     jobName,
+			Verb:       "delete",
+			APIVersion: apiVersion(r),
+		},
+	}
+	if err := h.storeFor(r).CreateOperation(op); err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to create operation: %v", err)
+		return
+	}
+
+	h.finishDeletion(op, h.timings.Merge(h.planDefaults(project).Timings).Duration(api.JobStateDeleting))
+
+	requestLog(w).Infof("Deleting job: %s", jobName)
+	writeJSON(w, http.StatusOK, op)
+}
+
+// finishDeletion removes the job targeted by the delete operation op after
+// delay and marks op done.
+func (h *Handler) finishDeletion(op *api.Operation, delay time.Duration) {
+	jobName := op.Metadata.Target
+	h.sim.Go(func(ctx context.Context) {
+		select {
+		case <-h.clock.After(delay):
+		case <-ctx.Done():
+			return
+		}
+
+		endTime := h.clock.Now()
+		metadata := *op.Metadata
+		metadata.EndTime = &endTime
+		done := &api.Operation{Name: op.Name, Metadata: &metadata, Done: true}
 
-	go func() {
-		time.Sleep(2 * time.Second)
 		if err := h.store.DeleteJob(jobName); err != nil {
 			logrus.Errorf("Failed to delete job %s: %v", jobName, err)
+			done.Error = &api.Status{Code: codeInternal, Message: err.Error()}
+		} else {
+			done.Response = map[string]string{"@type": emptyResponseType}
+			h.logs.DeleteJob(jobName)
 		}
-	}()
 
-	logrus.Infof("Deleting job: %s", jobName)
-	w.WriteHeader(http.StatusOK)
-	if _, err := w.Write([]byte(`{}`)); err != nil {
-		logrus.Errorf("Failed to write response: %v", err)
-	}
+		if err := h.store.UpdateOperation(done); err != nil {
+			logrus.Errorf("Failed to update operation %s: %v", op.Name, err)
+		}
+	})
 }
 
-// ListTasks returns all tasks for a specific job.
-func (h *Handler) ListTasks(w http.ResponseWriter, r *http.Request) {
+// GetOperation retrieves a long-running operation by ID.
+func (h *Handler) GetOperation(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	project := vars["project"]
 	location := vars["location"]
-	jobID := vars["job"]
+	operationID := vars["operation"]
 
-	jobName := fmt.Sprintf("projects/%s/locations/%s/jobs/%s", project, location, jobID)
+	opName := fmt.Sprintf("projects/%s/locations/%s/operations/%s", project, location, operationID)
 
-	tasks, err := h.store.ListTasks(jobName)
+	op, err := h.storeFor(r).GetOperation(opName)
 	if err != nil {
-		writeError(w, http.StatusNotFound, "Job not found: %v", err)
+		writeError(w, http.StatusNotFound, "Operation not found: %v", err)
 		return
 	}
 
-	response := &api.ListTasksResponse{
-		Tasks: tasks,
-	}
-
-	writeJSON(w, http.StatusOK, response)
+	writeJSON(w, http.StatusOK, op)
 }
 
-// GetTask retrieves a specific task by ID.
-func (h *Handler) GetTask(w http.ResponseWriter, r *http.Request) {
+// ListTasks returns the tasks of a job, one page at a time when pageSize or
+// pageToken is given, or at most maxPageSize at a time if the job has lazy
+// task groups. Like GetJob, it answers If-None-Match with 304 while the
+// listing is unchanged, except for listings of more than streamThreshold
+// tasks, which are streamed without an ETag.
+func (h *Handler) ListTasks(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	project := vars["project"]
 	location := vars["location"]
 	jobID := vars["job"]
-	taskID := vars["task"]
 
 	jobName := fmt.Sprintf("projects/%s/locations/%s/jobs/%s", project, location, jobID)
-	taskName := fmt.Sprintf("%s/tasks/%s", jobName, taskID)
 
-	task, err := h.store.GetTask(jobName, taskName)
+	pageReq, err := parsePageRequest(r)
 	if err != nil {
-		writeError(w, http.StatusNotFound, "Task not found: %v", err)
+		writeError(w, http.StatusBadRequest, "Invalid request: %v", err)
 		return
 	}
 
-	writeJSON(w, http.StatusOK, task)
-}
-
-func (h *Handler) simulateJobExecution(job *api.Job) {
-	time.Sleep(2 * time.Second)
+	job, err := h.storeFor(r).GetJob(jobName)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "Job not found: %v", err)
+		return
+	}
+	// Jobs with lazy task groups are too large to list at once.
+	if pageReq.size == 0 {
+		for _, taskGroup := range job.TaskGroups {
+			if storage.Lazy(taskGroup) {
+				pageReq.size = maxPageSize
+			}
+		}
+	}
 
-	job.State = api.JobStateRunning
-	job.UpdateTime = time.Now()
-	job.Status.State = api.JobStateRunning
-	job.Status.StatusEvents = append(job.Status.StatusEvents, &api.StatusEvent{
-		Type:        "job_started",
-		Description: "Job started running",
-		EventTime:   time.Now(),
+	names, nextPageToken, err := h.pages.page(jobName, pageReq, func() listing {
+		return newTaskList(job)
+	}, func(name string) bool {
+		_, err := h.storeFor(r).GetTask(jobName, name)
+		return err == nil
 	})
-
-	if err := h.store.UpdateJob(job); err != nil {
-		logrus.Errorf("Failed to update job state: %v", err)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request: %v", err)
 		return
 	}
 
-	tasks, _ := h.store.ListTasks(job.Name)
-	for _, task := range tasks {
-		task.Status.State = api.TaskStateRunning
-		task.Status.StatusEvents = append(task.Status.StatusEvents, &api.StatusEvent{
-			Type:        "task_started",
-			Description: "Task started running",
-			EventTime:   time.Now(),
+	if len(names) > streamThreshold {
+		streamList(w, "tasks", names, nextPageToken, func(name string) (interface{}, bool) {
+			task, err := h.storeFor(r).GetTask(jobName, name)
+			if err != nil {
+				return nil, false
+			}
+			return withEnvironment(job, task), true
 		})
-		h.store.UpdateTask(job.Name, task)
+		return
 	}
 
-	for _, taskGroup := range job.TaskGroups {
-		job.Status.TaskGroups[taskGroup.Name].Counts = map[string]int64{
-			"RUNNING": taskGroup.TaskCount,
+	response := &api.ListTasksResponse{
+		Tasks:         make([]*api.Task, 0, len(names)),
+		NextPageToken: nextPageToken,
+	}
+	for _, name := range names {
+		if task, err := h.storeFor(r).GetTask(jobName, name); err == nil {
+			response.Tasks = append(response.Tasks, withEnvironment(job, task))
 		}
 	}
-	h.store.UpdateJob(job)
 
-	time.Sleep(5 * time.Second)
+	writeJSONWithETag(w, r, response)
+}
 
-	for _, task := range tasks {
-		task.Status.State = api.TaskStateSucceeded
-		task.Status.StatusEvents = append(task.Status.StatusEvents, &api.StatusEvent{
-			Type:        "task_completed",
-			Description: "Task completed successfully",
-			EventTime:   time.Now(),
-		})
-		h.store.UpdateTask(job.Name, task)
-	}
+// GetTask retrieves a specific task by ID.
+func (h *Handler) GetTask(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	project := vars["project"]
+	location := vars["location"]
+	jobID := vars["job"]
+	group := vars["group"]
+	taskID := vars["task"]
 
-	job.State = api.JobStateSucceeded
-	job.UpdateTime = time.Now()
-	job.Status.State = api.JobStateSucceeded
-	job.Status.StatusEvents = append(job.Status.StatusEvents, &api.StatusEvent{
-		Type:        "job_completed",
-		Description: "Job completed successfully",
-		EventTime:   time.Now(),
-	})
-	job.Status.RunDuration = "7s"
+	jobName := fmt.Sprintf("projects/%s/locations/%s/jobs/%s", project, location, jobID)
+	taskName := fmt.Sprintf("%s/taskGroups/%s/tasks/%s", jobName, group, taskID)
 
-	for _, taskGroup := range job.TaskGroups {
-		job.Status.TaskGroups[taskGroup.Name].Counts = map[string]int64{
-			"SUCCEEDED": taskGroup.TaskCount,
-		}
+	job, err := h.storeFor(r).GetJob(jobName)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "Task not found: %v", err)
+		return
 	}
-
-	if err := h.store.UpdateJob(job); err != nil {
-		logrus.Errorf("Failed to update job state: %v", err)
+	task, err := h.storeFor(r).GetTask(jobName, taskName)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "Task not found: %v", err)
+		return
 	}
+
+	writeJSON(w, http.StatusOK, withEnvironment(job, task))
+}
+
+// withEnvironment returns a copy of task, which belongs to job, with the
+// BATCH_* variables its runnables get.
+func withEnvironment(job *api.Job, task *api.Task) *api.Task {
+	exposed := *task
+	exposed.Environment = &api.Environment{Variables: simulation.TaskEnvironment(job, task.Name)}
+	return &exposed
 }
 
 func writeJSON(w http.ResponseWriter, status int, v interface{}) {
 	w.WriteHeader(status)
 	if err := json.NewEncoder(w).Encode(v); err != nil {
-		logrus.Errorf("Failed to encode response: %v", err)
+		requestLog(w).Errorf("Failed to encode response: %v", err)
 	}
 }
 
 func writeError(w http.ResponseWriter, status int, format string, args ...interface{}) {
 	message := fmt.Sprintf(format, args...)
-	logrus.Error(message)
-	w.WriteHeader(status)
-	if err := json.NewEncoder(w).Encode(map[string]string{
-		"error": message,
-	}); err != nil {
-		logrus.Errorf("Failed to encode error response: %v", err)
-	}
+	requestLog(w).Error(message)
+	writeJSON(w, status, &api.ErrorResponse{
+		Error: &api.Status{
+			Code:    status,
+			Message: message,
+			Status:  canonicalStatus(status),
+			Details: withRequestInfo(w, nil),
+		},
+	})
 }
 
+// canonicalStatus maps an HTTP status code to the google.rpc.Code name Google
+// APIs report alongside it.
+func canonicalStatus(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return "INVALID_ARGUMENT"
+	case http.StatusUnauthorized:
+		return "UNAUTHENTICATED"
+	case http.StatusForbidden:
+		return "PERMISSION_DENIED"
+	case http.StatusNotFound:
+		return "NOT_FOUND"
+	case http.StatusConflict:
+		return "ALREADY_EXISTS"
+	case http.StatusTooManyRequests, http.StatusRequestEntityTooLarge:
+		return "RESOURCE_EXHAUSTED"
+	case http.StatusNotImplemented:
+		return "UNIMPLEMENTED"
+	case http.StatusServiceUnavailable:
+		return "UNAVAILABLE"
+	case http.StatusGatewayTimeout:
+		return "DEADLINE_EXCEEDED"
+	case statusClientClosedRequest:
+		return "CANCELLED"
+	case http.StatusInternalServerError:
+		return "INTERNAL"
+	default:
+		return "UNKNOWN"
+	}
+}
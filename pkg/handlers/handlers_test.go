@@ -1,19 +1,45 @@
 package handlers
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
 	"github.com/pyshx/fake-batch-server/pkg/api"
+	"github.com/pyshx/fake-batch-server/pkg/audit"
+	"github.com/pyshx/fake-batch-server/pkg/auth"
+	"github.com/pyshx/fake-batch-server/pkg/blobstore"
+	"github.com/pyshx/fake-batch-server/pkg/catalog"
+	"github.com/pyshx/fake-batch-server/pkg/clock"
+	"github.com/pyshx/fake-batch-server/pkg/doctor"
+	"github.com/pyshx/fake-batch-server/pkg/faults"
+	"github.com/pyshx/fake-batch-server/pkg/lint"
+	"github.com/pyshx/fake-batch-server/pkg/logging"
+	"github.com/pyshx/fake-batch-server/pkg/logs"
+	"github.com/pyshx/fake-batch-server/pkg/metrics"
+	"github.com/pyshx/fake-batch-server/pkg/pubsub"
+	"github.com/pyshx/fake-batch-server/pkg/simulation"
 	"github.com/pyshx/fake-batch-server/pkg/storage"
+	"github.com/pyshx/fake-batch-server/pkg/tracing"
+	"github.com/pyshx/fake-batch-server/pkg/webhook"
 )
 
 func setupTestHandler() *Handler {
@@ -21,17 +47,171 @@ func setupTestHandler() *Handler {
 	return NewHandler(store)
 }
 
+func setupFakeClockHandler() (*Handler, *clock.Fake) {
+	fake := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	return NewHandlerWithConfig(storage.NewMemoryStoreWithClock(fake), Config{Clock: fake}), fake
+}
+
+// stubSimulator records the calls made to it instead of simulating jobs.
+// Background functions are kept until the test runs them.
+type stubSimulator struct {
+	mu         sync.Mutex
+	started    []string
+	resumed    []string
+	recovered  []string
+	stopped    []string
+	completed  []string
+	background []func(ctx context.Context)
+}
+
+func (s *stubSimulator) Start(job *api.Job, plan *simulation.Plan) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.started = append(s.started, job.Name)
+}
+
+func (s *stubSimulator) Resume(job *api.Job, plan *simulation.Plan) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.resumed = append(s.resumed, job.Name)
+}
+
+func (s *stubSimulator) Recover(job *api.Job, plan *simulation.Plan) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.recovered = append(s.recovered, job.Name)
+}
+
+func (s *stubSimulator) Plans() map[string]*simulation.Plan {
+	return nil
+}
+
+func (s *stubSimulator) Running(name string) bool {
+	return false
+}
+
+func (s *stubSimulator) Stop(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stopped = append(s.stopped, name)
+	return false
+}
+
+func (s *stubSimulator) Reprioritize(name string, priority int32) {}
+
+func (s *stubSimulator) Update(name string, fn func(job *api.Job) error) (bool, error) {
+	return false, nil
+}
+
+func (s *stubSimulator) Complete(ctx context.Context, job *api.Job, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.completed = append(s.completed, job.Name)
+}
+
+func (s *stubSimulator) Go(fn func(ctx context.Context)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.background = append(s.background, fn)
+}
+
+func (s *stubSimulator) Shutdown() {}
+
+func (s *stubSimulator) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.background = nil
+}
+
+func (s *stubSimulator) Stats() simulation.Stats {
+	return simulation.Stats{}
+}
+
+// sequentialIDs generates the IDs id-1, id-2, ...
+type sequentialIDs struct {
+	n int
+}
+
+func (g *sequentialIDs) NewID() string {
+	g.n++
+	return fmt.Sprintf("id-%d", g.n)
+}
+
+func setupStubHandler() (*Handler, *stubSimulator, *clock.Fake) {
+	sim := &stubSimulator{}
+	fake := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	handler := NewHandler(storage.NewMemoryStoreWithClock(fake),
+		WithClock(fake),
+		WithSimulator(sim),
+		WithIDGenerator(&sequentialIDs{}),
+	)
+	return handler, sim, fake
+}
+
 func setupRouter(handler *Handler) *mux.Router {
 	router := mux.NewRouter()
-	v1 := router.PathPrefix("/v1").Subrouter()
-	
-	v1.HandleFunc("/projects/{project}/locations/{location}/jobs", handler.CreateJob).Methods("POST")
-	v1.HandleFunc("/projects/{project}/locations/{location}/jobs", handler.ListJobs).Methods("GET")
-	v1.HandleFunc("/projects/{project}/locations/{location}/jobs/{job}", handler.GetJob).Methods("GET")
-	v1.HandleFunc("/projects/{project}/locations/{location}/jobs/{job}", handler.DeleteJob).Methods("DELETE")
-	v1.HandleFunc("/projects/{project}/locations/{location}/jobs/{job}/tasks", handler.ListTasks).Methods("GET")
-	v1.HandleFunc("/projects/{project}/locations/{location}/jobs/{job}/tasks/{task}", handler.GetTask).Methods("GET")
-	
+	router.Use(RequestIDMiddleware)
+	router.Use(handler.TracingMiddleware)
+	router.Use(handler.MetricsMiddleware)
+	router.Use(handler.AuditMiddleware)
+	router.Use(handler.AuthMiddleware)
+	router.Use(handler.TenantMiddleware)
+	router.Use(handler.BodyLimitMiddleware)
+	router.Use(handler.DeadlineMiddleware)
+	router.Use(handler.ChaosMiddleware)
+	router.HandleFunc("/metrics", handler.Metrics).Methods("GET")
+
+	for _, version := range []string{"/v1", "/v1alpha"} {
+		sub := router.PathPrefix(version).Subrouter()
+		sub.HandleFunc("/jobs:lookup", handler.LookupJob).Methods("GET")
+		sub.HandleFunc("/projects/{project}/locations/{location}/jobs", handler.CreateJob).Methods("POST")
+		sub.HandleFunc("/projects/{project}/locations/{location}/jobs", handler.ListJobs).Methods("GET")
+		sub.HandleFunc("/projects/{project}/locations/{location}/jobs:lint", handler.LintJob).Methods("POST")
+		sub.HandleFunc("/projects/{project}/locations/{location}/jobs:watch", handler.WatchJobs).Methods("GET")
+		sub.HandleFunc("/projects/{project}/locations/{location}/jobs/{job}", handler.GetJob).Methods("GET")
+		sub.HandleFunc("/projects/{project}/locations/{location}/jobs/{job}", handler.UpdateJob).Methods("PATCH")
+		sub.HandleFunc("/projects/{project}/locations/{location}/jobs/{job}", handler.DeleteJob).Methods("DELETE")
+		sub.HandleFunc("/projects/{project}/locations/{location}/jobs/{job}/watch", handler.WatchJob).Methods("GET")
+		sub.HandleFunc("/projects/{project}/locations/{location}/jobs/{job}/tasks", handler.ListTasks).Methods("GET")
+		sub.HandleFunc("/projects/{project}/locations/{location}/jobs/{job}/taskGroups/{group}/tasks/{task}", handler.GetTask).Methods("GET")
+		sub.HandleFunc("/projects/{project}/locations/{location}/jobs/{job}/taskGroups/{group}/tasks/{task}/logs", handler.GetTaskLogs).Methods("GET")
+		sub.HandleFunc("/projects/{project}/locations/{location}/operations/{operation}", handler.GetOperation).Methods("GET")
+		if version == "/v1alpha" {
+			sub.HandleFunc("/projects/{project}/locations/{location}/jobs/{job}:cancel", handler.CancelJob).Methods("POST")
+			sub.HandleFunc("/projects/{project}/locations/{location}/resourceAllowances", handler.CreateResourceAllowance).Methods("POST")
+			sub.HandleFunc("/projects/{project}/locations/{location}/resourceAllowances", handler.ListResourceAllowances).Methods("GET")
+			sub.HandleFunc("/projects/{project}/locations/{location}/resourceAllowances/{allowance}", handler.GetResourceAllowance).Methods("GET")
+			sub.HandleFunc("/projects/{project}/locations/{location}/resourceAllowances/{allowance}", handler.DeleteResourceAllowance).Methods("DELETE")
+		}
+	}
+
+	v2 := router.PathPrefix("/v2").Subrouter()
+	v2.HandleFunc("/entries:list", handler.ListLogEntries).Methods("POST")
+	v2.HandleFunc("/entries:write", handler.WriteLogEntries).Methods("POST")
+
+	admin := router.PathPrefix("/admin").Subrouter()
+	admin.HandleFunc("/clock/advance", handler.AdvanceClock).Methods("POST")
+	admin.HandleFunc("/snapshot", handler.Snapshot).Methods("GET")
+	admin.HandleFunc("/reset", handler.Reset).Methods("POST")
+	admin.HandleFunc("/jobs", handler.ListAllJobs).Methods("GET")
+	admin.HandleFunc("/stats", handler.Stats).Methods("GET")
+	admin.HandleFunc("/audit", handler.ListAuditEntries).Methods("GET")
+	admin.HandleFunc("/simulator", handler.SimulatorStats).Methods("GET")
+	admin.HandleFunc("/doctor", handler.Doctor).Methods("GET", "POST")
+	admin.HandleFunc("/projects/{project}/locations/{location}/jobs/{job}/priority", handler.SetJobPriority).Methods("POST")
+	admin.HandleFunc("/projects/{project}/locations/{location}/jobs/{job}/state", handler.ForceJobState).Methods("POST")
+	admin.HandleFunc("/pubsub/projects/{project}/topics/{topic}", handler.ListTopicMessages).Methods("GET")
+	admin.HandleFunc("/pubsub/projects/{project}/topics/{topic}", handler.ClearTopicMessages).Methods("DELETE")
+	admin.HandleFunc("/webhooks", handler.ListWebhooks).Methods("GET")
+	admin.HandleFunc("/webhooks", handler.CreateWebhook).Methods("POST")
+	admin.HandleFunc("/webhooks/{id}", handler.DeleteWebhook).Methods("DELETE")
+	admin.HandleFunc("/projects", handler.ListProjects).Methods("GET")
+	admin.HandleFunc("/projects", handler.RegisterProject).Methods("POST")
+	admin.HandleFunc("/projects/{project}", handler.UnregisterProject).Methods("DELETE")
+
+	hooks := router.PathPrefix("/hooks").Subrouter()
+	hooks.HandleFunc("/scheduler/projects/{project}/locations/{location}/jobs", handler.TriggerJob).Methods("POST")
+
 	return router
 }
 
@@ -111,6 +291,62 @@ func TestCreateJob_AutoGenerateID(t *testing.T) {
 	assert.Contains(t, response.Name, "projects/test-project/locations/us-central1/jobs/job-")
 }
 
+func TestCreateJob_ServerDefaults(t *testing.T) {
+	handler := setupTestHandler()
+	router := setupRouter(handler)
+
+	body := `{"taskGroups": [{"taskSpec": {"runnables": [{"script": {"text": "echo hi"}, "timeout": "10.0s"}]}},
+		{"name": "custom", "taskCount": 4, "parallelism": 2, "taskSpec": {"computeResource": {"cpuMilli": 500}, "maxRunDuration": "60.5s"}}],
+		"allocationPolicy": {"instances": [{"machineType": "e2-standard-4"}]}}`
+	req := httptest.NewRequest("POST", "/v1/projects/p/locations/us-central1/jobs?job_id=defaults", bytes.NewBufferString(body))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var job api.Job
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&job))
+
+	first := job.TaskGroups[0]
+	assert.Equal(t, "group0", first.Name)
+	assert.Equal(t, int64(1), first.TaskCount)
+	assert.Equal(t, int64(1), first.Parallelism)
+	assert.Equal(t, int64(1), first.TaskCountPerNode)
+	assert.Equal(t, api.SchedulingPolicyAsSoonAsPossible, first.SchedulingPolicy)
+	assert.Equal(t, &api.ComputeResource{CPUMilli: 2000, MemoryMib: 2000}, first.TaskSpec.ComputeResource)
+	assert.Equal(t, "604800s", first.TaskSpec.MaxRunDuration)
+	assert.Equal(t, "10s", first.TaskSpec.Runnables[0].Timeout)
+
+	// Explicit values are kept.
+	second := job.TaskGroups[1]
+	assert.Equal(t, "custom", second.Name)
+	assert.Equal(t, int64(2), second.Parallelism)
+	assert.Equal(t, int64(500), second.TaskSpec.ComputeResource.CPUMilli)
+	assert.Equal(t, int64(2000), second.TaskSpec.ComputeResource.MemoryMib)
+	assert.Equal(t, "60.500s", second.TaskSpec.MaxRunDuration)
+
+	assert.Equal(t, &api.LogsPolicy{Destination: "CLOUD_LOGGING"}, job.LogsPolicy)
+	assert.Equal(t, []string{"regions/us-central1"}, job.AllocationPolicy.Location.AllowedLocations)
+	// The policy given inline, as earlier versions took it, is moved under
+	// policy.
+	assert.Equal(t, &api.InstancePolicy{MachineType: "e2-standard-4", ProvisioningModel: "STANDARD"}, job.AllocationPolicy.Instances[0].Policy)
+	assert.Equal(t, int64(1), job.Status.TaskGroups["group0"].Counts["PENDING"])
+
+	// Disabled defaults leave the job as submitted.
+	handler = NewHandlerWithConfig(storage.NewMemoryStore(), Config{ServerDefaults: &ServerDefaults{}})
+	router = setupRouter(handler)
+	req = httptest.NewRequest("POST", "/v1/projects/p/locations/us-central1/jobs?job_id=raw", bytes.NewBufferString(body))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	job = api.Job{}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&job))
+	assert.Empty(t, job.TaskGroups[0].Name)
+	assert.Nil(t, job.TaskGroups[0].TaskSpec.ComputeResource)
+	assert.Nil(t, job.LogsPolicy)
+	assert.Nil(t, job.AllocationPolicy.Location)
+}
+
 func TestGetJob(t *testing.T) {
 	handler := setupTestHandler()
 	router := setupRouter(handler)
@@ -137,6 +373,111 @@ func TestGetJob(t *testing.T) {
 	assert.Equal(t, job.UID, response.UID)
 }
 
+func TestLookupJob(t *testing.T) {
+	tokens, err := auth.NewTokens([]*auth.Token{{Token: "ci-token", Name: "ci", Projects: []string{"other"}}})
+	require.NoError(t, err)
+	handler := NewHandlerWithConfig(storage.NewMemoryStore(), Config{Simulator: &stubSimulator{}})
+	router := setupRouter(handler)
+
+	job := &api.Job{Name: "projects/test-project/locations/us-central1/jobs/test-job-123", UID: "test-uid"}
+	require.NoError(t, handler.store.CreateJob(job))
+
+	lookup := func(query, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/v1/jobs:lookup"+query, nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	w := lookup("?uid=test-uid", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var response api.Job
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+	assert.Equal(t, job.Name, response.Name)
+
+	assert.Equal(t, http.StatusNotFound, lookup("?uid=missing", "").Code)
+	assert.Equal(t, http.StatusBadRequest, lookup("", "").Code)
+
+	// Tokens only find the jobs of their projects.
+	handler.auth = tokens
+	assert.Equal(t, http.StatusForbidden, lookup("?uid=test-uid", "ci-token").Code)
+}
+
+func TestListJobs_ByUID(t *testing.T) {
+	handler := setupTestHandler()
+	router := setupRouter(handler)
+
+	for _, job := range []*api.Job{
+		{Name: "projects/test-project/locations/us-central1/jobs/job-1", UID: "uid-1"},
+		{Name: "projects/test-project/locations/us-central1/jobs/job-2", UID: "uid-2"},
+		{Name: "projects/test-project/locations/europe-west1/jobs/job-3", UID: "uid-3"},
+	} {
+		require.NoError(t, handler.store.CreateJob(job))
+	}
+
+	list := func(location, uid string) []string {
+		req := httptest.NewRequest("GET", "/v1/projects/test-project/locations/"+location+"/jobs?uid="+uid, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+		var response api.ListJobsResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+		names := []string{}
+		for _, job := range response.Jobs {
+			names = append(names, job.Name)
+		}
+		return names
+	}
+
+	assert.Equal(t, []string{"projects/test-project/locations/us-central1/jobs/job-2"}, list("us-central1", "uid-2"))
+	assert.Empty(t, list("us-central1", "uid-3"), "the job is in another location")
+	assert.Equal(t, []string{"projects/test-project/locations/europe-west1/jobs/job-3"}, list("-", "uid-3"))
+	assert.Empty(t, list("us-central1", "missing"))
+}
+
+func TestListJobs_AnyLocation(t *testing.T) {
+	handler := setupTestHandler()
+	router := setupRouter(handler)
+
+	for _, name := range []string{
+		"projects/test-project/locations/us-central1/jobs/job-1",
+		"projects/test-project/locations/europe-west1/jobs/job-2",
+		"projects/other-project/locations/us-central1/jobs/job-3",
+	} {
+		require.NoError(t, handler.store.CreateJob(&api.Job{Name: name}))
+	}
+
+	var names []string
+	pageToken := ""
+	for {
+		req := httptest.NewRequest("GET", "/v1/projects/test-project/locations/-/jobs?pageSize=1&pageToken="+pageToken, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+		var response api.ListJobsResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+		for _, job := range response.Jobs {
+			names = append(names, job.Name)
+		}
+		if pageToken = response.NextPageToken; pageToken == "" {
+			break
+		}
+	}
+	assert.Equal(t, []string{
+		"projects/test-project/locations/europe-west1/jobs/job-2",
+		"projects/test-project/locations/us-central1/jobs/job-1",
+	}, names)
+
+	// The wildcard only lists.
+	req := httptest.NewRequest("POST", "/v1/projects/test-project/locations/-/jobs", strings.NewReader(`{"taskGroups": [{"taskCount": 1}]}`))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
 func TestGetJob_NotFound(t *testing.T) {
 	handler := setupTestHandler()
 	router := setupRouter(handler)
@@ -147,6 +488,11 @@ func TestGetJob_NotFound(t *testing.T) {
 	router.ServeHTTP(w, req)
 
 	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	var response api.ErrorResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+	assert.Equal(t, http.StatusNotFound, response.Error.Code)
+	assert.Equal(t, "NOT_FOUND", response.Error.Status)
 }
 
 func TestListJobs(t *testing.T) {
@@ -177,150 +523,2983 @@ func TestListJobs(t *testing.T) {
 	assert.Len(t, response.Jobs, 2)
 }
 
-func TestDeleteJob(t *testing.T) {
+func TestListJobs_Pagination(t *testing.T) {
 	handler := setupTestHandler()
 	router := setupRouter(handler)
+	parent := "projects/test-project/locations/us-central1"
 
-	// Create a job
-	job := &api.Job{
-		Name:  "projects/test-project/locations/us-central1/jobs/test-job-123",
-		State: api.JobStateQueued,
+	for _, id := range []string{"job1", "job2", "job3", "job4", "job5"} {
+		require.NoError(t, handler.store.CreateJob(&api.Job{Name: parent + "/jobs/" + id}))
 	}
-	handler.store.CreateJob(job)
 
-	// Delete the job
-	req := httptest.NewRequest("DELETE", "/v1/projects/test-project/locations/us-central1/jobs/test-job-123", nil)
+	list := func(query string) (int, *api.ListJobsResponse) {
+		req := httptest.NewRequest("GET", "/v1/"+parent+"/jobs"+query, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		var response api.ListJobsResponse
+		json.NewDecoder(w.Body).Decode(&response)
+		return w.Code, &response
+	}
+	names := func(response *api.ListJobsResponse) []string {
+		var result []string
+		for _, job := range response.Jobs {
+			result = append(result, job.Name[len(parent+"/jobs/"):])
+		}
+		return result
+	}
+
+	code, page := list("?pageSize=2")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []string{"job1", "job2"}, names(page))
+	require.NotEmpty(t, page.NextPageToken)
+
+	// Changes made while paging neither duplicate nor skip existing jobs.
+	require.NoError(t, handler.store.CreateJob(&api.Job{Name: parent + "/jobs/job0"}))
+	require.NoError(t, handler.store.CreateJob(&api.Job{Name: parent + "/jobs/job3a"}))
+	require.NoError(t, handler.store.DeleteJob(parent+"/jobs/job4"))
+
+	code, page = list("?pageSize=2&pageToken=" + page.NextPageToken)
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []string{"job3", "job5"}, names(page))
+	assert.Empty(t, page.NextPageToken)
+
+	// Tokens are bound to their parent and become invalid once exhausted.
+	_, page = list("?pageSize=2")
+	code, _ = list("?pageToken=" + page.NextPageToken)
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = list("?pageToken=" + page.NextPageToken)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	_, page = list("?pageSize=2")
+	req := httptest.NewRequest("GET", "/v1/projects/other/locations/us-central1/jobs?pageToken="+page.NextPageToken, nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	code, _ = list("?pageToken=garbage")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = list("?pageSize=-1")
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestCreateJob_GeneratedIDs(t *testing.T) {
+	handler, sim, _ := setupStubHandler()
+	router := setupRouter(handler)
+
+	req := httptest.NewRequest("POST", "/v1/projects/p/locations/us-central1/jobs", bytes.NewBufferString(`{}`))
 	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var job api.Job
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&job))
+	assert.Equal(t, "projects/p/locations/us-central1/jobs/job-id-1", job.Name)
+	assert.Equal(t, "id-2", job.UID)
+	assert.Equal(t, []string{job.Name}, sim.started)
+}
+
+func TestCheckpoint(t *testing.T) {
+	handler, _, _ := setupStubHandler()
+	router := setupRouter(handler)
+
+	running := &api.Job{Name: "projects/p/locations/us-central1/jobs/running", State: api.JobStateRunning}
+	done := &api.Job{Name: "projects/p/locations/us-central1/jobs/done", State: api.JobStateSucceeded}
+	require.NoError(t, handler.store.CreateJob(running))
+	require.NoError(t, handler.store.CreateJob(done))
+	require.NoError(t, handler.store.CreateJob(&api.Job{Name: "projects/p/locations/us-central1/jobs/deleting", State: api.JobStateQueued}))
 
+	req := httptest.NewRequest("DELETE", "/v1/projects/p/locations/us-central1/jobs/deleting", nil)
+	w := httptest.NewRecorder()
 	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	var op api.Operation
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&op))
 
-	assert.Equal(t, http.StatusOK, w.Code)
+	path := filepath.Join(t.TempDir(), "state.json")
+	require.NoError(t, handler.Checkpoint(path))
 
-	// Wait for deletion to complete
-	time.Sleep(3 * time.Second)
+	restarted, sim, fake := setupStubHandler()
+	resumed, err := restarted.Restore(path)
+	require.NoError(t, err)
+	assert.Equal(t, 2, resumed)
+	assert.Equal(t, []string{running.Name}, sim.recovered)
 
-	// Verify job is deleted
-	_, err := handler.store.GetJob(job.Name)
+	job, err := restarted.store.GetJob(done.Name)
+	require.NoError(t, err)
+	assert.Equal(t, api.JobStateSucceeded, job.State)
+
+	// The pending deletion completes its operation.
+	require.Len(t, sim.background, 1)
+	finished := make(chan struct{})
+	go func() {
+		sim.background[0](context.Background())
+		close(finished)
+	}()
+	require.Eventually(t, func() bool { return fake.Waiters() == 1 }, time.Second, time.Millisecond)
+	fake.Advance(restarted.timings.Duration(api.JobStateDeleting))
+	<-finished
+	_, err = restarted.store.GetJob("projects/p/locations/us-central1/jobs/deleting")
 	assert.Error(t, err)
+	stored, err := restarted.store.GetOperation(op.Name)
+	require.NoError(t, err)
+	assert.True(t, stored.Done)
+
+	resumed, err = restarted.Restore(filepath.Join(t.TempDir(), "missing.json"))
+	require.NoError(t, err)
+	assert.Zero(t, resumed)
 }
 
-func TestListTasks(t *testing.T) {
-	handler := setupTestHandler()
-	router := setupRouter(handler)
+func TestRestore_Migrations(t *testing.T) {
+	// A later schema renames the uid of stored jobs.
+	migrations := checkpointMigrations
+	t.Cleanup(func() { checkpointMigrations = migrations })
+	checkpointMigrations = append(migrations[:len(migrations):len(migrations)], func(checkpoint map[string]interface{}) error {
+		store := checkpoint["store"].(map[string]interface{})
+		for _, job := range store["jobs"].([]interface{}) {
+			job := job.(map[string]interface{})
+			job["uid"] = "migrated-" + job["uid"].(string)
+		}
+		return nil
+	})
+
+	path := filepath.Join(t.TempDir(), "state.json")
+	original := `{"store": {"jobs": [{"name": "projects/p/locations/l/jobs/j", "uid": "1", "state": "SUCCEEDED"}], "tasks": {}}}`
+	require.NoError(t, os.WriteFile(path, []byte(original), 0o600))
+
+	handler, _, _ := setupStubHandler()
+	_, err := handler.Restore(path)
+	require.NoError(t, err)
+	job, err := handler.store.GetJob("projects/p/locations/l/jobs/j")
+	require.NoError(t, err)
+	assert.Equal(t, "migrated-1", job.UID)
 
-	// Create a job with tasks
-	job := &api.Job{
-		Name: "projects/test-project/locations/us-central1/jobs/test-job-123",
-		TaskGroups: []*api.TaskGroup{
-			{Name: "group1", TaskCount: 3},
-		},
+	// The migrated checkpoint replaces the original, which is kept aside.
+	backup, err := os.ReadFile(path + ".v0")
+	require.NoError(t, err)
+	assert.Equal(t, original, string(backup))
+	var migrated Checkpoint
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(data, &migrated))
+	assert.Equal(t, 2, migrated.SchemaVersion)
+
+	// Checkpoints of newer servers are refused.
+	require.NoError(t, os.WriteFile(path, []byte(`{"schemaVersion": 3, "store": {}}`), 0o600))
+	_, err = handler.Restore(path)
+	assert.ErrorContains(t, err, "newer")
+}
+
+func TestCreateJob_JobIDAndRequestID(t *testing.T) {
+	handler, sim, fake := setupStubHandler()
+	router := setupRouter(handler)
+	parent := "/v1/projects/p/locations/us-central1/jobs"
+	body := `{"taskGroups": [{"taskSpec": {"runnables": [{"script": {"text": "true"}}]}}]}`
+
+	create := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", parent+query, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
 	}
-	handler.store.CreateJob(job)
 
-	// List tasks
-	req := httptest.NewRequest("GET", "/v1/projects/test-project/locations/us-central1/jobs/test-job-123/tasks", nil)
-	w := httptest.NewRecorder()
+	w := create("?jobId=camel")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var job api.Job
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&job))
+	assert.Equal(t, "projects/p/locations/us-central1/jobs/camel", job.Name)
+
+	assert.Equal(t, http.StatusBadRequest, create("?jobId=a&job_id=b").Code)
+	assert.Equal(t, http.StatusBadRequest, create("?requestId=not-a-uuid").Code)
+	assert.Equal(t, http.StatusBadRequest, create("?requestId=00000000-0000-0000-0000-000000000000").Code)
+
+	// Retrying with the same requestId returns the original job.
+	requestID := "8c1d1b2e-5f4a-4a5b-9c3d-2e1f0a9b8c7d"
+	w = create("?jobId=idempotent&requestId=" + requestID)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var first api.Job
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&first))
+
+	w = create("?jobId=idempotent&requestId=" + requestID)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var retried api.Job
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&retried))
+	assert.Equal(t, first.UID, retried.UID)
+	assert.Len(t, sim.started, 2)
+
+	// Without the requestId the same job ID conflicts.
+	assert.Equal(t, http.StatusConflict, create("?jobId=idempotent").Code)
+
+	// A generated job ID is returned as well.
+	other := "0f6e3c7a-1b2d-4e5f-8a9b-c0d1e2f3a4b5"
+	w = create("?request_id=" + other)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&first))
+	w = create("?requestId=" + other)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&retried))
+	assert.Equal(t, first.Name, retried.Name)
+	assert.Len(t, sim.started, 3)
+
+	// RequestIds are forgotten after an hour.
+	fake.Advance(time.Hour)
+	assert.Equal(t, http.StatusConflict, create("?jobId=idempotent&requestId="+requestID).Code)
+}
+
+// constantIDs generates the same ID every time.
+type constantIDs struct{}
+
+func (constantIDs) NewID() string {
+	return "same"
+}
+
+func TestCreateJob_GeneratedIDCollision(t *testing.T) {
+	handler, _, _ := setupStubHandler()
+	router := setupRouter(handler)
+	parent := "projects/p/locations/us-central1"
+	require.NoError(t, handler.store.CreateJob(&api.Job{Name: parent + "/jobs/job-id-1"}))
 
+	req := httptest.NewRequest("POST", "/v1/"+parent+"/jobs", strings.NewReader(`{}`))
+	w := httptest.NewRecorder()
 	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var job api.Job
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&job))
+	assert.Equal(t, parent+"/jobs/job-id-3", job.Name)
+
+	// A generator that never yields a free ID gives up eventually.
+	handler = NewHandler(storage.NewMemoryStore(), WithSimulator(&stubSimulator{}), WithIDGenerator(constantIDs{}))
+	router = setupRouter(handler)
+	for _, want := range []int{http.StatusOK, http.StatusConflict} {
+		req := httptest.NewRequest("POST", "/v1/"+parent+"/jobs", strings.NewReader(`{}`))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, want, w.Code, w.Body.String())
+	}
+}
 
-	assert.Equal(t, http.StatusOK, w.Code)
+func TestCreateJob_ValidateOnly(t *testing.T) {
+	handler, sim, _ := setupStubHandler()
+	router := setupRouter(handler)
+	parent := "/v1/projects/p/locations/us-central1/jobs"
 
-	var response api.ListTasksResponse
-	json.NewDecoder(w.Body).Decode(&response)
-	assert.Len(t, response.Tasks, 3)
+	create := func(query, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", parent+query, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := create("?jobId=dry&validateOnly=true", `{"taskGroups": [{"taskCount": 2, "taskSpec": {"runnables": [{"script": {"text": "true"}}]}}]}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var job api.Job
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&job))
+	assert.Equal(t, "projects/p/locations/us-central1/jobs/dry", job.Name)
+	assert.Equal(t, api.JobStateQueued, job.State)
+	assert.Equal(t, "group0", job.TaskGroups[0].Name)
+	assert.Equal(t, int64(2), job.Status.TaskGroups["group0"].Counts["PENDING"])
+	assert.Empty(t, job.UID)
+
+	// Nothing was stored or started.
+	_, err := handler.store.GetJob(job.Name)
+	assert.Error(t, err)
+	assert.Empty(t, sim.started)
+
+	// Validation errors are reported as for a real creation.
+	w = create("?validate_only=true", `{"taskGroups": [{"taskSpec": {"maxRunDuration": "1h"}}]}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = create("?validateOnly=maybe", `{}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// So is a taken job ID.
+	require.Equal(t, http.StatusOK, create("?jobId=dry", `{}`).Code)
+	w = create("?jobId=dry&validateOnly=true", `{}`)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Len(t, sim.started, 1)
 }
 
-func TestGetTask(t *testing.T) {
-	handler := setupTestHandler()
+func TestCreateJob_InvalidDurations(t *testing.T) {
+	handler := NewHandler(storage.NewMemoryStore(), WithSimulator(&stubSimulator{}))
 	router := setupRouter(handler)
 
-	// Create a job with tasks
-	job := &api.Job{
-		Name: "projects/test-project/locations/us-central1/jobs/test-job-123",
-		TaskGroups: []*api.TaskGroup{
-			{Name: "group1", TaskCount: 1},
-		},
+	for _, body := range []string{
+		`{"taskGroups": [{"taskSpec": {"maxRunDuration": "1h", "runnables": [{"script": {"text": "true"}}]}}]}`,
+		`{"taskGroups": [{"taskSpec": {"runnables": [{"script": {"text": "true"}, "timeout": "-5s"}]}}]}`,
+	} {
+		req := httptest.NewRequest("POST", "/v1/projects/p/locations/us-central1/jobs", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code, body)
 	}
-	handler.store.CreateJob(job)
+}
 
-	// Get the task list to find task name
-	tasks, _ := handler.store.ListTasks(job.Name)
-	require.Len(t, tasks, 1)
+func TestCreateJob_TaskCountLimit(t *testing.T) {
+	handler := NewHandler(storage.NewMemoryStore(), WithSimulator(&stubSimulator{}), WithMaxTaskCount(10))
+	router := setupRouter(handler)
 
-	// Get specific task
-	taskID := tasks[0].Name[len(job.Name+"/tasks/"):]
-	req := httptest.NewRequest("GET", "/v1/projects/test-project/locations/us-central1/jobs/test-job-123/tasks/"+taskID, nil)
+	body := `{"taskGroups": [{"taskCount": 10}, {"taskCount": 11}]}`
+	req := httptest.NewRequest("POST", "/v1/projects/p/locations/us-central1/jobs", bytes.NewBufferString(body))
 	w := httptest.NewRecorder()
-
 	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	var response api.ErrorResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+	assert.Equal(t, "Invalid value for field 'taskGroups[1].taskCount': '11'. Task count must be between 1 and 10.", response.Error.Message)
+	assert.Equal(t, "INVALID_ARGUMENT", response.Error.Status)
 
+	req = httptest.NewRequest("POST", "/v1/projects/p/locations/us-central1/jobs", bytes.NewBufferString(`{"taskGroups": [{"taskCount": 10}]}`))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
 	assert.Equal(t, http.StatusOK, w.Code)
 
-	var response api.Task
-	json.NewDecoder(w.Body).Decode(&response)
-	assert.Equal(t, tasks[0].Name, response.Name)
+	// The production limit applies by default
+	assert.Equal(t, int64(DefaultMaxTaskCount), NewHandler(storage.NewMemoryStore(), WithSimulator(&stubSimulator{})).maxTaskCount)
 }
 
-func TestJobStateTransitions(t *testing.T) {
-	handler := setupTestHandler()
+func TestDeadlines(t *testing.T) {
+	handler, _, _ := setupStubHandler()
 	router := setupRouter(handler)
+	require.NoError(t, handler.store.CreateJob(&api.Job{Name: "projects/p/locations/us-central1/jobs/job"}))
 
-	// Create a job
-	jobRequest := api.Job{
-		TaskGroups: []*api.TaskGroup{
-			{Name: "group1", TaskSpec: &api.TaskSpec{}, TaskCount: 1},
-		},
+	decodeError := func(w *httptest.ResponseRecorder) *api.Status {
+		var response api.ErrorResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+		return response.Error
 	}
 
-	body, _ := json.Marshal(jobRequest)
-	req := httptest.NewRequest("POST", "/v1/projects/test-project/locations/us-central1/jobs?job_id=transition-test", bytes.NewBuffer(body))
-	req.Header.Set("Content-Type", "application/json")
+	req := httptest.NewRequest("GET", "/v1/projects/p/locations/us-central1/jobs/job", nil)
+	req.Header.Set("X-Server-Timeout", "30")
 	w := httptest.NewRecorder()
-
 	router.ServeHTTP(w, req)
 	assert.Equal(t, http.StatusOK, w.Code)
 
-	// Check initial state
-	req = httptest.NewRequest("GET", "/v1/projects/test-project/locations/us-central1/jobs/transition-test", nil)
+	req.Header.Set("X-Server-Timeout", "soon")
 	w = httptest.NewRecorder()
 	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
 
-	var job api.Job
-	json.NewDecoder(w.Body).Decode(&job)
-	assert.Equal(t, api.JobStateQueued, job.State)
-
-	// Wait for state transition to RUNNING
-	time.Sleep(3 * time.Second)
+	// A request past its deadline fails its store lookups and reports it.
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	req = httptest.NewRequest("GET", "/v1/projects/p/locations/us-central1/jobs/job", nil).WithContext(ctx)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+	assert.Equal(t, "DEADLINE_EXCEEDED", decodeError(w).Status)
 
-	req = httptest.NewRequest("GET", "/v1/projects/test-project/locations/us-central1/jobs/transition-test", nil)
+	// So does one the client gave up on, including filtered log listings.
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	req = httptest.NewRequest("POST", "/v2/entries:list", bytes.NewBufferString(`{"filter": "severity>=INFO"}`)).WithContext(ctx)
 	w = httptest.NewRecorder()
 	router.ServeHTTP(w, req)
+	assert.Equal(t, statusClientClosedRequest, w.Code)
+	assert.Equal(t, "CANCELLED", decodeError(w).Status)
+}
 
-	json.NewDecoder(w.Body).Decode(&job)
-	assert.Equal(t, api.JobStateRunning, job.State)
+func TestSeed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "seed.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+jobs:
+  - name: projects/p/locations/us-central1/jobs/nightly-1
+    state: FAILED
+    createTime: 2023-06-01T02:00:00Z
+    taskGroups:
+      - taskCount: 2
+    status:
+      statusEvents:
+        - type: job_failed
+          description: Job failed
+          eventTime: 2023-06-01T02:10:00Z
+    tasks:
+      - name: taskGroups/group0/tasks/0
+        status:
+          state: SUCCEEDED
+  - name: projects/p/locations/us-central1/jobs/nightly-2
+    state: RUNNING
+    taskGroups:
+      - taskCount: 1
+  - name: projects/q/locations/us-central1/jobs/report
+`), 0o644))
+
+	jobs, err := LoadSeed(path)
+	require.NoError(t, err)
+	require.Len(t, jobs, 3)
 
-	// Wait for completion
-	time.Sleep(6 * time.Second)
+	handler, sim, fake := setupStubHandler()
+	seeded, err := handler.Seed(jobs)
+	require.NoError(t, err)
+	assert.Equal(t, 3, seeded)
 
-	req = httptest.NewRequest("GET", "/v1/projects/test-project/locations/us-central1/jobs/transition-test", nil)
-	w = httptest.NewRecorder()
-	router.ServeHTTP(w, req)
+	failed, err := handler.store.GetJob("projects/p/locations/us-central1/jobs/nightly-1")
+	require.NoError(t, err)
+	assert.Equal(t, api.JobStateFailed, failed.Status.State)
+	assert.Equal(t, time.Date(2023, 6, 1, 2, 0, 0, 0, time.UTC), failed.CreateTime)
+	assert.Equal(t, "job_failed", failed.Status.StatusEvents[0].Type)
+	assert.Equal(t, map[string]int64{"SUCCEEDED": 1, "FAILED": 1}, failed.Status.TaskGroups["group0"].Counts)
 
-	json.NewDecoder(w.Body).Decode(&job)
-	assert.Equal(t, api.JobStateSucceeded, job.State)
-	assert.NotEmpty(t, job.Status.RunDuration)
+	report, err := handler.store.GetJob("projects/q/locations/us-central1/jobs/report")
+	require.NoError(t, err)
+	assert.Equal(t, api.JobStateSucceeded, report.State)
+	assert.Equal(t, fake.Now(), report.CreateTime)
+	assert.NotEmpty(t, report.UID)
+
+	// Unfinished jobs carry on from their seeded state.
+	assert.Equal(t, []string{"projects/p/locations/us-central1/jobs/nightly-2"}, sim.resumed)
+
+	// Seeding again leaves existing jobs alone.
+	seeded, err = handler.Seed(jobs)
+	require.NoError(t, err)
+	assert.Zero(t, seeded)
+
+	_, err = handler.Seed([]*SeedJob{{Job: api.Job{Name: "nightly-3"}}})
+	assert.Error(t, err)
 }
 
-func TestInvalidRequest(t *testing.T) {
-	handler := setupTestHandler()
+func TestDeleteJob(t *testing.T) {
+	handler, sim, fake := setupStubHandler()
 	router := setupRouter(handler)
 
-	// Test with invalid JSON
-	req := httptest.NewRequest("POST", "/v1/projects/test-project/locations/us-central1/jobs", bytes.NewBufferString("invalid json"))
-	req.Header.Set("Content-Type", "application/json")
+	// Create a job
+	job := &api.Job{
+		Name:  "projects/test-project/locations/us-central1/jobs/test-job-123",
+		State: api.JobStateQueued,
+	}
+	handler.store.CreateJob(job)
+
+	// Delete the job
+	req := httptest.NewRequest("DELETE", "/v1/projects/test-project/locations/us-central1/jobs/test-job-123", nil)
 	w := httptest.NewRecorder()
 
 	router.ServeHTTP(w, req)
 
-	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var op api.Operation
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&op))
+	assert.False(t, op.Done)
+	assert.Equal(t, job.Name, op.Metadata.Target)
+	assert.Equal(t, []string{job.Name}, sim.stopped)
+
+	// Run the deletion and let it complete
+	require.Len(t, sim.background, 1)
+	done := make(chan struct{})
+	go func() {
+		sim.background[0](context.Background())
+		close(done)
+	}()
+	require.Eventually(t, func() bool { return fake.Waiters() == 1 }, time.Second, time.Millisecond)
+	fake.Advance(handler.timings.Duration(api.JobStateDeleting))
+	<-done
+
+	// Verify job is deleted
+	_, err := handler.store.GetJob(job.Name)
+	assert.Error(t, err)
+
+	// Verify the operation completed
+	req = httptest.NewRequest("GET", "/v1/"+op.Name, nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&op))
+	assert.True(t, op.Done)
+	assert.Nil(t, op.Error)
+}
+
+func TestRetention(t *testing.T) {
+	fake := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	archive := t.TempDir()
+	handler := NewHandler(storage.NewMemoryStoreWithClock(fake),
+		WithClock(fake),
+		WithSimulator(&stubSimulator{}),
+		WithRetention(Retention{TTL: time.Hour, MaxFinishedJobs: 2, ArchiveDir: archive}),
+	)
+	defer handler.Close()
+
+	finished := func(name string, state api.JobState, age time.Duration) {
+		require.NoError(t, handler.store.CreateJob(&api.Job{
+			Name:  "projects/p/locations/l/jobs/" + name,
+			State: state,
+			Status: &api.JobStatus{State: state, StatusEvents: []*api.StatusEvent{
+				{Type: "job_completed", EventTime: fake.Now().Add(-age)},
+			}},
+			TaskGroups: []*api.TaskGroup{{Name: "group0", TaskCount: 1}},
+		}))
+	}
+	finished("expired", api.JobStateSucceeded, 2*time.Hour)
+	finished("oldest", api.JobStateFailed, 30*time.Minute)
+	finished("older", api.JobStateSucceeded, 20*time.Minute)
+	finished("newest", api.JobStateCancelled, 10*time.Minute)
+	require.NoError(t, handler.store.CreateJob(&api.Job{Name: "projects/p/locations/l/jobs/running", State: api.JobStateRunning}))
+
+	// The reaper runs every minute.
+	require.Eventually(t, func() bool { return fake.Waiters() == 1 }, time.Second, time.Millisecond)
+	fake.Advance(time.Minute)
+	require.Eventually(t, func() bool {
+		jobs, _ := handler.store.ListJobs("p", "l")
+		return len(jobs) == 3
+	}, time.Second, time.Millisecond)
+	for _, name := range []string{"older", "newest", "running"} {
+		_, err := handler.store.GetJob("projects/p/locations/l/jobs/" + name)
+		assert.NoError(t, err, name)
+	}
+
+	// Removed jobs are archived with their tasks.
+	data, err := os.ReadFile(filepath.Join(archive, "projects/p/locations/l/jobs/expired.json"))
+	require.NoError(t, err)
+	var snapshot storage.Snapshot
+	require.NoError(t, json.Unmarshal(data, &snapshot))
+	require.Len(t, snapshot.Jobs, 1)
+	assert.Equal(t, api.JobStateSucceeded, snapshot.Jobs[0].State)
+	assert.Len(t, snapshot.Tasks["projects/p/locations/l/jobs/expired"], 1)
+	assert.FileExists(t, filepath.Join(archive, "projects/p/locations/l/jobs/oldest.json"))
+
+	// Jobs expire as time goes by.
+	require.Eventually(t, func() bool { return fake.Waiters() == 1 }, time.Second, time.Millisecond)
+	fake.Advance(time.Hour)
+	require.Eventually(t, func() bool {
+		jobs, _ := handler.store.ListJobs("p", "l")
+		return len(jobs) == 1
+	}, time.Second, time.Millisecond)
+	assert.Zero(t, handler.reap())
+}
+
+func TestV1Alpha_CancelJob(t *testing.T) {
+	handler, sim, fake := setupStubHandler()
+	router := setupRouter(handler)
+
+	body := `{"taskGroups": [{"taskCount": 2, "taskSpec": {"runnables": [{"script": {"text": "true"}}]}}]}`
+	req := httptest.NewRequest("POST", "/v1alpha/projects/p/locations/us-central1/jobs?job_id=alpha", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	jobName := "projects/p/locations/us-central1/jobs/alpha"
+
+	// Cancellation is an alpha-only method.
+	req = httptest.NewRequest("POST", "/v1/"+jobName+":cancel", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.NotEqual(t, http.StatusOK, w.Code)
+
+	req = httptest.NewRequest("POST", "/v1alpha/"+jobName+":cancel", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var op api.Operation
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&op))
+	assert.False(t, op.Done)
+	assert.Equal(t, "cancel", op.Metadata.Verb)
+	assert.Equal(t, "v1alpha", op.Metadata.APIVersion)
+	assert.Equal(t, "type.googleapis.com/google.cloud.batch.v1alpha.OperationMetadata", op.Metadata.Type)
+	assert.Equal(t, []string{jobName}, sim.stopped)
+
+	job, err := handler.store.GetJob(jobName)
+	require.NoError(t, err)
+	assert.Equal(t, api.JobStateCancellationInProgress, job.State)
+
+	// A job already being cancelled cannot be cancelled again.
+	req = httptest.NewRequest("POST", "/v1alpha/"+jobName+":cancel", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	require.Len(t, sim.background, 1)
+	done := make(chan struct{})
+	go func() {
+		sim.background[0](context.Background())
+		close(done)
+	}()
+	require.Eventually(t, func() bool { return fake.Waiters() == 1 }, time.Second, time.Millisecond)
+	fake.Advance(handler.timings.Duration(api.JobStateCancellationInProgress))
+	<-done
+
+	req = httptest.NewRequest("GET", "/v1alpha/"+jobName, nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&job))
+	assert.Equal(t, api.JobStateCancelled, job.State)
+	assert.Equal(t, int64(2), job.Status.TaskGroups["group0"].Counts["FAILED"])
+	assert.Equal(t, "job_cancelled", job.Status.StatusEvents[len(job.Status.StatusEvents)-1].Type)
+
+	req = httptest.NewRequest("GET", "/v1alpha/"+op.Name, nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&op))
+	assert.True(t, op.Done)
+	assert.Nil(t, op.Error)
+	assert.Equal(t, cancelJobResponseType, op.Response["@type"])
+}
+
+func TestV1Alpha_ResourceAllowances(t *testing.T) {
+	handler, _, _ := setupStubHandler()
+	router := setupRouter(handler)
+	parent := "/v1alpha/projects/p/locations/us-central1/resourceAllowances"
+
+	body := `{"usageResourceAllowance": {"spec": {"type": "cpu-core-hours", "limit": {"calendarPeriod": "MONTH", "limit": 100}}}}`
+	req := httptest.NewRequest("POST", parent+"?resource_allowance_id=monthly", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var allowance api.ResourceAllowance
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&allowance))
+	assert.Equal(t, "projects/p/locations/us-central1/resourceAllowances/monthly", allowance.Name)
+	assert.Equal(t, "RESOURCE_ALLOWANCE_ACTIVE", allowance.UsageResourceAllowance.Status.State)
+
+	req = httptest.NewRequest("POST", parent+"?resource_allowance_id=monthly", strings.NewReader(body))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	req = httptest.NewRequest("POST", parent, strings.NewReader(`{"usageResourceAllowance": {"spec": {"type": "cpu-core-hours", "limit": {"calendarPeriod": "DECADE", "limit": 1}}}}`))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	req = httptest.NewRequest("GET", parent, nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	var list api.ListResourceAllowancesResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&list))
+	require.Len(t, list.ResourceAllowances, 1)
+	assert.Equal(t, allowance.Name, list.ResourceAllowances[0].Name)
+
+	req = httptest.NewRequest("DELETE", "/v1alpha/"+allowance.Name, nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	var op api.Operation
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&op))
+	assert.True(t, op.Done)
+
+	req = httptest.NewRequest("GET", "/v1alpha/"+allowance.Name, nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// Resource allowances are not part of v1.
+	req = httptest.NewRequest("GET", "/v1/projects/p/locations/us-central1/resourceAllowances", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestGetJob_ETag(t *testing.T) {
+	handler, _, _ := setupStubHandler()
+	router := setupRouter(handler)
+	job := &api.Job{
+		Name:       "projects/p/locations/us-central1/jobs/polled",
+		State:      api.JobStateQueued,
+		TaskGroups: []*api.TaskGroup{{Name: "group0", TaskCount: 2}},
+	}
+	require.NoError(t, handler.store.CreateJob(job))
+
+	get := func(path, ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, path := range []string{"/v1/" + job.Name, "/v1/" + job.Name + "/tasks"} {
+		w := get(path, "")
+		require.Equal(t, http.StatusOK, w.Code)
+		etag := w.Header().Get("ETag")
+		require.NotEmpty(t, etag, path)
+
+		w = get(path, etag)
+		assert.Equal(t, http.StatusNotModified, w.Code, path)
+		assert.Empty(t, w.Body.String())
+		assert.Equal(t, etag, w.Header().Get("ETag"))
+
+		w = get(path, `"other", W/`+etag)
+		assert.Equal(t, http.StatusNotModified, w.Code, path)
+
+		w = get(path, `"other"`)
+		assert.Equal(t, http.StatusOK, w.Code, path)
+	}
+
+	// A change to the job changes its ETag.
+	w := get("/v1/"+job.Name, "")
+	etag := w.Header().Get("ETag")
+	job.State = api.JobStateRunning
+	require.NoError(t, handler.store.UpdateJob(job))
+	w = get("/v1/"+job.Name, etag)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotEqual(t, etag, w.Header().Get("ETag"))
+}
+
+func TestListTasks(t *testing.T) {
+	handler := setupTestHandler()
+	router := setupRouter(handler)
+
+	// Create a job with tasks
+	job := &api.Job{
+		Name: "projects/test-project/locations/us-central1/jobs/test-job-123",
+		TaskGroups: []*api.TaskGroup{
+			{Name: "group1", TaskCount: 3},
+		},
+	}
+	handler.store.CreateJob(job)
+
+	// List tasks
+	req := httptest.NewRequest("GET", "/v1/projects/test-project/locations/us-central1/jobs/test-job-123/tasks", nil)
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var response api.ListTasksResponse
+	json.NewDecoder(w.Body).Decode(&response)
+	assert.Len(t, response.Tasks, 3)
+}
+
+func TestListTasks_Pagination(t *testing.T) {
+	handler := setupTestHandler()
+	router := setupRouter(handler)
+
+	jobName := "projects/test-project/locations/us-central1/jobs/many-tasks"
+	require.NoError(t, handler.store.CreateJob(&api.Job{
+		Name:       jobName,
+		TaskGroups: []*api.TaskGroup{{Name: "group1", TaskCount: 12}},
+	}))
+
+	var indexes []string
+	token := ""
+	for {
+		req := httptest.NewRequest("GET", "/v1/"+jobName+"/tasks?pageSize=5&pageToken="+token, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var response api.ListTasksResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+		assert.LessOrEqual(t, len(response.Tasks), 5)
+		for _, task := range response.Tasks {
+			indexes = append(indexes, task.Name[len(jobName+"/taskGroups/group1/tasks/"):])
+		}
+
+		if token = response.NextPageToken; token == "" {
+			break
+		}
+	}
+
+	// Tasks are ordered numerically by index.
+	assert.Equal(t, []string{"0", "1", "2", "3", "4", "5", "6", "7", "8", "9", "10", "11"}, indexes)
+}
+
+func TestListTasks_Streamed(t *testing.T) {
+	handler := setupTestHandler()
+	router := setupRouter(handler)
+
+	jobName := "projects/test-project/locations/us-central1/jobs/streamed"
+	require.NoError(t, handler.store.CreateJob(&api.Job{
+		Name: jobName,
+		TaskGroups: []*api.TaskGroup{
+			{Name: "group0", TaskCount: 900},
+			{Name: "group1", TaskCount: 900},
+			{Name: "group2", TaskCount: 900},
+		},
+	}))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/v1/"+jobName+"/tasks", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get("ETag"))
+	assert.True(t, strings.HasPrefix(w.Body.String(), `{"tasks":[{`))
+
+	var response api.ListTasksResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+	require.Len(t, response.Tasks, 2700)
+	assert.Equal(t, jobName+"/taskGroups/group0/tasks/0", response.Tasks[0].Name)
+	assert.Equal(t, jobName+"/taskGroups/group2/tasks/899", response.Tasks[2699].Name)
+	assert.NotEmpty(t, response.Tasks[0].Environment.Variables["BATCH_TASK_INDEX"])
+	assert.Empty(t, response.NextPageToken)
+
+	// Pages are not streamed.
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/v1/"+jobName+"/tasks?pageSize=1000", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.NotEmpty(t, w.Header().Get("ETag"))
+}
+
+func TestGetTask(t *testing.T) {
+	handler := setupTestHandler()
+	router := setupRouter(handler)
+
+	// Create a job with tasks
+	job := &api.Job{
+		Name: "projects/test-project/locations/us-central1/jobs/test-job-123",
+		TaskGroups: []*api.TaskGroup{
+			{Name: "group1", TaskCount: 1},
+		},
+	}
+	handler.store.CreateJob(job)
+
+	// Get the task list to find task name
+	tasks, _ := handler.store.ListTasks(job.Name)
+	require.Len(t, tasks, 1)
+
+	// Get specific task
+	req := httptest.NewRequest("GET", "/v1/"+tasks[0].Name, nil)
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var response api.Task
+	json.NewDecoder(w.Body).Decode(&response)
+	assert.Equal(t, tasks[0].Name, response.Name)
+	require.NotNil(t, response.Environment)
+	assert.Equal(t, "test-job-123", response.Environment.Variables["BATCH_JOB_ID"])
+	assert.Equal(t, "0", response.Environment.Variables["BATCH_TASK_INDEX"])
+	assert.Equal(t, "1", response.Environment.Variables["BATCH_TASK_COUNT"])
+	assert.Nil(t, tasks[0].Environment, "the stored task is left alone")
+}
+
+func TestJobStateTransitions(t *testing.T) {
+	handler, _ := setupFakeClockHandler()
+	router := setupRouter(handler)
+
+	// Create a job
+	jobRequest := api.Job{
+		TaskGroups: []*api.TaskGroup{
+			{Name: "group1", TaskSpec: &api.TaskSpec{}, TaskCount: 1},
+		},
+	}
+
+	body, _ := json.Marshal(jobRequest)
+	req := httptest.NewRequest("POST", "/v1/projects/test-project/locations/us-central1/jobs?job_id=transition-test", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	getJob := func() api.Job {
+		req := httptest.NewRequest("GET", "/v1/projects/test-project/locations/us-central1/jobs/transition-test", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		var job api.Job
+		json.NewDecoder(w.Body).Decode(&job)
+		return job
+	}
+	advance := func(d string) {
+		req := httptest.NewRequest("POST", "/admin/clock/advance?duration="+d, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+
+	// Check initial state
+	assert.Equal(t, api.JobStateQueued, getJob().State)
+
+	// Advance to the state transition to RUNNING
+	advance("2s")
+	assert.Eventually(t, func() bool {
+		return getJob().State == api.JobStateRunning
+	}, time.Second, time.Millisecond)
+
+	// Advance to completion
+	advance("5s")
+	assert.Eventually(t, func() bool {
+		return getJob().State == api.JobStateSucceeded
+	}, time.Second, time.Millisecond)
+	assert.NotEmpty(t, getJob().Status.RunDuration)
+}
+
+func TestAdvanceClock(t *testing.T) {
+	handler, fake := setupFakeClockHandler()
+	router := setupRouter(handler)
+	start := fake.Now()
+
+	req := httptest.NewRequest("POST", "/admin/clock/advance?duration=90s", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	var response AdvanceClockResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+	assert.Equal(t, start.Add(90*time.Second), response.Now)
+
+	// Invalid durations are rejected
+	req = httptest.NewRequest("POST", "/admin/clock/advance?duration=soon", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// The wall clock cannot be advanced
+	router = setupRouter(setupTestHandler())
+	req = httptest.NewRequest("POST", "/admin/clock/advance?duration=1s", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestSimulatorStats(t *testing.T) {
+	handler, _ := setupFakeClockHandler()
+	router := setupRouter(handler)
+	defer handler.Close()
+
+	stats := func() simulation.Stats {
+		req := httptest.NewRequest("GET", "/admin/simulator", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var response simulation.Stats
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+		return response
+	}
+
+	body, _ := json.Marshal(api.Job{TaskGroups: []*api.TaskGroup{{Name: "group1", TaskCount: 1}}})
+	req := httptest.NewRequest("POST", "/v1/projects/p/locations/l/jobs?job_id=job1", bytes.NewBuffer(body))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 1, stats().Runners)
+
+	// Deleting the job stops its simulation and leaves only the pending
+	// deletion running.
+	req = httptest.NewRequest("DELETE", "/v1/projects/p/locations/l/jobs/job1", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	current := stats()
+	assert.Equal(t, 0, current.Runners)
+	assert.Equal(t, 1, current.Background)
+	assert.Positive(t, current.Goroutines)
+
+	handler.Close()
+	assert.Equal(t, 0, stats().Background)
+}
+
+func TestDoctor(t *testing.T) {
+	handler := setupTestHandler()
+	router := setupRouter(handler)
+
+	job := &api.Job{
+		Name:       "projects/p/locations/l/jobs/drifted",
+		State:      api.JobStateSucceeded,
+		TaskGroups: []*api.TaskGroup{{Name: "group1", TaskCount: 1}},
+		Status:     &api.JobStatus{State: api.JobStateSucceeded},
+	}
+	require.NoError(t, handler.store.CreateJob(job))
+
+	doctorReport := func(method, query string) (int, *doctor.Report) {
+		req := httptest.NewRequest(method, "/admin/doctor"+query, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		var report doctor.Report
+		json.NewDecoder(w.Body).Decode(&report)
+		return w.Code, &report
+	}
+
+	code, report := doctorReport("GET", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Len(t, report.Findings, 2)
+
+	code, _ = doctorReport("GET", "?repair=true")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = doctorReport("GET", "?deleting_threshold=soon")
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, report = doctorReport("POST", "?repair=true")
+	assert.Equal(t, http.StatusOK, code)
+	require.Len(t, report.Findings, 2)
+	for _, finding := range report.Findings {
+		assert.True(t, finding.Repaired)
+	}
+
+	_, report = doctorReport("GET", "")
+	assert.Empty(t, report.Findings)
+}
+
+func TestInvalidRequest(t *testing.T) {
+	handler := setupTestHandler()
+	router := setupRouter(handler)
+
+	// Test with invalid JSON
+	req := httptest.NewRequest("POST", "/v1/projects/test-project/locations/us-central1/jobs", bytes.NewBufferString("invalid json"))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestTriggerJob(t *testing.T) {
+	handler := setupTestHandler()
+	router := setupRouter(handler)
+
+	template := `{
+		"labels": {"scheduled-at": "{{.ScheduleTime.Unix}}", "scheduler": "{{.SchedulerJob}}"},
+		"taskGroups": [{"name": "group1", "taskSpec": {}, "taskCount": 1}]
+	}`
+
+	for _, scheduleTime := range []string{"2024-01-01T00:00:00Z", "2024-01-01T01:00:00Z"} {
+		req := httptest.NewRequest("POST", "/hooks/scheduler/projects/test-project/locations/us-central1/jobs?job_id=nightly-{{.ScheduleTime.Unix}}", bytes.NewBufferString(template))
+		req.Header.Set("X-CloudScheduler-JobName", "nightly")
+		req.Header.Set("X-CloudScheduler-ScheduleTime", scheduleTime)
+		w := httptest.NewRecorder()
+
+		router.ServeHTTP(w, req)
+
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+
+	job, err := handler.store.GetJob("projects/test-project/locations/us-central1/jobs/nightly-1704067200")
+	require.NoError(t, err)
+	assert.Equal(t, "1704067200", job.Labels["scheduled-at"])
+	assert.Equal(t, "nightly", job.Labels["scheduler"])
+
+	jobs, err := handler.store.ListJobs("test-project", "us-central1")
+	require.NoError(t, err)
+	assert.Len(t, jobs, 2)
+}
+
+func TestTriggerJob_InvalidTemplate(t *testing.T) {
+	handler := setupTestHandler()
+	router := setupRouter(handler)
+
+	req := httptest.NewRequest("POST", "/hooks/scheduler/projects/test-project/locations/us-central1/jobs", bytes.NewBufferString(`{"labels": {"a": "{{.Missing}}"}}`))
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestSetJobPriority(t *testing.T) {
+	handler, fake := setupFakeClockHandler()
+	router := setupRouter(handler)
+
+	job := &api.Job{TaskGroups: []*api.TaskGroup{{Name: "group1", TaskCount: 1}}}
+	require.NoError(t, handler.submitJob(context.Background(), "test-project", "us-central1", "boost", job, &simulation.Plan{}))
+
+	url := "/admin/projects/test-project/locations/us-central1/jobs/boost/priority"
+	req := httptest.NewRequest("POST", url, bytes.NewBufferString(`{"priority": 90}`))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	var response api.Job
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+	assert.Equal(t, int32(90), response.Priority)
+	lastEvent := response.Status.StatusEvents[len(response.Status.StatusEvents)-1]
+	assert.Equal(t, "priority_changed", lastEvent.Type)
+
+	// Out of range priorities are rejected
+	req = httptest.NewRequest("POST", url, bytes.NewBufferString(`{"priority": 100}`))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// Jobs that already left the queue cannot be reprioritized
+	fake.Advance(2 * time.Second)
+	require.Eventually(t, func() bool {
+		stored, _ := handler.store.GetJob(job.Name)
+		return stored.State == api.JobStateRunning
+	}, time.Second, time.Millisecond)
+
+	req = httptest.NewRequest("POST", url, bytes.NewBufferString(`{"priority": 10}`))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// Unknown jobs are reported as not found
+	req = httptest.NewRequest("POST", "/admin/projects/test-project/locations/us-central1/jobs/missing/priority", bytes.NewBufferString(`{"priority": 10}`))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestAdminReset(t *testing.T) {
+	handler, fake := setupFakeClockHandler()
+	router := setupRouter(handler)
+
+	job := &api.Job{TaskGroups: []*api.TaskGroup{{Name: "group1", TaskCount: 1}}}
+	require.NoError(t, handler.submitJob(context.Background(), "test-project", "us-central1", "old", job, &simulation.Plan{}))
+	handler.topics.Publish(context.Background(), "projects/test-project/topics/t", &pubsub.Message{})
+
+	req := httptest.NewRequest("POST", "/admin/reset", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusNoContent, w.Code)
+
+	assert.Empty(t, handler.store.Snapshot().Jobs)
+	assert.False(t, handler.sim.Running(job.Name))
+	assert.Empty(t, handler.topics.Messages("projects/test-project/topics/t"))
+
+	// Jobs created afterwards are simulated as usual.
+	next := &api.Job{TaskGroups: []*api.TaskGroup{{Name: "group1", TaskCount: 1}}}
+	require.NoError(t, handler.submitJob(context.Background(), "test-project", "us-central1", "new", next, &simulation.Plan{}))
+	fake.Advance(time.Minute)
+	require.Eventually(t, func() bool {
+		stored, err := handler.store.GetJob(next.Name)
+		return err == nil && stored.State == api.JobStateSucceeded
+	}, time.Second, time.Millisecond)
+}
+
+func TestCreateJob_Quotas(t *testing.T) {
+	fake := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	quotas := &Quotas{Projects: map[string]Quota{
+		"limited": {JobsPerMinute: 2},
+		"small":   {MaxCPUMilli: 6000},
+	}}
+	handler := NewHandlerWithConfig(storage.NewMemoryStore(), Config{Clock: fake, Simulator: &stubSimulator{}, Quotas: quotas})
+	router := setupRouter(handler)
+
+	create := func(project string) *httptest.ResponseRecorder {
+		body := `{"taskGroups": [{"taskCount": 4, "parallelism": 2, "taskSpec": {"runnables": [{"script": {"text": "true"}}]}}]}`
+		r := httptest.NewRequest("POST", "/v1/projects/"+project+"/locations/us-central1/jobs", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	assert.Equal(t, http.StatusOK, create("limited").Code)
+	fake.Advance(30 * time.Second)
+	assert.Equal(t, http.StatusOK, create("limited").Code)
+	w := create("limited")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "30", w.Header().Get("Retry-After"))
+	var errResp api.ErrorResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&errResp))
+	assert.Equal(t, "RESOURCE_EXHAUSTED", errResp.Error.Status)
+
+	// The first job leaves the window a minute after it was created.
+	fake.Advance(30 * time.Second)
+	assert.Equal(t, http.StatusOK, create("limited").Code)
+
+	// Each job runs two tasks of the default 2000 cpuMilli at once.
+	assert.Equal(t, http.StatusOK, create("small").Code)
+	w = create("small")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Contains(t, w.Body.String(), "Quota 'CPUS' exceeded")
+
+	jobs, err := handler.store.ListJobs("small", "us-central1")
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	jobs[0].State = api.JobStateSucceeded
+	require.NoError(t, handler.store.UpdateJob(jobs[0]))
+	assert.Equal(t, http.StatusOK, create("small").Code)
+}
+
+func TestChaos(t *testing.T) {
+	handler := NewHandlerWithConfig(storage.NewMemoryStore(), Config{
+		Simulator: &stubSimulator{},
+		Chaos:     Chaos{Latency: 20 * time.Millisecond, ErrorRate: 1},
+	})
+	router := setupRouter(handler)
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/v1/projects/p/locations/l/jobs", nil))
+	assert.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond)
+	assert.Contains(t, []int{http.StatusInternalServerError, http.StatusServiceUnavailable}, w.Code)
+	var errResp api.ErrorResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&errResp))
+	assert.Contains(t, []string{"INTERNAL", "UNAVAILABLE"}, errResp.Error.Status)
+
+	// The admin API is left alone.
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/admin/snapshot", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// Requests whose deadline passes while delayed are not handled.
+	handler.chaos = Chaos{Latency: time.Second}
+	r := httptest.NewRequest("POST", "/v1/projects/p/locations/l/jobs?job_id=j", strings.NewReader(`{}`))
+	r.Header.Set(serverTimeoutHeader, "0.01")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+	_, err := handler.store.GetJob("projects/p/locations/l/jobs/j")
+	assert.Error(t, err)
+}
+
+func TestFaults(t *testing.T) {
+	matrix, err := faults.NewMatrix([]*faults.Rule{
+		{
+			Method: "POST",
+			Path:   "/jobs$",
+			When:   faults.Condition{Headers: map[string]string{"X-Fault": "quota"}},
+			Error: faults.Error{
+				Code:    429,
+				Message: "Quota exceeded",
+				Details: []map[string]interface{}{{"@type": "type.googleapis.com/google.rpc.RetryInfo", "retryDelay": "30s"}},
+			},
+		},
+		{Method: "GET", When: faults.Condition{Project: "flaky", Times: 1}, Error: faults.Error{Code: 503}},
+	})
+	require.NoError(t, err)
+	handler := NewHandlerWithConfig(storage.NewMemoryStore(), Config{Simulator: &stubSimulator{}, Faults: matrix})
+	router := setupRouter(handler)
+
+	r := httptest.NewRequest("POST", "/v1/projects/p/locations/l/jobs", strings.NewReader(`{}`))
+	r.Header.Set("X-Fault", "quota")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	var errResp api.ErrorResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&errResp))
+	assert.Equal(t, "RESOURCE_EXHAUSTED", errResp.Error.Status)
+	assert.Equal(t, "Quota exceeded", errResp.Error.Message)
+	assert.Equal(t, "30s", errResp.Error.Details[0]["retryDelay"])
+
+	// Requests outside the condition are handled.
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/v1/projects/p/locations/l/jobs", strings.NewReader(`{}`)))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// Rules limited in number let later requests through until a reset.
+	get := func() int {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/v1/projects/flaky/locations/l/jobs", nil))
+		return w.Code
+	}
+	assert.Equal(t, http.StatusServiceUnavailable, get())
+	assert.Equal(t, http.StatusOK, get())
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/admin/reset", nil))
+	require.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, http.StatusServiceUnavailable, get())
+}
+
+func TestAuth(t *testing.T) {
+	tokens, err := auth.NewTokens([]*auth.Token{
+		{Token: "ci-token", Name: "ci", Projects: []string{"a"}},
+		{Token: "admin-token", Projects: []string{auth.AnyProject}},
+	})
+	require.NoError(t, err)
+	handler := NewHandlerWithConfig(storage.NewMemoryStore(), Config{Simulator: &stubSimulator{}, Auth: tokens})
+	router := setupRouter(handler)
+
+	serve := func(method, path, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(`{}`))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	w := serve("POST", "/v1/projects/a/locations/l/jobs?job_id=j", "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Header().Get("WWW-Authenticate"), "Bearer")
+	var errResp api.ErrorResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&errResp))
+	assert.Equal(t, "UNAUTHENTICATED", errResp.Error.Status)
+	assert.Equal(t, http.StatusUnauthorized, serve("GET", "/v1/projects/a/locations/l/jobs", "wrong").Code)
+
+	assert.Equal(t, http.StatusOK, serve("POST", "/v1/projects/a/locations/l/jobs?job_id=j", "ci-token").Code)
+	w = serve("GET", "/v1/projects/b/locations/l/jobs", "ci-token")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&errResp))
+	assert.Equal(t, "PERMISSION_DENIED", errResp.Error.Status)
+	assert.Equal(t, http.StatusOK, serve("GET", "/v1/projects/b/locations/l/jobs", "admin-token").Code)
+
+	// The admin API stays open.
+	assert.Equal(t, http.StatusOK, serve("GET", "/admin/stats", "").Code)
+}
+
+func TestTenantMode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "projects.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("projects: [team-a]\n"), 0o644))
+	projects, err := LoadProjects(path)
+	require.NoError(t, err)
+	handler := NewHandlerWithConfig(storage.NewMemoryStore(), Config{Simulator: &stubSimulator{}, Projects: projects})
+	router := setupRouter(handler)
+
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+
+	require.Equal(t, http.StatusOK, serve("POST", "/v1/projects/team-a/locations/us-central1/jobs?job_id=j", "{}").Code)
+	w := serve("POST", "/v1/projects/team-b/locations/us-central1/jobs?job_id=j", "{}")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	var errResp api.ErrorResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&errResp))
+	assert.Equal(t, "PERMISSION_DENIED", errResp.Error.Status)
+	assert.Equal(t, "Permission denied on resource project team-b (or it may not exist)", errResp.Error.Message)
+
+	// Registering a project opens it; registering it twice is a collision.
+	assert.Equal(t, http.StatusOK, serve("POST", "/admin/projects", `{"projectId": "team-b"}`).Code)
+	assert.Equal(t, http.StatusConflict, serve("POST", "/admin/projects", `{"projectId": "team-b"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, serve("POST", "/admin/projects", `{"projectId": "a/b"}`).Code)
+	require.Equal(t, http.StatusOK, serve("POST", "/v1/projects/team-b/locations/us-central1/jobs?job_id=j", "{}").Code)
+	w = serve("GET", "/admin/projects", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var list ProjectList
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&list))
+	assert.Equal(t, []string{"team-a", "team-b"}, list.Projects)
+
+	// Stats cover every registered project, even without jobs, and can be
+	// narrowed to one.
+	assert.Equal(t, http.StatusOK, serve("POST", "/admin/projects", `{"projectId": "team-c"}`).Code)
+	w = serve("GET", "/admin/stats", "")
+	var stats StateStats
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&stats))
+	assert.Equal(t, map[string]map[api.JobState]int{
+		"team-a": {api.JobStateQueued: 1},
+		"team-b": {api.JobStateQueued: 1},
+		"team-c": {},
+	}, stats.Projects)
+	w = serve("GET", "/admin/stats?project=team-b", "")
+	stats = StateStats{}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&stats))
+	assert.Equal(t, map[api.JobState]int{api.JobStateQueued: 1}, stats.Jobs)
+	assert.Equal(t, map[string]map[api.JobState]int{"team-b": {api.JobStateQueued: 1}}, stats.Projects)
+
+	// A project cannot be unregistered while it has jobs. Once it is, its
+	// requests are refused again.
+	w = serve("DELETE", "/admin/projects/team-b", "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	require.NoError(t, handler.store.DeleteJob("projects/team-b/locations/us-central1/jobs/j"))
+	assert.Equal(t, http.StatusNoContent, serve("DELETE", "/admin/projects/team-b", "").Code)
+	assert.Equal(t, http.StatusNotFound, serve("DELETE", "/admin/projects/team-b", "").Code)
+	assert.Equal(t, http.StatusForbidden, serve("GET", "/v1/projects/team-b/locations/us-central1/jobs", "").Code)
+
+	// Without tenant mode the registry is not available.
+	router = setupRouter(NewHandlerWithConfig(storage.NewMemoryStore(), Config{Simulator: &stubSimulator{}}))
+	assert.Equal(t, http.StatusBadRequest, serve("GET", "/admin/projects", "").Code)
+}
+
+// recordingSink collects the audit entries written to it.
+type recordingSink struct {
+	mu      sync.Mutex
+	entries []*audit.Entry
+	closed  bool
+}
+
+func (s *recordingSink) Write(entry *audit.Entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = append(s.entries, entry)
+}
+
+func (s *recordingSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+func TestAccessLog(t *testing.T) {
+	handler := setupTestHandler()
+	require.NoError(t, handler.store.CreateJob(&api.Job{Name: "projects/p/locations/us-central1/jobs/job"}))
+	router := mux.NewRouter()
+	router.Use(AccessLogMiddleware)
+	router.HandleFunc("/v1/projects/{project}/locations/{location}/jobs/{job}", handler.GetJob).Methods("GET")
+
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+	handled := func() *logrus.Entry {
+		for _, entry := range hook.AllEntries() {
+			if entry.Message == "Request handled" {
+				return entry
+			}
+		}
+		return nil
+	}
+
+	req := httptest.NewRequest("GET", "/v1/projects/p/locations/us-central1/jobs/missing", nil)
+	req.Header.Set("X-Request-Id", "abc-123")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	entry := handled()
+	require.NotNil(t, entry)
+	assert.Equal(t, logrus.InfoLevel, entry.Level)
+	assert.Equal(t, "GET", entry.Data["method"])
+	assert.Equal(t, http.StatusNotFound, entry.Data["status"])
+	assert.Equal(t, "abc-123", entry.Data["requestId"])
+	assert.Equal(t, "p", entry.Data["project"])
+	assert.Equal(t, "us-central1", entry.Data["location"])
+	assert.Equal(t, "projects/p/locations/us-central1/jobs/missing", entry.Data["job"])
+	assert.IsType(t, float64(0), entry.Data["latencySeconds"])
+
+	// Requests without an ID or a job leave them out.
+	hook.Reset()
+	defer logrus.SetLevel(logrus.GetLevel())
+	logrus.SetLevel(logrus.DebugLevel)
+	router.HandleFunc("/v1/health", func(w http.ResponseWriter, r *http.Request) {}).Methods("GET")
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/v1/health", nil))
+	entry = handled()
+	require.NotNil(t, entry)
+	assert.Equal(t, logrus.DebugLevel, entry.Level)
+	assert.NotContains(t, entry.Data, "requestId")
+	assert.NotContains(t, entry.Data, "job")
+}
+
+func TestDrain(t *testing.T) {
+	create := func(handler *Handler) string {
+		body, _ := json.Marshal(api.Job{TaskGroups: []*api.TaskGroup{{TaskCount: 2}}})
+		w := httptest.NewRecorder()
+		setupRouter(handler).ServeHTTP(w, httptest.NewRequest("POST", "/v1/projects/p/locations/l/jobs?job_id=job", bytes.NewBuffer(body)))
+		require.Equal(t, http.StatusOK, w.Code)
+		return "projects/p/locations/l/jobs/job"
+	}
+
+	// A fake clock is fast-forwarded until the job is done.
+	handler, _ := setupFakeClockHandler()
+	defer handler.Close()
+	name := create(handler)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	assert.Equal(t, 0, handler.Drain(ctx))
+	job, err := handler.store.GetJob(name)
+	require.NoError(t, err)
+	assert.Equal(t, api.JobStateSucceeded, job.State)
+
+	// On the wall clock, simulations outlasting the deadline are left.
+	handler = NewHandlerWithConfig(storage.NewMemoryStore(), Config{
+		Timings: simulation.Timings{States: map[api.JobState]time.Duration{api.JobStateQueued: time.Hour}},
+	})
+	defer handler.Close()
+	name = create(handler)
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, 1, handler.Drain(ctx))
+	job, err = handler.store.GetJob(name)
+	require.NoError(t, err)
+	assert.Equal(t, api.JobStateQueued, job.State)
+}
+
+func TestRequestID(t *testing.T) {
+	handler := setupTestHandler()
+	router := setupRouter(handler)
+	get := func(id string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/v1/projects/p/locations/us-central1/jobs/missing", nil)
+		if id != "" {
+			req.Header.Set("X-Request-Id", id)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("")
+	id := w.Header().Get("X-Request-Id")
+	_, err := uuid.Parse(id)
+	require.NoError(t, err)
+	var response api.ErrorResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+	assert.Equal(t, []map[string]interface{}{
+		{"@type": "type.googleapis.com/google.rpc.RequestInfo", "requestId": id},
+	}, response.Error.Details)
+
+	// An incoming ID is honored, unless it is unusable.
+	assert.Equal(t, "test-42", get("test-42").Header().Get("X-Request-Id"))
+	assert.Contains(t, get("test-42").Body.String(), `"requestId":"test-42"`)
+	assert.NotEqual(t, strings.Repeat("x", 200), get(strings.Repeat("x", 200)).Header().Get("X-Request-Id"))
+
+	// Log lines of the request are tagged with it.
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+	get("test-43")
+	entry := hook.LastEntry()
+	require.NotNil(t, entry)
+	assert.Equal(t, "test-43", entry.Data["requestId"])
+}
+
+func TestAuditLog(t *testing.T) {
+	sink := &recordingSink{}
+	handler := NewHandlerWithConfig(storage.NewMemoryStore(), Config{Simulator: &stubSimulator{}, AuditSinks: []audit.Sink{sink}})
+	router := setupRouter(handler)
+
+	serve := func(method, path string, body string) int {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w.Code
+	}
+	require.Equal(t, http.StatusOK, serve("POST", "/v1/projects/a/locations/l/jobs?job_id=j", `{}`))
+	require.Equal(t, http.StatusNotFound, serve("GET", "/v1/projects/b/locations/l/jobs/missing", ""))
+	// Admin calls and metrics scrapes are not audited.
+	require.Equal(t, http.StatusOK, serve("GET", "/admin/stats", ""))
+	require.Equal(t, http.StatusOK, serve("GET", "/metrics", ""))
+
+	list := func(query string) []*audit.Entry {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/admin/audit"+query, nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		var response ListAuditEntriesResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+		return response.Entries
+	}
+
+	entries := list("")
+	require.Len(t, entries, 2)
+	assert.Equal(t, "POST", entries[0].Method)
+	assert.Equal(t, "/v1/projects/a/locations/l/jobs", entries[0].Path)
+	assert.Equal(t, "/v1/projects/{project}/locations/{location}/jobs", entries[0].Route)
+	assert.Equal(t, "a", entries[0].Project)
+	assert.Equal(t, http.StatusOK, entries[0].Status)
+	assert.Equal(t, http.StatusNotFound, entries[1].Status)
+
+	entries = list("?project=b&method=GET")
+	require.Len(t, entries, 1)
+	assert.Equal(t, "b", entries[0].Project)
+	assert.Empty(t, list("?method=DELETE"))
+	assert.Empty(t, list("?since=2999-01-01T00:00:00Z"))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/admin/audit?since=yesterday", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// Resetting drops the kept entries, but sinks keep everything.
+	require.Equal(t, http.StatusNoContent, serve("POST", "/admin/reset", ""))
+	assert.Empty(t, list(""))
+	handler.Close()
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	assert.Len(t, sink.entries, 2)
+	assert.True(t, sink.closed)
+}
+
+func TestAdminJobsAndStats(t *testing.T) {
+	handler, _, _ := setupStubHandler()
+	router := setupRouter(handler)
+
+	require.NoError(t, handler.store.CreateJob(&api.Job{
+		Name:       "projects/a/locations/us-central1/jobs/one",
+		State:      api.JobStateRunning,
+		TaskGroups: []*api.TaskGroup{{Name: "group0", TaskCount: 2}},
+	}))
+	require.NoError(t, handler.store.CreateJob(&api.Job{Name: "projects/b/locations/europe-west1/jobs/two", State: api.JobStateSucceeded}))
+	require.NoError(t, handler.store.CreateJob(&api.Job{Name: "projects/b/locations/us-central1/jobs/three", State: api.JobStateRunning}))
+
+	req := httptest.NewRequest("GET", "/admin/jobs?state=RUNNING", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	var list api.ListJobsResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&list))
+	require.Len(t, list.Jobs, 2)
+	assert.Equal(t, "projects/a/locations/us-central1/jobs/one", list.Jobs[0].Name)
+	assert.Equal(t, "projects/b/locations/us-central1/jobs/three", list.Jobs[1].Name)
+
+	req = httptest.NewRequest("GET", "/admin/jobs?project=b", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&list))
+	assert.Len(t, list.Jobs, 2)
+
+	req = httptest.NewRequest("GET", "/admin/stats", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	var stats StateStats
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&stats))
+	assert.Equal(t, map[api.JobState]int{api.JobStateRunning: 2, api.JobStateSucceeded: 1}, stats.Jobs)
+	assert.Equal(t, map[api.TaskState]int{api.TaskStatePending: 2}, stats.Tasks)
+	assert.Equal(t, map[api.JobState]int{api.JobStateRunning: 1, api.JobStateSucceeded: 1}, stats.Projects["b"])
+}
+
+func TestForceJobState(t *testing.T) {
+	handler, fake := setupFakeClockHandler()
+	router := setupRouter(handler)
+
+	job := &api.Job{TaskGroups: []*api.TaskGroup{{Name: "group1", TaskCount: 2}}}
+	require.NoError(t, handler.submitJob(context.Background(), "test-project", "us-central1", "stuck", job, &simulation.Plan{}))
+
+	url := "/admin/projects/test-project/locations/us-central1/jobs/stuck/state"
+	req := httptest.NewRequest("POST", url, bytes.NewBufferString(`{"state": "RUNNING"}`))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	req = httptest.NewRequest("POST", url, bytes.NewBufferString(`{"state": "FAILED"}`))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var response api.Job
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+	assert.Equal(t, api.JobStateFailed, response.State)
+	assert.Equal(t, int64(2), response.Status.TaskGroups["group1"].Counts["FAILED"])
+	lastEvent := response.Status.StatusEvents[len(response.Status.StatusEvents)-1]
+	assert.Equal(t, "job_forced", lastEvent.Type)
+	assert.False(t, handler.sim.Running(job.Name))
+
+	// The stopped simulation does not move the job on
+	fake.Advance(time.Minute)
+	stored, err := handler.store.GetJob(job.Name)
+	require.NoError(t, err)
+	assert.Equal(t, api.JobStateFailed, stored.State)
+
+	// Finished jobs cannot be forced again
+	req = httptest.NewRequest("POST", url, bytes.NewBufferString(`{"state": "SUCCEEDED"}`))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestForceJobState_LazyGroup(t *testing.T) {
+	callbacks := make(chan string, 2)
+	var mu sync.Mutex
+	var events []webhook.Event
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/events" {
+			var event webhook.Event
+			json.NewDecoder(r.Body).Decode(&event)
+			mu.Lock()
+			defer mu.Unlock()
+			events = append(events, event)
+			return
+		}
+		var job api.Job
+		json.NewDecoder(r.Body).Decode(&job)
+		callbacks <- r.URL.Path + " " + string(job.State)
+	}))
+	defer server.Close()
+
+	handler, _ := setupFakeClockHandler()
+	defer handler.Close()
+	router := setupRouter(handler)
+	require.NoError(t, handler.webhooks.Add(&webhook.Hook{URL: server.URL + "/events"}))
+
+	body, _ := json.Marshal(api.Job{
+		Labels: map[string]string{
+			webhook.SuccessURLLabel: server.URL + "/succeeded",
+			webhook.FailureURLLabel: server.URL + "/failed",
+		},
+		TaskGroups: []*api.TaskGroup{{Name: "group1", TaskCount: 2500}},
+	})
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/v1/projects/p/locations/l/jobs?job_id=big", bytes.NewBuffer(body)))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/admin/projects/p/locations/l/jobs/big/state", bytes.NewBufferString(`{"state": "FAILED"}`)))
+	require.Equal(t, http.StatusOK, w.Code)
+	var response api.Job
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+	assert.Equal(t, api.JobStateFailed, response.State)
+	assert.Equal(t, map[string]int64{"FAILED": 2500}, response.Status.TaskGroups["group1"].Counts)
+
+	// The tasks are forced through the group's progress, not stored.
+	progress, err := handler.store.GetTaskProgress(response.Name, "group1")
+	require.NoError(t, err)
+	require.NotNil(t, progress.Forced)
+	assert.Equal(t, api.TaskStateFailed, progress.Forced.State)
+	task, err := handler.store.GetTask(response.Name, response.Name+"/taskGroups/group1/tasks/2499")
+	require.NoError(t, err)
+	assert.Equal(t, api.TaskStateFailed, task.Status.State)
+	assert.Equal(t, "task_forced", task.Status.StatusEvents[len(task.Status.StatusEvents)-1].Type)
+
+	// The job's completion callback is called, and a single event sent for
+	// the job after the one of its creation, none for its tasks.
+	select {
+	case callback := <-callbacks:
+		assert.Equal(t, "/failed FAILED", callback)
+	case <-time.After(5 * time.Second):
+		t.Fatal("callback was not called")
+	}
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(events) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	for i, state := range []api.JobState{api.JobStateQueued, api.JobStateFailed} {
+		assert.Equal(t, api.NotificationTypeJobStateChanged, events[i].Type)
+		assert.Equal(t, state, events[i].Job.State)
+	}
+}
+
+func TestCreateJob_FailureInjection(t *testing.T) {
+	tests := []struct {
+		name   string
+		url    string
+		labels map[string]string
+		want   api.JobState
+	}{
+		{"Default", "/v1/projects/p/locations/l/jobs?job_id=job", nil, api.JobStateSucceeded},
+		{"Label", "/v1/projects/p/locations/l/jobs?job_id=job", map[string]string{simulation.FinalStateLabel: "FAILED"}, api.JobStateFailed},
+		{"QueryParam", "/v1/projects/p/locations/l/jobs?job_id=job&final_state=FAILED", nil, api.JobStateFailed},
+		{"QueryParamOverridesLabel", "/v1/projects/p/locations/l/jobs?job_id=job&final_state=SUCCEEDED", map[string]string{simulation.FinalStateLabel: "FAILED"}, api.JobStateSucceeded},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, fake := setupFakeClockHandler()
+			router := setupRouter(handler)
+
+			body, _ := json.Marshal(api.Job{
+				Labels:     tt.labels,
+				TaskGroups: []*api.TaskGroup{{Name: "group1", TaskSpec: &api.TaskSpec{}, TaskCount: 2}},
+			})
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("POST", tt.url, bytes.NewBuffer(body)))
+			require.Equal(t, http.StatusOK, w.Code)
+
+			fake.Advance(time.Minute)
+			name := "projects/p/locations/l/jobs/job"
+			require.Eventually(t, func() bool {
+				job, err := handler.store.GetJob(name)
+				return err == nil && (job.State == api.JobStateSucceeded || job.State == api.JobStateFailed)
+			}, time.Second, time.Millisecond)
+
+			job, _ := handler.store.GetJob(name)
+			assert.Equal(t, tt.want, job.State)
+			assert.Equal(t, int64(2), job.Status.TaskGroups["group1"].Counts[string(tt.want)])
+
+			tasks, _ := handler.store.ListTasks(name)
+			lastEvent := job.Status.StatusEvents[len(job.Status.StatusEvents)-1]
+			if tt.want == api.JobStateFailed {
+				assert.Equal(t, "job_failed", lastEvent.Type)
+				for _, task := range tasks {
+					assert.Equal(t, api.TaskStateFailed, task.Status.State)
+				}
+			} else {
+				assert.Equal(t, "job_completed", lastEvent.Type)
+			}
+		})
+	}
+}
+
+func TestCreateJob_InvalidFinalState(t *testing.T) {
+	router := setupRouter(setupTestHandler())
+
+	body, _ := json.Marshal(api.Job{TaskGroups: []*api.TaskGroup{{Name: "group1", TaskCount: 1}}})
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/v1/projects/p/locations/l/jobs?final_state=RUNNING", bytes.NewBuffer(body)))
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestCreateJob_ScenarioHeader(t *testing.T) {
+	handler, fake := setupFakeClockHandler()
+	router := setupRouter(handler)
+
+	body, _ := json.Marshal(api.Job{TaskGroups: []*api.TaskGroup{{Name: "group1", TaskCount: 2}}})
+	req := httptest.NewRequest("POST", "/v1/projects/p/locations/l/jobs?job_id=job", bytes.NewBuffer(body))
+	req.Header.Set(scenarioHeader, "fail-before-running,scheduled=10m")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	name := "projects/p/locations/l/jobs/job"
+	fake.Advance(time.Minute)
+	require.Eventually(t, func() bool {
+		job, err := handler.store.GetJob(name)
+		return err == nil && job.State == api.JobStateScheduled
+	}, time.Second, time.Millisecond)
+	fake.Advance(10 * time.Minute)
+	require.Eventually(t, func() bool {
+		job, err := handler.store.GetJob(name)
+		return err == nil && job.State == api.JobStateFailed
+	}, time.Second, time.Millisecond)
+
+	tasks, _ := handler.store.ListTasks(name)
+	for _, task := range tasks {
+		assert.Equal(t, api.TaskStatePending, task.Status.State)
+	}
+
+	// Other jobs are simulated as usual.
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/v1/projects/p/locations/l/jobs?job_id=other", bytes.NewBuffer(body)))
+	require.Equal(t, http.StatusOK, w.Code)
+	fake.Advance(time.Minute)
+	require.Eventually(t, func() bool {
+		job, err := handler.store.GetJob("projects/p/locations/l/jobs/other")
+		return err == nil && job.State == api.JobStateSucceeded
+	}, time.Second, time.Millisecond)
+
+	req = httptest.NewRequest("POST", "/v1/projects/p/locations/l/jobs", bytes.NewBuffer(body))
+	req.Header.Set(scenarioHeader, "explode")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "unknown simulation outcome or scenario")
+}
+
+func TestCreateJob_Callbacks(t *testing.T) {
+	received := make(chan string, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var job api.Job
+		json.NewDecoder(r.Body).Decode(&job)
+		received <- r.URL.Path + " " + string(job.State)
+	}))
+	defer server.Close()
+
+	handler, fake := setupFakeClockHandler()
+	defer handler.Close()
+	router := setupRouter(handler)
+
+	body, _ := json.Marshal(api.Job{
+		Labels: map[string]string{
+			webhook.SuccessURLLabel: server.URL + "/succeeded",
+			webhook.FailureURLLabel: server.URL + "/failed",
+		},
+		TaskGroups: []*api.TaskGroup{{Name: "group1", TaskCount: 1}},
+	})
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/v1/projects/p/locations/l/jobs?final_state=FAILED", bytes.NewBuffer(body)))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	fake.Advance(time.Minute)
+	select {
+	case callback := <-received:
+		assert.Equal(t, "/failed FAILED", callback)
+	case <-time.After(5 * time.Second):
+		t.Fatal("callback was not called")
+	}
+	assert.Empty(t, received)
+}
+
+func TestCreateJob_InvalidCallback(t *testing.T) {
+	router := setupRouter(setupTestHandler())
+
+	body, _ := json.Marshal(api.Job{Labels: map[string]string{webhook.SuccessURLLabel: "not a url"}})
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/v1/projects/p/locations/l/jobs", bytes.NewBuffer(body)))
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestGetTaskLogs(t *testing.T) {
+	handler, fake := setupFakeClockHandler()
+	defer handler.Close()
+	router := setupRouter(handler)
+
+	body, _ := json.Marshal(api.Job{TaskGroups: []*api.TaskGroup{{
+		TaskCount: 1,
+		TaskSpec: &api.TaskSpec{Runnables: []*api.Runnable{
+			{Script: &api.Script{Text: "echo hello"}},
+		}},
+	}}})
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/v1/projects/p/locations/l/jobs?job_id=job", bytes.NewBuffer(body)))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	fake.Advance(time.Minute)
+	require.Eventually(t, func() bool {
+		job, err := handler.store.GetJob("projects/p/locations/l/jobs/job")
+		return err == nil && job.State == api.JobStateSucceeded
+	}, time.Second, time.Millisecond)
+
+	url := "/v1/projects/p/locations/l/jobs/job/taskGroups/group0/tasks/0/logs"
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var response TaskLogsResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+	require.Len(t, response.Entries, 2)
+	assert.Equal(t, "Running script: echo hello", response.Entries[0].Text)
+	assert.Equal(t, "Exited with code 0", response.Entries[1].Text)
+
+	// Following a finished task returns its whole output and ends.
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", url+"?follow=true", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/x-ndjson", w.Header().Get("Content-Type"))
+	assert.Equal(t, 2, strings.Count(w.Body.String(), "\n"))
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", url+"?follow=maybe", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/v1/projects/p/locations/l/jobs/job/taskGroups/group0/tasks/9/logs", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestGetTaskLogs_FollowOutlivesWriteTimeout(t *testing.T) {
+	handler, _ := setupFakeClockHandler()
+	defer handler.Close()
+	server := httptest.NewUnstartedServer(setupRouter(handler))
+	server.Config.WriteTimeout = 100 * time.Millisecond
+	server.Start()
+	defer server.Close()
+
+	body, _ := json.Marshal(api.Job{TaskGroups: []*api.TaskGroup{{TaskCount: 1}}})
+	created, err := http.Post(server.URL+"/v1/projects/p/locations/l/jobs?job_id=job", "application/json", bytes.NewBuffer(body))
+	require.NoError(t, err)
+	created.Body.Close()
+
+	resp, err := http.Get(server.URL + "/v1/projects/p/locations/l/jobs/job/taskGroups/group0/tasks/0/logs?follow=true")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// The task writes after the server's write deadline has passed.
+	time.Sleep(3 * server.Config.WriteTimeout)
+	task := "projects/p/locations/l/jobs/job/taskGroups/group0/tasks/0"
+	handler.logs.Append(task, logs.Entry{Text: "late"})
+	handler.logs.Close(task)
+
+	var entries []logs.Entry
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var entry logs.Entry
+		if err := decoder.Decode(&entry); err != nil {
+			require.ErrorIs(t, err, io.EOF)
+			break
+		}
+		entries = append(entries, entry)
+	}
+	require.Len(t, entries, 1)
+	assert.Equal(t, "late", entries[0].Text)
+}
+
+func TestCreateJob_LogsPath(t *testing.T) {
+	root := t.TempDir()
+	fake := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	handler := NewHandlerWithConfig(storage.NewMemoryStore(), Config{Clock: fake, LogsRoot: root})
+	defer handler.Close()
+	router := setupRouter(handler)
+
+	body, _ := json.Marshal(api.Job{
+		LogsPolicy: &api.LogsPolicy{Destination: "PATH", LogsPath: "/mnt/share/logs"},
+		TaskGroups: []*api.TaskGroup{{
+			TaskCount: 2,
+			TaskSpec: &api.TaskSpec{Runnables: []*api.Runnable{
+				{Script: &api.Script{Text: "echo hello"}},
+			}},
+		}},
+	})
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/v1/projects/p/locations/l/jobs?job_id=job", bytes.NewBuffer(body)))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var job api.Job
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&job))
+
+	fake.Advance(time.Minute)
+	require.Eventually(t, func() bool {
+		stored, err := handler.store.GetJob(job.Name)
+		return err == nil && stored.State == api.JobStateSucceeded
+	}, time.Second, time.Millisecond)
+
+	for _, index := range []string{"0", "1"} {
+		data, err := os.ReadFile(filepath.Join(root, "mnt/share/logs", job.UID, "group0", "task-"+index+".log"))
+		require.NoError(t, err)
+		assert.Equal(t, "Running script: echo hello\nExited with code 0\n", string(data))
+	}
+
+	// PATH requires a logsPath.
+	body, _ = json.Marshal(api.Job{LogsPolicy: &api.LogsPolicy{Destination: "PATH"}})
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/v1/projects/p/locations/l/jobs", bytes.NewBuffer(body)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestCreateJob_LogsPathGCS(t *testing.T) {
+	var mu sync.Mutex
+	objects := make(map[string]string)
+	gcs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		objects[r.URL.Path+"?"+r.URL.Query().Get("name")] = string(data)
+	}))
+	defer gcs.Close()
+
+	fake := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	handler := NewHandlerWithConfig(storage.NewMemoryStore(), Config{Clock: fake, GCSEndpoint: gcs.URL})
+	defer handler.Close()
+	router := setupRouter(handler)
+
+	body, _ := json.Marshal(api.Job{
+		LogsPolicy: &api.LogsPolicy{Destination: "PATH", LogsPath: "gs://bucket/batch"},
+		TaskGroups: []*api.TaskGroup{{
+			TaskSpec: &api.TaskSpec{Runnables: []*api.Runnable{
+				{Script: &api.Script{Text: "echo hello"}},
+			}},
+		}},
+	})
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/v1/projects/p/locations/l/jobs?job_id=job", bytes.NewBuffer(body)))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var job api.Job
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&job))
+
+	fake.Advance(time.Minute)
+	require.Eventually(t, func() bool {
+		stored, err := handler.store.GetJob(job.Name)
+		return err == nil && stored.State == api.JobStateSucceeded
+	}, time.Second, time.Millisecond)
+
+	// The log is uploaded once closed, off the simulation's loop.
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(objects) > 0
+	}, time.Second, time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, map[string]string{
+		"/upload/storage/v1/b/bucket/o?batch/" + job.UID + "/group0/task-0.log": "Running script: echo hello\nExited with code 0\n",
+	}, objects)
+
+	body, _ = json.Marshal(api.Job{LogsPolicy: &api.LogsPolicy{Destination: "PATH", LogsPath: "gs://"}})
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/v1/projects/p/locations/l/jobs", bytes.NewBuffer(body)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestCreateJob_LogsPathObjectStore(t *testing.T) {
+	fake := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	objects := blobstore.NewStore(fake)
+	handler := NewHandlerWithConfig(storage.NewMemoryStore(), Config{Clock: fake, ObjectStore: objects})
+	defer handler.Close()
+	router := setupRouter(handler)
+
+	body, _ := json.Marshal(api.Job{
+		LogsPolicy: &api.LogsPolicy{Destination: "PATH", LogsPath: "gs://bucket/batch"},
+		TaskGroups: []*api.TaskGroup{{
+			TaskSpec: &api.TaskSpec{Runnables: []*api.Runnable{
+				{Script: &api.Script{Text: "echo hello"}},
+			}},
+		}},
+	})
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/v1/projects/p/locations/l/jobs?job_id=job", bytes.NewBuffer(body)))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var job api.Job
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&job))
+
+	fake.Advance(time.Minute)
+	require.Eventually(t, func() bool {
+		stored, err := handler.store.GetJob(job.Name)
+		return err == nil && stored.State == api.JobStateSucceeded
+	}, time.Second, time.Millisecond)
+
+	// The log is uploaded once closed, off the simulation's loop.
+	var data []byte
+	require.Eventually(t, func() bool {
+		var ok bool
+		_, data, ok = objects.Get("bucket", "batch/"+job.UID+"/group0/task-0.log")
+		return ok
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, "Running script: echo hello\nExited with code 0\n", string(data))
+
+	// Resetting the server empties the object store.
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/admin/reset", nil))
+	require.Equal(t, http.StatusNoContent, w.Code)
+	assert.Empty(t, objects.List("bucket", ""))
+}
+
+func TestWatchJob(t *testing.T) {
+	handler, fake := setupFakeClockHandler()
+	defer handler.Close()
+	server := httptest.NewServer(setupRouter(handler))
+	defer server.Close()
+
+	body, _ := json.Marshal(api.Job{TaskGroups: []*api.TaskGroup{{TaskCount: 1}}})
+	resp, err := http.Post(server.URL+"/v1/projects/p/locations/l/jobs?job_id=job", "application/json", bytes.NewBuffer(body))
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	resp, err = http.Get(server.URL + "/v1/projects/p/locations/l/jobs/job/watch")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	scanner := bufio.NewScanner(resp.Body)
+	nextEvent := func() (string, api.Job) {
+		var event string
+		var job api.Job
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &job))
+			case line == "":
+				return event, job
+			}
+		}
+		t.Fatal("stream ended")
+		return "", job
+	}
+
+	event, job := nextEvent()
+	assert.Equal(t, "job", event)
+	assert.Equal(t, api.JobStateQueued, job.State)
+
+	fake.Advance(time.Minute)
+	for job.State != api.JobStateSucceeded {
+		event, job = nextEvent()
+		require.Equal(t, "job", event)
+	}
+
+	// Deleting the job ends the stream.
+	req, _ := http.NewRequest("DELETE", server.URL+"/v1/projects/p/locations/l/jobs/job", nil)
+	resp2, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp2.Body.Close()
+	deleted := make(chan struct{})
+	defer close(deleted)
+	go func() {
+		// Advance until the pending deletion has registered with the clock.
+		for {
+			select {
+			case <-deleted:
+				return
+			case <-time.After(time.Millisecond):
+				fake.Advance(time.Minute)
+			}
+		}
+	}()
+	for event != "deleted" {
+		event, job = nextEvent()
+	}
+	assert.Equal(t, "projects/p/locations/l/jobs/job", job.Name)
+	assert.False(t, scanner.Scan())
+}
+
+func TestWatchJob_NotFound(t *testing.T) {
+	router := setupRouter(setupTestHandler())
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/v1/projects/p/locations/l/jobs/missing/watch", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestWatchJobs(t *testing.T) {
+	handler := setupTestHandler()
+	server := httptest.NewServer(setupRouter(handler))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/v1/projects/p/locations/l/jobs:watch")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	scanner := bufio.NewScanner(resp.Body)
+	nextEvent := func() (string, api.ListJobsResponse) {
+		var event string
+		var jobs api.ListJobsResponse
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &jobs))
+			case line == "":
+				return event, jobs
+			}
+		}
+		t.Fatal("stream ended")
+		return "", jobs
+	}
+
+	event, jobs := nextEvent()
+	assert.Equal(t, "jobs", event)
+	assert.Empty(t, jobs.Jobs)
+
+	for _, id := range []string{"b", "a"} {
+		body, _ := json.Marshal(api.Job{TaskGroups: []*api.TaskGroup{{TaskCount: 1}}})
+		created, err := http.Post(server.URL+"/v1/projects/p/locations/l/jobs?job_id="+id, "application/json", bytes.NewBuffer(body))
+		require.NoError(t, err)
+		created.Body.Close()
+	}
+	for len(jobs.Jobs) < 2 {
+		event, jobs = nextEvent()
+		require.Equal(t, "jobs", event)
+	}
+	assert.Equal(t, "projects/p/locations/l/jobs/a", jobs.Jobs[0].Name)
+	assert.Equal(t, "projects/p/locations/l/jobs/b", jobs.Jobs[1].Name)
+
+	// Changes to a job are streamed too.
+	job, _ := handler.store.GetJob("projects/p/locations/l/jobs/a")
+	updated := *job
+	updated.State = api.JobStateRunning
+	require.NoError(t, handler.store.UpdateJob(&updated))
+	for jobs.Jobs[0].State != api.JobStateRunning {
+		_, jobs = nextEvent()
+	}
+}
+
+func TestWatchJobs_OutlivesWriteTimeout(t *testing.T) {
+	handler := setupTestHandler()
+	server := httptest.NewUnstartedServer(setupRouter(handler))
+	server.Config.WriteTimeout = 100 * time.Millisecond
+	server.Start()
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/v1/projects/p/locations/l/jobs:watch")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	reader := bufio.NewReader(resp.Body)
+	nextEvent := func() string {
+		for {
+			line, err := reader.ReadString('\n')
+			require.NoError(t, err, "stream ended")
+			if strings.HasPrefix(line, "event: ") {
+				return strings.TrimSpace(strings.TrimPrefix(line, "event: "))
+			}
+		}
+	}
+	assert.Equal(t, "jobs", nextEvent())
+
+	// The job is created after the server's write deadline has passed.
+	time.Sleep(3 * server.Config.WriteTimeout)
+	body, _ := json.Marshal(api.Job{TaskGroups: []*api.TaskGroup{{TaskCount: 1}}})
+	created, err := http.Post(server.URL+"/v1/projects/p/locations/l/jobs?job_id=late", "application/json", bytes.NewBuffer(body))
+	require.NoError(t, err)
+	created.Body.Close()
+	assert.Equal(t, "jobs", nextEvent())
+}
+
+func TestListLogEntries(t *testing.T) {
+	handler, fake := setupFakeClockHandler()
+	defer handler.Close()
+	router := setupRouter(handler)
+
+	for _, id := range []string{"job", "other"} {
+		body, _ := json.Marshal(api.Job{TaskGroups: []*api.TaskGroup{{
+			TaskSpec: &api.TaskSpec{Runnables: []*api.Runnable{
+				{Script: &api.Script{Text: "echo " + id}},
+			}},
+		}}})
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/v1/projects/p/locations/l/jobs?job_id="+id, bytes.NewBuffer(body)))
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+
+	fake.Advance(time.Minute)
+	require.Eventually(t, func() bool {
+		for _, id := range []string{"job", "other"} {
+			job, err := handler.store.GetJob("projects/p/locations/l/jobs/" + id)
+			if err != nil || job.State != api.JobStateSucceeded {
+				return false
+			}
+		}
+		return true
+	}, time.Second, time.Millisecond)
+
+	job, err := handler.store.GetJob("projects/p/locations/l/jobs/job")
+	require.NoError(t, err)
+
+	list := func(req logging.ListRequest) (*httptest.ResponseRecorder, logging.ListResponse) {
+		body, _ := json.Marshal(req)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/v2/entries:list", bytes.NewBuffer(body)))
+		var response logging.ListResponse
+		if w.Code == http.StatusOK {
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+		}
+		return w, response
+	}
+
+	filter := fmt.Sprintf(`logName="projects/p/logs/batch_task_logs" AND labels.job_uid=%q`, job.UID)
+	w, response := list(logging.ListRequest{ResourceNames: []string{"projects/p"}, Filter: filter})
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Len(t, response.Entries, 2)
+	assert.Equal(t, "Running script: echo job", response.Entries[0].TextPayload)
+	assert.Equal(t, "Exited with code 0", response.Entries[1].TextPayload)
+	assert.Equal(t, logging.JobResourceType, response.Entries[0].Resource.Type)
+	assert.Equal(t, "job", response.Entries[0].Resource.Labels["job_id"])
+
+	// Pages follow the requested order.
+	w, response = list(logging.ListRequest{Filter: filter, OrderBy: "timestamp desc", PageSize: 1})
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Len(t, response.Entries, 1)
+	assert.Equal(t, "Exited with code 0", response.Entries[0].TextPayload)
+	require.NotEmpty(t, response.NextPageToken)
+
+	w, response = list(logging.ListRequest{Filter: filter, OrderBy: "timestamp desc", PageSize: 1, PageToken: response.NextPageToken})
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Len(t, response.Entries, 1)
+	assert.Equal(t, "Running script: echo job", response.Entries[0].TextPayload)
+	assert.Empty(t, response.NextPageToken)
+
+	w, response = list(logging.ListRequest{ResourceNames: []string{"projects/other"}})
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, response.Entries)
+
+	w, _ = list(logging.ListRequest{Filter: `labels.job_uid="a" OR labels.job_uid="b"`})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// Written entries are listed alongside task logs.
+	body, _ := json.Marshal(logging.WriteRequest{
+		LogName: "projects/p/logs/app",
+		Labels:  map[string]string{"job_uid": job.UID},
+		Entries: []*logging.LogEntry{{TextPayload: "written"}},
+	})
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/v2/entries:write", bytes.NewBuffer(body)))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w, response = list(logging.ListRequest{Filter: fmt.Sprintf(`labels.job_uid=%q`, job.UID)})
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Len(t, response.Entries, 3)
+	assert.Equal(t, "written", response.Entries[2].TextPayload)
+	assert.True(t, fake.Now().Equal(response.Entries[2].Timestamp))
+}
+
+func TestLintJob(t *testing.T) {
+	handler := setupTestHandler()
+	router := setupRouter(handler)
+
+	lintJob := func(job api.Job) LintJobResponse {
+		body, _ := json.Marshal(job)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/v1/projects/p/locations/l/jobs:lint", bytes.NewBuffer(body)))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var response LintJobResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+		return response
+	}
+
+	response := lintJob(api.Job{TaskGroups: []*api.TaskGroup{{
+		TaskSpec: &api.TaskSpec{Runnables: []*api.Runnable{{Script: &api.Script{Text: "echo hi"}}}},
+	}}})
+	assert.Empty(t, response.Errors)
+	require.Len(t, response.Warnings, 2)
+	assert.Equal(t, lint.KindNoMaxRunDuration, response.Warnings[0].Kind)
+	assert.Equal(t, lint.KindNoRetries, response.Warnings[1].Kind)
+
+	response = lintJob(api.Job{
+		Labels:     map[string]string{simulation.FinalStateLabel: "DELETED"},
+		LogsPolicy: &api.LogsPolicy{Destination: "PATH"},
+		TaskGroups: []*api.TaskGroup{{TaskSpec: &api.TaskSpec{MaxRunDuration: "60s", MaxRetryCount: 1}}},
+	})
+	assert.Len(t, response.Errors, 2)
+	assert.Empty(t, response.Warnings)
+
+	// Linting does not create the job.
+	jobs, _ := handler.store.ListJobs("p", "l")
+	assert.Empty(t, jobs)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/v1/projects/p/locations/l/jobs:lint", strings.NewReader("{")))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestCreateJob_LegacyFields(t *testing.T) {
+	handler := setupTestHandler()
+	router := setupRouter(handler)
+
+	body := `{
+		"labels": {"team_name": "infra"},
+		"task_groups": [{
+			"task_count": 2,
+			"taskSpec": {
+				"max_run_duration": "60s",
+				"maxRunDuration": "30s",
+				"runnables": [{"script": {"text": "echo hi"}}],
+				"environment": {"variables": {"LOG_LEVEL": "debug"}}
+			}
+		}]
+	}`
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/v1/projects/p/locations/l/jobs?job_id=legacy", strings.NewReader(body)))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var job api.Job
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&job))
+	require.Len(t, job.TaskGroups, 1)
+	assert.Equal(t, int64(2), job.TaskGroups[0].TaskCount)
+	assert.Equal(t, "30s", job.TaskGroups[0].TaskSpec.MaxRunDuration)
+	assert.Equal(t, "debug", job.TaskGroups[0].TaskSpec.Environment.Variables["LOG_LEVEL"])
+	assert.Equal(t, "infra", job.Labels["team_name"])
+	assert.Equal(t, []string{
+		`299 - "task_groups: task_groups is a legacy spelling; use taskGroups"`,
+		`299 - "taskGroups[0].taskSpec.max_run_duration: max_run_duration is a legacy spelling of maxRunDuration and is ignored since both are set"`,
+		`299 - "taskGroups[0].task_count: task_count is a legacy spelling; use taskCount"`,
+	}, w.Header().Values("Warning"))
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/v1/projects/p/locations/l/jobs:lint", strings.NewReader(body)))
+	require.Equal(t, http.StatusOK, w.Code)
+	var response LintJobResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+	require.NotEmpty(t, response.Warnings)
+	assert.Equal(t, lint.KindDeprecatedField, response.Warnings[0].Kind)
+	assert.Equal(t, "task_groups", response.Warnings[0].Field)
+}
+
+// stubImages knows a fixed set of images.
+type stubImages map[string]bool
+
+func (s stubImages) ImageExists(ctx context.Context, image string) (bool, error) {
+	if image == "unreachable" {
+		return false, fmt.Errorf("registry unavailable")
+	}
+	return s[image], nil
+}
+
+func TestCreateJob_ImageCheck(t *testing.T) {
+	handler := NewHandler(storage.NewMemoryStore(), WithSimulator(&stubSimulator{}), WithImageChecker(stubImages{"busybox": true}))
+	router := setupRouter(handler)
+
+	create := func(id string, images ...string) *httptest.ResponseRecorder {
+		var runnables []*api.Runnable
+		for _, image := range images {
+			runnables = append(runnables, &api.Runnable{Container: &api.Container{ImageURI: image}})
+		}
+		runnables = append(runnables, &api.Runnable{Script: &api.Script{Text: "echo hi"}})
+		body, _ := json.Marshal(api.Job{TaskGroups: []*api.TaskGroup{{TaskSpec: &api.TaskSpec{Runnables: runnables}}}})
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/v1/projects/p/locations/l/jobs?job_id="+id, bytes.NewBuffer(body)))
+		return w
+	}
+
+	assert.Equal(t, http.StatusOK, create("ok", "busybox", "busybox").Code)
+
+	w := create("missing", "busybox", "typo/busybox")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), `image \"typo/busybox\" does not exist`)
+	assert.Contains(t, w.Body.String(), "INVALID_ARGUMENT")
+
+	w = create("unreachable", "unreachable")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "registry unavailable")
+
+	_, err := handler.store.GetJob("projects/p/locations/l/jobs/missing")
+	assert.Error(t, err)
+}
+
+func TestCreateJob_MachineCatalog(t *testing.T) {
+	body := `{
+		"allocationPolicy": {"instances": [{"machineType": "e2-standrad-4"}, {"accelerators": [{"type": "nvidia-tesla-t5", "count": 1}]}]}
+	}`
+	create := func(handler *Handler, id string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		setupRouter(handler).ServeHTTP(w, httptest.NewRequest("POST", "/v1/projects/p/locations/us-central1/jobs?job_id="+id, strings.NewReader(body)))
+		return w
+	}
+
+	handler := NewHandler(storage.NewMemoryStore(), WithSimulator(&stubSimulator{}), WithCatalog(catalog.Default(), false))
+	w := create(handler, "warned")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, []string{
+		`299 - "allocationPolicy.instances[0].policy.machineType: machine type \"e2-standrad-4\" does not exist"`,
+		`299 - "allocationPolicy.instances[1].policy.accelerators[0].type: accelerator type \"nvidia-tesla-t5\" does not exist"`,
+	}, w.Header().Values("Warning"))
+
+	w = httptest.NewRecorder()
+	setupRouter(handler).ServeHTTP(w, httptest.NewRequest("POST", "/v1/projects/p/locations/us-central1/jobs:lint", strings.NewReader(body)))
+	var response LintJobResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+	assert.Empty(t, response.Errors)
+	require.NotEmpty(t, response.Warnings)
+	assert.Equal(t, lint.KindMachineCatalog, response.Warnings[len(response.Warnings)-1].Kind)
+
+	handler = NewHandler(storage.NewMemoryStore(), WithSimulator(&stubSimulator{}), WithCatalog(catalog.Default(), true))
+	w = create(handler, "rejected")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "INVALID_ARGUMENT")
+	assert.Contains(t, w.Body.String(), `allocationPolicy.instances[0].policy.machineType: machine type \"e2-standrad-4\" does not exist`)
+	_, err := handler.store.GetJob("projects/p/locations/us-central1/jobs/rejected")
+	assert.Error(t, err)
+}
+
+func TestCreateJob_ComputeResource(t *testing.T) {
+	handler := NewHandler(storage.NewMemoryStore(), WithSimulator(&stubSimulator{}))
+	router := setupRouter(handler)
+
+	create := func(id string, resource *api.ComputeResource, instance *api.InstancePolicy) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(api.Job{
+			TaskGroups:       []*api.TaskGroup{{TaskCount: 1, TaskSpec: &api.TaskSpec{ComputeResource: resource}}},
+			AllocationPolicy: &api.AllocationPolicy{Instances: []*api.InstancePolicyOrTemplate{{Policy: instance}}},
+		})
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/v1/projects/p/locations/us-central1/jobs?job_id="+id, bytes.NewBuffer(body)))
+		return w
+	}
+
+	w := create("fits", &api.ComputeResource{CPUMilli: 4000, MemoryMib: 8192, GPUCount: 1, BootDiskMib: 10240}, &api.InstancePolicy{
+		MachineType:  "n1-standard-4",
+		Accelerators: []*api.Accelerator{{Type: "nvidia-tesla-t4", Count: 1}},
+		BootDisk:     &api.Disk{SizeGb: 50},
+	})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	// Resources are checked without a catalog being configured.
+	w = create("gpus", &api.ComputeResource{GPUCount: 1}, &api.InstancePolicy{MachineType: "n1-standard-4"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "INVALID_ARGUMENT")
+	assert.Contains(t, w.Body.String(), "taskGroups[0].taskSpec.computeResource.gpuCount: 1 task(s) of 1 gpuCount do not fit the 0 GPUs of allocationPolicy.instances[0].policy")
+
+	w = create("disk", &api.ComputeResource{BootDiskMib: 40960}, &api.InstancePolicy{BootDisk: &api.Disk{SizeGb: 30}})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "40960 bootDiskMib do not fit the 30 GB boot disk")
+
+	_, err := handler.store.GetJob("projects/p/locations/us-central1/jobs/gpus")
+	assert.Error(t, err)
+}
+
+func TestCreateJob_AllowedLocations(t *testing.T) {
+	handler := NewHandler(storage.NewMemoryStore(), WithSimulator(&stubSimulator{}))
+	router := setupRouter(handler)
+
+	create := func(id string, allowed ...string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(api.Job{
+			TaskGroups:       []*api.TaskGroup{{TaskCount: 1}},
+			AllocationPolicy: &api.AllocationPolicy{Location: &api.LocationPolicy{AllowedLocations: allowed}},
+		})
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/v1/projects/p/locations/us-central1/jobs?job_id="+id, bytes.NewBuffer(body)))
+		return w
+	}
+
+	w := create("valid", "regions/us-central1", "zones/us-central1-b")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Empty(t, w.Header().Values("Warning"))
+
+	// Bare names are rewritten, so that the simulation places instances in
+	// the zone.
+	w = create("bare", "us-central1-b", "us-central1")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, []string{
+		`299 - "allocationPolicy.location.allowedLocations[0]: us-central1-b is not a location the service accepts; use zones/us-central1-b"`,
+		`299 - "allocationPolicy.location.allowedLocations[1]: us-central1 is not a location the service accepts; use regions/us-central1"`,
+	}, w.Header().Values("Warning"))
+	job, err := handler.store.GetJob("projects/p/locations/us-central1/jobs/bare")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"zones/us-central1-b", "regions/us-central1"}, job.AllocationPolicy.Location.AllowedLocations)
+
+	w = create("malformed", "zones/us-central1b")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "INVALID_ARGUMENT")
+	assert.Contains(t, w.Body.String(), `allocationPolicy.location.allowedLocations[0]: invalid location \"zones/us-central1b\", must be regions/REGION or zones/ZONE`)
+
+	w = create("elsewhere", "zones/us-central1-a", "zones/europe-west4-b")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "allocationPolicy.location.allowedLocations[1]: zones/europe-west4-b is not in the job's region us-central1")
+	_, err = handler.store.GetJob("projects/p/locations/us-central1/jobs/elsewhere")
+	assert.Error(t, err)
+}
+
+func TestCreateJob_StrictJSON(t *testing.T) {
+	body := `{"taskGroups": [{"taskcount": 2, "taskSpec": {"runnables": [{"script": {"text": "true"}}]}}], "labelz": {"team": "a"}}`
+	create := func(handler *Handler, id, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		setupRouter(handler).ServeHTTP(w, httptest.NewRequest("POST", "/v1/projects/p/locations/us-central1/jobs?job_id="+id, strings.NewReader(body)))
+		return w
+	}
+
+	// Unknown fields are ignored by default.
+	w := create(NewHandler(storage.NewMemoryStore(), WithSimulator(&stubSimulator{})), "lenient", body)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	handler := NewHandler(storage.NewMemoryStore(), WithSimulator(&stubSimulator{}), WithStrictJSON())
+	w = create(handler, "strict", body)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "INVALID_ARGUMENT")
+	assert.Contains(t, w.Body.String(), `unknown fields \"labelz\", \"taskGroups[0].taskcount\"`)
+	_, err := handler.store.GetJob("projects/p/locations/us-central1/jobs/strict")
+	assert.Error(t, err)
+
+	// Legacy snake_case names, inline instance policies and free-form keys
+	// are not unknown.
+	w = create(handler, "legacy", `{"task_groups": [{"task_count": 1}], "labels": {"anything": "x"},
+		"allocationPolicy": {"instances": [{"machineType": "e2-standard-4"}]}}`)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	w = httptest.NewRecorder()
+	setupRouter(handler).ServeHTTP(w, httptest.NewRequest("POST", "/admin/projects/p/locations/us-central1/jobs/legacy/priority", strings.NewReader(`{"prority": 5}`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), `unknown field \"prority\"`)
+}
+
+func TestRequestBodyLimits(t *testing.T) {
+	handler := NewHandlerWithConfig(storage.NewMemoryStore(), Config{Simulator: &stubSimulator{}, MaxRequestBytes: 1024})
+	router := setupRouter(handler)
+	create := func(id, body string, chunked bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/v1/projects/p/locations/us-central1/jobs?job_id="+id, strings.NewReader(body))
+		if chunked {
+			req.ContentLength = -1
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := create("small", `{"taskGroups": [{"taskCount": 1}]}`, false)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	large := `{"taskGroups": [{"taskCount": 1}], "labels": {"padding": "` + strings.Repeat("x", 2048) + `"}}`
+	for _, chunked := range []bool{false, true} {
+		w = create("large", large, chunked)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+		assert.Contains(t, w.Body.String(), "RESOURCE_EXHAUSTED")
+		assert.Contains(t, w.Body.String(), "Request payload size exceeds the limit: 1024 bytes")
+	}
+	_, err := handler.store.GetJob("projects/p/locations/us-central1/jobs/large")
+	assert.Error(t, err)
+
+	w = create("deep", `{"labels": `+strings.Repeat("[", 100)+strings.Repeat("]", 100)+`}`, false)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "nesting exceeds the maximum depth of 64")
+
+	// Brackets inside strings do not count.
+	w = create("brackets", `{"taskGroups": [{"taskCount": 1}], "labels": {"b": "`+strings.Repeat("[", 100)+`\\\""}}`, false)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+}
+
+func TestCreateJob_Notifications(t *testing.T) {
+	handler, fake := setupFakeClockHandler()
+	defer handler.Close()
+	router := setupRouter(handler)
+
+	body, _ := json.Marshal(api.Job{
+		TaskGroups: []*api.TaskGroup{{TaskCount: 1}},
+		Notifications: []*api.JobNotification{
+			{PubsubTopic: "projects/p/topics/jobs", Message: &api.NotificationMessage{Type: api.NotificationTypeJobStateChanged}},
+			{PubsubTopic: "projects/p/topics/tasks", Message: &api.NotificationMessage{Type: api.NotificationTypeTaskStateChanged, NewTaskState: api.TaskStateSucceeded}},
+		},
+	})
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/v1/projects/p/locations/l/jobs?job_id=job", bytes.NewBuffer(body)))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// The final message is published after the job is stored.
+	fake.Advance(time.Minute)
+	require.Eventually(t, func() bool {
+		return len(handler.topics.Messages("projects/p/topics/jobs")) == 4
+	}, time.Second, time.Millisecond)
+
+	messages := func(topic string) []string {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/admin/pubsub/projects/p/topics/"+topic, nil))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var response TopicMessagesResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+		var states []string
+		for _, message := range response.Messages {
+			states = append(states, message.Attributes["NewJobState"]+message.Attributes["NewTaskState"])
+		}
+		return states
+	}
+
+	assert.Equal(t, []string{"QUEUED", "SCHEDULED", "RUNNING", "SUCCEEDED"}, messages("jobs"))
+	assert.Equal(t, []string{"SUCCEEDED"}, messages("tasks"))
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("DELETE", "/admin/pubsub/projects/p/topics/jobs", nil))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Empty(t, messages("jobs"))
+
+	body, _ = json.Marshal(api.Job{Notifications: []*api.JobNotification{{PubsubTopic: "topic"}}})
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/v1/projects/p/locations/l/jobs?job_id=invalid", bytes.NewBuffer(body)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestWebhooks(t *testing.T) {
+	var mu sync.Mutex
+	var events []webhook.Event
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event webhook.Event
+		json.NewDecoder(r.Body).Decode(&event)
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, event)
+	}))
+	defer receiver.Close()
+
+	handler, fake := setupFakeClockHandler()
+	defer handler.Close()
+	router := setupRouter(handler)
+
+	body, _ := json.Marshal(webhook.Hook{URL: receiver.URL, Types: []string{api.NotificationTypeJobStateChanged}})
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/admin/webhooks", bytes.NewBuffer(body)))
+	require.Equal(t, http.StatusOK, w.Code)
+	var hook webhook.Hook
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&hook))
+	assert.NotEmpty(t, hook.ID)
+
+	body, _ = json.Marshal(webhook.Hook{URL: "not a url"})
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/admin/webhooks", bytes.NewBuffer(body)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/admin/webhooks", nil))
+	var list WebhooksResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&list))
+	require.Len(t, list.Webhooks, 1)
+
+	body, _ = json.Marshal(api.Job{TaskGroups: []*api.TaskGroup{{TaskCount: 1}}})
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/v1/projects/p/locations/l/jobs?job_id=job", bytes.NewBuffer(body)))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	fake.Advance(time.Minute)
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(events) == 4
+	}, time.Second, time.Millisecond)
+
+	mu.Lock()
+	var states []api.JobState
+	for _, event := range events {
+		assert.Equal(t, api.NotificationTypeJobStateChanged, event.Type)
+		assert.Nil(t, event.Task)
+		states = append(states, event.Job.State)
+	}
+	mu.Unlock()
+	assert.Equal(t, []api.JobState{api.JobStateQueued, api.JobStateScheduled, api.JobStateRunning, api.JobStateSucceeded}, states)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("DELETE", "/admin/webhooks/"+hook.ID, nil))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("DELETE", "/admin/webhooks/"+hook.ID, nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestCreateJob_Profiles(t *testing.T) {
+	chaos := 1.0
+	profiles := &simulation.Profiles{
+		Profiles: map[string]simulation.Profile{
+			"fast": {Timings: simulation.Timings{States: map[api.JobState]time.Duration{
+				api.JobStateQueued:    0,
+				api.JobStateScheduled: 0,
+				api.JobStateRunning:   100 * time.Millisecond,
+			}}},
+			"chaos": {TaskFailureRate: &chaos},
+		},
+		Projects: map[string]string{"fast": "fast", "chaos": "chaos"},
+	}
+	fake := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	handler := NewHandler(storage.NewMemoryStore(), WithClock(fake), WithProfiles(profiles))
+	defer handler.Close()
+	router := setupRouter(handler)
+
+	for _, project := range []string{"fast", "chaos", "default"} {
+		body, _ := json.Marshal(api.Job{TaskGroups: []*api.TaskGroup{{TaskCount: 1}}})
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/v1/projects/"+project+"/locations/l/jobs?job_id=job", bytes.NewBuffer(body)))
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+
+	state := func(project string) api.JobState {
+		job, err := handler.store.GetJob("projects/" + project + "/locations/l/jobs/job")
+		require.NoError(t, err)
+		return job.State
+	}
+
+	// Only the fast project finishes within its shortened timings
+	fake.Advance(500 * time.Millisecond)
+	require.Eventually(t, func() bool {
+		return state("fast") == api.JobStateSucceeded
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, api.JobStateQueued, state("chaos"))
+	assert.Equal(t, api.JobStateQueued, state("default"))
+
+	fake.Advance(time.Minute)
+	require.Eventually(t, func() bool {
+		return state("chaos") == api.JobStateFailed && state("default") == api.JobStateSucceeded
+	}, time.Second, time.Millisecond)
+}
+
+func TestMetrics(t *testing.T) {
+	handler, fake := setupFakeClockHandler()
+	defer handler.Close()
+	router := setupRouter(handler)
+
+	body, _ := json.Marshal(api.Job{TaskGroups: []*api.TaskGroup{{TaskCount: 1}}})
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/v1/projects/p/locations/l/jobs?job_id=job", bytes.NewBuffer(body)))
+	require.Equal(t, http.StatusOK, w.Code)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/v1/projects/p/locations/l/jobs/missing", nil))
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	fake.Advance(time.Minute)
+	require.Eventually(t, func() bool {
+		return handler.metrics.jobDurations.Count(string(api.JobStateSucceeded)) == 1
+	}, time.Second, time.Millisecond)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, metrics.ContentType, w.Header().Get("Content-Type"))
+
+	output := w.Body.String()
+	assert.Contains(t, output, `batch_api_requests_total{method="POST",route="/v1/projects/{project}/locations/{location}/jobs",code="200"} 1`)
+	assert.Contains(t, output, `batch_api_requests_total{method="GET",route="/v1/projects/{project}/locations/{location}/jobs/{job}",code="404"} 1`)
+	assert.Contains(t, output, `batch_api_request_duration_seconds_count{method="POST",route="/v1/projects/{project}/locations/{location}/jobs"} 1`)
+	assert.Contains(t, output, `batch_jobs{state="SUCCEEDED"} 1`)
+	assert.Contains(t, output, `batch_jobs{state="RUNNING"} 0`)
+	// The job spends 1s QUEUED, 1s SCHEDULED and 5s RUNNING
+	assert.Contains(t, output, `batch_job_duration_seconds_bucket{state="SUCCEEDED",le="5"} 0`)
+	assert.Contains(t, output, `batch_job_duration_seconds_bucket{state="SUCCEEDED",le="10"} 1`)
+	assert.Contains(t, output, `batch_job_duration_seconds_sum{state="SUCCEEDED"} 7`)
+}
+
+// spanRecorder keeps exported spans in memory.
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans []*tracing.Span
+}
+
+func (r *spanRecorder) Export(span *tracing.Span) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, span)
+}
+
+func (r *spanRecorder) named(name string) *tracing.Span {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, span := range r.spans {
+		if span.Name == name {
+			return span
+		}
+	}
+	return nil
+}
+
+func TestTracing(t *testing.T) {
+	exporter := &spanRecorder{}
+	fake := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	handler := NewHandlerWithConfig(storage.NewMemoryStore(), Config{Clock: fake, Tracer: tracing.NewTracer("test", exporter)})
+	defer handler.Close()
+	router := setupRouter(handler)
+
+	remote, ok := tracing.ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	require.True(t, ok)
+
+	body, _ := json.Marshal(api.Job{TaskGroups: []*api.TaskGroup{{TaskCount: 1}}})
+	req := httptest.NewRequest("POST", "/v1/projects/p/locations/l/jobs?job_id=job", bytes.NewBuffer(body))
+	req.Header.Set("traceparent", remote.Traceparent())
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	server := exporter.named("POST /v1/projects/{project}/locations/{location}/jobs")
+	require.NotNil(t, server)
+	assert.Equal(t, remote.TraceID, server.Context.TraceID)
+	assert.Equal(t, remote.SpanID, server.Parent)
+	assert.Equal(t, tracing.KindServer, server.Kind)
+
+	store := exporter.named("store.CreateJob")
+	require.NotNil(t, store)
+	assert.Equal(t, server.Context.SpanID, store.Parent)
+
+	// The simulation joins the trace of the request that submitted the job
+	fake.Advance(time.Minute)
+	require.Eventually(t, func() bool {
+		return exporter.named("simulation.run") != nil
+	}, time.Second, time.Millisecond)
+	run := exporter.named("simulation.run")
+	assert.Equal(t, remote.TraceID, run.Context.TraceID)
+	assert.Equal(t, server.Context.SpanID, run.Parent)
+	update := exporter.named("store.UpdateJob")
+	require.NotNil(t, update)
+	assert.Equal(t, run.Context.SpanID, update.Parent)
+}
+
+func TestUpdateJob(t *testing.T) {
+	handler, fake := setupFakeClockHandler()
+	router := setupRouter(handler)
+
+	job := &api.Job{TaskGroups: []*api.TaskGroup{{Name: "group1", TaskCount: 2}}}
+	require.NoError(t, handler.submitJob(context.Background(), "test-project", "us-central1", "grow", job, &simulation.Plan{}))
+
+	patch := func(mask, body string) *httptest.ResponseRecorder {
+		url := "/v1/projects/test-project/locations/us-central1/jobs/grow?updateMask=" + mask
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("PATCH", url, bytes.NewBufferString(body)))
+		return w
+	}
+
+	// Labels and the priority of a QUEUED job can be changed together
+	w := patch("labels,priority", `{"labels": {"team": "ml"}, "priority": 40}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	var response api.Job
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+	assert.Equal(t, map[string]string{"team": "ml"}, response.Labels)
+	assert.Equal(t, int32(40), response.Priority)
+	assert.Equal(t, "priority_changed", response.Status.StatusEvents[len(response.Status.StatusEvents)-1].Type)
+
+	// Fields outside the mask are left alone
+	w = patch("labels", `{"labels": {"team": "infra"}, "priority": 10}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	stored, err := handler.store.GetJob(job.Name)
+	require.NoError(t, err)
+	assert.Equal(t, "infra", stored.Labels["team"])
+	assert.Equal(t, int32(40), stored.Priority)
+
+	fake.Advance(2 * time.Second)
+	require.Eventually(t, func() bool {
+		stored, _ := handler.store.GetJob(job.Name)
+		return stored.State == api.JobStateRunning
+	}, time.Second, time.Millisecond)
+
+	// Invalid masks and changes are rejected
+	assert.Equal(t, http.StatusBadRequest, patch("", `{}`).Code)
+	assert.Equal(t, http.StatusBadRequest, patch("uid", `{}`).Code)
+	assert.Equal(t, http.StatusBadRequest, patch("priority", `{"priority": 5}`).Code)
+	assert.Equal(t, http.StatusBadRequest, patch("taskGroups[0].taskCount", `{"taskGroups": [{"taskCount": 1}]}`).Code)
+	assert.Equal(t, http.StatusBadRequest, patch("taskGroups[1].taskCount", `{"taskGroups": [{}, {"taskCount": 3}]}`).Code)
+
+	// A RUNNING job grows its task count, and the added tasks run too
+	w = patch("task_groups[0].task_count", `{"taskGroups": [{"taskCount": 4}]}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	response = api.Job{}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+	assert.Equal(t, int64(4), response.TaskGroups[0].TaskCount)
+
+	// The added tasks wait for the slots of the attempts in progress, which
+	// carry on rather than restarting.
+	tasks, err := handler.store.ListTasks(job.Name)
+	require.NoError(t, err)
+	require.Len(t, tasks, 4)
+	states := make(map[string]api.TaskState)
+	for _, task := range tasks {
+		states[task.Name[strings.LastIndex(task.Name, "/")+1:]] = task.Status.State
+		for _, event := range task.Status.StatusEvents {
+			assert.NotEqual(t, "task_resumed", event.Type, task.Name)
+		}
+	}
+	assert.Equal(t, map[string]api.TaskState{"0": api.TaskStateRunning, "1": api.TaskStateRunning, "2": api.TaskStatePending, "3": api.TaskStatePending}, states)
+
+	require.Eventually(t, func() bool {
+		fake.Advance(time.Second)
+		stored, _ := handler.store.GetJob(job.Name)
+		return stored.State == api.JobStateSucceeded
+	}, 5*time.Second, 10*time.Millisecond)
+	stored, err = handler.store.GetJob(job.Name)
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), stored.Status.TaskGroups["group1"].Counts["SUCCEEDED"])
+
+	// Finished jobs cannot grow
+	assert.Equal(t, http.StatusBadRequest, patch("taskGroups", `{"taskGroups": [{"taskCount": 5}]}`).Code)
+
+	// Unknown jobs are reported as not found
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("PATCH", "/v1/projects/test-project/locations/us-central1/jobs/missing?updateMask=labels", bytes.NewBufferString(`{}`)))
+	assert.Equal(t, http.StatusNotFound, w.Code)
 }
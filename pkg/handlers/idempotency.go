@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+	"github.com/pyshx/fake-batch-server/pkg/storage"
+)
+
+// requestIDTTL is how long the job created for a requestId is returned to
+// retries of the request, as in production.
+const requestIDTTL = time.Hour
+
+// createRequest is a CreateJob request made with a requestId.
+type createRequest struct {
+	job  string
+	time time.Time
+}
+
+// queryParam returns the value of the first of names set in the query of r,
+// for parameters accepted in both their camelCase and snake_case spelling. It
+// fails if the spellings are given different values.
+func queryParam(r *http.Request, names ...string) (string, error) {
+	value, from := "", ""
+	query := r.URL.Query()
+	for _, name := range names {
+		v := query.Get(name)
+		if v == "" {
+			continue
+		}
+		if value != "" && v != value {
+			return "", fmt.Errorf("conflicting query parameters %s=%q and %s=%q", from, value, name, v)
+		}
+		value, from = v, name
+	}
+	return value, nil
+}
+
+// validateRequestID checks that id is a non-zero UUID, as the API requires.
+func validateRequestID(id string) error {
+	parsed, err := uuid.Parse(id)
+	if err != nil || parsed == uuid.Nil {
+		return fmt.Errorf("invalid requestId %q, must be a non-zero UUID", id)
+	}
+	return nil
+}
+
+// requestedJob returns the job created by an earlier CreateJob request in
+// parent with requestID, if it was made in the last requestIDTTL and the job
+// still exists. The caller must hold h.requestMu.
+func (h *Handler) requestedJob(store storage.Store, parent, requestID string) (*api.Job, bool) {
+	now := h.clock.Now()
+	for key, request := range h.createRequests {
+		if now.Sub(request.time) >= requestIDTTL {
+			delete(h.createRequests, key)
+		}
+	}
+
+	request, ok := h.createRequests[parent+"/"+requestID]
+	if !ok {
+		return nil, false
+	}
+	job, err := store.GetJob(request.job)
+	if err != nil {
+		return nil, false
+	}
+	return job, true
+}
@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// DefaultMaxRequestBytes is the largest request body the emulated APIs
+// accept by default, the 10 MiB limit of Google APIs.
+const DefaultMaxRequestBytes = 10 << 20
+
+// maxJSONDepth is the deepest nesting of objects and arrays accepted in a
+// JSON request body. Job specs nest about ten levels deep.
+const maxJSONDepth = 64
+
+// BodyLimitMiddleware fails API requests whose body is larger than the
+// handler's MaxRequestBytes with 413, before the body is read if its length
+// is known and otherwise once reading passes the limit. The admin API and
+// the built-in object store are left alone.
+func (h *Handler) BodyLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.maxBodyBytes <= 0 || !isAPIRequest(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.ContentLength > h.maxBodyBytes {
+			writeBodyError(w, &http.MaxBytesError{Limit: h.maxBodyBytes})
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, h.maxBodyBytes)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeBodyError reports a request body that could not be read or decoded,
+// as 413 if it is larger than allowed and 400 INVALID_ARGUMENT otherwise.
+func writeBodyError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeError(w, http.StatusRequestEntityTooLarge, "Request payload size exceeds the limit: %d bytes", tooLarge.Limit)
+		return
+	}
+	writeError(w, http.StatusBadRequest, "Invalid request body: %v", err)
+}
+
+// checkDepth returns an error if the objects and arrays of the JSON document
+// data nest deeper than maxJSONDepth. It only tracks brackets, leaving the
+// rest of the syntax to the decoder.
+func checkDepth(data []byte) error {
+	depth := 0
+	inString, escaped := false, false
+	for _, c := range data {
+		switch {
+		case escaped:
+			escaped = false
+		case inString:
+			switch c {
+			case '\\':
+				escaped = true
+			case '"':
+				inString = false
+			}
+		case c == '"':
+			inString = true
+		case c == '{' || c == '[':
+			if depth++; depth > maxJSONDepth {
+				return fmt.Errorf("nesting exceeds the maximum depth of %d", maxJSONDepth)
+			}
+		case c == '}' || c == ']':
+			depth--
+		}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/pyshx/fake-batch-server/pkg/lint"
+	"github.com/pyshx/fake-batch-server/pkg/simulation"
+)
+
+// LintJobResponse is the result of linting a job spec.
+type LintJobResponse struct {
+	// Errors are the reasons CreateJob would reject the job.
+	Errors []string `json:"errors"`
+	// Warnings are best-practice violations that do not prevent submission.
+	Warnings []*lint.Warning `json:"warnings"`
+}
+
+// LintJob checks a job spec without creating it, reporting both the errors
+// CreateJob would reject it with and best-practice warnings.
+func (h *Handler) LintJob(w http.ResponseWriter, r *http.Request) {
+	job, warnings, err := decodeJob(r.Body, h.strictJSON)
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+
+	response := &LintJobResponse{Errors: []string{}}
+	plan, err := simulation.NewPlan(job, h.planDefaults(mux.Vars(r)["project"]), r.URL.Query().Get("final_state"))
+	if value := r.Header.Get(scenarioHeader); value != "" && err == nil {
+		err = simulation.ApplyOverride(plan, value, h.timings, h.scenarios)
+	}
+	if err != nil {
+		response.Errors = append(response.Errors, "Invalid simulation options: "+err.Error())
+	}
+	if err := h.checkTaskCounts(job); err != nil {
+		response.Errors = append(response.Errors, err.Error())
+	}
+	if err := validateJob(job); err != nil {
+		response.Errors = append(response.Errors, "Invalid job: "+err.Error())
+	}
+	locationWarnings, err := checkAllowedLocations(job, mux.Vars(r)["location"])
+	if err != nil {
+		response.Errors = append(response.Errors, "Invalid job: "+err.Error())
+	}
+	if err := h.checkResources(job); err != nil {
+		response.Errors = append(response.Errors, "Invalid job: "+err.Error())
+	}
+	catalogWarnings, err := h.checkCatalog(job, mux.Vars(r)["location"])
+	if err != nil {
+		response.Errors = append(response.Errors, "Invalid job: "+err.Error())
+	}
+	if err := h.checkImages(r.Context(), job); err != nil {
+		response.Errors = append(response.Errors, "Invalid job: "+err.Error())
+	}
+	warnings = append(append(warnings, lint.Check(job)...), locationWarnings...)
+	response.Warnings = append(warnings, catalogWarnings...)
+
+	writeJSON(w, http.StatusOK, response)
+}
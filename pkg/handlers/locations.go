@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+	"github.com/pyshx/fake-batch-server/pkg/lint"
+)
+
+var (
+	regionName = regexp.MustCompile(`^[a-z]+(-[a-z]+)+[0-9]+$`)
+	zoneName   = regexp.MustCompile(`^([a-z]+(-[a-z]+)+[0-9]+)-[a-z]$`)
+)
+
+// checkAllowedLocations validates the allowedLocations of job, a job of
+// location, like the service does: each must be regions/REGION or
+// zones/ZONE, within location. Bare region and zone names, which the
+// service rejects, are rewritten to the prefixed form and reported as
+// warnings.
+func checkAllowedLocations(job *api.Job, location string) ([]*lint.Warning, error) {
+	if job.AllocationPolicy == nil || job.AllocationPolicy.Location == nil {
+		return nil, nil
+	}
+
+	var warnings []*lint.Warning
+	allowed := job.AllocationPolicy.Location.AllowedLocations
+	for i, value := range allowed {
+		field := fmt.Sprintf("allocationPolicy.location.allowedLocations[%d]", i)
+		if !strings.HasPrefix(value, "regions/") && !strings.HasPrefix(value, "zones/") {
+			switch {
+			case regionName.MatchString(value):
+				allowed[i] = "regions/" + value
+			case zoneName.MatchString(value):
+				allowed[i] = "zones/" + value
+			}
+			if allowed[i] != value {
+				warnings = append(warnings, &lint.Warning{Kind: lint.KindLocationShorthand, Field: field,
+					Message: fmt.Sprintf("%s is not a location the service accepts; use %s", value, allowed[i])})
+			}
+		}
+
+		var region string
+		if name, ok := strings.CutPrefix(allowed[i], "regions/"); ok && regionName.MatchString(name) {
+			region = name
+		} else if name, ok := strings.CutPrefix(allowed[i], "zones/"); ok && zoneName.MatchString(name) {
+			region = zoneName.FindStringSubmatch(name)[1]
+		} else {
+			return nil, fmt.Errorf("%s: invalid location %q, must be regions/REGION or zones/ZONE", field, value)
+		}
+		if region != location {
+			return nil, fmt.Errorf("%s: %s is not in the job's region %s", field, allowed[i], location)
+		}
+	}
+	return warnings, nil
+}
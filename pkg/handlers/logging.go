@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+	"github.com/pyshx/fake-batch-server/pkg/logging"
+	"github.com/pyshx/fake-batch-server/pkg/simulation"
+)
+
+// ListLogEntries implements the Cloud Logging entries:list method over the
+// captured output of tasks of jobs logging to CLOUD_LOGGING and the entries
+// written with WriteLogEntries.
+func (h *Handler) ListLogEntries(w http.ResponseWriter, r *http.Request) {
+	var req logging.ListRequest
+	if err := h.decodeBody(r.Body, &req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+
+	filter, err := logging.ParseFilter(req.Filter)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid filter: %v", err)
+		return
+	}
+
+	offset := 0
+	if req.PageToken != "" {
+		var err error
+		if _, offset, err = decodePageToken(req.PageToken); err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid page token")
+			return
+		}
+	}
+	if req.PageSize <= 0 || req.PageSize > maxPageSize {
+		req.PageSize = maxPageSize
+	}
+
+	var entries []*logging.LogEntry
+	for _, entry := range append(h.taskLogEntries(), h.logging.Entries()...) {
+		// Stop filtering as soon as the client gives up.
+		if err := r.Context().Err(); err != nil {
+			writeContextError(w, err)
+			return
+		}
+		if logging.InResources(entry, req.ResourceNames) && filter.Match(entry) {
+			entries = append(entries, entry)
+		}
+	}
+	logging.Sort(entries, req.OrderBy)
+
+	response := &logging.ListResponse{Entries: []*logging.LogEntry{}}
+	if offset < len(entries) {
+		end := offset + req.PageSize
+		if end < len(entries) {
+			response.NextPageToken = encodePageToken("entries", end)
+		} else {
+			end = len(entries)
+		}
+		response.Entries = entries[offset:end]
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// WriteLogEntries implements the Cloud Logging entries:write method.
+func (h *Handler) WriteLogEntries(w http.ResponseWriter, r *http.Request) {
+	var req logging.WriteRequest
+	if err := h.decodeBody(r.Body, &req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+
+	for i, entry := range req.Entries {
+		if entry.LogName == "" && req.LogName == "" {
+			writeError(w, http.StatusBadRequest, "Entry %d has no logName", i)
+			return
+		}
+	}
+
+	h.logging.Write(&req, h.clock.Now())
+	writeJSON(w, http.StatusOK, struct{}{})
+}
+
+// taskLogEntries converts the captured output of every task of jobs logging
+// to Cloud Logging into log entries, labelled the way Batch labels them.
+func (h *Handler) taskLogEntries() []*logging.LogEntry {
+	var entries []*logging.LogEntry
+
+	snap := h.store.Snapshot()
+	for _, job := range snap.Jobs {
+		if !isCloudLogging(job) {
+			continue
+		}
+
+		// projects/{project}/locations/{location}/jobs/{job}
+		parts := strings.Split(job.Name, "/")
+		if len(parts) != 6 {
+			continue
+		}
+		project, location, jobID := parts[1], parts[3], parts[5]
+
+		resource := &logging.MonitoredResource{
+			Type: logging.JobResourceType,
+			Labels: map[string]string{
+				"job_uid":            job.UID,
+				"job_id":             jobID,
+				"location":           location,
+				"resource_container": "projects/" + project,
+			},
+		}
+
+		for _, task := range snap.Tasks[job.Name] {
+			taskID := fmt.Sprintf("task/%s-%s-%d/0/0", job.UID, simulation.TaskGroupName(task.Name), simulation.TaskIndex(task.Name))
+			for i, line := range h.logs.Entries(task.Name) {
+				entries = append(entries, &logging.LogEntry{
+					LogName:   fmt.Sprintf("projects/%s/logs/%s", project, logging.TaskLogName),
+					Resource:  resource,
+					Timestamp: line.Time,
+					Severity:  "INFO",
+					InsertID:  fmt.Sprintf("%s-%d", taskID, i),
+					Labels: map[string]string{
+						"job_uid":        job.UID,
+						"task_id":        taskID,
+						"runnable_index": strconv.Itoa(line.Runnable),
+					},
+					TextPayload: line.Text,
+				})
+			}
+		}
+	}
+
+	return entries
+}
+
+// isCloudLogging reports whether job sends its task logs to Cloud Logging.
+func isCloudLogging(job *api.Job) bool {
+	return job.LogsPolicy == nil || job.LogsPolicy.Destination == "" || job.LogsPolicy.Destination == "CLOUD_LOGGING"
+}
@@ -0,0 +1,112 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+	"github.com/pyshx/fake-batch-server/pkg/logs"
+	"github.com/pyshx/fake-batch-server/pkg/simulation"
+)
+
+// logsDestinationPath is the logsPolicy.destination that writes task logs to
+// files under logsPolicy.logsPath.
+const logsDestinationPath = "PATH"
+
+// TaskLogsResponse is returned by GetTaskLogs.
+type TaskLogsResponse struct {
+	Entries []logs.Entry `json:"entries"`
+}
+
+// GetTaskLogs returns the output captured for a task. With follow=true the
+// output is streamed as newline-delimited JSON entries until the task
+// finishes or the client disconnects.
+func (h *Handler) GetTaskLogs(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	jobName := fmt.Sprintf("projects/%s/locations/%s/jobs/%s", vars["project"], vars["location"], vars["job"])
+	taskName := fmt.Sprintf("%s/taskGroups/%s/tasks/%s", jobName, vars["group"], vars["task"])
+
+	follow := false
+	if value := r.URL.Query().Get("follow"); value != "" {
+		var err error
+		if follow, err = strconv.ParseBool(value); err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid follow %q", value)
+			return
+		}
+	}
+
+	if _, err := h.storeFor(r).GetTask(jobName, taskName); err != nil {
+		writeError(w, http.StatusNotFound, "Task not found: %v", err)
+		return
+	}
+
+	if !follow {
+		writeJSON(w, http.StatusOK, &TaskLogsResponse{Entries: h.logs.Entries(taskName)})
+		return
+	}
+
+	clearWriteDeadline(w)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	encoder := json.NewEncoder(w)
+	err := h.logs.Follow(r.Context(), taskName, func(entry logs.Entry) error {
+		if err := encoder.Encode(entry); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	})
+	if err != nil && r.Context().Err() == nil {
+		logrus.Errorf("Failed to stream logs of %s: %v", taskName, err)
+	}
+}
+
+// mirrorLogs writes the output of the tasks of job to files under its
+// logsPath if its logsPolicy asks for it. Every task gets its own file,
+// <logsPath>/<job UID>/<task group>/task-<index>.log. A gs:// logsPath is
+// written to the configured Cloud Storage emulator with the same layout.
+func (h *Handler) mirrorLogs(job *api.Job) {
+	if job.LogsPolicy == nil || job.LogsPolicy.Destination != logsDestinationPath {
+		return
+	}
+
+	tasks, err := h.store.ListTasks(job.Name)
+	if err != nil {
+		logrus.Errorf("Failed to list tasks of %s: %v", job.Name, err)
+		return
+	}
+
+	if bucket, prefix, ok := logs.ParseGCSURL(job.LogsPolicy.LogsPath); ok {
+		if h.gcs == nil {
+			logrus.Warnf("Not writing task logs of %s to %s; no Cloud Storage endpoint is configured", job.Name, job.LogsPolicy.LogsPath)
+			return
+		}
+		for _, task := range tasks {
+			object := path.Join(prefix, job.UID, simulation.TaskGroupName(task.Name), fmt.Sprintf("task-%d.log", simulation.TaskIndex(task.Name)))
+			h.logs.Mirror(task.Name, h.gcs.Writer(bucket, object))
+		}
+		logrus.Infof("Writing task logs of %s to %s", job.Name, job.LogsPolicy.LogsPath)
+		return
+	}
+
+	dir := filepath.Join(h.logsRoot, job.LogsPolicy.LogsPath, job.UID)
+	for _, task := range tasks {
+		path := filepath.Join(dir, simulation.TaskGroupName(task.Name), fmt.Sprintf("task-%d.log", simulation.TaskIndex(task.Name)))
+		h.logs.Mirror(task.Name, logs.NewFileWriter(path))
+	}
+	logrus.Infof("Writing task logs of %s to %s", job.Name, dir)
+}
@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+	"github.com/pyshx/fake-batch-server/pkg/metrics"
+)
+
+// jobDurationBuckets are the histogram buckets, in seconds, of simulated job
+// durations.
+var jobDurationBuckets = []float64{1, 5, 10, 30, 60, 300, 600, 1800, 3600}
+
+// jobStates are the states reported by the jobs gauge even when no job is in
+// them.
+var jobStates = []api.JobState{
+	api.JobStateQueued,
+	api.JobStateScheduled,
+	api.JobStateRunning,
+	api.JobStateSucceeded,
+	api.JobStateFailed,
+	api.JobStateDeleting,
+}
+
+// serverMetrics are the metrics served on /metrics.
+type serverMetrics struct {
+	registry     *metrics.Registry
+	requests     *metrics.CounterVec
+	latency      *metrics.HistogramVec
+	jobDurations *metrics.HistogramVec
+}
+
+// newServerMetrics registers the metrics of h.
+func newServerMetrics(h *Handler) *serverMetrics {
+	registry := metrics.NewRegistry()
+	m := &serverMetrics{
+		registry: registry,
+		requests: registry.NewCounterVec("batch_api_requests_total",
+			"API requests handled, by method, route and status code.", "method", "route", "code"),
+		latency: registry.NewHistogramVec("batch_api_request_duration_seconds",
+			"Time taken to handle API requests, by method and route.", metrics.DefaultBuckets, "method", "route"),
+		jobDurations: registry.NewHistogramVec("batch_job_duration_seconds",
+			"Simulated time from creation to the terminal state of jobs, by final state.", jobDurationBuckets, "state"),
+	}
+
+	registry.NewGaugeFunc("batch_jobs", "Jobs currently stored, by state.", []string{"state"},
+		func(emit func(float64, ...string)) {
+			counts := make(map[api.JobState]int)
+			for _, job := range h.store.Snapshot().Jobs {
+				counts[job.State]++
+			}
+			for _, state := range jobStates {
+				emit(float64(counts[state]), string(state))
+			}
+			// Report unusual states too, such as DELETED.
+			for state, count := range counts {
+				emit(float64(count), string(state))
+			}
+		})
+	registry.NewGaugeFunc("batch_simulation_goroutines", "Goroutines tracked by the simulator, by kind.", []string{"kind"},
+		func(emit func(float64, ...string)) {
+			stats := h.sim.Stats()
+			emit(float64(stats.Runners), "runner")
+			emit(float64(stats.Background), "background")
+		})
+	registry.NewGaugeFunc("batch_scheduler_waiting_jobs", "Jobs waiting for a scheduler slot, by tenant.", []string{"tenant"},
+		func(emit func(float64, ...string)) {
+			if stats := h.sim.Stats().Scheduler; stats != nil {
+				for tenant, t := range stats.Tenants {
+					emit(float64(t.Waiting), tenant)
+				}
+			}
+		})
+	registry.NewGaugeFunc("batch_scheduler_wait_seconds_total", "Total time jobs waited for a scheduler slot, by tenant.", []string{"tenant"},
+		func(emit func(float64, ...string)) {
+			if stats := h.sim.Stats().Scheduler; stats != nil {
+				for tenant, t := range stats.Tenants {
+					emit(t.TotalWaitSeconds, tenant)
+				}
+			}
+		})
+
+	return m
+}
+
+// jobFinished records the duration of a job that reached a terminal state
+// at the given time.
+func (m *serverMetrics) jobFinished(job *api.Job, at time.Time) {
+	switch job.State {
+	case api.JobStateSucceeded, api.JobStateFailed, api.JobStateCancelled:
+	default:
+		return
+	}
+	m.jobDurations.Observe(at.Sub(job.CreateTime).Seconds(), string(job.State))
+}
+
+// Metrics serves the server metrics in the Prometheus text format.
+func (h *Handler) Metrics(w http.ResponseWriter, r *http.Request) {
+	h.metrics.registry.ServeHTTP(w, r)
+}
+
+// MetricsMiddleware counts and times the requests handled by next, labelled
+// with the path template of the matched route to keep cardinality bounded.
+func (h *Handler) MetricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		route := routeTemplate(r)
+		h.metrics.requests.Inc(r.Method, route, strconv.Itoa(recorder.status))
+		h.metrics.latency.Observe(time.Since(start).Seconds(), r.Method, route)
+	})
+}
+
+// routeTemplate returns the path template of the route r matched.
+func routeTemplate(r *http.Request) string {
+	if current := mux.CurrentRoute(r); current != nil {
+		if template, err := current.GetPathTemplate(); err == nil {
+			return template
+		}
+	}
+	return "unmatched"
+}
+
+// statusRecorder remembers the status code written through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// Flush lets streaming handlers such as WatchJob flush through the recorder.
+func (s *statusRecorder) Flush() {
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap lets an http.ResponseController reach the connection's writer.
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+)
+
+// checkpointMigration upgrades a decoded checkpoint from one schema version to
+// the next, in place.
+type checkpointMigration func(checkpoint map[string]interface{}) error
+
+// checkpointMigrations upgrade the checkpoints of older servers. The migration
+// at index i takes schema version i to i+1, and Checkpoint writes version
+// len(checkpointMigrations). Append to it whenever the layout of Checkpoint or
+// of the stored resources changes in a way older files do not decode into.
+var checkpointMigrations = []checkpointMigration{
+	// Version 0 checkpoints predate schemaVersion and share the layout of
+	// version 1.
+	func(map[string]interface{}) error { return nil },
+}
+
+// checkpointSchemaVersion returns the schema version Checkpoint writes.
+func checkpointSchemaVersion() int {
+	return len(checkpointMigrations)
+}
+
+// migrateCheckpoint upgrades the checkpoint read from path to the current
+// schema version and returns it. A migrated checkpoint is written back to
+// path, keeping the original next to it as path.v<version> for servers of the
+// previous version. Checkpoints of a newer version are refused rather than
+// loaded partially.
+func migrateCheckpoint(path string, data []byte) ([]byte, error) {
+	var checkpoint map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&checkpoint); err != nil {
+		return nil, fmt.Errorf("failed to parse checkpoint %s: %v", path, err)
+	}
+
+	version := 0
+	if raw, ok := checkpoint["schemaVersion"]; ok {
+		number, ok := raw.(json.Number)
+		v, err := number.Int64()
+		if !ok || err != nil || v < 0 {
+			return nil, fmt.Errorf("checkpoint %s has invalid schemaVersion %v", path, raw)
+		}
+		version = int(v)
+	}
+
+	current := checkpointSchemaVersion()
+	if version > current {
+		return nil, fmt.Errorf("checkpoint %s has schema version %d, newer than the %d this server supports", path, version, current)
+	}
+	if version == current {
+		return data, nil
+	}
+
+	backup := fmt.Sprintf("%s.v%d", path, version)
+	if err := writeFileAtomic(backup, data); err != nil {
+		return nil, fmt.Errorf("failed to back up checkpoint %s: %v", path, err)
+	}
+	for v := version; v < current; v++ {
+		if err := checkpointMigrations[v](checkpoint); err != nil {
+			return nil, fmt.Errorf("failed to migrate checkpoint %s from schema version %d: %v", path, v, err)
+		}
+	}
+	checkpoint["schemaVersion"] = current
+
+	migrated, err := json.MarshalIndent(checkpoint, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(path, migrated); err != nil {
+		return nil, fmt.Errorf("failed to write migrated checkpoint %s: %v", path, err)
+	}
+	logrus.Infof("Migrated checkpoint %s from schema version %d to %d, keeping the original as %s", path, version, current, backup)
+	return migrated, nil
+}
+
+// writeFileAtomic writes data to path through a temporary file, so that a
+// crash mid-write leaves the previous contents intact.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,169 @@
+package handlers
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+	"github.com/pyshx/fake-batch-server/pkg/catalog"
+	"github.com/pyshx/fake-batch-server/pkg/clock"
+	"github.com/pyshx/fake-batch-server/pkg/executor"
+	"github.com/pyshx/fake-batch-server/pkg/registry"
+	"github.com/pyshx/fake-batch-server/pkg/simulation"
+)
+
+// Simulator drives submitted jobs through their lifecycle. It is implemented
+// by *simulation.Engine.
+type Simulator interface {
+	// Start begins simulating job according to plan.
+	Start(job *api.Job, plan *simulation.Plan)
+	// Resume continues simulating job from the state it is stored in.
+	Resume(job *api.Job, plan *simulation.Plan)
+	// Recover continues simulating job, restored after a restart, from the
+	// state it is stored in, timing what is left of that state from its
+	// stored timestamps.
+	Recover(job *api.Job, plan *simulation.Plan)
+	// Plans returns the plans of the jobs being simulated, keyed by job
+	// name.
+	Plans() map[string]*simulation.Plan
+	// Running reports whether the job named name is being simulated.
+	Running(name string) bool
+	// Stop ends the simulation of the job named name and reports whether one
+	// was running.
+	Stop(name string) bool
+	// Reprioritize changes the priority the job named name waits for
+	// capacity with.
+	Reprioritize(name string, priority int32)
+	// Update calls fn with the job named name between the steps of its
+	// simulation and saves it unless fn fails. It reports false, without
+	// calling fn, if the job is not being simulated.
+	Update(name string, fn func(job *api.Job) error) (bool, error)
+	// Complete announces that job, which is not being simulated, was moved
+	// to a terminal state at the given time, like a simulated job completing.
+	Complete(ctx context.Context, job *api.Job, at time.Time)
+	// Go runs fn in the background until it returns or the simulator shuts
+	// down.
+	Go(fn func(ctx context.Context))
+	// Shutdown stops every simulation and background function and waits for
+	// them to exit.
+	Shutdown()
+	// Reset stops every simulation and background function like Shutdown,
+	// but keeps accepting new ones.
+	Reset()
+	// Stats reports the simulations currently running.
+	Stats() simulation.Stats
+}
+
+var _ Simulator = (*simulation.Engine)(nil)
+
+// IDGenerator generates the unique IDs of jobs and operations.
+type IDGenerator interface {
+	NewID() string
+}
+
+// ImageChecker looks up container images before jobs using them are
+// created. It is implemented by *registry.Checker and *executor.Docker.
+type ImageChecker interface {
+	// ImageExists reports whether image can be pulled.
+	ImageExists(ctx context.Context, image string) (bool, error)
+}
+
+var (
+	_ ImageChecker = (*registry.Checker)(nil)
+	_ ImageChecker = (*executor.Docker)(nil)
+)
+
+// uuidGenerator generates random UUIDs.
+type uuidGenerator struct{}
+
+func (uuidGenerator) NewID() string {
+	return uuid.New().String()
+}
+
+// Option configures a Handler created with NewHandler.
+type Option func(*Config)
+
+// WithClock sets the time source of the handler and its simulator.
+func WithClock(c clock.Clock) Option {
+	return func(cfg *Config) {
+		cfg.Clock = c
+	}
+}
+
+// WithTimings sets the simulated job lifecycle timings.
+func WithTimings(timings simulation.Timings) Option {
+	return func(cfg *Config) {
+		cfg.Timings = timings
+	}
+}
+
+// WithProfiles selects the simulation settings of each project from profiles.
+func WithProfiles(profiles *simulation.Profiles) Option {
+	return func(cfg *Config) {
+		cfg.Profiles = profiles
+	}
+}
+
+// WithMaxTaskCount sets the most tasks a task group may have.
+func WithMaxTaskCount(max int64) Option {
+	return func(cfg *Config) {
+		cfg.MaxTaskCount = max
+	}
+}
+
+// WithSimulator replaces the simulation engine, e.g. with a stub in tests.
+func WithSimulator(sim Simulator) Option {
+	return func(cfg *Config) {
+		cfg.Simulator = sim
+	}
+}
+
+// WithIDGenerator sets the generator of job and operation IDs.
+func WithIDGenerator(ids IDGenerator) Option {
+	return func(cfg *Config) {
+		cfg.IDGenerator = ids
+	}
+}
+
+// WithRetention removes finished jobs according to policy.
+func WithRetention(policy Retention) Option {
+	return func(cfg *Config) {
+		cfg.Retention = policy
+	}
+}
+
+// WithImageChecker makes CreateJob reject jobs whose container images do not
+// exist.
+func WithImageChecker(images ImageChecker) Option {
+	return func(cfg *Config) {
+		cfg.ImageChecker = images
+	}
+}
+
+// WithCatalog makes CreateJob check the machine and accelerator types of
+// jobs against c, warning about those it does not offer, or rejecting the
+// job if strict is set.
+func WithCatalog(c *catalog.Catalog, strict bool) Option {
+	return func(cfg *Config) {
+		cfg.Catalog = c
+		cfg.StrictCatalog = strict
+	}
+}
+
+// WithStrictJSON makes the handlers reject request bodies with unknown
+// fields.
+func WithStrictJSON() Option {
+	return func(cfg *Config) {
+		cfg.StrictJSON = true
+	}
+}
+
+// shortID truncates id to the eight characters used in generated job IDs.
+func shortID(id string) string {
+	if len(id) > 8 {
+		return id[:8]
+	}
+	return id
+}
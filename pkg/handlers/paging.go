@@ -0,0 +1,199 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+)
+
+const (
+	// maxPageSize caps the pageSize of list requests.
+	maxPageSize = 1000
+	// cursorTTL is how long a page token stays valid after its last use.
+	cursorTTL = 30 * time.Minute
+)
+
+// cursor is the listing snapshot behind a page token: the names that existed
+// when the first page was requested, in order.
+type cursor struct {
+	parent  string
+	names   listing
+	expires time.Time
+}
+
+// listing is the ordered names of a listing.
+type listing interface {
+	Len() int
+	Name(i int) string
+}
+
+// nameList is a listing held in full.
+type nameList []string
+
+func (l nameList) Len() int { return len(l) }
+
+func (l nameList) Name(i int) string { return l[i] }
+
+// taskList lists the tasks of a job by task group name and then index,
+// naming each task on demand so that task groups of millions of tasks do not
+// have their names held in memory.
+type taskList struct {
+	job    string
+	groups []*api.TaskGroup
+}
+
+// newTaskList returns the listing of the tasks of job.
+func newTaskList(job *api.Job) *taskList {
+	groups := append([]*api.TaskGroup(nil), job.TaskGroups...)
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+	return &taskList{job: job.Name, groups: groups}
+}
+
+func (l *taskList) Len() int {
+	n := 0
+	for _, group := range l.groups {
+		n += int(group.TaskCount)
+	}
+	return n
+}
+
+func (l *taskList) Name(i int) string {
+	for _, group := range l.groups {
+		if i < int(group.TaskCount) {
+			return fmt.Sprintf("%s/taskGroups/%s/tasks/%d", l.job, group.Name, i)
+		}
+		i -= int(group.TaskCount)
+	}
+	return ""
+}
+
+// cursors hands out page tokens that point into snapshots of a listing, so
+// paging stays stable while jobs are created and deleted: every entry that
+// exists for the whole listing is returned exactly once, entries deleted in
+// the meantime are skipped and entries created after the first page are not
+// included.
+type cursors struct {
+	mu      sync.Mutex
+	entries map[string]*cursor
+}
+
+func newCursors() *cursors {
+	return &cursors{entries: make(map[string]*cursor)}
+}
+
+// pageRequest holds the paging parameters of a list request.
+type pageRequest struct {
+	size  int
+	token string
+}
+
+// parsePageRequest reads the pageSize and pageToken query parameters. A zero
+// size without a token means the whole listing is returned at once.
+func parsePageRequest(r *http.Request) (pageRequest, error) {
+	req := pageRequest{token: r.URL.Query().Get("pageToken")}
+
+	if value := r.URL.Query().Get("pageSize"); value != "" {
+		size, err := strconv.Atoi(value)
+		if err != nil || size < 0 {
+			return req, fmt.Errorf("invalid pageSize %q", value)
+		}
+		req.size = size
+	}
+	if req.size > maxPageSize || (req.size == 0 && req.token != "") {
+		req.size = maxPageSize
+	}
+
+	return req, nil
+}
+
+// page returns the next names of the listing of parent and the token for the
+// page after it, which is empty on the last page. names returns the listing
+// and is only called for the first page; later pages come from the snapshot
+// it returned. exists reports whether a name is still present so deleted
+// entries can be skipped.
+func (c *cursors) page(parent string, req pageRequest, names func() listing, exists func(string) bool) ([]string, string, error) {
+	if req.size == 0 {
+		all := names()
+		page := make([]string, 0, all.Len())
+		for i := 0; i < all.Len(); i++ {
+			page = append(page, all.Name(i))
+		}
+		return page, "", nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.expire(now)
+
+	var id string
+	var cur *cursor
+	offset := 0
+	if req.token == "" {
+		id = uuid.New().String()
+		cur = &cursor{parent: parent, names: names()}
+		c.entries[id] = cur
+	} else {
+		var err error
+		id, offset, err = decodePageToken(req.token)
+		if err != nil {
+			return nil, "", err
+		}
+		cur = c.entries[id]
+		if cur == nil || cur.parent != parent || offset > cur.names.Len() {
+			return nil, "", fmt.Errorf("invalid or expired page token")
+		}
+	}
+	cur.expires = now.Add(cursorTTL)
+
+	var page []string
+	for offset < cur.names.Len() && len(page) < req.size {
+		if name := cur.names.Name(offset); exists(name) {
+			page = append(page, name)
+		}
+		offset++
+	}
+
+	if offset >= cur.names.Len() {
+		delete(c.entries, id)
+		return page, "", nil
+	}
+	return page, encodePageToken(id, offset), nil
+}
+
+// expire drops cursors that have not been used for cursorTTL.
+func (c *cursors) expire(now time.Time) {
+	for id, cur := range c.entries {
+		if now.After(cur.expires) {
+			delete(c.entries, id)
+		}
+	}
+}
+
+func encodePageToken(id string, offset int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%d", id, offset)))
+}
+
+func decodePageToken(token string) (string, int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid page token")
+	}
+
+	id, value, ok := strings.Cut(string(data), ":")
+	offset, err := strconv.Atoi(value)
+	if !ok || err != nil || offset < 0 {
+		return "", 0, fmt.Errorf("invalid page token")
+	}
+	return id, offset, nil
+}
@@ -0,0 +1,211 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/yaml.v3"
+)
+
+// Projects is the registry of tenant mode: the project IDs API requests may
+// name. Requests for any other project fail with PERMISSION_DENIED, as the
+// service answers for projects that do not exist or the caller cannot see, so
+// that teams sharing an emulator cannot use each other's project names by
+// accident. A nil *Projects allows every project.
+type Projects struct {
+	mu  sync.RWMutex
+	ids map[string]bool
+}
+
+// NewProjects creates a registry of ids.
+func NewProjects(ids []string) (*Projects, error) {
+	p := &Projects{ids: make(map[string]bool, len(ids))}
+	for i, id := range ids {
+		if err := validateProjectID(id); err != nil {
+			return nil, fmt.Errorf("projects[%d]: %v", i, err)
+		}
+		if p.ids[id] {
+			return nil, fmt.Errorf("projects[%d]: duplicate project %s", i, id)
+		}
+		p.ids[id] = true
+	}
+	return p, nil
+}
+
+// LoadProjects reads the registered projects from a YAML or JSON file, e.g.:
+//
+//	projects: [team-a-dev, team-b-dev]
+func LoadProjects(path string) (*Projects, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config struct {
+		Projects []string `yaml:"projects"`
+	}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse projects config %s: %v", path, err)
+	}
+	projects, err := NewProjects(config.Projects)
+	if err != nil {
+		return nil, fmt.Errorf("invalid projects config %s: %v", path, err)
+	}
+	return projects, nil
+}
+
+func validateProjectID(id string) error {
+	switch {
+	case id == "":
+		return fmt.Errorf("project ID is required")
+	case strings.ContainsAny(id, "/ "):
+		return fmt.Errorf("invalid project ID %q", id)
+	}
+	return nil
+}
+
+// Allows reports whether id is registered, or p is nil.
+func (p *Projects) Allows(id string) bool {
+	if p == nil {
+		return true
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.ids[id]
+}
+
+// Register adds id to the registry. It reports false if id was already
+// registered.
+func (p *Projects) Register(id string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.ids[id] {
+		return false
+	}
+	p.ids[id] = true
+	return true
+}
+
+// Unregister removes id from the registry. It reports false if id was not
+// registered.
+func (p *Projects) Unregister(id string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.ids[id] {
+		return false
+	}
+	delete(p.ids, id)
+	return true
+}
+
+// List returns the registered project IDs, sorted.
+func (p *Projects) List() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	ids := make([]string, 0, len(p.ids))
+	for id := range p.ids {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// TenantMiddleware fails API requests for a project that is not registered
+// with 403 PERMISSION_DENIED when the handler runs in tenant mode. Requests
+// that do not name their project are checked by their handlers.
+func (h *Handler) TenantMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if project := mux.Vars(r)["project"]; isAPIRequest(r.URL.Path) && project != "" && !h.projects.Allows(project) {
+			writeProjectDenied(w, project)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeProjectDenied fails a request for project, which is not registered.
+func writeProjectDenied(w http.ResponseWriter, project string) {
+	writeError(w, http.StatusForbidden, "Permission denied on resource project %s (or it may not exist)", project)
+}
+
+// ProjectList is returned by ListProjects.
+type ProjectList struct {
+	Projects []string `json:"projects"`
+}
+
+// RegisterProjectRequest is the body of RegisterProject.
+type RegisterProjectRequest struct {
+	ProjectID string `json:"projectId"`
+}
+
+// ListProjects returns the projects registered for tenant mode.
+func (h *Handler) ListProjects(w http.ResponseWriter, r *http.Request) {
+	if !h.tenantMode(w) {
+		return
+	}
+	writeJSON(w, http.StatusOK, &ProjectList{Projects: h.projects.List()})
+}
+
+// RegisterProject registers a project for tenant mode. A project that is
+// already registered fails with 409 ALREADY_EXISTS, so that a second team
+// picking the same name finds out.
+func (h *Handler) RegisterProject(w http.ResponseWriter, r *http.Request) {
+	if !h.tenantMode(w) {
+		return
+	}
+	var req RegisterProjectRequest
+	if err := h.decodeBody(r.Body, &req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if err := validateProjectID(req.ProjectID); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid project: %v", err)
+		return
+	}
+
+	if !h.projects.Register(req.ProjectID) {
+		writeError(w, http.StatusConflict, "Project %s is already registered", req.ProjectID)
+		return
+	}
+	requestLog(w).Infof("Registered project %s", req.ProjectID)
+	writeJSON(w, http.StatusOK, &req)
+}
+
+// UnregisterProject removes a project from the registry of tenant mode. A
+// project that still has jobs is refused, its jobs being out of reach once it
+// is gone; delete them first.
+func (h *Handler) UnregisterProject(w http.ResponseWriter, r *http.Request) {
+	if !h.tenantMode(w) {
+		return
+	}
+	project := mux.Vars(r)["project"]
+	if !h.projects.Allows(project) {
+		writeError(w, http.StatusNotFound, "Project %s is not registered", project)
+		return
+	}
+	for _, job := range h.store.Snapshot().Jobs {
+		if strings.HasPrefix(job.Name, "projects/"+project+"/") {
+			writeError(w, http.StatusBadRequest, "Project %s still has jobs, e.g. %s; delete them first", project, job.Name)
+			return
+		}
+	}
+
+	h.projects.Unregister(project)
+	requestLog(w).Infof("Unregistered project %s", project)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// tenantMode reports whether the handler runs in tenant mode, failing the
+// request if it does not.
+func (h *Handler) tenantMode(w http.ResponseWriter) bool {
+	if h.projects == nil {
+		writeError(w, http.StatusBadRequest, "Tenant mode is off; start the server with --tenant-mode or --projects-config")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,187 @@
+package handlers
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+)
+
+// Quota limits the jobs of a project. Zero fields are unlimited.
+type Quota struct {
+	// JobsPerMinute is the most jobs created in any minute. Further
+	// CreateJob calls fail with RESOURCE_EXHAUSTED.
+	JobsPerMinute int `yaml:"jobsPerMinute"`
+	// MaxRunningJobs is the most jobs past QUEUED at once. Further jobs stay
+	// QUEUED until one ends. It counts the jobs of the scheduler tenant,
+	// which is the project unless the fake-batch/tenant label is set.
+	MaxRunningJobs int `yaml:"maxRunningJobs"`
+	// MaxCPUMilli is the most cpuMilli of tasks running at once across the
+	// unfinished jobs of a location, counting each task group at its
+	// parallelism. Jobs that would exceed it fail with RESOURCE_EXHAUSTED.
+	MaxCPUMilli int64 `yaml:"maxCpuMilli"`
+}
+
+// Quotas maps projects to quotas.
+type Quotas struct {
+	// Default applies to projects not listed in Projects.
+	Default  Quota            `yaml:"default"`
+	Projects map[string]Quota `yaml:"projects"`
+}
+
+// LoadQuotas reads quotas from a YAML or JSON file, e.g.:
+//
+//	default:
+//	  jobsPerMinute: 60
+//	  maxRunningJobs: 10
+//	projects:
+//	  load-tests:
+//	    maxCpuMilli: 64000
+func LoadQuotas(path string) (*Quotas, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var quotas Quotas
+	if err := yaml.Unmarshal(data, &quotas); err != nil {
+		return nil, fmt.Errorf("failed to parse quotas config %s: %v", path, err)
+	}
+	if err := quotas.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid quotas config %s: %v", path, err)
+	}
+	return &quotas, nil
+}
+
+// Validate checks that no quota is negative.
+func (q *Quotas) Validate() error {
+	if err := q.Default.validate(); err != nil {
+		return fmt.Errorf("default: %v", err)
+	}
+	for project, quota := range q.Projects {
+		if err := quota.validate(); err != nil {
+			return fmt.Errorf("project %s: %v", project, err)
+		}
+	}
+	return nil
+}
+
+func (q Quota) validate() error {
+	switch {
+	case q.JobsPerMinute < 0:
+		return fmt.Errorf("negative jobsPerMinute %d", q.JobsPerMinute)
+	case q.MaxRunningJobs < 0:
+		return fmt.Errorf("negative maxRunningJobs %d", q.MaxRunningJobs)
+	case q.MaxCPUMilli < 0:
+		return fmt.Errorf("negative maxCpuMilli %d", q.MaxCPUMilli)
+	}
+	return nil
+}
+
+// For returns the quota of project. A project listed in Projects does not
+// inherit the unset fields of Default.
+func (q *Quotas) For(project string) Quota {
+	if quota, ok := q.Projects[project]; ok {
+		return quota
+	}
+	return q.Default
+}
+
+// RunningJobLimits returns the MaxRunningJobs of the default quota and of
+// each listed project, for simulation.Scheduler.SetTenantLimits. It reports
+// false if no quota limits running jobs.
+func (q *Quotas) RunningJobLimits() (int, map[string]int, bool) {
+	limited := q.Default.MaxRunningJobs > 0
+	limits := make(map[string]int, len(q.Projects))
+	for project, quota := range q.Projects {
+		limits[project] = quota.MaxRunningJobs
+		limited = limited || quota.MaxRunningJobs > 0
+	}
+	return q.Default.MaxRunningJobs, limits, limited
+}
+
+// quotaError is a job creation refused by a quota, reported as
+// RESOURCE_EXHAUSTED.
+type quotaError struct {
+	message string
+	// retryAfter, if set, is how long until the request may succeed.
+	retryAfter time.Duration
+}
+
+func (e *quotaError) Error() string {
+	return e.message
+}
+
+// checkQuota returns a quotaError if creating job, with its defaults applied,
+// in project and location would exceed the project's quota. The caller must
+// hold h.quotaMu and record the job with h.quotaCreated once it is stored.
+func (h *Handler) checkQuota(project, location string, job *api.Job) error {
+	if h.quotas == nil {
+		return nil
+	}
+	quota := h.quotas.For(project)
+
+	if quota.JobsPerMinute > 0 {
+		now := h.clock.Now()
+		created := h.recentCreates[project]
+		for len(created) > 0 && !created[0].After(now.Add(-time.Minute)) {
+			created = created[1:]
+		}
+		h.recentCreates[project] = created
+		if len(created) >= quota.JobsPerMinute {
+			return &quotaError{
+				message: fmt.Sprintf("Quota exceeded for quota metric 'Job create requests' and limit 'Job create requests per minute per project' of service 'batch.googleapis.com' for consumer 'project:%s'.",
+					project),
+				retryAfter: created[0].Add(time.Minute).Sub(now),
+			}
+		}
+	}
+
+	if quota.MaxCPUMilli > 0 {
+		jobs, err := h.store.ListJobs(project, location)
+		if err != nil {
+			return err
+		}
+		inFlight := int64(0)
+		for _, other := range jobs {
+			switch other.State {
+			case api.JobStateSucceeded, api.JobStateFailed, api.JobStateCancelled, api.JobStateDeleted:
+				continue
+			}
+			inFlight += cpuMilli(other)
+		}
+		if requested := cpuMilli(job); inFlight+requested > quota.MaxCPUMilli {
+			return &quotaError{message: fmt.Sprintf("Quota 'CPUS' exceeded. Limit: %d milli CPUs in region %s, in use: %d, requested: %d.",
+				quota.MaxCPUMilli, location, inFlight, requested)}
+		}
+	}
+	return nil
+}
+
+// quotaCreated counts a job created in project against its jobs per minute.
+// The caller must hold h.quotaMu.
+func (h *Handler) quotaCreated(project string) {
+	if h.quotas != nil && h.quotas.For(project).JobsPerMinute > 0 {
+		h.recentCreates[project] = append(h.recentCreates[project], h.clock.Now())
+	}
+}
+
+// cpuMilli returns the cpuMilli job's tasks use at once, with each task group
+// running as many tasks as its parallelism allows.
+func cpuMilli(job *api.Job) int64 {
+	total := int64(0)
+	for _, taskGroup := range job.TaskGroups {
+		if taskGroup.TaskSpec == nil || taskGroup.TaskSpec.ComputeResource == nil {
+			continue
+		}
+		tasks := taskGroup.TaskCount
+		if taskGroup.Parallelism > 0 && taskGroup.Parallelism < tasks {
+			tasks = taskGroup.Parallelism
+		}
+		total += taskGroup.TaskSpec.ComputeResource.CPUMilli * tasks
+	}
+	return total
+}
@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// requestIDHeader carries the ID a request is correlated by, in both the
+// request and its response.
+const requestIDHeader = "X-Request-Id"
+
+// requestInfoType is the type URL of the google.rpc.RequestInfo error detail.
+const requestInfoType = "type.googleapis.com/google.rpc.RequestInfo"
+
+// maxRequestIDLength is the longest X-Request-Id honored.
+const maxRequestIDLength = 128
+
+// RequestIDMiddleware gives every request an ID: the X-Request-Id it was sent
+// with, or a random UUID if it has none or an unusable one. The ID is echoed
+// in the X-Request-Id response header, which handlers tag their log lines
+// and error details with.
+func RequestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = uuid.New().String()
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// validRequestID reports whether id is a non-empty string of at most
+// maxRequestIDLength printable ASCII characters.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// requestLog returns the logger of the request answered through w, which
+// tags lines with its request ID.
+func requestLog(w http.ResponseWriter) *logrus.Entry {
+	if id := w.Header().Get(requestIDHeader); id != "" {
+		return logrus.WithField("requestId", id)
+	}
+	return logrus.NewEntry(logrus.StandardLogger())
+}
+
+// withRequestInfo returns details with a google.rpc.RequestInfo detail
+// carrying the ID of the request answered through w added, if it has one.
+func withRequestInfo(w http.ResponseWriter, details []map[string]interface{}) []map[string]interface{} {
+	id := w.Header().Get(requestIDHeader)
+	if id == "" {
+		return details
+	}
+	info := map[string]interface{}{"@type": requestInfoType, "requestId": id}
+	return append(append([]map[string]interface{}(nil), details...), info)
+}
@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+	"github.com/pyshx/fake-batch-server/pkg/storage"
+)
+
+// reapInterval is how often finished jobs are checked against the retention
+// policy.
+const reapInterval = time.Minute
+
+// Retention is the policy removing finished (SUCCEEDED, FAILED or CANCELLED)
+// jobs, so that long-lived servers do not grow without bound. A zero
+// Retention keeps every job.
+type Retention struct {
+	// TTL is how long a job is kept after it finished. Zero keeps jobs
+	// regardless of their age.
+	TTL time.Duration
+	// MaxFinishedJobs is the most finished jobs kept; beyond it, the jobs
+	// that finished first are removed. Zero means no limit.
+	MaxFinishedJobs int
+	// ArchiveDir, if set, is the directory removed jobs are written to
+	// first, each as a store snapshot holding the job and its tasks, in
+	// <ArchiveDir>/<job name>.json.
+	ArchiveDir string
+}
+
+// enabled reports whether the policy removes any jobs.
+func (p Retention) enabled() bool {
+	return p.TTL > 0 || p.MaxFinishedJobs > 0
+}
+
+// reapLoop applies the retention policy every reapInterval until the
+// handler is closed.
+func (h *Handler) reapLoop() {
+	for {
+		select {
+		case <-h.clock.After(reapInterval):
+			h.reap()
+		case <-h.closing:
+			return
+		}
+	}
+}
+
+// reap removes the finished jobs the retention policy no longer keeps,
+// archiving them first if it asks for it, and returns how many it removed.
+// Jobs that fail to archive are kept.
+func (h *Handler) reap() int {
+	type finished struct {
+		job *api.Job
+		at  time.Time
+	}
+	var jobs []finished
+	for _, job := range h.store.Snapshot().Jobs {
+		switch job.State {
+		case api.JobStateSucceeded, api.JobStateFailed, api.JobStateCancelled:
+			jobs = append(jobs, finished{job: job, at: finishTime(job)})
+		}
+	}
+	// Most recently finished first, so the jobs past MaxFinishedJobs are
+	// the oldest.
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].at.After(jobs[j].at) })
+
+	now := h.clock.Now()
+	removed := 0
+	for i, f := range jobs {
+		expired := h.retention.TTL > 0 && now.Sub(f.at) >= h.retention.TTL
+		excess := h.retention.MaxFinishedJobs > 0 && i >= h.retention.MaxFinishedJobs
+		if !expired && !excess {
+			continue
+		}
+		if h.retention.ArchiveDir != "" {
+			if err := h.archive(f.job); err != nil {
+				logrus.Errorf("Failed to archive job %s: %v", f.job.Name, err)
+				continue
+			}
+		}
+		h.sim.Stop(f.job.Name)
+		if err := h.store.DeleteJob(f.job.Name); err != nil {
+			continue
+		}
+		h.logs.DeleteJob(f.job.Name)
+		removed++
+	}
+	if removed > 0 {
+		logrus.Infof("Removed %d finished jobs past their retention", removed)
+	}
+	return removed
+}
+
+// archive writes job and its tasks to the archive directory.
+func (h *Handler) archive(job *api.Job) error {
+	tasks, err := h.store.ListTasks(job.Name)
+	if err != nil {
+		return err
+	}
+	snapshot := &storage.Snapshot{
+		Jobs:  []*api.Job{job},
+		Tasks: map[string][]*api.Task{job.Name: tasks},
+	}
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(h.retention.ArchiveDir, filepath.FromSlash(job.Name)+".json")
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path, data); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	return nil
+}
+
+// finishTime returns when job reached its final state: the time of its last
+// status event, or its update time if it has none.
+func finishTime(job *api.Job) time.Time {
+	if job.Status != nil && len(job.Status.StatusEvents) > 0 {
+		return job.Status.StatusEvents[len(job.Status.StatusEvents)-1].EventTime
+	}
+	return job.UpdateTime
+}
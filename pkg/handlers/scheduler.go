@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Headers set by Cloud Scheduler on HTTP target invocations.
+const (
+	schedulerJobNameHeader      = "X-CloudScheduler-JobName"
+	schedulerScheduleTimeHeader = "X-CloudScheduler-ScheduleTime"
+)
+
+// SchedulerInvocation is the data available to job templates rendered by
+// TriggerJob.
+type SchedulerInvocation struct {
+	// SchedulerJob is the name of the scheduler job that fired, if known.
+	SchedulerJob string
+	// ScheduleTime is the time the invocation was scheduled for.
+	ScheduleTime time.Time
+	// InvocationID is a short random identifier unique to this invocation.
+	InvocationID string
+}
+
+// TriggerJob handles Cloud Scheduler HTTP target invocations. The request body
+// is a job spec rendered as a text/template on every call, so a single
+// scheduler job pointed at this endpoint creates a fresh batch job each time
+// it fires. The optional job_id query parameter is rendered the same way.
+func (h *Handler) TriggerJob(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	project := vars["project"]
+	location := vars["location"]
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+
+	invocation, err := newSchedulerInvocation(r, h.clock.Now(), h.ids.NewID())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid scheduler headers: %v", err)
+		return
+	}
+
+	spec, err := renderTemplate(string(body), invocation)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid job template: %v", err)
+		return
+	}
+
+	job, warnings, err := decodeJob(strings.NewReader(spec), h.strictJSON)
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	writeWarnings(w, warnings)
+
+	jobID, err := renderTemplate(r.URL.Query().Get("job_id"), invocation)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid job_id template: %v", err)
+		return
+	}
+
+	plan, err := h.newPlan(job, project, r.URL.Query().Get("final_state"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid simulation options: %v", err)
+		return
+	}
+
+	if err := h.checkTaskCounts(job); err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+
+	if err := validateJob(job); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid job: %v", err)
+		return
+	}
+
+	if err := h.checkImages(r.Context(), job); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid job: %v", err)
+		return
+	}
+
+	if err := h.submitJob(r.Context(), project, location, jobID, job, plan); err != nil {
+		writeSubmitError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, job)
+}
+
+func newSchedulerInvocation(r *http.Request, now time.Time, id string) (*SchedulerInvocation, error) {
+	invocation := &SchedulerInvocation{
+		SchedulerJob: r.Header.Get(schedulerJobNameHeader),
+		ScheduleTime: now.UTC(),
+		InvocationID: shortID(id),
+	}
+
+	if value := r.Header.Get(schedulerScheduleTimeHeader); value != "" {
+		scheduleTime, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", schedulerScheduleTimeHeader, err)
+		}
+		invocation.ScheduleTime = scheduleTime
+	}
+
+	return invocation, nil
+}
+
+func renderTemplate(text string, data interface{}) (string, error) {
+	tmpl, err := template.New("").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
@@ -0,0 +1,165 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+	"github.com/pyshx/fake-batch-server/pkg/simulation"
+)
+
+// SeedJob is a job loaded from a seed file. It is written like a job returned
+// by the API, with tasks to override those created for its task groups.
+type SeedJob struct {
+	api.Job
+	// Tasks sets the state and status events of individual tasks, named in
+	// full or relative to the job, e.g. "taskGroups/group0/tasks/1".
+	Tasks []*api.Task `json:"tasks,omitempty"`
+}
+
+// LoadSeed reads the jobs of a YAML or JSON seed file of the form
+// {"jobs": [{"name": "projects/p/locations/l/jobs/j", "state": "FAILED", ...}]}.
+func LoadSeed(path string) ([]*SeedJob, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Jobs are decoded through JSON so that YAML seeds use the same field
+	// names as the API.
+	var raw interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse seed file %s: %v", path, err)
+	}
+	if data, err = json.Marshal(raw); err != nil {
+		return nil, fmt.Errorf("failed to parse seed file %s: %v", path, err)
+	}
+
+	var seed struct {
+		Jobs []*SeedJob `json:"jobs"`
+	}
+	if err := json.Unmarshal(data, &seed); err != nil {
+		return nil, fmt.Errorf("failed to parse seed file %s: %v", path, err)
+	}
+	return seed.Jobs, nil
+}
+
+// Seed stores jobs as if they had been created and run earlier. Unset fields
+// are filled like CreateJob fills them, jobs default to SUCCEEDED, and tasks
+// not listed take the job's state once it is SUCCEEDED or FAILED, or stay
+// PENDING. Jobs left QUEUED, SCHEDULED or RUNNING are simulated from there.
+// Jobs that already exist are skipped. It returns the number of jobs stored.
+func (h *Handler) Seed(jobs []*SeedJob) (int, error) {
+	seeded := 0
+	for i, seed := range jobs {
+		job := &seed.Job
+		parts := strings.Split(job.Name, "/")
+		if len(parts) != 6 || parts[0] != "projects" || parts[2] != "locations" || parts[4] != "jobs" || parts[1] == "" || parts[3] == "" || parts[5] == "" {
+			return seeded, fmt.Errorf("jobs[%d]: invalid name %q, must be projects/{project}/locations/{location}/jobs/{job}", i, job.Name)
+		}
+		project, location := parts[1], parts[3]
+
+		if _, err := h.store.GetJob(job.Name); err == nil {
+			logrus.Infof("Not seeding job %s: it already exists", job.Name)
+			continue
+		}
+
+		if job.State == "" {
+			job.State = api.JobStateSucceeded
+		}
+		if job.UID == "" {
+			job.UID = h.ids.NewID()
+		}
+		if job.CreateTime.IsZero() {
+			job.CreateTime = h.clock.Now()
+		}
+		if job.UpdateTime.IsZero() {
+			job.UpdateTime = job.CreateTime
+		}
+		h.serverDefaults.apply(job, location)
+		if job.Status == nil {
+			job.Status = &api.JobStatus{}
+		}
+		job.Status.State = job.State
+
+		if err := h.store.CreateJob(job); err != nil {
+			return seeded, fmt.Errorf("jobs[%d]: %v", i, err)
+		}
+		tasks, err := h.seedTasks(job, seed.Tasks)
+		if err != nil {
+			h.store.DeleteJob(job.Name)
+			return seeded, fmt.Errorf("jobs[%d]: %v", i, err)
+		}
+
+		job.Status.TaskGroups = make(map[string]*api.TaskGroupStatus)
+		for name, counts := range simulation.TaskCounts(job, tasks) {
+			job.Status.TaskGroups[name] = &api.TaskGroupStatus{Counts: counts}
+		}
+		if err := h.store.UpdateJob(job); err != nil {
+			return seeded, fmt.Errorf("jobs[%d]: %v", i, err)
+		}
+		seeded++
+
+		switch job.State {
+		case api.JobStateQueued, api.JobStateScheduled, api.JobStateRunning:
+			plan, err := h.newPlan(job, project, "")
+			if err != nil {
+				return seeded, fmt.Errorf("jobs[%d]: %v", i, err)
+			}
+			h.sim.Resume(job, plan)
+		}
+	}
+	return seeded, nil
+}
+
+// seedTasks applies the task overrides of a seeded job to its stored tasks,
+// defaulting the others to the job's terminal state, and returns them.
+func (h *Handler) seedTasks(job *api.Job, overrides []*api.Task) ([]*api.Task, error) {
+	tasks, err := h.store.ListTasks(job.Name)
+	if err != nil {
+		return nil, err
+	}
+	byName := make(map[string]*api.Task, len(tasks))
+	for _, task := range tasks {
+		byName[task.Name] = task
+	}
+
+	defaultState := api.TaskStatePending
+	if job.State == api.JobStateSucceeded || job.State == api.JobStateFailed {
+		defaultState = api.TaskState(job.State)
+	}
+	for _, task := range tasks {
+		task.Status.State = defaultState
+	}
+
+	for _, override := range overrides {
+		name := override.Name
+		if !strings.HasPrefix(name, job.Name+"/") {
+			name = job.Name + "/" + name
+		}
+		task, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown task %q", override.Name)
+		}
+		if override.Status != nil {
+			if override.Status.State != "" {
+				task.Status.State = override.Status.State
+			}
+			if override.Status.StatusEvents != nil {
+				task.Status.StatusEvents = override.Status.StatusEvents
+			}
+		}
+	}
+
+	for _, task := range tasks {
+		if err := h.store.UpdateTask(job.Name, task); err != nil {
+			return nil, err
+		}
+	}
+	return tasks, nil
+}
@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+)
+
+// streamThreshold is the number of items above which list responses are
+// streamed by streamList instead of being encoded at once.
+const streamThreshold = 1000
+
+// streamFlushEvery is the number of streamed items sent between flushes.
+const streamFlushEvery = 500
+
+// streamList writes the list response {field: [...], "nextPageToken": ...},
+// as writeJSON would, fetching each of the items called names with get only
+// as it is written, so that memory stays flat however long the list is.
+// Items get cannot find, e.g. deleted since they were listed, are left out.
+// The response starts before the items are read, so it carries no ETag.
+func streamList(w http.ResponseWriter, field string, names []string, nextPageToken string, get func(name string) (interface{}, bool)) {
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	buf := bufio.NewWriterSize(w, 64<<10)
+
+	key, _ := json.Marshal(field)
+	buf.WriteString("{")
+	buf.Write(key)
+	buf.WriteString(":[")
+	written := 0
+	for _, name := range names {
+		item, ok := get(name)
+		if !ok {
+			continue
+		}
+		data, err := json.Marshal(item)
+		if err != nil {
+			requestLog(w).Errorf("Failed to encode %s: %v", name, err)
+			return
+		}
+		if written > 0 {
+			buf.WriteByte(',')
+		}
+		buf.Write(data)
+		if written++; written%streamFlushEvery == 0 {
+			if err := buf.Flush(); err != nil {
+				requestLog(w).Errorf("Failed to write response: %v", err)
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+	buf.WriteString("]")
+	if nextPageToken != "" {
+		token, _ := json.Marshal(nextPageToken)
+		buf.WriteString(`,"nextPageToken":`)
+		buf.Write(token)
+	}
+	buf.WriteString("}\n")
+	if err := buf.Flush(); err != nil {
+		requestLog(w).Errorf("Failed to write response: %v", err)
+	}
+}
@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+)
+
+// inlineTypes maps the types whose UnmarshalJSON also takes the fields of
+// another type inline to that type.
+var inlineTypes = map[reflect.Type]reflect.Type{
+	reflect.TypeOf(api.InstancePolicyOrTemplate{}): reflect.TypeOf(api.InstancePolicy{}),
+}
+
+var unmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+// decodeBody decodes a JSON request body into v, rejecting bodies nested
+// deeper than maxJSONDepth. With --strict-json, bodies with fields v has no
+// room for are rejected rather than decoded without them.
+func (h *Handler) decodeBody(body io.Reader, v interface{}) error {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	if err := checkDepth(data); err != nil {
+		return err
+	}
+	if !h.strictJSON {
+		return json.Unmarshal(data, v)
+	}
+
+	var raw interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	if err := checkUnknownFields(raw, reflect.TypeOf(v)); err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
+
+// checkUnknownFields returns an error listing the fields of value, a decoded
+// JSON body, that t has no field for. Unlike encoding/json, which matches
+// names case-insensitively, field names must be spelled exactly, as the
+// service requires.
+func checkUnknownFields(value interface{}, t reflect.Type) error {
+	unknown := unknownFields(value, t, "")
+	switch len(unknown) {
+	case 0:
+		return nil
+	case 1:
+		return fmt.Errorf("unknown field %q", unknown[0])
+	default:
+		for i, field := range unknown {
+			unknown[i] = strconv.Quote(field)
+		}
+		return fmt.Errorf("unknown fields %s", strings.Join(unknown, ", "))
+	}
+}
+
+// unknownFields returns the paths of the object keys in value, found at
+// path, that t has no field for.
+func unknownFields(value interface{}, t reflect.Type, path string) []string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	var unknown []string
+	switch value := value.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		switch t.Kind() {
+		case reflect.Map:
+			for _, key := range keys {
+				unknown = append(unknown, unknownFields(value[key], t.Elem(), joinField(path, key))...)
+			}
+		case reflect.Struct:
+			inline, ok := inlineTypes[t]
+			if !ok && reflect.PointerTo(t).Implements(unmarshalerType) {
+				return nil
+			}
+			fields := jsonFields(t)
+			if ok {
+				for name, field := range jsonFields(inline) {
+					if _, ok := fields[name]; !ok {
+						fields[name] = field
+					}
+				}
+			}
+			for _, key := range keys {
+				field, ok := fields[key]
+				if !ok {
+					unknown = append(unknown, joinField(path, key))
+					continue
+				}
+				unknown = append(unknown, unknownFields(value[key], field, joinField(path, key))...)
+			}
+		}
+	case []interface{}:
+		if t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+			for i, item := range value {
+				unknown = append(unknown, unknownFields(item, t.Elem(), path+"["+strconv.Itoa(i)+"]")...)
+			}
+		}
+	}
+	return unknown
+}
+
+// jsonFields returns the types of the fields of the struct type t by their
+// JSON names, including those of embedded structs.
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		if field.Anonymous && name == "" {
+			embedded := field.Type
+			if embedded.Kind() == reflect.Pointer {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				for name, t := range jsonFields(embedded) {
+					if _, ok := fields[name]; !ok {
+						fields[name] = t
+					}
+				}
+				continue
+			}
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fields[name] = field.Type
+	}
+	return fields
+}
@@ -0,0 +1,36 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/pyshx/fake-batch-server/pkg/tracing"
+)
+
+// TracingMiddleware records a server span for every request handled by next,
+// joining the caller's trace when the request has a traceparent header. It
+// does nothing unless the handler has a tracer.
+func (h *Handler) TracingMiddleware(next http.Handler) http.Handler {
+	if h.tracer == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := routeTemplate(r)
+		ctx, span := h.tracer.Start(tracing.Extract(r.Context(), r.Header), r.Method+" "+route, tracing.KindServer)
+		defer span.End()
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+
+		span.SetAttributes(
+			tracing.Attribute{Key: "http.request.method", Value: r.Method},
+			tracing.Attribute{Key: "http.route", Value: route},
+			tracing.Attribute{Key: "url.path", Value: r.URL.Path},
+			tracing.Attribute{Key: "http.response.status_code", Value: recorder.status},
+		)
+		if recorder.status >= http.StatusInternalServerError {
+			span.SetError(fmt.Errorf("%d %s", recorder.status, http.StatusText(recorder.status)))
+		}
+	})
+}
@@ -0,0 +1,283 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+	"github.com/pyshx/fake-batch-server/pkg/simulation"
+	"github.com/pyshx/fake-batch-server/pkg/storage"
+)
+
+// taskCountPath matches the updateMask path of the task count of one task
+// group, e.g. taskGroups[0].taskCount.
+var taskCountPath = regexp.MustCompile(`^taskGroups\[(\d+)\]\.taskCount$`)
+
+// maskPaths is the Replacer turning the snake_case spelling of updateMask
+// paths into camelCase.
+var maskPaths = strings.NewReplacer("task_groups", "taskGroups", "task_count", "taskCount")
+
+// UpdateJob changes the fields of a job named by the comma-separated
+// updateMask query parameter to their values in the body. Supported paths
+// are labels, priority, taskGroups[N].taskCount and taskGroups, which updates
+// the task count of every task group in the body. As in production, the
+// priority only changes while the job is QUEUED, and task counts only grow
+// while the job has not finished; the added tasks start PENDING and are
+// scheduled along with the job's remaining tasks.
+func (h *Handler) UpdateJob(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	project := vars["project"]
+	jobName := fmt.Sprintf("projects/%s/locations/%s/jobs/%s", project, vars["location"], vars["job"])
+
+	mask, err := queryParam(r, "updateMask", "update_mask")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	if mask == "" {
+		writeError(w, http.StatusBadRequest, "updateMask is required")
+		return
+	}
+
+	var patch api.Job
+	if err := h.decodeBody(r.Body, &patch); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+
+	store := h.storeFor(r)
+	if _, err := store.GetJob(jobName); err != nil {
+		writeError(w, http.StatusNotFound, "Job not found: %v", err)
+		return
+	}
+
+	updateLabels, updatePriority := false, false
+	taskCounts := make(map[int]int64)
+	for _, path := range strings.Split(mask, ",") {
+		path = maskPaths.Replace(strings.TrimSpace(path))
+		switch {
+		case path == "labels":
+			updateLabels = true
+		case path == "priority":
+			updatePriority = true
+		case path == "taskGroups":
+			for i, taskGroup := range patch.TaskGroups {
+				taskCounts[i] = taskGroup.TaskCount
+			}
+		case taskCountPath.MatchString(path):
+			i, _ := strconv.Atoi(taskCountPath.FindStringSubmatch(path)[1])
+			if i >= len(patch.TaskGroups) {
+				writeError(w, http.StatusBadRequest, "updateMask path %s has no value in the request body", path)
+				return
+			}
+			taskCounts[i] = patch.TaskGroups[i].TaskCount
+		default:
+			writeError(w, http.StatusBadRequest, "Unsupported updateMask path %q, must be labels, priority, taskGroups or taskGroups[N].taskCount", path)
+			return
+		}
+	}
+
+	update := &jobPatch{
+		values:       &patch,
+		labels:       updateLabels,
+		priority:     updatePriority,
+		taskCounts:   taskCounts,
+		maxTaskCount: h.maxTaskCount,
+		now:          h.clock.Now(),
+	}
+	simulated, err := h.sim.Update(jobName, update.apply)
+	if !simulated {
+		err = h.updateStored(store, jobName, update)
+	}
+	var invalid *patchError
+	if errors.As(err, &invalid) {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to update job: %v", err)
+		return
+	}
+	if update.priority {
+		h.sim.Reprioritize(jobName, patch.Priority)
+	}
+
+	job, err := store.GetJob(jobName)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "Job not found: %v", err)
+		return
+	}
+	requestLog(w).Infof("Updated job %s: %s", jobName, mask)
+	writeJSON(w, http.StatusOK, job)
+}
+
+// patchError is a change UpdateJob cannot make to a job, failing the request
+// with 400 INVALID_ARGUMENT.
+type patchError struct {
+	message string
+}
+
+func (e *patchError) Error() string {
+	return e.message
+}
+
+// jobPatch is the change UpdateJob makes to a job: the labels, priority and
+// task counts, keyed by task group index, of values named by the update
+// mask.
+type jobPatch struct {
+	values       *api.Job
+	labels       bool
+	priority     bool
+	taskCounts   map[int]int64
+	maxTaskCount int64
+	now          time.Time
+	// grown is set by apply if it raised a task count.
+	grown bool
+}
+
+// apply checks that p can be made to job and makes it. Every change is worked
+// out before any is made, so that job is left untouched if one is invalid.
+func (p *jobPatch) apply(job *api.Job) error {
+	if p.priority && p.values.Priority != job.Priority {
+		if p.values.Priority < 0 || p.values.Priority > 99 {
+			return &patchError{fmt.Sprintf("Invalid priority %d, must be between 0 and 99", p.values.Priority)}
+		}
+		if job.State != api.JobStateQueued {
+			return &patchError{fmt.Sprintf("Job %s is %s; only QUEUED jobs can be reprioritized", job.Name, job.State)}
+		}
+	}
+	grown := false
+	for i, count := range p.taskCounts {
+		if i >= len(job.TaskGroups) {
+			return &patchError{fmt.Sprintf("Job %s has no task group %d", job.Name, i)}
+		}
+		current := job.TaskGroups[i].TaskCount
+		if count == current {
+			continue
+		}
+		if count < current {
+			return &patchError{fmt.Sprintf("Invalid value for field 'taskGroups[%d].taskCount': '%d'. Task count cannot be decreased from %d.", i, count, current)}
+		}
+		if count > p.maxTaskCount {
+			return &patchError{fmt.Sprintf("Invalid value for field 'taskGroups[%d].taskCount': '%d'. Task count must be between 1 and %d.", i, count, p.maxTaskCount)}
+		}
+		grown = true
+	}
+	if grown {
+		switch job.State {
+		case api.JobStateQueued, api.JobStateScheduled, api.JobStateRunning:
+		default:
+			return &patchError{fmt.Sprintf("Job %s is %s; only unfinished jobs can grow their task count", job.Name, job.State)}
+		}
+	}
+
+	if p.labels {
+		job.Labels = p.values.Labels
+	}
+	if p.priority && p.values.Priority != job.Priority {
+		job.Status.StatusEvents = append(job.Status.StatusEvents, &api.StatusEvent{
+			Type:        "priority_changed",
+			Description: fmt.Sprintf("Job priority changed from %d to %d", job.Priority, p.values.Priority),
+			EventTime:   p.now,
+		})
+		job.Priority = p.values.Priority
+	}
+	for i, count := range p.taskCounts {
+		job.TaskGroups[i].TaskCount = count
+	}
+	p.grown = grown
+	job.UpdateTime = p.now
+	return nil
+}
+
+// updateStored makes p to the stored job named jobName, which is not being
+// simulated. A job whose task count grew is simulated again, so that the
+// added tasks run.
+func (h *Handler) updateStored(store storage.Store, jobName string, p *jobPatch) error {
+	job, err := store.GetJob(jobName)
+	if err != nil {
+		return err
+	}
+	before := make(map[int]int64, len(job.TaskGroups))
+	for i, taskGroup := range job.TaskGroups {
+		before[i] = taskGroup.TaskCount
+	}
+	if err := p.apply(job); err != nil {
+		return err
+	}
+
+	var plan *simulation.Plan
+	if p.grown {
+		if plan, err = h.growTasks(store, job, before); err != nil {
+			return fmt.Errorf("failed to update tasks: %v", err)
+		}
+	}
+	if err := store.UpdateJob(job); err != nil {
+		return err
+	}
+	if plan != nil {
+		h.sim.Resume(job, plan)
+	}
+	return nil
+}
+
+// growTasks creates the tasks job's task groups gained since they had the
+// task counts in before, keyed by task group index, except in lazy task
+// groups, whose added tasks are derived as PENDING. It returns the plan to
+// simulate the job with.
+func (h *Handler) growTasks(store storage.Store, job *api.Job, before map[int]int64) (*simulation.Plan, error) {
+	project, _, _ := strings.Cut(strings.TrimPrefix(job.Name, "projects/"), "/")
+	plan, err := h.newPlan(job, project, "")
+	if err != nil {
+		return nil, err
+	}
+
+	now := h.clock.Now()
+	lazy := false
+	for i, taskGroup := range job.TaskGroups {
+		if storage.Lazy(taskGroup) {
+			if _, err := store.GetTaskProgress(job.Name, taskGroup.Name); err == nil {
+				lazy = true
+				continue
+			}
+		}
+		for index := before[i]; index < taskGroup.TaskCount; index++ {
+			task := &api.Task{
+				Name: fmt.Sprintf("%s/taskGroups/%s/tasks/%d", job.Name, taskGroup.Name, index),
+				Status: &api.TaskStatus{
+					State: api.TaskStatePending,
+					StatusEvents: []*api.StatusEvent{
+						{Type: "task_created", Description: "Task created", EventTime: now},
+					},
+				},
+			}
+			if err := store.CreateTask(job.Name, task); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// The simulation refreshes the counts of lazy task groups once resumed.
+	if !lazy {
+		tasks, err := store.ListTasks(job.Name)
+		if err != nil {
+			return nil, err
+		}
+		for name, taskCounts := range simulation.TaskCounts(job, tasks) {
+			status := &api.TaskGroupStatus{Counts: taskCounts}
+			if previous, ok := job.Status.TaskGroups[name]; ok {
+				status.Instances = previous.Instances
+			}
+			job.Status.TaskGroups[name] = status
+		}
+	}
+
+	return plan, nil
+}
@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+)
+
+// Server-sent event types emitted by WatchJob.
+const (
+	// watchEventJob carries the JSON of the job after a change.
+	watchEventJob = "job"
+	// watchEventDeleted carries the name of the job once it has been deleted.
+	watchEventDeleted = "deleted"
+	// watchEventJobs carries the api.ListJobsResponse of every job of a
+	// location after a change to any of them.
+	watchEventJobs = "jobs"
+)
+
+// WatchJob streams a job as server-sent events: a "job" event with the
+// current job right away and after every change to it or its tasks, and a
+// final "deleted" event once it has been removed. The stream stays open
+// until the job is deleted or the client disconnects.
+func (h *Handler) WatchJob(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	jobName := fmt.Sprintf("projects/%s/locations/%s/jobs/%s", vars["project"], vars["location"], vars["job"])
+
+	changes, stop := h.store.Watch(jobName)
+	defer stop()
+
+	if _, err := h.store.GetJob(jobName); err != nil {
+		writeError(w, http.StatusNotFound, "Job not found: %v", err)
+		return
+	}
+
+	clearWriteDeadline(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+
+	var last []byte
+	for {
+		event, data := watchEventDeleted, []byte(fmt.Sprintf(`{"name":%q}`, jobName))
+		if job, err := h.store.GetJob(jobName); err == nil {
+			if data, err = json.Marshal(job); err != nil {
+				logrus.Errorf("Failed to encode job %s: %v", jobName, err)
+				return
+			}
+			event = watchEventJob
+		}
+
+		if !bytes.Equal(data, last) {
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+			last = data
+		}
+		if event == watchEventDeleted {
+			return
+		}
+
+		select {
+		case <-changes:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// WatchJobs streams the jobs of a location as server-sent events: a "jobs"
+// event with all of them, sorted by name, right away and after every change
+// to any of them or their tasks, including jobs being created and deleted.
+// The stream stays open until the client disconnects.
+func (h *Handler) WatchJobs(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	project, location := vars["project"], vars["location"]
+
+	changes, stop := h.store.Watch(fmt.Sprintf("projects/%s/locations/%s", project, location))
+	defer stop()
+
+	clearWriteDeadline(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+
+	var last []byte
+	for {
+		jobs, err := h.store.ListJobs(project, location)
+		if err != nil {
+			logrus.Errorf("Failed to list jobs of %s/%s: %v", project, location, err)
+			return
+		}
+		sort.Slice(jobs, func(i, j int) bool { return jobs[i].Name < jobs[j].Name })
+		if jobs == nil {
+			jobs = []*api.Job{}
+		}
+		data, err := json.Marshal(&api.ListJobsResponse{Jobs: jobs})
+		if err != nil {
+			logrus.Errorf("Failed to encode jobs of %s/%s: %v", project, location, err)
+			return
+		}
+
+		if !bytes.Equal(data, last) {
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", watchEventJobs, data); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+			last = data
+		}
+
+		select {
+		case <-changes:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,236 @@
+// Package launcher starts the emulator for integration tests, in a Docker
+// container or as a subprocess, waits until it is healthy and tears it down
+// afterwards, in the manner of a Testcontainers module.
+package launcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pyshx/fake-batch-server/pkg/executor"
+)
+
+const (
+	// DefaultImage is the image RunContainer starts.
+	DefaultImage = "fake-batch-server:latest"
+	// DefaultStartupTimeout is how long the emulator may take to become
+	// healthy.
+	DefaultStartupTimeout = time.Minute
+
+	// containerPort is the port the server listens on in its image.
+	containerPort = 8080
+	// envPrefix starts the environment variables overriding the server's
+	// flags.
+	envPrefix = "FAKE_BATCH_"
+)
+
+// Emulator is a running emulator.
+type Emulator struct {
+	// Endpoint is the base URL of the emulator, e.g.
+	// "http://127.0.0.1:49153".
+	Endpoint string
+
+	terminate func(ctx context.Context) error
+}
+
+// APIEndpoint returns the root of the v1 API, e.g. for client.New.
+func (e *Emulator) APIEndpoint() string {
+	return e.Endpoint + "/v1"
+}
+
+// Terminate stops the emulator, and removes its container if it runs in one.
+func (e *Emulator) Terminate(ctx context.Context) error {
+	return e.terminate(ctx)
+}
+
+// Option configures how the emulator is started.
+type Option func(*options)
+
+type options struct {
+	image          string
+	dockerHost     string
+	env            map[string]string
+	startupTimeout time.Duration
+}
+
+// WithImage makes RunContainer start image instead of DefaultImage.
+func WithImage(image string) Option {
+	return func(o *options) {
+		o.image = image
+	}
+}
+
+// WithDockerHost makes RunContainer use the Docker daemon at host, e.g.
+// tcp://localhost:2375, instead of $DOCKER_HOST or the local socket.
+func WithDockerHost(host string) Option {
+	return func(o *options) {
+		o.dockerHost = host
+	}
+}
+
+// WithSetting sets a server flag, e.g. WithSetting("sim-running-duration",
+// "2s"), through its FAKE_BATCH_* environment variable.
+func WithSetting(flag, value string) Option {
+	return WithEnv(envPrefix+strings.ToUpper(strings.ReplaceAll(flag, "-", "_")), value)
+}
+
+// WithEnv sets an environment variable of the emulator.
+func WithEnv(name, value string) Option {
+	return func(o *options) {
+		o.env[name] = value
+	}
+}
+
+// WithStartupTimeout sets how long the emulator may take to become healthy
+// instead of DefaultStartupTimeout.
+func WithStartupTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.startupTimeout = timeout
+	}
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{
+		image:          DefaultImage,
+		dockerHost:     os.Getenv("DOCKER_HOST"),
+		env:            make(map[string]string),
+		startupTimeout: DefaultStartupTimeout,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// RunContainer starts the emulator image in a Docker container, with its
+// port published on a free port of the daemon's host, and waits until it is
+// healthy.
+func RunContainer(ctx context.Context, opts ...Option) (*Emulator, error) {
+	o := newOptions(opts)
+	docker, err := executor.NewDocker(o.dockerHost)
+	if err != nil {
+		return nil, err
+	}
+
+	service, err := docker.StartService(ctx, o.image, containerPort, o.env)
+	if err != nil {
+		return nil, err
+	}
+	emulator := &Emulator{
+		Endpoint: "http://" + service.Address,
+		terminate: func(ctx context.Context) error {
+			return docker.StopService(ctx, service.ID)
+		},
+	}
+	if err := waitHealthy(ctx, emulator.Endpoint, o.startupTimeout, nil); err != nil {
+		emulator.Terminate(context.Background())
+		return nil, err
+	}
+	return emulator, nil
+}
+
+// RunBinary starts the emulator binary at path, e.g. one built with
+// `go build ./cmd/server`, as a subprocess listening on a free loopback
+// port, and waits until it is healthy. Its output goes to the test's
+// stderr.
+func RunBinary(ctx context.Context, path string, opts ...Option) (*Emulator, error) {
+	o := newOptions(opts)
+	port, err := freePort()
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(path, "--host", "127.0.0.1", "--port", strconv.Itoa(port))
+	cmd.Env = os.Environ()
+	for name, value := range o.env {
+		cmd.Env = append(cmd.Env, name+"="+value)
+	}
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start %s: %v", path, err)
+	}
+	// exited is closed, with the result of the process in waitErr, once it
+	// exits.
+	exited := make(chan struct{})
+	var waitErr error
+	go func() {
+		waitErr = cmd.Wait()
+		close(exited)
+	}()
+
+	emulator := &Emulator{
+		Endpoint: fmt.Sprintf("http://127.0.0.1:%d", port),
+		terminate: func(ctx context.Context) error {
+			// The server checkpoints its state, if asked to, on SIGINT.
+			if err := cmd.Process.Signal(os.Interrupt); err != nil && !errors.Is(err, os.ErrProcessDone) {
+				return err
+			}
+			select {
+			case <-exited:
+				return nil
+			case <-ctx.Done():
+				cmd.Process.Kill()
+				<-exited
+				return ctx.Err()
+			}
+		},
+	}
+	if err := waitHealthy(ctx, emulator.Endpoint, o.startupTimeout, exited); err != nil {
+		cmd.Process.Kill()
+		<-exited
+		if errors.Is(err, errExited) {
+			return nil, fmt.Errorf("%w: %v", err, waitErr)
+		}
+		return nil, err
+	}
+	return emulator, nil
+}
+
+// errExited is returned by waitHealthy when the emulator exits first.
+var errExited = errors.New("emulator exited before becoming healthy")
+
+// waitHealthy polls the health check of the emulator at endpoint until it
+// succeeds, timeout passes, ctx is done, or exited is closed.
+func waitHealthy(ctx context.Context, endpoint string, timeout time.Duration, exited <-chan struct{}) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint+"/v1/health", nil)
+		if err != nil {
+			return err
+		}
+		if resp, err := http.DefaultClient.Do(req); err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return nil
+			}
+		}
+
+		select {
+		case <-exited:
+			return errExited
+		case <-ctx.Done():
+			return fmt.Errorf("emulator at %s did not become healthy: %w", endpoint, ctx.Err())
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// freePort returns a TCP port of the loopback interface no one listens on.
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
@@ -0,0 +1,107 @@
+package launcher
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+	"github.com/pyshx/fake-batch-server/pkg/client"
+)
+
+func TestRunContainer(t *testing.T) {
+	emulator := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/health" {
+			w.Write([]byte(`{"status":"healthy"}`))
+		}
+	}))
+	t.Cleanup(emulator.Close)
+	published, err := url.Parse(emulator.URL)
+	require.NoError(t, err)
+
+	// The daemon publishes the container's port on the port of emulator.
+	var mu sync.Mutex
+	var requests []string
+	docker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+		switch {
+		case r.URL.Path == "/containers/create":
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"Id":"c1"}`))
+		case r.URL.Path == "/containers/c1/json":
+			fmt.Fprintf(w, `{"NetworkSettings":{"Ports":{"8080/tcp":[{"HostPort":%q}]}}}`, published.Port())
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	t.Cleanup(docker.Close)
+
+	ctx := context.Background()
+	started, err := RunContainer(ctx, WithDockerHost("tcp://"+strings.TrimPrefix(docker.URL, "http://")), WithImage("emulator:dev"))
+	require.NoError(t, err)
+	assert.Equal(t, "http://127.0.0.1:"+published.Port(), started.Endpoint)
+	assert.Equal(t, started.Endpoint+"/v1", started.APIEndpoint())
+
+	require.NoError(t, started.Terminate(ctx))
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{
+		"GET /images/emulator:dev/json",
+		"POST /containers/create",
+		"POST /containers/c1/start",
+		"GET /containers/c1/json",
+		"DELETE /containers/c1",
+	}, requests)
+}
+
+func TestRunBinary(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds the server")
+	}
+	binary := filepath.Join(t.TempDir(), "fake-batch-server")
+	build := exec.Command("go", "build", "-o", binary, "github.com/pyshx/fake-batch-server/cmd/server")
+	output, err := build.CombinedOutput()
+	require.NoError(t, err, string(output))
+
+	ctx := context.Background()
+	emulator, err := RunBinary(ctx, binary, WithSetting("sim-running-duration", "100ms"), WithStartupTimeout(30*time.Second))
+	require.NoError(t, err)
+	t.Cleanup(func() { emulator.Terminate(context.Background()) })
+
+	c := client.New(emulator.APIEndpoint(), client.WithPollInterval(10*time.Millisecond, 100*time.Millisecond))
+	job, err := c.CreateJob(ctx, "projects/p/locations/l", "job1", &api.Job{TaskGroups: []*api.TaskGroup{{TaskCount: 1}}})
+	require.NoError(t, err)
+	waitCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	job, err = c.WaitForJobCompletion(waitCtx, job.Name)
+	require.NoError(t, err)
+	assert.Equal(t, api.JobStateSucceeded, job.State)
+
+	require.NoError(t, emulator.Terminate(ctx))
+	_, err = c.GetJob(ctx, job.Name)
+	assert.Error(t, err)
+}
+
+func TestRunBinary_Unhealthy(t *testing.T) {
+	_, err := RunBinary(context.Background(), "/bin/false")
+	assert.ErrorContains(t, err, "exited before becoming healthy")
+
+	hang := filepath.Join(t.TempDir(), "hang")
+	require.NoError(t, os.WriteFile(hang, []byte("#!/bin/sh\nexec sleep 10\n"), 0o755))
+	_, err = RunBinary(context.Background(), hang, WithStartupTimeout(200*time.Millisecond))
+	assert.ErrorContains(t, err, "did not become healthy")
+}
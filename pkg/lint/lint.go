@@ -0,0 +1,143 @@
+// Package lint checks job specs against Batch best practices. Unlike the
+// validation done on submission, its findings are advisory: a job with
+// warnings is still accepted.
+package lint
+
+import (
+	"fmt"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+)
+
+// Kinds of warnings reported by Check.
+const (
+	// KindNoMaxRunDuration is a task group without a maxRunDuration, whose
+	// tasks may run for up to the default of 7 days.
+	KindNoMaxRunDuration = "NO_MAX_RUN_DURATION"
+	// KindNoRetries is a task group whose tasks are not retried.
+	KindNoRetries = "NO_RETRIES"
+	// KindDeprecatedField is a field or value superseded by another one.
+	KindDeprecatedField = "DEPRECATED_FIELD"
+	// KindOversizedEnvironment is a task whose environment variables exceed
+	// MaxEnvironmentSize.
+	KindOversizedEnvironment = "OVERSIZED_ENVIRONMENT"
+	// KindMachineCatalog is a machine or accelerator type the server's
+	// catalog does not offer in the job's region. Check does not report it;
+	// the server does when started with a catalog.
+	KindMachineCatalog = "MACHINE_CATALOG"
+	// KindLocationShorthand is an allowed location given as a bare region or
+	// zone name, which the server accepts but the service rejects. Check
+	// does not report it; CreateJob does.
+	KindLocationShorthand = "LOCATION_SHORTHAND"
+)
+
+// MaxEnvironmentSize is the combined size in bytes of the names and values of
+// a task's environment variables above which Check warns.
+const MaxEnvironmentSize = 32 * 1024
+
+// Warning is a single best-practice violation.
+type Warning struct {
+	Kind string `json:"kind"`
+	// Field is the path of the offending field, e.g.
+	// "taskGroups[0].taskSpec.maxRunDuration".
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Check returns the warnings for job, in the order of its fields.
+func Check(job *api.Job) []*Warning {
+	warnings := []*Warning{}
+	warn := func(kind, field, format string, args ...interface{}) {
+		warnings = append(warnings, &Warning{Kind: kind, Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	for i, taskGroup := range job.TaskGroups {
+		prefix := fmt.Sprintf("taskGroups[%d]", i)
+		spec := taskGroup.TaskSpec
+		if spec == nil {
+			spec = &api.TaskSpec{}
+		}
+
+		if spec.MaxRunDuration == "" {
+			warn(KindNoMaxRunDuration, prefix+".taskSpec.maxRunDuration",
+				"maxRunDuration is not set; tasks that hang run for up to 7 days")
+		}
+		if spec.MaxRetryCount == 0 {
+			warn(KindNoRetries, prefix+".taskSpec.maxRetryCount",
+				"maxRetryCount is 0; a single transient failure fails the task")
+		}
+		if len(spec.Environments) > 0 {
+			warn(KindDeprecatedField, prefix+".taskSpec.environments",
+				"environments is deprecated; use environment.variables")
+		}
+
+		if size := environmentSize(taskGroup); size > MaxEnvironmentSize {
+			warn(KindOversizedEnvironment, prefix+".taskSpec",
+				"environment variables take %d bytes, more than %d; pass large values through files or Secret Manager", size, MaxEnvironmentSize)
+		}
+	}
+
+	if job.AllocationPolicy != nil {
+		for i, instance := range job.AllocationPolicy.Instances {
+			if instance.Policy != nil && instance.Policy.ProvisioningModel == "PREEMPTIBLE" {
+				warn(KindDeprecatedField, fmt.Sprintf("allocationPolicy.instances[%d].policy.provisioningModel", i),
+					"PREEMPTIBLE is deprecated; use SPOT")
+			}
+		}
+	}
+
+	return warnings
+}
+
+// environmentSize returns the combined size of the environment variables of
+// the runnable of taskGroup that gets the most.
+func environmentSize(taskGroup *api.TaskGroup) int {
+	spec := taskGroup.TaskSpec
+	if spec == nil {
+		return 0
+	}
+
+	tasks := []*api.Environment{nil}
+	if len(taskGroup.TaskEnvironments) > 0 {
+		tasks = taskGroup.TaskEnvironments
+	}
+	runnables := []*api.Environment{nil}
+	for _, runnable := range spec.Runnables {
+		runnables = append(runnables, runnable.Environment)
+	}
+
+	largest := 0
+	for _, task := range tasks {
+		for _, runnable := range runnables {
+			env := map[string]string{}
+			for name, value := range spec.Environments {
+				env[name] = value
+			}
+			merge(env, spec.Environment)
+			merge(env, task)
+			merge(env, runnable)
+
+			n := 0
+			for name, value := range env {
+				n += len(name) + len(value)
+			}
+			if n > largest {
+				largest = n
+			}
+		}
+	}
+	return largest
+}
+
+// merge copies the variables and secret variables of environment into env.
+func merge(env map[string]string, environment *api.Environment) {
+	if environment == nil {
+		return
+	}
+	for name, value := range environment.Variables {
+		env[name] = value
+	}
+	for name, value := range environment.SecretVariables {
+		env[name] = value
+	}
+}
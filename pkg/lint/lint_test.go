@@ -0,0 +1,79 @@
+package lint
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+)
+
+func kinds(warnings []*Warning) []string {
+	result := []string{}
+	for _, warning := range warnings {
+		result = append(result, warning.Kind+" "+warning.Field)
+	}
+	return result
+}
+
+func TestCheck_Clean(t *testing.T) {
+	job := &api.Job{TaskGroups: []*api.TaskGroup{{
+		TaskSpec: &api.TaskSpec{
+			MaxRunDuration: "3600s",
+			MaxRetryCount:  2,
+			Runnables:      []*api.Runnable{{Script: &api.Script{Text: "echo hi"}}},
+		},
+	}}}
+
+	assert.Empty(t, Check(job))
+}
+
+func TestCheck(t *testing.T) {
+	job := &api.Job{
+		TaskGroups: []*api.TaskGroup{
+			{TaskSpec: &api.TaskSpec{Environments: map[string]string{"A": "1"}}},
+			{},
+		},
+		AllocationPolicy: &api.AllocationPolicy{Instances: []*api.InstancePolicyOrTemplate{
+			{Policy: &api.InstancePolicy{ProvisioningModel: "SPOT"}},
+			{Policy: &api.InstancePolicy{ProvisioningModel: "PREEMPTIBLE"}},
+			{InstanceTemplate: "batch-template"},
+		}},
+	}
+
+	assert.Equal(t, []string{
+		"NO_MAX_RUN_DURATION taskGroups[0].taskSpec.maxRunDuration",
+		"NO_RETRIES taskGroups[0].taskSpec.maxRetryCount",
+		"DEPRECATED_FIELD taskGroups[0].taskSpec.environments",
+		"NO_MAX_RUN_DURATION taskGroups[1].taskSpec.maxRunDuration",
+		"NO_RETRIES taskGroups[1].taskSpec.maxRetryCount",
+		"DEPRECATED_FIELD allocationPolicy.instances[1].policy.provisioningModel",
+	}, kinds(Check(job)))
+}
+
+func TestCheck_OversizedEnvironment(t *testing.T) {
+	half := strings.Repeat("x", MaxEnvironmentSize/2)
+	spec := func() *api.TaskSpec {
+		return &api.TaskSpec{
+			MaxRunDuration: "3600s",
+			MaxRetryCount:  1,
+			Environment:    &api.Environment{Variables: map[string]string{"A": half}},
+			Runnables: []*api.Runnable{
+				{Environment: &api.Environment{Variables: map[string]string{"B": half[:len(half)/2]}}},
+				{Environment: &api.Environment{Variables: map[string]string{"C": half[:len(half)/2]}}},
+			},
+		}
+	}
+
+	// Each runnable gets its own variables, so they are not added up.
+	job := &api.Job{TaskGroups: []*api.TaskGroup{{TaskSpec: spec()}}}
+	assert.Empty(t, Check(job))
+
+	// A task environment pushes one task over the limit.
+	job.TaskGroups[0].TaskEnvironments = []*api.Environment{
+		nil,
+		{SecretVariables: map[string]string{"D": half}},
+	}
+	assert.Equal(t, []string{"OVERSIZED_ENVIRONMENT taskGroups[0].taskSpec"}, kinds(Check(job)))
+}
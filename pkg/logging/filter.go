@@ -0,0 +1,157 @@
+package logging
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// severities orders the LogSeverity names.
+var severities = map[string]int{
+	"DEFAULT":   0,
+	"DEBUG":     100,
+	"INFO":      200,
+	"NOTICE":    300,
+	"WARNING":   400,
+	"ERROR":     500,
+	"CRITICAL":  600,
+	"ALERT":     700,
+	"EMERGENCY": 800,
+}
+
+// comparison is a single `field op value` term of a filter.
+type comparison struct {
+	field string
+	op    string
+	value string
+}
+
+// Filter is a parsed logging query. Only conjunctions of comparisons are
+// supported, e.g. `logName="projects/p/logs/batch_task_logs" AND
+// labels.job_uid="abc" severity>=WARNING`.
+type Filter []comparison
+
+var termPattern = regexp.MustCompile(`^\s*([A-Za-z_][\w.]*)\s*(!=|>=|<=|=|>|<|:)\s*("(?:[^"\\]|\\.)*"|[^\s()]+)`)
+
+// ParseFilter parses a filter in the supported subset of the logging query
+// language. An empty filter matches every entry.
+func ParseFilter(s string) (Filter, error) {
+	var filter Filter
+	rest := strings.TrimSpace(s)
+	for rest != "" {
+		if strings.HasPrefix(rest, "AND ") || strings.HasPrefix(rest, "AND\t") {
+			rest = strings.TrimSpace(rest[3:])
+			continue
+		}
+
+		m := termPattern.FindStringSubmatch(rest)
+		if m == nil {
+			return nil, fmt.Errorf("unsupported filter near %q; only comparisons joined by AND are supported", rest)
+		}
+		value := m[3]
+		if strings.HasPrefix(value, `"`) {
+			unquoted, err := strconv.Unquote(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid string %s", value)
+			}
+			value = unquoted
+		}
+		filter = append(filter, comparison{field: m[1], op: m[2], value: value})
+		rest = strings.TrimSpace(rest[len(m[0]):])
+	}
+	return filter, nil
+}
+
+// Match reports whether entry satisfies every term of the filter.
+func (f Filter) Match(entry *LogEntry) bool {
+	for _, c := range f {
+		if !c.match(entry) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c comparison) match(entry *LogEntry) bool {
+	switch c.field {
+	case "timestamp":
+		t, err := time.Parse(time.RFC3339Nano, c.value)
+		if err != nil {
+			return false
+		}
+		return compare(entry.Timestamp.Compare(t), c.op)
+	case "severity":
+		level, ok := severities[strings.ToUpper(c.value)]
+		if !ok {
+			return false
+		}
+		return compare(severities[entry.Severity]-level, c.op)
+	}
+
+	value, ok := fieldValue(entry, c.field)
+	switch c.op {
+	case "=":
+		return ok && value == c.value
+	case "!=":
+		return !ok || value != c.value
+	case ":":
+		return ok && strings.Contains(value, c.value)
+	default:
+		return ok && compare(strings.Compare(value, c.value), c.op)
+	}
+}
+
+// fieldValue looks up a field path of entry.
+func fieldValue(entry *LogEntry, field string) (string, bool) {
+	switch {
+	case field == "logName":
+		return entry.LogName, true
+	case field == "textPayload":
+		return entry.TextPayload, true
+	case field == "insertId":
+		return entry.InsertID, true
+	case field == "resource.type":
+		return entry.resourceType(), entry.Resource != nil
+	case strings.HasPrefix(field, "resource.labels."):
+		if entry.Resource == nil {
+			return "", false
+		}
+		value, ok := entry.Resource.Labels[strings.TrimPrefix(field, "resource.labels.")]
+		return value, ok
+	case strings.HasPrefix(field, "labels."):
+		value, ok := entry.Labels[strings.TrimPrefix(field, "labels.")]
+		return value, ok
+	default:
+		return "", false
+	}
+}
+
+func (e *LogEntry) resourceType() string {
+	if e.Resource == nil {
+		return ""
+	}
+	return e.Resource.Type
+}
+
+// compare applies an ordering operator to the result of a three-way
+// comparison.
+func compare(cmp int, op string) bool {
+	switch op {
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	default:
+		return false
+	}
+}
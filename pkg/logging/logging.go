@@ -0,0 +1,143 @@
+// Package logging implements the parts of the Cloud Logging v2 API that code
+// reading Batch task logs relies on: entries:list with a subset of the
+// filter language, and entries:write.
+package logging
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log names and resource types used for Batch task logs.
+const (
+	// TaskLogName is the log ID Batch writes task output to.
+	TaskLogName = "batch_task_logs"
+	// JobResourceType is the monitored resource type of Batch task logs.
+	JobResourceType = "batch.googleapis.com/Job"
+)
+
+// MonitoredResource identifies the resource a log entry belongs to.
+type MonitoredResource struct {
+	Type   string            `json:"type"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// LogEntry is a single log entry.
+type LogEntry struct {
+	LogName     string             `json:"logName"`
+	Resource    *MonitoredResource `json:"resource,omitempty"`
+	Timestamp   time.Time          `json:"timestamp"`
+	Severity    string             `json:"severity,omitempty"`
+	InsertID    string             `json:"insertId,omitempty"`
+	Labels      map[string]string  `json:"labels,omitempty"`
+	TextPayload string             `json:"textPayload,omitempty"`
+	JSONPayload interface{}        `json:"jsonPayload,omitempty"`
+}
+
+// ListRequest is the body of entries:list.
+type ListRequest struct {
+	ResourceNames []string `json:"resourceNames"`
+	Filter        string   `json:"filter,omitempty"`
+	OrderBy       string   `json:"orderBy,omitempty"`
+	PageSize      int      `json:"pageSize,omitempty"`
+	PageToken     string   `json:"pageToken,omitempty"`
+}
+
+// ListResponse is the response of entries:list.
+type ListResponse struct {
+	Entries       []*LogEntry `json:"entries"`
+	NextPageToken string      `json:"nextPageToken,omitempty"`
+}
+
+// WriteRequest is the body of entries:write. LogName, Resource and Labels
+// are defaults for entries that do not set them.
+type WriteRequest struct {
+	LogName  string             `json:"logName,omitempty"`
+	Resource *MonitoredResource `json:"resource,omitempty"`
+	Labels   map[string]string  `json:"labels,omitempty"`
+	Entries  []*LogEntry        `json:"entries"`
+}
+
+// Store keeps the entries written through entries:write.
+type Store struct {
+	mu      sync.Mutex
+	entries []*LogEntry
+}
+
+// NewStore creates an empty Store.
+func NewStore() *Store {
+	return &Store{}
+}
+
+// Write stores entries, filling unset fields from the request defaults.
+func (s *Store) Write(req *WriteRequest, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, entry := range req.Entries {
+		if entry.LogName == "" {
+			entry.LogName = req.LogName
+		}
+		if entry.Resource == nil {
+			entry.Resource = req.Resource
+		}
+		if len(req.Labels) > 0 {
+			labels := make(map[string]string, len(req.Labels)+len(entry.Labels))
+			for name, value := range req.Labels {
+				labels[name] = value
+			}
+			for name, value := range entry.Labels {
+				labels[name] = value
+			}
+			entry.Labels = labels
+		}
+		if entry.Timestamp.IsZero() {
+			entry.Timestamp = now
+		}
+		s.entries = append(s.entries, entry)
+	}
+}
+
+// Entries returns the stored entries.
+func (s *Store) Entries() []*LogEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]*LogEntry{}, s.entries...)
+}
+
+// Reset drops every stored entry.
+func (s *Store) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries = nil
+}
+
+// InResources reports whether entry belongs to one of the given resource
+// names, e.g. "projects/p". Entries match any resource when none is given.
+func InResources(entry *LogEntry, resourceNames []string) bool {
+	if len(resourceNames) == 0 {
+		return true
+	}
+	for _, name := range resourceNames {
+		if strings.HasPrefix(entry.LogName, name+"/logs/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Sort orders entries by timestamp as requested by an orderBy of
+// "timestamp asc" (the default) or "timestamp desc".
+func Sort(entries []*LogEntry, orderBy string) {
+	desc := strings.EqualFold(strings.TrimSpace(orderBy), "timestamp desc")
+	sort.SliceStable(entries, func(i, j int) bool {
+		if desc {
+			return entries[i].Timestamp.After(entries[j].Timestamp)
+		}
+		return entries[i].Timestamp.Before(entries[j].Timestamp)
+	})
+}
@@ -0,0 +1,128 @@
+package logging
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseFilter(t *testing.T) {
+	for _, filter := range []string{
+		"",
+		`labels.job_uid="abc"`,
+		`logName="projects/p/logs/batch_task_logs" AND labels.job_uid="abc"`,
+		`labels.job_uid="abc" severity>=WARNING`,
+		`textPayload:"hello world"`,
+		`timestamp>="2024-01-01T00:00:00Z"`,
+	} {
+		_, err := ParseFilter(filter)
+		assert.NoError(t, err, filter)
+	}
+
+	for _, filter := range []string{
+		`labels.a="x" OR labels.a="y"`,
+		`NOT labels.a="x"`,
+		`(labels.a="x")`,
+		`labels.a=`,
+		`labels.a="x`,
+	} {
+		_, err := ParseFilter(filter)
+		assert.Error(t, err, filter)
+	}
+}
+
+func TestFilter_Match(t *testing.T) {
+	entry := &LogEntry{
+		LogName:     "projects/p/logs/batch_task_logs",
+		Resource:    &MonitoredResource{Type: JobResourceType, Labels: map[string]string{"job_id": "job"}},
+		Timestamp:   time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC),
+		Severity:    "WARNING",
+		Labels:      map[string]string{"job_uid": "abc"},
+		TextPayload: "hello world",
+	}
+
+	tests := map[string]bool{
+		``:                      true,
+		`labels.job_uid="abc"`:  true,
+		`labels.job_uid=abc`:    true,
+		`labels.job_uid="def"`:  false,
+		`labels.job_uid!="def"`: true,
+		`labels.missing!="def"`: true,
+		`labels.missing="def"`:  false,
+		`resource.type="batch.googleapis.com/Job"`: true,
+		`resource.labels.job_id="job"`:             true,
+		`textPayload:"world"`:                      true,
+		`textPayload:"planet"`:                     false,
+		`severity>=WARNING`:                        true,
+		`severity>warning`:                         false,
+		`severity<ERROR`:                           true,
+		`timestamp>="2024-01-01T12:00:00Z"`:        true,
+		`timestamp<"2024-01-01T12:00:00Z"`:         false,
+		`labels.job_uid="abc" severity=INFO`:       false,
+		`logName="projects/p/logs/batch_task_logs" AND labels.job_uid="abc"`: true,
+	}
+	for text, want := range tests {
+		filter, err := ParseFilter(text)
+		require.NoError(t, err, text)
+		assert.Equal(t, want, filter.Match(entry), text)
+	}
+}
+
+func TestStore_Write(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := NewStore()
+
+	store.Write(&WriteRequest{
+		LogName:  "projects/p/logs/app",
+		Resource: &MonitoredResource{Type: "global"},
+		Labels:   map[string]string{"env": "test", "job_uid": "abc"},
+		Entries: []*LogEntry{
+			{TextPayload: "first"},
+			{LogName: "projects/p/logs/other", Labels: map[string]string{"job_uid": "def"}, Timestamp: now.Add(-time.Hour)},
+		},
+	}, now)
+
+	entries := store.Entries()
+	require.Len(t, entries, 2)
+	assert.Equal(t, "projects/p/logs/app", entries[0].LogName)
+	assert.Equal(t, "global", entries[0].Resource.Type)
+	assert.Equal(t, now, entries[0].Timestamp)
+	assert.Equal(t, map[string]string{"env": "test", "job_uid": "abc"}, entries[0].Labels)
+
+	assert.Equal(t, "projects/p/logs/other", entries[1].LogName)
+	assert.Equal(t, now.Add(-time.Hour), entries[1].Timestamp)
+	assert.Equal(t, map[string]string{"env": "test", "job_uid": "def"}, entries[1].Labels)
+}
+
+func TestInResources(t *testing.T) {
+	entry := &LogEntry{LogName: "projects/p/logs/batch_task_logs"}
+
+	assert.True(t, InResources(entry, nil))
+	assert.True(t, InResources(entry, []string{"projects/q", "projects/p"}))
+	assert.False(t, InResources(entry, []string{"projects/q"}))
+	assert.False(t, InResources(entry, []string{"projects/pp"}))
+}
+
+func TestSort(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	entries := []*LogEntry{
+		{InsertID: "b", Timestamp: base.Add(time.Second)},
+		{InsertID: "a", Timestamp: base},
+		{InsertID: "c", Timestamp: base.Add(2 * time.Second)},
+	}
+	ids := func() []string {
+		var result []string
+		for _, entry := range entries {
+			result = append(result, entry.InsertID)
+		}
+		return result
+	}
+
+	Sort(entries, "")
+	assert.Equal(t, []string{"a", "b", "c"}, ids())
+
+	Sort(entries, "timestamp desc")
+	assert.Equal(t, []string{"c", "b", "a"}, ids())
+}
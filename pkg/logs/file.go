@@ -0,0 +1,52 @@
+package logs
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// fileWriter appends to a file that is only created once something is
+// written to it.
+type fileWriter struct {
+	path string
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewFileWriter returns a writer appending to the file at path. The file and
+// its directory are created on the first write.
+func NewFileWriter(path string) io.WriteCloser {
+	return &fileWriter{path: path}
+}
+
+func (w *fileWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		if err := os.MkdirAll(filepath.Dir(w.path), 0o755); err != nil {
+			return 0, err
+		}
+		file, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return 0, err
+		}
+		w.file = file
+	}
+	return w.file.Write(p)
+}
+
+func (w *fileWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
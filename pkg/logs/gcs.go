@@ -0,0 +1,236 @@
+package logs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ObjectWriter opens objects in a bucket for task logs to be written to.
+type ObjectWriter interface {
+	Writer(bucket, object string) io.WriteCloser
+}
+
+// GCS uploads task logs to a Cloud Storage emulator such as fake-gcs-server,
+// and syncs the buckets of GCS volumes with local directories.
+type GCS struct {
+	client   *http.Client
+	endpoint string
+}
+
+// NewGCS creates a GCS client for the JSON API at endpoint, e.g.
+// "http://localhost:4443" or, as in STORAGE_EMULATOR_HOST, "localhost:4443".
+// Uploads time out after timeout.
+func NewGCS(endpoint string, timeout time.Duration) *GCS {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "http://" + endpoint
+	}
+	return &GCS{client: &http.Client{Timeout: timeout}, endpoint: strings.TrimSuffix(endpoint, "/")}
+}
+
+// ParseGCSURL splits a gs://bucket/prefix URL. It reports false if path is
+// not a gs:// URL.
+func ParseGCSURL(path string) (bucket, prefix string, ok bool) {
+	rest, ok := strings.CutPrefix(path, "gs://")
+	if !ok {
+		return "", "", false
+	}
+	bucket, prefix, _ = strings.Cut(rest, "/")
+	return bucket, strings.Trim(prefix, "/"), true
+}
+
+// Writer returns a writer that collects its input and uploads it as object in
+// bucket when closed. Objects cannot be appended to, so nothing is visible
+// until the log is complete. Nothing is uploaded if nothing was written.
+func (g *GCS) Writer(bucket, object string) io.WriteCloser {
+	return &gcsWriter{gcs: g, bucket: bucket, object: object}
+}
+
+// BucketExists reports whether bucket exists.
+func (g *GCS) BucketExists(ctx context.Context, bucket string) (bool, error) {
+	resp, err := g.get(ctx, fmt.Sprintf("%s/storage/v1/b/%s", g.endpoint, url.PathEscape(bucket)))
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return false, nil
+	case resp.StatusCode >= 300:
+		return false, fmt.Errorf("getting bucket %s returned %d", bucket, resp.StatusCode)
+	}
+	return true, nil
+}
+
+// Download copies the objects of bucket under prefix into dir, keeping their
+// paths below prefix.
+func (g *GCS) Download(ctx context.Context, bucket, prefix, dir string) error {
+	if prefix != "" {
+		prefix = strings.TrimSuffix(prefix, "/") + "/"
+	}
+	pageToken := ""
+	for {
+		query := url.Values{"prefix": {prefix}}
+		if pageToken != "" {
+			query.Set("pageToken", pageToken)
+		}
+		resp, err := g.get(ctx, fmt.Sprintf("%s/storage/v1/b/%s/o?%s", g.endpoint, url.PathEscape(bucket), query.Encode()))
+		if err != nil {
+			return err
+		}
+		var list struct {
+			Items []struct {
+				Name string `json:"name"`
+			} `json:"items"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		err = decode(resp, &list)
+		if err != nil {
+			return fmt.Errorf("listing gs://%s/%s: %v", bucket, prefix, err)
+		}
+
+		for _, item := range list.Items {
+			name := strings.TrimPrefix(item.Name, prefix)
+			if name == "" || strings.HasSuffix(name, "/") || !fs.ValidPath(name) {
+				continue
+			}
+			if err := g.download(ctx, bucket, item.Name, filepath.Join(dir, filepath.FromSlash(name))); err != nil {
+				return err
+			}
+		}
+		if pageToken = list.NextPageToken; pageToken == "" {
+			return nil
+		}
+	}
+}
+
+// download stores object of bucket in the file at path.
+func (g *GCS) download(ctx context.Context, bucket, object, path string) error {
+	resp, err := g.get(ctx, fmt.Sprintf("%s/storage/v1/b/%s/o/%s?alt=media", g.endpoint, url.PathEscape(bucket), url.PathEscape(object)))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("downloading gs://%s/%s returned %d", bucket, object, resp.StatusCode)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Upload copies the files in dir to bucket under prefix, replacing the
+// objects of the same names.
+func (g *GCS) Upload(ctx context.Context, bucket, prefix, dir string) error {
+	return filepath.WalkDir(dir, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		return g.upload(ctx, bucket, path.Join(prefix, filepath.ToSlash(rel)), data, "application/octet-stream")
+	})
+}
+
+// get sends a GET request to the JSON API.
+func (g *GCS) get(ctx context.Context, u string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	return g.client.Do(req)
+}
+
+// decode decodes the JSON body of a successful response into v.
+func decode(resp *http.Response, v interface{}) error {
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("returned %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// upload stores data as object in bucket with a simple media upload.
+func (g *GCS) upload(ctx context.Context, bucket, object string, data []byte, contentType string) error {
+	u := fmt.Sprintf("%s/upload/storage/v1/b/%s/o?%s", g.endpoint, url.PathEscape(bucket),
+		url.Values{"uploadType": {"media"}, "name": {object}}.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("uploading gs://%s/%s returned %d: %s", bucket, object, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// gcsWriter buffers a log until it is closed.
+type gcsWriter struct {
+	gcs    *GCS
+	bucket string
+	object string
+
+	mu     sync.Mutex
+	buf    bytes.Buffer
+	closed bool
+}
+
+func (w *gcsWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return 0, fmt.Errorf("write to closed log gs://%s/%s", w.bucket, w.object)
+	}
+	return w.buf.Write(p)
+}
+
+func (w *gcsWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed || w.buf.Len() == 0 {
+		w.closed = true
+		return nil
+	}
+	w.closed = true
+	return w.gcs.upload(context.Background(), w.bucket, w.object, w.buf.Bytes(), "text/plain; charset=utf-8")
+}
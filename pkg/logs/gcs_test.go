@@ -0,0 +1,158 @@
+package logs
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeGCS records media uploads by bucket/object, and serves them back.
+// Every bucket but "missing" exists.
+type fakeGCS struct {
+	mu      sync.Mutex
+	objects map[string]string
+}
+
+func (f *fakeGCS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		f.serveGet(w, r)
+		return
+	}
+	const prefix = "/upload/storage/v1/b/"
+	if r.Method != http.MethodPost || len(r.URL.Path) <= len(prefix) || r.URL.Query().Get("uploadType") != "media" {
+		http.NotFound(w, r)
+		return
+	}
+	bucket := r.URL.Path[len(prefix) : len(r.URL.Path)-len("/o")]
+	if bucket == "missing" {
+		http.Error(w, "no such bucket", http.StatusNotFound)
+		return
+	}
+
+	data, _ := io.ReadAll(r.Body)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[bucket+"/"+r.URL.Query().Get("name")] = string(data)
+	w.Write([]byte(`{}`))
+}
+
+// serveGet serves buckets, object listings and object media.
+func (f *fakeGCS) serveGet(w http.ResponseWriter, r *http.Request) {
+	bucket, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/storage/v1/b/"), "/")
+	if bucket == "missing" {
+		http.Error(w, "no such bucket", http.StatusNotFound)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch {
+	case rest == "":
+		w.Write([]byte(`{}`))
+	case rest == "o":
+		var items []map[string]string
+		for name := range f.objects {
+			if object, ok := strings.CutPrefix(name, bucket+"/"); ok && strings.HasPrefix(object, r.URL.Query().Get("prefix")) {
+				items = append(items, map[string]string{"name": object})
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"items": items})
+	default:
+		data, ok := f.objects[bucket+"/"+strings.TrimPrefix(rest, "o/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(data))
+	}
+}
+
+func setupGCS(t *testing.T) (*GCS, *fakeGCS) {
+	fake := &fakeGCS{objects: make(map[string]string)}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return NewGCS(server.URL, time.Second), fake
+}
+
+func TestParseGCSURL(t *testing.T) {
+	bucket, prefix, ok := ParseGCSURL("gs://logs/batch/")
+	assert.True(t, ok)
+	assert.Equal(t, "logs", bucket)
+	assert.Equal(t, "batch", prefix)
+
+	bucket, prefix, ok = ParseGCSURL("gs://logs")
+	assert.True(t, ok)
+	assert.Equal(t, "logs", bucket)
+	assert.Empty(t, prefix)
+
+	_, _, ok = ParseGCSURL("/mnt/logs")
+	assert.False(t, ok)
+}
+
+func TestGCS_Writer(t *testing.T) {
+	gcs, fake := setupGCS(t)
+	store := NewStore()
+
+	store.Mirror(task, gcs.Writer("logs", "batch/uid/group0/task-0.log"))
+	store.Append(task, Entry{Text: "one"})
+	store.Append(task, Entry{Text: "two"})
+	assert.Empty(t, fake.objects, "objects are uploaded when the log is complete")
+
+	store.Close(task)
+	assert.Equal(t, map[string]string{"logs/batch/uid/group0/task-0.log": "one\ntwo\n"}, fake.objects)
+
+	// Empty logs are not uploaded.
+	require.NoError(t, gcs.Writer("logs", "empty.log").Close())
+	assert.Len(t, fake.objects, 1)
+
+	w := gcs.Writer("missing", "task-0.log")
+	_, err := w.Write([]byte("text\n"))
+	require.NoError(t, err)
+	err = w.Close()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no such bucket")
+}
+
+func TestGCS_Volumes(t *testing.T) {
+	gcs, fake := setupGCS(t)
+	ctx := context.Background()
+	fake.objects["data/input/a.txt"] = "a"
+	fake.objects["data/input/nested/b.txt"] = "b"
+	fake.objects["data/inputs.txt"] = "not under the prefix"
+
+	exists, err := gcs.BucketExists(ctx, "data")
+	require.NoError(t, err)
+	assert.True(t, exists)
+	exists, err = gcs.BucketExists(ctx, "missing")
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	dir := t.TempDir()
+	require.NoError(t, gcs.Download(ctx, "data", "input", dir))
+	data, err := os.ReadFile(filepath.Join(dir, "nested", "b.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "b", string(data))
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	assert.Equal(t, []string{"a.txt", "nested"}, names, "only the objects under the prefix are downloaded")
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "c.txt"), []byte("c"), 0o644))
+	require.NoError(t, gcs.Upload(ctx, "data", "output", dir))
+	assert.Equal(t, "c", fake.objects["data/output/c.txt"])
+	assert.Equal(t, "b", fake.objects["data/output/nested/b.txt"])
+}
@@ -0,0 +1,249 @@
+// Package logs captures the output of tasks so it can be retrieved and
+// followed through the API.
+package logs
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Entry is a single line of task output.
+type Entry struct {
+	Time time.Time `json:"time"`
+	// Runnable is the index of the runnable that wrote the line.
+	Runnable int    `json:"runnable"`
+	Text     string `json:"text"`
+}
+
+// taskLog holds the output of a single task.
+type taskLog struct {
+	entries []Entry
+	closed  bool
+	// mirror, if set, receives the text of every entry.
+	mirror io.WriteCloser
+	// changed is closed and replaced whenever an entry is added or the log
+	// is closed, waking up followers.
+	changed chan struct{}
+}
+
+func newTaskLog() *taskLog {
+	return &taskLog{changed: make(chan struct{})}
+}
+
+func (l *taskLog) notify() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// close marks the log complete and detaches its mirror, which the caller
+// must close once it no longer holds the store's lock: closing a mirror may
+// be slow, e.g. when it uploads the log.
+func (l *taskLog) close() io.WriteCloser {
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	l.notify()
+	mirror := l.mirror
+	l.mirror = nil
+	return mirror
+}
+
+// closeMirror closes a mirror detached from the log of task.
+func closeMirror(task string, mirror io.WriteCloser) {
+	if mirror == nil {
+		return
+	}
+	if err := mirror.Close(); err != nil {
+		logrus.Warnf("Failed to close log of %s: %v", task, err)
+	}
+}
+
+// Store keeps the output of every task in memory, keyed by task name.
+type Store struct {
+	mu    sync.Mutex
+	tasks map[string]*taskLog
+}
+
+// NewStore creates an empty Store.
+func NewStore() *Store {
+	return &Store{tasks: make(map[string]*taskLog)}
+}
+
+// get returns the log of task, creating it if needed. s.mu must be held.
+func (s *Store) get(task string) *taskLog {
+	l, ok := s.tasks[task]
+	if !ok {
+		l = newTaskLog()
+		s.tasks[task] = l
+	}
+	return l
+}
+
+// Append adds entry to the log of task. Entries appended after Close are
+// dropped.
+func (s *Store) Append(task string, entry Entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l := s.get(task)
+	if l.closed {
+		return
+	}
+	l.entries = append(l.entries, entry)
+	l.notify()
+
+	if l.mirror != nil {
+		if _, err := io.WriteString(l.mirror, entry.Text+"\n"); err != nil {
+			logrus.Warnf("Failed to write log of %s: %v", task, err)
+			l.mirror.Close()
+			l.mirror = nil
+		}
+	}
+}
+
+// Mirror makes the text of every entry later appended to the log of task also
+// be written to w, one line per entry. w is closed with the log.
+func (s *Store) Mirror(task string, w io.WriteCloser) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l := s.get(task)
+	if l.closed {
+		w.Close()
+		return
+	}
+	if l.mirror != nil {
+		l.mirror.Close()
+	}
+	l.mirror = w
+}
+
+// Close marks the log of task as complete, ending any Follow of it.
+func (s *Store) Close(task string) {
+	s.mu.Lock()
+	mirror := s.get(task).close()
+	s.mu.Unlock()
+
+	closeMirror(task, mirror)
+}
+
+// Entries returns a copy of the log of task.
+func (s *Store) Entries(task string) []Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l, ok := s.tasks[task]
+	if !ok {
+		return []Entry{}
+	}
+	return append([]Entry{}, l.entries...)
+}
+
+// Follow calls fn with every entry of the log of task, waiting for new ones,
+// until the log is closed, ctx is done or fn returns an error.
+func (s *Store) Follow(ctx context.Context, task string, fn func(Entry) error) error {
+	s.mu.Lock()
+	l := s.get(task)
+	s.mu.Unlock()
+
+	next := 0
+	for {
+		s.mu.Lock()
+		entries := l.entries[next:]
+		closed := l.closed
+		changed := l.changed
+		s.mu.Unlock()
+
+		for _, entry := range entries {
+			if err := fn(entry); err != nil {
+				return err
+			}
+		}
+		next += len(entries)
+
+		if closed {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// DeleteJob drops the logs of every task of the job named job, ending any
+// Follow of them.
+func (s *Store) DeleteJob(job string) {
+	s.mu.Lock()
+	mirrors := make(map[string]io.WriteCloser)
+	prefix := job + "/"
+	for task, l := range s.tasks {
+		if strings.HasPrefix(task, prefix) {
+			mirrors[task] = l.close()
+			delete(s.tasks, task)
+		}
+	}
+	s.mu.Unlock()
+
+	for task, mirror := range mirrors {
+		closeMirror(task, mirror)
+	}
+}
+
+// Writer returns a writer that appends every line written to it to the log
+// of task, stamped with now. Closing it flushes an unterminated last line.
+func (s *Store) Writer(task string, runnable int, now func() time.Time) io.WriteCloser {
+	return &lineWriter{store: s, task: task, runnable: runnable, now: now}
+}
+
+// lineWriter splits its input into log entries.
+type lineWriter struct {
+	store    *Store
+	task     string
+	runnable int
+	now      func() time.Time
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.emit(w.buf[:i])
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+func (w *lineWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.buf) > 0 {
+		w.emit(w.buf)
+		w.buf = nil
+	}
+	return nil
+}
+
+func (w *lineWriter) emit(line []byte) {
+	text := strings.TrimSuffix(string(line), "\r")
+	w.store.Append(w.task, Entry{Time: w.now(), Runnable: w.runnable, Text: text})
+}
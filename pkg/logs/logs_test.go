@@ -0,0 +1,136 @@
+package logs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const task = "projects/p/locations/l/jobs/job/taskGroups/group0/tasks/0"
+
+func texts(entries []Entry) []string {
+	result := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		result = append(result, entry.Text)
+	}
+	return result
+}
+
+func TestStore_AppendAndEntries(t *testing.T) {
+	store := NewStore()
+	assert.Empty(t, store.Entries(task))
+
+	store.Append(task, Entry{Text: "one"})
+	store.Append(task, Entry{Text: "two"})
+	assert.Equal(t, []string{"one", "two"}, texts(store.Entries(task)))
+
+	// Entries after Close are dropped.
+	store.Close(task)
+	store.Append(task, Entry{Text: "three"})
+	assert.Equal(t, []string{"one", "two"}, texts(store.Entries(task)))
+}
+
+func TestStore_Follow(t *testing.T) {
+	store := NewStore()
+	store.Append(task, Entry{Text: "one"})
+
+	followed := make(chan string)
+	done := make(chan error, 1)
+	go func() {
+		done <- store.Follow(context.Background(), task, func(entry Entry) error {
+			followed <- entry.Text
+			return nil
+		})
+	}()
+
+	assert.Equal(t, "one", <-followed)
+	store.Append(task, Entry{Text: "two"})
+	assert.Equal(t, "two", <-followed)
+
+	store.Close(task)
+	assert.NoError(t, <-done)
+}
+
+func TestStore_FollowCancelled(t *testing.T) {
+	store := NewStore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := store.Follow(ctx, task, func(Entry) error { return nil })
+	assert.ErrorIs(t, err, context.Canceled)
+
+	// Errors returned by the callback end the follow.
+	store.Append(task, Entry{Text: "one"})
+	err = store.Follow(context.Background(), task, func(Entry) error { return fmt.Errorf("gone") })
+	assert.EqualError(t, err, "gone")
+}
+
+func TestStore_DeleteJob(t *testing.T) {
+	store := NewStore()
+	other := "projects/p/locations/l/jobs/job2/taskGroups/group0/tasks/0"
+	store.Append(task, Entry{Text: "one"})
+	store.Append(other, Entry{Text: "two"})
+
+	following := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- store.Follow(context.Background(), task, func(Entry) error {
+			close(following)
+			return nil
+		})
+	}()
+
+	<-following
+	store.DeleteJob("projects/p/locations/l/jobs/job")
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("follow did not end")
+	}
+	assert.Empty(t, store.Entries(task))
+	assert.Len(t, store.Entries(other), 1)
+}
+
+func TestWriter(t *testing.T) {
+	store := NewStore()
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	w := store.Writer(task, 2, func() time.Time { return now })
+
+	_, err := w.Write([]byte("hello\r\nwor"))
+	require.NoError(t, err)
+	_, err = w.Write([]byte("ld\npartial"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"hello", "world"}, texts(store.Entries(task)))
+
+	require.NoError(t, w.Close())
+	entries := store.Entries(task)
+	assert.Equal(t, []string{"hello", "world", "partial"}, texts(entries))
+	assert.Equal(t, 2, entries[2].Runnable)
+	assert.Equal(t, now, entries[2].Time)
+}
+
+func TestStore_Mirror(t *testing.T) {
+	store := NewStore()
+	path := filepath.Join(t.TempDir(), "job", "group0", "task-0.log")
+
+	store.Append(task, Entry{Text: "before"})
+	store.Mirror(task, NewFileWriter(path))
+	_, err := os.Stat(path)
+	assert.True(t, os.IsNotExist(err), "file is created on the first write")
+
+	store.Append(task, Entry{Text: "one"})
+	store.Append(task, Entry{Text: "two"})
+	store.Close(task)
+	store.Append(task, Entry{Text: "after"})
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "one\ntwo\n", string(data))
+}
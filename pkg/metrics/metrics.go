@@ -0,0 +1,302 @@
+// Package metrics is a minimal Prometheus instrumentation library: counters,
+// histograms and gauges computed at scrape time, written in the text
+// exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContentType is the content type of the text exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefaultBuckets are the histogram buckets, in seconds, suited to request
+// latencies.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Registry holds metrics and writes them out in registration order.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+// metric is a family of samples sharing a name.
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+// NewRegistry creates an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.metrics = append(r.metrics, m)
+}
+
+// Write writes every metric to w in the text exposition format.
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	metrics := append([]metric{}, r.metrics...)
+	r.mu.Unlock()
+
+	buf := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(buf)
+	}
+	return buf.Flush()
+}
+
+// ServeHTTP serves the metrics for scraping.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	r.Write(w)
+}
+
+// desc holds what every metric family has in common.
+type desc struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+}
+
+func (d *desc) header(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, helpEscaper.Replace(d.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, d.typ)
+}
+
+// sample writes a single sample of the metric named name+suffix. extra is
+// an additional label pair such as le="0.5".
+func (d *desc) sample(w *bufio.Writer, suffix string, values []string, extra string, value float64) {
+	w.WriteString(d.name + suffix)
+	if len(values) > 0 || extra != "" {
+		w.WriteByte('{')
+		for i, label := range d.labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, `%s="%s"`, label, labelEscaper.Replace(values[i]))
+		}
+		if extra != "" {
+			if len(values) > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(extra)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(value))
+	w.WriteByte('\n')
+}
+
+func (d *desc) check(values []string) {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metric %s takes %d label values, got %d", d.name, len(d.labels), len(values)))
+	}
+}
+
+// helpEscaper escapes help text as the exposition format requires.
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+// labelEscaper escapes label values as the exposition format requires.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+// key joins label values into a map key.
+func key(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+// CounterVec is a counter partitioned by labels.
+type CounterVec struct {
+	desc
+	mu     sync.Mutex
+	values map[string]float64
+	labels map[string][]string
+}
+
+// NewCounterVec registers a counter with the given label names.
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		desc:   desc{name: name, help: help, typ: "counter", labels: labels},
+		values: make(map[string]float64),
+		labels: make(map[string][]string),
+	}
+	r.register(c)
+	return c
+}
+
+// Inc adds one to the counter with the given label values.
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add adds delta, which must not be negative, to the counter with the given
+// label values.
+func (c *CounterVec) Add(delta float64, values ...string) {
+	c.check(values)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	k := key(values)
+	c.values[k] += delta
+	c.labels[k] = values
+}
+
+// Value returns the counter with the given label values.
+func (c *CounterVec) Value(values ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.values[key(values)]
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.header(w)
+	for _, k := range sortedKeys(c.values) {
+		c.sample(w, "", c.labels[k], "", c.values[k])
+	}
+}
+
+// HistogramVec is a histogram partitioned by labels.
+type HistogramVec struct {
+	desc
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogram
+}
+
+type histogram struct {
+	labels []string
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogramVec registers a histogram with the given upper bounds, in
+// increasing order, and label names.
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{
+		desc:    desc{name: name, help: help, typ: "histogram", labels: labels},
+		buckets: buckets,
+		series:  make(map[string]*histogram),
+	}
+	r.register(h)
+	return h
+}
+
+// Observe adds value to the histogram with the given label values.
+func (h *HistogramVec) Observe(value float64, values ...string) {
+	h.check(values)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	k := key(values)
+	s, ok := h.series[k]
+	if !ok {
+		s = &histogram{labels: values, counts: make([]uint64, len(h.buckets))}
+		h.series[k] = s
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += value
+}
+
+// Count returns the number of observations of the histogram with the given
+// label values.
+func (h *HistogramVec) Count(values ...string) uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if s, ok := h.series[key(values)]; ok {
+		return s.count
+	}
+	return 0
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.header(w)
+	for _, k := range sortedKeys(h.series) {
+		s := h.series[k]
+		for i, bound := range h.buckets {
+			h.sample(w, "_bucket", s.labels, `le="`+formatFloat(bound)+`"`, float64(s.counts[i]))
+		}
+		h.sample(w, "_bucket", s.labels, `le="+Inf"`, float64(s.count))
+		h.sample(w, "_sum", s.labels, "", s.sum)
+		h.sample(w, "_count", s.labels, "", float64(s.count))
+	}
+}
+
+// GaugeFunc is a gauge whose samples are collected at scrape time.
+type GaugeFunc struct {
+	desc
+	collect func(emit func(value float64, values ...string))
+}
+
+// NewGaugeFunc registers a gauge with the given label names. collect is
+// called on every scrape and reports each sample through emit.
+func (r *Registry) NewGaugeFunc(name, help string, labels []string, collect func(emit func(value float64, values ...string))) *GaugeFunc {
+	g := &GaugeFunc{desc: desc{name: name, help: help, typ: "gauge", labels: labels}, collect: collect}
+	r.register(g)
+	return g
+}
+
+func (g *GaugeFunc) write(w *bufio.Writer) {
+	values := make(map[string]float64)
+	labels := make(map[string][]string)
+	g.collect(func(value float64, vs ...string) {
+		g.check(vs)
+		k := key(vs)
+		values[k] = value
+		labels[k] = vs
+	})
+
+	g.header(w)
+	for _, k := range sortedKeys(values) {
+		g.sample(w, "", labels[k], "", values[k])
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
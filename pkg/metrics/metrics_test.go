@@ -0,0 +1,47 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry_Write(t *testing.T) {
+	registry := NewRegistry()
+	requests := registry.NewCounterVec("requests_total", "Requests handled.", "method", "code")
+	latency := registry.NewHistogramVec("latency_seconds", "Request latency.", []float64{0.1, 1})
+	registry.NewGaugeFunc("queue_length", "Jobs waiting,\nby queue.", []string{"queue"}, func(emit func(float64, ...string)) {
+		emit(3, `batch "a"`)
+	})
+
+	requests.Inc("GET", "200")
+	requests.Inc("GET", "200")
+	requests.Add(1.5, "POST", "500")
+	latency.Observe(0.05)
+	latency.Observe(0.5)
+	latency.Observe(5)
+
+	var buf bytes.Buffer
+	require.NoError(t, registry.Write(&buf))
+	assert.Equal(t, `# HELP requests_total Requests handled.
+# TYPE requests_total counter
+requests_total{method="GET",code="200"} 2
+requests_total{method="POST",code="500"} 1.5
+# HELP latency_seconds Request latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 1
+latency_seconds_bucket{le="1"} 2
+latency_seconds_bucket{le="+Inf"} 3
+latency_seconds_sum 5.55
+latency_seconds_count 3
+# HELP queue_length Jobs waiting,\nby queue.
+# TYPE queue_length gauge
+queue_length{queue="batch \"a\""} 3
+`, buf.String())
+
+	assert.Equal(t, 2.0, requests.Value("GET", "200"))
+	assert.Equal(t, uint64(3), latency.Count())
+	assert.Panics(t, func() { requests.Inc("GET") })
+}
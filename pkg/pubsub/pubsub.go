@@ -0,0 +1,238 @@
+// Package pubsub publishes the Pub/Sub messages requested by the
+// notifications of a job, either to a Pub/Sub emulator or to in-memory topics
+// that tests can read back.
+package pubsub
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+)
+
+// Message is a published Pub/Sub message. Data is the JSON of the job or
+// task whose state changed.
+type Message struct {
+	ID          string            `json:"messageId,omitempty"`
+	Data        []byte            `json:"data"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+	PublishTime time.Time         `json:"publishTime"`
+}
+
+// Publisher publishes messages to topics named like "projects/p/topics/t".
+type Publisher interface {
+	Publish(ctx context.Context, topic string, message *Message) error
+}
+
+// Topics keeps published messages in memory.
+type Topics struct {
+	mu     sync.Mutex
+	seq    int
+	topics map[string][]*Message
+}
+
+// NewTopics creates an empty set of topics.
+func NewTopics() *Topics {
+	return &Topics{topics: make(map[string][]*Message)}
+}
+
+// Publish appends message to topic, assigning it an ID.
+func (t *Topics) Publish(ctx context.Context, topic string, message *Message) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.seq++
+	message.ID = strconv.Itoa(t.seq)
+	t.topics[topic] = append(t.topics[topic], message)
+	return nil
+}
+
+// Messages returns the messages published to topic, oldest first.
+func (t *Topics) Messages(topic string) []*Message {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return append([]*Message{}, t.topics[topic]...)
+}
+
+// Clear drops the messages published to topic.
+func (t *Topics) Clear(topic string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.topics, topic)
+}
+
+// Reset drops the messages published to every topic.
+func (t *Topics) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.topics = make(map[string][]*Message)
+}
+
+// Emulator publishes messages to a Pub/Sub emulator.
+type Emulator struct {
+	client  *http.Client
+	baseURL string
+}
+
+// NewEmulator creates a publisher for the emulator at host, e.g.
+// "localhost:8085" as found in PUBSUB_EMULATOR_HOST.
+func NewEmulator(host string, timeout time.Duration) *Emulator {
+	baseURL := host
+	if !strings.Contains(host, "://") {
+		baseURL = "http://" + host
+	}
+	return &Emulator{client: &http.Client{Timeout: timeout}, baseURL: strings.TrimSuffix(baseURL, "/")}
+}
+
+// Publish sends message to topic through the topics.publish method.
+func (e *Emulator) Publish(ctx context.Context, topic string, message *Message) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"messages": []map[string]interface{}{{
+			"data":       message.Data,
+			"attributes": message.Attributes,
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.baseURL+"/v1/"+topic+":publish", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("emulator returned %d", resp.StatusCode)
+	}
+
+	var published struct {
+		MessageIDs []string `json:"messageIds"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&published); err == nil && len(published.MessageIDs) > 0 {
+		message.ID = published.MessageIDs[0]
+	}
+	return nil
+}
+
+// Notifier publishes the messages the notifications of a job ask for.
+type Notifier struct {
+	publisher Publisher
+}
+
+// NewNotifier creates a Notifier publishing through publisher.
+func NewNotifier(publisher Publisher) *Notifier {
+	return &Notifier{publisher: publisher}
+}
+
+// Notify publishes a message to every notification topic of job that asks
+// for the state change of task, or of the job itself if task is nil, made at
+// the given time. Failures are logged and the first one is returned.
+func (n *Notifier) Notify(ctx context.Context, job *api.Job, task *api.Task, at time.Time) error {
+	var first error
+	for _, notification := range job.Notifications {
+		if !matches(notification.Message, job, task) {
+			continue
+		}
+
+		message, err := newMessage(job, task, at)
+		if err != nil {
+			return err
+		}
+		if err := n.publisher.Publish(ctx, notification.PubsubTopic, message); err != nil {
+			logrus.Warnf("Failed to publish notification for %s to %s: %v", job.Name, notification.PubsubTopic, err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+// Validate checks the notifications of job: topics must be named like
+// "projects/p/topics/t" and messages must select a known type of change.
+func Validate(job *api.Job) error {
+	for i, notification := range job.Notifications {
+		parts := strings.Split(notification.PubsubTopic, "/")
+		if len(parts) != 4 || parts[0] != "projects" || parts[1] == "" || parts[2] != "topics" || parts[3] == "" {
+			return fmt.Errorf("invalid notifications[%d].pubsubTopic %q, must be projects/{project}/topics/{topic}", i, notification.PubsubTopic)
+		}
+
+		message := notification.Message
+		if message == nil {
+			continue
+		}
+		switch message.Type {
+		case api.NotificationTypeJobStateChanged:
+			if message.NewTaskState != "" {
+				return fmt.Errorf("notifications[%d].message.newTaskState requires type %s", i, api.NotificationTypeTaskStateChanged)
+			}
+		case api.NotificationTypeTaskStateChanged:
+			if message.NewJobState != "" {
+				return fmt.Errorf("notifications[%d].message.newJobState requires type %s", i, api.NotificationTypeJobStateChanged)
+			}
+		default:
+			return fmt.Errorf("unsupported notifications[%d].message.type %q", i, message.Type)
+		}
+	}
+	return nil
+}
+
+// matches reports whether a notification with message selects the state
+// change of task, or of job if task is nil.
+func matches(message *api.NotificationMessage, job *api.Job, task *api.Task) bool {
+	if message == nil {
+		return false
+	}
+	if task == nil {
+		return message.Type == api.NotificationTypeJobStateChanged &&
+			(message.NewJobState == "" || message.NewJobState == job.State)
+	}
+	return message.Type == api.NotificationTypeTaskStateChanged &&
+		(message.NewTaskState == "" || message.NewTaskState == task.Status.State)
+}
+
+// newMessage builds the message announcing the current state of task, or of
+// job if task is nil, with the attributes Batch sets.
+func newMessage(job *api.Job, task *api.Task, at time.Time) (*Message, error) {
+	attributes := map[string]string{
+		"JobName": job.Name,
+		"JobUID":  job.UID,
+	}
+
+	var data []byte
+	var err error
+	if task == nil {
+		attributes["Type"] = api.NotificationTypeJobStateChanged
+		attributes["NewJobState"] = string(job.State)
+		data, err = json.Marshal(job)
+	} else {
+		attributes["Type"] = api.NotificationTypeTaskStateChanged
+		attributes["TaskName"] = task.Name
+		attributes["NewTaskState"] = string(task.Status.State)
+		data, err = json.Marshal(task)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &Message{Data: data, Attributes: attributes, PublishTime: at}, nil
+}
@@ -0,0 +1,119 @@
+package pubsub
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+)
+
+func newJob(notifications ...*api.JobNotification) *api.Job {
+	return &api.Job{
+		Name:          "projects/p/locations/l/jobs/j",
+		UID:           "uid",
+		State:         api.JobStateRunning,
+		Notifications: notifications,
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := []*api.JobNotification{
+		{PubsubTopic: "projects/p/topics/t"},
+		{PubsubTopic: "projects/p/topics/t", Message: &api.NotificationMessage{Type: api.NotificationTypeJobStateChanged, NewJobState: api.JobStateFailed}},
+		{PubsubTopic: "projects/p/topics/t", Message: &api.NotificationMessage{Type: api.NotificationTypeTaskStateChanged, NewTaskState: api.TaskStateFailed}},
+	}
+	for _, notification := range valid {
+		assert.NoError(t, Validate(newJob(notification)))
+	}
+
+	invalid := []*api.JobNotification{
+		{PubsubTopic: "t"},
+		{PubsubTopic: "projects/p/subscriptions/s"},
+		{PubsubTopic: "projects/p/topics/t", Message: &api.NotificationMessage{Type: "STATE_CHANGED"}},
+		{PubsubTopic: "projects/p/topics/t", Message: &api.NotificationMessage{Type: api.NotificationTypeJobStateChanged, NewTaskState: api.TaskStateFailed}},
+		{PubsubTopic: "projects/p/topics/t", Message: &api.NotificationMessage{Type: api.NotificationTypeTaskStateChanged, NewJobState: api.JobStateFailed}},
+	}
+	for _, notification := range invalid {
+		assert.Error(t, Validate(newJob(notification)), notification.PubsubTopic)
+	}
+}
+
+func TestNotifier_Notify(t *testing.T) {
+	topics := NewTopics()
+	notifier := NewNotifier(topics)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	job := newJob(
+		&api.JobNotification{PubsubTopic: "projects/p/topics/jobs", Message: &api.NotificationMessage{Type: api.NotificationTypeJobStateChanged}},
+		&api.JobNotification{PubsubTopic: "projects/p/topics/failures", Message: &api.NotificationMessage{Type: api.NotificationTypeJobStateChanged, NewJobState: api.JobStateFailed}},
+		&api.JobNotification{PubsubTopic: "projects/p/topics/tasks", Message: &api.NotificationMessage{Type: api.NotificationTypeTaskStateChanged}},
+		&api.JobNotification{PubsubTopic: "projects/p/topics/silent"},
+	)
+	task := &api.Task{Name: job.Name + "/taskGroups/group0/tasks/0", Status: &api.TaskStatus{State: api.TaskStateSucceeded}}
+
+	require.NoError(t, notifier.Notify(context.Background(), job, nil, now))
+	require.NoError(t, notifier.Notify(context.Background(), job, task, now))
+
+	messages := topics.Messages("projects/p/topics/jobs")
+	require.Len(t, messages, 1)
+	assert.Equal(t, map[string]string{
+		"JobName":     job.Name,
+		"JobUID":      "uid",
+		"Type":        api.NotificationTypeJobStateChanged,
+		"NewJobState": "RUNNING",
+	}, messages[0].Attributes)
+	assert.Equal(t, now, messages[0].PublishTime)
+	var published api.Job
+	require.NoError(t, json.Unmarshal(messages[0].Data, &published))
+	assert.Equal(t, job.Name, published.Name)
+
+	messages = topics.Messages("projects/p/topics/tasks")
+	require.Len(t, messages, 1)
+	assert.Equal(t, task.Name, messages[0].Attributes["TaskName"])
+	assert.Equal(t, "SUCCEEDED", messages[0].Attributes["NewTaskState"])
+
+	assert.Empty(t, topics.Messages("projects/p/topics/failures"))
+	assert.Empty(t, topics.Messages("projects/p/topics/silent"))
+
+	topics.Clear("projects/p/topics/jobs")
+	assert.Empty(t, topics.Messages("projects/p/topics/jobs"))
+}
+
+func TestEmulator_Publish(t *testing.T) {
+	var path string
+	var body struct {
+		Messages []struct {
+			Data       string            `json:"data"`
+			Attributes map[string]string `json:"attributes"`
+		} `json:"messages"`
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		json.NewDecoder(r.Body).Decode(&body)
+		w.Write([]byte(`{"messageIds":["42"]}`))
+	}))
+	defer server.Close()
+
+	emulator := NewEmulator(server.Listener.Addr().String(), time.Second)
+	message := &Message{Data: []byte(`{"name":"job"}`), Attributes: map[string]string{"Type": "JOB_STATE_CHANGED"}}
+	require.NoError(t, emulator.Publish(context.Background(), "projects/p/topics/t", message))
+
+	assert.Equal(t, "/v1/projects/p/topics/t:publish", path)
+	require.Len(t, body.Messages, 1)
+	assert.Equal(t, base64.StdEncoding.EncodeToString([]byte(`{"name":"job"}`)), body.Messages[0].Data)
+	assert.Equal(t, "JOB_STATE_CHANGED", body.Messages[0].Attributes["Type"])
+	assert.Equal(t, "42", message.ID)
+
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+	assert.Error(t, emulator.Publish(context.Background(), "projects/p/topics/missing", message))
+}
@@ -0,0 +1,212 @@
+// Package registry looks up container images in OCI distribution registries
+// such as Docker Hub, Artifact Registry or a local registry:2.
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// dockerHub is the registry of images without a registry host.
+const dockerHub = "registry-1.docker.io"
+
+// manifestTypes are the manifest media types accepted when looking up an
+// image, covering single and multi-platform images.
+var manifestTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+// Reference is a parsed image reference.
+type Reference struct {
+	// Registry is the registry host, e.g. "us-docker.pkg.dev".
+	Registry string
+	// Repository is the repository path, e.g. "library/busybox".
+	Repository string
+	// Reference is the tag or digest of the image.
+	Reference string
+}
+
+// ParseReference parses image the way Docker does: images without a
+// registry host are on Docker Hub, official images there live under
+// "library/" and the tag defaults to "latest".
+func ParseReference(image string) (*Reference, error) {
+	if image == "" || strings.ContainsAny(image, " \t") {
+		return nil, fmt.Errorf("invalid image %q", image)
+	}
+
+	name, ref := image, "latest"
+	if i := strings.Index(image, "@"); i >= 0 {
+		name, ref = image[:i], image[i+1:]
+	} else if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		name, ref = image[:i], image[i+1:]
+	}
+	if name == "" || ref == "" {
+		return nil, fmt.Errorf("invalid image %q", image)
+	}
+
+	registry, repository := dockerHub, name
+	if first, rest, ok := strings.Cut(name, "/"); ok && (strings.ContainsAny(first, ".:") || first == "localhost") {
+		registry, repository = first, rest
+	}
+	if registry == "docker.io" || registry == "index.docker.io" {
+		registry = dockerHub
+	}
+	if registry == dockerHub && !strings.Contains(repository, "/") {
+		repository = "library/" + repository
+	}
+
+	return &Reference{Registry: registry, Repository: repository, Reference: ref}, nil
+}
+
+// Checker looks up images anonymously.
+type Checker struct {
+	client   *http.Client
+	insecure map[string]bool
+}
+
+// NewChecker creates a Checker using client. Registries listed in insecure,
+// e.g. "localhost:5000", are reached over plain HTTP.
+func NewChecker(client *http.Client, insecure ...string) *Checker {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	c := &Checker{client: client, insecure: make(map[string]bool)}
+	for _, registry := range insecure {
+		c.insecure[registry] = true
+	}
+	return c
+}
+
+// ImageExists reports whether the manifest of image exists in its registry.
+// Registries that require a token get one anonymously, so private images are
+// reported as errors rather than as missing.
+func (c *Checker) ImageExists(ctx context.Context, image string) (bool, error) {
+	ref, err := ParseReference(image)
+	if err != nil {
+		return false, err
+	}
+
+	scheme := "https"
+	if c.insecure[ref.Registry] {
+		scheme = "http"
+	}
+	manifestURL := fmt.Sprintf("%s://%s/v2/%s/manifests/%s", scheme, ref.Registry, ref.Repository, ref.Reference)
+
+	resp, err := c.head(ctx, manifestURL, "")
+	if err != nil {
+		return false, fmt.Errorf("failed to look up %s: %v", image, err)
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		token, err := c.token(ctx, resp.Header.Get("WWW-Authenticate"), ref)
+		if err != nil {
+			return false, fmt.Errorf("failed to authenticate to %s: %v", ref.Registry, err)
+		}
+		if resp, err = c.head(ctx, manifestURL, token); err != nil {
+			return false, fmt.Errorf("failed to look up %s: %v", image, err)
+		}
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("failed to look up %s: registry returned %d", image, resp.StatusCode)
+	}
+}
+
+// head requests the manifest at manifestURL, authorized by token if given.
+func (c *Checker) head(ctx context.Context, manifestURL, token string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, manifestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", strings.Join(manifestTypes, ", "))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+// token fetches an anonymous pull token as described by a Bearer challenge.
+func (c *Checker) token(ctx context.Context, challenge string, ref *Reference) (string, error) {
+	params, ok := parseChallenge(challenge)
+	if !ok || params["realm"] == "" {
+		return "", fmt.Errorf("unsupported challenge %q", challenge)
+	}
+
+	query := url.Values{}
+	if service := params["service"]; service != "" {
+		query.Set("service", service)
+	}
+	scope := params["scope"]
+	if scope == "" {
+		scope = "repository:" + ref.Repository + ":pull"
+	}
+	query.Set("scope", scope)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, params["realm"]+"?"+query.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint returned %d", resp.StatusCode)
+	}
+
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	if body.Token != "" {
+		return body.Token, nil
+	}
+	return body.AccessToken, nil
+}
+
+// parseChallenge parses a `Bearer realm="...",service="..."` challenge.
+func parseChallenge(challenge string) (map[string]string, bool) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(challenge), " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return nil, false
+	}
+
+	params := make(map[string]string)
+	for rest != "" {
+		var name, value string
+		name, rest, _ = strings.Cut(strings.TrimLeft(rest, " ,"), "=")
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				return nil, false
+			}
+			value, rest = rest[1:end+1], rest[end+2:]
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+		params[strings.ToLower(strings.TrimSpace(name))] = value
+	}
+	return params, true
+}
@@ -0,0 +1,108 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseReference(t *testing.T) {
+	tests := map[string]Reference{
+		"busybox":                    {Registry: "registry-1.docker.io", Repository: "library/busybox", Reference: "latest"},
+		"busybox:1.36":               {Registry: "registry-1.docker.io", Repository: "library/busybox", Reference: "1.36"},
+		"docker.io/team/app":         {Registry: "registry-1.docker.io", Repository: "team/app", Reference: "latest"},
+		"localhost/app:v1":           {Registry: "localhost", Repository: "app", Reference: "v1"},
+		"localhost:5000/team/app:v1": {Registry: "localhost:5000", Repository: "team/app", Reference: "v1"},
+		"us-docker.pkg.dev/p/r/app@sha256:abc": {
+			Registry: "us-docker.pkg.dev", Repository: "p/r/app", Reference: "sha256:abc",
+		},
+	}
+	for image, want := range tests {
+		ref, err := ParseReference(image)
+		require.NoError(t, err, image)
+		assert.Equal(t, want, *ref, image)
+	}
+
+	for _, image := range []string{"", "app:", "has space", "@sha256:abc"} {
+		_, err := ParseReference(image)
+		assert.Error(t, err, image)
+	}
+}
+
+// fakeRegistry serves manifests of repository:tag pairs behind an anonymous
+// token.
+type fakeRegistry struct {
+	manifests map[string]bool
+	realm     string
+	scopes    []string
+}
+
+func (f *fakeRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/token" {
+		f.scopes = append(f.scopes, r.URL.Query().Get("scope"))
+		json.NewEncoder(w).Encode(map[string]string{"token": "anonymous"})
+		return
+	}
+
+	if r.Header.Get("Authorization") != "Bearer anonymous" {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="`+f.realm+`",service="fake"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	repository, tag, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v2/"), "/manifests/")
+	switch {
+	case repository == "broken":
+		w.WriteHeader(http.StatusInternalServerError)
+	case f.manifests[repository+":"+tag]:
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestChecker_ImageExists(t *testing.T) {
+	fake := &fakeRegistry{manifests: map[string]bool{"team/app:v1": true}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	fake.realm = server.URL + "/token"
+
+	host := strings.TrimPrefix(server.URL, "http://")
+	checker := NewChecker(server.Client(), host)
+	ctx := context.Background()
+
+	exists, err := checker.ImageExists(ctx, host+"/team/app:v1")
+	require.NoError(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, []string{"repository:team/app:pull"}, fake.scopes)
+
+	exists, err = checker.ImageExists(ctx, host+"/team/app:v2")
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	_, err = checker.ImageExists(ctx, host+"/broken:v1")
+	assert.Error(t, err)
+
+	// Without the registry marked insecure, HTTPS is used and fails.
+	_, err = NewChecker(server.Client()).ImageExists(ctx, host+"/team/app:v1")
+	assert.Error(t, err)
+}
+
+func TestParseChallenge(t *testing.T) {
+	params, ok := parseChallenge(`Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/busybox:pull"`)
+	require.True(t, ok)
+	assert.Equal(t, map[string]string{
+		"realm":   "https://auth.docker.io/token",
+		"service": "registry.docker.io",
+		"scope":   "repository:library/busybox:pull",
+	}, params)
+
+	_, ok = parseChallenge(`Basic realm="registry"`)
+	assert.False(t, ok)
+}
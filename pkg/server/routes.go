@@ -0,0 +1,128 @@
+package server
+
+import (
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+
+	"github.com/pyshx/fake-batch-server/pkg/apispec"
+	"github.com/pyshx/fake-batch-server/pkg/blobstore"
+	"github.com/pyshx/fake-batch-server/pkg/handlers"
+	"github.com/pyshx/fake-batch-server/pkg/ui"
+)
+
+// NewRouter routes every endpoint of the emulator to handler, behind its
+// middleware. The built-in object store is served under /storage if objects
+// is not nil.
+func NewRouter(handler *handlers.Handler, objects *blobstore.Store) *mux.Router {
+	router := mux.NewRouter()
+	router.Use(handlers.RequestIDMiddleware)
+	router.Use(handler.TracingMiddleware)
+	router.Use(handlers.AccessLogMiddleware)
+	router.Use(contentTypeMiddleware)
+	router.Use(handler.MetricsMiddleware)
+	router.Use(handler.AuditMiddleware)
+	router.Use(handler.AuthMiddleware)
+	router.Use(handler.TenantMiddleware)
+	router.Use(handler.BodyLimitMiddleware)
+	router.Use(handler.DeadlineMiddleware)
+	router.Use(handler.ChaosMiddleware)
+
+	router.HandleFunc("/metrics", handler.Metrics).Methods("GET")
+	router.Handle("/$discovery/rest", apispec.DiscoveryHandler()).Methods("GET")
+	router.Handle("/openapi.json", apispec.OpenAPIHandler()).Methods("GET")
+	router.Handle("/ui", http.RedirectHandler("/ui/", http.StatusMovedPermanently))
+	router.PathPrefix("/ui/").Handler(ui.Handler("/ui/"))
+	if objects != nil {
+		router.PathPrefix("/storage/").Handler(blobstore.Handler(objects, "/storage/"))
+	}
+
+	v1 := router.PathPrefix("/v1").Subrouter()
+
+	batchRoutes(v1, handler)
+	v1.HandleFunc("/health", healthCheck).Methods("GET")
+
+	v1alpha := router.PathPrefix("/v1alpha").Subrouter()
+	batchRoutes(v1alpha, handler)
+	v1alpha.HandleFunc("/projects/{project}/locations/{location}/jobs/{job}:cancel", handler.CancelJob).Methods("POST")
+	v1alpha.HandleFunc("/projects/{project}/locations/{location}/resourceAllowances", handler.CreateResourceAllowance).Methods("POST")
+	v1alpha.HandleFunc("/projects/{project}/locations/{location}/resourceAllowances", handler.ListResourceAllowances).Methods("GET")
+	v1alpha.HandleFunc("/projects/{project}/locations/{location}/resourceAllowances/{allowance}", handler.GetResourceAllowance).Methods("GET")
+	v1alpha.HandleFunc("/projects/{project}/locations/{location}/resourceAllowances/{allowance}", handler.DeleteResourceAllowance).Methods("DELETE")
+
+	v2 := router.PathPrefix("/v2").Subrouter()
+	v2.HandleFunc("/entries:list", handler.ListLogEntries).Methods("POST")
+	v2.HandleFunc("/entries:write", handler.WriteLogEntries).Methods("POST")
+
+	admin := router.PathPrefix("/admin").Subrouter()
+	admin.HandleFunc("/clock/advance", handler.AdvanceClock).Methods("POST")
+	admin.HandleFunc("/snapshot", handler.Snapshot).Methods("GET")
+	admin.HandleFunc("/reset", handler.Reset).Methods("POST")
+	admin.HandleFunc("/jobs", handler.ListAllJobs).Methods("GET")
+	admin.HandleFunc("/stats", handler.Stats).Methods("GET")
+	admin.HandleFunc("/audit", handler.ListAuditEntries).Methods("GET")
+	admin.HandleFunc("/simulator", handler.SimulatorStats).Methods("GET")
+	admin.HandleFunc("/doctor", handler.Doctor).Methods("GET", "POST")
+	admin.HandleFunc("/projects/{project}/locations/{location}/jobs/{job}/priority", handler.SetJobPriority).Methods("POST")
+	admin.HandleFunc("/projects/{project}/locations/{location}/jobs/{job}/state", handler.ForceJobState).Methods("POST")
+	admin.HandleFunc("/pubsub/projects/{project}/topics/{topic}", handler.ListTopicMessages).Methods("GET")
+	admin.HandleFunc("/pubsub/projects/{project}/topics/{topic}", handler.ClearTopicMessages).Methods("DELETE")
+	admin.HandleFunc("/webhooks", handler.ListWebhooks).Methods("GET")
+	admin.HandleFunc("/webhooks", handler.CreateWebhook).Methods("POST")
+	admin.HandleFunc("/webhooks/{id}", handler.DeleteWebhook).Methods("DELETE")
+	admin.HandleFunc("/projects", handler.ListProjects).Methods("GET")
+	admin.HandleFunc("/projects", handler.RegisterProject).Methods("POST")
+	admin.HandleFunc("/projects/{project}", handler.UnregisterProject).Methods("DELETE")
+
+	hooks := router.PathPrefix("/hooks").Subrouter()
+	hooks.HandleFunc("/scheduler/projects/{project}/locations/{location}/jobs", handler.TriggerJob).Methods("POST")
+
+	return router
+}
+
+// batchRoutes registers the Batch API methods shared by every API version on
+// the subrouter of a version.
+func batchRoutes(r *mux.Router, handler *handlers.Handler) {
+	r.HandleFunc("/jobs:lookup", handler.LookupJob).Methods("GET")
+	r.HandleFunc("/projects/{project}/locations/{location}/jobs", handler.CreateJob).Methods("POST")
+	r.HandleFunc("/projects/{project}/locations/{location}/jobs", handler.ListJobs).Methods("GET")
+	r.HandleFunc("/projects/{project}/locations/{location}/jobs:lint", handler.LintJob).Methods("POST")
+	r.HandleFunc("/projects/{project}/locations/{location}/jobs:watch", handler.WatchJobs).Methods("GET")
+	r.HandleFunc("/projects/{project}/locations/{location}/jobs/{job}", handler.GetJob).Methods("GET")
+	r.HandleFunc("/projects/{project}/locations/{location}/jobs/{job}", handler.UpdateJob).Methods("PATCH")
+	r.HandleFunc("/projects/{project}/locations/{location}/jobs/{job}", handler.DeleteJob).Methods("DELETE")
+	r.HandleFunc("/projects/{project}/locations/{location}/jobs/{job}/watch", handler.WatchJob).Methods("GET")
+	r.HandleFunc("/projects/{project}/locations/{location}/jobs/{job}/tasks", handler.ListTasks).Methods("GET")
+	r.HandleFunc("/projects/{project}/locations/{location}/jobs/{job}/taskGroups/{group}/tasks/{task}", handler.GetTask).Methods("GET")
+	r.HandleFunc("/projects/{project}/locations/{location}/jobs/{job}/taskGroups/{group}/tasks/{task}/logs", handler.GetTaskLogs).Methods("GET")
+	r.HandleFunc("/projects/{project}/locations/{location}/operations/{operation}", handler.GetOperation).Methods("GET")
+}
+
+// debugRoutes registers the net/http/pprof profiles under /debug/pprof/ and
+// the runtime counters of the handler under /debug/vars. They are left out
+// by default, profiles exposing the internals of the process.
+func debugRoutes(router *mux.Router, handler *handlers.Handler) {
+	debug := router.PathPrefix("/debug").Subrouter()
+	debug.HandleFunc("/vars", handler.DebugVars).Methods("GET")
+	debug.HandleFunc("/pprof/cmdline", pprof.Cmdline)
+	debug.HandleFunc("/pprof/profile", pprof.Profile)
+	debug.HandleFunc("/pprof/symbol", pprof.Symbol)
+	debug.HandleFunc("/pprof/trace", pprof.Trace)
+	debug.PathPrefix("/pprof/").HandlerFunc(pprof.Index)
+}
+
+func contentTypeMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		next.ServeHTTP(w, r)
+	})
+}
+
+func healthCheck(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write([]byte(`{"status":"healthy"}`)); err != nil {
+		logrus.Errorf("Failed to write health check response: %v", err)
+	}
+}
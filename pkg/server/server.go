@@ -0,0 +1,174 @@
+// Package server assembles the emulator, its API handler and every route,
+// so that Go tests can run it in process, either as an http.Handler or on a
+// listener of its own, without repeating the wiring of cmd/server.
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/pyshx/fake-batch-server/pkg/clock"
+	"github.com/pyshx/fake-batch-server/pkg/handlers"
+	"github.com/pyshx/fake-batch-server/pkg/simulation"
+	"github.com/pyshx/fake-batch-server/pkg/storage"
+)
+
+// Server is an emulator. It serves the API as an http.Handler, and on a
+// listener between Start and Stop.
+type Server struct {
+	handler  *handlers.Handler
+	router   http.Handler
+	listener net.Listener
+
+	mu   sync.Mutex
+	http *http.Server
+}
+
+// Option configures a Server.
+type Option func(*options)
+
+type options struct {
+	store    storage.Store
+	config   handlers.Config
+	listener net.Listener
+}
+
+// WithStore makes the server keep its jobs in store instead of a new
+// storage.MemoryStore.
+func WithStore(store storage.Store) Option {
+	return func(o *options) {
+		o.store = store
+	}
+}
+
+// WithSimTimings sets how long simulated jobs spend in each state.
+func WithSimTimings(timings simulation.Timings) Option {
+	return func(o *options) {
+		o.config.Timings = timings
+	}
+}
+
+// WithClock drives the simulation from c, e.g. a *clock.Fake.
+func WithClock(c clock.Clock) Option {
+	return func(o *options) {
+		o.config.Clock = c
+	}
+}
+
+// WithConfig replaces the handler config, including the settings of the
+// options before it.
+func WithConfig(cfg handlers.Config) Option {
+	return func(o *options) {
+		o.config = cfg
+	}
+}
+
+// WithHandlerOptions applies handler options to the handler config.
+func WithHandlerOptions(opts ...handlers.Option) Option {
+	return func(o *options) {
+		for _, opt := range opts {
+			opt(&o.config)
+		}
+	}
+}
+
+// WithListener makes Start serve on l instead of a new listener on a free
+// port of the loopback interface.
+func WithListener(l net.Listener) Option {
+	return func(o *options) {
+		o.listener = l
+	}
+}
+
+// New creates a Server. It simulates jobs right away, but only serves them
+// on a listener once started.
+func New(opts ...Option) *Server {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.store == nil && o.config.Clock != nil {
+		o.store = storage.NewMemoryStoreWithClock(o.config.Clock)
+	} else if o.store == nil {
+		o.store = storage.NewMemoryStore()
+	}
+
+	handler := handlers.NewHandlerWithConfig(o.store, o.config)
+	router := NewRouter(handler, o.config.ObjectStore)
+	if o.config.Pprof {
+		debugRoutes(router, handler)
+	}
+	return &Server{
+		handler:  handler,
+		router:   router,
+		listener: o.listener,
+	}
+}
+
+// ServeHTTP serves a request to the API.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.router.ServeHTTP(w, r)
+}
+
+// API returns the handler behind the server, e.g. to seed, checkpoint or
+// restore its jobs.
+func (s *Server) API() *handlers.Handler {
+	return s.handler
+}
+
+// Start serves the API on the server's listener in the background. A
+// server is started at most once.
+func (s *Server) Start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.http != nil {
+		return errors.New("server already started")
+	}
+
+	if s.listener == nil {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return err
+		}
+		s.listener = l
+	}
+	s.http = &http.Server{Handler: s}
+	srv, l := s.http, s.listener
+	go func() {
+		if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			logrus.Errorf("Server stopped serving: %v", err)
+		}
+	}()
+	return nil
+}
+
+// URL returns the base URL of the started server, e.g.
+// "http://127.0.0.1:41235", or "" if it has not been started.
+func (s *Server) URL() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.http == nil {
+		return ""
+	}
+	return "http://" + s.listener.Addr().String()
+}
+
+// Stop gracefully stops serving, if the server was started, waiting until
+// ctx is done for requests in flight, and then stops every simulation.
+func (s *Server) Stop(ctx context.Context) error {
+	s.mu.Lock()
+	srv := s.http
+	s.mu.Unlock()
+
+	var err error
+	if srv != nil {
+		err = srv.Shutdown(ctx)
+	}
+	s.handler.Close()
+	return err
+}
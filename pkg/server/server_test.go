@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+	"github.com/pyshx/fake-batch-server/pkg/client"
+	"github.com/pyshx/fake-batch-server/pkg/clock"
+	"github.com/pyshx/fake-batch-server/pkg/handlers"
+	"github.com/pyshx/fake-batch-server/pkg/simulation"
+	"github.com/pyshx/fake-batch-server/pkg/storage"
+)
+
+func TestServer_Handler(t *testing.T) {
+	srv := New()
+	t.Cleanup(func() { srv.Stop(context.Background()) })
+
+	for _, path := range []string{"/v1/health", "/openapi.json", "/v1alpha/projects/p/locations/l/jobs", "/admin/stats"} {
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		assert.Equal(t, http.StatusOK, rec.Code, path)
+	}
+	assert.Empty(t, srv.URL())
+}
+
+func TestServer_Pprof(t *testing.T) {
+	get := func(srv *Server, path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	srv := New()
+	t.Cleanup(func() { srv.Stop(context.Background()) })
+	assert.Equal(t, http.StatusNotFound, get(srv, "/debug/vars").Code)
+	assert.Equal(t, http.StatusNotFound, get(srv, "/debug/pprof/").Code)
+
+	srv = New(WithConfig(handlers.Config{Pprof: true}))
+	t.Cleanup(func() { srv.Stop(context.Background()) })
+	_, err := srv.API().Seed([]*handlers.SeedJob{{Job: api.Job{Name: "projects/p/locations/l/jobs/job1", State: api.JobStateSucceeded}}})
+	require.NoError(t, err)
+
+	rec := get(srv, "/debug/vars")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var vars handlers.DebugVars
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&vars))
+	assert.Positive(t, vars.Goroutines)
+	assert.Positive(t, vars.Memory.AllocBytes)
+	assert.Equal(t, 1, vars.Store.Jobs)
+
+	rec = get(srv, "/debug/pprof/goroutine?debug=1")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "goroutine profile")
+	assert.Equal(t, http.StatusOK, get(srv, "/debug/pprof/").Code)
+}
+
+func TestServer_StartStop(t *testing.T) {
+	fake := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	store := storage.NewMemoryStore()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	srv := New(
+		WithStore(store),
+		WithClock(fake),
+		WithSimTimings(simulation.Timings{States: map[api.JobState]time.Duration{api.JobStateRunning: time.Hour}}),
+		WithListener(listener),
+	)
+	require.NoError(t, srv.Start())
+	assert.Error(t, srv.Start())
+	assert.Equal(t, "http://"+listener.Addr().String(), srv.URL())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c := client.New(srv.URL()+"/v1", client.WithPollInterval(time.Millisecond, 10*time.Millisecond))
+	created, err := c.CreateJob(ctx, "projects/p/locations/l", "job1", &api.Job{TaskGroups: []*api.TaskGroup{{TaskCount: 1}}})
+	require.NoError(t, err)
+
+	// The job runs for an hour, so it is still running ten minutes in.
+	fake.Advance(10 * time.Minute)
+	_, err = c.WaitForState(ctx, created.Name, api.JobStateRunning)
+	require.NoError(t, err)
+	fake.Advance(time.Hour)
+	done, err := c.WaitForJobCompletion(ctx, created.Name)
+	require.NoError(t, err)
+	assert.Equal(t, api.JobStateSucceeded, done.State)
+
+	stored, err := store.GetJob(created.Name)
+	require.NoError(t, err)
+	assert.Equal(t, api.JobStateSucceeded, stored.State)
+
+	require.NoError(t, srv.Stop(ctx))
+	_, err = c.GetJob(ctx, created.Name)
+	assert.Error(t, err)
+}
@@ -0,0 +1,209 @@
+package simulation
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+)
+
+// The computeResource the service gives tasks that do not set one.
+const (
+	defaultTaskCPUMilli  = 2000
+	defaultTaskMemoryMib = 2000
+)
+
+// Resources is an amount of vCPU and memory.
+type Resources struct {
+	CPUMilli  int64 `yaml:"cpuMilli" json:"cpuMilli"`
+	MemoryMib int64 `yaml:"memoryMib" json:"memoryMib"`
+}
+
+// Capacity is the fake compute capacity of each location. A job leaves
+// QUEUED only once the resources of its location can hold its tasks, and
+// holds them until its simulation ends. Zero fields are unlimited.
+type Capacity struct {
+	// Default applies to locations not listed in Locations.
+	Default   Resources            `yaml:"default"`
+	Locations map[string]Resources `yaml:"locations"`
+}
+
+// LoadCapacity reads per-location capacity from a YAML or JSON file, e.g.:
+//
+//	default:
+//	  cpuMilli: 64000
+//	  memoryMib: 262144
+//	locations:
+//	  us-central1:
+//	    cpuMilli: 8000
+func LoadCapacity(path string) (*Capacity, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var capacity Capacity
+	if err := yaml.Unmarshal(data, &capacity); err != nil {
+		return nil, fmt.Errorf("failed to parse capacity config %s: %v", path, err)
+	}
+	if err := capacity.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid capacity config %s: %v", path, err)
+	}
+	return &capacity, nil
+}
+
+// Validate checks that no capacity is negative.
+func (c *Capacity) Validate() error {
+	if c.Default.CPUMilli < 0 || c.Default.MemoryMib < 0 {
+		return fmt.Errorf("default: negative capacity")
+	}
+	for location, resources := range c.Locations {
+		if resources.CPUMilli < 0 || resources.MemoryMib < 0 {
+			return fmt.Errorf("location %s: negative capacity", location)
+		}
+	}
+	return nil
+}
+
+// For returns the capacity of location. A location listed in Locations does
+// not inherit the unset fields of Default.
+func (c *Capacity) For(location string) Resources {
+	if resources, ok := c.Locations[location]; ok {
+		return resources
+	}
+	return c.Default
+}
+
+// SetCapacity makes jobs wait in QUEUED until the capacity of their location
+// can hold them, in addition to any slot and tenant limits. It must be
+// called before any job is started.
+func (s *Scheduler) SetCapacity(c *Capacity) {
+	s.locationCapacity = c
+}
+
+// JobResources returns the resources job's tasks use at once, with each task
+// group running as many tasks as its parallelism allows. Tasks without a
+// computeResource count with the service's defaults of 2 vCPUs and 2000 MiB.
+func JobResources(job *api.Job) Resources {
+	var total Resources
+	for _, taskGroup := range job.TaskGroups {
+		tasks := taskGroup.TaskCount
+		if taskGroup.Parallelism > 0 && taskGroup.Parallelism < tasks {
+			tasks = taskGroup.Parallelism
+		}
+		task := Resources{CPUMilli: defaultTaskCPUMilli, MemoryMib: defaultTaskMemoryMib}
+		if taskGroup.TaskSpec != nil && taskGroup.TaskSpec.ComputeResource != nil {
+			if cpu := taskGroup.TaskSpec.ComputeResource.CPUMilli; cpu > 0 {
+				task.CPUMilli = cpu
+			}
+			if memory := taskGroup.TaskSpec.ComputeResource.MemoryMib; memory > 0 {
+				task.MemoryMib = memory
+			}
+		}
+		total.CPUMilli += task.CPUMilli * tasks
+		total.MemoryMib += task.MemoryMib * tasks
+	}
+	return total
+}
+
+// jobLocation returns the location of job from its name.
+func jobLocation(job *api.Job) string {
+	if parts := strings.Split(job.Name, "/"); len(parts) > 3 {
+		return parts[3]
+	}
+	return ""
+}
+
+// pool tracks the capacity of a location like the slots of a Scheduler: as
+// the amounts freed at each time, so that capacity freed at t only goes to
+// jobs ready by t.
+type pool struct {
+	capacity Resources
+	inUse    Resources
+	free     []freed
+}
+
+// freed is an amount of capacity freed at a time.
+type freed struct {
+	at time.Time
+	Resources
+}
+
+func newPool(capacity Resources) *pool {
+	return &pool{capacity: capacity, free: []freed{{Resources: capacity}}}
+}
+
+// limited returns the part of demand the pool limits: the amounts of its
+// unlimited resources are dropped.
+func (p *pool) limited(demand Resources) Resources {
+	if p.capacity.CPUMilli == 0 {
+		demand.CPUMilli = 0
+	}
+	if p.capacity.MemoryMib == 0 {
+		demand.MemoryMib = 0
+	}
+	return demand
+}
+
+// fitTime returns the earliest time enough capacity had been freed for
+// demand. It reports false if there is not enough free capacity.
+func (p *pool) fitTime(demand Resources) (time.Time, bool) {
+	demand = p.limited(demand)
+	if demand == (Resources{}) {
+		return time.Time{}, true
+	}
+	sort.SliceStable(p.free, func(i, j int) bool { return p.free[i].at.Before(p.free[j].at) })
+	var got Resources
+	for _, f := range p.free {
+		got.CPUMilli += f.CPUMilli
+		got.MemoryMib += f.MemoryMib
+		if got.CPUMilli >= demand.CPUMilli && got.MemoryMib >= demand.MemoryMib {
+			return f.at, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// take uses demand out of the capacity freed earliest. The caller must have
+// checked that it fits.
+func (p *pool) take(demand Resources) {
+	demand = p.limited(demand)
+	p.inUse.CPUMilli += demand.CPUMilli
+	p.inUse.MemoryMib += demand.MemoryMib
+
+	sort.SliceStable(p.free, func(i, j int) bool { return p.free[i].at.Before(p.free[j].at) })
+	remaining := p.free[:0]
+	for _, f := range p.free {
+		cpu, memory := min(f.CPUMilli, demand.CPUMilli), min(f.MemoryMib, demand.MemoryMib)
+		f.CPUMilli -= cpu
+		f.MemoryMib -= memory
+		demand.CPUMilli -= cpu
+		demand.MemoryMib -= memory
+		if f.Resources != (Resources{}) {
+			remaining = append(remaining, f)
+		}
+	}
+	p.free = remaining
+}
+
+// release frees demand, taken before, at the time at.
+func (p *pool) release(demand Resources, at time.Time) {
+	demand = p.limited(demand)
+	if demand == (Resources{}) {
+		return
+	}
+	p.inUse.CPUMilli -= demand.CPUMilli
+	p.inUse.MemoryMib -= demand.MemoryMib
+	p.free = append(p.free, freed{at: at, Resources: demand})
+}
+
+// PoolStats reports the capacity of a location.
+type PoolStats struct {
+	Capacity Resources `json:"capacity"`
+	InUse    Resources `json:"inUse"`
+}
@@ -0,0 +1,108 @@
+package simulation
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+)
+
+func TestLoadCapacity(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capacity.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+default:
+  cpuMilli: 64000
+locations:
+  us-central1:
+    memoryMib: 4096
+`), 0o644))
+
+	capacity, err := LoadCapacity(path)
+	require.NoError(t, err)
+	assert.Equal(t, Resources{CPUMilli: 64000}, capacity.For("europe-west1"))
+	assert.Equal(t, Resources{MemoryMib: 4096}, capacity.For("us-central1"))
+
+	require.NoError(t, os.WriteFile(path, []byte("default:\n  cpuMilli: -1\n"), 0o644))
+	_, err = LoadCapacity(path)
+	assert.Error(t, err)
+}
+
+func TestJobResources(t *testing.T) {
+	job := &api.Job{TaskGroups: []*api.TaskGroup{
+		{TaskCount: 10, Parallelism: 2, TaskSpec: &api.TaskSpec{ComputeResource: &api.ComputeResource{CPUMilli: 500, MemoryMib: 100}}},
+		{TaskCount: 1},
+	}}
+	assert.Equal(t, Resources{CPUMilli: 3000, MemoryMib: 2200}, JobResources(job))
+}
+
+func TestScheduler_Capacity(t *testing.T) {
+	s, err := NewTenantScheduler("")
+	require.NoError(t, err)
+	s.SetCapacity(&Capacity{Locations: map[string]Resources{"small": {CPUMilli: 4000, MemoryMib: 4000}}})
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	granted := grants{}
+	first := s.add(&ticket{tenant: "a", location: "small", demand: Resources{CPUMilli: 3000, MemoryMib: 1000}, readyAt: start, granted: granted.to("first")})
+	second := s.add(&ticket{tenant: "a", location: "small", demand: Resources{CPUMilli: 2000, MemoryMib: 1000}, readyAt: start, granted: granted.to("second")})
+	third := s.add(&ticket{tenant: "a", location: "small", demand: Resources{CPUMilli: 1000, MemoryMib: 1000}, readyAt: start, granted: granted.to("third")})
+	elsewhere := s.add(&ticket{tenant: "a", location: "large", demand: Resources{CPUMilli: 100000}, readyAt: start, granted: granted.to("elsewhere")})
+
+	for _, ticket := range []*ticket{first, second, third, elsewhere} {
+		s.acquire(ticket)
+	}
+	// The third job fits next to the first while the second waits, and
+	// unlimited locations are not held up.
+	assert.Equal(t, grants{"first": start, "third": start, "elsewhere": start}, granted)
+	stats := s.Stats()
+	assert.Equal(t, 1, stats.Waiting)
+	assert.Equal(t, &PoolStats{
+		Capacity: Resources{CPUMilli: 4000, MemoryMib: 4000},
+		InUse:    Resources{CPUMilli: 4000, MemoryMib: 2000},
+	}, stats.Pools["small"])
+
+	// Freeing only part of what the second job needs is not enough.
+	s.finish(third, start.Add(time.Second))
+	assert.NotContains(t, granted, "second")
+	s.finish(first, start.Add(5*time.Second))
+	assert.Equal(t, start.Add(5*time.Second), granted["second"])
+	assert.Equal(t, Resources{CPUMilli: 2000, MemoryMib: 1000}, s.Stats().Pools["small"].InUse)
+}
+
+func TestEngine_Capacity(t *testing.T) {
+	engine, store, fake := setupFakeEngine()
+	scheduler, err := NewTenantScheduler("")
+	require.NoError(t, err)
+	scheduler.SetCapacity(&Capacity{Default: Resources{CPUMilli: 3000}})
+	engine.SetScheduler(scheduler)
+	defer engine.Shutdown()
+
+	var jobs []*api.Job
+	for i := 0; i < 2; i++ {
+		job := newTestJob(t, store, fake.Now(), &api.TaskGroup{
+			Name:      "group1",
+			TaskCount: 1,
+			TaskSpec:  &api.TaskSpec{ComputeResource: &api.ComputeResource{CPUMilli: 2000}},
+		})
+		engine.Start(job, &Plan{})
+		jobs = append(jobs, job)
+	}
+
+	fake.Advance(2 * time.Second)
+	waitForJobState(t, store, jobs[0].Name, api.JobStateRunning)
+	stored, err := store.GetJob(jobs[1].Name)
+	require.NoError(t, err)
+	assert.Equal(t, api.JobStateQueued, stored.State)
+
+	// The second job is scheduled once the first frees its vCPUs after 1s
+	// QUEUED, 1s SCHEDULED and 5s RUNNING.
+	fake.Advance(time.Minute)
+	waitForJobState(t, store, jobs[1].Name, api.JobStateSucceeded)
+	stored, err = store.GetJob(jobs[1].Name)
+	require.NoError(t, err)
+	assert.Equal(t, jobs[1].CreateTime.Add(7*time.Second), stored.Status.StatusEvents[0].EventTime)
+}
@@ -0,0 +1,227 @@
+package simulation
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+)
+
+// Executor actually runs container runnables instead of simulating them.
+type Executor interface {
+	// Run executes a container runnable to completion and returns its exit
+	// code. It must stop the container and return once ctx is done.
+	Run(ctx context.Context, execution *Execution) (int, error)
+}
+
+// Execution describes a container runnable to run.
+type Execution struct {
+	// Task is the name of the task the runnable belongs to.
+	Task      string
+	Container *api.Container
+	// Env holds the environment variables of the runnable, including the
+	// BATCH_* variables the real service sets.
+	Env map[string]string
+	// Files holds the contents of files to add to the container before it
+	// starts, by absolute path, e.g. the hosts file of BATCH_HOSTS_FILE.
+	Files map[string]string
+	// Mounts are the host directories to mount into the container.
+	Mounts []Mount
+	// Output receives the output of the runnable. It may be nil.
+	Output io.Writer
+}
+
+// Mount is a host directory mounted into a container.
+type Mount struct {
+	// Source is the directory on the host and Target where the container
+	// sees it.
+	Source   string
+	Target   string
+	ReadOnly bool
+	// Options are further bind options, e.g. "z" or "rshared".
+	Options []string
+}
+
+// completion is the outcome of an Executor run.
+type completion struct {
+	attempt  *attempt
+	exitCode int
+	err      error
+	// cause is set if the runnable was killed for running too long.
+	cause stopCause
+}
+
+// SetExecutor makes the engine run container runnables with x. Runnables
+// without a container are still simulated. It must be called before any job
+// is started.
+func (e *Engine) SetExecutor(x Executor) {
+	e.executor = x
+}
+
+// SetObjectStoreURL makes the engine pass url to executed containers as
+// OBJECT_STORE_URL, for them to stage inputs and outputs through the
+// built-in object store. It must be called before any job is started.
+func (e *Engine) SetObjectStoreURL(url string) {
+	e.objectStoreURL = url
+}
+
+// execute runs the container runnable at a's current step in the background
+// and posts its completion to the engine's loop.
+func (r *run) execute(a *attempt, runnable *api.Runnable) {
+	execution := &Execution{
+		Task:      a.task.Name,
+		Container: runnable.Container,
+		Env:       r.environment(a.task, runnable),
+	}
+	if hostsFile, ok := execution.Env["BATCH_HOSTS_FILE"]; ok {
+		execution.Files = map[string]string{
+			hostsFile: strings.Join(groupHosts(r.job, TaskGroupName(a.task.Name)), "\n") + "\n",
+		}
+	}
+	var output io.WriteCloser
+	if r.logs != nil {
+		output = r.logs.Writer(a.task.Name, a.step, r.clock.Now)
+		execution.Output = output
+	}
+
+	mounts, mountErr := r.containerMounts(a.group, runnable.Container)
+	var volumes []*api.Volume
+	if r.buckets != nil {
+		volumes = r.gcsVolumes(a.group)
+	}
+
+	// The container is stopped at the runnable's timeout or the attempt's
+	// deadline, whichever comes first, counted in wall-clock time.
+	ctx, cancel := r.ctx, context.CancelFunc(func() {})
+	var timeout time.Duration
+	cause := stopNone
+	if t := r.runnableTimeout(a); t > 0 {
+		timeout, cause = t, stopTimeout
+	}
+	if !a.deadline.IsZero() {
+		if remaining := a.deadline.Sub(r.now); cause == stopNone || remaining <= timeout {
+			timeout, cause = remaining, stopMaxRunDuration
+		}
+	}
+	if cause != stopNone {
+		ctx, cancel = context.WithTimeout(r.ctx, timeout)
+	}
+
+	r.executing++
+	r.execs.Add(1)
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		defer r.execs.Done()
+		defer cancel()
+
+		c := completion{attempt: a}
+		switch {
+		case mountErr != nil:
+			c.err = mountErr
+		case len(mounts) > 0:
+			c.exitCode, c.err = r.executeWithVolumes(ctx, execution, mounts, volumes)
+		default:
+			c.exitCode, c.err = r.executor.Run(ctx, execution)
+		}
+		if output != nil {
+			output.Close()
+		}
+		if r.ctx.Err() == nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			c.exitCode, c.err, c.cause = timeoutExitCode, nil, cause
+		}
+		r.post(r.clock.Now(), func() {
+			r.executing--
+			r.now = r.clock.Now()
+			r.finishExecution(c, r.now)
+			r.step()
+		})
+	}()
+}
+
+// finishExecution records the outcome of an executed container runnable. A
+// runnable whose volumes could not be mounted fails.
+func (r *run) finishExecution(c completion, at time.Time) {
+	var mountErr *mountError
+	if errors.As(c.err, &mountErr) {
+		r.addTaskEvent(c.attempt.task, "volume_mount_failed", "Failed to mount volume "+mountErr.Error())
+	}
+	c.attempt.cause = c.cause
+	if c.cause == stopMaxRunDuration {
+		r.exceedMaxRunDuration(c.attempt, at)
+		return
+	}
+	r.finishStep(c.attempt, c.exitCode, c.err, at)
+}
+
+// HostsFile is where the runtime lists the instances of a task group that
+// requires a hosts file.
+const HostsFile = "/etc/cloudbatch-taskgroup-hosts"
+
+// TaskEnvironment returns the BATCH_* variables the runtime sets for the
+// runnables of the task named taskName of job.
+func TaskEnvironment(job *api.Job, taskName string) map[string]string {
+	group := TaskGroupName(taskName)
+	instance := TaskInstance(job, taskName)
+
+	env := map[string]string{
+		"BATCH_JOB_ID":     job.Name[strings.LastIndex(job.Name, "/")+1:],
+		"BATCH_JOB_UID":    job.UID,
+		"BATCH_TASK_INDEX": strconv.FormatInt(TaskIndex(taskName), 10),
+		"BATCH_NODE_INDEX": strconv.FormatInt(instance.Index, 10),
+		"BATCH_NODE_NAME":  instance.Name,
+		"BATCH_NODE_ZONE":  instance.Zone,
+	}
+	for _, taskGroup := range job.TaskGroups {
+		if taskGroup.Name != group {
+			continue
+		}
+		env["BATCH_TASK_COUNT"] = strconv.FormatInt(taskGroup.TaskCount, 10)
+		if taskGroup.RequireHostsFile {
+			env["BATCH_HOSTS_FILE"] = HostsFile
+		}
+	}
+	return env
+}
+
+// environment builds the environment variables of a runnable of task.
+func (r *run) environment(task *api.Task, runnable *api.Runnable) map[string]string {
+	group := TaskGroupName(task.Name)
+	index := TaskIndex(task.Name)
+
+	env := TaskEnvironment(r.job, task.Name)
+	if r.objectStoreURL != "" {
+		env["OBJECT_STORE_URL"] = r.objectStoreURL
+	}
+	for _, taskGroup := range r.job.TaskGroups {
+		if taskGroup.Name != group {
+			continue
+		}
+		if taskGroup.TaskSpec != nil {
+			for name, value := range taskGroup.TaskSpec.Environments {
+				env[name] = value
+			}
+			if taskGroup.TaskSpec.Environment != nil {
+				for name, value := range taskGroup.TaskSpec.Environment.Variables {
+					env[name] = value
+				}
+			}
+		}
+		if index >= 0 && index < int64(len(taskGroup.TaskEnvironments)) && taskGroup.TaskEnvironments[index] != nil {
+			for name, value := range taskGroup.TaskEnvironments[index].Variables {
+				env[name] = value
+			}
+		}
+	}
+	if runnable.Environment != nil {
+		for name, value := range runnable.Environment.Variables {
+			env[name] = value
+		}
+	}
+
+	return env
+}
@@ -0,0 +1,138 @@
+package simulation
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+	"github.com/pyshx/fake-batch-server/pkg/logs"
+)
+
+// stubExecutor returns a fixed exit code per image and records the
+// executions it was asked to run.
+type stubExecutor struct {
+	mu         sync.Mutex
+	exitCodes  map[string]int
+	executions []*Execution
+}
+
+func (s *stubExecutor) Run(ctx context.Context, execution *Execution) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.executions = append(s.executions, execution)
+	if execution.Output != nil {
+		fmt.Fprintf(execution.Output, "output of %s\n", execution.Container.ImageURI)
+	}
+	return s.exitCodes[execution.Container.ImageURI], nil
+}
+
+func TestEngine_Executor(t *testing.T) {
+	engine, store, fake := setupFakeEngine()
+	executor := &stubExecutor{exitCodes: map[string]int{"ignored": 2, "failing": 7}}
+	engine.SetExecutor(executor)
+	taskLogs := logs.NewStore()
+	engine.SetLogs(taskLogs)
+	engine.SetObjectStoreURL("http://host.docker.internal:8080/storage")
+
+	job := newTestJob(t, store, fake.Now(), &api.TaskGroup{
+		Name:      "group1",
+		TaskCount: 1,
+		TaskSpec: &api.TaskSpec{
+			Environment:  &api.Environment{Variables: map[string]string{"MODE": "test"}},
+			Environments: map[string]string{"MODE": "deprecated", "LEGACY": "yes"},
+			Runnables: []*api.Runnable{
+				{Container: &api.Container{ImageURI: "ok"}},
+				{Container: &api.Container{ImageURI: "ignored"}, IgnoreExitStatus: true},
+				{Container: &api.Container{ImageURI: "failing"}},
+				{Container: &api.Container{ImageURI: "cleanup"}, AlwaysRun: true},
+			},
+		},
+	})
+
+	engine.Start(job, &Plan{})
+	fake.Advance(time.Minute)
+	waitForJobState(t, store, job.Name, api.JobStateFailed)
+
+	tasks, _ := store.ListTasks(job.Name)
+	events := runnableEvents(tasks[0], job.CreateTime)
+	assert.Contains(t, events[3], "Runnable 1 failed with exit code 2; exit status ignored")
+	assert.Contains(t, events[5], "Runnable 2 failed with exit code 7")
+	assert.Contains(t, events[7], "Runnable 3 completed")
+	assert.Equal(t, api.TaskStateFailed, tasks[0].Status.State)
+
+	var output []string
+	for _, entry := range taskLogs.Entries(tasks[0].Name) {
+		output = append(output, fmt.Sprintf("%d %s", entry.Runnable, entry.Text))
+	}
+	assert.Equal(t, []string{"0 output of ok", "1 output of ignored", "2 output of failing", "3 output of cleanup"}, output)
+
+	executor.mu.Lock()
+	defer executor.mu.Unlock()
+	assert.Len(t, executor.executions, 4)
+	assert.Equal(t, "test", executor.executions[0].Env["MODE"])
+	assert.Equal(t, "yes", executor.executions[0].Env["LEGACY"])
+	assert.Equal(t, "0", executor.executions[0].Env["BATCH_TASK_INDEX"])
+	assert.Equal(t, "1", executor.executions[0].Env["BATCH_TASK_COUNT"])
+	assert.Equal(t, "0", executor.executions[0].Env["BATCH_NODE_INDEX"])
+	assert.Equal(t, TaskInstance(job, tasks[0].Name).Name, executor.executions[0].Env["BATCH_NODE_NAME"])
+	assert.Equal(t, "l-a", executor.executions[0].Env["BATCH_NODE_ZONE"])
+	assert.Equal(t, "http://host.docker.internal:8080/storage", executor.executions[0].Env["OBJECT_STORE_URL"])
+	assert.Equal(t, job.UID, executor.executions[0].Env["BATCH_JOB_UID"])
+	assert.NotContains(t, executor.executions[0].Env, "BATCH_HOSTS_FILE")
+	assert.Nil(t, executor.executions[0].Files)
+}
+
+func TestEngine_ExecutorHostsFile(t *testing.T) {
+	engine, store, fake := setupFakeEngine()
+	executor := &stubExecutor{}
+	engine.SetExecutor(executor)
+
+	job := newTestJob(t, store, fake.Now(), &api.TaskGroup{
+		Name:             "group1",
+		TaskCount:        3,
+		TaskCountPerNode: 2,
+		RequireHostsFile: true,
+		TaskSpec:         &api.TaskSpec{Runnables: []*api.Runnable{{Container: &api.Container{ImageURI: "mpi"}}}},
+	})
+
+	engine.Start(job, &Plan{})
+	fake.Advance(time.Minute)
+	waitForJobState(t, store, job.Name, api.JobStateSucceeded)
+
+	executor.mu.Lock()
+	defer executor.mu.Unlock()
+	require.Len(t, executor.executions, 3)
+	execution := executor.executions[0]
+	assert.Equal(t, HostsFile, execution.Env["BATCH_HOSTS_FILE"])
+	assert.Equal(t, map[string]string{
+		HostsFile: instanceName(job, "group1", 0) + "\n" + instanceName(job, "group1", 1) + "\n",
+	}, execution.Files)
+}
+
+func TestTaskEnvironment(t *testing.T) {
+	job := &api.Job{
+		Name: "projects/p/locations/us-central1/jobs/my-job",
+		UID:  "1a2b3c4d-5e6f-7a8b-9c0d-1e2f3a4b5c6d",
+		TaskGroups: []*api.TaskGroup{
+			{Name: "group0", TaskCount: 4},
+			{Name: "group1", TaskCount: 2, RequireHostsFile: true},
+		},
+	}
+
+	assert.Equal(t, map[string]string{
+		"BATCH_JOB_ID":     "my-job",
+		"BATCH_JOB_UID":    "1a2b3c4d-5e6f-7a8b-9c0d-1e2f3a4b5c6d",
+		"BATCH_TASK_INDEX": "3",
+		"BATCH_TASK_COUNT": "4",
+		"BATCH_NODE_INDEX": "3",
+		"BATCH_NODE_NAME":  "my-job-1a2b3c4d-group0-3",
+		"BATCH_NODE_ZONE":  "us-central1-a",
+	}, TaskEnvironment(job, job.Name+"/taskGroups/group0/tasks/3"))
+	assert.Equal(t, HostsFile, TaskEnvironment(job, job.Name+"/taskGroups/group1/tasks/0")["BATCH_HOSTS_FILE"])
+}
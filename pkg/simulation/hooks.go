@@ -0,0 +1,40 @@
+package simulation
+
+import "github.com/pyshx/fake-batch-server/pkg/api"
+
+const (
+	// hookWorkers is the number of goroutines calling hooks.
+	hookWorkers = 4
+	// hookBacklog is how many calls may wait for each worker before the
+	// loop blocks handing it more.
+	hookBacklog = 256
+)
+
+// completed queues the completion hooks for the job, which has just been
+// stored in a terminal state, with a copy of it.
+func (r *run) completed() {
+	if len(r.hooks) == 0 {
+		return
+	}
+	ctx, job := r.hookCtx, r.job.Clone()
+	r.calls.Add(job.Name, func() {
+		for _, hook := range r.hooks {
+			hook(ctx, job)
+		}
+	})
+}
+
+// notifyTransition queues the transition hooks for a state change of task,
+// or of the job if task is nil, with copies of both.
+func (r *run) notifyTransition(task *api.Task) {
+	if len(r.transitions) == 0 {
+		return
+	}
+	ctx := r.hookCtx
+	transition := Transition{Job: r.job.Clone(), Task: task.Clone(), Time: r.now}
+	r.calls.Add(r.job.Name, func() {
+		for _, hook := range r.transitions {
+			hook(ctx, transition)
+		}
+	})
+}
@@ -0,0 +1,192 @@
+package simulation
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+)
+
+// maxInstanceNameLength is the longest name Compute Engine allows.
+const maxInstanceNameLength = 63
+
+// zoneSuffixes are the zones simulated instances are spread over when the job
+// names a region rather than zones.
+var zoneSuffixes = []string{"a", "b", "c"}
+
+// Instance is the simulated VM a task runs on.
+type Instance struct {
+	// Name is the instance name, e.g. "my-job-1a2b3c4d-group0-0".
+	Name string
+	// Zone is the zone of the instance, e.g. "us-central1-a".
+	Zone string
+	// Index is the index of the instance among those of its task group.
+	Index int64
+}
+
+// TaskInstance returns the instance the task named taskName of job runs on.
+// The tasks of a group are packed onto instances taskCountPerNode at a time in
+// index order, and the instances are spread over the zones the job's
+// allocation policy allows, or over the zones of its region. The result only
+// depends on the job and the task, so it is stable across restarts.
+func TaskInstance(job *api.Job, taskName string) Instance {
+	group := TaskGroupName(taskName)
+	index := TaskIndex(taskName)
+	if index < 0 {
+		index = 0
+	}
+	perNode := int64(1)
+	for _, taskGroup := range job.TaskGroups {
+		if taskGroup.Name == group && taskGroup.TaskCountPerNode > 0 {
+			perNode = taskGroup.TaskCountPerNode
+		}
+	}
+	node := index / perNode
+
+	return Instance{
+		Name:  instanceName(job, group, node),
+		Zone:  instanceZone(job, node),
+		Index: node,
+	}
+}
+
+// groupHosts returns the names of the instances the tasks of group run on, in
+// index order.
+func groupHosts(job *api.Job, group string) []string {
+	var hosts []string
+	for _, taskGroup := range job.TaskGroups {
+		if taskGroup.Name != group {
+			continue
+		}
+		perNode := max(taskGroup.TaskCountPerNode, 1)
+		for node := int64(0); node*perNode < taskGroup.TaskCount; node++ {
+			hosts = append(hosts, instanceName(job, group, node))
+		}
+	}
+	return hosts
+}
+
+// instanceName names the node-th instance of group like the instances the
+// service creates: the job ID, the start of the job UID, the group and the
+// node index.
+func instanceName(job *api.Job, group string, node int64) string {
+	jobID := job.Name[strings.LastIndex(job.Name, "/")+1:]
+	uid := strings.ReplaceAll(job.UID, "-", "")
+	if len(uid) > 8 {
+		uid = uid[:8]
+	}
+
+	suffix := sanitizeName(fmt.Sprintf("-%s-%s-%d", uid, group, node))
+	prefix := sanitizeName(jobID)
+	if prefix == "" || prefix[0] < 'a' || prefix[0] > 'z' {
+		prefix = "batch" + prefix
+	}
+	if room := maxInstanceNameLength - len(suffix); len(prefix) > room {
+		prefix = prefix[:room]
+	}
+	return strings.TrimRight(prefix, "-") + suffix
+}
+
+// sanitizeName lowercases s and replaces characters instance names cannot
+// contain with hyphens.
+func sanitizeName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		default:
+			return '-'
+		}
+	}, s)
+}
+
+// instanceZone returns the zone of the node-th instance of job, cycling
+// through the zones its allocation policy allows. Without any, the zones of
+// the allowed region, or of the job's location, are used.
+func instanceZone(job *api.Job, node int64) string {
+	zones := instanceZones(job)
+	return zones[node%int64(len(zones))]
+}
+
+// instanceZones returns the zones the instances of job cycle through, in
+// order: the node-th instance runs in the zone at node modulo their number.
+func instanceZones(job *api.Job) []string {
+	var zones, regions []string
+	if job.AllocationPolicy != nil && job.AllocationPolicy.Location != nil {
+		for _, location := range job.AllocationPolicy.Location.AllowedLocations {
+			if zone, ok := strings.CutPrefix(location, "zones/"); ok {
+				zones = append(zones, zone)
+			} else if region, ok := strings.CutPrefix(location, "regions/"); ok {
+				regions = append(regions, region)
+			}
+		}
+	}
+	if len(zones) > 0 {
+		return zones
+	}
+
+	if len(regions) == 0 {
+		region := ""
+		if parts := strings.Split(job.Name, "/"); len(parts) > 3 {
+			region = parts[3]
+		}
+		regions = []string{region}
+	}
+	// Both the region and the zone suffix have come round again after this
+	// many instances.
+	for node := 0; node < len(regions)*len(zoneSuffixes); node++ {
+		zones = append(zones, regions[node%len(regions)]+"-"+zoneSuffixes[node%len(zoneSuffixes)])
+	}
+	return zones
+}
+
+// onSpot reports whether the instances of job are Spot VMs, or preemptible
+// VMs, their predecessor, which Compute Engine may reclaim at any time.
+func onSpot(job *api.Job) bool {
+	if job.AllocationPolicy == nil {
+		return false
+	}
+	for _, instance := range job.AllocationPolicy.Instances {
+		if instance.Policy == nil {
+			continue
+		}
+		if model := instance.Policy.ProvisioningModel; model == "SPOT" || model == "PREEMPTIBLE" {
+			return true
+		}
+	}
+	return false
+}
+
+// instanceStatuses returns the kinds of VMs the tasks of taskGroup, a group
+// of job, run on: one per instance policy or template of the job, or
+// standard VMs of a machine type the service picks if it has none. The
+// machine types of templates are not known.
+func instanceStatuses(job *api.Job, taskGroup *api.TaskGroup) []*api.InstanceStatus {
+	taskPack := max(taskGroup.TaskCountPerNode, 1)
+	var instances []*api.InstancePolicyOrTemplate
+	if job.AllocationPolicy != nil {
+		instances = job.AllocationPolicy.Instances
+	}
+	var statuses []*api.InstanceStatus
+	for _, instance := range instances {
+		if instance == nil {
+			continue
+		}
+		status := &api.InstanceStatus{TaskPack: taskPack}
+		if policy := instance.Policy; policy != nil {
+			status.MachineType = policy.MachineType
+			status.ProvisioningModel = policy.ProvisioningModel
+			status.BootDisk = policy.BootDisk
+		}
+		if status.ProvisioningModel == "" {
+			status.ProvisioningModel = "STANDARD"
+		}
+		statuses = append(statuses, status)
+	}
+	if len(statuses) == 0 {
+		statuses = append(statuses, &api.InstanceStatus{ProvisioningModel: "STANDARD", TaskPack: taskPack})
+	}
+	return statuses
+}
@@ -0,0 +1,89 @@
+package simulation
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+)
+
+func TestTaskInstance(t *testing.T) {
+	job := &api.Job{
+		Name: "projects/p/locations/us-central1/jobs/my-job",
+		UID:  "1a2b3c4d-5e6f-7a8b-9c0d-1e2f3a4b5c6d",
+		TaskGroups: []*api.TaskGroup{
+			{Name: "group0", TaskCount: 6, TaskCountPerNode: 2},
+		},
+	}
+	task := func(index int) string {
+		return fmt.Sprintf("%s/taskGroups/group0/tasks/%d", job.Name, index)
+	}
+
+	assert.Equal(t, Instance{Name: "my-job-1a2b3c4d-group0-0", Zone: "us-central1-a", Index: 0}, TaskInstance(job, task(0)))
+	assert.Equal(t, Instance{Name: "my-job-1a2b3c4d-group0-0", Zone: "us-central1-a", Index: 0}, TaskInstance(job, task(1)))
+	assert.Equal(t, Instance{Name: "my-job-1a2b3c4d-group0-2", Zone: "us-central1-c", Index: 2}, TaskInstance(job, task(5)))
+
+	job.AllocationPolicy = &api.AllocationPolicy{Location: &api.LocationPolicy{
+		AllowedLocations: []string{"zones/europe-west4-b", "zones/europe-west4-c"},
+	}}
+	assert.Equal(t, "europe-west4-b", TaskInstance(job, task(0)).Zone)
+	assert.Equal(t, "europe-west4-c", TaskInstance(job, task(2)).Zone)
+
+	job.AllocationPolicy.Location.AllowedLocations = []string{"regions/asia-east1"}
+	assert.Equal(t, "asia-east1-b", TaskInstance(job, task(3)).Zone)
+}
+
+func TestTaskInstance_Name(t *testing.T) {
+	job := &api.Job{
+		Name:       "projects/p/locations/l/jobs/9-Job_" + strings.Repeat("x", 80),
+		TaskGroups: []*api.TaskGroup{{Name: "group0", TaskCount: 1}},
+	}
+
+	name := TaskInstance(job, "projects/p/locations/l/jobs/j/taskGroups/group0/tasks/0").Name
+	assert.LessOrEqual(t, len(name), 63)
+	assert.Regexp(t, `^[a-z]([-a-z0-9]*[a-z0-9])?$`, name)
+	assert.True(t, strings.HasPrefix(name, "batch9-job-x"), name)
+	assert.True(t, strings.HasSuffix(name, "-group0-0"), name)
+}
+
+func TestEngine_InstanceStatus(t *testing.T) {
+	engine, store, fake := setupFakeEngine()
+	job := newTestJob(t, store, fake.Now(),
+		&api.TaskGroup{Name: "group0", TaskCount: 4, TaskCountPerNode: 2},
+		&api.TaskGroup{Name: "group1", TaskCount: 1},
+	)
+	job.AllocationPolicy = &api.AllocationPolicy{Instances: []*api.InstancePolicyOrTemplate{
+		{Policy: &api.InstancePolicy{MachineType: "e2-standard-4", BootDisk: &api.Disk{SizeGb: 50}}},
+	}}
+	require.NoError(t, store.UpdateJob(job))
+
+	engine.Start(job, &Plan{})
+	stored, err := store.GetJob(job.Name)
+	require.NoError(t, err)
+	for _, status := range stored.Status.TaskGroups {
+		assert.Empty(t, status.Instances, "a queued job has no instances")
+	}
+
+	fake.Advance(time.Minute)
+	waitForJobState(t, store, job.Name, api.JobStateSucceeded)
+	stored, err = store.GetJob(job.Name)
+	require.NoError(t, err)
+	assert.Equal(t, []*api.InstanceStatus{
+		{MachineType: "e2-standard-4", ProvisioningModel: "STANDARD", TaskPack: 2, BootDisk: &api.Disk{SizeGb: 50}},
+	}, stored.Status.TaskGroups["group0"].Instances)
+	assert.Equal(t, int64(4), stored.Status.TaskGroups["group0"].Counts["SUCCEEDED"])
+	assert.Equal(t, int64(1), stored.Status.TaskGroups["group1"].Instances[0].TaskPack)
+
+	job = newTestJob(t, store, fake.Now(), &api.TaskGroup{Name: "group0", TaskCount: 1})
+	engine.Start(job, &Plan{})
+	fake.Advance(time.Minute)
+	waitForJobState(t, store, job.Name, api.JobStateSucceeded)
+	stored, err = store.GetJob(job.Name)
+	require.NoError(t, err)
+	assert.Equal(t, []*api.InstanceStatus{{ProvisioningModel: "STANDARD", TaskPack: 1}}, stored.Status.TaskGroups["group0"].Instances)
+}
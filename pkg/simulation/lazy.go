@@ -0,0 +1,261 @@
+package simulation
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+	"github.com/pyshx/fake-batch-server/pkg/storage"
+)
+
+// lazyGroup is the simulation of a lazy task group, whose tasks are not
+// stored but derived from its storage.TaskProgress. Its tasks run in waves of
+// as many as its parallelism allows rather than one by one: every wave takes
+// the group's RUNNING time, and a task fails, after exhausting its retries,
+// with the probability that each of its attempts does. Only failed tasks are
+// stored, and only their transitions reach the transition hooks; the
+// runnables of the group are neither stepped through nor executed.
+type lazyGroup struct {
+	name     string
+	progress *storage.TaskProgress
+	total    int64
+	waveSize int64
+	duration time.Duration
+	// endAt is when the running wave finishes, or zero if none is running.
+	endAt time.Time
+}
+
+// loadTasks loads the stored tasks of the run's job and the progress of its
+// lazy task groups. The tasks of the other groups are fetched one by one when
+// there are lazy groups, so that those of the lazy ones are not derived.
+func (r *run) loadTasks() ([]*api.Task, error) {
+	timings := r.timings.Merge(r.plan.Timings)
+	r.lazy = nil
+	for _, taskGroup := range r.job.TaskGroups {
+		if !storage.Lazy(taskGroup) {
+			continue
+		}
+		// A group grown past the limit after the job was created keeps its
+		// stored tasks.
+		progress, err := r.store.GetTaskProgress(r.job.Name, taskGroup.Name)
+		if err != nil {
+			continue
+		}
+		if r.resumeAt.IsZero() {
+			progress = &storage.TaskProgress{}
+		}
+		lastNode := (taskGroup.TaskCount - 1) / max(taskGroup.TaskCountPerNode, 1)
+		progress.InstancePrefix = strings.TrimSuffix(instanceName(r.job, taskGroup.Name, lastNode), strconv.FormatInt(lastNode, 10))
+		progress.Zones = instanceZones(r.job)
+		progress.TasksPerNode = max(taskGroup.TaskCountPerNode, 1)
+		r.lazy = append(r.lazy, &lazyGroup{
+			name:     taskGroup.Name,
+			progress: progress,
+			total:    taskGroup.TaskCount,
+			waveSize: parallelism(taskGroup),
+			duration: timings.Duration(api.JobStateRunning),
+		})
+	}
+	if len(r.lazy) == 0 {
+		return r.store.ListTasks(r.job.Name)
+	}
+
+	var tasks []*api.Task
+	for _, taskGroup := range r.job.TaskGroups {
+		if r.isLazy(taskGroup.Name) {
+			continue
+		}
+		for index := int64(0); index < taskGroup.TaskCount; index++ {
+			task, err := r.store.GetTask(r.job.Name, fmt.Sprintf("%s/taskGroups/%s/tasks/%d", r.job.Name, taskGroup.Name, index))
+			if err != nil {
+				return nil, err
+			}
+			tasks = append(tasks, task)
+		}
+	}
+	return tasks, nil
+}
+
+// isLazy reports whether the named task group of the run's job is lazy.
+func (r *run) isLazy(name string) bool {
+	return r.lazyGroup(name) != nil
+}
+
+// lazyGroup returns the named lazy task group of the run's job, or nil if
+// the group is not lazy.
+func (r *run) lazyGroup(name string) *lazyGroup {
+	for _, g := range r.lazy {
+		if g.name == name {
+			return g
+		}
+	}
+	return nil
+}
+
+// growWaves raises the task count of g to total. A running wave carries on,
+// the next ones taking in the added tasks; a group whose waves were over
+// starts a new epoch with them if the job is running, and the first wave of
+// a job yet to run takes in as many as it has room for.
+func (r *run) growWaves(g *lazyGroup, total int64) {
+	p := g.progress
+	g.total = total
+	switch {
+	case r.plan.Scenario != nil:
+		if r.job.State != api.JobStateRunning {
+			return
+		}
+		var duration time.Duration
+		if len(p.Epochs) > 0 {
+			duration = p.Epochs[len(p.Epochs)-1].WaveDuration
+		}
+		p.Epochs = append(p.Epochs, storage.TaskEpoch{
+			From:         p.Started,
+			ScheduledAt:  r.now,
+			RunningAt:    r.now,
+			WaveSize:     total - p.Started,
+			WaveDuration: duration,
+		})
+		p.Assigned, p.Started = total, total
+	case r.started:
+		if !g.endAt.IsZero() {
+			return
+		}
+		p.Assigned = min(p.Finished+g.waveSize, total)
+		p.Epochs = append(p.Epochs, storage.TaskEpoch{
+			From:         p.Finished,
+			ScheduledAt:  r.now,
+			RunningAt:    r.now,
+			WaveSize:     g.waveSize,
+			WaveDuration: g.duration,
+		})
+		r.startWave(g, r.now)
+		return
+	case r.assigned:
+		// A group that was over when the job was scheduled has no wave yet.
+		if p.Assigned == p.Finished {
+			p.Started = p.Finished
+			p.Epochs = append(p.Epochs, storage.TaskEpoch{
+				From:         p.Finished,
+				ScheduledAt:  r.now,
+				WaveSize:     g.waveSize,
+				WaveDuration: g.duration,
+			})
+		}
+		p.Assigned = min(p.Finished+g.waveSize, total)
+	default:
+		return
+	}
+	r.saveProgress(g)
+}
+
+// scheduleWaves assigns the first wave of every lazy task group at the given
+// time. Tasks a resumed run left unfinished start over in the new wave.
+func (r *run) scheduleWaves(at time.Time) {
+	for _, g := range r.lazy {
+		p := g.progress
+		if p.Finished >= g.total {
+			continue
+		}
+		p.Started = p.Finished
+		p.Assigned = min(p.Finished+g.waveSize, g.total)
+		p.Epochs = append(p.Epochs, storage.TaskEpoch{
+			From:         p.Finished,
+			ScheduledAt:  at,
+			WaveSize:     g.waveSize,
+			WaveDuration: g.duration,
+		})
+		r.saveProgress(g)
+	}
+}
+
+// startWaves starts the first wave of every lazy task group at the given
+// time.
+func (r *run) startWaves(at time.Time) {
+	for _, g := range r.lazy {
+		if p := g.progress; p.Assigned > p.Started {
+			p.Epochs[len(p.Epochs)-1].RunningAt = at
+		}
+		r.startWave(g, at)
+	}
+}
+
+// startWave starts the assigned tasks of g running at the given time.
+func (r *run) startWave(g *lazyGroup, at time.Time) {
+	p := g.progress
+	p.Started = p.Assigned
+	r.active[g.name] = int(p.Started - p.Finished)
+	g.endAt = time.Time{}
+	if p.Started > p.Finished {
+		g.endAt = at.Add(g.duration)
+	}
+	r.saveProgress(g)
+}
+
+// endWaves finishes every wave due by at and starts the next one of its
+// group right away.
+func (r *run) endWaves(at time.Time) {
+	r.now = at
+	for _, g := range r.lazy {
+		if g.endAt.IsZero() || g.endAt.After(at) {
+			continue
+		}
+		end := g.endAt
+		p := g.progress
+		rate := math.Pow(r.plan.TaskFailureRate, float64(r.maxRetries[g.name])+1)
+		for index := p.Finished; index < p.Started; index++ {
+			if rate > 0 && rand.Float64() < rate {
+				r.failLazyTask(g, index)
+				p.Failed++
+			}
+		}
+		p.Finished = p.Started
+		p.Assigned = min(p.Finished+g.waveSize, g.total)
+		r.startWave(g, end)
+	}
+}
+
+// failLazyTask stores the task at index of g as having failed every attempt.
+func (r *run) failLazyTask(g *lazyGroup, index int64) {
+	task, err := r.store.GetTask(r.job.Name, fmt.Sprintf("%s/taskGroups/%s/tasks/%d", r.job.Name, g.name, index))
+	if err != nil {
+		logrus.Errorf("Failed to get task %d of group %s of job %s: %v", index, g.name, r.job.Name, err)
+		return
+	}
+	retries := r.maxRetries[g.name]
+	for number := int32(1); number <= retries; number++ {
+		r.recordTaskEvent(task, r.exitEvent("task_failed", fmt.Sprintf("Task failed with exit code %d on attempt %d", simulatedExitCode, number), simulatedExitCode))
+		r.setTaskState(task, api.TaskStateRunning, "task_retried", fmt.Sprintf("Task retry %d of %d started", number, retries))
+	}
+	r.setTaskStateWith(task, api.TaskStateFailed, r.exitEvent("task_failed", fmt.Sprintf("Task failed with exit code %d on attempt %d", simulatedExitCode, retries+1), simulatedExitCode))
+}
+
+// saveProgress stores the progress of g.
+func (r *run) saveProgress(g *lazyGroup) {
+	if r.ctx.Err() != nil {
+		return
+	}
+	if err := r.store.UpdateTaskProgress(r.job.Name, g.name, g.progress); err != nil {
+		logrus.Errorf("Failed to update progress of task group %s: %v", g.name, err)
+	}
+}
+
+// wavesRunning reports whether a wave of any lazy task group is running.
+func (r *run) wavesRunning() bool {
+	for _, g := range r.lazy {
+		if !g.endAt.IsZero() {
+			return true
+		}
+	}
+	return false
+}
+
+// counts returns the task counts of g by state, like TaskCounts.
+func (g *lazyGroup) counts() map[string]int64 {
+	return g.progress.Counts(g.total)
+}
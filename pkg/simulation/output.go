@@ -0,0 +1,54 @@
+package simulation
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+	"github.com/pyshx/fake-batch-server/pkg/logs"
+)
+
+// SetLogs makes the engine record task output in store: synthetic lines for
+// simulated runnables and the real output of runnables run by an Executor.
+// It must be called before any job is started.
+func (e *Engine) SetLogs(store *logs.Store) {
+	e.logs = store
+}
+
+// log appends a synthetic line to the output of task.
+func (r *run) log(task *api.Task, runnable int, format string, args ...interface{}) {
+	if r.logs == nil || r.ctx.Err() != nil {
+		return
+	}
+	r.logs.Append(task.Name, logs.Entry{Time: r.now, Runnable: runnable, Text: fmt.Sprintf(format, args...)})
+}
+
+// closeLog marks the output of a finished task as complete. The log is
+// closed off the loop, along with the job's hook calls, as closing it may
+// upload it to GCS.
+func (r *run) closeLog(task *api.Task) {
+	if r.logs == nil || r.ctx.Err() != nil {
+		return
+	}
+	logs, name := r.logs, task.Name
+	r.calls.Add(r.job.Name, func() { logs.Close(name) })
+}
+
+// commandLine describes what a simulated runnable pretends to run.
+func commandLine(runnable *api.Runnable) string {
+	switch {
+	case runnable.Container != nil:
+		args := []string{runnable.Container.ImageURI}
+		if runnable.Container.Entrypoint != "" {
+			args = append(args, runnable.Container.Entrypoint)
+		}
+		return "Running " + strings.Join(append(args, runnable.Container.Commands...), " ")
+	case runnable.Script != nil && runnable.Script.Path != "":
+		return "Running script " + runnable.Script.Path
+	case runnable.Script != nil:
+		text, _, _ := strings.Cut(strings.TrimSpace(runnable.Script.Text), "\n")
+		return "Running script: " + text
+	default:
+		return "Running"
+	}
+}
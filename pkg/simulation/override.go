@@ -0,0 +1,123 @@
+package simulation
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+)
+
+// overrideDurations maps the duration settings of an override to the state
+// they time.
+var overrideDurations = map[string]api.JobState{
+	"queued":    api.JobStateQueued,
+	"scheduled": api.JobStateScheduled,
+	"run":       api.JobStateRunning,
+}
+
+// ApplyOverride overrides the simulation of a single job on its plan, e.g.
+// with "fail-after-running,run=30s". The value is a comma-separated list of
+// an optional outcome followed by settings:
+//
+//   - succeed: the job succeeds
+//   - fail-after-running: every task attempt fails once it has run
+//   - fail-before-running: the job fails while it is SCHEDULED, before any
+//     task runs
+//   - any other name picks that scenario from scenarios
+//   - queued=, scheduled=, run=: the time spent in QUEUED, SCHEDULED and,
+//     per task attempt, RUNNING, or in the scenario's steps for them
+//   - failure-rate=: the probability, between 0 and 1, that a task attempt
+//     fails
+//
+// timings are those of the engine, merged with the plan's to time the
+// fail-before-running scenario. The override takes precedence over the
+// job's labels and any scenario it matched.
+func ApplyOverride(plan *Plan, value string, timings Timings, scenarios *Scenarios) error {
+	durations := make(map[api.JobState]time.Duration)
+	outcome := ""
+	for i, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		key, setting, ok := strings.Cut(item, "=")
+		if !ok {
+			if i > 0 || item == "" {
+				return fmt.Errorf("invalid simulation override %q, the outcome must come first", value)
+			}
+			outcome = item
+			continue
+		}
+
+		key = strings.TrimSpace(key)
+		setting = strings.TrimSpace(setting)
+		if key == "failure-rate" {
+			rate, err := strconv.ParseFloat(setting, 64)
+			if err != nil || rate < 0 || rate > 1 {
+				return fmt.Errorf("invalid failure-rate %q, must be a number between 0 and 1", setting)
+			}
+			plan.TaskFailureRate = rate
+			continue
+		}
+		state, ok := overrideDurations[key]
+		if !ok {
+			return fmt.Errorf("unknown simulation setting %q, must be one of queued, scheduled, run or failure-rate", key)
+		}
+		d, err := time.ParseDuration(setting)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid %s duration %q", key, setting)
+		}
+		durations[state] = d
+	}
+
+	switch outcome {
+	case "":
+	case "succeed":
+		plan.TaskFailureRate = 0
+		plan.Scenario = nil
+	case "fail-after-running":
+		plan.TaskFailureRate = 1
+		plan.Scenario = nil
+	case "fail-before-running":
+		plan.Scenario = nil
+	default:
+		var scenario *Scenario
+		if scenarios != nil {
+			for _, s := range scenarios.Scenarios {
+				if s.Name == outcome {
+					scenario = s
+					break
+				}
+			}
+		}
+		if scenario == nil {
+			return fmt.Errorf("unknown simulation outcome or scenario %q", outcome)
+		}
+		plan.Scenario = scenario
+	}
+
+	if len(durations) > 0 {
+		plan.Timings = plan.Timings.Merge(Timings{States: durations})
+	}
+	if outcome == "fail-before-running" {
+		merged := timings.Merge(plan.Timings)
+		plan.Scenario = &Scenario{Name: outcome, Steps: []ScenarioStep{
+			{State: api.JobStateQueued, Duration: merged.Duration(api.JobStateQueued)},
+			{State: api.JobStateScheduled, Duration: merged.Duration(api.JobStateScheduled)},
+			{State: api.JobStateFailed, Description: "Job failed: no VMs could be provisioned"},
+		}}
+	} else if plan.Scenario != nil && len(durations) > 0 {
+		// The scenario is shared with other jobs, so its steps are copied.
+		scenario := *plan.Scenario
+		scenario.Steps = append([]ScenarioStep(nil), scenario.Steps...)
+		for i, step := range scenario.Steps {
+			if d, ok := durations[step.State]; ok {
+				scenario.Steps[i].Duration = d
+			}
+		}
+		if err := (&Scenarios{Scenarios: []*Scenario{&scenario}}).Validate(); err != nil {
+			return err
+		}
+		plan.Scenario = &scenario
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package simulation
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+)
+
+func TestApplyOverride(t *testing.T) {
+	plan := &Plan{TaskFailureRate: 0.5}
+	require.NoError(t, ApplyOverride(plan, "fail-after-running, run=30s", DefaultTimings(), nil))
+	assert.Equal(t, 1.0, plan.TaskFailureRate)
+	assert.Equal(t, 30*time.Second, plan.Timings.Duration(api.JobStateRunning))
+
+	plan = &Plan{}
+	require.NoError(t, ApplyOverride(plan, "failure-rate=0.25,queued=0s", DefaultTimings(), nil))
+	assert.Equal(t, 0.25, plan.TaskFailureRate)
+	assert.Equal(t, time.Duration(0), plan.Timings.Duration(api.JobStateQueued))
+	assert.Nil(t, plan.Scenario)
+
+	plan = &Plan{}
+	require.NoError(t, ApplyOverride(plan, "fail-before-running,scheduled=10m", DefaultTimings(), nil))
+	assert.Equal(t, []ScenarioStep{
+		{State: api.JobStateQueued, Duration: time.Second},
+		{State: api.JobStateScheduled, Duration: 10 * time.Minute},
+		{State: api.JobStateFailed, Description: "Job failed: no VMs could be provisioned"},
+	}, plan.Scenario.Steps)
+}
+
+func TestApplyOverride_NamedScenario(t *testing.T) {
+	shared := &Scenario{Name: "slow", Steps: []ScenarioStep{
+		{State: api.JobStateScheduled, Duration: time.Minute},
+		{State: api.JobStateRunning, Duration: time.Hour},
+		{State: api.JobStateSucceeded},
+	}}
+	scenarios := &Scenarios{Scenarios: []*Scenario{shared}}
+
+	plan := &Plan{}
+	require.NoError(t, ApplyOverride(plan, "slow,run=1m", DefaultTimings(), scenarios))
+	assert.Equal(t, time.Minute, plan.Scenario.Steps[1].Duration)
+	assert.Equal(t, time.Hour, shared.Steps[1].Duration)
+
+	// An outcome replaces the scenario the job matched.
+	plan = &Plan{Scenario: shared}
+	require.NoError(t, ApplyOverride(plan, "succeed", DefaultTimings(), scenarios))
+	assert.Nil(t, plan.Scenario)
+}
+
+func TestApplyOverride_Invalid(t *testing.T) {
+	for _, value := range []string{
+		"unknown",
+		"run=30s,succeed",
+		"run=soon",
+		"run=-1s",
+		"failure-rate=2",
+		"color=red",
+		"succeed,,run=1s",
+	} {
+		assert.Error(t, ApplyOverride(&Plan{}, value, DefaultTimings(), nil), value)
+	}
+}
@@ -0,0 +1,82 @@
+package simulation
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+	"github.com/pyshx/fake-batch-server/pkg/tracing"
+)
+
+// Labels that steer the simulation of an individual job.
+const (
+	// FinalStateLabel forces the terminal state a simulated job ends in.
+	FinalStateLabel = "fake-batch/final-state"
+	// TaskFailureRateLabel overrides the probability, between 0 and 1, that
+	// each task attempt of the job fails.
+	TaskFailureRateLabel = "fake-batch/task-failure-rate"
+	// SpotPreemptionRateLabel overrides the probability, between 0 and 1,
+	// that each task attempt of a job on Spot VMs is preempted.
+	SpotPreemptionRateLabel = "fake-batch/spot-preemption-rate"
+	// TenantLabel names the tenant a Scheduler counts the job against
+	// instead of its project.
+	TenantLabel = "fake-batch/tenant"
+)
+
+// Plan holds the per-job choices that steer a simulated run.
+type Plan struct {
+	// TaskFailureRate is the probability that a single task attempt fails.
+	// Forcing the final state pins it to 0 (SUCCEEDED) or 1 (FAILED).
+	TaskFailureRate float64
+	// SpotPreemptionRate is the probability that a single task attempt of
+	// a job on Spot or preemptible VMs is preempted before it finishes.
+	SpotPreemptionRate float64
+	// Timings overrides the engine timings of the states it sets.
+	Timings Timings
+	// WarmPool, if set, lets the job skip provisioning while the pool has
+	// room for it. It is shared with other plans and not checkpointed.
+	WarmPool *WarmPool `json:"-"`
+	// Scenario, if set, scripts the lifecycle of the job instead.
+	Scenario *Scenario
+	// Trace is the span the job was submitted under. The span of its
+	// simulation joins that trace.
+	Trace tracing.SpanContext
+}
+
+// NewPlan builds the plan for job by applying its labels to defaults. A
+// non-empty finalState, typically taken from the request, takes precedence
+// over FinalStateLabel.
+func NewPlan(job *api.Job, defaults Plan, finalState string) (*Plan, error) {
+	plan := defaults
+
+	if value, ok := job.Labels[TaskFailureRateLabel]; ok {
+		rate, err := strconv.ParseFloat(value, 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return nil, fmt.Errorf("invalid %s %q, must be a number between 0 and 1", TaskFailureRateLabel, value)
+		}
+		plan.TaskFailureRate = rate
+	}
+	if value, ok := job.Labels[SpotPreemptionRateLabel]; ok {
+		rate, err := strconv.ParseFloat(value, 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return nil, fmt.Errorf("invalid %s %q, must be a number between 0 and 1", SpotPreemptionRateLabel, value)
+		}
+		plan.SpotPreemptionRate = rate
+	}
+
+	if finalState == "" {
+		finalState = job.Labels[FinalStateLabel]
+	}
+
+	switch api.JobState(finalState) {
+	case "":
+	case api.JobStateSucceeded:
+		plan.TaskFailureRate = 0
+	case api.JobStateFailed:
+		plan.TaskFailureRate = 1
+	default:
+		return nil, fmt.Errorf("unsupported final state %q, must be SUCCEEDED or FAILED", finalState)
+	}
+
+	return &plan, nil
+}
@@ -0,0 +1,159 @@
+package simulation
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Profile is a named set of simulation settings applied to the jobs of some
+// projects instead of the server-wide ones.
+type Profile struct {
+	// Timings overrides the server timings of the states it sets.
+	Timings `yaml:",inline"`
+	// TaskFailureRate, if set, overrides the server default probability that
+	// a task attempt fails. The failure rate label still takes precedence.
+	TaskFailureRate *float64 `yaml:"taskFailureRate"`
+	// WarmPool, if set, is capacity kept warm for the profile's jobs.
+	WarmPool *WarmPool `yaml:"warmPool"`
+}
+
+// WarmPool models VMs kept running for the jobs of a profile. A job whose
+// first wave of tasks fits on the idle VMs of the pool takes them and skips
+// its SCHEDULED provisioning time; other jobs are provisioned as usual. Jobs
+// hold the VMs they took until they end. Every plan built from the profile
+// shares the pool.
+type WarmPool struct {
+	// Size is the number of VMs in the pool.
+	Size int `yaml:"size"`
+
+	mu    sync.Mutex
+	inUse int
+}
+
+// take reserves n VMs of the pool and reports whether that many were idle.
+// A nil pool has none.
+func (p *WarmPool) take(n int) bool {
+	if p == nil {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.inUse+n > p.Size {
+		return false
+	}
+	p.inUse += n
+	return true
+}
+
+// release returns n VMs reserved by take to the pool.
+func (p *WarmPool) release(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.inUse -= n
+}
+
+// Profiles maps projects to profiles.
+type Profiles struct {
+	Profiles map[string]Profile `yaml:"profiles"`
+	// Projects maps a project ID to the name of its profile. Projects not
+	// listed use Default, or the server settings if Default is empty.
+	Projects map[string]string `yaml:"projects"`
+	Default  string            `yaml:"default"`
+}
+
+// LoadProfiles reads profiles from a YAML or JSON file, e.g.:
+//
+//	profiles:
+//	  fast:
+//	    states:
+//	      QUEUED: 0s
+//	      SCHEDULED: 0s
+//	      RUNNING: 100ms
+//	  chaos:
+//	    taskFailureRate: 0.3
+//	  warm:
+//	    warmPool:
+//	      size: 8
+//	projects:
+//	  unit-tests: fast
+//	  resilience-tests: chaos
+func LoadProfiles(path string) (*Profiles, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var profiles Profiles
+	if err := yaml.Unmarshal(data, &profiles); err != nil {
+		return nil, fmt.Errorf("failed to parse profiles config %s: %v", path, err)
+	}
+	if err := profiles.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid profiles config %s: %v", path, err)
+	}
+	return &profiles, nil
+}
+
+// Validate checks that every referenced profile exists and holds sensible
+// values.
+func (p *Profiles) Validate() error {
+	for name, profile := range p.Profiles {
+		for state, d := range profile.States {
+			if d < 0 {
+				return fmt.Errorf("profile %s: negative duration %s for state %s", name, d, state)
+			}
+		}
+		if profile.Progress < 0 {
+			return fmt.Errorf("profile %s: negative progress interval %s", name, profile.Progress)
+		}
+		if profile.Jitter < 0 {
+			return fmt.Errorf("profile %s: negative jitter %s", name, profile.Jitter)
+		}
+		if rate := profile.TaskFailureRate; rate != nil && (*rate < 0 || *rate > 1) {
+			return fmt.Errorf("profile %s: taskFailureRate must be between 0 and 1, got %v", name, *rate)
+		}
+		if profile.WarmPool != nil && profile.WarmPool.Size < 0 {
+			return fmt.Errorf("profile %s: negative warm pool size %d", name, profile.WarmPool.Size)
+		}
+	}
+	for project, name := range p.Projects {
+		if _, ok := p.Profiles[name]; !ok {
+			return fmt.Errorf("project %s uses unknown profile %q", project, name)
+		}
+	}
+	if _, ok := p.Profiles[p.Default]; p.Default != "" && !ok {
+		return fmt.Errorf("unknown default profile %q", p.Default)
+	}
+	return nil
+}
+
+// For returns the name and profile of project, and false if it has none.
+func (p *Profiles) For(project string) (string, *Profile, bool) {
+	if p == nil {
+		return "", nil, false
+	}
+	name, ok := p.Projects[project]
+	if !ok {
+		name = p.Default
+	}
+	profile, ok := p.Profiles[name]
+	if !ok {
+		return "", nil, false
+	}
+	return name, &profile, true
+}
+
+// Apply returns a copy of defaults with the settings of profile applied.
+func (p *Profile) Apply(defaults Plan) Plan {
+	plan := defaults
+	plan.Timings = defaults.Timings.Merge(p.Timings)
+	if p.TaskFailureRate != nil {
+		plan.TaskFailureRate = *p.TaskFailureRate
+	}
+	if p.WarmPool != nil {
+		plan.WarmPool = p.WarmPool
+	}
+	return plan
+}
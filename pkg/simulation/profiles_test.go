@@ -0,0 +1,113 @@
+package simulation
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+)
+
+func TestLoadProfiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "profiles.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+profiles:
+  fast:
+    states:
+      QUEUED: 0s
+      RUNNING: 100ms
+  chaos:
+    taskFailureRate: 0.5
+projects:
+  unit-tests: fast
+default: chaos
+`), 0o644))
+
+	profiles, err := LoadProfiles(path)
+	require.NoError(t, err)
+
+	name, profile, ok := profiles.For("unit-tests")
+	require.True(t, ok)
+	assert.Equal(t, "fast", name)
+	plan := profile.Apply(Plan{TaskFailureRate: 0.1})
+	assert.Equal(t, 0.1, plan.TaskFailureRate)
+	assert.Equal(t, 100*time.Millisecond, plan.Timings.Duration(api.JobStateRunning))
+	queued, ok := plan.Timings.States[api.JobStateQueued]
+	assert.True(t, ok)
+	assert.Zero(t, queued)
+
+	name, profile, ok = profiles.For("anything-else")
+	require.True(t, ok)
+	assert.Equal(t, "chaos", name)
+	plan = profile.Apply(Plan{TaskFailureRate: 0.1})
+	assert.Equal(t, 0.5, plan.TaskFailureRate)
+	assert.Empty(t, plan.Timings.States)
+
+	var none *Profiles
+	_, _, ok = none.For("unit-tests")
+	assert.False(t, ok)
+}
+
+func TestLoadProfiles_Invalid(t *testing.T) {
+	tests := map[string]string{
+		"UnknownProfile":  "projects:\n  p: missing\n",
+		"UnknownDefault":  "default: missing\n",
+		"NegativeTiming":  "profiles:\n  slow:\n    states:\n      QUEUED: -1s\n",
+		"FailureRate":     "profiles:\n  chaos:\n    taskFailureRate: 2\n",
+		"WarmPoolSize":    "profiles:\n  warm:\n    warmPool:\n      size: -1\n",
+		"MalformedConfig": "profiles: [\n",
+	}
+	for name, config := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "profiles.yaml")
+			require.NoError(t, os.WriteFile(path, []byte(config), 0o644))
+			_, err := LoadProfiles(path)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestEngine_WarmPool(t *testing.T) {
+	engine, store, fake := setupFakeEngine()
+	plan := (&Profile{WarmPool: &WarmPool{Size: 2}}).Apply(Plan{})
+
+	eventTimes := func(job *api.Job) map[string]time.Duration {
+		times := make(map[string]time.Duration)
+		for _, event := range job.Status.StatusEvents {
+			times[event.Type] = event.EventTime.Sub(job.CreateTime)
+		}
+		return times
+	}
+
+	// Two tasks fit on the two warm VMs, so provisioning is skipped
+	warm := newTestJob(t, store, fake.Now(), &api.TaskGroup{Name: "group1", TaskCount: 2})
+	engine.Start(warm, &plan)
+	fake.Advance(time.Second)
+	running := waitForJobState(t, store, warm.Name, api.JobStateRunning)
+	assert.Equal(t, "Job scheduled; VMs taken from the warm pool", running.Status.StatusEvents[0].Description)
+	assert.Equal(t, time.Second, eventTimes(running)["job_started"])
+
+	// While they are taken, the next job is provisioned as usual
+	cold := newTestJob(t, store, fake.Now().Add(-time.Second), &api.TaskGroup{Name: "group1", TaskCount: 1})
+	engine.Start(cold, &plan)
+	scheduled := waitForJobState(t, store, cold.Name, api.JobStateScheduled)
+	assert.Equal(t, "Job scheduled; VMs are being provisioned", scheduled.Status.StatusEvents[0].Description)
+
+	fake.Advance(time.Minute)
+	waitForJobState(t, store, warm.Name, api.JobStateSucceeded)
+	cold = waitForJobState(t, store, cold.Name, api.JobStateSucceeded)
+	assert.Equal(t, 2*time.Second, eventTimes(cold)["job_started"])
+
+	// Ended jobs hand their VMs back to the pool
+	require.Eventually(t, func() bool {
+		return !engine.Running(warm.Name) && !engine.Running(cold.Name)
+	}, time.Second, time.Millisecond)
+	next := newTestJob(t, store, fake.Now().Add(-time.Second), &api.TaskGroup{Name: "group1", TaskCount: 4, TaskCountPerNode: 2})
+	engine.Start(next, &plan)
+	next = waitForJobState(t, store, next.Name, api.JobStateRunning)
+	assert.Equal(t, time.Second, eventTimes(next)["job_started"])
+}
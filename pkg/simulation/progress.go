@@ -0,0 +1,62 @@
+package simulation
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+	"github.com/pyshx/fake-batch-server/pkg/tracing"
+)
+
+// reportProgress records a job_progress event at the given time, giving the
+// number of instances the running tasks occupy and how many tasks are done,
+// and schedules the next one. The caller saves the job.
+func (r *run) reportProgress(at time.Time) {
+	r.now = at
+	r.progressAt = at.Add(r.progressEvery)
+
+	complete, running, total := 0, 0, len(r.tasks)
+	for _, task := range r.tasks {
+		switch task.Status.State {
+		case api.TaskStateSucceeded, api.TaskStateFailed:
+			complete++
+		case api.TaskStateRunning:
+			running++
+		}
+	}
+	for _, g := range r.lazy {
+		complete += int(g.progress.Finished)
+		running += int(g.progress.Started - g.progress.Finished)
+		total += int(g.total)
+	}
+
+	r.job.Status.StatusEvents = append(r.job.Status.StatusEvents, &api.StatusEvent{
+		Type:        "job_progress",
+		Description: fmt.Sprintf("Scaled to %d instances; %d of %d tasks complete, %d running", r.instances(), complete, total, running),
+		EventTime:   at,
+	})
+	r.span.AddEvent("job progress", at,
+		tracing.Attribute{Key: "batch.tasks_complete", Value: complete},
+		tracing.Attribute{Key: "batch.tasks_running", Value: running})
+}
+
+// instances returns how many VMs the active tasks occupy, packing
+// taskCountPerNode tasks of a group onto each.
+func (r *run) instances() int {
+	return r.instancesFor(r.active)
+}
+
+// instancesFor returns how many VMs the given numbers of tasks per group
+// occupy, packing taskCountPerNode tasks of a group onto each.
+func (r *run) instancesFor(tasks map[string]int) int {
+	instances := 0
+	for _, taskGroup := range r.job.TaskGroups {
+		count := tasks[taskGroup.Name]
+		perNode := int(taskGroup.TaskCountPerNode)
+		if perNode <= 0 {
+			perNode = 1
+		}
+		instances += (count + perNode - 1) / perNode
+	}
+	return instances
+}
@@ -0,0 +1,362 @@
+package simulation
+
+import (
+	"container/heap"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+)
+
+// Exit codes of runnables and tasks stopped for running too long.
+const (
+	// timeoutExitCode is reported by a runnable killed at its timeout, as
+	// by timeout(1).
+	timeoutExitCode = 124
+	// maxRunDurationExitCode is the exit code production reports for a
+	// task that exceeded its maxRunDuration.
+	maxRunDurationExitCode = 50005
+	// preemptionExitCode is the exit code production reports for a task
+	// whose Spot VM was preempted.
+	preemptionExitCode = 50001
+)
+
+// stopCause is why a runnable ended before finishing on its own.
+type stopCause int
+
+const (
+	stopNone stopCause = iota
+	// stopTimeout means the runnable reached its timeout.
+	stopTimeout
+	// stopMaxRunDuration means the attempt reached its task's
+	// maxRunDuration.
+	stopMaxRunDuration
+	// stopPreempted means the Spot VM of the attempt was preempted.
+	stopPreempted
+)
+
+// ParseDuration parses a google.protobuf.Duration in its JSON form: a
+// decimal number of seconds followed by "s", such as "3600s" or "0.5s".
+func ParseDuration(value string) (time.Duration, error) {
+	seconds, ok := strings.CutSuffix(value, "s")
+	number, err := strconv.ParseFloat(seconds, 64)
+	if !ok || err != nil || number < 0 {
+		return 0, fmt.Errorf("invalid duration %q, must be a non-negative number of seconds ending in \"s\", e.g. \"3600s\"", value)
+	}
+	return time.Duration(number * float64(time.Second)), nil
+}
+
+// limit returns the duration value sets as a limit, or 0 for no limit if
+// it is empty or invalid.
+func limit(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	d, err := ParseDuration(value)
+	if err != nil {
+		return 0
+	}
+	return d
+}
+
+// isForeground reports whether a runnable blocks the task while it runs.
+// Background runnables and barriers take no time of their own.
+func isForeground(runnable *api.Runnable) bool {
+	return runnable.Barrier == nil && !runnable.Background
+}
+
+// stepDuration splits the running time of an attempt evenly among its
+// foreground runnables. A task without runnables runs for the whole time.
+func stepDuration(runnables []*api.Runnable, running time.Duration) time.Duration {
+	foreground := countForeground(runnables)
+	if foreground == 0 {
+		return running
+	}
+	return running / time.Duration(foreground)
+}
+
+// countForeground returns how many of runnables are foreground runnables.
+func countForeground(runnables []*api.Runnable) int {
+	foreground := 0
+	for _, runnable := range runnables {
+		if isForeground(runnable) {
+			foreground++
+		}
+	}
+	return foreground
+}
+
+// runnableName describes a runnable in status events.
+func runnableName(runnable *api.Runnable, index int) string {
+	if runnable.DisplayName != "" {
+		return fmt.Sprintf("Runnable %d (%s)", index, runnable.DisplayName)
+	}
+	return fmt.Sprintf("Runnable %d", index)
+}
+
+// newAttempt creates attempt number of task. With probability
+// plan.TaskFailureRate the attempt fails: the first foreground runnable that
+// does not ignore its exit status exits non-zero, as does any foreground
+// runnable before it that does ignore it. A task without runnables fails as a
+// whole. Runnables run by an Executor report their real exit code instead.
+//
+// The attempt of a job on Spot VMs is also preempted with probability
+// plan.SpotPreemptionRate, at a random point of its RUNNING time. With a
+// jitter, the attempt runs up to that much longer, spread evenly over its
+// runnables.
+func (r *run) newAttempt(task *api.Task, number int32) *attempt {
+	group := TaskGroupName(task.Name)
+	a := &attempt{task: task, group: group, number: number, fail: -1, ignored: -1}
+
+	if r.spot && rand.Float64() < r.plan.SpotPreemptionRate {
+		running := r.stepDurations[group]
+		if foreground := countForeground(r.runnables[group]); foreground > 0 {
+			running *= time.Duration(foreground)
+		}
+		if running > 1 {
+			a.preemptAfter = time.Duration(rand.Int63n(int64(running)-1)) + 1
+		}
+	}
+
+	if r.jitter > 0 {
+		a.extra = time.Duration(rand.Int63n(int64(r.jitter)))
+		if foreground := countForeground(r.runnables[group]); foreground > 1 {
+			a.extra /= time.Duration(foreground)
+		}
+	}
+
+	if rand.Float64() >= r.plan.TaskFailureRate {
+		return a
+	}
+
+	runnables := r.runnables[group]
+	if len(runnables) == 0 {
+		a.fail = 0
+		return a
+	}
+	for i, runnable := range runnables {
+		if !isForeground(runnable) {
+			continue
+		}
+		if !runnable.IgnoreExitStatus {
+			a.fail = i
+			break
+		}
+		if a.ignored < 0 {
+			a.ignored = i
+		}
+	}
+	return a
+}
+
+// advance executes a's runnables in order starting at index from, at time at,
+// until one blocks: a foreground runnable is started or the attempt waits at
+// a barrier. Once an earlier runnable has failed, only alwaysRun runnables
+// execute. When no runnables remain the attempt finishes.
+func (r *run) advance(a *attempt, from int, at time.Time) {
+	runnables := r.runnables[a.group]
+	if from == 0 && r.maxRunDurations[a.group] > 0 {
+		a.deadline = at.Add(r.maxRunDurations[a.group])
+	}
+	if from == 0 && a.preemptAfter > 0 {
+		a.preemptAt = at.Add(a.preemptAfter)
+	}
+	if from == 0 {
+		if err := r.checkVolumes(a.group); err != nil {
+			r.failMount(a, err, at)
+			return
+		}
+	}
+	if len(runnables) == 0 && from == 0 {
+		r.log(a.task, 0, "Running attempt %d", a.number)
+		r.push(a, at)
+		return
+	}
+
+	for i := from; i < len(runnables); i++ {
+		runnable := runnables[i]
+		name := runnableName(runnable, i)
+
+		if a.failed && !runnable.AlwaysRun {
+			r.addTaskEvent(a.task, "runnable_skipped", fmt.Sprintf("%s skipped after an earlier runnable failed", name))
+			continue
+		}
+
+		switch {
+		case runnable.Barrier != nil:
+			a.step = i
+			r.addTaskEvent(a.task, "barrier_waiting", fmt.Sprintf("Waiting at barrier %s", runnable.Barrier.Name))
+			r.waiting[a.group] = append(r.waiting[a.group], a)
+			r.releaseBarrier(a.group, at)
+			return
+		case runnable.Background:
+			r.addTaskEvent(a.task, "runnable_started", fmt.Sprintf("%s started in the background", name))
+		default:
+			a.step = i
+			r.addTaskEvent(a.task, "runnable_started", fmt.Sprintf("%s started", name))
+			if runnable.Container != nil && r.executor != nil {
+				r.execute(a, runnable)
+			} else {
+				r.log(a.task, i, "%s", commandLine(runnable))
+				r.push(a, at)
+			}
+			return
+		}
+	}
+
+	r.finishAttempt(a, at)
+}
+
+// push queues the end of a's current foreground runnable, started at at.
+func (r *run) push(a *attempt, at time.Time) {
+	r.seq++
+	a.endAt, a.cause = r.stepEnd(a, at)
+	a.seq = r.seq
+	heap.Push(&r.attempts, a)
+}
+
+// stepEnd returns when a's current foreground runnable, started at at, ends
+// and why. It ends once it has run its share of the RUNNING time unless its
+// timeout or the attempt's maxRunDuration deadline comes first; a runnable
+// finishing right at a limit completes. When the timeout and the deadline
+// fall at the same time, the deadline wins. A preemption due before then
+// ends the runnable first.
+func (r *run) stepEnd(a *attempt, at time.Time) (time.Time, stopCause) {
+	end, cause := at.Add(r.stepDurations[a.group]+a.extra), stopNone
+	if timeout := r.runnableTimeout(a); timeout > 0 && at.Add(timeout).Before(end) {
+		end, cause = at.Add(timeout), stopTimeout
+	}
+	if !a.deadline.IsZero() && (a.deadline.Before(end) || cause == stopTimeout && a.deadline.Equal(end)) {
+		end, cause = a.deadline, stopMaxRunDuration
+	}
+	if !a.preemptAt.IsZero() && a.preemptAt.Before(end) {
+		end, cause = a.preemptAt, stopPreempted
+	}
+	return end, cause
+}
+
+// runnableTimeout returns the timeout of a's current runnable, or 0 if it
+// has none.
+func (r *run) runnableTimeout(a *attempt) time.Duration {
+	runnables := r.runnables[a.group]
+	if a.step >= len(runnables) {
+		return 0
+	}
+	return limit(runnables[a.step].Timeout)
+}
+
+// endStep ends a's current simulated runnable, which fails if newAttempt
+// chose it to or it ran out of time.
+func (r *run) endStep(a *attempt, at time.Time) {
+	switch a.cause {
+	case stopMaxRunDuration:
+		r.exceedMaxRunDuration(a, at)
+		return
+	case stopPreempted:
+		r.preempt(a, at)
+		return
+	case stopTimeout:
+		r.log(a.task, a.step, "Killed after reaching its timeout of %s", r.runnableTimeout(a))
+		r.finishStep(a, timeoutExitCode, nil, at)
+		return
+	}
+
+	exitCode := 0
+	if a.step == a.fail || a.step == a.ignored {
+		exitCode = simulatedExitCode
+	}
+	r.log(a.task, a.step, "Exited with code %d", exitCode)
+	r.finishStep(a, exitCode, nil, at)
+}
+
+// exceedMaxRunDuration kills a's current runnable once the attempt has run
+// for its task's maxRunDuration and fails the attempt with exit code 50005.
+// The remaining runnables, alwaysRun ones included, do not run. The attempt
+// is retried like any other failed one.
+func (r *run) exceedMaxRunDuration(a *attempt, at time.Time) {
+	maxRunDuration := r.maxRunDurations[a.group]
+	if runnables := r.runnables[a.group]; a.step < len(runnables) {
+		r.log(a.task, a.step, "Killed after the task reached its maxRunDuration of %s", maxRunDuration)
+		r.addTaskEvent(a.task, "runnable_failed", fmt.Sprintf("%s killed: task exceeded its maxRunDuration of %s", runnableName(runnables[a.step], a.step), maxRunDuration))
+	}
+	a.failed = true
+	a.exitCode = maxRunDurationExitCode
+	a.reason = fmt.Sprintf("task exceeded its maxRunDuration of %s", maxRunDuration)
+	r.finishAttempt(a, at)
+}
+
+// preempt fails a once its Spot VM has been preempted, with the event and
+// exit code 50001 production reports. Like a task that exceeded its
+// maxRunDuration, its remaining runnables do not run and it is retried like
+// any other failed attempt.
+func (r *run) preempt(a *attempt, at time.Time) {
+	if runnables := r.runnables[a.group]; a.step < len(runnables) {
+		r.log(a.task, a.step, "Killed by the preemption of its Spot VM")
+		r.addTaskEvent(a.task, "runnable_failed", fmt.Sprintf("%s killed: the Spot VM was preempted", runnableName(runnables[a.step], a.step)))
+	}
+	instance := TaskInstance(r.job, a.task.Name)
+	r.recordTaskEvent(a.task, r.exitEvent("vm_preempted", fmt.Sprintf("Task state is updated from RUNNING to FAILED on zones/%s/instances/%s due to Spot VM preemption with exit code %d.", instance.Zone, instance.Name, preemptionExitCode), preemptionExitCode))
+	a.failed = true
+	a.exitCode = preemptionExitCode
+	a.reason = "the Spot VM was preempted"
+	r.finishAttempt(a, at)
+}
+
+// finishStep records the outcome of a's current foreground runnable and moves
+// on to the next one. A non-zero exit code or an error fails the attempt
+// unless the runnable ignores its exit status.
+func (r *run) finishStep(a *attempt, exitCode int, err error, at time.Time) {
+	runnables := r.runnables[a.group]
+	if len(runnables) == 0 {
+		// A task without runnables succeeds or fails as a whole.
+		if exitCode != 0 {
+			a.failed = true
+			a.exitCode = exitCode
+		}
+		r.advance(a, a.step+1, at)
+		return
+	}
+
+	runnable := runnables[a.step]
+	name := runnableName(runnable, a.step)
+	failure := fmt.Sprintf("failed with exit code %d", exitCode)
+	if a.cause == stopTimeout {
+		failure = fmt.Sprintf("timed out after %s and was killed with exit code %d", limit(runnable.Timeout), exitCode)
+	}
+	switch {
+	case err != nil:
+		a.failed = true
+		a.exitCode = -1
+		r.addTaskEvent(a.task, "runnable_failed", fmt.Sprintf("%s could not be run: %v", name, err))
+	case exitCode == 0:
+		r.addTaskEvent(a.task, "runnable_completed", fmt.Sprintf("%s completed", name))
+	case runnable.IgnoreExitStatus:
+		r.addTaskEvent(a.task, "runnable_failed", fmt.Sprintf("%s %s; exit status ignored", name, failure))
+	default:
+		a.failed = true
+		a.exitCode = exitCode
+		r.addTaskEvent(a.task, "runnable_failed", fmt.Sprintf("%s %s", name, failure))
+	}
+
+	r.advance(a, a.step+1, at)
+}
+
+// releaseBarrier lets the attempts of group waiting at a barrier continue
+// once every active attempt of the group has reached one. Tasks still
+// PENDING for a slot are not waited for.
+func (r *run) releaseBarrier(group string, at time.Time) {
+	waiting := r.waiting[group]
+	if len(waiting) == 0 || len(waiting) < r.active[group] {
+		return
+	}
+
+	r.waiting[group] = nil
+	for _, a := range waiting {
+		barrier := r.runnables[group][a.step].Barrier
+		r.addTaskEvent(a.task, "barrier_released", fmt.Sprintf("Barrier %s released", barrier.Name))
+		r.advance(a, a.step+1, at)
+	}
+}
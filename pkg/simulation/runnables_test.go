@@ -0,0 +1,385 @@
+package simulation
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+	"github.com/pyshx/fake-batch-server/pkg/logs"
+)
+
+// runToCompletion simulates a job with a single task group to its end and
+// returns its sorted tasks.
+func runToCompletion(t *testing.T, taskGroup *api.TaskGroup, plan *Plan, state api.JobState) (*api.Job, []*api.Task) {
+	engine, store, fake := setupFakeEngine()
+	job := newTestJob(t, store, fake.Now(), taskGroup)
+
+	engine.Start(job, plan)
+	fake.Advance(time.Minute)
+	waitForJobState(t, store, job.Name, state)
+
+	tasks, err := store.ListTasks(job.Name)
+	require.NoError(t, err)
+	sortTasks(tasks)
+	return job, tasks
+}
+
+// runnableEvents returns the descriptions of task's runnable and barrier
+// events, prefixed with their offset from start.
+func runnableEvents(task *api.Task, start time.Time) []string {
+	var events []string
+	for _, event := range task.Status.StatusEvents {
+		switch event.Type {
+		case "runnable_started", "runnable_completed", "runnable_failed", "runnable_skipped", "barrier_waiting", "barrier_released":
+			events = append(events, event.EventTime.Sub(start).String()+" "+event.Description)
+		}
+	}
+	return events
+}
+
+func TestRunnables_SequentialAndBackground(t *testing.T) {
+	job, tasks := runToCompletion(t, &api.TaskGroup{
+		Name:      "group1",
+		TaskCount: 1,
+		TaskSpec: &api.TaskSpec{Runnables: []*api.Runnable{
+			{DisplayName: "setup"},
+			{DisplayName: "sidecar", Background: true},
+			{DisplayName: "main"},
+		}},
+	}, &Plan{}, api.JobStateSucceeded)
+
+	assert.Equal(t, []string{
+		"0s Runnable 0 (setup) started",
+		"2.5s Runnable 0 (setup) completed",
+		"2.5s Runnable 1 (sidecar) started in the background",
+		"2.5s Runnable 2 (main) started",
+		"5s Runnable 2 (main) completed",
+	}, runnableEvents(tasks[0], job.CreateTime.Add(2*time.Second)))
+	assert.Equal(t, api.TaskStateSucceeded, tasks[0].Status.State)
+}
+
+func TestRunnables_FailureHandling(t *testing.T) {
+	job, tasks := runToCompletion(t, &api.TaskGroup{
+		Name:      "group1",
+		TaskCount: 1,
+		TaskSpec: &api.TaskSpec{Runnables: []*api.Runnable{
+			{IgnoreExitStatus: true},
+			{},
+			{},
+			{AlwaysRun: true},
+		}},
+	}, &Plan{TaskFailureRate: 1}, api.JobStateFailed)
+
+	start := job.CreateTime.Add(2 * time.Second)
+	assert.Equal(t, []string{
+		"0s Runnable 0 started",
+		"1.25s Runnable 0 failed with exit code 1; exit status ignored",
+		"1.25s Runnable 1 started",
+		"2.5s Runnable 1 failed with exit code 1",
+		"2.5s Runnable 2 skipped after an earlier runnable failed",
+		"2.5s Runnable 3 started",
+		"3.75s Runnable 3 completed",
+	}, runnableEvents(tasks[0], start))
+	assert.Equal(t, api.TaskStateFailed, tasks[0].Status.State)
+}
+
+func TestRunnables_Timeout(t *testing.T) {
+	job, tasks := runToCompletion(t, &api.TaskGroup{
+		Name:      "group1",
+		TaskCount: 1,
+		TaskSpec: &api.TaskSpec{Runnables: []*api.Runnable{
+			{Timeout: "1s", IgnoreExitStatus: true},
+			{Timeout: "1s"},
+			{},
+			{AlwaysRun: true, Timeout: "10s"},
+		}},
+	}, &Plan{}, api.JobStateFailed)
+
+	start := job.CreateTime.Add(2 * time.Second)
+	assert.Equal(t, []string{
+		"0s Runnable 0 started",
+		"1s Runnable 0 timed out after 1s and was killed with exit code 124; exit status ignored",
+		"1s Runnable 1 started",
+		"2s Runnable 1 timed out after 1s and was killed with exit code 124",
+		"2s Runnable 2 skipped after an earlier runnable failed",
+		"2s Runnable 3 started",
+		"3.25s Runnable 3 completed",
+	}, runnableEvents(tasks[0], start))
+	assert.Equal(t, api.TaskStateFailed, tasks[0].Status.State)
+}
+
+func TestRunnables_ExitCodes(t *testing.T) {
+	engine, store, fake := setupFakeEngine()
+	job := newTestJob(t, store, fake.Now(), &api.TaskGroup{
+		Name:      "group1",
+		TaskCount: 2,
+		TaskSpec: &api.TaskSpec{
+			MaxRetryCount: 1,
+			Runnables:     []*api.Runnable{{Timeout: "1s"}},
+		},
+	})
+
+	engine.Start(job, &Plan{TaskFailureRate: 1})
+	fake.Advance(time.Minute)
+	waitForJobState(t, store, job.Name, api.JobStateFailed)
+
+	tasks, err := store.ListTasks(job.Name)
+	require.NoError(t, err)
+	for _, task := range tasks {
+		var exitCodes []int32
+		for _, event := range task.Status.StatusEvents {
+			if event.TaskExecution != nil {
+				exitCodes = append(exitCodes, event.TaskExecution.ExitCode)
+			}
+		}
+		assert.Equal(t, []int32{124, 124}, exitCodes, task.Name)
+		exitCode, ok := task.Status.ExitCode()
+		assert.True(t, ok)
+		assert.Equal(t, int32(124), exitCode)
+	}
+
+	stored, err := store.GetJob(job.Name)
+	require.NoError(t, err)
+	last := stored.Status.StatusEvents[len(stored.Status.StatusEvents)-1]
+	assert.Equal(t, "Job failed: 2 task(s) failed", last.Description)
+	require.NotNil(t, last.TaskExecution)
+	assert.Equal(t, int32(124), last.TaskExecution.ExitCode)
+
+	_, tasks = runToCompletion(t, &api.TaskGroup{Name: "group1", TaskCount: 1}, &Plan{}, api.JobStateSucceeded)
+	exitCode, ok := tasks[0].Status.ExitCode()
+	assert.True(t, ok)
+	assert.Equal(t, int32(0), exitCode)
+}
+
+func TestRunnables_MaxRunDuration(t *testing.T) {
+	job, tasks := runToCompletion(t, &api.TaskGroup{
+		Name:      "group1",
+		TaskCount: 1,
+		TaskSpec: &api.TaskSpec{
+			MaxRunDuration: "3s",
+			MaxRetryCount:  1,
+			Runnables: []*api.Runnable{
+				{},
+				{Timeout: "0.5s"},
+				{AlwaysRun: true},
+			},
+		},
+	}, &Plan{}, api.JobStateFailed)
+
+	start := job.CreateTime.Add(2 * time.Second)
+	task := tasks[0]
+	assert.Equal(t, []string{
+		"0s Runnable 0 started",
+		"1.666666666s Runnable 0 completed",
+		"1.666666666s Runnable 1 started",
+		"2.166666666s Runnable 1 timed out after 500ms and was killed with exit code 124",
+		"2.166666666s Runnable 2 started",
+		"3s Runnable 2 killed: task exceeded its maxRunDuration of 3s",
+		// Every attempt gets the full maxRunDuration.
+		"3s Runnable 0 started",
+		"4.666666666s Runnable 0 completed",
+		"4.666666666s Runnable 1 started",
+		"5.166666666s Runnable 1 timed out after 500ms and was killed with exit code 124",
+		"5.166666666s Runnable 2 started",
+		"6s Runnable 2 killed: task exceeded its maxRunDuration of 3s",
+	}, runnableEvents(task, start))
+	assert.Equal(t, api.TaskStateFailed, task.Status.State)
+	last := task.Status.StatusEvents[len(task.Status.StatusEvents)-1]
+	assert.Equal(t, "Task failed with exit code 50005 on attempt 2: task exceeded its maxRunDuration of 3s", last.Description)
+}
+
+func TestRunnables_SpotPreemption(t *testing.T) {
+	engine, store, fake := setupFakeEngine()
+	job := newTestJob(t, store, fake.Now(), &api.TaskGroup{
+		Name:      "group1",
+		TaskCount: 1,
+		TaskSpec: &api.TaskSpec{
+			MaxRetryCount: 1,
+			Runnables:     []*api.Runnable{{}},
+		},
+	})
+	job.AllocationPolicy = &api.AllocationPolicy{Instances: []*api.InstancePolicyOrTemplate{{Policy: &api.InstancePolicy{ProvisioningModel: "SPOT"}}}}
+	require.NoError(t, store.UpdateJob(job))
+
+	engine.Start(job, &Plan{SpotPreemptionRate: 1})
+	fake.Advance(time.Minute)
+	waitForJobState(t, store, job.Name, api.JobStateFailed)
+
+	tasks, err := store.ListTasks(job.Name)
+	require.NoError(t, err)
+	var preemptions, retries int
+	var killed []string
+	for _, event := range tasks[0].Status.StatusEvents {
+		switch event.Type {
+		case "vm_preempted":
+			preemptions++
+			assert.Equal(t, "Task state is updated from RUNNING to FAILED on zones/l-a/instances/job-0--group1-0 due to Spot VM preemption with exit code 50001.", event.Description)
+		case "task_retried":
+			retries++
+		case "runnable_failed":
+			killed = append(killed, event.Description)
+		}
+	}
+	// Every attempt is preempted before its runnable completes.
+	assert.Equal(t, 2, preemptions)
+	assert.Equal(t, 1, retries)
+	assert.Equal(t, []string{"Runnable 0 killed: the Spot VM was preempted", "Runnable 0 killed: the Spot VM was preempted"}, killed)
+	assert.Equal(t, api.TaskStateFailed, tasks[0].Status.State)
+	last := tasks[0].Status.StatusEvents[len(tasks[0].Status.StatusEvents)-1]
+	assert.Equal(t, "Task failed with exit code 50001 on attempt 2: the Spot VM was preempted", last.Description)
+
+	// Jobs on standard VMs are never preempted.
+	_, tasks = runToCompletion(t, &api.TaskGroup{Name: "group1", TaskCount: 2}, &Plan{SpotPreemptionRate: 1}, api.JobStateSucceeded)
+	for _, task := range tasks {
+		assert.Equal(t, api.TaskStateSucceeded, task.Status.State)
+	}
+}
+
+func TestRunnables_MaxRunDurationBeatsTimeout(t *testing.T) {
+	job, tasks := runToCompletion(t, &api.TaskGroup{
+		Name:      "group1",
+		TaskCount: 1,
+		TaskSpec: &api.TaskSpec{
+			MaxRunDuration: "2s",
+			Runnables:      []*api.Runnable{{Timeout: "2s"}},
+		},
+	}, &Plan{}, api.JobStateFailed)
+
+	assert.Equal(t, []string{
+		"0s Runnable 0 started",
+		"2s Runnable 0 killed: task exceeded its maxRunDuration of 2s",
+	}, runnableEvents(tasks[0], job.CreateTime.Add(2*time.Second)))
+}
+
+func TestParseDuration(t *testing.T) {
+	d, err := ParseDuration("3600s")
+	require.NoError(t, err)
+	assert.Equal(t, time.Hour, d)
+	d, err = ParseDuration("0.5s")
+	require.NoError(t, err)
+	assert.Equal(t, 500*time.Millisecond, d)
+
+	for _, value := range []string{"", "1h", "-1s", "s"} {
+		_, err := ParseDuration(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestRunnables_Barrier(t *testing.T) {
+	job, tasks := runToCompletion(t, &api.TaskGroup{
+		Name:      "group1",
+		TaskCount: 2,
+		TaskSpec: &api.TaskSpec{Runnables: []*api.Runnable{
+			{},
+			{Barrier: &api.Barrier{Name: "sync"}},
+			{},
+		}},
+	}, &Plan{}, api.JobStateSucceeded)
+
+	start := job.CreateTime.Add(2 * time.Second)
+	for _, task := range tasks {
+		assert.Equal(t, []string{
+			"0s Runnable 0 started",
+			"2.5s Runnable 0 completed",
+			"2.5s Waiting at barrier sync",
+			"2.5s Barrier sync released",
+			"2.5s Runnable 2 started",
+			"5s Runnable 2 completed",
+		}, runnableEvents(task, start), task.Name)
+	}
+}
+
+func TestRunnables_BarrierWaitsForSlowerTask(t *testing.T) {
+	// The first task fails its first runnable and retries it, so the second
+	// task waits at the barrier until the retry catches up.
+	engine, store, fake := setupFakeEngine()
+	job := newTestJob(t, store, fake.Now(), &api.TaskGroup{
+		Name:      "group1",
+		TaskCount: 2,
+		TaskSpec: &api.TaskSpec{
+			MaxRetryCount: 1,
+			Runnables: []*api.Runnable{
+				{},
+				{Barrier: &api.Barrier{Name: "sync"}},
+			},
+		},
+	})
+	tasks, _ := store.ListTasks(job.Name)
+	sortTasks(tasks)
+
+	r := &run{
+		Engine:        engine,
+		ctx:           engine.ctx,
+		job:           job,
+		store:         store,
+		plan:          &Plan{},
+		tasks:         tasks,
+		maxRetries:    map[string]int32{"group1": 1},
+		runnables:     map[string][]*api.Runnable{"group1": job.TaskGroups[0].TaskSpec.Runnables},
+		stepDurations: map[string]time.Duration{"group1": 5 * time.Second},
+		active:        map[string]int{"group1": 2},
+		waiting:       make(map[string][]*attempt),
+	}
+	start := fake.Now()
+	r.now = start
+	for _, task := range tasks {
+		task.Status.State = api.TaskStateRunning
+	}
+
+	failing := &attempt{task: tasks[0], group: "group1", number: 1, fail: 0, ignored: -1}
+	r.advance(failing, 0, start)
+	r.advance(&attempt{task: tasks[1], group: "group1", number: 1, fail: -1, ignored: -1}, 0, start)
+
+	// Both first runnables end; the failed one is retried and the other
+	// task waits at the barrier.
+	for r.attempts.Len() > 0 {
+		a := heap.Pop(&r.attempts).(*attempt)
+		r.now = a.endAt
+		r.endStep(a, a.endAt)
+	}
+
+	assert.Contains(t, runnableEvents(tasks[1], start), "5s Waiting at barrier sync")
+	assert.Contains(t, runnableEvents(tasks[1], start), "10s Barrier sync released")
+	assert.Equal(t, api.TaskStateSucceeded, tasks[1].Status.State)
+	assert.Equal(t, api.TaskStateSucceeded, tasks[0].Status.State)
+}
+
+func TestRunnables_Logs(t *testing.T) {
+	engine, store, fake := setupFakeEngine()
+	taskLogs := logs.NewStore()
+	engine.SetLogs(taskLogs)
+
+	job := newTestJob(t, store, fake.Now(), &api.TaskGroup{
+		Name:      "group1",
+		TaskCount: 1,
+		TaskSpec: &api.TaskSpec{Runnables: []*api.Runnable{
+			{Container: &api.Container{ImageURI: "busybox", Entrypoint: "/bin/sh", Commands: []string{"-c", "true"}}},
+			{Script: &api.Script{Text: "echo hello\necho world"}},
+		}},
+	})
+	engine.Start(job, &Plan{})
+	fake.Advance(time.Minute)
+	waitForJobState(t, store, job.Name, api.JobStateSucceeded)
+
+	tasks, _ := store.ListTasks(job.Name)
+	start := job.CreateTime.Add(2 * time.Second)
+	var output []string
+	for _, entry := range taskLogs.Entries(tasks[0].Name) {
+		output = append(output, fmt.Sprintf("%s %d %s", entry.Time.Sub(start), entry.Runnable, entry.Text))
+	}
+	assert.Equal(t, []string{
+		"0s 0 Running busybox /bin/sh -c true",
+		"2.5s 0 Exited with code 0",
+		"2.5s 1 Running script: echo hello",
+		"5s 1 Exited with code 0",
+	}, output)
+
+	// The log is complete once the task has finished.
+	assert.NoError(t, taskLogs.Follow(context.Background(), tasks[0].Name, func(logs.Entry) error { return nil }))
+}
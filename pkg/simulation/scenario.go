@@ -0,0 +1,326 @@
+package simulation
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+	"github.com/pyshx/fake-batch-server/pkg/storage"
+)
+
+// Scenario scripts the lifecycle of the jobs it matches, e.g. to replay the
+// timeline of a production incident: the job goes through the states of its
+// steps, spending the step's duration in each, instead of being simulated.
+// Timings, failure rates and final states requested for the job are ignored,
+// and its runnables are neither stepped through nor executed.
+type Scenario struct {
+	Name  string        `yaml:"name"`
+	Match ScenarioMatch `yaml:"match"`
+	// Steps are the states the job goes through, from QUEUED to SUCCEEDED or
+	// FAILED. A first QUEUED step sets how long the job stays queued; without
+	// one it leaves QUEUED as soon as it is created.
+	Steps []ScenarioStep `yaml:"steps"`
+}
+
+// ScenarioMatch selects the jobs of a scenario. An empty match selects every
+// job.
+type ScenarioMatch struct {
+	// Labels must all be set on the job with these values.
+	Labels map[string]string `yaml:"labels"`
+	// JobID, if set, is a glob the job ID must match, e.g. "etl-*".
+	JobID string `yaml:"jobId"`
+}
+
+// ScenarioStep is a state of a scripted job.
+type ScenarioStep struct {
+	State api.JobState `yaml:"state"`
+	// Duration is how long the job stays in the state. It is ignored for
+	// the final state.
+	Duration time.Duration `yaml:"duration"`
+	// Description, if set, replaces that of the status event recorded when
+	// the job enters the state.
+	Description string `yaml:"description"`
+	// Events are further status events recorded while the job is in the
+	// state.
+	Events []ScenarioEvent `yaml:"events"`
+	// FailedTasks is how many of the running tasks, from the first, fail
+	// when the job reaches the final state; the others succeed. A job
+	// FAILED after RUNNING fails all of them if it is 0. The tasks of a job
+	// that never ran stay PENDING.
+	FailedTasks int64 `yaml:"failedTasks"`
+}
+
+// ScenarioEvent is a status event a step records.
+type ScenarioEvent struct {
+	// After is how long after the job entered the step the event is
+	// recorded.
+	After       time.Duration `yaml:"after"`
+	Type        string        `yaml:"type"`
+	Description string        `yaml:"description"`
+}
+
+// Scenarios is an ordered list of scenarios. A job follows the first one it
+// matches.
+type Scenarios struct {
+	Scenarios []*Scenario `yaml:"scenarios"`
+}
+
+// LoadScenarios reads scenarios from a YAML or JSON file, e.g.:
+//
+//	scenarios:
+//	  - name: stuck-in-scheduling
+//	    match:
+//	      labels:
+//	        incident: inc-1234
+//	    steps:
+//	      - state: QUEUED
+//	        duration: 30s
+//	      - state: SCHEDULED
+//	        duration: 10m
+//	        events:
+//	          - after: 5m
+//	            type: job_delayed
+//	            description: "Resources are not available in zone us-central1-a"
+//	      - state: FAILED
+//	        description: "Job failed: no VMs could be provisioned"
+//	  - name: flaky-etl
+//	    match:
+//	      jobId: "etl-*"
+//	    steps:
+//	      - state: SCHEDULED
+//	        duration: 1m
+//	      - state: RUNNING
+//	        duration: 20m
+//	      - state: FAILED
+//	        failedTasks: 2
+func LoadScenarios(path string) (*Scenarios, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var scenarios Scenarios
+	if err := yaml.Unmarshal(data, &scenarios); err != nil {
+		return nil, fmt.Errorf("failed to parse scenarios config %s: %v", path, err)
+	}
+	if err := scenarios.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid scenarios config %s: %v", path, err)
+	}
+	return &scenarios, nil
+}
+
+// Validate checks that the steps of every scenario are valid transitions
+// from QUEUED to a final state, with sensible durations and events.
+func (s *Scenarios) Validate() error {
+	for i, scenario := range s.Scenarios {
+		name := scenario.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+		if _, err := path.Match(scenario.Match.JobID, ""); err != nil {
+			return fmt.Errorf("scenario %s: invalid jobId pattern %q", name, scenario.Match.JobID)
+		}
+		if len(scenario.Steps) == 0 {
+			return fmt.Errorf("scenario %s: no steps", name)
+		}
+
+		state := api.JobStateQueued
+		for j, step := range scenario.Steps {
+			if !(j == 0 && step.State == api.JobStateQueued) && !CanTransitionJob(state, step.State) {
+				return fmt.Errorf("scenario %s: a job cannot go from %s to %s", name, state, step.State)
+			}
+			if step.Duration < 0 {
+				return fmt.Errorf("scenario %s: negative duration %s for state %s", name, step.Duration, step.State)
+			}
+			if final(step.State) != (j == len(scenario.Steps)-1) {
+				return fmt.Errorf("scenario %s: must end with its only SUCCEEDED or FAILED step", name)
+			}
+			if final(step.State) && len(step.Events) > 0 {
+				return fmt.Errorf("scenario %s: the final state cannot have events", name)
+			}
+			if step.FailedTasks < 0 || (step.FailedTasks > 0 && step.State != api.JobStateFailed) {
+				return fmt.Errorf("scenario %s: failedTasks must be positive and only set for FAILED", name)
+			}
+			for _, event := range step.Events {
+				if event.After < 0 || event.After >= step.Duration {
+					return fmt.Errorf("scenario %s: event %q of state %s must come within the %s spent in it", name, event.Type, step.State, step.Duration)
+				}
+			}
+			state = step.State
+		}
+	}
+	return nil
+}
+
+// For returns the first scenario job matches, or nil if none does.
+func (s *Scenarios) For(job *api.Job) *Scenario {
+	if s == nil {
+		return nil
+	}
+	for _, scenario := range s.Scenarios {
+		if scenario.Match.matches(job) {
+			return scenario
+		}
+	}
+	return nil
+}
+
+// matches reports whether job is selected by m.
+func (m ScenarioMatch) matches(job *api.Job) bool {
+	for key, value := range m.Labels {
+		if actual, ok := job.Labels[key]; !ok || actual != value {
+			return false
+		}
+	}
+	if m.JobID != "" {
+		if ok, _ := path.Match(m.JobID, path.Base(job.Name)); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// final reports whether a scripted job ends in state.
+func final(state api.JobState) bool {
+	return state == api.JobStateSucceeded || state == api.JobStateFailed
+}
+
+// script drives the run through the steps of its plan's scenario. A resumed
+// run picks the script up at the step of the job's stored state, which it
+// spends its whole duration in again.
+func (r *run) script() {
+	if r.resumeAt.IsZero() {
+		r.enterStep(0, r.job.CreateTime)
+		return
+	}
+	for i, step := range r.plan.Scenario.Steps {
+		if step.State == r.job.State {
+			r.enterStep(i, r.resumeAt)
+			return
+		}
+	}
+	// A job without a QUEUED step leaves QUEUED right away.
+	if r.job.State == api.JobStateQueued {
+		r.enterStep(0, r.resumeAt)
+		return
+	}
+	r.end()
+}
+
+// enterStep moves the job to the state of step i at the given time, and
+// times its events and the next step.
+func (r *run) enterStep(i int, at time.Time) {
+	step := r.plan.Scenario.Steps[i]
+	r.now = at
+	if r.job.State != step.State {
+		eventType, description := r.scriptTasks(step)
+		if step.Description != "" {
+			description = step.Description
+		}
+		event := &api.StatusEvent{Type: eventType, Description: description}
+		if step.State == api.JobStateFailed {
+			event = r.jobFailedEvent(description)
+		}
+		if !r.setJobStateWith(step.State, event) {
+			r.end()
+			return
+		}
+	}
+	if final(step.State) {
+		r.completed()
+		r.end()
+		return
+	}
+
+	for _, event := range step.Events {
+		event, eventAt := event, at.Add(event.After)
+		r.post(eventAt, func() {
+			r.now = eventAt
+			r.job.UpdateTime = eventAt
+			r.job.Status.StatusEvents = append(r.job.Status.StatusEvents, &api.StatusEvent{
+				Type:        event.Type,
+				Description: event.Description,
+				EventTime:   eventAt,
+			})
+			if !r.save() {
+				r.end()
+			}
+		})
+	}
+	next := at.Add(step.Duration)
+	r.after(next, func() { r.enterStep(i+1, next) })
+}
+
+// scriptTasks moves the tasks of the job along with it as it enters step,
+// and returns the type and description of the job's status event: they
+// start running when the job does, and finish when it does.
+func (r *run) scriptTasks(step ScenarioStep) (string, string) {
+	switch step.State {
+	case api.JobStateScheduled:
+		return "job_scheduled", "Job scheduled; VMs are being provisioned"
+	case api.JobStateRunning:
+		for _, task := range r.tasks {
+			if task.Status.State == api.TaskStatePending {
+				r.setTaskState(task, api.TaskStateAssigned, "task_assigned", r.assignedDescription(task))
+			}
+			if task.Status.State == api.TaskStateAssigned {
+				r.setTaskState(task, api.TaskStateRunning, "task_started", "Task started running")
+			}
+		}
+		for _, g := range r.lazy {
+			p := g.progress
+			p.Assigned, p.Started = g.total, g.total
+			p.Epochs = append(p.Epochs, storage.TaskEpoch{
+				From:         p.Finished,
+				ScheduledAt:  r.now,
+				RunningAt:    r.now,
+				WaveSize:     g.total - p.Finished,
+				WaveDuration: step.Duration,
+			})
+			r.saveProgress(g)
+		}
+		return "job_started", "Job started running"
+	}
+
+	fail := step.FailedTasks
+	if fail == 0 && step.State == api.JobStateFailed {
+		fail = -1
+	}
+	failed := int64(0)
+	for _, task := range r.tasks {
+		if task.Status.State != api.TaskStateRunning {
+			continue
+		}
+		if fail < 0 || failed < fail {
+			r.setTaskStateWith(task, api.TaskStateFailed, r.exitEvent("task_failed", fmt.Sprintf("Task failed with exit code %d on attempt 1", simulatedExitCode), simulatedExitCode))
+			failed++
+		} else {
+			r.setTaskStateWith(task, api.TaskStateSucceeded, r.exitEvent("task_completed", "Task completed successfully", 0))
+		}
+	}
+	for _, g := range r.lazy {
+		p := g.progress
+		for index := p.Finished; index < p.Started; index++ {
+			if fail >= 0 && failed >= fail {
+				break
+			}
+			r.failLazyTask(g, index)
+			p.Failed++
+			failed++
+		}
+		p.Finished = p.Started
+		r.saveProgress(g)
+	}
+
+	if step.State == api.JobStateSucceeded {
+		return "job_completed", "Job completed successfully"
+	}
+	if failed == 0 {
+		return "job_failed", "Job failed"
+	}
+	return "job_failed", fmt.Sprintf("Job failed: %d task(s) failed", failed)
+}
@@ -0,0 +1,147 @@
+package simulation
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+)
+
+func TestLoadScenarios(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "scenarios.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+scenarios:
+  - name: incident
+    match:
+      labels:
+        incident: inc-1
+      jobId: "etl-*"
+    steps:
+      - state: SCHEDULED
+        duration: 10m
+        events:
+          - after: 5m
+            type: job_delayed
+            description: Waiting for resources
+      - state: FAILED
+  - name: everything-else
+    steps:
+      - state: SCHEDULED
+      - state: RUNNING
+        duration: 1s
+      - state: SUCCEEDED
+`), 0o644))
+
+	scenarios, err := LoadScenarios(path)
+	require.NoError(t, err)
+	require.Len(t, scenarios.Scenarios, 2)
+	assert.Equal(t, 10*time.Minute, scenarios.Scenarios[0].Steps[0].Duration)
+
+	job := &api.Job{Name: "projects/p/locations/l/jobs/etl-1", Labels: map[string]string{"incident": "inc-1"}}
+	assert.Equal(t, "incident", scenarios.For(job).Name)
+	job.Name = "projects/p/locations/l/jobs/web-1"
+	assert.Equal(t, "everything-else", scenarios.For(job).Name)
+
+	var none *Scenarios
+	assert.Nil(t, none.For(job))
+}
+
+func TestScenarios_Validate(t *testing.T) {
+	for name, steps := range map[string][]ScenarioStep{
+		"no steps":           nil,
+		"skipped state":      {{State: api.JobStateRunning}, {State: api.JobStateSucceeded}},
+		"no final state":     {{State: api.JobStateScheduled}},
+		"steps after final":  {{State: api.JobStateFailed}, {State: api.JobStateSucceeded}},
+		"negative duration":  {{State: api.JobStateScheduled, Duration: -time.Second}, {State: api.JobStateFailed}},
+		"late event":         {{State: api.JobStateScheduled, Duration: time.Second, Events: []ScenarioEvent{{After: time.Second}}}, {State: api.JobStateFailed}},
+		"failed tasks on ok": {{State: api.JobStateSucceeded, FailedTasks: 1}},
+	} {
+		scenarios := &Scenarios{Scenarios: []*Scenario{{Name: name, Steps: steps}}}
+		assert.Error(t, scenarios.Validate(), name)
+	}
+}
+
+func TestEngine_Scenario(t *testing.T) {
+	engine, store, fake := setupFakeEngine()
+	start := fake.Now()
+	job := newTestJob(t, store, start, &api.TaskGroup{Name: "group1", TaskCount: 2})
+
+	completed := make(chan *api.Job, 1)
+	engine.OnComplete(func(_ context.Context, job *api.Job) { completed <- job })
+	engine.Start(job, &Plan{Scenario: &Scenario{Steps: []ScenarioStep{
+		{State: api.JobStateQueued, Duration: time.Minute},
+		{State: api.JobStateScheduled, Duration: 10 * time.Minute, Events: []ScenarioEvent{
+			{After: 5 * time.Minute, Type: "job_delayed", Description: "Waiting for resources"},
+		}},
+		{State: api.JobStateFailed, Description: "No VMs could be provisioned"},
+	}}})
+
+	// The job stays in SCHEDULED for ten minutes, well past the default
+	// timings.
+	fake.Advance(time.Minute)
+	waitForJobState(t, store, job.Name, api.JobStateScheduled)
+	fake.Advance(9 * time.Minute)
+	stored, err := store.GetJob(job.Name)
+	require.NoError(t, err)
+	assert.Equal(t, api.JobStateScheduled, stored.State)
+	fake.Advance(10 * time.Minute)
+	waitForJobState(t, store, job.Name, api.JobStateFailed)
+	require.Eventually(t, func() bool { return !engine.Running(job.Name) }, time.Second, time.Millisecond)
+
+	stored, err = store.GetJob(job.Name)
+	require.NoError(t, err)
+	var events []string
+	for _, event := range stored.Status.StatusEvents {
+		events = append(events, event.Type+" "+event.EventTime.Sub(start).String()+" "+event.Description)
+	}
+	assert.Equal(t, []string{
+		"job_scheduled 1m0s Job scheduled; VMs are being provisioned",
+		"job_delayed 6m0s Waiting for resources",
+		"job_failed 11m0s No VMs could be provisioned",
+	}, events)
+	assert.Equal(t, api.JobStateFailed, (<-completed).State)
+	assert.Empty(t, stored.Status.RunDuration, "the job never ran")
+
+	// The tasks never ran.
+	tasks, err := store.ListTasks(job.Name)
+	require.NoError(t, err)
+	for _, task := range tasks {
+		assert.Equal(t, api.TaskStatePending, task.Status.State)
+	}
+}
+
+func TestEngine_ScenarioFailedTasks(t *testing.T) {
+	engine, store, fake := setupFakeEngine()
+	job := newTestJob(t, store, fake.Now(), &api.TaskGroup{Name: "group1", TaskCount: 3})
+
+	engine.Start(job, &Plan{Scenario: &Scenario{Steps: []ScenarioStep{
+		{State: api.JobStateScheduled, Duration: time.Minute},
+		{State: api.JobStateRunning, Duration: time.Hour},
+		{State: api.JobStateFailed, FailedTasks: 1},
+	}}})
+
+	fake.Advance(time.Minute)
+	waitForJobState(t, store, job.Name, api.JobStateRunning)
+	tasks, err := store.ListTasks(job.Name)
+	require.NoError(t, err)
+	for _, task := range tasks {
+		assert.Equal(t, api.TaskStateRunning, task.Status.State)
+	}
+
+	fake.Advance(time.Hour)
+	waitForJobState(t, store, job.Name, api.JobStateFailed)
+	stored, err := store.GetJob(job.Name)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{"FAILED": 1, "SUCCEEDED": 2}, stored.Status.TaskGroups["group1"].Counts)
+	assert.Equal(t, "3600s", stored.Status.RunDuration)
+	last := stored.Status.StatusEvents[len(stored.Status.StatusEvents)-1]
+	assert.Equal(t, "Job failed: 1 task(s) failed", last.Description)
+	require.NotNil(t, last.TaskExecution)
+	assert.Equal(t, int32(simulatedExitCode), last.TaskExecution.ExitCode)
+}
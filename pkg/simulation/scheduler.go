@@ -0,0 +1,486 @@
+package simulation
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+)
+
+// Scheduling policies of a Scheduler. Under either, a job of higher
+// priority is given a slot before the jobs of lower priority ready by then.
+const (
+	// PolicyFIFO gives a free slot to the job that has waited longest.
+	PolicyFIFO = "fifo"
+	// PolicyFair gives free slots to tenants in turn, and to the job that
+	// has waited longest within a tenant.
+	PolicyFair = "fair"
+)
+
+// Scheduler is a capacity model limiting how many jobs run at once, overall
+// and per tenant. Jobs leaving QUEUED wait for a free slot before they are
+// SCHEDULED, and hold it until their simulation ends.
+//
+// Slots are handed out in simulated time: a slot freed at t goes to a job
+// that was ready by t, so the outcome does not depend on the order in which
+// the simulator processes events after a fake clock jumps ahead.
+type Scheduler struct {
+	// capacity is the most jobs running at once, or 0 for no overall limit.
+	capacity int
+	policy   string
+	// tenantLimits are the most jobs of a tenant running at once, with
+	// defaultTenantLimit for tenants not listed. 0 is unlimited.
+	tenantLimits       map[string]int
+	defaultTenantLimit int
+	// locationCapacity, if set, is the capacity of each location jobs must
+	// fit in.
+	locationCapacity *Capacity
+
+	mu      sync.Mutex
+	seq     int
+	running int
+	// free holds the times at which the unused slots were freed.
+	free []time.Time
+	// tenantFree holds the times at which the unused slots of each limited
+	// tenant were freed.
+	tenantFree map[string][]time.Time
+	// pools holds the capacity of each limited location.
+	pools   map[string]*pool
+	waiting []*ticket
+	// last is the tenant most recently given a slot under PolicyFair.
+	last    string
+	tenants map[string]*tenantStats
+}
+
+// ticket is a job's place in the queue for a slot.
+type ticket struct {
+	seq     int
+	tenant  string
+	readyAt time.Time
+	// location is where the job runs, and demand the resources it holds
+	// there while it has a slot.
+	location string
+	demand   Resources
+	// priority is the job's priority, between 0 and 99.
+	priority int32
+	// granted is called with the time the job was given a slot, with the
+	// scheduler's lock held.
+	granted func(at time.Time)
+	// holding is set once the ticket has been given a slot at grantedAt.
+	holding   bool
+	grantedAt time.Time
+}
+
+type tenantStats struct {
+	scheduled int
+	waiting   int
+	totalWait time.Duration
+	maxWait   time.Duration
+}
+
+// SchedulerStats reports the state of a Scheduler.
+type SchedulerStats struct {
+	Policy string `json:"policy"`
+	// Capacity is the most jobs running at once, or 0 for no overall limit.
+	Capacity int `json:"capacity"`
+	// Running is the number of jobs holding a slot.
+	Running int `json:"running"`
+	// Waiting is the number of jobs that have not been given a slot yet,
+	// including those still in their simulated QUEUED time.
+	Waiting int `json:"waiting"`
+	// Tenants reports wait times per tenant.
+	Tenants map[string]*TenantStats `json:"tenants"`
+	// Pools reports the capacity of each limited location jobs have run
+	// in.
+	Pools map[string]*PoolStats `json:"pools,omitempty"`
+}
+
+// TenantStats reports how long the jobs of a tenant waited for a slot after
+// their simulated QUEUED time was up.
+type TenantStats struct {
+	Scheduled        int     `json:"scheduled"`
+	Waiting          int     `json:"waiting"`
+	TotalWaitSeconds float64 `json:"totalWaitSeconds"`
+	MeanWaitSeconds  float64 `json:"meanWaitSeconds"`
+	MaxWaitSeconds   float64 `json:"maxWaitSeconds"`
+}
+
+// NewScheduler creates a Scheduler running at most capacity jobs at once,
+// handing out slots according to policy. An empty policy means PolicyFIFO.
+func NewScheduler(capacity int, policy string) (*Scheduler, error) {
+	if capacity <= 0 {
+		return nil, fmt.Errorf("capacity must be positive, got %d", capacity)
+	}
+	return newScheduler(capacity, policy)
+}
+
+// NewTenantScheduler creates a Scheduler without an overall limit, for
+// limiting tenants with SetTenantLimits only.
+func NewTenantScheduler(policy string) (*Scheduler, error) {
+	return newScheduler(0, policy)
+}
+
+func newScheduler(capacity int, policy string) (*Scheduler, error) {
+	switch policy {
+	case "":
+		policy = PolicyFIFO
+	case PolicyFIFO, PolicyFair:
+	default:
+		return nil, fmt.Errorf("unsupported scheduling policy %q, must be %s or %s", policy, PolicyFIFO, PolicyFair)
+	}
+
+	return &Scheduler{
+		capacity:   capacity,
+		policy:     policy,
+		free:       make([]time.Time, capacity),
+		tenantFree: make(map[string][]time.Time),
+		pools:      make(map[string]*pool),
+		tenants:    make(map[string]*tenantStats),
+	}, nil
+}
+
+// SetTenantLimits caps how many jobs of each tenant run at once, to
+// limits[tenant] or defaultLimit for tenants not listed. A limit of 0 is
+// unlimited. Jobs of a tenant at its limit stay QUEUED even when overall
+// capacity is free. It must be called before any job is started.
+func (s *Scheduler) SetTenantLimits(defaultLimit int, limits map[string]int) {
+	s.defaultTenantLimit = defaultLimit
+	s.tenantLimits = limits
+}
+
+// SetScheduler makes the engine run jobs only as capacity in s allows. It
+// must be called before any job is started.
+func (e *Engine) SetScheduler(s *Scheduler) {
+	e.scheduler = s
+}
+
+// Tenant returns the tenant the scheduler shares capacity between for job:
+// the value of TenantLabel, or the job's project.
+func Tenant(job *api.Job) string {
+	if tenant := job.Labels[TenantLabel]; tenant != "" {
+		return tenant
+	}
+	project, _, _ := strings.Cut(strings.TrimPrefix(job.Name, "projects/"), "/")
+	return project
+}
+
+// enqueue adds a ticket for a job of tenant that is ready for a slot at
+// readyAt, calling granted once it is given one. Tickets ready at the same
+// time are served in enqueue order.
+func (s *Scheduler) enqueue(tenant string, readyAt time.Time, granted func(at time.Time)) *ticket {
+	return s.add(&ticket{tenant: tenant, readyAt: readyAt, granted: granted})
+}
+
+// enqueueJob is enqueue for job, which is also ordered by its priority and
+// needs its resources out of the capacity of its location.
+func (s *Scheduler) enqueueJob(job *api.Job, readyAt time.Time, granted func(at time.Time)) *ticket {
+	return s.add(&ticket{
+		tenant:   Tenant(job),
+		readyAt:  readyAt,
+		location: jobLocation(job),
+		demand:   JobResources(job),
+		priority: job.Priority,
+		granted:  granted,
+	})
+}
+
+// add queues t behind the tickets added before it.
+func (s *Scheduler) add(t *ticket) *ticket {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.seq++
+	t.seq = s.seq
+	s.waiting = append(s.waiting, t)
+	s.stats(t.tenant).waiting++
+	return t
+}
+
+// reprioritize changes the priority of t while it waits for a slot. It does
+// nothing if s or t is nil.
+func (s *Scheduler) reprioritize(t *ticket, priority int32) {
+	if s == nil || t == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t.priority = priority
+}
+
+// acquire hands out the slots free by t.readyAt, which the caller's clock
+// must have reached. t's granted function is called right away if t gets
+// one, or later once a slot is freed for it. It may already have been called
+// if a slot was freed for t before.
+func (s *Scheduler) acquire(t *ticket) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.dispatch(t.readyAt)
+}
+
+// finish gives up t at the simulated time at: a waiting ticket leaves the
+// queue and a held slot is freed. It does nothing if s or t is nil.
+func (s *Scheduler) finish(t *ticket, at time.Time) {
+	if s == nil || t == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !t.holding {
+		for i, waiting := range s.waiting {
+			if waiting == t {
+				s.waiting = append(s.waiting[:i], s.waiting[i+1:]...)
+				s.stats(t.tenant).waiting--
+				return
+			}
+		}
+	}
+
+	// A run cancelled before picking up its slot frees it no earlier than
+	// it was granted.
+	if at.Before(t.grantedAt) {
+		at = t.grantedAt
+	}
+	s.running--
+	if s.capacity > 0 {
+		s.free = append(s.free, at)
+	}
+	if s.tenantLimit(t.tenant) > 0 {
+		s.tenantFree[t.tenant] = append(s.tenantFree[t.tenant], at)
+	}
+	if p := s.pool(t.location); p != nil {
+		p.release(t.demand, at)
+	}
+	s.dispatch(at)
+}
+
+// dispatch hands out free slots to waiting tickets, in simulated time order,
+// up to the time now. The caller must hold s.mu.
+func (s *Scheduler) dispatch(now time.Time) {
+	for len(s.waiting) > 0 && (s.capacity == 0 || len(s.free) > 0) {
+		slot, freedAt := earliest(s.free)
+		ready, ok := s.earliestReady()
+		if !ok {
+			return
+		}
+		// The next slot is handed out once it is free and a job is ready.
+		at := maxTime(freedAt, ready)
+		if at.After(now) {
+			return
+		}
+
+		t := s.pick(at)
+		for i, waiting := range s.waiting {
+			if waiting == t {
+				s.waiting = append(s.waiting[:i], s.waiting[i+1:]...)
+				break
+			}
+		}
+		if slot >= 0 {
+			s.free = append(s.free[:slot], s.free[slot+1:]...)
+		}
+		if s.tenantLimit(t.tenant) > 0 {
+			free := s.tenantFree[t.tenant]
+			i, _ := earliest(free)
+			s.tenantFree[t.tenant] = append(free[:i], free[i+1:]...)
+		}
+		if p := s.pool(t.location); p != nil {
+			p.take(t.demand)
+		}
+		s.running++
+
+		wait := at.Sub(t.readyAt)
+		stats := s.stats(t.tenant)
+		stats.waiting--
+		stats.scheduled++
+		stats.totalWait += wait
+		if wait > stats.maxWait {
+			stats.maxWait = wait
+		}
+
+		s.last = t.tenant
+		t.holding, t.grantedAt = true, at
+		if t.granted != nil {
+			t.granted(at)
+		}
+	}
+}
+
+// earliestReady returns the earliest time a waiting ticket is ready. It
+// reports false if every waiting ticket's tenant is at its limit. The caller
+// must hold s.mu.
+func (s *Scheduler) earliestReady() (time.Time, bool) {
+	var earliest time.Time
+	found := false
+	for _, t := range s.waiting {
+		if readyAt, ok := s.readyTime(t); ok && (!found || readyAt.Before(earliest)) {
+			earliest, found = readyAt, true
+		}
+	}
+	return earliest, found
+}
+
+// readyTime returns the time t is ready for a slot: once its QUEUED time is
+// up, if its tenant is limited, one of the tenant's slots is free and, if
+// its location is limited, enough of the location's capacity is free. It
+// reports false if all of the tenant's slots are held or the location lacks
+// the capacity. The caller must hold s.mu.
+func (s *Scheduler) readyTime(t *ticket) (time.Time, bool) {
+	readyAt := t.readyAt
+	if p := s.pool(t.location); p != nil {
+		fitAt, ok := p.fitTime(t.demand)
+		if !ok {
+			return time.Time{}, false
+		}
+		readyAt = maxTime(readyAt, fitAt)
+	}
+
+	limit := s.tenantLimit(t.tenant)
+	if limit == 0 {
+		return readyAt, true
+	}
+	free, ok := s.tenantFree[t.tenant]
+	if !ok {
+		free = make([]time.Time, limit)
+		s.tenantFree[t.tenant] = free
+	}
+	if len(free) == 0 {
+		return time.Time{}, false
+	}
+	_, freedAt := earliest(free)
+	return maxTime(readyAt, freedAt), true
+}
+
+// pool returns the capacity of location, or nil if it is unlimited. The
+// caller must hold s.mu.
+func (s *Scheduler) pool(location string) *pool {
+	if s.locationCapacity == nil {
+		return nil
+	}
+	if p, ok := s.pools[location]; ok {
+		return p
+	}
+	capacity := s.locationCapacity.For(location)
+	if capacity == (Resources{}) {
+		return nil
+	}
+	p := newPool(capacity)
+	s.pools[location] = p
+	return p
+}
+
+func (s *Scheduler) tenantLimit(tenant string) int {
+	if limit, ok := s.tenantLimits[tenant]; ok {
+		return limit
+	}
+	return s.defaultTenantLimit
+}
+
+// pick chooses the ticket to give a slot freed at the time at among those
+// ready by then, highest priority first. The caller must hold s.mu.
+func (s *Scheduler) pick(at time.Time) *ticket {
+	var ready []*ticket
+	for _, t := range s.waiting {
+		if readyAt, ok := s.readyTime(t); ok && !readyAt.After(at) {
+			ready = append(ready, t)
+		}
+	}
+	sort.Slice(ready, func(i, j int) bool {
+		if ready[i].priority != ready[j].priority {
+			return ready[i].priority > ready[j].priority
+		}
+		if !ready[i].readyAt.Equal(ready[j].readyAt) {
+			return ready[i].readyAt.Before(ready[j].readyAt)
+		}
+		return ready[i].seq < ready[j].seq
+	})
+	if s.policy != PolicyFair {
+		return ready[0]
+	}
+
+	// Serve the tenant after the last one served, in name order.
+	var next, first *ticket
+	for _, t := range ready {
+		if first == nil || t.tenant < first.tenant {
+			first = t
+		}
+		if t.tenant > s.last && (next == nil || t.tenant < next.tenant) {
+			next = t
+		}
+	}
+	if next == nil {
+		next = first
+	}
+	return next
+}
+
+func (s *Scheduler) stats(tenant string) *tenantStats {
+	stats, ok := s.tenants[tenant]
+	if !ok {
+		stats = &tenantStats{}
+		s.tenants[tenant] = stats
+	}
+	return stats
+}
+
+// Stats returns the current slot usage and per-tenant wait times.
+func (s *Scheduler) Stats() SchedulerStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := SchedulerStats{
+		Policy:   s.policy,
+		Capacity: s.capacity,
+		Running:  s.running,
+		Waiting:  len(s.waiting),
+		Tenants:  make(map[string]*TenantStats, len(s.tenants)),
+	}
+	for tenant, t := range s.tenants {
+		tenantStats := &TenantStats{
+			Scheduled:        t.scheduled,
+			Waiting:          t.waiting,
+			TotalWaitSeconds: t.totalWait.Seconds(),
+			MaxWaitSeconds:   t.maxWait.Seconds(),
+		}
+		if t.scheduled > 0 {
+			tenantStats.MeanWaitSeconds = t.totalWait.Seconds() / float64(t.scheduled)
+		}
+		stats.Tenants[tenant] = tenantStats
+	}
+	if len(s.pools) > 0 {
+		stats.Pools = make(map[string]*PoolStats, len(s.pools))
+		for location, p := range s.pools {
+			stats.Pools[location] = &PoolStats{Capacity: p.capacity, InUse: p.inUse}
+		}
+	}
+	return stats
+}
+
+// earliest returns the index and value of the earliest of times, or -1 and
+// the zero time if there are none.
+func earliest(times []time.Time) (int, time.Time) {
+	if len(times) == 0 {
+		return -1, time.Time{}
+	}
+	index := 0
+	for i, t := range times {
+		if t.Before(times[index]) {
+			index = i
+		}
+	}
+	return index, times[index]
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
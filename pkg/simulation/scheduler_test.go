@@ -0,0 +1,200 @@
+package simulation
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+)
+
+func TestNewScheduler(t *testing.T) {
+	s, err := NewScheduler(2, "")
+	require.NoError(t, err)
+	assert.Equal(t, PolicyFIFO, s.Stats().Policy)
+	assert.Equal(t, 2, s.Stats().Capacity)
+
+	_, err = NewScheduler(0, PolicyFair)
+	assert.Error(t, err)
+	_, err = NewScheduler(1, "lottery")
+	assert.Error(t, err)
+}
+
+// grants records the times tickets are given a slot, keyed by tenant.
+type grants map[string]time.Time
+
+func (g grants) to(tenant string) func(time.Time) {
+	return func(at time.Time) { g[tenant] = at }
+}
+
+func TestScheduler_Finish(t *testing.T) {
+	s, err := NewScheduler(1, PolicyFIFO)
+	require.NoError(t, err)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	granted := grants{}
+	first := s.enqueue("a", start, granted.to("a"))
+	second := s.enqueue("b", start, granted.to("b"))
+	third := s.enqueue("c", start.Add(time.Second), granted.to("c"))
+
+	s.acquire(first)
+	assert.Equal(t, grants{"a": start}, granted)
+
+	// A cancelled job leaves the queue without taking a slot
+	s.finish(second, time.Time{})
+	assert.Equal(t, 1, s.Stats().Waiting)
+
+	// The slot freed by the first job goes to the next ready one
+	s.acquire(third)
+	assert.NotContains(t, granted, "c")
+	s.finish(first, start.Add(5*time.Second))
+	assert.Equal(t, start.Add(5*time.Second), granted["c"])
+
+	stats := s.Stats()
+	assert.Equal(t, 1, stats.Running)
+	assert.Equal(t, 0, stats.Waiting)
+	assert.Equal(t, 4.0, stats.Tenants["c"].MaxWaitSeconds)
+	assert.Equal(t, 0, stats.Tenants["b"].Scheduled)
+
+	s.finish(third, start.Add(10*time.Second))
+	assert.Equal(t, 0, s.Stats().Running)
+}
+
+func TestScheduler_TenantLimits(t *testing.T) {
+	s, err := NewTenantScheduler("")
+	require.NoError(t, err)
+	s.SetTenantLimits(1, map[string]int{"big": 0})
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	granted := grants{}
+	first := s.enqueue("a", start, granted.to("a"))
+	second := s.enqueue("a", start, granted.to("second a"))
+	big := []*ticket{s.enqueue("big", start, granted.to("big")), s.enqueue("big", start, granted.to("second big"))}
+
+	s.acquire(first)
+	assert.Equal(t, start, granted["a"])
+
+	// Unlimited tenants are not held up by limited ones
+	for _, ticket := range big {
+		s.acquire(ticket)
+	}
+	assert.Equal(t, start, granted["big"])
+	assert.Equal(t, start, granted["second big"])
+	stats := s.Stats()
+	assert.Equal(t, 3, stats.Running)
+	assert.Equal(t, 1, stats.Waiting)
+	assert.Equal(t, 0, stats.Capacity)
+
+	// The second job of a waits for the first to end
+	s.acquire(second)
+	assert.NotContains(t, granted, "second a")
+	s.finish(first, start.Add(5*time.Second))
+	assert.Equal(t, start.Add(5*time.Second), granted["second a"])
+	assert.Equal(t, 5.0, s.Stats().Tenants["a"].MaxWaitSeconds)
+}
+
+func TestEngine_Scheduler(t *testing.T) {
+	tests := []struct {
+		policy string
+		want   []string
+	}{
+		{PolicyFIFO, []string{"a", "a", "a", "b"}},
+		{PolicyFair, []string{"a", "b", "a", "a"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			engine, store, fake := setupFakeEngine()
+			scheduler, err := NewScheduler(1, tt.policy)
+			require.NoError(t, err)
+			engine.SetScheduler(scheduler)
+			defer engine.Shutdown()
+
+			var jobs []*api.Job
+			for _, tenant := range []string{"a", "a", "a", "b"} {
+				job := newTestJob(t, store, fake.Now(), &api.TaskGroup{Name: "group1", TaskCount: 1})
+				job.Labels = map[string]string{TenantLabel: tenant}
+				engine.Start(job, &Plan{})
+				jobs = append(jobs, job)
+			}
+
+			fake.Advance(time.Minute)
+			for i, job := range jobs {
+				jobs[i] = waitForJobState(t, store, job.Name, api.JobStateSucceeded)
+			}
+
+			// Each job holds the only slot for 6s: 1s SCHEDULED and 5s RUNNING
+			tenants := make(map[time.Time]string)
+			for _, job := range jobs {
+				tenants[job.Status.StatusEvents[0].EventTime] = job.Labels[TenantLabel]
+			}
+			start := jobs[0].CreateTime.Add(time.Second)
+			var order []string
+			for i := range jobs {
+				order = append(order, tenants[start.Add(time.Duration(i)*6*time.Second)])
+			}
+			assert.Equal(t, tt.want, order)
+
+			stats := engine.Stats().Scheduler
+			require.NotNil(t, stats)
+			assert.Equal(t, 0, stats.Running)
+			assert.Equal(t, 3, stats.Tenants["a"].Scheduled)
+			assert.Equal(t, 1, stats.Tenants["b"].Scheduled)
+		})
+	}
+}
+
+func TestScheduler_Priority(t *testing.T) {
+	s, err := NewScheduler(1, PolicyFIFO)
+	require.NoError(t, err)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	granted := grants{}
+	running := s.add(&ticket{tenant: "a", readyAt: start, granted: granted.to("running")})
+	low := s.add(&ticket{tenant: "a", readyAt: start, granted: granted.to("low")})
+	high := s.add(&ticket{tenant: "a", readyAt: start.Add(time.Second), priority: 50, granted: granted.to("high")})
+	late := s.add(&ticket{tenant: "a", readyAt: start.Add(10 * time.Second), priority: 99, granted: granted.to("late")})
+	for _, ticket := range []*ticket{running, low, high} {
+		s.acquire(ticket)
+	}
+
+	// The higher priority job goes first even though it was ready later, but
+	// not before jobs that were not ready when the slot was freed.
+	s.finish(running, start.Add(5*time.Second))
+	assert.Equal(t, start.Add(5*time.Second), granted["high"])
+	s.reprioritize(low, 99)
+	s.acquire(late)
+	s.finish(high, start.Add(10*time.Second))
+	assert.Equal(t, start.Add(10*time.Second), granted["low"])
+	assert.NotContains(t, granted, "late")
+}
+
+func TestEngine_SchedulerPriority(t *testing.T) {
+	engine, store, fake := setupFakeEngine()
+	scheduler, err := NewScheduler(1, PolicyFIFO)
+	require.NoError(t, err)
+	engine.SetScheduler(scheduler)
+	defer engine.Shutdown()
+
+	var jobs []*api.Job
+	for _, priority := range []int32{0, 10, 20} {
+		job := newTestJob(t, store, fake.Now(), &api.TaskGroup{Name: "group1", TaskCount: 1})
+		job.Priority = priority
+		engine.Start(job, &Plan{})
+		jobs = append(jobs, job)
+	}
+	// The second job is bumped past the third while they are QUEUED.
+	engine.Reprioritize(jobs[1].Name, 30)
+
+	fake.Advance(time.Minute)
+	for i, job := range jobs {
+		jobs[i] = waitForJobState(t, store, job.Name, api.JobStateSucceeded)
+	}
+	// All of them are ready at once, and each holds the slot for 6s.
+	start := jobs[0].CreateTime.Add(time.Second)
+	assert.Equal(t, start, jobs[1].Status.StatusEvents[0].EventTime)
+	assert.Equal(t, start.Add(6*time.Second), jobs[2].Status.StatusEvents[0].EventTime)
+	assert.Equal(t, start.Add(12*time.Second), jobs[0].Status.StatusEvents[0].EventTime)
+}
@@ -0,0 +1,1391 @@
+// Package simulation drives emulated jobs and their tasks through the Batch
+// lifecycle without running any workload.
+package simulation
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+	"github.com/pyshx/fake-batch-server/pkg/clock"
+	"github.com/pyshx/fake-batch-server/pkg/logs"
+	"github.com/pyshx/fake-batch-server/pkg/simulator"
+	"github.com/pyshx/fake-batch-server/pkg/storage"
+	"github.com/pyshx/fake-batch-server/pkg/tracing"
+	"github.com/pyshx/fake-batch-server/pkg/workqueue"
+)
+
+// simulatedExitCode is the exit code reported by failed task attempts.
+const simulatedExitCode = 1
+
+// jobTransitions lists the states a job may move to from each state.
+// Jobs fail before running when they cannot be scheduled, e.g. for lack of
+// resources, which only scenarios simulate.
+var jobTransitions = map[api.JobState][]api.JobState{
+	api.JobStateQueued:    {api.JobStateScheduled, api.JobStateFailed},
+	api.JobStateScheduled: {api.JobStateRunning, api.JobStateFailed},
+	api.JobStateRunning:   {api.JobStateSucceeded, api.JobStateFailed},
+}
+
+// taskTransitions lists the states a task may move to from each state. A
+// RUNNING task re-enters RUNNING when a failed attempt is retried.
+var taskTransitions = map[api.TaskState][]api.TaskState{
+	api.TaskStatePending:  {api.TaskStateAssigned},
+	api.TaskStateAssigned: {api.TaskStateRunning},
+	api.TaskStateRunning:  {api.TaskStateRunning, api.TaskStateSucceeded, api.TaskStateFailed},
+}
+
+// CanTransitionJob reports whether a job may move from one state to another.
+func CanTransitionJob(from, to api.JobState) bool {
+	for _, next := range jobTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// CanTransitionTask reports whether a task may move from one state to another.
+func CanTransitionTask(from, to api.TaskState) bool {
+	for _, next := range taskTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Engine drives simulated jobs through QUEUED, SCHEDULED and RUNNING to a
+// terminal state, and their tasks through PENDING, ASSIGNED and RUNNING.
+//
+// Simulations do not get goroutines of their own: every transition is an
+// event on the engine's simulator.Loop, which applies them one at a time in
+// simulated time order. Only executed containers and background functions
+// run on goroutines, under a context derived from the engine's own, so Stop
+// and Shutdown can cancel them and wait for them to exit, besides the few
+// workers the hooks are called on. A cancelled run makes no further store
+// updates.
+type Engine struct {
+	store    storage.Store
+	clock    clock.Clock
+	timings  Timings
+	executor Executor
+	// objectStoreURL, if set, is passed to executed containers.
+	objectStoreURL string
+	// buckets, if set, backs the GCS volumes of tasks, and volumesRoot is
+	// the host directory the other volumes of executed containers are
+	// resolved under.
+	buckets     Buckets
+	volumesRoot string
+	logs        *logs.Store
+	// scheduler, if set, limits how many jobs run at once.
+	scheduler *Scheduler
+	tracer    *tracing.Tracer
+	hooks     []CompletionHook
+	// transitions are the hooks called on every state change.
+	transitions []TransitionHook
+	// calls makes the hook calls of every run, and closes the logs of
+	// finished tasks, off the simulator's loop, so that a slow webhook
+	// endpoint or log upload does not hold up every simulation. The calls
+	// for a job are made in the order they were queued.
+	calls *workqueue.Queue
+
+	// loop applies the transitions of every run.
+	loop *simulator.Loop
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu         sync.Mutex
+	runners    map[string]*run
+	background int
+	closed     bool
+}
+
+// CompletionHook is called with a copy of a job once its simulation has
+// stored it in a terminal state. ctx is cancelled when the engine shuts down.
+type CompletionHook func(ctx context.Context, job *api.Job)
+
+// Transition is a state change of a job or one of its tasks.
+type Transition struct {
+	Job *api.Job
+	// Task is the task whose state changed, or nil if the job's did.
+	Task *api.Task
+	// Time is the simulated time of the change.
+	Time time.Time
+}
+
+// TransitionHook is called with every state change a simulation stores. The
+// job and task are copies, taken at the time of the change, that hooks may
+// keep. ctx is cancelled when the engine shuts down.
+type TransitionHook func(ctx context.Context, transition Transition)
+
+// Stats reports the simulations and goroutines tracked by an Engine.
+type Stats struct {
+	// Runners is the number of jobs currently being simulated.
+	Runners int `json:"runners"`
+	// Events is the number of transitions waiting on the simulator's queue.
+	Events int `json:"events"`
+	// Background is the number of other tracked goroutines, such as pending
+	// deletions.
+	Background int `json:"background"`
+	// Goroutines is the total number of goroutines in the process.
+	Goroutines int `json:"goroutines"`
+	// Scheduler reports slot usage and wait times when the engine has a
+	// Scheduler.
+	Scheduler *SchedulerStats `json:"scheduler,omitempty"`
+}
+
+// NewEngine creates an Engine that records transitions in store, using clk
+// as its time source.
+func NewEngine(store storage.Store, clk clock.Clock, timings Timings) *Engine {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Engine{
+		store:   store,
+		clock:   clk,
+		timings: timings,
+		loop:    simulator.New(clk),
+		ctx:     ctx,
+		cancel:  cancel,
+		runners: make(map[string]*run),
+		calls:   workqueue.New(hookWorkers, hookBacklog),
+	}
+}
+
+// OnComplete registers hook to be called whenever a simulated job reaches a
+// terminal state. Hooks run off the simulator's event loop, after the
+// transition hooks of the job's earlier changes, in the order they were
+// added. It must be called before any job is started.
+func (e *Engine) OnComplete(hook CompletionHook) {
+	e.hooks = append(e.hooks, hook)
+}
+
+// OnTransition registers hook to be called whenever a simulated job or task
+// changes state. Hooks run off the simulator's event loop, one change of a
+// job after another, in the order they were added. It must be called before
+// any job is started.
+func (e *Engine) OnTransition(hook TransitionHook) {
+	e.transitions = append(e.transitions, hook)
+}
+
+// SetTracer makes the engine record a span for every simulated job, with an
+// event per state change. It must be called before any job is started.
+func (e *Engine) SetTracer(t *tracing.Tracer) {
+	e.tracer = t
+}
+
+// Start simulates job in the background according to plan. The job and its
+// tasks must already be stored. The simulation works on a copy of job, which
+// the caller may go on reading. Any previous run for a job of the same name
+// is stopped first. Start does nothing once the engine has been shut down.
+func (e *Engine) Start(job *api.Job, plan *Plan) {
+	e.start(job, plan, time.Time{}, 0)
+}
+
+// Resume continues simulating a stored job from the state it was left in,
+// e.g. by an engine that was shut down mid-run. A QUEUED job waits out its
+// queueing time again, a SCHEDULED job its provisioning time, and the tasks
+// of a RUNNING job restart the attempts they were in. Transitions are timed
+// from the current time rather than the job's creation time.
+func (e *Engine) Resume(job *api.Job, plan *Plan) {
+	e.start(job, plan, e.clock.Now(), 0)
+}
+
+// Recover continues simulating a job restored after a restart, like Resume,
+// except that a QUEUED or SCHEDULED job only waits out what is left of that
+// state, counted from when its stored timestamps say it entered it. Time the
+// server was down counts, so a job that would have moved on by now does so
+// right away. The tasks of a RUNNING job still restart their attempts.
+func (e *Engine) Recover(job *api.Job, plan *Plan) {
+	now := e.clock.Now()
+	e.start(job, plan, now, max(now.Sub(enteredAt(job)), 0))
+}
+
+// enteredEvents are the types of the status events recorded when a job
+// enters each state.
+var enteredEvents = map[api.JobState]string{
+	api.JobStateQueued:    "job_created",
+	api.JobStateScheduled: "job_scheduled",
+	api.JobStateRunning:   "job_started",
+}
+
+// enteredAt returns when job entered its current state, from the last status
+// event recording it, or its creation time if there is none.
+func enteredAt(job *api.Job) time.Time {
+	if job.Status != nil {
+		events := job.Status.StatusEvents
+		for i := len(events) - 1; i >= 0; i-- {
+			if events[i].Type == enteredEvents[job.State] {
+				return events[i].EventTime
+			}
+		}
+	}
+	return job.CreateTime
+}
+
+// start runs job in the background, resuming it at resumeAt unless that is
+// zero, elapsed after it entered the state it is stored in.
+func (e *Engine) start(job *api.Job, plan *Plan, resumeAt time.Time, elapsed time.Duration) {
+	e.Stop(job.Name)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.ctx.Err() != nil {
+		return
+	}
+
+	job = job.Clone()
+	ctx, cancel := context.WithCancel(e.ctx)
+	ctx, span := e.tracer.Start(tracing.ContextWithRemoteParent(ctx, plan.Trace), "simulation.run", tracing.KindInternal)
+	span.SetAttributes(tracing.Attribute{Key: "batch.job", Value: job.Name})
+	r := &run{
+		Engine:   e,
+		ctx:      ctx,
+		cancel:   cancel,
+		hookCtx:  tracing.ContextWithRemoteParent(e.ctx, tracing.SpanContextFromContext(ctx)),
+		job:      job,
+		store:    tracing.WrapStore(ctx, storage.WithContext(ctx, e.store)),
+		span:     span,
+		plan:     plan,
+		resumeAt: resumeAt,
+		elapsed:  elapsed,
+	}
+	e.runners[job.Name] = r
+
+	// Queue for capacity right away so that jobs ready at the same time are
+	// scheduled in submission order. Scripted jobs take no capacity.
+	if e.scheduler != nil && plan.Scenario == nil {
+		readyAt := job.CreateTime
+		if !resumeAt.IsZero() {
+			readyAt = resumeAt
+		}
+		if resumeAt.IsZero() || job.State == api.JobStateQueued {
+			readyAt = readyAt.Add(max(e.timings.Merge(plan.Timings).Duration(api.JobStateQueued)-elapsed, 0))
+		}
+		r.ticket = e.scheduler.enqueueJob(job, readyAt, func(at time.Time) {
+			r.post(at, func() { r.granted(at) })
+		})
+	}
+
+	r.post(time.Time{}, r.begin)
+}
+
+// Running reports whether the named job is currently being simulated.
+func (e *Engine) Running(name string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	_, ok := e.runners[name]
+	return ok
+}
+
+// Stop cancels the simulation of the named job and waits for the containers
+// it executes to exit. It reports whether a simulation was running.
+func (e *Engine) Stop(name string) bool {
+	e.mu.Lock()
+	r, ok := e.runners[name]
+	e.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	r.cancel()
+	e.loop.Do(r.end)
+	r.execs.Wait()
+	return true
+}
+
+// Plans returns the plans of the jobs currently being simulated, keyed by
+// job name.
+func (e *Engine) Plans() map[string]*Plan {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	plans := make(map[string]*Plan, len(e.runners))
+	for name, r := range e.runners {
+		plans[name] = r.plan
+	}
+	return plans
+}
+
+// Reprioritize makes the named job, if it is still waiting for a slot of the
+// engine's Scheduler, wait with the given priority instead.
+func (e *Engine) Reprioritize(name string, priority int32) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if r, ok := e.runners[name]; ok {
+		e.scheduler.reprioritize(r.ticket, priority)
+	}
+}
+
+// Update calls fn with the job of the named simulation on the engine's loop,
+// between the steps of its run, and saves the job unless fn fails, which it
+// must do before changing the job. The tasks added by raising the task count
+// of a group are created PENDING, and those of a RUNNING job take the free
+// slots of their group right away while the attempts in progress carry on.
+// Update reports false, without calling fn, if no simulation of the job is
+// running.
+func (e *Engine) Update(name string, fn func(job *api.Job) error) (bool, error) {
+	e.mu.Lock()
+	r, ok := e.runners[name]
+	e.mu.Unlock()
+	if !ok {
+		return false, nil
+	}
+
+	var updated bool
+	var err error
+	e.loop.Do(func() {
+		if r.ended || r.ctx.Err() != nil {
+			return
+		}
+		updated = true
+
+		before := make(map[string]int64)
+		for _, taskGroup := range r.job.TaskGroups {
+			before[taskGroup.Name] = taskGroup.TaskCount
+		}
+		if err = fn(r.job); err != nil {
+			return
+		}
+		r.now = e.clock.Now()
+		if err = r.grow(before); err != nil {
+			r.end()
+			return
+		}
+		if !r.save() {
+			err = fmt.Errorf("failed to save job %s", name)
+			r.end()
+			return
+		}
+		if r.started && r.plan.Scenario == nil {
+			r.next()
+		}
+	})
+	return updated, err
+}
+
+// Complete announces that job, which is not being simulated, was moved to
+// the terminal state it is stored in at the given time: the transition hooks
+// are called for the job, and then the completion hooks, off the caller's
+// goroutine and after the hook calls already queued for it, as when a
+// simulated job completes.
+func (e *Engine) Complete(ctx context.Context, job *api.Job, at time.Time) {
+	ctx = tracing.ContextWithRemoteParent(e.ctx, tracing.SpanContextFromContext(ctx))
+	transition := Transition{Job: job.Clone(), Time: at}
+	completed := job.Clone()
+	e.calls.Add(job.Name, func() {
+		for _, hook := range e.transitions {
+			hook(ctx, transition)
+		}
+		for _, hook := range e.hooks {
+			hook(ctx, completed)
+		}
+	})
+}
+
+// Go runs fn in a tracked background goroutine. The context passed to fn is
+// cancelled by Shutdown. Go does nothing once the engine has been shut down.
+func (e *Engine) Go(fn func(ctx context.Context)) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.ctx.Err() != nil {
+		return
+	}
+
+	ctx := e.ctx
+	e.background++
+	e.wg.Add(1)
+
+	go func() {
+		defer e.wg.Done()
+
+		fn(ctx)
+
+		e.mu.Lock()
+		e.background--
+		e.mu.Unlock()
+	}()
+}
+
+// Shutdown stops every simulation, cancels every tracked goroutine and waits
+// for them to exit, and then stops the simulator's event loop. The engine
+// starts no new simulations afterwards.
+func (e *Engine) Shutdown() {
+	e.mu.Lock()
+	e.closed = true
+	e.cancel()
+	e.mu.Unlock()
+
+	e.stopAll()
+	e.wg.Wait()
+	e.loop.Close()
+	e.calls.Close()
+}
+
+// Reset stops every simulation, cancels every tracked goroutine and waits for
+// them to exit, like Shutdown, but leaves the engine ready to simulate new
+// jobs. Jobs started while a reset is in progress are not simulated.
+func (e *Engine) Reset() {
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		return
+	}
+	e.cancel()
+	e.mu.Unlock()
+
+	e.stopAll()
+	e.wg.Wait()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !e.closed {
+		e.ctx, e.cancel = context.WithCancel(context.Background())
+	}
+}
+
+// stopAll stops the simulation of every job.
+func (e *Engine) stopAll() {
+	e.mu.Lock()
+	names := make([]string, 0, len(e.runners))
+	for name := range e.runners {
+		names = append(names, name)
+	}
+	e.mu.Unlock()
+
+	for _, name := range names {
+		e.Stop(name)
+	}
+}
+
+// Stats returns the current simulation and goroutine counts.
+func (e *Engine) Stats() Stats {
+	e.mu.Lock()
+	stats := Stats{
+		Runners:    len(e.runners),
+		Background: e.background,
+		Goroutines: runtime.NumGoroutine(),
+	}
+	e.mu.Unlock()
+	stats.Events = e.loop.Len()
+
+	if e.scheduler != nil {
+		scheduler := e.scheduler.Stats()
+		stats.Scheduler = &scheduler
+	}
+	return stats
+}
+
+// run is the state of a single simulated job. It is only touched by events
+// on the engine's loop, or by other goroutines through loop.Do.
+type run struct {
+	*Engine
+	ctx    context.Context
+	cancel context.CancelFunc
+	// hookCtx is the context of the run's hook calls, which may be made
+	// after it has ended: it carries the run's span, but is only cancelled
+	// when the engine shuts down.
+	hookCtx context.Context
+	job     *api.Job
+	// store records spans under span when tracing, and fails every access
+	// once ctx is cancelled, so a stopped run cannot update the job even
+	// midway through a step.
+	store storage.Store
+	span  *tracing.Span
+	plan  *Plan
+	tasks []*api.Task
+	// spot is set if the job runs on Spot VMs, which its plan may preempt.
+	spot bool
+
+	// resumeAt, unless zero, is when the job resumes from its stored state,
+	// and phase is the state it resumes in. elapsed is how long a recovered
+	// job had already been in that state, which counts against its time in
+	// it.
+	resumeAt time.Time
+	phase    api.JobState
+	elapsed  time.Duration
+	// timer is the next timed step of the run, replaced by every new one.
+	timer *simulator.Event
+	// ended is set once the run has finished or been stopped.
+	ended bool
+
+	// With a scheduler, the job leaves QUEUED once its queueing time is up
+	// at scheduledAt (ready) and ticket has been given a slot at slotAt
+	// (slotted).
+	ticket      *ticket
+	scheduledAt time.Time
+	ready       bool
+	slotted     bool
+	slotAt      time.Time
+	// warm is the number of VMs taken from the plan's warm pool.
+	warm int
+	// held are the tasks that kept their slot across a resume, and
+	// firstWave the tasks that start running once the job does. assigned is
+	// set once the first wave has been assigned, and started once it has
+	// started running.
+	held      []*api.Task
+	firstWave []*api.Task
+	assigned  bool
+	started   bool
+
+	// lazy simulates the lazy task groups of the job, whose tasks are not
+	// in tasks.
+	lazy []*lazyGroup
+	// pending holds, per task group, the tasks still waiting for a slot.
+	pending map[string][]*api.Task
+	// attempts holds the running runnables of task attempts ordered by end
+	// time.
+	attempts   attemptQueue
+	maxRetries map[string]int32
+	seq        int
+
+	// runnables and stepDurations hold, per task group, the runnables each
+	// task executes and how long each foreground runnable takes.
+	runnables     map[string][]*api.Runnable
+	stepDurations map[string]time.Duration
+	// maxRunDurations holds, per task group, how long a task attempt may
+	// run before it is killed, or 0 for no limit.
+	maxRunDurations map[string]time.Duration
+	// active counts, per task group, the attempts in progress, and waiting
+	// holds those of them blocked at a barrier.
+	active  map[string]int
+	waiting map[string][]*attempt
+
+	// executing counts the container runnables being run by the engine's
+	// Executor, whose completions are posted to the loop.
+	executing int
+	execs     sync.WaitGroup
+
+	// jitter is the most a task attempt runs past its RUNNING time.
+	jitter time.Duration
+	// failedExecution is how the first task to fail in this run ended,
+	// reported with the job's failure.
+	failedExecution *api.TaskExecution
+	// volumeErrors holds, per task group, the error mounting its GCS
+	// volumes, or nil if they could be mounted.
+	volumeErrors map[string]error
+
+	// progressEvery is the interval between progress events while RUNNING,
+	// and progressAt the time of the next one.
+	progressEvery time.Duration
+	progressAt    time.Time
+
+	// now is the simulated time of the step being applied. Events are
+	// stamped with it rather than the clock's current time, so their
+	// timestamps stay ordered even when a fake clock jumps past several
+	// deadlines at once.
+	now time.Time
+}
+
+// post schedules fn on the engine's loop at the given time. fn is skipped if
+// the run has ended or been cancelled by then, and the run ends instead if
+// its job has been removed from the store without stopping it, e.g. by a
+// doctor repair.
+func (r *run) post(at time.Time, fn func()) *simulator.Event {
+	return r.loop.At(at, func() {
+		if r.ended || r.ctx.Err() != nil {
+			return
+		}
+		if _, err := r.Engine.store.GetJob(r.job.Name); err != nil {
+			r.end()
+			return
+		}
+		fn()
+	})
+}
+
+// after makes fn the next timed step of the run, at the given time,
+// cancelling the previous one if it has not run yet.
+func (r *run) after(at time.Time, fn func()) {
+	r.loop.Cancel(r.timer)
+	r.timer = r.post(at, fn)
+}
+
+// begin sets the run up from the stored job and its tasks, and times the end
+// of its QUEUED state. Transition times are computed from the job's creation
+// time rather than relative to each other, so advancing a fake clock past
+// several deadlines at once applies all of them. With a non-zero resumeAt the
+// job continues from its stored state at that time.
+func (r *run) begin() {
+	tasks, err := r.loadTasks()
+	if err != nil {
+		logrus.Errorf("Failed to list tasks for job %s: %v", r.job.Name, err)
+		r.end()
+		return
+	}
+	sortTasks(tasks)
+	timings := r.timings.Merge(r.plan.Timings)
+
+	r.tasks = tasks
+	r.spot = onSpot(r.job)
+	r.pending = make(map[string][]*api.Task)
+	r.maxRetries = make(map[string]int32)
+	r.runnables = make(map[string][]*api.Runnable)
+	r.stepDurations = make(map[string]time.Duration)
+	r.active = make(map[string]int)
+	r.maxRunDurations = make(map[string]time.Duration)
+	r.waiting = make(map[string][]*attempt)
+	r.progressEvery = timings.Progress
+	r.jitter = timings.Jitter
+
+	// A fresh run starts every task from PENDING. A resumed one leaves
+	// terminal tasks alone and hands their slots back to the tasks that held
+	// them.
+	r.phase = api.JobStateQueued
+	queuedFrom := r.job.CreateTime
+	if !r.resumeAt.IsZero() {
+		r.phase, queuedFrom = r.job.State, r.resumeAt
+	}
+	for _, task := range tasks {
+		group := TaskGroupName(task.Name)
+		switch {
+		case r.resumeAt.IsZero() || task.Status.State == api.TaskStatePending:
+			r.pending[group] = append(r.pending[group], task)
+		case task.Status.State == api.TaskStateAssigned || task.Status.State == api.TaskStateRunning:
+			r.held = append(r.held, task)
+		}
+	}
+	for _, taskGroup := range r.job.TaskGroups {
+		if taskGroup.TaskSpec != nil {
+			r.maxRetries[taskGroup.Name] = taskGroup.TaskSpec.MaxRetryCount
+			r.runnables[taskGroup.Name] = taskGroup.TaskSpec.Runnables
+			r.maxRunDurations[taskGroup.Name] = limit(taskGroup.TaskSpec.MaxRunDuration)
+		}
+		r.stepDurations[taskGroup.Name] = stepDuration(r.runnables[taskGroup.Name], timings.Duration(api.JobStateRunning))
+	}
+	if r.plan.Scenario != nil {
+		r.script()
+		return
+	}
+
+	switch r.phase {
+	case api.JobStateQueued:
+		r.scheduledAt = queuedFrom.Add(max(timings.Duration(api.JobStateQueued)-r.elapsed, 0))
+		r.after(r.scheduledAt, r.queued)
+	case api.JobStateScheduled, api.JobStateRunning:
+		r.scheduledAt = r.resumeAt
+		r.queued()
+	default:
+		r.end()
+	}
+}
+
+// queued is called once the job's QUEUED time is up. Without a scheduler the
+// job is scheduled right away; with one, once its ticket gets a slot.
+func (r *run) queued() {
+	r.ready = true
+	switch {
+	case r.ticket == nil:
+		r.schedule(r.scheduledAt)
+	case r.slotted:
+		r.schedule(r.slotAt)
+	default:
+		r.scheduler.acquire(r.ticket)
+	}
+}
+
+// granted is called once the scheduler has given the job a slot at the
+// given time, which may be before its QUEUED time is up.
+func (r *run) granted(at time.Time) {
+	r.slotted, r.slotAt = true, at
+	if r.ready {
+		r.schedule(at)
+	}
+}
+
+// schedule moves the job to SCHEDULED at the given time, assigns the tasks
+// of its first wave and times the end of its provisioning.
+func (r *run) schedule(scheduledAt time.Time) {
+	timings := r.timings.Merge(r.plan.Timings)
+	r.now = scheduledAt
+	r.firstWave = append(r.held, r.assign(r.held)...)
+	r.scheduleWaves(scheduledAt)
+	r.assigned = true
+
+	// Jobs that fit on the idle VMs of their warm pool start right away.
+	runningAt := scheduledAt
+	scheduled := "Job scheduled; VMs are being provisioned"
+	if r.phase != api.JobStateRunning {
+		wave := make(map[string]int)
+		for _, task := range r.firstWave {
+			wave[TaskGroupName(task.Name)]++
+		}
+		for _, g := range r.lazy {
+			wave[g.name] += int(g.progress.Assigned - g.progress.Started)
+		}
+		if vms := r.instancesFor(wave); r.plan.WarmPool.take(vms) {
+			r.warm = vms
+			scheduled = "Job scheduled; VMs taken from the warm pool"
+		} else if r.phase == api.JobStateScheduled {
+			runningAt = scheduledAt.Add(max(timings.Duration(api.JobStateScheduled)-r.elapsed, 0))
+		} else {
+			runningAt = scheduledAt.Add(timings.Duration(api.JobStateScheduled))
+		}
+	}
+	if r.phase == api.JobStateQueued {
+		if !r.setJobState(api.JobStateScheduled, "job_scheduled", scheduled) {
+			r.end()
+			return
+		}
+	}
+
+	r.after(runningAt, func() { r.startRunning(runningAt) })
+}
+
+// startRunning moves the job to RUNNING at the given time and starts the
+// attempts of its first wave.
+func (r *run) startRunning(runningAt time.Time) {
+	r.now = runningAt
+	// Every task of the first wave counts as active before any of them
+	// starts, so barriers wait for all of them.
+	for _, task := range r.firstWave {
+		r.active[TaskGroupName(task.Name)]++
+	}
+	for _, task := range r.firstWave {
+		if task.Status.State == api.TaskStateRunning && r.phase == api.JobStateRunning {
+			r.resumeAttempt(task, runningAt)
+		} else {
+			r.startAttempt(task, runningAt)
+		}
+	}
+	r.startWaves(runningAt)
+	r.started = true
+	if r.phase != api.JobStateRunning {
+		if !r.setJobState(api.JobStateRunning, "job_started", "Job started running") {
+			r.end()
+			return
+		}
+	} else if !r.save() {
+		r.end()
+		return
+	}
+	r.progressAt = runningAt.Add(r.progressEvery)
+
+	r.next()
+}
+
+// end finishes the run, whether it completed, failed to update the job or
+// was stopped: it cancels its next step, gives up its scheduler slot and warm
+// VMs, and stops tracking it. Containers it still executes are cancelled and
+// waited for by Stop. end does nothing if the run has already ended.
+func (r *run) end() {
+	if r.ended {
+		return
+	}
+	r.ended = true
+	r.loop.Cancel(r.timer)
+	r.cancel()
+
+	r.scheduler.finish(r.ticket, r.now)
+	if r.warm > 0 {
+		r.plan.WarmPool.release(r.warm)
+	}
+	r.span.End()
+
+	r.mu.Lock()
+	if r.runners[r.job.Name] == r {
+		delete(r.runners, r.job.Name)
+	}
+	r.mu.Unlock()
+}
+
+// grow creates the tasks added to the task groups of the job since they had
+// the task counts in before, PENDING, and hands them the free slots of their
+// group the way release does. Before the run has loaded its tasks, it only
+// creates them for begin to pick up.
+func (r *run) grow(before map[string]int64) error {
+	loaded := r.pending != nil
+	var added []*api.Task
+	for _, taskGroup := range r.job.TaskGroups {
+		from := before[taskGroup.Name]
+		if taskGroup.TaskCount <= from {
+			continue
+		}
+		if g := r.lazyGroup(taskGroup.Name); g != nil {
+			r.growWaves(g, taskGroup.TaskCount)
+			continue
+		}
+		if !loaded {
+			if _, err := r.store.GetTaskProgress(r.job.Name, taskGroup.Name); err == nil {
+				continue
+			}
+		}
+		for index := from; index < taskGroup.TaskCount; index++ {
+			task := &api.Task{
+				Name: fmt.Sprintf("%s/taskGroups/%s/tasks/%d", r.job.Name, taskGroup.Name, index),
+				Status: &api.TaskStatus{
+					State: api.TaskStatePending,
+					StatusEvents: []*api.StatusEvent{
+						{Type: "task_created", Description: "Task created", EventTime: r.now},
+					},
+				},
+			}
+			if err := r.store.CreateTask(r.job.Name, task); err != nil {
+				return err
+			}
+			added = append(added, task)
+		}
+	}
+	if !loaded {
+		return nil
+	}
+	r.tasks = append(r.tasks, added...)
+
+	// Scripted tasks run along with the job rather than in slots.
+	if r.plan.Scenario != nil {
+		if r.job.State == api.JobStateRunning {
+			for _, task := range added {
+				r.setTaskState(task, api.TaskStateAssigned, "task_assigned", r.assignedDescription(task))
+				r.setTaskState(task, api.TaskStateRunning, "task_started", "Task started running")
+			}
+		}
+		return nil
+	}
+
+	for _, task := range added {
+		group := TaskGroupName(task.Name)
+		r.pending[group] = append(r.pending[group], task)
+	}
+	switch {
+	case r.started:
+		for _, taskGroup := range r.job.TaskGroups {
+			group := taskGroup.Name
+			for int64(r.active[group]) < parallelism(taskGroup) && len(r.pending[group]) > 0 {
+				task := r.pending[group][0]
+				r.pending[group] = r.pending[group][1:]
+				r.setTaskState(task, api.TaskStateAssigned, "task_assigned", r.assignedDescription(task))
+				r.active[group]++
+				r.startAttempt(task, r.now)
+			}
+		}
+	case r.assigned:
+		r.firstWave = append(r.firstWave, r.assign(r.firstWave)...)
+	}
+	return nil
+}
+
+// assign moves pending tasks to ASSIGNED until every group has as many tasks
+// as its parallelism allows, counting the held tasks that already have a
+// slot, and returns the tasks it assigned.
+func (r *run) assign(held []*api.Task) []*api.Task {
+	slots := make(map[string]int64)
+	for _, task := range held {
+		slots[TaskGroupName(task.Name)]++
+	}
+
+	var assigned []*api.Task
+	for _, taskGroup := range r.job.TaskGroups {
+		for i := slots[taskGroup.Name]; i < parallelism(taskGroup) && len(r.pending[taskGroup.Name]) > 0; i++ {
+			task := r.pending[taskGroup.Name][0]
+			r.pending[taskGroup.Name] = r.pending[taskGroup.Name][1:]
+			r.setTaskState(task, api.TaskStateAssigned, "task_assigned", r.assignedDescription(task))
+			assigned = append(assigned, task)
+		}
+	}
+	return assigned
+}
+
+// assignedDescription describes the assignment of task to its simulated
+// instance, in the format of the service's task events.
+func (r *run) assignedDescription(task *api.Task) string {
+	instance := TaskInstance(r.job, task.Name)
+	return fmt.Sprintf("Task assigned to VM on zones/%s/instances/%s", instance.Zone, instance.Name)
+}
+
+// parallelism returns how many tasks of the group may run at once. Unset
+// parallelism means all of them. IN_ORDER groups run one task at a time so
+// that each task starts only after the previous index has finished.
+func parallelism(taskGroup *api.TaskGroup) int64 {
+	if taskGroup.SchedulingPolicy == api.SchedulingPolicyInOrder {
+		return 1
+	}
+	if taskGroup.Parallelism > 0 {
+		return taskGroup.Parallelism
+	}
+	return taskGroup.TaskCount
+}
+
+// startAttempt moves task to RUNNING at the given time and starts its first
+// attempt. The caller must already have counted the task as active.
+func (r *run) startAttempt(task *api.Task, at time.Time) {
+	r.setTaskState(task, api.TaskStateRunning, "task_started", "Task started running")
+	r.advance(r.newAttempt(task, 1), 0, at)
+}
+
+// resumeAttempt restarts the attempt a RUNNING task was in when its
+// simulation stopped. The attempt number carries over from the retries
+// recorded in its status events. The caller must already have counted the
+// task as active.
+func (r *run) resumeAttempt(task *api.Task, at time.Time) {
+	number := int32(1)
+	for _, event := range task.Status.StatusEvents {
+		if event.Type == "task_retried" {
+			number++
+		}
+	}
+	r.addTaskEvent(task, "task_resumed", fmt.Sprintf("Task attempt %d restarted after the simulation resumed", number))
+	r.advance(r.newAttempt(task, number), 0, at)
+}
+
+// next times the run's next step: the end of the earliest simulated
+// runnable or wave, or the next progress event, whichever comes first.
+// Executed runnables post their completions themselves. Once every task has
+// reached a terminal state the job completes.
+func (r *run) next() {
+	if r.attempts.Len() == 0 && r.executing == 0 && !r.wavesRunning() {
+		r.complete()
+		r.end()
+		return
+	}
+
+	var at time.Time
+	timed := r.attempts.Len() > 0
+	if timed {
+		at = r.attempts[0].endAt
+	}
+	for _, g := range r.lazy {
+		if !g.endAt.IsZero() && (!timed || g.endAt.Before(at)) {
+			at, timed = g.endAt, true
+		}
+	}
+	progress := r.progressEvery > 0 && (!timed || r.progressAt.Before(at))
+	if progress {
+		at, timed = r.progressAt, true
+	}
+	if !timed {
+		r.loop.Cancel(r.timer)
+		return
+	}
+
+	r.after(at, func() {
+		if progress {
+			r.reportProgress(at)
+		} else {
+			r.endSteps(at)
+			r.endWaves(at)
+		}
+		r.step()
+	})
+}
+
+// step saves the job after a step of the run, refreshing its task counts,
+// and times the next one. The run ends if the job vanished.
+func (r *run) step() {
+	if !r.save() {
+		r.end()
+		return
+	}
+	r.next()
+}
+
+// endSteps ends every simulated runnable due by at.
+func (r *run) endSteps(at time.Time) {
+	r.now = at
+	for r.attempts.Len() > 0 && !r.attempts[0].endAt.After(at) {
+		r.endStep(heap.Pop(&r.attempts).(*attempt), at)
+	}
+}
+
+// finishAttempt ends a task attempt once all of its runnables are done.
+// Failed attempts are retried in the same slot until the group's
+// maxRetryCount is exhausted; once the task is terminal its slot goes to the
+// group's next pending task.
+func (r *run) finishAttempt(a *attempt, at time.Time) {
+	if !a.failed {
+		r.setTaskStateWith(a.task, api.TaskStateSucceeded, r.exitEvent("task_completed", "Task completed successfully", 0))
+		r.release(a.group, at)
+		return
+	}
+
+	description := fmt.Sprintf("Task failed with exit code %d on attempt %d", a.exitCode, a.number)
+	if a.reason != "" {
+		description += ": " + a.reason
+	}
+	retries := r.maxRetries[a.group]
+	if a.number > retries {
+		r.setTaskStateWith(a.task, api.TaskStateFailed, r.exitEvent("task_failed", description, a.exitCode))
+		r.release(a.group, at)
+		return
+	}
+
+	r.recordTaskEvent(a.task, r.exitEvent("task_failed", description, a.exitCode))
+	r.setTaskState(a.task, api.TaskStateRunning, "task_retried", fmt.Sprintf("Task retry %d of %d started", a.number, retries))
+	r.advance(r.newAttempt(a.task, a.number+1), 0, at)
+}
+
+// release frees the slot of a task that has reached a terminal state and
+// hands it to the group's next pending task, if any.
+func (r *run) release(group string, at time.Time) {
+	r.active[group]--
+
+	if len(r.pending[group]) > 0 {
+		task := r.pending[group][0]
+		r.pending[group] = r.pending[group][1:]
+		r.setTaskState(task, api.TaskStateAssigned, "task_assigned", r.assignedDescription(task))
+		r.active[group]++
+		r.startAttempt(task, at)
+	}
+
+	// The finished task no longer holds up tasks waiting at a barrier.
+	r.releaseBarrier(group, at)
+}
+
+// complete moves the job to its terminal state once all tasks have finished.
+func (r *run) complete() {
+	if r.ctx.Err() != nil {
+		return
+	}
+
+	failed := 0
+	for _, task := range r.tasks {
+		if task.Status.State == api.TaskStateFailed {
+			failed++
+		}
+	}
+	for _, g := range r.lazy {
+		failed += int(g.progress.Failed)
+	}
+
+	var saved bool
+	if failed > 0 {
+		saved = r.setJobStateWith(api.JobStateFailed, r.jobFailedEvent(fmt.Sprintf("Job failed: %d task(s) failed", failed)))
+	} else {
+		saved = r.setJobState(api.JobStateSucceeded, "job_completed", "Job completed successfully")
+	}
+	if !saved {
+		return
+	}
+	r.completed()
+}
+
+// setJobState transitions the job, records a status event, refreshes the
+// task group counts and persists it. It returns false if the transition is
+// invalid, the run was cancelled or the job no longer exists, in which case
+// the run should stop.
+func (r *run) setJobState(state api.JobState, eventType, description string) bool {
+	return r.setJobStateWith(state, &api.StatusEvent{Type: eventType, Description: description})
+}
+
+// jobFailedEvent returns the job_failed event of a job whose tasks failed,
+// with the exit code of the first of them.
+func (r *run) jobFailedEvent(description string) *api.StatusEvent {
+	event := &api.StatusEvent{Type: "job_failed", Description: description, TaskExecution: r.failedExecution}
+	if event.TaskExecution != nil {
+		return event
+	}
+	// The tasks may have failed before the job was resumed.
+	for _, task := range r.tasks {
+		if exitCode, ok := task.Status.ExitCode(); ok && task.Status.State == api.TaskStateFailed {
+			event.TaskExecution = &api.TaskExecution{ExitCode: exitCode}
+			break
+		}
+	}
+	return event
+}
+
+// setJobStateWith is setJobState recording event, whose time is set to the
+// run's.
+func (r *run) setJobStateWith(state api.JobState, event *api.StatusEvent) bool {
+	if r.ctx.Err() != nil {
+		return false
+	}
+	if !CanTransitionJob(r.job.State, state) {
+		logrus.Errorf("Invalid job transition for %s: %s -> %s", r.job.Name, r.job.State, state)
+		return false
+	}
+
+	now := r.now
+	r.job.State = state
+	r.job.UpdateTime = now
+	r.job.Status.State = state
+	if state == api.JobStateScheduled {
+		r.allocateInstances()
+	}
+	if final(state) {
+		r.job.Status.RunDuration = runDuration(r.job, now)
+	}
+	event.EventTime = now
+	r.job.Status.StatusEvents = append(r.job.Status.StatusEvents, event)
+
+	if !r.save() {
+		return false
+	}
+	r.transitioned(nil)
+	return true
+}
+
+// runDuration returns how long job has been RUNNING at end, from the event
+// of it starting to run, formatted like a google.protobuf.Duration. It
+// returns "" for a job that never ran.
+func runDuration(job *api.Job, end time.Time) string {
+	for _, event := range job.Status.StatusEvents {
+		if event.Type == "job_started" {
+			return api.FormatDuration(end.Sub(event.EventTime))
+		}
+	}
+	return ""
+}
+
+// transitioned calls the transition hooks for a state change of task, or of
+// the job if task is nil.
+func (r *run) transitioned(task *api.Task) {
+	if task == nil {
+		r.span.AddEvent("job "+string(r.job.State), r.now)
+	} else {
+		r.span.AddEvent("task "+string(task.Status.State), r.now, tracing.Attribute{Key: "batch.task", Value: task.Name})
+	}
+	r.notifyTransition(task)
+}
+
+// save refreshes the task group counts and persists the job. It returns
+// false if the run was cancelled or the job no longer exists.
+func (r *run) save() bool {
+	if r.ctx.Err() != nil {
+		return false
+	}
+	r.updateCounts()
+
+	if err := r.store.UpdateJob(r.job); err != nil {
+		logrus.Errorf("Failed to update job state: %v", err)
+		return false
+	}
+	return true
+}
+
+// setTaskState transitions a task and records a status event.
+func (r *run) setTaskState(task *api.Task, state api.TaskState, eventType, description string) {
+	r.setTaskStateWith(task, state, &api.StatusEvent{Type: eventType, Description: description, EventTime: r.now})
+}
+
+// setTaskStateWith is setTaskState recording event.
+func (r *run) setTaskStateWith(task *api.Task, state api.TaskState, event *api.StatusEvent) {
+	if r.ctx.Err() != nil {
+		return
+	}
+	if !CanTransitionTask(task.Status.State, state) {
+		logrus.Errorf("Invalid task transition for %s: %s -> %s", task.Name, task.Status.State, state)
+		return
+	}
+
+	from := task.Status.State
+	changed := from != state
+	task.Status.State = state
+	if changed {
+		r.recount(task, from)
+	}
+	if state == api.TaskStateFailed && event.TaskExecution != nil && r.failedExecution == nil {
+		r.failedExecution = event.TaskExecution
+	}
+	r.recordTaskEvent(task, event)
+	if state == api.TaskStateSucceeded || state == api.TaskStateFailed {
+		r.closeLog(task)
+	}
+	if changed {
+		r.transitioned(task)
+	}
+}
+
+// addTaskEvent records a task status event without changing its state.
+func (r *run) addTaskEvent(task *api.Task, eventType, description string) {
+	r.recordTaskEvent(task, &api.StatusEvent{Type: eventType, Description: description, EventTime: r.now})
+}
+
+// exitEvent returns a task status event for an attempt that ended with
+// exitCode.
+func (r *run) exitEvent(eventType, description string, exitCode int) *api.StatusEvent {
+	return &api.StatusEvent{
+		Type:          eventType,
+		Description:   description,
+		EventTime:     r.now,
+		TaskExecution: &api.TaskExecution{ExitCode: int32(exitCode)},
+	}
+}
+
+// recordTaskEvent records event on task without changing its state.
+func (r *run) recordTaskEvent(task *api.Task, event *api.StatusEvent) {
+	if r.ctx.Err() != nil {
+		return
+	}
+	task.Status.StatusEvents = append(task.Status.StatusEvents, event)
+
+	if err := r.store.UpdateTask(r.job.Name, task); err != nil {
+		logrus.Errorf("Failed to update task %s: %v", task.Name, err)
+	}
+}
+
+// recount moves task, which just left state from, to its new state in the
+// counts of its group, so that they follow every task transition rather than
+// only the job's saves. The job is the run's own; the store keeps a copy.
+func (r *run) recount(task *api.Task, from api.TaskState) {
+	group := TaskGroupName(task.Name)
+	status, ok := r.job.Status.TaskGroups[group]
+	if !ok || status.Counts == nil {
+		r.updateCounts()
+		return
+	}
+	if status.Counts[string(from)]--; status.Counts[string(from)] <= 0 {
+		delete(status.Counts, string(from))
+	}
+	status.Counts[string(task.Status.State)]++
+}
+
+// updateCounts recomputes the per-group task state counts of the job.
+func (r *run) updateCounts() {
+	if r.job.Status.TaskGroups == nil {
+		r.job.Status.TaskGroups = make(map[string]*api.TaskGroupStatus)
+	}
+	for name, groupCounts := range TaskCounts(r.job, r.tasks) {
+		r.job.Status.TaskGroups[name] = &api.TaskGroupStatus{Counts: groupCounts, Instances: r.groupInstances(name)}
+	}
+	for _, g := range r.lazy {
+		r.job.Status.TaskGroups[g.name] = &api.TaskGroupStatus{Counts: g.counts(), Instances: r.groupInstances(g.name)}
+	}
+}
+
+// groupInstances returns the instances reported in the status of group.
+func (r *run) groupInstances(group string) []*api.InstanceStatus {
+	if status, ok := r.job.Status.TaskGroups[group]; ok {
+		return status.Instances
+	}
+	return nil
+}
+
+// allocateInstances reports the VMs the tasks of each group run on in the
+// status of the group, like the service does once the job is scheduled.
+func (r *run) allocateInstances() {
+	if r.job.Status.TaskGroups == nil {
+		r.job.Status.TaskGroups = make(map[string]*api.TaskGroupStatus)
+	}
+	for _, taskGroup := range r.job.TaskGroups {
+		counts := map[string]int64{}
+		if status, ok := r.job.Status.TaskGroups[taskGroup.Name]; ok {
+			counts = status.Counts
+		}
+		r.job.Status.TaskGroups[taskGroup.Name] = &api.TaskGroupStatus{Counts: counts, Instances: instanceStatuses(r.job, taskGroup)}
+	}
+}
+
+// TaskCounts counts the tasks of each of job's task groups by state. Every
+// group has an entry, even if it has no tasks.
+func TaskCounts(job *api.Job, tasks []*api.Task) map[string]map[string]int64 {
+	counts := make(map[string]map[string]int64, len(job.TaskGroups))
+	for _, taskGroup := range job.TaskGroups {
+		counts[taskGroup.Name] = make(map[string]int64)
+	}
+	for _, task := range tasks {
+		if groupCounts, ok := counts[TaskGroupName(task.Name)]; ok {
+			groupCounts[string(task.Status.State)]++
+		}
+	}
+	return counts
+}
+
+// TaskGroupName extracts the task group from a task name of the form
+// .../taskGroups/{group}/tasks/{index}.
+func TaskGroupName(taskName string) string {
+	const marker = "/taskGroups/"
+	i := strings.LastIndex(taskName, marker)
+	if i < 0 {
+		return ""
+	}
+	rest := taskName[i+len(marker):]
+	if j := strings.Index(rest, "/"); j >= 0 {
+		return rest[:j]
+	}
+	return rest
+}
+
+// TaskIndex extracts the index from a task name of the form
+// .../tasks/{index}. It returns -1 if the name has no numeric index.
+func TaskIndex(taskName string) int64 {
+	i := strings.LastIndex(taskName, "/")
+	index, err := strconv.ParseInt(taskName[i+1:], 10, 64)
+	if err != nil {
+		return -1
+	}
+	return index
+}
+
+// sortTasks orders tasks by group name and then numerically by index.
+func sortTasks(tasks []*api.Task) {
+	sort.Slice(tasks, func(i, j int) bool {
+		gi, gj := TaskGroupName(tasks[i].Name), TaskGroupName(tasks[j].Name)
+		if gi != gj {
+			return gi < gj
+		}
+		return TaskIndex(tasks[i].Name) < TaskIndex(tasks[j].Name)
+	})
+}
+
+// attempt is a single run of a task.
+type attempt struct {
+	task   *api.Task
+	group  string
+	number int32
+	// step is the index of the runnable in progress or being waited on at a
+	// barrier.
+	step int
+	// fail is the index of the runnable that fails this attempt, and ignored
+	// the index of one whose failure is ignored, or -1.
+	fail    int
+	ignored int
+	// failed is set once a runnable has failed; from then on only alwaysRun
+	// runnables execute. exitCode is the exit code of that runnable, and
+	// reason, if set, explains the failure.
+	failed   bool
+	exitCode int
+	reason   string
+	// deadline is when the attempt reaches its task's maxRunDuration, or
+	// zero for no limit.
+	deadline time.Time
+	// preemptAfter is how long after it starts the attempt's Spot VM is
+	// preempted, and preemptAt when, or zero if it is not.
+	preemptAfter time.Duration
+	preemptAt    time.Time
+	// extra is how much longer than their share of the RUNNING time each of
+	// the attempt's simulated runnables runs, for the run's jitter.
+	extra time.Duration
+	// endAt is when the current simulated runnable ends, and cause why.
+	endAt time.Time
+	cause stopCause
+	seq   int
+}
+
+// attemptQueue is a min-heap of attempts ordered by end time, then by the
+// order they were started.
+type attemptQueue []*attempt
+
+func (q attemptQueue) Len() int { return len(q) }
+
+func (q attemptQueue) Less(i, j int) bool {
+	if !q[i].endAt.Equal(q[j].endAt) {
+		return q[i].endAt.Before(q[j].endAt)
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q attemptQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *attemptQueue) Push(x interface{}) { *q = append(*q, x.(*attempt)) }
+
+func (q *attemptQueue) Pop() interface{} {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return item
+}
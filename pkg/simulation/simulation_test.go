@@ -0,0 +1,749 @@
+package simulation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+	"github.com/pyshx/fake-batch-server/pkg/clock"
+	"github.com/pyshx/fake-batch-server/pkg/storage"
+)
+
+// newTestJob stores a queued job the way CreateJob does and returns it.
+func newTestJob(t *testing.T, store *storage.MemoryStore, createTime time.Time, groups ...*api.TaskGroup) *api.Job {
+	job := &api.Job{
+		Name:       fmt.Sprintf("projects/p/locations/l/jobs/job-%d", len(store.Snapshot().Jobs)),
+		State:      api.JobStateQueued,
+		CreateTime: createTime,
+		TaskGroups: groups,
+		Status: &api.JobStatus{
+			State:      api.JobStateQueued,
+			TaskGroups: make(map[string]*api.TaskGroupStatus),
+		},
+	}
+	require.NoError(t, store.CreateJob(job))
+	return job
+}
+
+func setupFakeEngine() (*Engine, *storage.MemoryStore, *clock.Fake) {
+	store := storage.NewMemoryStore()
+	fake := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	return NewEngine(store, fake, DefaultTimings()), store, fake
+}
+
+// waitForJobState waits for the named job to reach state and returns it as
+// stored then.
+func waitForJobState(t *testing.T, store *storage.MemoryStore, name string, state api.JobState) *api.Job {
+	t.Helper()
+	var job *api.Job
+	require.Eventually(t, func() bool {
+		var err error
+		job, err = store.GetJob(name)
+		return err == nil && job.State == state
+	}, time.Second, time.Millisecond)
+	return job
+}
+
+func TestEngine_StateMachine(t *testing.T) {
+	engine, store, fake := setupFakeEngine()
+	job := newTestJob(t, store, fake.Now(), &api.TaskGroup{Name: "group1", TaskCount: 2})
+
+	engine.Start(job, &Plan{})
+
+	fake.Advance(time.Second)
+	scheduled := waitForJobState(t, store, job.Name, api.JobStateScheduled)
+	tasks, _ := store.ListTasks(job.Name)
+	for _, task := range tasks {
+		assert.Equal(t, api.TaskStateAssigned, task.Status.State)
+	}
+	assert.Equal(t, int64(2), scheduled.Status.TaskGroups["group1"].Counts["ASSIGNED"])
+
+	fake.Advance(time.Second)
+	waitForJobState(t, store, job.Name, api.JobStateRunning)
+	tasks, _ = store.ListTasks(job.Name)
+	for _, task := range tasks {
+		assert.Equal(t, api.TaskStateRunning, task.Status.State)
+	}
+
+	fake.Advance(5 * time.Second)
+	job = waitForJobState(t, store, job.Name, api.JobStateSucceeded)
+	tasks, _ = store.ListTasks(job.Name)
+	sortTasks(tasks)
+
+	var eventTypes []string
+	for _, event := range job.Status.StatusEvents {
+		eventTypes = append(eventTypes, event.Type)
+	}
+	assert.Equal(t, []string{"job_scheduled", "job_started", "job_completed"}, eventTypes)
+	assert.Equal(t, "5s", job.Status.RunDuration)
+
+	eventTypes = nil
+	for _, event := range tasks[0].Status.StatusEvents {
+		eventTypes = append(eventTypes, event.Type)
+	}
+	assert.Equal(t, []string{"task_created", "task_assigned", "task_started", "task_completed"}, eventTypes)
+}
+
+func TestEngine_CustomTimings(t *testing.T) {
+	store := storage.NewMemoryStore()
+	engine := NewEngine(store, clock.Real(), Timings{States: map[api.JobState]time.Duration{
+		api.JobStateQueued:    10 * time.Millisecond,
+		api.JobStateScheduled: 10 * time.Millisecond,
+		api.JobStateRunning:   10 * time.Millisecond,
+	}})
+
+	job := newTestJob(t, store, time.Now(), &api.TaskGroup{Name: "group1", TaskCount: 2})
+	engine.Start(job, &Plan{})
+
+	waitForJobState(t, store, job.Name, api.JobStateSucceeded)
+}
+
+func TestEngine_Progress(t *testing.T) {
+	store := storage.NewMemoryStore()
+	fake := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	timings := DefaultTimings()
+	timings.Progress = 2 * time.Second
+	engine := NewEngine(store, fake, timings)
+
+	// The tasks run one after another from 2s to 7s and from 7s to 12s
+	job := newTestJob(t, store, fake.Now(), &api.TaskGroup{Name: "group1", TaskCount: 2, Parallelism: 1})
+	engine.Start(job, &Plan{})
+
+	fake.Advance(time.Minute)
+	job = waitForJobState(t, store, job.Name, api.JobStateSucceeded)
+
+	var progress []string
+	for _, event := range job.Status.StatusEvents {
+		if event.Type == "job_progress" {
+			progress = append(progress, fmt.Sprintf("%s %s", event.EventTime.Sub(job.CreateTime), event.Description))
+		}
+	}
+	assert.Equal(t, []string{
+		"4s Scaled to 1 instances; 0 of 2 tasks complete, 1 running",
+		"6s Scaled to 1 instances; 0 of 2 tasks complete, 1 running",
+		"8s Scaled to 1 instances; 1 of 2 tasks complete, 1 running",
+		"10s Scaled to 1 instances; 1 of 2 tasks complete, 1 running",
+	}, progress)
+}
+
+func TestEngine_Resume(t *testing.T) {
+	engine, store, fake := setupFakeEngine()
+
+	// Left RUNNING by a previous engine an hour ago: task 0 is done, task 1
+	// is on its second attempt and task 2 still waits for a slot.
+	job := newTestJob(t, store, fake.Now().Add(-time.Hour), &api.TaskGroup{
+		Name: "group1", TaskCount: 3, Parallelism: 2,
+		TaskSpec: &api.TaskSpec{MaxRetryCount: 2},
+	})
+	job.State = api.JobStateRunning
+	job.Status.State = api.JobStateRunning
+	tasks, err := store.ListTasks(job.Name)
+	require.NoError(t, err)
+	sortTasks(tasks)
+	tasks[0].Status.State = api.TaskStateSucceeded
+	tasks[1].Status.State = api.TaskStateRunning
+	tasks[1].Status.StatusEvents = append(tasks[1].Status.StatusEvents, &api.StatusEvent{Type: "task_retried"})
+	require.NoError(t, store.UpdateJob(job))
+	for _, task := range tasks[:2] {
+		require.NoError(t, store.UpdateTask(job.Name, task))
+	}
+
+	resumedAt := fake.Now()
+	engine.Resume(job, &Plan{})
+
+	fake.Advance(time.Minute)
+	job = waitForJobState(t, store, job.Name, api.JobStateSucceeded)
+	tasks, err = store.ListTasks(job.Name)
+	require.NoError(t, err)
+	sortTasks(tasks)
+
+	for _, event := range job.Status.StatusEvents {
+		assert.NotEqual(t, "job_scheduled", event.Type, "a resumed RUNNING job is not scheduled again")
+	}
+
+	resumed := tasks[1].Status.StatusEvents
+	assert.Equal(t, "task_resumed", resumed[2].Type)
+	assert.Equal(t, "Task attempt 2 restarted after the simulation resumed", resumed[2].Description)
+	assert.Equal(t, resumedAt.Add(5*time.Second), resumed[len(resumed)-1].EventTime)
+
+	assigned := tasks[2].Status.StatusEvents
+	assert.Equal(t, "task_assigned", assigned[1].Type)
+	assert.Equal(t, resumedAt, assigned[1].EventTime)
+	assert.Equal(t, api.TaskStateSucceeded, tasks[2].Status.State)
+	assert.Len(t, tasks[0].Status.StatusEvents, 1, "finished tasks are left alone")
+}
+
+func TestEngine_ResumeScheduled(t *testing.T) {
+	engine, store, fake := setupFakeEngine()
+
+	job := newTestJob(t, store, fake.Now().Add(-time.Hour), &api.TaskGroup{Name: "group1", TaskCount: 1})
+	job.State = api.JobStateScheduled
+	job.Status.State = api.JobStateScheduled
+	tasks, err := store.ListTasks(job.Name)
+	require.NoError(t, err)
+	tasks[0].Status.State = api.TaskStateAssigned
+	require.NoError(t, store.UpdateTask(job.Name, tasks[0]))
+	require.NoError(t, store.UpdateJob(job))
+
+	resumedAt := fake.Now()
+	engine.Resume(job, &Plan{})
+
+	fake.Advance(time.Minute)
+	job = waitForJobState(t, store, job.Name, api.JobStateSucceeded)
+
+	started := job.Status.StatusEvents[0]
+	assert.Equal(t, "job_started", started.Type)
+	assert.Equal(t, resumedAt.Add(time.Second), started.EventTime, "provisioning restarts from the resume time")
+}
+
+func TestEngine_Recover(t *testing.T) {
+	store := storage.NewMemoryStore()
+	fake := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	engine := NewEngine(store, fake, Timings{States: map[api.JobState]time.Duration{
+		api.JobStateQueued:    10 * time.Second,
+		api.JobStateScheduled: 10 * time.Second,
+		api.JobStateRunning:   5 * time.Second,
+	}})
+	recoveredAt := fake.Now()
+
+	// Queued 4s before the restart, it has 6s left to wait.
+	queued := newTestJob(t, store, recoveredAt.Add(-4*time.Second), &api.TaskGroup{Name: "group1", TaskCount: 1})
+	// Queued long enough ago that it would have been scheduled already.
+	overdue := newTestJob(t, store, recoveredAt.Add(-time.Hour), &api.TaskGroup{Name: "group1", TaskCount: 1})
+	// Scheduled 3s before the restart, it has 7s of provisioning left.
+	scheduled := newTestJob(t, store, recoveredAt.Add(-time.Hour), &api.TaskGroup{Name: "group1", TaskCount: 1})
+	scheduled.State = api.JobStateScheduled
+	scheduled.Status.State = api.JobStateScheduled
+	scheduled.Status.StatusEvents = []*api.StatusEvent{{Type: "job_scheduled", EventTime: recoveredAt.Add(-3 * time.Second)}}
+	tasks, err := store.ListTasks(scheduled.Name)
+	require.NoError(t, err)
+	tasks[0].Status.State = api.TaskStateAssigned
+	require.NoError(t, store.UpdateTask(scheduled.Name, tasks[0]))
+	require.NoError(t, store.UpdateJob(scheduled))
+
+	for _, job := range []*api.Job{queued, overdue, scheduled} {
+		engine.Recover(job, &Plan{})
+	}
+	fake.Advance(time.Minute)
+	queued = waitForJobState(t, store, queued.Name, api.JobStateSucceeded)
+	overdue = waitForJobState(t, store, overdue.Name, api.JobStateSucceeded)
+	scheduled = waitForJobState(t, store, scheduled.Name, api.JobStateSucceeded)
+
+	eventTime := func(job *api.Job, eventType string) time.Time {
+		for _, event := range job.Status.StatusEvents {
+			if event.Type == eventType {
+				return event.EventTime
+			}
+		}
+		t.Fatalf("job %s has no %s event", job.Name, eventType)
+		return time.Time{}
+	}
+	assert.Equal(t, recoveredAt.Add(6*time.Second), eventTime(queued, "job_scheduled"))
+	assert.Equal(t, recoveredAt.Add(16*time.Second), eventTime(queued, "job_started"))
+	assert.Equal(t, recoveredAt, eventTime(overdue, "job_scheduled"))
+	assert.Equal(t, recoveredAt.Add(7*time.Second), eventTime(scheduled, "job_started"))
+}
+
+func TestEngine_Update(t *testing.T) {
+	engine, store, fake := setupFakeEngine()
+	job := newTestJob(t, store, fake.Now(),
+		&api.TaskGroup{Name: "group1", TaskCount: 2},
+		&api.TaskGroup{Name: "group2", TaskCount: 2000, Parallelism: 1000})
+	startedAt := fake.Now()
+
+	updated, err := engine.Update(job.Name, func(*api.Job) error { return nil })
+	require.NoError(t, err)
+	assert.False(t, updated, "the job is not simulated yet")
+
+	engine.Start(job, &Plan{})
+	fake.Advance(2 * time.Second)
+	waitForJobState(t, store, job.Name, api.JobStateRunning)
+
+	// The added tasks of a RUNNING job take the free slots of their group
+	// while the attempts in progress carry on.
+	fake.Advance(time.Second)
+	updated, err = engine.Update(job.Name, func(job *api.Job) error {
+		job.Labels = map[string]string{"team": "ml"}
+		job.TaskGroups[0].TaskCount = 3
+		job.TaskGroups[1].TaskCount = 2500
+		return nil
+	})
+	require.NoError(t, err)
+	assert.True(t, updated)
+	stored, err := store.GetJob(job.Name)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"team": "ml"}, stored.Labels)
+	assert.Equal(t, map[string]int64{"RUNNING": 3}, stored.Status.TaskGroups["group1"].Counts)
+	assert.Equal(t, map[string]int64{"RUNNING": 1000, "PENDING": 1500}, stored.Status.TaskGroups["group2"].Counts)
+
+	// A failed update changes nothing.
+	updated, err = engine.Update(job.Name, func(job *api.Job) error { return errors.New("invalid") })
+	assert.True(t, updated)
+	assert.Error(t, err)
+
+	fake.Advance(time.Minute)
+	job = waitForJobState(t, store, job.Name, api.JobStateSucceeded)
+	assert.Equal(t, map[string]int64{"SUCCEEDED": 3}, job.Status.TaskGroups["group1"].Counts)
+	assert.Equal(t, map[string]int64{"SUCCEEDED": 2500}, job.Status.TaskGroups["group2"].Counts)
+	completed := job.Status.StatusEvents[len(job.Status.StatusEvents)-1]
+	assert.Equal(t, startedAt.Add(17*time.Second), completed.EventTime, "the added wave runs after the first two")
+
+	tasks, err := store.ListTasks(job.Name)
+	require.NoError(t, err)
+	sortTasks(tasks)
+	var eventTypes []string
+	for _, event := range tasks[0].Status.StatusEvents {
+		eventTypes = append(eventTypes, event.Type)
+	}
+	assert.Equal(t, []string{"task_created", "task_assigned", "task_started", "task_completed"}, eventTypes)
+	assert.Equal(t, startedAt.Add(7*time.Second), tasks[0].Status.StatusEvents[3].EventTime)
+	assert.Equal(t, startedAt.Add(3*time.Second), tasks[2].Status.StatusEvents[2].EventTime, "the added task starts right away")
+
+	require.Eventually(t, func() bool { return !engine.Running(job.Name) }, time.Second, time.Millisecond)
+	updated, _ = engine.Update(job.Name, func(*api.Job) error { return nil })
+	assert.False(t, updated, "the simulation has ended")
+}
+
+func TestEngine_TaskRetries(t *testing.T) {
+	engine, store, fake := setupFakeEngine()
+	job := newTestJob(t, store, fake.Now(), &api.TaskGroup{
+		Name:      "group1",
+		TaskSpec:  &api.TaskSpec{MaxRetryCount: 2},
+		TaskCount: 2,
+	})
+
+	engine.Start(job, &Plan{TaskFailureRate: 1})
+
+	fake.Advance(time.Minute)
+	job = waitForJobState(t, store, job.Name, api.JobStateFailed)
+	assert.Equal(t, int64(2), job.Status.TaskGroups["group1"].Counts["FAILED"])
+
+	tasks, _ := store.ListTasks(job.Name)
+	for _, task := range tasks {
+		assert.Equal(t, api.TaskStateFailed, task.Status.State)
+
+		var failures, retries int
+		for _, event := range task.Status.StatusEvents {
+			switch event.Type {
+			case "task_failed":
+				failures++
+			case "task_retried":
+				retries++
+			}
+		}
+		assert.Equal(t, 3, failures)
+		assert.Equal(t, 2, retries)
+	}
+}
+
+func TestEngine_Parallelism(t *testing.T) {
+	engine, store, fake := setupFakeEngine()
+	job := newTestJob(t, store, fake.Now(), &api.TaskGroup{Name: "group1", TaskCount: 3, Parallelism: 1})
+	tasks, _ := store.ListTasks(job.Name)
+	sortTasks(tasks)
+
+	waitForTaskStates := func(states ...api.TaskState) {
+		t.Helper()
+		require.Eventually(t, func() bool {
+			for i, task := range tasks {
+				current, err := store.GetTask(job.Name, task.Name)
+				if err != nil || current.Status.State != states[i] {
+					return false
+				}
+			}
+			return true
+		}, time.Second, time.Millisecond)
+	}
+
+	engine.Start(job, &Plan{})
+
+	fake.Advance(time.Second)
+	waitForJobState(t, store, job.Name, api.JobStateScheduled)
+	waitForTaskStates(api.TaskStateAssigned, api.TaskStatePending, api.TaskStatePending)
+
+	fake.Advance(time.Second)
+	waitForJobState(t, store, job.Name, api.JobStateRunning)
+	waitForTaskStates(api.TaskStateRunning, api.TaskStatePending, api.TaskStatePending)
+
+	fake.Advance(5 * time.Second)
+	waitForTaskStates(api.TaskStateSucceeded, api.TaskStateRunning, api.TaskStatePending)
+
+	fake.Advance(5 * time.Second)
+	waitForTaskStates(api.TaskStateSucceeded, api.TaskStateSucceeded, api.TaskStateRunning)
+
+	fake.Advance(5 * time.Second)
+	job = waitForJobState(t, store, job.Name, api.JobStateSucceeded)
+	assert.Equal(t, int64(3), job.Status.TaskGroups["group1"].Counts["SUCCEEDED"])
+}
+
+func TestEngine_InOrder(t *testing.T) {
+	engine, store, fake := setupFakeEngine()
+	job := newTestJob(t, store, fake.Now(), &api.TaskGroup{
+		Name:             "group1",
+		TaskCount:        3,
+		Parallelism:      3,
+		SchedulingPolicy: api.SchedulingPolicyInOrder,
+	})
+
+	engine.Start(job, &Plan{})
+	fake.Advance(time.Minute)
+	waitForJobState(t, store, job.Name, api.JobStateSucceeded)
+
+	tasks, _ := store.ListTasks(job.Name)
+	sortTasks(tasks)
+
+	eventTime := func(task *api.Task, eventType string) time.Time {
+		for _, event := range task.Status.StatusEvents {
+			if event.Type == eventType {
+				return event.EventTime
+			}
+		}
+		t.Fatalf("task %s has no %s event", task.Name, eventType)
+		return time.Time{}
+	}
+
+	// Each task starts exactly when the previous one completes.
+	start := job.CreateTime.Add(2 * time.Second)
+	for _, task := range tasks {
+		assert.Equal(t, start, eventTime(task, "task_started"), task.Name)
+		start = start.Add(5 * time.Second)
+		assert.Equal(t, start, eventTime(task, "task_completed"), task.Name)
+	}
+}
+
+func TestEngine_LazyTasks(t *testing.T) {
+	engine, store, fake := setupFakeEngine()
+	job := newTestJob(t, store, fake.Now(), &api.TaskGroup{Name: "group1", TaskCount: 100000, Parallelism: 40000})
+	taskState := func(index int) api.TaskState {
+		task, err := store.GetTask(job.Name, fmt.Sprintf("%s/taskGroups/group1/tasks/%d", job.Name, index))
+		require.NoError(t, err)
+		return task.Status.State
+	}
+
+	engine.Start(job, &Plan{})
+
+	fake.Advance(time.Second)
+	job = waitForJobState(t, store, job.Name, api.JobStateScheduled)
+	assert.Equal(t, map[string]int64{"ASSIGNED": 40000, "PENDING": 60000}, job.Status.TaskGroups["group1"].Counts)
+	assert.Equal(t, api.TaskStateAssigned, taskState(39999))
+	assert.Equal(t, api.TaskStatePending, taskState(40000))
+
+	// The tasks run in waves of 40000.
+	fake.Advance(time.Second)
+	waitForJobState(t, store, job.Name, api.JobStateRunning)
+	fake.Advance(5 * time.Second)
+	require.Eventually(t, func() bool { return taskState(40000) == api.TaskStateRunning }, time.Second, time.Millisecond)
+	assert.Equal(t, api.TaskStateSucceeded, taskState(0))
+	assert.Equal(t, api.TaskStatePending, taskState(80000))
+
+	fake.Advance(10 * time.Second)
+	job = waitForJobState(t, store, job.Name, api.JobStateSucceeded)
+	assert.Equal(t, map[string]int64{"SUCCEEDED": 100000}, job.Status.TaskGroups["group1"].Counts)
+	task, err := store.GetTask(job.Name, job.Name+"/taskGroups/group1/tasks/99999")
+	require.NoError(t, err)
+	assert.Equal(t, fake.Now(), task.Status.StatusEvents[3].EventTime)
+
+	// Only the tasks that failed are stored.
+	failing := newTestJob(t, store, fake.Now(), &api.TaskGroup{
+		Name:      "group1",
+		TaskSpec:  &api.TaskSpec{MaxRetryCount: 1},
+		TaskCount: 1001,
+	})
+	engine.Start(failing, &Plan{TaskFailureRate: 1})
+	fake.Advance(time.Minute)
+	failing = waitForJobState(t, store, failing.Name, api.JobStateFailed)
+	assert.Equal(t, map[string]int64{"FAILED": 1001}, failing.Status.TaskGroups["group1"].Counts)
+	task, err = store.GetTask(failing.Name, failing.Name+"/taskGroups/group1/tasks/1000")
+	require.NoError(t, err)
+	var eventTypes []string
+	for _, event := range task.Status.StatusEvents {
+		eventTypes = append(eventTypes, event.Type)
+	}
+	assert.Equal(t, []string{"task_created", "task_assigned", "task_started", "task_failed", "task_retried", "task_failed"}, eventTypes)
+}
+
+func TestEngine_StopsWhenJobDeleted(t *testing.T) {
+	engine, store, fake := setupFakeEngine()
+	job := newTestJob(t, store, fake.Now(), &api.TaskGroup{Name: "group1", TaskCount: 1})
+
+	engine.Start(job, &Plan{})
+	require.NoError(t, store.DeleteJob(job.Name))
+
+	fake.Advance(time.Minute)
+	_, err := store.GetJob(job.Name)
+	assert.Error(t, err)
+}
+
+func TestEngine_StopsWhenJobDeletedMidRun(t *testing.T) {
+	engine, store, fake := setupFakeEngine()
+	job := newTestJob(t, store, fake.Now(), &api.TaskGroup{Name: "group1", TaskCount: 2})
+
+	engine.Start(job, &Plan{})
+	fake.Advance(2 * time.Second)
+	waitForJobState(t, store, job.Name, api.JobStateRunning)
+
+	// The run notices the deletion at its next step and ends without
+	// recreating the job or leaving events queued.
+	require.NoError(t, store.DeleteJob(job.Name))
+	fake.Advance(time.Minute)
+	require.Eventually(t, func() bool { return !engine.Running(job.Name) }, time.Second, time.Millisecond)
+	assert.Equal(t, 0, engine.Stats().Events)
+	_, err := store.GetJob(job.Name)
+	assert.Error(t, err)
+	_, err = store.ListTasks(job.Name)
+	assert.Error(t, err)
+}
+
+func TestEngine_Stop(t *testing.T) {
+	engine, store, fake := setupFakeEngine()
+	job := newTestJob(t, store, fake.Now(), &api.TaskGroup{Name: "group1", TaskCount: 1})
+
+	engine.Start(job, &Plan{})
+	assert.Equal(t, 1, engine.Stats().Runners)
+
+	assert.True(t, engine.Stop(job.Name))
+	assert.False(t, engine.Stop(job.Name))
+	assert.Equal(t, 0, engine.Stats().Runners)
+	assert.Equal(t, 0, engine.Stats().Events)
+
+	// A stopped run makes no further updates.
+	fake.Advance(time.Minute)
+	stored, err := store.GetJob(job.Name)
+	require.NoError(t, err)
+	assert.Equal(t, api.JobStateQueued, stored.State)
+	assert.Empty(t, stored.Status.StatusEvents)
+}
+
+func TestEngine_OnComplete(t *testing.T) {
+	engine, store, fake := setupFakeEngine()
+	completed := make(chan api.JobState, 2)
+	engine.OnComplete(func(ctx context.Context, job *api.Job) {
+		completed <- job.State
+	})
+
+	succeeding := newTestJob(t, store, fake.Now(), &api.TaskGroup{Name: "group1", TaskCount: 1})
+	failing := newTestJob(t, store, fake.Now(), &api.TaskGroup{Name: "group1", TaskCount: 1})
+	engine.Start(succeeding, &Plan{})
+	engine.Start(failing, &Plan{TaskFailureRate: 1})
+	fake.Advance(time.Minute)
+
+	states := []api.JobState{<-completed, <-completed}
+	assert.ElementsMatch(t, []api.JobState{api.JobStateSucceeded, api.JobStateFailed}, states)
+}
+
+func TestEngine_OnTransition(t *testing.T) {
+	engine, store, fake := setupFakeEngine()
+	var transitions []string
+	engine.OnTransition(func(ctx context.Context, transition Transition) {
+		if transition.Task != nil {
+			transitions = append(transitions, "task "+string(transition.Task.Status.State))
+		} else {
+			transitions = append(transitions, "job "+string(transition.Job.State))
+		}
+	})
+
+	job := newTestJob(t, store, fake.Now(), &api.TaskGroup{
+		Name:      "group1",
+		TaskCount: 1,
+		TaskSpec:  &api.TaskSpec{MaxRetryCount: 1},
+	})
+	engine.Start(job, &Plan{TaskFailureRate: 1})
+	fake.Advance(time.Minute)
+	waitForJobState(t, store, job.Name, api.JobStateFailed)
+	engine.Shutdown()
+
+	// The retry keeps the task RUNNING, which is not a change.
+	assert.Equal(t, []string{
+		"task ASSIGNED",
+		"job SCHEDULED",
+		"task RUNNING",
+		"job RUNNING",
+		"task FAILED",
+		"job FAILED",
+	}, transitions)
+}
+
+func TestEngine_SlowHooks(t *testing.T) {
+	engine, store, fake := setupFakeEngine()
+	release := make(chan struct{})
+	engine.OnTransition(func(ctx context.Context, transition Transition) { <-release })
+	completed := make(chan *api.Job, 1)
+	engine.OnComplete(func(ctx context.Context, job *api.Job) { completed <- job })
+
+	// Simulations and Stop carry on while the hooks are stuck.
+	done := newTestJob(t, store, fake.Now(), &api.TaskGroup{Name: "group1", TaskCount: 2})
+	stopped := newTestJob(t, store, fake.Now(), &api.TaskGroup{Name: "group1", TaskCount: 1})
+	engine.Start(done, &Plan{})
+	engine.Start(stopped, &Plan{})
+	fake.Advance(2 * time.Second)
+	assert.True(t, engine.Stop(stopped.Name))
+	fake.Advance(time.Minute)
+	waitForJobState(t, store, done.Name, api.JobStateSucceeded)
+
+	close(release)
+	job := <-completed
+	assert.Equal(t, done.Name, job.Name)
+	assert.Equal(t, api.JobStateSucceeded, job.State)
+	engine.Shutdown()
+}
+
+func TestEngine_LiveCounts(t *testing.T) {
+	store := storage.NewMemoryStore()
+	fake := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	engine := NewEngine(store, fake, DefaultTimings().Merge(Timings{Jitter: 10 * time.Second}))
+	defer engine.Shutdown()
+
+	// Every task transition is reflected in the job's counts right away.
+	var mixed bool
+	engine.OnTransition(func(ctx context.Context, transition Transition) {
+		if transition.Task == nil {
+			return
+		}
+		counts := transition.Job.Status.TaskGroups["group1"].Counts
+		total := int64(0)
+		for _, n := range counts {
+			total += n
+		}
+		assert.Equal(t, int64(10), total)
+		assert.Positive(t, counts[string(transition.Task.Status.State)])
+		mixed = mixed || counts["RUNNING"] > 0 && counts["SUCCEEDED"] > 0
+	})
+
+	job := newTestJob(t, store, fake.Now(), &api.TaskGroup{Name: "group1", TaskCount: 10})
+	engine.Start(job, &Plan{})
+	fake.Advance(time.Minute)
+	waitForJobState(t, store, job.Name, api.JobStateSucceeded)
+	// Shutting down waits for the hooks to return.
+	engine.Shutdown()
+
+	// With jitter, the tasks started together finish apart.
+	assert.True(t, mixed)
+	tasks, err := store.ListTasks(job.Name)
+	require.NoError(t, err)
+	ends := make(map[time.Time]bool)
+	for _, task := range tasks {
+		ends[task.Status.StatusEvents[len(task.Status.StatusEvents)-1].EventTime] = true
+	}
+	assert.Greater(t, len(ends), 1)
+}
+
+func TestEngine_Shutdown(t *testing.T) {
+	engine, store, fake := setupFakeEngine()
+	for i := 0; i < 3; i++ {
+		engine.Start(newTestJob(t, store, fake.Now(), &api.TaskGroup{Name: "group1", TaskCount: 1}), &Plan{})
+	}
+
+	cancelled := make(chan struct{})
+	engine.Go(func(ctx context.Context) {
+		<-ctx.Done()
+		close(cancelled)
+	})
+
+	stats := engine.Stats()
+	assert.Equal(t, 3, stats.Runners)
+	assert.Equal(t, 1, stats.Background)
+
+	engine.Shutdown()
+	<-cancelled
+	stats = engine.Stats()
+	assert.Equal(t, 0, stats.Runners)
+	assert.Equal(t, 0, stats.Background)
+
+	// Nothing starts after shutdown.
+	engine.Start(newTestJob(t, store, fake.Now(), &api.TaskGroup{Name: "group1", TaskCount: 1}), &Plan{})
+	assert.Equal(t, 0, engine.Stats().Runners)
+}
+
+func TestEngine_Reset(t *testing.T) {
+	engine, store, fake := setupFakeEngine()
+	engine.Start(newTestJob(t, store, fake.Now(), &api.TaskGroup{Name: "group1", TaskCount: 1}), &Plan{})
+
+	cancelled := make(chan struct{})
+	engine.Go(func(ctx context.Context) {
+		<-ctx.Done()
+		close(cancelled)
+	})
+
+	engine.Reset()
+	<-cancelled
+	stats := engine.Stats()
+	assert.Equal(t, 0, stats.Runners)
+	assert.Equal(t, 0, stats.Background)
+
+	// Unlike after Shutdown, new jobs are simulated.
+	job := newTestJob(t, store, fake.Now(), &api.TaskGroup{Name: "group1", TaskCount: 1})
+	engine.Start(job, &Plan{})
+	fake.Advance(time.Minute)
+	waitForJobState(t, store, job.Name, api.JobStateSucceeded)
+
+	engine.Shutdown()
+	engine.Reset()
+	engine.Start(newTestJob(t, store, fake.Now(), &api.TaskGroup{Name: "group1", TaskCount: 1}), &Plan{})
+	assert.Equal(t, 0, engine.Stats().Runners)
+}
+
+func TestTransitions(t *testing.T) {
+	assert.True(t, CanTransitionJob(api.JobStateQueued, api.JobStateScheduled))
+	assert.False(t, CanTransitionJob(api.JobStateQueued, api.JobStateRunning))
+	assert.False(t, CanTransitionJob(api.JobStateSucceeded, api.JobStateRunning))
+
+	assert.True(t, CanTransitionTask(api.TaskStatePending, api.TaskStateAssigned))
+	assert.False(t, CanTransitionTask(api.TaskStatePending, api.TaskStateRunning))
+	assert.True(t, CanTransitionTask(api.TaskStateRunning, api.TaskStateRunning))
+}
+
+func TestNewPlan(t *testing.T) {
+	defaults := Plan{TaskFailureRate: 0.5}
+
+	plan, err := NewPlan(&api.Job{}, defaults, "")
+	require.NoError(t, err)
+	assert.Equal(t, 0.5, plan.TaskFailureRate)
+
+	plan, err = NewPlan(&api.Job{Labels: map[string]string{TaskFailureRateLabel: "0.25"}}, defaults, "")
+	require.NoError(t, err)
+	assert.Equal(t, 0.25, plan.TaskFailureRate)
+
+	plan, err = NewPlan(&api.Job{Labels: map[string]string{SpotPreemptionRateLabel: "0.1"}}, defaults, "")
+	require.NoError(t, err)
+	assert.Equal(t, 0.1, plan.SpotPreemptionRate)
+
+	plan, err = NewPlan(&api.Job{Labels: map[string]string{FinalStateLabel: "FAILED"}}, defaults, "")
+	require.NoError(t, err)
+	assert.Equal(t, 1.0, plan.TaskFailureRate)
+
+	plan, err = NewPlan(&api.Job{Labels: map[string]string{FinalStateLabel: "FAILED"}}, defaults, "SUCCEEDED")
+	require.NoError(t, err)
+	assert.Equal(t, 0.0, plan.TaskFailureRate)
+
+	_, err = NewPlan(&api.Job{Labels: map[string]string{TaskFailureRateLabel: "2"}}, defaults, "")
+	assert.Error(t, err)
+
+	_, err = NewPlan(&api.Job{Labels: map[string]string{SpotPreemptionRateLabel: "-1"}}, defaults, "")
+	assert.Error(t, err)
+
+	_, err = NewPlan(&api.Job{}, defaults, "RUNNING")
+	assert.Error(t, err)
+}
+
+func TestTaskNameHelpers(t *testing.T) {
+	name := "projects/p/locations/l/jobs/j/taskGroups/group0/tasks/12"
+	assert.Equal(t, "group0", TaskGroupName(name))
+	assert.Equal(t, int64(12), TaskIndex(name))
+	assert.Equal(t, int64(-1), TaskIndex("projects/p/locations/l/jobs/j"))
+
+	tasks := []*api.Task{
+		{Name: "jobs/j/taskGroups/b/tasks/0"},
+		{Name: "jobs/j/taskGroups/a/tasks/10"},
+		{Name: "jobs/j/taskGroups/a/tasks/2"},
+	}
+	sortTasks(tasks)
+	assert.Equal(t, "jobs/j/taskGroups/a/tasks/2", tasks[0].Name)
+	assert.Equal(t, "jobs/j/taskGroups/a/tasks/10", tasks[1].Name)
+	assert.Equal(t, "jobs/j/taskGroups/b/tasks/0", tasks[2].Name)
+}
@@ -0,0 +1,100 @@
+package simulation
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+)
+
+// Timings controls how long a simulated job remains in each state before
+// moving on to the next one.
+type Timings struct {
+	// States maps a job state to the time spent in it. QUEUED, SCHEDULED,
+	// RUNNING, DELETING and CANCELLATION_IN_PROGRESS are timed; RUNNING is
+	// the length of a single task attempt.
+	States map[api.JobState]time.Duration `yaml:"states"`
+	// Progress is the interval between the progress events a RUNNING job
+	// records. Zero disables them.
+	Progress time.Duration `yaml:"progress"`
+	// Jitter is the most a task attempt runs past RUNNING, drawn at random
+	// for each attempt, so that tasks started together finish apart. Zero
+	// runs every attempt for exactly RUNNING.
+	Jitter time.Duration `yaml:"jitter"`
+}
+
+// DefaultTimings returns the timings used when none are configured.
+func DefaultTimings() Timings {
+	return Timings{
+		States: map[api.JobState]time.Duration{
+			api.JobStateQueued:                 1 * time.Second,
+			api.JobStateScheduled:              1 * time.Second,
+			api.JobStateRunning:                5 * time.Second,
+			api.JobStateDeleting:               2 * time.Second,
+			api.JobStateCancellationInProgress: 1 * time.Second,
+		},
+	}
+}
+
+// LoadTimings reads per-state timing overrides from a YAML or JSON file,
+// e.g.:
+//
+//	states:
+//	  QUEUED: 100ms
+//	  SCHEDULED: 50ms
+//	  RUNNING: 250ms
+//	progress: 50ms
+//	jitter: 100ms
+func LoadTimings(path string) (Timings, error) {
+	var timings Timings
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return timings, err
+	}
+
+	if err := yaml.Unmarshal(data, &timings); err != nil {
+		return timings, fmt.Errorf("failed to parse simulation config %s: %v", path, err)
+	}
+
+	for state, d := range timings.States {
+		if d < 0 {
+			return timings, fmt.Errorf("negative duration %s for state %s", d, state)
+		}
+	}
+	if timings.Progress < 0 {
+		return timings, fmt.Errorf("negative progress interval %s", timings.Progress)
+	}
+	if timings.Jitter < 0 {
+		return timings, fmt.Errorf("negative jitter %s", timings.Jitter)
+	}
+
+	return timings, nil
+}
+
+// Merge returns a copy of t with the states, progress interval and jitter
+// set in overrides replaced.
+func (t Timings) Merge(overrides Timings) Timings {
+	merged := Timings{States: make(map[api.JobState]time.Duration), Progress: t.Progress, Jitter: t.Jitter}
+	if overrides.Progress != 0 {
+		merged.Progress = overrides.Progress
+	}
+	if overrides.Jitter != 0 {
+		merged.Jitter = overrides.Jitter
+	}
+	for state, d := range t.States {
+		merged.States[state] = d
+	}
+	for state, d := range overrides.States {
+		merged.States[state] = d
+	}
+	return merged
+}
+
+// Duration returns the time a job spends in state.
+func (t Timings) Duration(state api.JobState) time.Duration {
+	return t.States[state]
+}
@@ -0,0 +1,40 @@
+package simulation
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+)
+
+func TestLoadTimings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sim.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("states:\n  QUEUED: 10ms\n  RUNNING: 1s\nprogress: 200ms\njitter: 3s\n"), 0o644))
+
+	timings, err := LoadTimings(path)
+	require.NoError(t, err)
+
+	merged := DefaultTimings().Merge(timings)
+	assert.Equal(t, 10*time.Millisecond, merged.Duration(api.JobStateQueued))
+	assert.Equal(t, time.Second, merged.Duration(api.JobStateScheduled))
+	assert.Equal(t, time.Second, merged.Duration(api.JobStateRunning))
+	assert.Equal(t, 2*time.Second, merged.Duration(api.JobStateDeleting))
+	assert.Equal(t, 200*time.Millisecond, merged.Progress)
+	assert.Equal(t, 3*time.Second, merged.Jitter)
+}
+
+func TestLoadTimings_Invalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sim.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("states:\n  QUEUED: -1s\n"), 0o644))
+
+	_, err := LoadTimings(path)
+	assert.Error(t, err)
+
+	_, err = LoadTimings(filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.Error(t, err)
+}
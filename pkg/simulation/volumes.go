@@ -0,0 +1,265 @@
+package simulation
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+)
+
+// Buckets gives access to the Cloud Storage buckets of GCS volumes, e.g.
+// those of a fake-gcs-server.
+type Buckets interface {
+	// BucketExists reports whether bucket exists.
+	BucketExists(ctx context.Context, bucket string) (bool, error)
+	// Download copies the objects of bucket under prefix into dir.
+	Download(ctx context.Context, bucket, prefix, dir string) error
+	// Upload copies the files in dir to bucket under prefix.
+	Upload(ctx context.Context, bucket, prefix, dir string) error
+}
+
+// SetBuckets makes the engine check the buckets of GCS volumes with b before
+// each task attempt runs, failing the attempt like the service's agent does
+// if one is missing. Container runnables run by the engine's Executor get a
+// local copy of each volume they mount, synced back to the bucket once they
+// exit. It must be called before any job is started.
+func (e *Engine) SetBuckets(b Buckets) {
+	e.buckets = b
+}
+
+// SetVolumesRoot makes the engine resolve the paths on the VM that container
+// runnables mount, other than those of GCS volumes backed by its Buckets,
+// under the host directory root rather than the filesystem root. It must be
+// called before any job is started.
+func (e *Engine) SetVolumesRoot(root string) {
+	e.volumesRoot = root
+}
+
+// gcsVolumes returns the GCS volumes of group.
+func (r *run) gcsVolumes(group string) []*api.Volume {
+	var volumes []*api.Volume
+	for _, taskGroup := range r.job.TaskGroups {
+		if taskGroup.Name != group || taskGroup.TaskSpec == nil {
+			continue
+		}
+		for _, volume := range taskGroup.TaskSpec.Volumes {
+			if volume != nil && volume.GCS != nil {
+				volumes = append(volumes, volume)
+			}
+		}
+	}
+	return volumes
+}
+
+// splitRemotePath splits the remotePath of a GCS volume, e.g.
+// "bucket/data/input", into its bucket and the prefix of its objects.
+func splitRemotePath(remotePath string) (bucket, prefix string) {
+	bucket, prefix, _ = strings.Cut(strings.TrimPrefix(remotePath, "gs://"), "/")
+	return bucket, strings.Trim(prefix, "/")
+}
+
+// bindOptions are the mount options a Docker bind mount takes besides ro and
+// rw. Other options, e.g. those of NFS or gcsfuse, do not apply to binds.
+var bindOptions = map[string]bool{
+	"z": true, "Z": true, "nocopy": true,
+	"shared": true, "rshared": true, "slave": true, "rslave": true, "private": true, "rprivate": true,
+}
+
+// mountOptions splits the mountOptions of a volume into whether it is
+// mounted read-only and the bind options that apply.
+func mountOptions(options []string) (readOnly bool, binds []string) {
+	for _, option := range options {
+		option = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(option), "-o "))
+		switch {
+		case option == "ro":
+			readOnly = true
+		case bindOptions[option]:
+			binds = append(binds, option)
+		}
+	}
+	return readOnly, binds
+}
+
+// volumeMount is a mount of a container before the path on the VM it mounts
+// is resolved to a directory of the host.
+type volumeMount struct {
+	vmPath   string
+	target   string
+	readOnly bool
+	options  []string
+}
+
+// mountError is an error mounting a volume into a container.
+type mountError struct {
+	err error
+}
+
+func (e *mountError) Error() string {
+	return e.err.Error()
+}
+
+// containerMounts returns the mounts of container, a runnable of group: those
+// its volumes list as "VM_PATH:CONTAINER_PATH[:OPTIONS]", or, like the
+// service, every volume of the task at its mountPath if it lists none.
+func (r *run) containerMounts(group string, container *api.Container) ([]volumeMount, error) {
+	var mounts []volumeMount
+	if len(container.Volumes) == 0 {
+		for _, taskGroup := range r.job.TaskGroups {
+			if taskGroup.Name != group || taskGroup.TaskSpec == nil {
+				continue
+			}
+			for _, volume := range taskGroup.TaskSpec.Volumes {
+				if volume == nil || volume.MountPath == "" {
+					continue
+				}
+				m := volumeMount{vmPath: volume.MountPath, target: volume.MountPath}
+				m.readOnly, m.options = mountOptions(volume.MountOptions)
+				mounts = append(mounts, m)
+			}
+		}
+		return mounts, nil
+	}
+
+	for _, spec := range container.Volumes {
+		parts := strings.Split(spec, ":")
+		if len(parts) < 2 || len(parts) > 3 || !path.IsAbs(parts[0]) || !path.IsAbs(parts[1]) {
+			return nil, &mountError{fmt.Errorf("%q: must be VM_PATH:CONTAINER_PATH[:OPTIONS] with absolute paths", spec)}
+		}
+		m := volumeMount{vmPath: parts[0], target: parts[1]}
+		if len(parts) == 3 {
+			m.readOnly, m.options = mountOptions(strings.Split(parts[2], ","))
+		}
+		mounts = append(mounts, m)
+	}
+	return mounts, nil
+}
+
+// under returns the path of p relative to dir, reporting false if p is not
+// dir or below it.
+func under(p, dir string) (string, bool) {
+	p, dir = path.Clean(p), path.Clean(dir)
+	if p == dir {
+		return "", true
+	}
+	rel, ok := strings.CutPrefix(p, strings.TrimSuffix(dir, "/")+"/")
+	return rel, ok
+}
+
+// checkVolumes returns an error naming the first missing bucket of group's
+// GCS volumes. Buckets are checked once per run; a bucket that cannot be
+// checked is assumed to exist.
+func (r *run) checkVolumes(group string) error {
+	if r.buckets == nil {
+		return nil
+	}
+	if err, ok := r.volumeErrors[group]; ok {
+		return err
+	}
+
+	var err error
+	for _, volume := range r.gcsVolumes(group) {
+		bucket, _ := splitRemotePath(volume.GCS.RemotePath)
+		exists, checkErr := r.buckets.BucketExists(r.ctx, bucket)
+		if checkErr != nil {
+			logrus.Warnf("Failed to check bucket %s of job %s: %v", bucket, r.job.Name, checkErr)
+			continue
+		}
+		if !exists {
+			err = fmt.Errorf("gs://%s at %s: bucket %s does not exist", volume.GCS.RemotePath, volume.MountPath, bucket)
+			break
+		}
+	}
+	if r.volumeErrors == nil {
+		r.volumeErrors = make(map[string]error)
+	}
+	r.volumeErrors[group] = err
+	return err
+}
+
+// failMount fails a before any of its runnables runs, as its volumes could
+// not be mounted. It is retried like any other failed attempt.
+func (r *run) failMount(a *attempt, err error, at time.Time) {
+	r.log(a.task, 0, "Failed to mount volume %v", err)
+	r.addTaskEvent(a.task, "volume_mount_failed", fmt.Sprintf("Failed to mount volume %v", err))
+	a.failed = true
+	a.exitCode = -1
+	a.reason = "a volume could not be mounted"
+	r.finishAttempt(a, at)
+}
+
+// executeWithVolumes runs execution with mounts bound to directories of the
+// host: the local copy of the GCS volume of volumes mounted at or above their
+// path on the VM, or that path under the engine's volumes root. The copies
+// of the GCS volumes not mounted read-only are synced back once the
+// container exits. Errors mounting a volume are *mountError.
+func (r *run) executeWithVolumes(ctx context.Context, execution *Execution, mounts []volumeMount, volumes []*api.Volume) (int, error) {
+	// copies holds the local copies of the GCS volumes used, by volume.
+	copies := make(map[*api.Volume]string)
+	defer func() {
+		for _, dir := range copies {
+			os.RemoveAll(dir)
+		}
+	}()
+	for _, m := range mounts {
+		source, err := r.hostPath(ctx, m.vmPath, volumes, copies)
+		if err != nil {
+			return 0, &mountError{err}
+		}
+		execution.Mounts = append(execution.Mounts, Mount{Source: source, Target: m.target, ReadOnly: m.readOnly, Options: m.options})
+	}
+
+	exitCode, err := r.executor.Run(ctx, execution)
+	for _, volume := range volumes {
+		dir, ok := copies[volume]
+		if readOnly, _ := mountOptions(volume.MountOptions); !ok || readOnly {
+			continue
+		}
+		bucket, prefix := splitRemotePath(volume.GCS.RemotePath)
+		if uploadErr := r.buckets.Upload(r.ctx, bucket, prefix, dir); uploadErr != nil {
+			logrus.Errorf("Failed to sync %s back to gs://%s: %v", volume.MountPath, volume.GCS.RemotePath, uploadErr)
+		}
+	}
+	return exitCode, err
+}
+
+// hostPath returns the directory of the host backing vmPath, creating it if
+// needed. A GCS volume of volumes is downloaded into copies the first time a
+// path at or below its mountPath is used.
+func (r *run) hostPath(ctx context.Context, vmPath string, volumes []*api.Volume, copies map[*api.Volume]string) (string, error) {
+	for _, volume := range volumes {
+		rel, ok := under(vmPath, volume.MountPath)
+		if !ok {
+			continue
+		}
+		dir, ok := copies[volume]
+		if !ok {
+			var err error
+			if dir, err = os.MkdirTemp("", "fake-batch-gcs-"); err != nil {
+				return "", err
+			}
+			copies[volume] = dir
+			bucket, prefix := splitRemotePath(volume.GCS.RemotePath)
+			if err := r.buckets.Download(ctx, bucket, prefix, dir); err != nil {
+				return "", fmt.Errorf("gs://%s at %s: %v", volume.GCS.RemotePath, volume.MountPath, err)
+			}
+		}
+		dir = filepath.Join(dir, filepath.FromSlash(rel))
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return "", fmt.Errorf("%s: %v", vmPath, err)
+		}
+		return dir, nil
+	}
+
+	dir := filepath.Join(r.volumesRoot, filepath.FromSlash(vmPath))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", fmt.Errorf("%s: %v", vmPath, err)
+	}
+	return dir, nil
+}
@@ -0,0 +1,260 @@
+package simulation
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+)
+
+// stubBuckets holds the objects of its buckets, by bucket and object name,
+// and counts the existence checks.
+type stubBuckets struct {
+	mu      sync.Mutex
+	objects map[string]map[string]string
+	checks  int
+}
+
+func (s *stubBuckets) BucketExists(_ context.Context, bucket string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checks++
+	_, ok := s.objects[bucket]
+	return ok, nil
+}
+
+func (s *stubBuckets) Download(_ context.Context, bucket, prefix, dir string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, data := range s.objects[bucket] {
+		if rel, ok := strings.CutPrefix(name, prefix+"/"); ok {
+			if err := os.WriteFile(filepath.Join(dir, rel), []byte(data), 0o644); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *stubBuckets) Upload(_ context.Context, bucket, prefix, dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+		s.objects[bucket][filepath.Join(prefix, entry.Name())] = string(data)
+	}
+	return nil
+}
+
+// mountingExecutor reads input.txt from the first mount of each execution
+// and writes output.txt next to it.
+type mountingExecutor struct {
+	mu     sync.Mutex
+	mounts [][]Mount
+}
+
+func (m *mountingExecutor) Run(_ context.Context, execution *Execution) (int, error) {
+	m.mu.Lock()
+	m.mounts = append(m.mounts, execution.Mounts)
+	m.mu.Unlock()
+	input, err := os.ReadFile(filepath.Join(execution.Mounts[0].Source, "input.txt"))
+	if err != nil {
+		return 1, nil
+	}
+	return 0, os.WriteFile(filepath.Join(execution.Mounts[0].Source, "output.txt"), append(input, " processed"...), 0o644)
+}
+
+func TestEngine_MissingBucket(t *testing.T) {
+	engine, store, fake := setupFakeEngine()
+	buckets := &stubBuckets{objects: map[string]map[string]string{"present": {}}}
+	engine.SetBuckets(buckets)
+
+	job := newTestJob(t, store, fake.Now(), &api.TaskGroup{
+		Name:      "group1",
+		TaskCount: 2,
+		TaskSpec: &api.TaskSpec{
+			MaxRetryCount: 1,
+			Runnables:     []*api.Runnable{{}},
+			Volumes: []*api.Volume{
+				{GCS: &api.GCS{RemotePath: "present/data"}, MountPath: "/mnt/disks/present"},
+				{GCS: &api.GCS{RemotePath: "absent/data"}, MountPath: "/mnt/disks/absent"},
+			},
+		},
+	})
+
+	engine.Start(job, &Plan{})
+	fake.Advance(time.Minute)
+	waitForJobState(t, store, job.Name, api.JobStateFailed)
+
+	tasks, err := store.ListTasks(job.Name)
+	require.NoError(t, err)
+	for _, task := range tasks {
+		assert.Equal(t, api.TaskStateFailed, task.Status.State)
+		var mountFailures int
+		for _, event := range task.Status.StatusEvents {
+			assert.NotEqual(t, "runnable_started", event.Type, "no runnable runs")
+			if event.Type == "volume_mount_failed" {
+				mountFailures++
+				assert.Equal(t, "Failed to mount volume gs://absent/data at /mnt/disks/absent: bucket absent does not exist", event.Description)
+			}
+		}
+		assert.Equal(t, 2, mountFailures, "every attempt fails")
+	}
+	buckets.mu.Lock()
+	defer buckets.mu.Unlock()
+	assert.Equal(t, 2, buckets.checks, "the buckets are checked once per run")
+}
+
+func TestEngine_ExecutorVolumes(t *testing.T) {
+	engine, store, fake := setupFakeEngine()
+	buckets := &stubBuckets{objects: map[string]map[string]string{
+		"data":   {"jobs/input.txt": "hello"},
+		"shared": {},
+	}}
+	engine.SetBuckets(buckets)
+	executor := &mountingExecutor{}
+	engine.SetExecutor(executor)
+
+	job := newTestJob(t, store, fake.Now(), &api.TaskGroup{
+		Name:      "group1",
+		TaskCount: 1,
+		TaskSpec: &api.TaskSpec{
+			Runnables: []*api.Runnable{{Container: &api.Container{ImageURI: "process"}}},
+			Volumes: []*api.Volume{
+				{GCS: &api.GCS{RemotePath: "data/jobs"}, MountPath: "/mnt/disks/data"},
+				{GCS: &api.GCS{RemotePath: "shared"}, MountPath: "/mnt/disks/shared", MountOptions: []string{"-o ro"}},
+			},
+		},
+	})
+
+	engine.Start(job, &Plan{})
+	fake.Advance(time.Minute)
+	waitForJobState(t, store, job.Name, api.JobStateSucceeded)
+
+	executor.mu.Lock()
+	require.Len(t, executor.mounts, 1)
+	mounts := executor.mounts[0]
+	executor.mu.Unlock()
+	require.Len(t, mounts, 2)
+	assert.Equal(t, "/mnt/disks/data", mounts[0].Target)
+	assert.False(t, mounts[0].ReadOnly)
+	assert.Equal(t, "/mnt/disks/shared", mounts[1].Target)
+	assert.True(t, mounts[1].ReadOnly)
+
+	buckets.mu.Lock()
+	defer buckets.mu.Unlock()
+	assert.Equal(t, "hello processed", buckets.objects["data"]["jobs/output.txt"], "the volume is synced back")
+	assert.Empty(t, buckets.objects["shared"], "read-only volumes are not synced back")
+	_, err := os.Stat(mounts[0].Source)
+	assert.True(t, os.IsNotExist(err), "the local copy is removed")
+}
+
+func TestEngine_ContainerVolumes(t *testing.T) {
+	engine, store, fake := setupFakeEngine()
+	root := t.TempDir()
+	engine.SetVolumesRoot(root)
+	executor := &mountingExecutor{}
+	engine.SetExecutor(executor)
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "mnt/share/in"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "mnt/share/in/input.txt"), []byte("hello"), 0o644))
+
+	job := newTestJob(t, store, fake.Now(), &api.TaskGroup{
+		Name:      "group1",
+		TaskCount: 1,
+		TaskSpec: &api.TaskSpec{
+			Runnables: []*api.Runnable{{Container: &api.Container{
+				ImageURI: "process",
+				Volumes:  []string{"/mnt/share/in:/data", "/mnt/share/refs:/refs:ro,z,nolock"},
+			}}},
+			Volumes: []*api.Volume{
+				{NFS: &api.NFS{Server: "nfs", RemotePath: "/export"}, MountPath: "/mnt/share"},
+			},
+		},
+	})
+
+	engine.Start(job, &Plan{})
+	fake.Advance(time.Minute)
+	waitForJobState(t, store, job.Name, api.JobStateSucceeded)
+
+	executor.mu.Lock()
+	require.Len(t, executor.mounts, 1)
+	mounts := executor.mounts[0]
+	executor.mu.Unlock()
+	assert.Equal(t, []Mount{
+		{Source: filepath.Join(root, "mnt/share/in"), Target: "/data"},
+		{Source: filepath.Join(root, "mnt/share/refs"), Target: "/refs", ReadOnly: true, Options: []string{"z"}},
+	}, mounts)
+	output, err := os.ReadFile(filepath.Join(root, "mnt/share/in/output.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "hello processed", string(output))
+	assert.DirExists(t, filepath.Join(root, "mnt/share/refs"), "missing VM paths are created")
+}
+
+func TestEngine_InvalidContainerVolume(t *testing.T) {
+	engine, store, fake := setupFakeEngine()
+	engine.SetVolumesRoot(t.TempDir())
+	executor := &mountingExecutor{}
+	engine.SetExecutor(executor)
+
+	job := newTestJob(t, store, fake.Now(), &api.TaskGroup{
+		Name:      "group1",
+		TaskCount: 1,
+		TaskSpec: &api.TaskSpec{
+			Runnables: []*api.Runnable{{Container: &api.Container{ImageURI: "process", Volumes: []string{"data:/data"}}}},
+		},
+	})
+
+	engine.Start(job, &Plan{})
+	fake.Advance(time.Minute)
+	waitForJobState(t, store, job.Name, api.JobStateFailed)
+
+	executor.mu.Lock()
+	assert.Empty(t, executor.mounts, "the container is not run")
+	executor.mu.Unlock()
+	tasks, err := store.ListTasks(job.Name)
+	require.NoError(t, err)
+	require.Len(t, tasks, 1)
+	var mountFailed bool
+	for _, event := range tasks[0].Status.StatusEvents {
+		if event.Type == "volume_mount_failed" {
+			mountFailed = true
+			assert.Equal(t, `Failed to mount volume "data:/data": must be VM_PATH:CONTAINER_PATH[:OPTIONS] with absolute paths`, event.Description)
+		}
+	}
+	assert.True(t, mountFailed)
+}
+
+func TestMountOptions(t *testing.T) {
+	readOnly, binds := mountOptions([]string{"-o ro", "rw", "Z", "vers=4", "rslave"})
+	assert.True(t, readOnly)
+	assert.Equal(t, []string{"Z", "rslave"}, binds)
+
+	readOnly, binds = mountOptions(nil)
+	assert.False(t, readOnly)
+	assert.Empty(t, binds)
+}
+
+func TestSplitRemotePath(t *testing.T) {
+	bucket, prefix := splitRemotePath("bucket/data/input/")
+	assert.Equal(t, "bucket", bucket)
+	assert.Equal(t, "data/input", prefix)
+
+	bucket, prefix = splitRemotePath("gs://bucket")
+	assert.Equal(t, "bucket", bucket)
+	assert.Empty(t, prefix)
+}
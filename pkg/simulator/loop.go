@@ -0,0 +1,214 @@
+// Package simulator provides the central event loop the simulation engine
+// runs on: a priority queue of timed events processed in time order by a
+// single goroutine, instead of a sleeping goroutine per simulated job.
+package simulator
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+
+	"github.com/pyshx/fake-batch-server/pkg/clock"
+)
+
+// Loop calls scheduled functions once their time has come on the clock, one
+// at a time and in time order, on a goroutine of its own. Events due at the
+// same time run in the order they were scheduled. Events scheduled by a
+// running event for a time already reached run in the same pass, so
+// advancing a fake clock past several deadlines at once runs all of them.
+type Loop struct {
+	clock clock.Clock
+
+	mu     sync.Mutex
+	events queue
+	seq    int
+	closed bool
+
+	// wake is signalled when an event becomes the earliest one.
+	wake chan struct{}
+	quit chan struct{}
+	done chan struct{}
+}
+
+// Event is a function scheduled on a Loop.
+type Event struct {
+	at  time.Time
+	seq int
+	fn  func()
+	// index is the position of the event in the queue, or -1 once it has
+	// been removed.
+	index int
+}
+
+// New creates a Loop timed by clk and starts it.
+func New(clk clock.Clock) *Loop {
+	l := &Loop{
+		clock: clk,
+		wake:  make(chan struct{}, 1),
+		quit:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go l.run()
+	return l
+}
+
+// At schedules fn to run on the loop once the clock reaches at. A time
+// already reached runs fn as soon as the events before it are done. Events
+// scheduled after Close never run.
+func (l *Loop) At(at time.Time, fn func()) *Event {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.seq++
+	e := &Event{at: at, seq: l.seq, fn: fn, index: -1}
+	if l.closed {
+		return e
+	}
+	heap.Push(&l.events, e)
+	if e.index == 0 {
+		select {
+		case l.wake <- struct{}{}:
+		default:
+		}
+	}
+	return e
+}
+
+// Cancel removes e from the queue if it has not run yet. It does nothing if
+// e is nil.
+func (l *Loop) Cancel(e *Event) {
+	if e == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if e.index >= 0 {
+		heap.Remove(&l.events, e.index)
+	}
+}
+
+// Do runs fn on the loop as soon as the running event, if any, returns, and
+// waits for fn to return, letting other goroutines touch the state events
+// use without racing them. It must not be called from an event, which would
+// deadlock. Once the loop is closed, fn runs on the calling goroutine.
+func (l *Loop) Do(fn func()) {
+	ran := make(chan struct{})
+	l.At(time.Time{}, func() {
+		defer close(ran)
+		fn()
+	})
+
+	select {
+	case <-ran:
+	case <-l.done:
+		// The loop exited before getting to fn.
+		select {
+		case <-ran:
+		default:
+			fn()
+		}
+	}
+}
+
+// Len returns the number of events waiting to run.
+func (l *Loop) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return len(l.events)
+}
+
+// Close stops the loop and waits for the running event, if any, to return.
+// Events still queued are dropped. Close may be called more than once.
+func (l *Loop) Close() {
+	l.mu.Lock()
+	if !l.closed {
+		l.closed = true
+		close(l.quit)
+	}
+	for _, e := range l.events {
+		e.index = -1
+	}
+	l.events = nil
+	l.mu.Unlock()
+
+	<-l.done
+}
+
+// run processes events as they fall due until the loop is closed.
+func (l *Loop) run() {
+	defer close(l.done)
+
+	// timer fires at armed, the time of the earliest event when it was
+	// set. It is only replaced when an earlier event is scheduled, as the
+	// clock offers no way to stop it.
+	var timer <-chan time.Time
+	var armed time.Time
+	for {
+		l.mu.Lock()
+		for !l.closed && len(l.events) > 0 && !l.events[0].at.After(l.clock.Now()) {
+			e := heap.Pop(&l.events).(*Event)
+			l.mu.Unlock()
+			e.fn()
+			l.mu.Lock()
+		}
+		if l.closed {
+			l.mu.Unlock()
+			return
+		}
+		if len(l.events) > 0 {
+			next := l.events[0].at
+			if timer == nil || next.Before(armed) {
+				timer, armed = l.clock.After(next.Sub(l.clock.Now())), next
+			}
+			// The clock may have moved on while the timer was set.
+			if !next.After(l.clock.Now()) {
+				l.mu.Unlock()
+				continue
+			}
+		}
+		l.mu.Unlock()
+
+		select {
+		case <-timer:
+			timer = nil
+		case <-l.wake:
+		case <-l.quit:
+			return
+		}
+	}
+}
+
+// queue is a min-heap of events ordered by time, then by the order they were
+// scheduled.
+type queue []*Event
+
+func (q queue) Len() int { return len(q) }
+
+func (q queue) Less(i, j int) bool {
+	if !q[i].at.Equal(q[j].at) {
+		return q[i].at.Before(q[j].at)
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q queue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *queue) Push(x interface{}) {
+	e := x.(*Event)
+	e.index = len(*q)
+	*q = append(*q, e)
+}
+
+func (q *queue) Pop() interface{} {
+	old := *q
+	e := old[len(old)-1]
+	e.index = -1
+	*q = old[:len(old)-1]
+	return e
+}
@@ -0,0 +1,92 @@
+package simulator
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pyshx/fake-batch-server/pkg/clock"
+)
+
+// recorder collects the names of the events that ran.
+type recorder struct {
+	mu  sync.Mutex
+	ran []string
+}
+
+func (r *recorder) event(name string) func() {
+	return func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.ran = append(r.ran, name)
+	}
+}
+
+func (r *recorder) names() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.ran...)
+}
+
+func TestLoop_Order(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	fake := clock.NewFake(start)
+	loop := New(fake)
+	defer loop.Close()
+
+	var rec recorder
+	loop.At(start.Add(2*time.Second), rec.event("second"))
+	loop.At(start.Add(time.Second), func() {
+		rec.event("first")()
+		// Follow-ups already due run in the same pass.
+		loop.At(start.Add(1500*time.Millisecond), rec.event("follow-up"))
+	})
+	loop.At(start.Add(2*time.Second), rec.event("second, scheduled later"))
+	loop.At(start.Add(time.Hour), rec.event("later"))
+
+	fake.Advance(time.Minute)
+	require.Eventually(t, func() bool { return len(rec.names()) == 4 }, time.Second, time.Millisecond)
+	assert.Equal(t, []string{"first", "follow-up", "second", "second, scheduled later"}, rec.names())
+	assert.Equal(t, 1, loop.Len())
+}
+
+func TestLoop_Cancel(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	fake := clock.NewFake(start)
+	loop := New(fake)
+	defer loop.Close()
+
+	var rec recorder
+	cancelled := loop.At(start.Add(time.Second), rec.event("cancelled"))
+	loop.At(start.Add(2*time.Second), rec.event("kept"))
+	loop.Cancel(cancelled)
+	loop.Cancel(cancelled)
+	loop.Cancel(nil)
+
+	fake.Advance(time.Minute)
+	require.Eventually(t, func() bool { return len(rec.names()) == 1 }, time.Second, time.Millisecond)
+	assert.Equal(t, []string{"kept"}, rec.names())
+}
+
+func TestLoop_Do(t *testing.T) {
+	loop := New(clock.Real())
+
+	// Do waits for its function, which runs between events.
+	ran := false
+	loop.Do(func() { ran = true })
+	assert.True(t, ran)
+
+	var rec recorder
+	loop.At(time.Now().Add(time.Hour), rec.event("dropped"))
+	loop.Close()
+	loop.Close()
+	assert.Equal(t, 0, loop.Len())
+
+	// Once closed, nothing is scheduled and Do runs in place.
+	loop.At(time.Now(), rec.event("after close"))
+	loop.Do(rec.event("done"))
+	assert.Equal(t, []string{"done"}, rec.names())
+}
@@ -0,0 +1,160 @@
+// Package snapshot loads emulator state snapshots and reports what changed
+// between two of them.
+package snapshot
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+	"github.com/pyshx/fake-batch-server/pkg/storage"
+)
+
+// Load reads a snapshot written from GET /admin/snapshot.
+func Load(path string) (*storage.Snapshot, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var snap storage.Snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, fmt.Errorf("failed to parse snapshot %s: %v", path, err)
+	}
+
+	return &snap, nil
+}
+
+// JobRef identifies a job and the state it was in.
+type JobRef struct {
+	Name  string       `json:"name"`
+	State api.JobState `json:"state"`
+}
+
+// TaskTransition records a task whose state changed between snapshots.
+type TaskTransition struct {
+	Name string        `json:"name"`
+	From api.TaskState `json:"from"`
+	To   api.TaskState `json:"to"`
+}
+
+// JobTransition records a job present in both snapshots whose state, or the
+// state of any of its tasks, changed.
+type JobTransition struct {
+	Name  string           `json:"name"`
+	From  api.JobState     `json:"from"`
+	To    api.JobState     `json:"to"`
+	Tasks []TaskTransition `json:"tasks,omitempty"`
+}
+
+// Report is the structured difference between two snapshots.
+type Report struct {
+	Created      []JobRef        `json:"created"`
+	Deleted      []JobRef        `json:"deleted"`
+	Transitioned []JobTransition `json:"transitioned"`
+}
+
+// Diff compares two snapshots. Entries in each section are sorted by job name.
+func Diff(before, after *storage.Snapshot) *Report {
+	report := &Report{
+		Created:      []JobRef{},
+		Deleted:      []JobRef{},
+		Transitioned: []JobTransition{},
+	}
+
+	beforeJobs := indexJobs(before)
+	afterJobs := indexJobs(after)
+
+	for name, job := range afterJobs {
+		prev, existed := beforeJobs[name]
+		if !existed {
+			report.Created = append(report.Created, JobRef{Name: name, State: job.State})
+			continue
+		}
+
+		transition := JobTransition{Name: name, From: prev.State, To: job.State}
+		transition.Tasks = diffTasks(before.Tasks[name], after.Tasks[name])
+		if transition.From != transition.To || len(transition.Tasks) > 0 {
+			report.Transitioned = append(report.Transitioned, transition)
+		}
+	}
+
+	for name, job := range beforeJobs {
+		if _, exists := afterJobs[name]; !exists {
+			report.Deleted = append(report.Deleted, JobRef{Name: name, State: job.State})
+		}
+	}
+
+	sort.Slice(report.Created, func(i, j int) bool { return report.Created[i].Name < report.Created[j].Name })
+	sort.Slice(report.Deleted, func(i, j int) bool { return report.Deleted[i].Name < report.Deleted[j].Name })
+	sort.Slice(report.Transitioned, func(i, j int) bool {
+		return report.Transitioned[i].Name < report.Transitioned[j].Name
+	})
+
+	return report
+}
+
+// WriteText writes a human-readable summary of the report to w.
+func (r *Report) WriteText(w io.Writer) error {
+	for _, job := range r.Created {
+		if _, err := fmt.Fprintf(w, "+ %s (%s)\n", job.Name, job.State); err != nil {
+			return err
+		}
+	}
+	for _, job := range r.Deleted {
+		if _, err := fmt.Fprintf(w, "- %s (%s)\n", job.Name, job.State); err != nil {
+			return err
+		}
+	}
+	for _, job := range r.Transitioned {
+		if _, err := fmt.Fprintf(w, "~ %s %s -> %s\n", job.Name, job.From, job.To); err != nil {
+			return err
+		}
+		for _, task := range job.Tasks {
+			if _, err := fmt.Fprintf(w, "    ~ %s %s -> %s\n", task.Name, task.From, task.To); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err := fmt.Fprintf(w, "%d created, %d deleted, %d transitioned\n",
+		len(r.Created), len(r.Deleted), len(r.Transitioned))
+	return err
+}
+
+func indexJobs(snap *storage.Snapshot) map[string]*api.Job {
+	jobs := make(map[string]*api.Job, len(snap.Jobs))
+	for _, job := range snap.Jobs {
+		jobs[job.Name] = job
+	}
+	return jobs
+}
+
+func diffTasks(before, after []*api.Task) []TaskTransition {
+	states := make(map[string]api.TaskState, len(before))
+	for _, task := range before {
+		states[task.Name] = taskState(task)
+	}
+
+	var transitions []TaskTransition
+	for _, task := range after {
+		from, existed := states[task.Name]
+		to := taskState(task)
+		if existed && from != to {
+			transitions = append(transitions, TaskTransition{Name: task.Name, From: from, To: to})
+		}
+	}
+
+	sort.Slice(transitions, func(i, j int) bool { return transitions[i].Name < transitions[j].Name })
+	return transitions
+}
+
+func taskState(task *api.Task) api.TaskState {
+	if task.Status == nil {
+		return api.TaskStateUnspecified
+	}
+	return task.Status.State
+}
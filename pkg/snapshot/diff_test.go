@@ -0,0 +1,80 @@
+package snapshot
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+	"github.com/pyshx/fake-batch-server/pkg/storage"
+)
+
+func task(name string, state api.TaskState) *api.Task {
+	return &api.Task{Name: name, Status: &api.TaskStatus{State: state}}
+}
+
+func TestDiff(t *testing.T) {
+	before := &storage.Snapshot{
+		Jobs: []*api.Job{
+			{Name: "jobs/deleted", State: api.JobStateSucceeded},
+			{Name: "jobs/running", State: api.JobStateQueued},
+			{Name: "jobs/unchanged", State: api.JobStateSucceeded},
+		},
+		Tasks: map[string][]*api.Task{
+			"jobs/running": {task("jobs/running/tasks/0", api.TaskStatePending)},
+		},
+	}
+	after := &storage.Snapshot{
+		Jobs: []*api.Job{
+			{Name: "jobs/created", State: api.JobStateQueued},
+			{Name: "jobs/running", State: api.JobStateRunning},
+			{Name: "jobs/unchanged", State: api.JobStateSucceeded},
+		},
+		Tasks: map[string][]*api.Task{
+			"jobs/running": {task("jobs/running/tasks/0", api.TaskStateRunning)},
+		},
+	}
+
+	report := Diff(before, after)
+
+	assert.Equal(t, []JobRef{{Name: "jobs/created", State: api.JobStateQueued}}, report.Created)
+	assert.Equal(t, []JobRef{{Name: "jobs/deleted", State: api.JobStateSucceeded}}, report.Deleted)
+	require.Len(t, report.Transitioned, 1)
+	assert.Equal(t, "jobs/running", report.Transitioned[0].Name)
+	assert.Equal(t, api.JobStateQueued, report.Transitioned[0].From)
+	assert.Equal(t, api.JobStateRunning, report.Transitioned[0].To)
+	assert.Equal(t, []TaskTransition{
+		{Name: "jobs/running/tasks/0", From: api.TaskStatePending, To: api.TaskStateRunning},
+	}, report.Transitioned[0].Tasks)
+
+	var text bytes.Buffer
+	require.NoError(t, report.WriteText(&text))
+	assert.Contains(t, text.String(), "+ jobs/created (QUEUED)")
+	assert.Contains(t, text.String(), "1 created, 1 deleted, 1 transitioned")
+}
+
+func TestLoad(t *testing.T) {
+	store := storage.NewMemoryStore()
+	require.NoError(t, store.CreateJob(&api.Job{
+		Name:       "projects/p/locations/l/jobs/job1",
+		TaskGroups: []*api.TaskGroup{{Name: "group1", TaskCount: 2}},
+	}))
+
+	data, err := json.Marshal(store.Snapshot())
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "snap.json")
+	require.NoError(t, os.WriteFile(path, data, 0o644))
+
+	snap, err := Load(path)
+	require.NoError(t, err)
+	assert.Len(t, snap.Jobs, 1)
+	assert.Len(t, snap.Tasks["projects/p/locations/l/jobs/job1"], 2)
+
+	_, err = Load(filepath.Join(t.TempDir(), "missing.json"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"context"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+)
+
+// contextStore fails every job, task and operation access with the error of
+// its context once the context is done.
+type contextStore struct {
+	Store
+	ctx context.Context
+}
+
+// WithContext returns store failing its operations with ctx.Err() once ctx is
+// cancelled or past its deadline, so work done for a request that has been
+// given up stops at the next store access.
+func WithContext(ctx context.Context, store Store) Store {
+	if ctx.Done() == nil {
+		return store
+	}
+	return &contextStore{Store: store, ctx: ctx}
+}
+
+func (s *contextStore) CreateJob(job *api.Job) error {
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+	return s.Store.CreateJob(job)
+}
+
+func (s *contextStore) GetJob(name string) (*api.Job, error) {
+	if err := s.ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.Store.GetJob(name)
+}
+
+func (s *contextStore) GetJobByUID(uid string) (*api.Job, error) {
+	if err := s.ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.Store.GetJobByUID(uid)
+}
+
+func (s *contextStore) ListJobs(project, location string) ([]*api.Job, error) {
+	if err := s.ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.Store.ListJobs(project, location)
+}
+
+func (s *contextStore) UpdateJob(job *api.Job) error {
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+	return s.Store.UpdateJob(job)
+}
+
+func (s *contextStore) DeleteJob(name string) error {
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+	return s.Store.DeleteJob(name)
+}
+
+func (s *contextStore) GetTask(jobName, taskName string) (*api.Task, error) {
+	if err := s.ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.Store.GetTask(jobName, taskName)
+}
+
+func (s *contextStore) ListTasks(jobName string) ([]*api.Task, error) {
+	if err := s.ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.Store.ListTasks(jobName)
+}
+
+func (s *contextStore) UpdateTask(jobName string, task *api.Task) error {
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+	return s.Store.UpdateTask(jobName, task)
+}
+
+func (s *contextStore) GetTaskProgress(jobName, group string) (*TaskProgress, error) {
+	if err := s.ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.Store.GetTaskProgress(jobName, group)
+}
+
+func (s *contextStore) UpdateTaskProgress(jobName, group string, progress *TaskProgress) error {
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+	return s.Store.UpdateTaskProgress(jobName, group, progress)
+}
+
+func (s *contextStore) CreateOperation(op *api.Operation) error {
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+	return s.Store.CreateOperation(op)
+}
+
+func (s *contextStore) GetOperation(name string) (*api.Operation, error) {
+	if err := s.ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.Store.GetOperation(name)
+}
+
+func (s *contextStore) UpdateOperation(op *api.Operation) error {
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+	return s.Store.UpdateOperation(op)
+}
@@ -0,0 +1,265 @@
+package storage
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+)
+
+// EagerTaskLimit is the most tasks a task group may have for CreateJob to
+// store each of them. The tasks of larger groups are lazy: they are derived
+// from the group's TaskProgress whenever they are read, and only stored once
+// they are updated, e.g. because they failed.
+const EagerTaskLimit = 1000
+
+// TaskProgress is the group-level progress of a lazy task group. Its tasks
+// run in waves, in index order, so the state of each task follows from how
+// far the group has got.
+type TaskProgress struct {
+	// Assigned, Started and Finished count the tasks, from index 0, that
+	// have been assigned a VM, have started running and have finished.
+	Assigned int64 `json:"assigned"`
+	Started  int64 `json:"started"`
+	Finished int64 `json:"finished"`
+	// Failed is how many of the finished tasks failed. Failed tasks are
+	// stored, the others succeeded.
+	Failed int64 `json:"failed"`
+	// Forced, if set, ended the tasks that had not finished, from index
+	// Finished, when the job's state was forced.
+	Forced *TaskForce `json:"forced,omitempty"`
+	// Epochs time the waves of the group, one per time its simulation
+	// started or resumed.
+	Epochs []TaskEpoch `json:"epochs,omitempty"`
+	// InstancePrefix, Zones and TasksPerNode name the VMs tasks are assigned
+	// to: the task at index i runs on instance InstancePrefix followed by
+	// node i/TasksPerNode, in zone Zones[node%len(Zones)].
+	InstancePrefix string   `json:"instancePrefix,omitempty"`
+	Zones          []string `json:"zones,omitempty"`
+	TasksPerNode   int64    `json:"tasksPerNode,omitempty"`
+}
+
+// TaskEpoch times a run of waves of a lazy task group. Wave w of the epoch
+// holds the WaveSize tasks from From+w*WaveSize. The first wave is assigned
+// at ScheduledAt; every wave starts at RunningAt+w*WaveDuration, when the
+// later ones are also assigned, and finishes WaveDuration later.
+type TaskEpoch struct {
+	From         int64         `json:"from"`
+	ScheduledAt  time.Time     `json:"scheduledAt"`
+	RunningAt    time.Time     `json:"runningAt"`
+	WaveSize     int64         `json:"waveSize"`
+	WaveDuration time.Duration `json:"waveDuration"`
+}
+
+// TaskForce is the state the unfinished tasks of a lazy task group were
+// forced to, and when.
+type TaskForce struct {
+	State api.TaskState `json:"state"`
+	At    time.Time     `json:"at"`
+}
+
+// Lazy reports whether the tasks of taskGroup are too many to store each of
+// them when the job is created.
+func Lazy(taskGroup *api.TaskGroup) bool {
+	return taskGroup.TaskCount > EagerTaskLimit
+}
+
+// GetTaskProgress returns the progress of the lazy task group named group of
+// a job. It fails if the job does not exist or the group is not lazy.
+func (s *MemoryStore) GetTaskProgress(jobName, group string) (*TaskProgress, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if _, exists := s.jobs[jobName]; !exists {
+		return nil, fmt.Errorf("job %s not found", jobName)
+	}
+	progress, exists := s.progress[jobName][group]
+	if !exists {
+		return nil, fmt.Errorf("task group %s of job %s is not lazy", group, jobName)
+	}
+	return progress.clone(), nil
+}
+
+// UpdateTaskProgress updates the progress of the lazy task group named group
+// of a job.
+func (s *MemoryStore) UpdateTaskProgress(jobName, group string, progress *TaskProgress) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.progress[jobName][group]; !exists {
+		return fmt.Errorf("task group %s of job %s not found or not lazy", group, jobName)
+	}
+	s.progress[jobName][group] = progress.clone()
+	s.notify(jobName)
+
+	return nil
+}
+
+// clone copies p, so that the store and its callers do not share it.
+func (p *TaskProgress) clone() *TaskProgress {
+	c := *p
+	c.Epochs = append([]TaskEpoch(nil), p.Epochs...)
+	c.Zones = append([]string(nil), p.Zones...)
+	if p.Forced != nil {
+		forced := *p.Forced
+		c.Forced = &forced
+	}
+	return &c
+}
+
+// Counts returns the counts of the tasks of a group of total tasks with
+// progress p by state, like those of a TaskGroupStatus. States without tasks
+// are left out.
+func (p *TaskProgress) Counts(total int64) map[string]int64 {
+	byState := map[api.TaskState]int64{
+		api.TaskStatePending:   total - p.Assigned,
+		api.TaskStateAssigned:  p.Assigned - p.Started,
+		api.TaskStateRunning:   p.Started - p.Finished,
+		api.TaskStateSucceeded: p.Finished - p.Failed,
+		api.TaskStateFailed:    p.Failed,
+	}
+	if p.Forced != nil {
+		delete(byState, api.TaskStatePending)
+		delete(byState, api.TaskStateAssigned)
+		delete(byState, api.TaskStateRunning)
+		byState[p.Forced.State] += total - p.Finished
+	}
+
+	counts := make(map[string]int64)
+	for state, count := range byState {
+		if count > 0 {
+			counts[string(state)] = count
+		}
+	}
+	return counts
+}
+
+// lazyTask returns the task named taskName of a lazy task group of job, as
+// derived from the group's progress, or nil if it is not one. s.mu must be
+// held.
+func (s *MemoryStore) lazyTask(job *api.Job, taskName string) *api.Task {
+	rest, ok := strings.CutPrefix(taskName, job.Name+"/taskGroups/")
+	if !ok {
+		return nil
+	}
+	group, indexText, ok := strings.Cut(rest, "/tasks/")
+	if !ok {
+		return nil
+	}
+	index, err := strconv.ParseInt(indexText, 10, 64)
+	if err != nil || strconv.FormatInt(index, 10) != indexText {
+		return nil
+	}
+	progress, exists := s.progress[job.Name][group]
+	if !exists {
+		return nil
+	}
+	for _, taskGroup := range job.TaskGroups {
+		if taskGroup.Name == group && index >= 0 && index < taskGroup.TaskCount {
+			return progress.task(job, taskName, index)
+		}
+	}
+	return nil
+}
+
+// lazyTasks returns the tasks of the lazy task groups of job that are not
+// stored, as derived from the groups' progress. s.mu must be held.
+func (s *MemoryStore) lazyTasks(job *api.Job) []*api.Task {
+	var tasks []*api.Task
+	stored := s.tasks[job.Name]
+	for _, taskGroup := range job.TaskGroups {
+		progress, exists := s.progress[job.Name][taskGroup.Name]
+		if !exists {
+			continue
+		}
+		for index := int64(0); index < taskGroup.TaskCount; index++ {
+			name := fmt.Sprintf("%s/taskGroups/%s/tasks/%d", job.Name, taskGroup.Name, index)
+			if _, exists := stored[name]; !exists {
+				tasks = append(tasks, progress.task(job, name, index))
+			}
+		}
+	}
+	return tasks
+}
+
+// task derives the task at index of the group from its progress. Tasks
+// before Finished that are not stored succeeded; the others end in the
+// forced state, if any.
+func (p *TaskProgress) task(job *api.Job, name string, index int64) *api.Task {
+	task := p.progressTask(job, name, index)
+	if p.Forced != nil && index >= p.Finished {
+		task.Status.State = p.Forced.State
+		task.Status.StatusEvents = append(task.Status.StatusEvents, &api.StatusEvent{
+			Type:        "task_forced",
+			Description: fmt.Sprintf("Task state forced to %s", p.Forced.State),
+			EventTime:   p.Forced.At,
+		})
+	}
+	return task
+}
+
+// progressTask derives the task at index of the group from how far its waves
+// have got.
+func (p *TaskProgress) progressTask(job *api.Job, name string, index int64) *api.Task {
+	task := &api.Task{
+		Name: name,
+		Status: &api.TaskStatus{
+			State: api.TaskStatePending,
+			StatusEvents: []*api.StatusEvent{
+				{Type: "task_created", Description: "Task created", EventTime: job.CreateTime},
+			},
+		},
+	}
+
+	var epoch *TaskEpoch
+	for i := range p.Epochs {
+		if p.Epochs[i].From <= index {
+			epoch = &p.Epochs[i]
+		}
+	}
+	if epoch == nil || index >= p.Assigned {
+		return task
+	}
+
+	wave := int64(0)
+	if epoch.WaveSize > 0 {
+		wave = (index - epoch.From) / epoch.WaveSize
+	}
+	startAt := epoch.RunningAt.Add(time.Duration(wave) * epoch.WaveDuration)
+	assignedAt := startAt
+	if wave == 0 {
+		assignedAt = epoch.ScheduledAt
+	}
+	add := func(state api.TaskState, eventType, description string, at time.Time) {
+		task.Status.State = state
+		task.Status.StatusEvents = append(task.Status.StatusEvents, &api.StatusEvent{
+			Type:        eventType,
+			Description: description,
+			EventTime:   at,
+		})
+	}
+
+	add(api.TaskStateAssigned, "task_assigned", p.assignedDescription(index), assignedAt)
+	if index < p.Started {
+		add(api.TaskStateRunning, "task_started", "Task started running", startAt)
+	}
+	if index < p.Finished {
+		add(api.TaskStateSucceeded, "task_completed", "Task completed successfully", startAt.Add(epoch.WaveDuration))
+	}
+	return task
+}
+
+// assignedDescription describes the assignment of the task at index to its
+// VM, like the task_assigned events of stored tasks.
+func (p *TaskProgress) assignedDescription(index int64) string {
+	if p.InstancePrefix == "" || len(p.Zones) == 0 {
+		return "Task assigned to VM"
+	}
+	node := index
+	if p.TasksPerNode > 0 {
+		node = index / p.TasksPerNode
+	}
+	return fmt.Sprintf("Task assigned to VM on zones/%s/instances/%s%d", p.Zones[node%int64(len(p.Zones))], p.InstancePrefix, node)
+}
@@ -3,40 +3,126 @@ package storage
 
 import (
 	"fmt"
+	"strings"
 	"sync"
-	"time"
 
 	"github.com/pyshx/fake-batch-server/pkg/api"
+	"github.com/pyshx/fake-batch-server/pkg/clock"
 )
 
 // MemoryStore provides an in-memory storage implementation for jobs and tasks.
+// It keeps copies of the jobs, tasks and operations it is given and hands
+// out copies of them, so that callers may modify what they get while other
+// goroutines read the store.
 type MemoryStore struct {
-	mu    sync.RWMutex
-	jobs  map[string]*api.Job
-	tasks map[string]map[string]*api.Task
+	mu   sync.RWMutex
+	jobs map[string]*api.Job
+	// byLocation indexes jobs by the project and location they belong to,
+	// and byUID job names by job UID, so neither ListJobs nor GetJobByUID
+	// scans every job.
+	byLocation map[jobLocation]map[string]*api.Job
+	byUID      map[string]string
+	tasks      map[string]map[string]*api.Task
+	operations map[string]*api.Operation
+	// progress holds the progress of the lazy task groups of each job.
+	progress map[string]map[string]*TaskProgress
+	watchers map[string]map[chan struct{}]struct{}
+	// clock stamps the update time of jobs and the creation of tasks.
+	clock clock.Clock
+}
+
+// jobLocation is the project and location a job belongs to.
+type jobLocation struct {
+	project, location string
+}
+
+// locationOf returns the project and location of the job named name, which
+// is of the form projects/{project}/locations/{location}/jobs/{job}, or the
+// zero jobLocation for names of another form.
+func locationOf(name string) jobLocation {
+	parts := strings.SplitN(name, "/", 6)
+	if len(parts) < 6 || parts[0] != "projects" || parts[2] != "locations" || parts[4] != "jobs" {
+		return jobLocation{}
+	}
+	return jobLocation{project: parts[1], location: parts[3]}
+}
+
+// index adds job to the indexes, replacing the job of the same name. s.mu
+// must be held.
+func (s *MemoryStore) index(job *api.Job) {
+	s.unindex(job.Name)
+	s.jobs[job.Name] = job
+
+	if key := locationOf(job.Name); key != (jobLocation{}) {
+		if s.byLocation[key] == nil {
+			s.byLocation[key] = make(map[string]*api.Job)
+		}
+		s.byLocation[key][job.Name] = job
+	}
+	if job.UID != "" {
+		s.byUID[job.UID] = job.Name
+	}
+}
+
+// unindex removes the job named name from the indexes. s.mu must be held.
+func (s *MemoryStore) unindex(name string) {
+	job, exists := s.jobs[name]
+	if !exists {
+		return
+	}
+	delete(s.jobs, name)
+
+	key := locationOf(name)
+	delete(s.byLocation[key], name)
+	if len(s.byLocation[key]) == 0 {
+		delete(s.byLocation, key)
+	}
+	if s.byUID[job.UID] == name {
+		delete(s.byUID, job.UID)
+	}
 }
 
 // NewMemoryStore creates a new in-memory storage instance.
 func NewMemoryStore() *MemoryStore {
+	return NewMemoryStoreWithClock(clock.Real())
+}
+
+// NewMemoryStoreWithClock creates a new in-memory storage instance that
+// stamps jobs and tasks with the time of clk, e.g. the fake clock of
+// deterministic mode.
+func NewMemoryStoreWithClock(clk clock.Clock) *MemoryStore {
 	return &MemoryStore{
-		jobs:  make(map[string]*api.Job),
-		tasks: make(map[string]map[string]*api.Task),
+		jobs:       make(map[string]*api.Job),
+		byLocation: make(map[jobLocation]map[string]*api.Job),
+		byUID:      make(map[string]string),
+		tasks:      make(map[string]map[string]*api.Task),
+		operations: make(map[string]*api.Operation),
+		progress:   make(map[string]map[string]*TaskProgress),
+		watchers:   make(map[string]map[chan struct{}]struct{}),
+		clock:      clk,
 	}
 }
 
-// CreateJob stores a new job and creates associated tasks.
+// CreateJob stores a new job and creates associated tasks. The tasks of lazy
+// task groups are not created; the group starts with an empty TaskProgress
+// instead.
 func (s *MemoryStore) CreateJob(job *api.Job) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	if _, exists := s.jobs[job.Name]; exists {
-		return fmt.Errorf("job %s already exists", job.Name)
+		return fmt.Errorf("job %s %w", job.Name, ErrAlreadyExists)
 	}
 
-	s.jobs[job.Name] = job
+	s.index(job.Clone())
 	s.tasks[job.Name] = make(map[string]*api.Task)
+	s.progress[job.Name] = make(map[string]*TaskProgress)
 
 	for _, taskGroup := range job.TaskGroups {
+		if Lazy(taskGroup) {
+			s.progress[job.Name][taskGroup.Name] = &TaskProgress{}
+			continue
+		}
 		for i := int64(0); i < taskGroup.TaskCount; i++ {
 			taskName := fmt.Sprintf("%s/taskGroups/%s/tasks/%d", job.Name, taskGroup.Name, i)
 			task := &api.Task{
@@ -47,7 +133,7 @@ func (s *MemoryStore) CreateJob(job *api.Job) error {
 						{
 							Type:        "task_created",
 							Description: "Task created",
-							EventTime:   time.Now(),
+							EventTime:   s.clock.Now(),
 						},
 					},
 				},
@@ -55,6 +141,7 @@ func (s *MemoryStore) CreateJob(job *api.Job) error {
 			s.tasks[job.Name][taskName] = task
 		}
 	}
+	s.notify(job.Name)
 
 	return nil
 }
@@ -69,21 +156,45 @@ func (s *MemoryStore) GetJob(name string) (*api.Job, error) {
 		return nil, fmt.Errorf("job %s not found", name)
 	}
 
-	return job, nil
+	return job.Clone(), nil
 }
 
-// ListJobs returns all jobs for a specific project and location.
-func (s *MemoryStore) ListJobs(project, location string) ([]*api.Job, error) {
+// GetJobByUID retrieves the job with the given UID.
+func (s *MemoryStore) GetJobByUID(uid string) (*api.Job, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	var jobs []*api.Job
-	prefix := fmt.Sprintf("projects/%s/locations/%s/jobs/", project, location)
+	job, exists := s.jobs[s.byUID[uid]]
+	if !exists {
+		return nil, fmt.Errorf("job with uid %s not found", uid)
+	}
+
+	return job.Clone(), nil
+}
+
+// ListJobs returns all jobs for a specific project and location, or for
+// every location of the project if location is AnyLocation.
+func (s *MemoryStore) ListJobs(project, location string) ([]*api.Job, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
-	for name, job := range s.jobs {
-		if len(name) >= len(prefix) && name[:len(prefix)] == prefix {
-			jobs = append(jobs, job)
+	if location == AnyLocation {
+		var jobs []*api.Job
+		for key, located := range s.byLocation {
+			if key.project != project {
+				continue
+			}
+			for _, job := range located {
+				jobs = append(jobs, job.Clone())
+			}
 		}
+		return jobs, nil
+	}
+
+	located := s.byLocation[jobLocation{project: project, location: location}]
+	jobs := make([]*api.Job, 0, len(located))
+	for _, job := range located {
+		jobs = append(jobs, job.Clone())
 	}
 
 	return jobs, nil
@@ -98,8 +209,9 @@ func (s *MemoryStore) UpdateJob(job *api.Job) error {
 		return fmt.Errorf("job %s not found", job.Name)
 	}
 
-	job.UpdateTime = time.Now()
-	s.jobs[job.Name] = job
+	job.UpdateTime = s.clock.Now()
+	s.index(job.Clone())
+	s.notify(job.Name)
 
 	return nil
 }
@@ -113,13 +225,36 @@ func (s *MemoryStore) DeleteJob(name string) error {
 		return fmt.Errorf("job %s not found", name)
 	}
 
-	delete(s.jobs, name)
+	s.unindex(name)
 	delete(s.tasks, name)
+	delete(s.progress, name)
+	s.notify(name)
 
 	return nil
 }
 
-// GetTask retrieves a specific task from a job.
+// CreateTask adds a task to an existing job, e.g. when its task count grows.
+func (s *MemoryStore) CreateTask(jobName string, task *api.Task) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	jobTasks, exists := s.tasks[jobName]
+	if !exists {
+		return fmt.Errorf("job %s not found", jobName)
+	}
+
+	if _, exists := jobTasks[task.Name]; exists {
+		return fmt.Errorf("task %s %w", task.Name, ErrAlreadyExists)
+	}
+
+	jobTasks[task.Name] = task.Clone()
+	s.notify(jobName)
+
+	return nil
+}
+
+// GetTask retrieves a specific task from a job. Tasks of lazy task groups
+// that are not stored are derived from the group's progress.
 func (s *MemoryStore) GetTask(jobName, taskName string) (*api.Task, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
@@ -131,13 +266,17 @@ func (s *MemoryStore) GetTask(jobName, taskName string) (*api.Task, error) {
 
 	task, exists := jobTasks[taskName]
 	if !exists {
-		return nil, fmt.Errorf("task %s not found", taskName)
+		if task = s.lazyTask(s.jobs[jobName], taskName); task == nil {
+			return nil, fmt.Errorf("task %s not found", taskName)
+		}
+		return task, nil
 	}
 
-	return task, nil
+	return task.Clone(), nil
 }
 
-// ListTasks returns all tasks for a specific job.
+// ListTasks returns all tasks for a specific job, deriving those of lazy
+// task groups that are not stored.
 func (s *MemoryStore) ListTasks(jobName string) ([]*api.Task, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
@@ -149,8 +288,9 @@ func (s *MemoryStore) ListTasks(jobName string) ([]*api.Task, error) {
 
 	var tasks []*api.Task
 	for _, task := range jobTasks {
-		tasks = append(tasks, task)
+		tasks = append(tasks, task.Clone())
 	}
+	tasks = append(tasks, s.lazyTasks(s.jobs[jobName])...)
 
 	return tasks, nil
 }
@@ -165,12 +305,54 @@ func (s *MemoryStore) UpdateTask(jobName string, task *api.Task) error {
 		return fmt.Errorf("job %s not found", jobName)
 	}
 
-	if _, exists := jobTasks[task.Name]; !exists {
+	// Updating a task of a lazy task group stores it.
+	if _, exists := jobTasks[task.Name]; !exists && s.lazyTask(s.jobs[jobName], task.Name) == nil {
 		return fmt.Errorf("task %s not found", task.Name)
 	}
 
-	jobTasks[task.Name] = task
+	jobTasks[task.Name] = task.Clone()
+	s.notify(jobName)
+
+	return nil
+}
+
+// CreateOperation stores a new long-running operation.
+func (s *MemoryStore) CreateOperation(op *api.Operation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.operations[op.Name]; exists {
+		return fmt.Errorf("operation %s %w", op.Name, ErrAlreadyExists)
+	}
+
+	s.operations[op.Name] = op.Clone()
 
 	return nil
 }
 
+// GetOperation retrieves a long-running operation by name.
+func (s *MemoryStore) GetOperation(name string) (*api.Operation, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	op, exists := s.operations[name]
+	if !exists {
+		return nil, fmt.Errorf("operation %s not found", name)
+	}
+
+	return op.Clone(), nil
+}
+
+// UpdateOperation updates an existing long-running operation.
+func (s *MemoryStore) UpdateOperation(op *api.Operation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.operations[op.Name]; !exists {
+		return fmt.Errorf("operation %s not found", op.Name)
+	}
+
+	s.operations[op.Name] = op.Clone()
+
+	return nil
+}
@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"context"
 	"fmt"
 	"testing"
 	"time"
@@ -9,6 +10,7 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"github.com/pyshx/fake-batch-server/pkg/api"
+	"github.com/pyshx/fake-batch-server/pkg/clock"
 )
 
 func TestMemoryStore_CreateJob(t *testing.T) {
@@ -44,6 +46,7 @@ func TestMemoryStore_CreateJob(t *testing.T) {
 	err = store.CreateJob(job)
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "already exists")
+	assert.ErrorIs(t, err, ErrAlreadyExists)
 }
 
 func TestMemoryStore_GetJob(t *testing.T) {
@@ -65,6 +68,23 @@ func TestMemoryStore_GetJob(t *testing.T) {
 	assert.Equal(t, job.Name, retrieved.Name)
 }
 
+func TestMemoryStore_GetJobByUID(t *testing.T) {
+	store := NewMemoryStore()
+	job := &api.Job{Name: "projects/test/locations/us-central1/jobs/test-job-1", UID: "uid-1"}
+	require.NoError(t, store.CreateJob(job))
+
+	retrieved, err := store.GetJobByUID("uid-1")
+	require.NoError(t, err)
+	assert.Equal(t, job.Name, retrieved.Name)
+
+	_, err = store.GetJobByUID("uid-2")
+	assert.ErrorContains(t, err, "not found")
+
+	require.NoError(t, store.DeleteJob(job.Name))
+	_, err = store.GetJobByUID("uid-1")
+	assert.ErrorContains(t, err, "not found")
+}
+
 func TestMemoryStore_ListJobs(t *testing.T) {
 	store := NewMemoryStore()
 
@@ -95,6 +115,44 @@ func TestMemoryStore_ListJobs(t *testing.T) {
 	listed, err = store.ListJobs("project1", "us-west1")
 	assert.NoError(t, err)
 	assert.Len(t, listed, 1)
+
+	// List jobs for every location of project1
+	listed, err = store.ListJobs("project1", AnyLocation)
+	assert.NoError(t, err)
+	assert.Len(t, listed, 3)
+
+	// The index follows deletions and restores
+	require.NoError(t, store.DeleteJob("projects/project1/locations/us-west1/jobs/job4"))
+	listed, err = store.ListJobs("project1", "us-west1")
+	assert.NoError(t, err)
+	assert.Empty(t, listed)
+
+	restored := NewMemoryStore()
+	require.NoError(t, restored.Restore(store.Snapshot()))
+	listed, err = restored.ListJobs("project1", "us-central1")
+	assert.NoError(t, err)
+	assert.Len(t, listed, 2)
+}
+
+func BenchmarkMemoryStore_ListJobs(b *testing.B) {
+	store := NewMemoryStore()
+	for i := 0; i < 100000; i++ {
+		job := &api.Job{
+			Name: fmt.Sprintf("projects/project%d/locations/us-central1/jobs/job%d", i%100, i),
+			UID:  fmt.Sprintf("uid-%d", i),
+		}
+		require.NoError(b, store.CreateJob(job))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := store.ListJobs("project42", "us-central1"); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := store.GetJobByUID("uid-4242"); err != nil {
+			b.Fatal(err)
+		}
+	}
 }
 
 func TestMemoryStore_UpdateJob(t *testing.T) {
@@ -123,6 +181,24 @@ func TestMemoryStore_UpdateJob(t *testing.T) {
 	assert.True(t, retrieved.UpdateTime.After(oldUpdateTime))
 }
 
+func TestMemoryStore_Clock(t *testing.T) {
+	fake := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	store := NewMemoryStoreWithClock(fake)
+
+	job := &api.Job{
+		Name:       "projects/test/locations/us-central1/jobs/test-job-1",
+		TaskGroups: []*api.TaskGroup{{Name: "group1", TaskCount: 1}},
+	}
+	require.NoError(t, store.CreateJob(job))
+	tasks, err := store.ListTasks(job.Name)
+	require.NoError(t, err)
+	assert.Equal(t, fake.Now(), tasks[0].Status.StatusEvents[0].EventTime)
+
+	fake.Advance(time.Minute)
+	require.NoError(t, store.UpdateJob(job))
+	assert.Equal(t, fake.Now(), job.UpdateTime)
+}
+
 func TestMemoryStore_DeleteJob(t *testing.T) {
 	store := NewMemoryStore()
 
@@ -196,6 +272,15 @@ func TestMemoryStore_Tasks(t *testing.T) {
 	// Test non-existent task
 	_, err = store.GetTask(jobName, "non-existent-task")
 	assert.Error(t, err)
+
+	// Create task
+	added := &api.Task{Name: jobName + "/taskGroups/group1/tasks/2", Status: &api.TaskStatus{State: api.TaskStatePending}}
+	assert.NoError(t, store.CreateTask(jobName, added))
+	tasks, err = store.ListTasks(jobName)
+	assert.NoError(t, err)
+	assert.Len(t, tasks, 3)
+	assert.ErrorIs(t, store.CreateTask(jobName, added), ErrAlreadyExists)
+	assert.Error(t, store.CreateTask("non-existent", added))
 }
 
 func TestMemoryStore_Concurrency(t *testing.T) {
@@ -223,3 +308,215 @@ func TestMemoryStore_Concurrency(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Len(t, jobs, 10)
 }
+
+func TestMemoryStore_Operations(t *testing.T) {
+	store := NewMemoryStore()
+
+	op := &api.Operation{Name: "projects/test/locations/us-central1/operations/op-1"}
+	require.NoError(t, store.CreateOperation(op))
+	assert.Error(t, store.CreateOperation(op))
+
+	retrieved, err := store.GetOperation(op.Name)
+	require.NoError(t, err)
+	assert.False(t, retrieved.Done)
+
+	require.NoError(t, store.UpdateOperation(&api.Operation{Name: op.Name, Done: true}))
+	retrieved, err = store.GetOperation(op.Name)
+	require.NoError(t, err)
+	assert.True(t, retrieved.Done)
+
+	_, err = store.GetOperation("non-existent")
+	assert.Error(t, err)
+	assert.Error(t, store.UpdateOperation(&api.Operation{Name: "non-existent"}))
+}
+
+func TestMemoryStore_Snapshot(t *testing.T) {
+	store := NewMemoryStore()
+
+	require.NoError(t, store.CreateJob(&api.Job{Name: "projects/test/locations/us-central1/jobs/b"}))
+	require.NoError(t, store.CreateJob(&api.Job{
+		Name:       "projects/test/locations/us-central1/jobs/a",
+		TaskGroups: []*api.TaskGroup{{Name: "group1", TaskCount: 2}},
+	}))
+
+	snapshot := store.Snapshot()
+	require.Len(t, snapshot.Jobs, 2)
+	assert.Equal(t, "projects/test/locations/us-central1/jobs/a", snapshot.Jobs[0].Name)
+	assert.Len(t, snapshot.Tasks["projects/test/locations/us-central1/jobs/a"], 2)
+	assert.Empty(t, snapshot.Tasks["projects/test/locations/us-central1/jobs/b"])
+}
+
+func TestMemoryStore_Watch(t *testing.T) {
+	store := NewMemoryStore()
+	job := &api.Job{
+		Name:       "projects/p/locations/l/jobs/job",
+		TaskGroups: []*api.TaskGroup{{Name: "group0", TaskCount: 1}},
+	}
+	require.NoError(t, store.CreateJob(job))
+
+	changes, stop := store.Watch(job.Name)
+	other, stopOther := store.Watch("projects/p/locations/l/jobs/other")
+	location, stopLocation := store.Watch("projects/p/locations/l")
+
+	// Updates are coalesced until read.
+	require.NoError(t, store.UpdateJob(job))
+	tasks, _ := store.ListTasks(job.Name)
+	require.NoError(t, store.UpdateTask(job.Name, tasks[0]))
+	<-changes
+	assert.Empty(t, changes)
+
+	require.NoError(t, store.DeleteJob(job.Name))
+	<-changes
+	assert.Empty(t, other)
+	<-location
+
+	// Watching a location also sees jobs created in it.
+	require.NoError(t, store.CreateJob(&api.Job{Name: "projects/p/locations/l/jobs/new"}))
+	<-location
+	assert.Empty(t, changes)
+
+	stop()
+	stopOther()
+	stopLocation()
+	assert.Empty(t, store.watchers)
+}
+
+func TestMemoryStore_Restore(t *testing.T) {
+	source := NewMemoryStore()
+	require.NoError(t, source.CreateJob(&api.Job{
+		Name:       "projects/test/locations/us-central1/jobs/a",
+		TaskGroups: []*api.TaskGroup{{Name: "group1", TaskCount: 2}},
+	}))
+	require.NoError(t, source.CreateOperation(&api.Operation{Name: "projects/test/locations/us-central1/operations/op"}))
+
+	store := NewMemoryStore()
+	require.NoError(t, store.CreateJob(&api.Job{Name: "projects/test/locations/us-central1/jobs/old"}))
+	require.NoError(t, store.Restore(source.Snapshot()))
+
+	_, err := store.GetJob("projects/test/locations/us-central1/jobs/old")
+	assert.Error(t, err)
+	tasks, err := store.ListTasks("projects/test/locations/us-central1/jobs/a")
+	require.NoError(t, err)
+	assert.Len(t, tasks, 2)
+	_, err = store.GetOperation("projects/test/locations/us-central1/operations/op")
+	assert.NoError(t, err)
+
+	err = store.Restore(&Snapshot{Tasks: map[string][]*api.Task{"projects/test/locations/us-central1/jobs/x": nil}})
+	assert.Error(t, err)
+}
+
+func TestWithContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	store := WithContext(ctx, NewMemoryStore())
+
+	require.NoError(t, store.CreateJob(&api.Job{Name: "projects/test/locations/us-central1/jobs/a"}))
+	_, err := store.GetJob("projects/test/locations/us-central1/jobs/a")
+	require.NoError(t, err)
+
+	cancel()
+	_, err = store.GetJob("projects/test/locations/us-central1/jobs/a")
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.ErrorIs(t, store.UpdateJob(&api.Job{Name: "projects/test/locations/us-central1/jobs/a"}), context.Canceled)
+}
+
+func TestMemoryStore_LazyTasks(t *testing.T) {
+	store := NewMemoryStore()
+
+	created := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	job := &api.Job{
+		Name:       "projects/test/locations/us-central1/jobs/array",
+		CreateTime: created,
+		TaskGroups: []*api.TaskGroup{{Name: "group0", TaskCount: 2500}},
+	}
+	require.NoError(t, store.CreateJob(job))
+
+	tasks, err := store.ListTasks(job.Name)
+	require.NoError(t, err)
+	assert.Len(t, tasks, 2500)
+	task, err := store.GetTask(job.Name, job.Name+"/taskGroups/group0/tasks/2499")
+	require.NoError(t, err)
+	assert.Equal(t, api.TaskStatePending, task.Status.State)
+	_, err = store.GetTask(job.Name, job.Name+"/taskGroups/group0/tasks/2500")
+	assert.Error(t, err)
+
+	// Waves of 1000 tasks: the first one has finished, the second is running
+	// and the third assigned.
+	running := created.Add(time.Minute)
+	require.NoError(t, store.UpdateTaskProgress(job.Name, "group0", &TaskProgress{
+		Assigned: 2500, Started: 2000, Finished: 1000,
+		Epochs: []TaskEpoch{{
+			ScheduledAt: created, RunningAt: running, WaveSize: 1000, WaveDuration: time.Minute,
+		}},
+		InstancePrefix: "array-group0-",
+		Zones:          []string{"us-central1-a", "us-central1-b"},
+		TasksPerNode:   1,
+	}))
+	progress, err := store.GetTaskProgress(job.Name, "group0")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2000), progress.Started)
+
+	task, err = store.GetTask(job.Name, job.Name+"/taskGroups/group0/tasks/999")
+	require.NoError(t, err)
+	assert.Equal(t, api.TaskStateSucceeded, task.Status.State)
+	assert.Equal(t, running.Add(time.Minute), task.Status.StatusEvents[3].EventTime)
+	task, err = store.GetTask(job.Name, job.Name+"/taskGroups/group0/tasks/1001")
+	require.NoError(t, err)
+	assert.Equal(t, api.TaskStateRunning, task.Status.State)
+	assert.Equal(t, "Task assigned to VM on zones/us-central1-b/instances/array-group0-1001", task.Status.StatusEvents[1].Description)
+	assert.Equal(t, running.Add(time.Minute), task.Status.StatusEvents[2].EventTime)
+	task, err = store.GetTask(job.Name, job.Name+"/taskGroups/group0/tasks/2000")
+	require.NoError(t, err)
+	assert.Equal(t, api.TaskStateAssigned, task.Status.State)
+
+	// Updating a derived task stores it.
+	task.Status.State = api.TaskStateFailed
+	require.NoError(t, store.UpdateTask(job.Name, task))
+	task, err = store.GetTask(job.Name, task.Name)
+	require.NoError(t, err)
+	assert.Equal(t, api.TaskStateFailed, task.Status.State)
+	tasks, err = store.ListTasks(job.Name)
+	require.NoError(t, err)
+	assert.Len(t, tasks, 2500)
+
+	// The progress survives a snapshot.
+	restored := NewMemoryStore()
+	require.NoError(t, restored.Restore(store.Snapshot()))
+	progress, err = restored.GetTaskProgress(job.Name, "group0")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1000), progress.Finished)
+
+	require.NoError(t, store.DeleteJob(job.Name))
+	_, err = store.GetTaskProgress(job.Name, "group0")
+	assert.Error(t, err)
+}
+
+func TestTaskProgress_Forced(t *testing.T) {
+	created := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	job := &api.Job{Name: "projects/p/locations/l/jobs/big", CreateTime: created}
+	progress := &TaskProgress{
+		Assigned: 2000, Started: 1000, Finished: 1000, Failed: 3,
+		Epochs: []TaskEpoch{{
+			ScheduledAt: created, RunningAt: created, WaveSize: 1000, WaveDuration: time.Minute,
+		}},
+	}
+	assert.Equal(t, map[string]int64{"PENDING": 500, "ASSIGNED": 1000, "SUCCEEDED": 997, "FAILED": 3}, progress.Counts(2500))
+
+	forcedAt := created.Add(time.Hour)
+	progress.Forced = &TaskForce{State: api.TaskStateFailed, At: forcedAt}
+	assert.Equal(t, map[string]int64{"SUCCEEDED": 997, "FAILED": 1503}, progress.Counts(2500))
+
+	task := progress.task(job, job.Name+"/taskGroups/group0/tasks/999", 999)
+	assert.Equal(t, api.TaskStateSucceeded, task.Status.State)
+	for _, index := range []int64{1000, 2499} {
+		task = progress.task(job, fmt.Sprintf("%s/taskGroups/group0/tasks/%d", job.Name, index), index)
+		assert.Equal(t, api.TaskStateFailed, task.Status.State)
+		last := task.Status.StatusEvents[len(task.Status.StatusEvents)-1]
+		assert.Equal(t, "task_forced", last.Type)
+		assert.Equal(t, forcedAt, last.EventTime)
+	}
+
+	// The store keeps its own copy of the forced state.
+	clone := progress.clone()
+	clone.Forced.State = api.TaskStateSucceeded
+	assert.Equal(t, api.TaskStateFailed, progress.Forced.State)
+}
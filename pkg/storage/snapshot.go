@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+)
+
+// Snapshot is a point-in-time dump of every job, task and operation in a
+// store.
+type Snapshot struct {
+	Jobs       []*api.Job             `json:"jobs"`
+	Tasks      map[string][]*api.Task `json:"tasks"`
+	Operations []*api.Operation       `json:"operations,omitempty"`
+	// Progress holds the progress of the lazy task groups of each job,
+	// whose tasks are only in Tasks if they were stored.
+	Progress map[string]map[string]*TaskProgress `json:"progress,omitempty"`
+}
+
+// Snapshot returns a copy of the current contents of the store, keyed by job
+// name and sorted by name.
+func (s *MemoryStore) Snapshot() *Snapshot {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	snapshot := &Snapshot{
+		Jobs:  make([]*api.Job, 0, len(s.jobs)),
+		Tasks: make(map[string][]*api.Task, len(s.tasks)),
+	}
+
+	for _, job := range s.jobs {
+		snapshot.Jobs = append(snapshot.Jobs, job.Clone())
+	}
+	sort.Slice(snapshot.Jobs, func(i, j int) bool {
+		return snapshot.Jobs[i].Name < snapshot.Jobs[j].Name
+	})
+
+	for jobName, jobTasks := range s.tasks {
+		tasks := make([]*api.Task, 0, len(jobTasks))
+		for _, task := range jobTasks {
+			tasks = append(tasks, task.Clone())
+		}
+		sort.Slice(tasks, func(i, j int) bool {
+			return tasks[i].Name < tasks[j].Name
+		})
+		snapshot.Tasks[jobName] = tasks
+	}
+
+	for jobName, groups := range s.progress {
+		for group, progress := range groups {
+			if snapshot.Progress == nil {
+				snapshot.Progress = make(map[string]map[string]*TaskProgress)
+			}
+			if snapshot.Progress[jobName] == nil {
+				snapshot.Progress[jobName] = make(map[string]*TaskProgress)
+			}
+			snapshot.Progress[jobName][group] = progress.clone()
+		}
+	}
+
+	for _, op := range s.operations {
+		snapshot.Operations = append(snapshot.Operations, op.Clone())
+	}
+	sort.Slice(snapshot.Operations, func(i, j int) bool {
+		return snapshot.Operations[i].Name < snapshot.Operations[j].Name
+	})
+
+	return snapshot
+}
+
+// Restore replaces the contents of the store with a copy of those of
+// snapshot. Every task and task group progress must belong to a job of the
+// snapshot.
+func (s *MemoryStore) Restore(snapshot *Snapshot) error {
+	jobs := make(map[string]*api.Job, len(snapshot.Jobs))
+	tasks := make(map[string]map[string]*api.Task, len(snapshot.Jobs))
+	progress := make(map[string]map[string]*TaskProgress, len(snapshot.Jobs))
+	for _, job := range snapshot.Jobs {
+		jobs[job.Name] = job.Clone()
+		tasks[job.Name] = make(map[string]*api.Task)
+		progress[job.Name] = make(map[string]*TaskProgress)
+	}
+	for jobName, jobTasks := range snapshot.Tasks {
+		if _, exists := jobs[jobName]; !exists {
+			return fmt.Errorf("tasks of unknown job %s", jobName)
+		}
+		for _, task := range jobTasks {
+			tasks[jobName][task.Name] = task.Clone()
+		}
+	}
+	for jobName, groups := range snapshot.Progress {
+		if _, exists := jobs[jobName]; !exists {
+			return fmt.Errorf("task progress of unknown job %s", jobName)
+		}
+		for group, groupProgress := range groups {
+			progress[jobName][group] = groupProgress.clone()
+		}
+	}
+	operations := make(map[string]*api.Operation, len(snapshot.Operations))
+	for _, op := range snapshot.Operations {
+		operations[op.Name] = op.Clone()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.jobs = make(map[string]*api.Job, len(jobs))
+	s.byLocation = make(map[jobLocation]map[string]*api.Job)
+	s.byUID = make(map[string]string, len(jobs))
+	for _, job := range jobs {
+		s.index(job)
+	}
+	s.tasks, s.operations, s.progress = tasks, operations, progress
+	for name := range s.watchers {
+		s.notify(name)
+	}
+	return nil
+}
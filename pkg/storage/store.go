@@ -0,0 +1,42 @@
+package storage
+
+import (
+	"errors"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+)
+
+// ErrAlreadyExists is wrapped by the errors of creations whose name is taken.
+var ErrAlreadyExists = errors.New("already exists")
+
+// AnyLocation is the location wildcard of Google APIs: ListJobs with it lists
+// the jobs of every location of the project.
+const AnyLocation = "-"
+
+// Store persists jobs, their tasks and long-running operations.
+type Store interface {
+	CreateJob(job *api.Job) error
+	GetJob(name string) (*api.Job, error)
+	GetJobByUID(uid string) (*api.Job, error)
+	ListJobs(project, location string) ([]*api.Job, error)
+	UpdateJob(job *api.Job) error
+	DeleteJob(name string) error
+
+	CreateTask(jobName string, task *api.Task) error
+	GetTask(jobName, taskName string) (*api.Task, error)
+	ListTasks(jobName string) ([]*api.Task, error)
+	UpdateTask(jobName string, task *api.Task) error
+
+	GetTaskProgress(jobName, group string) (*TaskProgress, error)
+	UpdateTaskProgress(jobName, group string, progress *TaskProgress) error
+
+	CreateOperation(op *api.Operation) error
+	GetOperation(name string) (*api.Operation, error)
+	UpdateOperation(op *api.Operation) error
+
+	Snapshot() *Snapshot
+	Restore(snapshot *Snapshot) error
+	Watch(name string) (<-chan struct{}, func())
+}
+
+var _ Store = (*MemoryStore)(nil)
@@ -0,0 +1,46 @@
+package storage
+
+import "strings"
+
+// Watch returns a channel that receives a value whenever the job named name
+// or one of its tasks is updated, or the job is deleted. name may also be a
+// parent such as projects/p/locations/l, to watch every job under it,
+// including jobs created later. Updates that happen
+// while a previous one is still unread are coalesced. The returned function
+// stops the watch.
+func (s *MemoryStore) Watch(name string) (<-chan struct{}, func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ch := make(chan struct{}, 1)
+	if s.watchers[name] == nil {
+		s.watchers[name] = make(map[chan struct{}]struct{})
+	}
+	s.watchers[name][ch] = struct{}{}
+
+	return ch, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		delete(s.watchers[name], ch)
+		if len(s.watchers[name]) == 0 {
+			delete(s.watchers, name)
+		}
+	}
+}
+
+// notify wakes up the watchers of the job named name and of its parents.
+// s.mu must be held.
+func (s *MemoryStore) notify(name string) {
+	for watched, chans := range s.watchers {
+		if watched != name && !strings.HasPrefix(name, watched+"/") {
+			continue
+		}
+		for ch := range chans {
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
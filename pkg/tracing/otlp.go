@@ -0,0 +1,262 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// OTLP batching limits.
+const (
+	otlpQueueSize     = 4096
+	otlpBatchSize     = 512
+	otlpFlushInterval = 5 * time.Second
+)
+
+// OTLP exports spans in batches to an OTLP/HTTP collector using the JSON
+// encoding.
+type OTLP struct {
+	client  *http.Client
+	url     string
+	service string
+
+	spans chan *Span
+	flush chan chan struct{}
+	done  chan struct{}
+	once  sync.Once
+}
+
+// NewOTLP creates an exporter sending the spans of service to the collector
+// at endpoint, e.g. "http://localhost:4318". Spans are sent every few
+// seconds until Shutdown.
+func NewOTLP(endpoint, service string, timeout time.Duration) *OTLP {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "http://" + endpoint
+	}
+	e := &OTLP{
+		client:  &http.Client{Timeout: timeout},
+		url:     strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		service: service,
+		spans:   make(chan *Span, otlpQueueSize),
+		flush:   make(chan chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go e.loop()
+	return e
+}
+
+// Export queues span for sending. Spans are dropped when the queue is full
+// or the exporter has been shut down.
+func (e *OTLP) Export(span *Span) {
+	select {
+	case <-e.done:
+		return
+	default:
+	}
+
+	select {
+	case e.spans <- span:
+	default:
+		logrus.Debugf("Dropping span %s: export queue is full", span.Name)
+	}
+}
+
+// Flush sends the queued spans and waits until they have been sent.
+func (e *OTLP) Flush() {
+	flushed := make(chan struct{})
+	select {
+	case e.flush <- flushed:
+		<-flushed
+	case <-e.done:
+	}
+}
+
+// Shutdown sends the queued spans and stops the exporter.
+func (e *OTLP) Shutdown() {
+	e.Flush()
+	e.once.Do(func() { close(e.done) })
+}
+
+func (e *OTLP) loop() {
+	ticker := time.NewTicker(otlpFlushInterval)
+	defer ticker.Stop()
+
+	var batch []*Span
+	send := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := e.send(batch); err != nil {
+			logrus.Warnf("Failed to export %d spans to %s: %v", len(batch), e.url, err)
+		}
+		batch = nil
+	}
+
+	for {
+		select {
+		case span := <-e.spans:
+			batch = append(batch, span)
+			if len(batch) >= otlpBatchSize {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		case flushed := <-e.flush:
+			for drained := false; !drained; {
+				select {
+				case span := <-e.spans:
+					batch = append(batch, span)
+				default:
+					drained = true
+				}
+			}
+			send()
+			close(flushed)
+		case <-e.done:
+			return
+		}
+	}
+}
+
+// send posts spans to the collector.
+func (e *OTLP) send(spans []*Span) error {
+	body, err := json.Marshal(e.request(spans))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("collector returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// The OTLP/JSON encoding of an ExportTraceServiceRequest.
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID           string          `json:"traceId"`
+		SpanID            string          `json:"spanId"`
+		ParentSpanID      string          `json:"parentSpanId,omitempty"`
+		Name              string          `json:"name"`
+		Kind              int             `json:"kind"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		Events            []otlpEvent     `json:"events,omitempty"`
+		Status            *otlpStatus     `json:"status,omitempty"`
+	}
+	otlpEvent struct {
+		TimeUnixNano string          `json:"timeUnixNano"`
+		Name         string          `json:"name"`
+		Attributes   []otlpAttribute `json:"attributes,omitempty"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+	otlpAttribute struct {
+		Key   string                 `json:"key"`
+		Value map[string]interface{} `json:"value"`
+	}
+)
+
+// otlpStatusError is the OTLP code of failed spans.
+const otlpStatusError = 2
+
+func (e *OTLP) request(spans []*Span) *otlpRequest {
+	encoded := make([]otlpSpan, 0, len(spans))
+	for _, span := range spans {
+		end, attributes, events, err := span.snapshot()
+		s := otlpSpan{
+			TraceID:           hex.EncodeToString(span.Context.TraceID[:]),
+			SpanID:            hex.EncodeToString(span.Context.SpanID[:]),
+			Name:              span.Name,
+			Kind:              span.Kind,
+			StartTimeUnixNano: unixNano(span.Start),
+			EndTimeUnixNano:   unixNano(end),
+			Attributes:        encodeAttributes(attributes),
+		}
+		if span.Parent != (SpanID{}) {
+			s.ParentSpanID = hex.EncodeToString(span.Parent[:])
+		}
+		for _, event := range events {
+			s.Events = append(s.Events, otlpEvent{
+				TimeUnixNano: unixNano(event.Time),
+				Name:         event.Name,
+				Attributes:   encodeAttributes(event.Attributes),
+			})
+		}
+		if err != "" {
+			s.Status = &otlpStatus{Code: otlpStatusError, Message: err}
+		}
+		encoded = append(encoded, s)
+	}
+
+	return &otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: encodeAttributes([]Attribute{{Key: "service.name", Value: e.service}})},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: e.service}, Spans: encoded}},
+	}}}
+}
+
+func encodeAttributes(attributes []Attribute) []otlpAttribute {
+	encoded := make([]otlpAttribute, 0, len(attributes))
+	for _, attribute := range attributes {
+		var value map[string]interface{}
+		switch v := attribute.Value.(type) {
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		case int:
+			value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			value = map[string]interface{}{"doubleValue": v}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+		encoded = append(encoded, otlpAttribute{Key: attribute.Key, Value: value})
+	}
+	return encoded
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
@@ -0,0 +1,111 @@
+package tracing
+
+import (
+	"context"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+	"github.com/pyshx/fake-batch-server/pkg/storage"
+)
+
+// tracedStore records a span, as a child of the span in ctx, for every store
+// operation.
+type tracedStore struct {
+	storage.Store
+	ctx context.Context
+}
+
+// WrapStore returns store recording a child span of the span in ctx for each
+// operation. It returns store itself if ctx carries no span.
+func WrapStore(ctx context.Context, store storage.Store) storage.Store {
+	if FromContext(ctx) == nil {
+		return store
+	}
+	return &tracedStore{Store: store, ctx: ctx}
+}
+
+// trace records a span named after op around fn.
+func (s *tracedStore) trace(op, name string, fn func() error) {
+	_, span := Start(s.ctx, "store."+op)
+	span.SetAttributes(Attribute{Key: "batch.resource", Value: name})
+	err := fn()
+	span.SetError(err)
+	span.End()
+}
+
+func (s *tracedStore) CreateJob(job *api.Job) (err error) {
+	s.trace("CreateJob", job.Name, func() error { err = s.Store.CreateJob(job); return err })
+	return err
+}
+
+func (s *tracedStore) GetJob(name string) (job *api.Job, err error) {
+	s.trace("GetJob", name, func() error { job, err = s.Store.GetJob(name); return err })
+	return job, err
+}
+
+func (s *tracedStore) GetJobByUID(uid string) (job *api.Job, err error) {
+	s.trace("GetJobByUID", uid, func() error { job, err = s.Store.GetJobByUID(uid); return err })
+	return job, err
+}
+
+func (s *tracedStore) ListJobs(project, location string) (jobs []*api.Job, err error) {
+	s.trace("ListJobs", "projects/"+project+"/locations/"+location, func() error {
+		jobs, err = s.Store.ListJobs(project, location)
+		return err
+	})
+	return jobs, err
+}
+
+func (s *tracedStore) UpdateJob(job *api.Job) (err error) {
+	s.trace("UpdateJob", job.Name, func() error { err = s.Store.UpdateJob(job); return err })
+	return err
+}
+
+func (s *tracedStore) DeleteJob(name string) (err error) {
+	s.trace("DeleteJob", name, func() error { err = s.Store.DeleteJob(name); return err })
+	return err
+}
+
+func (s *tracedStore) CreateTask(jobName string, task *api.Task) (err error) {
+	s.trace("CreateTask", task.Name, func() error { err = s.Store.CreateTask(jobName, task); return err })
+	return err
+}
+
+func (s *tracedStore) GetTask(jobName, taskName string) (task *api.Task, err error) {
+	s.trace("GetTask", taskName, func() error { task, err = s.Store.GetTask(jobName, taskName); return err })
+	return task, err
+}
+
+func (s *tracedStore) ListTasks(jobName string) (tasks []*api.Task, err error) {
+	s.trace("ListTasks", jobName, func() error { tasks, err = s.Store.ListTasks(jobName); return err })
+	return tasks, err
+}
+
+func (s *tracedStore) UpdateTask(jobName string, task *api.Task) (err error) {
+	s.trace("UpdateTask", task.Name, func() error { err = s.Store.UpdateTask(jobName, task); return err })
+	return err
+}
+
+func (s *tracedStore) GetTaskProgress(jobName, group string) (progress *storage.TaskProgress, err error) {
+	s.trace("GetTaskProgress", jobName+"/taskGroups/"+group, func() error { progress, err = s.Store.GetTaskProgress(jobName, group); return err })
+	return progress, err
+}
+
+func (s *tracedStore) UpdateTaskProgress(jobName, group string, progress *storage.TaskProgress) (err error) {
+	s.trace("UpdateTaskProgress", jobName+"/taskGroups/"+group, func() error { err = s.Store.UpdateTaskProgress(jobName, group, progress); return err })
+	return err
+}
+
+func (s *tracedStore) CreateOperation(op *api.Operation) (err error) {
+	s.trace("CreateOperation", op.Name, func() error { err = s.Store.CreateOperation(op); return err })
+	return err
+}
+
+func (s *tracedStore) GetOperation(name string) (op *api.Operation, err error) {
+	s.trace("GetOperation", name, func() error { op, err = s.Store.GetOperation(name); return err })
+	return op, err
+}
+
+func (s *tracedStore) UpdateOperation(op *api.Operation) (err error) {
+	s.trace("UpdateOperation", op.Name, func() error { err = s.Store.UpdateOperation(op); return err })
+	return err
+}
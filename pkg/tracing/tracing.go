@@ -0,0 +1,260 @@
+// Package tracing records OpenTelemetry-compatible spans for requests and
+// simulations and exports them over OTLP. Incoming W3C traceparent headers
+// are honored, so the emulator's spans join the traces of its clients.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceID identifies a trace.
+type TraceID [16]byte
+
+// SpanID identifies a span within a trace.
+type SpanID [8]byte
+
+// SpanContext is the part of a span propagated across process boundaries.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+// IsValid reports whether sc identifies a span.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// Traceparent formats sc as a W3C traceparent header value.
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", hex.EncodeToString(sc.TraceID[:]), hex.EncodeToString(sc.SpanID[:]), flags)
+}
+
+// ParseTraceparent parses a W3C traceparent header value.
+func ParseTraceparent(value string) (SpanContext, bool) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return sc, false
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, false
+	}
+	var flags [1]byte
+	if _, err := hex.Decode(flags[:], []byte(parts[3])); err != nil {
+		return sc, false
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, sc.IsValid()
+}
+
+// Extract returns ctx carrying the remote parent found in the traceparent
+// header of h, if any.
+func Extract(ctx context.Context, h http.Header) context.Context {
+	if sc, ok := ParseTraceparent(h.Get("traceparent")); ok {
+		return ContextWithRemoteParent(ctx, sc)
+	}
+	return ctx
+}
+
+// Inject sets the traceparent header of h to the span in ctx, if any.
+func Inject(ctx context.Context, h http.Header) {
+	if sc := SpanContextFromContext(ctx); sc.IsValid() {
+		h.Set("traceparent", sc.Traceparent())
+	}
+}
+
+// Span kinds, as numbered by OTLP.
+const (
+	KindInternal = 1
+	KindServer   = 2
+	KindClient   = 3
+)
+
+// Attribute is a key/value pair describing a span or event. Values are
+// strings, bools, ints or float64s.
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// Event is a timestamped annotation of a span.
+type Event struct {
+	Name       string
+	Time       time.Time
+	Attributes []Attribute
+}
+
+// Span is a timed operation. All methods are safe to call on a nil Span,
+// which is what Start returns when tracing is disabled.
+type Span struct {
+	tracer *Tracer
+
+	Name    string
+	Kind    int
+	Context SpanContext
+	Parent  SpanID
+	Start   time.Time
+
+	mu         sync.Mutex
+	end        time.Time
+	attributes []Attribute
+	events     []Event
+	err        string
+	ended      bool
+}
+
+// SetAttributes adds attributes to s.
+func (s *Span) SetAttributes(attributes ...Attribute) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.attributes = append(s.attributes, attributes...)
+}
+
+// AddEvent records an event that happened at the given time.
+func (s *Span) AddEvent(name string, at time.Time, attributes ...Attribute) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.events = append(s.events, Event{Name: name, Time: at, Attributes: attributes})
+}
+
+// SetError marks s as failed with err. A nil err is ignored.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.err = err.Error()
+}
+
+// End completes s and hands it to the exporter if it is sampled. Only the
+// first call has an effect.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mu.Unlock()
+
+	if s.Context.Sampled {
+		s.tracer.exporter.Export(s)
+	}
+}
+
+// snapshot returns the fields of an ended span for export.
+func (s *Span) snapshot() (end time.Time, attributes []Attribute, events []Event, err string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.end, s.attributes, s.events, s.err
+}
+
+// Exporter receives ended spans.
+type Exporter interface {
+	Export(span *Span)
+}
+
+// Tracer starts spans for a service. A nil Tracer starts no spans.
+type Tracer struct {
+	service  string
+	exporter Exporter
+}
+
+// NewTracer creates a Tracer handing spans of service to exporter.
+func NewTracer(service string, exporter Exporter) *Tracer {
+	return &Tracer{service: service, exporter: exporter}
+}
+
+// Start starts a span of the given kind, as a child of the span or remote
+// parent in ctx, and returns a context carrying it.
+func (t *Tracer) Start(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+
+	span := &Span{tracer: t, Name: name, Kind: kind, Start: time.Now()}
+	parent := SpanContextFromContext(ctx)
+	if parent.IsValid() {
+		span.Context.TraceID = parent.TraceID
+		span.Context.Sampled = parent.Sampled
+		span.Parent = parent.SpanID
+	} else {
+		rand.Read(span.Context.TraceID[:])
+		span.Context.Sampled = true
+	}
+	rand.Read(span.Context.SpanID[:])
+
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// Start starts an internal span as a child of the span in ctx, using that
+// span's tracer. It starts nothing if ctx carries no span.
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	parent := FromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	return parent.tracer.Start(ctx, name, KindInternal)
+}
+
+type spanKey struct{}
+
+type remoteKey struct{}
+
+// FromContext returns the span carried by ctx, or nil.
+func FromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// ContextWithRemoteParent returns ctx carrying sc as the parent of the next
+// span started from it.
+func ContextWithRemoteParent(ctx context.Context, sc SpanContext) context.Context {
+	if !sc.IsValid() {
+		return ctx
+	}
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+// SpanContextFromContext returns the span context of the span in ctx, or of
+// its remote parent if no span was started from it.
+func SpanContextFromContext(ctx context.Context) SpanContext {
+	if span := FromContext(ctx); span != nil {
+		return span.Context
+	}
+	sc, _ := ctx.Value(remoteKey{}).(SpanContext)
+	return sc
+}
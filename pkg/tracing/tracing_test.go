@@ -0,0 +1,149 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pyshx/fake-batch-server/pkg/storage"
+)
+
+// recorder keeps exported spans in memory.
+type recorder struct {
+	mu    sync.Mutex
+	spans []*Span
+}
+
+func (r *recorder) Export(span *Span) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, span)
+}
+
+func TestParseTraceparent(t *testing.T) {
+	const header = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, ok := ParseTraceparent(header)
+	require.True(t, ok)
+	assert.True(t, sc.Sampled)
+	assert.Equal(t, header, sc.Traceparent())
+
+	for _, invalid := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"00-xyz92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	} {
+		_, ok := ParseTraceparent(invalid)
+		assert.False(t, ok, invalid)
+	}
+}
+
+func TestTracer_Start(t *testing.T) {
+	exporter := &recorder{}
+	tracer := NewTracer("test", exporter)
+
+	remote, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx, parent := tracer.Start(ContextWithRemoteParent(context.Background(), remote), "parent", KindServer)
+	assert.Equal(t, remote.TraceID, parent.Context.TraceID)
+	assert.Equal(t, remote.SpanID, parent.Parent)
+
+	_, child := Start(ctx, "child")
+	child.SetError(errors.New("boom"))
+	child.End()
+	child.End()
+	parent.End()
+
+	require.Len(t, exporter.spans, 2)
+	assert.Equal(t, "child", exporter.spans[0].Name)
+	assert.Equal(t, parent.Context.SpanID, exporter.spans[0].Parent)
+	assert.Equal(t, remote.TraceID, exporter.spans[0].Context.TraceID)
+
+	header := http.Header{}
+	Inject(ctx, header)
+	assert.Equal(t, parent.Context.Traceparent(), header.Get("traceparent"))
+
+	// Unsampled parents are followed but not exported
+	remote.Sampled = false
+	_, span := tracer.Start(ContextWithRemoteParent(context.Background(), remote), "unsampled", KindServer)
+	span.End()
+	assert.Len(t, exporter.spans, 2)
+
+	// Tracing is disabled without a tracer or a span to continue
+	var none *Tracer
+	_, span = none.Start(context.Background(), "disabled", KindServer)
+	assert.Nil(t, span)
+	_, span = Start(context.Background(), "orphan")
+	assert.Nil(t, span)
+	span.SetAttributes(Attribute{Key: "k", Value: "v"})
+	span.End()
+}
+
+func TestWrapStore(t *testing.T) {
+	store := storage.NewMemoryStore()
+	assert.Same(t, store, WrapStore(context.Background(), store))
+
+	exporter := &recorder{}
+	ctx, _ := NewTracer("test", exporter).Start(context.Background(), "request", KindServer)
+	_, err := WrapStore(ctx, store).GetJob("projects/p/locations/l/jobs/missing")
+	assert.Error(t, err)
+
+	require.Len(t, exporter.spans, 1)
+	span := exporter.spans[0]
+	assert.Equal(t, "store.GetJob", span.Name)
+	_, attributes, _, spanErr := span.snapshot()
+	assert.Equal(t, []Attribute{{Key: "batch.resource", Value: "projects/p/locations/l/jobs/missing"}}, attributes)
+	assert.NotEmpty(t, spanErr)
+}
+
+func TestOTLP(t *testing.T) {
+	var mu sync.Mutex
+	var requests []otlpRequest
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/traces", r.URL.Path)
+		var req otlpRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, req)
+	}))
+	defer collector.Close()
+
+	exporter := NewOTLP(collector.URL, "fake-batch-server", time.Second)
+	tracer := NewTracer("fake-batch-server", exporter)
+	ctx, parent := tracer.Start(context.Background(), "GET /jobs", KindServer)
+	_, child := Start(ctx, "store.ListJobs")
+	child.AddEvent("job RUNNING", time.Unix(0, 42), Attribute{Key: "attempt", Value: 1})
+	child.End()
+	parent.SetAttributes(Attribute{Key: "http.response.status_code", Value: 200})
+	parent.End()
+	exporter.Shutdown()
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, requests, 1)
+	resource := requests[0].ResourceSpans[0]
+	assert.Equal(t, "service.name", resource.Resource.Attributes[0].Key)
+	spans := resource.ScopeSpans[0].Spans
+	require.Len(t, spans, 2)
+	assert.Equal(t, "store.ListJobs", spans[0].Name)
+	assert.Equal(t, spans[1].SpanID, spans[0].ParentSpanID)
+	assert.Equal(t, spans[1].TraceID, spans[0].TraceID)
+	assert.Equal(t, "42", spans[0].Events[0].TimeUnixNano)
+	assert.Equal(t, map[string]interface{}{"intValue": "200"}, spans[1].Attributes[0].Value)
+	assert.Equal(t, KindServer, spans[1].Kind)
+	assert.Empty(t, spans[1].ParentSpanID)
+
+	// Spans ended after shutdown are dropped
+	_, late := tracer.Start(context.Background(), "late", KindServer)
+	late.End()
+}
@@ -0,0 +1,216 @@
+// Dashboard for the fake Batch server. The job list comes from
+// /admin/snapshot; task logs and actions use the regular API.
+"use strict";
+
+const state = {
+  snapshot: { jobs: [], tasks: {} },
+  project: null,
+  job: null,
+  task: null,
+};
+
+const $ = (id) => document.getElementById(id);
+
+async function request(method, path, body) {
+  const response = await fetch(path, {
+    method,
+    headers: body ? { "Content-Type": "application/json" } : {},
+    body: body ? JSON.stringify(body) : undefined,
+  });
+  const data = await response.json().catch(() => ({}));
+  if (!response.ok) {
+    throw new Error((data.error && data.error.message) || response.statusText);
+  }
+  return data;
+}
+
+function showError(err) {
+  $("error").textContent = err ? err.message : "";
+}
+
+function projectOf(name) {
+  return name.split("/")[1];
+}
+
+function shortName(name) {
+  return name.substring(name.lastIndexOf("/jobs/") + 6);
+}
+
+function formatTime(time) {
+  return time ? new Date(time).toLocaleString() : "";
+}
+
+function cell(row, text, className) {
+  const td = row.insertCell();
+  td.textContent = text == null ? "" : text;
+  if (className) {
+    td.className = className;
+  }
+  return td;
+}
+
+function stateCell(row, value) {
+  cell(row, value, "state state-" + value);
+}
+
+function taskCounts(job) {
+  const counts = {};
+  const groups = (job.status && job.status.taskGroups) || {};
+  for (const group of Object.values(groups)) {
+    for (const [taskState, count] of Object.entries(group.counts || {})) {
+      counts[taskState] = (counts[taskState] || 0) + Number(count);
+    }
+  }
+  return Object.entries(counts).map(([s, n]) => s + ": " + n).join(", ");
+}
+
+function renderEvents(tbody, events) {
+  tbody.replaceChildren();
+  for (const event of events || []) {
+    const row = tbody.insertRow();
+    cell(row, formatTime(event.eventTime));
+    cell(row, event.type);
+    cell(row, event.description);
+  }
+}
+
+function renderProjects() {
+  const projects = [...new Set(state.snapshot.jobs.map((job) => projectOf(job.name)))].sort();
+  if (!projects.includes(state.project)) {
+    state.project = projects[0] || null;
+  }
+
+  const list = $("projects");
+  list.replaceChildren();
+  for (const project of projects) {
+    const item = document.createElement("li");
+    const count = state.snapshot.jobs.filter((job) => projectOf(job.name) === project).length;
+    item.textContent = project + " (" + count + ")";
+    item.classList.toggle("selected", project === state.project);
+    item.onclick = () => {
+      state.project = project;
+      state.job = null;
+      state.task = null;
+      render();
+    };
+    list.appendChild(item);
+  }
+}
+
+function renderJobs() {
+  const tbody = $("jobs");
+  tbody.replaceChildren();
+  for (const job of state.snapshot.jobs) {
+    if (projectOf(job.name) !== state.project) {
+      continue;
+    }
+    const row = tbody.insertRow();
+    row.classList.toggle("selected", job.name === state.job);
+    cell(row, shortName(job.name));
+    stateCell(row, job.state);
+    cell(row, taskCounts(job));
+    cell(row, formatTime(job.createTime));
+    cell(row, formatTime(job.updateTime));
+    row.onclick = () => {
+      state.job = job.name;
+      state.task = null;
+      render();
+    };
+  }
+}
+
+function renderJob() {
+  const job = state.snapshot.jobs.find((j) => j.name === state.job);
+  $("job-pane").hidden = !job;
+  if (!job) {
+    state.job = null;
+    return;
+  }
+
+  $("job-name").textContent = job.name;
+  renderEvents($("job-events"), job.status && job.status.statusEvents);
+
+  const tasks = state.snapshot.tasks[job.name] || [];
+  const tbody = $("tasks");
+  tbody.replaceChildren();
+  for (const task of tasks) {
+    const events = task.status.statusEvents || [];
+    const last = events[events.length - 1];
+    const row = tbody.insertRow();
+    row.classList.toggle("selected", task.name === state.task);
+    cell(row, task.name.substring(job.name.length + 1));
+    stateCell(row, task.status.state);
+    cell(row, last ? last.description : "");
+    row.onclick = () => {
+      state.task = task.name;
+      render();
+    };
+  }
+
+  const task = tasks.find((t) => t.name === state.task);
+  $("task-pane").hidden = !task;
+  if (task) {
+    $("task-name").textContent = task.name;
+    renderEvents($("task-events"), task.status.statusEvents);
+    loadLogs(task.name);
+  }
+}
+
+async function loadLogs(taskName) {
+  try {
+    const data = await request("GET", "/v1/" + taskName + "/logs");
+    if (taskName === state.task) {
+      $("logs").textContent = (data.entries || [])
+        .map((entry) => formatTime(entry.time) + "  " + entry.text)
+        .join("\n");
+    }
+  } catch (err) {
+    showError(err);
+  }
+}
+
+function render() {
+  renderProjects();
+  renderJobs();
+  renderJob();
+}
+
+async function refresh() {
+  try {
+    state.snapshot = await request("GET", "/admin/snapshot");
+    showError(null);
+    render();
+  } catch (err) {
+    showError(err);
+  }
+}
+
+async function act(method, path, body) {
+  try {
+    await request(method, path, body);
+    showError(null);
+  } catch (err) {
+    showError(err);
+  }
+  refresh();
+}
+
+for (const button of document.querySelectorAll("[data-force]")) {
+  button.onclick = () => act("POST", "/admin/" + state.job + "/state", { state: button.dataset.force });
+}
+
+$("delete").onclick = () => {
+  if (confirm("Delete " + state.job + "?")) {
+    act("DELETE", "/v1/" + state.job);
+  }
+};
+
+$("refresh").onclick = refresh;
+
+setInterval(() => {
+  if ($("auto-refresh").checked) {
+    refresh();
+  }
+}, 2000);
+
+refresh();
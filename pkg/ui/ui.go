@@ -0,0 +1,38 @@
+// Package ui serves a small web dashboard for browsing the jobs, tasks,
+// status events and logs held by the emulator. The page talks to the regular
+// API and admin endpoints from the browser.
+package ui
+
+import (
+	"embed"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+//go:embed static
+var static embed.FS
+
+// Handler serves the dashboard files for requests under prefix, e.g. "/ui/".
+func Handler(prefix string) http.Handler {
+	files, err := fs.Sub(static, "static")
+	if err != nil {
+		panic(err)
+	}
+	server := http.StripPrefix(prefix, http.FileServer(http.FS(files)))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The server sets a JSON content type on every response, which
+		// FileServer would keep.
+		name := strings.TrimPrefix(r.URL.Path, prefix)
+		if name == "" || strings.HasSuffix(name, "/") {
+			name += "index.html"
+		}
+		if contentType := mime.TypeByExtension(path.Ext(name)); contentType != "" {
+			w.Header().Set("Content-Type", contentType)
+		}
+		server.ServeHTTP(w, r)
+	})
+}
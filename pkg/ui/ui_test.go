@@ -0,0 +1,33 @@
+package ui
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler(t *testing.T) {
+	handler := Handler("/ui/")
+
+	for path, contentType := range map[string]string{
+		"/ui/":          "text/html",
+		"/ui/app.js":    "javascript",
+		"/ui/style.css": "text/css",
+	} {
+		w := httptest.NewRecorder()
+		// The server marks every response as JSON before it gets here.
+		w.Header().Set("Content-Type", "application/json")
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+
+		require.Equal(t, http.StatusOK, w.Code, path)
+		assert.Contains(t, w.Header().Get("Content-Type"), contentType, path)
+		assert.NotEmpty(t, w.Body.String(), path)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/ui/missing.js", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
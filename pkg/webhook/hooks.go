@@ -0,0 +1,230 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+	"github.com/pyshx/fake-batch-server/pkg/tracing"
+	"github.com/pyshx/fake-batch-server/pkg/workqueue"
+)
+
+const (
+	// deliveryWorkers is the number of goroutines posting events.
+	deliveryWorkers = 4
+	// deliveryBacklog is how many deliveries may wait for each worker before
+	// Deliver blocks handing it more.
+	deliveryBacklog = 256
+)
+
+// Hook is a URL that receives an Event for every state change.
+type Hook struct {
+	ID  string `json:"id" yaml:"id"`
+	URL string `json:"url" yaml:"url"`
+	// Types limits the hook to api.NotificationTypeJobStateChanged or
+	// api.NotificationTypeTaskStateChanged events. It receives both when
+	// empty.
+	Types []string `json:"types,omitempty" yaml:"types"`
+}
+
+// wants reports whether h receives events of the given type.
+func (h *Hook) wants(eventType string) bool {
+	if len(h.Types) == 0 {
+		return true
+	}
+	for _, t := range h.Types {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks that h has an http or https URL and known types.
+func (h *Hook) Validate() error {
+	u, err := url.Parse(h.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid webhook URL %q, must be an http or https URL", h.URL)
+	}
+	for _, t := range h.Types {
+		if t != api.NotificationTypeJobStateChanged && t != api.NotificationTypeTaskStateChanged {
+			return fmt.Errorf("unsupported webhook type %q", t)
+		}
+	}
+	return nil
+}
+
+// Event is the body posted to hooks.
+type Event struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	Job  *api.Job  `json:"job"`
+	// Task is the task whose state changed, for TASK_STATE_CHANGED events.
+	Task *api.Task `json:"task,omitempty"`
+}
+
+// LoadHooks reads hooks from a YAML or JSON file of the form
+// {"webhooks": [{"url": "...", "types": ["JOB_STATE_CHANGED"]}]}.
+func LoadHooks(path string) ([]*Hook, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config struct {
+		Webhooks []*Hook `yaml:"webhooks"`
+	}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse webhooks config %s: %v", path, err)
+	}
+	return config.Webhooks, nil
+}
+
+// Registry holds the hooks called on state changes. Events are posted off
+// the caller's goroutine, so that a slow endpoint does not hold up the
+// request or simulation that changed the state; the events of a job are
+// posted one after another, in the order they were delivered.
+type Registry struct {
+	client *http.Client
+	// ctx is the context of the posts, which outlive the context of the
+	// change that caused them. It is cancelled by Close.
+	ctx    context.Context
+	cancel context.CancelFunc
+	calls  *workqueue.Queue
+
+	mu    sync.Mutex
+	seq   int
+	hooks []*Hook
+}
+
+// NewRegistry creates an empty Registry whose requests time out after
+// timeout.
+func NewRegistry(timeout time.Duration) *Registry {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Registry{
+		client: &http.Client{Timeout: timeout},
+		ctx:    ctx,
+		cancel: cancel,
+		calls:  workqueue.New(deliveryWorkers, deliveryBacklog),
+	}
+}
+
+// Close cancels the posts in flight and queued, and waits for them to give
+// up. Events delivered afterwards are dropped.
+func (r *Registry) Close() {
+	r.cancel()
+	r.calls.Close()
+}
+
+// Add validates and registers hook, assigning it an ID if it has none.
+func (r *Registry) Add(hook *Hook) error {
+	if err := hook.Validate(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if hook.ID == "" {
+		r.seq++
+		hook.ID = fmt.Sprintf("webhook-%d", r.seq)
+	}
+	for _, existing := range r.hooks {
+		if existing.ID == hook.ID {
+			return fmt.Errorf("webhook %s already exists", hook.ID)
+		}
+	}
+	r.hooks = append(r.hooks, hook)
+	return nil
+}
+
+// List returns the registered hooks in the order they were added.
+func (r *Registry) List() []*Hook {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]*Hook{}, r.hooks...)
+}
+
+// Remove unregisters the hook with the given ID and reports whether it
+// existed.
+func (r *Registry) Remove(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, hook := range r.hooks {
+		if hook.ID == id {
+			r.hooks = append(r.hooks[:i], r.hooks[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Deliver queues an Event for the state change of task, or of job if task is
+// nil, to be posted to every hook that wants it, one after another. The event
+// is encoded before Deliver returns, so job and task may change afterwards.
+// Each hook is attempted once; failures are logged.
+func (r *Registry) Deliver(ctx context.Context, job *api.Job, task *api.Task, at time.Time) {
+	event := &Event{Type: api.NotificationTypeJobStateChanged, Time: at, Job: job, Task: task}
+	if task != nil {
+		event.Type = api.NotificationTypeTaskStateChanged
+	}
+
+	var hooks []*Hook
+	for _, hook := range r.List() {
+		if hook.wants(event.Type) {
+			hooks = append(hooks, hook)
+		}
+	}
+	if len(hooks) == 0 {
+		return
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		logrus.Errorf("Failed to encode webhook event for %s: %v", job.Name, err)
+		return
+	}
+
+	ctx = tracing.ContextWithRemoteParent(r.ctx, tracing.SpanContextFromContext(ctx))
+	r.calls.Add(job.Name, func() {
+		for _, hook := range hooks {
+			r.post(ctx, hook, body)
+		}
+	})
+}
+
+// post sends body to hook.
+func (r *Registry) post(ctx context.Context, hook *Hook, body []byte) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		logrus.Warnf("Webhook %s to %s failed: %v", hook.ID, hook.URL, err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	tracing.Inject(ctx, req.Header)
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		if r.ctx.Err() != nil {
+			return
+		}
+		logrus.Warnf("Webhook %s to %s failed: %v", hook.ID, hook.URL, err)
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		logrus.Warnf("Webhook %s to %s returned %d", hook.ID, hook.URL, resp.StatusCode)
+	}
+}
@@ -0,0 +1,138 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+)
+
+func TestRegistry_AddRemove(t *testing.T) {
+	registry := NewRegistry(time.Second)
+
+	hook := &Hook{URL: "http://localhost:9000/events"}
+	require.NoError(t, registry.Add(hook))
+	assert.Equal(t, "webhook-1", hook.ID)
+	require.NoError(t, registry.Add(&Hook{ID: "named", URL: "https://example.com", Types: []string{api.NotificationTypeTaskStateChanged}}))
+
+	assert.Error(t, registry.Add(&Hook{ID: "named", URL: "https://example.com"}))
+	assert.Error(t, registry.Add(&Hook{URL: "ftp://example.com"}))
+	assert.Error(t, registry.Add(&Hook{URL: "http://example.com", Types: []string{"JOB_CREATED"}}))
+	assert.Len(t, registry.List(), 2)
+
+	assert.True(t, registry.Remove("webhook-1"))
+	assert.False(t, registry.Remove("webhook-1"))
+	require.Len(t, registry.List(), 1)
+	assert.Equal(t, "named", registry.List()[0].ID)
+}
+
+func TestRegistry_Deliver(t *testing.T) {
+	var mu sync.Mutex
+	received := make(map[string][]string)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event Event
+		json.NewDecoder(r.Body).Decode(&event)
+		state := string(event.Job.State)
+		if event.Task != nil {
+			state = string(event.Task.Status.State)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		received[r.URL.Path] = append(received[r.URL.Path], event.Type+" "+state)
+	}))
+	defer server.Close()
+
+	registry := NewRegistry(time.Second)
+	defer registry.Close()
+	require.NoError(t, registry.Add(&Hook{URL: server.URL + "/all"}))
+	require.NoError(t, registry.Add(&Hook{URL: server.URL + "/jobs", Types: []string{api.NotificationTypeJobStateChanged}}))
+
+	job := &api.Job{Name: "projects/p/locations/l/jobs/j", State: api.JobStateRunning}
+	task := &api.Task{Name: job.Name + "/taskGroups/group0/tasks/0", Status: &api.TaskStatus{State: api.TaskStateRunning}}
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	registry.Deliver(context.Background(), job, task, now)
+	registry.Deliver(context.Background(), job, nil, now)
+
+	want := map[string][]string{
+		"/all":  {"TASK_STATE_CHANGED RUNNING", "JOB_STATE_CHANGED RUNNING"},
+		"/jobs": {"JOB_STATE_CHANGED RUNNING"},
+	}
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return assert.ObjectsAreEqual(want, received)
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestRegistry_DeliverBlockingHook(t *testing.T) {
+	release := make(chan struct{})
+	received := make(chan string, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event Event
+		json.NewDecoder(r.Body).Decode(&event)
+		<-release
+		received <- string(event.Job.State)
+	}))
+	defer server.Close()
+
+	registry := NewRegistry(time.Minute)
+	defer registry.Close()
+	require.NoError(t, registry.Add(&Hook{URL: server.URL}))
+
+	job := &api.Job{Name: "projects/p/locations/l/jobs/j", State: api.JobStateRunning}
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	delivered := make(chan struct{})
+	go func() {
+		registry.Deliver(context.Background(), job, nil, now)
+		job.State = api.JobStateSucceeded
+		registry.Deliver(context.Background(), job, nil, now)
+		close(delivered)
+	}()
+
+	select {
+	case <-delivered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Deliver waited for the hook endpoint")
+	}
+
+	close(release)
+	for _, want := range []api.JobState{api.JobStateRunning, api.JobStateSucceeded} {
+		select {
+		case state := <-received:
+			assert.Equal(t, string(want), state)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s event was not posted", want)
+		}
+	}
+}
+
+func TestLoadHooks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "webhooks.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+webhooks:
+  - url: http://localhost:9000/events
+  - id: failures
+    url: http://localhost:9000/tasks
+    types: [TASK_STATE_CHANGED]
+`), 0o644))
+
+	hooks, err := LoadHooks(path)
+	require.NoError(t, err)
+	require.Len(t, hooks, 2)
+	assert.Equal(t, "http://localhost:9000/events", hooks[0].URL)
+	assert.Equal(t, "failures", hooks[1].ID)
+	assert.Equal(t, []string{api.NotificationTypeTaskStateChanged}, hooks[1].Types)
+
+	_, err = LoadHooks(filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,104 @@
+// Package webhook calls the per-job callback URLs declared in job labels once
+// the job reaches a terminal state, and the server-wide hooks registered for
+// every state change.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+)
+
+// Labels that declare the callbacks of an individual job.
+const (
+	// SuccessURLLabel is called when the job SUCCEEDED.
+	SuccessURLLabel = "fake-batch/on-success-url"
+	// FailureURLLabel is called when the job FAILED.
+	FailureURLLabel = "fake-batch/on-failure-url"
+)
+
+// DefaultTimeout bounds a single callback request.
+const DefaultTimeout = 10 * time.Second
+
+// Validate checks that the callback labels of job hold absolute http or
+// https URLs.
+func Validate(job *api.Job) error {
+	for _, label := range []string{SuccessURLLabel, FailureURLLabel} {
+		value, ok := job.Labels[label]
+		if !ok {
+			continue
+		}
+		u, err := url.Parse(value)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid %s %q, must be an http or https URL", label, value)
+		}
+	}
+	return nil
+}
+
+// CallbackURL returns the callback URL job declares for its current state, or
+// an empty string if there is none.
+func CallbackURL(job *api.Job) string {
+	switch job.State {
+	case api.JobStateSucceeded:
+		return job.Labels[SuccessURLLabel]
+	case api.JobStateFailed:
+		return job.Labels[FailureURLLabel]
+	default:
+		return ""
+	}
+}
+
+// Notifier posts finished jobs to their callback URLs.
+type Notifier struct {
+	client *http.Client
+}
+
+// NewNotifier creates a Notifier whose requests time out after timeout.
+func NewNotifier(timeout time.Duration) *Notifier {
+	return &Notifier{client: &http.Client{Timeout: timeout}}
+}
+
+// Notify posts the JSON of job to the callback URL for its terminal state, if
+// it declares one. The callback is attempted once; failures are logged and
+// returned.
+func (n *Notifier) Notify(ctx context.Context, job *api.Job) error {
+	callback := CallbackURL(job)
+	if callback == "" {
+		return nil
+	}
+
+	body, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, callback, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		logrus.Warnf("Callback for job %s to %s failed: %v", job.Name, callback, err)
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		logrus.Warnf("Callback for job %s to %s returned %d", job.Name, callback, resp.StatusCode)
+		return fmt.Errorf("callback returned %d", resp.StatusCode)
+	}
+
+	logrus.Infof("Called back %s for job %s (%s)", callback, job.Name, job.State)
+	return nil
+}
@@ -0,0 +1,86 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+)
+
+func TestValidate(t *testing.T) {
+	assert.NoError(t, Validate(&api.Job{}))
+	assert.NoError(t, Validate(&api.Job{Labels: map[string]string{
+		SuccessURLLabel: "http://localhost:9000/done",
+		FailureURLLabel: "https://example.com/failed",
+	}}))
+	assert.Error(t, Validate(&api.Job{Labels: map[string]string{SuccessURLLabel: "localhost:9000"}}))
+	assert.Error(t, Validate(&api.Job{Labels: map[string]string{FailureURLLabel: "ftp://example.com"}}))
+}
+
+func TestCallbackURL(t *testing.T) {
+	job := &api.Job{Labels: map[string]string{
+		SuccessURLLabel: "http://host/success",
+		FailureURLLabel: "http://host/failure",
+	}}
+
+	job.State = api.JobStateRunning
+	assert.Empty(t, CallbackURL(job))
+	job.State = api.JobStateSucceeded
+	assert.Equal(t, "http://host/success", CallbackURL(job))
+	job.State = api.JobStateFailed
+	assert.Equal(t, "http://host/failure", CallbackURL(job))
+}
+
+func TestNotifier_Notify(t *testing.T) {
+	var received []*api.Job
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "POST", r.Method)
+		assert.Equal(t, "/failed", r.URL.Path)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+
+		var job api.Job
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&job))
+		received = append(received, &job)
+	}))
+	defer server.Close()
+
+	job := &api.Job{
+		Name:  "projects/p/locations/l/jobs/j",
+		State: api.JobStateFailed,
+		Labels: map[string]string{
+			SuccessURLLabel: server.URL + "/succeeded",
+			FailureURLLabel: server.URL + "/failed",
+		},
+	}
+
+	notifier := NewNotifier(time.Second)
+	require.NoError(t, notifier.Notify(context.Background(), job))
+	require.Len(t, received, 1)
+	assert.Equal(t, job.Name, received[0].Name)
+	assert.Equal(t, api.JobStateFailed, received[0].State)
+
+	// Jobs without a callback for their state are not posted.
+	job.Labels = map[string]string{SuccessURLLabel: server.URL + "/succeeded"}
+	require.NoError(t, notifier.Notify(context.Background(), job))
+	assert.Len(t, received, 1)
+}
+
+func TestNotifier_NotifyError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	job := &api.Job{
+		State:  api.JobStateSucceeded,
+		Labels: map[string]string{SuccessURLLabel: server.URL},
+	}
+	assert.Error(t, NewNotifier(time.Second).Notify(context.Background(), job))
+}
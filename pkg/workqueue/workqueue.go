@@ -0,0 +1,73 @@
+// Package workqueue calls functions on a few background goroutines, keeping
+// those queued under the same key in order, so that callers on a hot path,
+// such as the simulator's loop or an HTTP request, need not wait for slow
+// work like posting to a webhook endpoint.
+package workqueue
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// Queue calls the functions added to it on a fixed number of workers. The
+// functions added under a key are called one after another, in the order
+// they were added, by the same worker. Workers are started on first use.
+type Queue struct {
+	size    int
+	backlog int
+
+	mu      sync.Mutex
+	workers []chan func()
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+// New creates a Queue with the given number of workers, each of which holds
+// up to backlog functions waiting to be called.
+func New(workers, backlog int) *Queue {
+	return &Queue{size: workers, backlog: backlog}
+}
+
+// Add hands fn to the worker of key. It blocks while that worker's backlog is
+// full, and drops fn once the queue has been closed.
+func (q *Queue) Add(key string, fn func()) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return
+	}
+	if q.workers == nil {
+		q.workers = make([]chan func(), q.size)
+		for i := range q.workers {
+			calls := make(chan func(), q.backlog)
+			q.workers[i] = calls
+			q.wg.Add(1)
+			go func() {
+				defer q.wg.Done()
+				for call := range calls {
+					call()
+				}
+			}()
+		}
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	q.workers[h.Sum32()%uint32(len(q.workers))] <- fn
+}
+
+// Close stops the workers once they have called the functions already added,
+// and waits for them to exit. Close may be called more than once.
+func (q *Queue) Close() {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		for _, calls := range q.workers {
+			close(calls)
+		}
+	}
+	q.mu.Unlock()
+
+	q.wg.Wait()
+}
@@ -0,0 +1,44 @@
+package workqueue
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueue_OrderPerKey(t *testing.T) {
+	q := New(4, 8)
+
+	var mu sync.Mutex
+	calls := make(map[string][]int)
+	for i := 0; i < 100; i++ {
+		i := i
+		for _, key := range []string{"a", "b", "c"} {
+			key := key
+			q.Add(key, func() {
+				mu.Lock()
+				defer mu.Unlock()
+				calls[key] = append(calls[key], i)
+			})
+		}
+	}
+	q.Close()
+
+	for _, key := range []string{"a", "b", "c"} {
+		assert.Len(t, calls[key], 100, key)
+		for i, call := range calls[key] {
+			assert.Equal(t, i, call, key)
+		}
+	}
+}
+
+func TestQueue_Close(t *testing.T) {
+	q := New(2, 1)
+	q.Close()
+
+	called := false
+	q.Add("a", func() { called = true })
+	q.Close()
+	assert.False(t, called)
+}
@@ -9,25 +9,13 @@ import (
 	"sync"
 	"testing"
 
-	"github.com/gorilla/mux"
-
 	"github.com/pyshx/fake-batch-server/pkg/api"
-	"github.com/pyshx/fake-batch-server/pkg/handlers"
+	"github.com/pyshx/fake-batch-server/pkg/server"
 	"github.com/pyshx/fake-batch-server/pkg/storage"
 )
 
 func setupBenchmarkServer() *httptest.Server {
-	store := storage.NewMemoryStore()
-	handler := handlers.NewHandler(store)
-
-	router := mux.NewRouter()
-	v1 := router.PathPrefix("/v1").Subrouter()
-	
-	v1.HandleFunc("/projects/{project}/locations/{location}/jobs", handler.CreateJob).Methods("POST")
-	v1.HandleFunc("/projects/{project}/locations/{location}/jobs", handler.ListJobs).Methods("GET")
-	v1.HandleFunc("/projects/{project}/locations/{location}/jobs/{job}", handler.GetJob).Methods("GET")
-
-	return httptest.NewServer(router)
+	return httptest.NewServer(server.New())
 }
 
 func BenchmarkCreateJob(b *testing.B) {
@@ -138,16 +126,7 @@ func BenchmarkListJobs(b *testing.B) {
 }
 
 func BenchmarkConcurrentOperations(b *testing.B) {
-	store := storage.NewMemoryStore()
-	handler := handlers.NewHandler(store)
-
-	router := mux.NewRouter()
-	v1 := router.PathPrefix("/v1").Subrouter()
-	v1.HandleFunc("/projects/{project}/locations/{location}/jobs", handler.CreateJob).Methods("POST")
-	v1.HandleFunc("/projects/{project}/locations/{location}/jobs", handler.ListJobs).Methods("GET")
-	v1.HandleFunc("/projects/{project}/locations/{location}/jobs/{job}", handler.GetJob).Methods("GET")
-
-	server := httptest.NewServer(router)
+	server := setupBenchmarkServer()
 	defer server.Close()
 
 	client := &http.Client{}
@@ -6,41 +6,33 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"sync"
 	"testing"
 	"time"
 
-	"github.com/gorilla/mux"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
 	"github.com/pyshx/fake-batch-server/pkg/api"
+	batchassert "github.com/pyshx/fake-batch-server/pkg/assert"
+	"github.com/pyshx/fake-batch-server/pkg/clock"
 	"github.com/pyshx/fake-batch-server/pkg/handlers"
-	"github.com/pyshx/fake-batch-server/pkg/storage"
+	"github.com/pyshx/fake-batch-server/pkg/server"
 )
 
-func setupTestServer() *httptest.Server {
-	store := storage.NewMemoryStore()
-	handler := handlers.NewHandler(store)
-
-	router := mux.NewRouter()
-	v1 := router.PathPrefix("/v1").Subrouter()
-	
-	v1.HandleFunc("/projects/{project}/locations/{location}/jobs", handler.CreateJob).Methods("POST")
-	v1.HandleFunc("/projects/{project}/locations/{location}/jobs", handler.ListJobs).Methods("GET")
-	v1.HandleFunc("/projects/{project}/locations/{location}/jobs/{job}", handler.GetJob).Methods("GET")
-	v1.HandleFunc("/projects/{project}/locations/{location}/jobs/{job}", handler.DeleteJob).Methods("DELETE")
-	v1.HandleFunc("/projects/{project}/locations/{location}/jobs/{job}/tasks", handler.ListTasks).Methods("GET")
-	v1.HandleFunc("/projects/{project}/locations/{location}/jobs/{job}/tasks/{task}", handler.GetTask).Methods("GET")
-	v1.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(`{"status":"healthy"}`))
-	}).Methods("GET")
-
-	return httptest.NewServer(router)
+// setupTestServer starts a server whose simulation is driven by the returned
+// fake clock.
+func setupTestServer() (*httptest.Server, *clock.Fake) {
+	fake := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	return setupTestServerWithConfig(handlers.Config{Clock: fake}), fake
+}
+
+func setupTestServerWithConfig(cfg handlers.Config) *httptest.Server {
+	return httptest.NewServer(server.New(server.WithConfig(cfg)))
 }
 
 func TestEndToEnd_CompleteJobLifecycle(t *testing.T) {
-	server := setupTestServer()
+	server, fake := setupTestServer()
 	defer server.Close()
 
 	client := &http.Client{Timeout: 30 * time.Second}
@@ -140,8 +132,7 @@ func TestEndToEnd_CompleteJobLifecycle(t *testing.T) {
 	// 5. Get individual task
 	if len(taskList.Tasks) > 0 {
 		taskName := taskList.Tasks[0].Name
-		taskID := taskName[len(createdJob.Name+"/tasks/"):]
-		resp, err = client.Get(fmt.Sprintf("%s/%s/tasks/%s", baseURL, createdJob.Name, taskID))
+		resp, err = client.Get(baseURL + "/" + taskName)
 		require.NoError(t, err)
 		assert.Equal(t, http.StatusOK, resp.StatusCode)
 
@@ -153,25 +144,30 @@ func TestEndToEnd_CompleteJobLifecycle(t *testing.T) {
 	}
 
 	// 6. Monitor job state transitions
-	checkJobState := func(expectedState api.JobState) {
+	jobState := func() api.JobState {
 		resp, err := client.Get(baseURL + "/" + createdJob.Name)
 		require.NoError(t, err)
 		var job api.Job
 		json.NewDecoder(resp.Body).Decode(&job)
 		resp.Body.Close()
-		assert.Equal(t, expectedState, job.State)
+		return job.State
+	}
+	waitForJobState := func(expectedState api.JobState) {
+		batchassert.EventuallyJobState(t, client, baseURL, createdJob.Name, expectedState, 5*time.Second)
 	}
 
 	// Initial state should be QUEUED
-	checkJobState(api.JobStateQueued)
+	assert.Equal(t, api.JobStateQueued, jobState())
 
-	// Wait and check for RUNNING state
-	time.Sleep(3 * time.Second)
-	checkJobState(api.JobStateRunning)
+	// Advance past QUEUED and SCHEDULED to RUNNING
+	fake.Advance(3 * time.Second)
+	waitForJobState(api.JobStateRunning)
 
-	// Wait and check for SUCCEEDED state
-	time.Sleep(6 * time.Second)
-	checkJobState(api.JobStateSucceeded)
+	// Advance to SUCCEEDED. With parallelism 2 the five tasks run in three
+	// waves of 5 seconds each.
+	fake.Advance(15 * time.Second)
+	waitForJobState(api.JobStateSucceeded)
+	batchassert.TaskStateCounts(t, client, baseURL, createdJob.Name, "main-group", map[string]int64{"SUCCEEDED": 5}, 5*time.Second)
 
 	// 7. List all jobs
 	resp, err = client.Get(baseURL + "/projects/test-project/locations/us-central1/jobs")
@@ -190,18 +186,21 @@ func TestEndToEnd_CompleteJobLifecycle(t *testing.T) {
 	assert.Equal(t, http.StatusOK, resp.StatusCode)
 	resp.Body.Close()
 
-	// Wait for deletion
-	time.Sleep(3 * time.Second)
+	// Advance past DELETING once the deletion is waiting for the clock
+	require.Eventually(t, func() bool { return fake.Waiters() == 1 }, 5*time.Second, time.Millisecond)
+	fake.Advance(3 * time.Second)
 
 	// Verify job is deleted
-	resp, err = client.Get(baseURL + "/" + createdJob.Name)
-	require.NoError(t, err)
-	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
-	resp.Body.Close()
+	require.Eventually(t, func() bool {
+		resp, err := client.Get(baseURL + "/" + createdJob.Name)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusNotFound
+	}, 5*time.Second, 10*time.Millisecond)
 }
 
 func TestEndToEnd_MultipleJobs(t *testing.T) {
-	server := setupTestServer()
+	server, _ := setupTestServer()
 	defer server.Close()
 
 	client := &http.Client{Timeout: 10 * time.Second}
@@ -210,9 +209,12 @@ func TestEndToEnd_MultipleJobs(t *testing.T) {
 	// Create multiple jobs concurrently
 	numJobs := 5
 	jobNames := make([]string, numJobs)
-	
+
+	var wg sync.WaitGroup
 	for i := 0; i < numJobs; i++ {
+		wg.Add(1)
 		go func(idx int) {
+			defer wg.Done()
 			jobRequest := api.Job{
 				Priority: int32(idx * 10),
 				TaskGroups: []*api.TaskGroup{
@@ -241,7 +243,7 @@ func TestEndToEnd_MultipleJobs(t *testing.T) {
 	}
 
 	// Wait for all jobs to be created
-	time.Sleep(1 * time.Second)
+	wg.Wait()
 
 	// List all jobs
 	resp, err := client.Get(baseURL + "/projects/test-project/locations/us-central1/jobs")
@@ -255,7 +257,7 @@ func TestEndToEnd_MultipleJobs(t *testing.T) {
 }
 
 func TestEndToEnd_ErrorCases(t *testing.T) {
-	server := setupTestServer()
+	server, _ := setupTestServer()
 	defer server.Close()
 
 	client := &http.Client{Timeout: 10 * time.Second}
@@ -303,4 +305,3 @@ func TestEndToEnd_ErrorCases(t *testing.T) {
 	assert.Equal(t, http.StatusConflict, resp.StatusCode)
 	resp.Body.Close()
 }
-
@@ -0,0 +1,191 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pyshx/fake-batch-server/pkg/api"
+	"github.com/pyshx/fake-batch-server/pkg/handlers"
+	"github.com/pyshx/fake-batch-server/pkg/simulation"
+)
+
+// workflowsConnector mimics the GCP Workflows Batch connector: it submits
+// requests, decodes Google API error envelopes and polls jobs and
+// long-running operations until they finish.
+type workflowsConnector struct {
+	client   *http.Client
+	baseURL  string
+	interval time.Duration
+	timeout  time.Duration
+}
+
+// connectorError is the error the connector raises for non-2xx responses.
+type connectorError struct {
+	Code    int
+	Status  string
+	Message string
+}
+
+func (e *connectorError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Code, e.Status, e.Message)
+}
+
+func (c *workflowsConnector) call(method, path string, body, out interface{}) error {
+	var payload bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&payload).Encode(body); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, c.baseURL+path, &payload)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var errResp api.ErrorResponse
+		if err := json.NewDecoder(resp.Body).Decode(&errResp); err != nil || errResp.Error == nil {
+			return fmt.Errorf("malformed error response for status %d", resp.StatusCode)
+		}
+		return &connectorError{
+			Code:    errResp.Error.Code,
+			Status:  errResp.Error.Status,
+			Message: errResp.Error.Message,
+		}
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// createJob behaves like googleapis.batch.v1.projects.locations.jobs.create,
+// which waits for the job to reach a terminal state before returning.
+func (c *workflowsConnector) createJob(parent, jobID string, job *api.Job) (*api.Job, error) {
+	var created api.Job
+	if err := c.call("POST", "/"+parent+"/jobs?job_id="+jobID, job, &created); err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(c.timeout)
+	for time.Now().Before(deadline) {
+		var current api.Job
+		if err := c.call("GET", "/"+created.Name, nil, &current); err != nil {
+			return nil, err
+		}
+		switch current.State {
+		case api.JobStateSucceeded:
+			return &current, nil
+		case api.JobStateFailed:
+			return &current, fmt.Errorf("job %s failed", current.Name)
+		}
+		time.Sleep(c.interval)
+	}
+
+	return nil, fmt.Errorf("timed out waiting for job %s", created.Name)
+}
+
+// deleteJob behaves like googleapis.batch.v1.projects.locations.jobs.delete,
+// which polls the returned long-running operation until it is done.
+func (c *workflowsConnector) deleteJob(name string) (*api.Operation, error) {
+	var op api.Operation
+	if err := c.call("DELETE", "/"+name, nil, &op); err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(c.timeout)
+	for time.Now().Before(deadline) {
+		if op.Done {
+			if op.Error != nil {
+				return &op, fmt.Errorf("operation %s failed: %s", op.Name, op.Error.Message)
+			}
+			return &op, nil
+		}
+		time.Sleep(c.interval)
+		if err := c.call("GET", "/"+op.Name, nil, &op); err != nil {
+			return nil, err
+		}
+	}
+
+	return nil, fmt.Errorf("timed out waiting for operation %s", op.Name)
+}
+
+func setupWorkflowsConnector(t *testing.T) *workflowsConnector {
+	server := setupTestServerWithConfig(handlers.Config{
+		Timings: simulation.Timings{States: map[api.JobState]time.Duration{
+			api.JobStateQueued:    50 * time.Millisecond,
+			api.JobStateScheduled: 50 * time.Millisecond,
+			api.JobStateRunning:   50 * time.Millisecond,
+			api.JobStateDeleting:  50 * time.Millisecond,
+		}},
+	})
+	t.Cleanup(server.Close)
+
+	return &workflowsConnector{
+		client:   &http.Client{Timeout: 10 * time.Second},
+		baseURL:  server.URL + "/v1",
+		interval: 10 * time.Millisecond,
+		timeout:  5 * time.Second,
+	}
+}
+
+func TestWorkflowsConnector_CreateAndDelete(t *testing.T) {
+	connector := setupWorkflowsConnector(t)
+	parent := "projects/test-project/locations/us-central1"
+
+	job, err := connector.createJob(parent, "workflow-job", &api.Job{
+		TaskGroups: []*api.TaskGroup{{Name: "group0", TaskSpec: &api.TaskSpec{}, TaskCount: 2}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, api.JobStateSucceeded, job.State)
+
+	op, err := connector.deleteJob(job.Name)
+	require.NoError(t, err)
+	assert.True(t, op.Done)
+	assert.Contains(t, op.Name, parent+"/operations/")
+	require.NotNil(t, op.Metadata)
+	assert.Equal(t, job.Name, op.Metadata.Target)
+	assert.Equal(t, "delete", op.Metadata.Verb)
+	assert.NotNil(t, op.Metadata.EndTime)
+
+	var deleted api.Job
+	err = connector.call("GET", "/"+job.Name, nil, &deleted)
+	var connErr *connectorError
+	require.ErrorAs(t, err, &connErr)
+	assert.Equal(t, http.StatusNotFound, connErr.Code)
+	assert.Equal(t, "NOT_FOUND", connErr.Status)
+}
+
+func TestWorkflowsConnector_ErrorShapes(t *testing.T) {
+	connector := setupWorkflowsConnector(t)
+	parent := "projects/test-project/locations/us-central1"
+	job := &api.Job{TaskGroups: []*api.TaskGroup{{Name: "group0", TaskSpec: &api.TaskSpec{}, TaskCount: 1}}}
+
+	var created api.Job
+	require.NoError(t, connector.call("POST", "/"+parent+"/jobs?job_id=dup", job, &created))
+
+	err := connector.call("POST", "/"+parent+"/jobs?job_id=dup", job, &created)
+	var connErr *connectorError
+	require.ErrorAs(t, err, &connErr)
+	assert.Equal(t, http.StatusConflict, connErr.Code)
+	assert.Equal(t, "ALREADY_EXISTS", connErr.Status)
+	assert.NotEmpty(t, connErr.Message)
+
+	var op api.Operation
+	err = connector.call("GET", "/"+parent+"/operations/missing", nil, &op)
+	require.ErrorAs(t, err, &connErr)
+	assert.Equal(t, "NOT_FOUND", connErr.Status)
+}